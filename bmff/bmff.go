@@ -0,0 +1,245 @@
+// Package bmff implements just enough of the ISO base media file format
+// (ISO/IEC 14496-12) to produce fragmented MP4, as used both by disk
+// recordings and by CMAF segments for HLS.
+package bmff
+
+import (
+	"encoding/binary"
+
+	gcodecs "github.com/jech/galene/codecs"
+)
+
+// Box returns an ISO BMFF box with the given type and contents.
+func Box(typ string, contents ...[]byte) []byte {
+	size := 8
+	for _, c := range contents {
+		size += len(c)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:8], typ)
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// FullBox returns a box with a version and flags.
+func FullBox(typ string, version uint8, flags uint32, contents ...[]byte) []byte {
+	vf := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return Box(typ, append([][]byte{vf}, contents...)...)
+}
+
+func U16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func U32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func U64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+var unityMatrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// MovieHeader returns an mvhd box with a timescale of 1000.  Tracks are
+// numbered from 1, and nextTrack is one more than the number of tracks.
+func MovieHeader(nextTrack uint32) []byte {
+	mvhd := make([]byte, 96)
+	binary.BigEndian.PutUint32(mvhd[8:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 0x00010000)
+	binary.BigEndian.PutUint16(mvhd[20:], 0x0100)
+	copy(mvhd[32:], unityMatrix)
+	binary.BigEndian.PutUint32(mvhd[92:], nextTrack)
+	return FullBox("mvhd", 0, 0, mvhd)
+}
+
+// TrackExtends returns a trex box with default values for the given
+// track.
+func TrackExtends(id uint32) []byte {
+	return FullBox("trex", 0, 0, U32(id), U32(1), U32(0), U32(0), U32(0))
+}
+
+// VisualSampleEntry returns a sample entry of the given type for video,
+// followed by the given codec configuration box.
+func VisualSampleEntry(typ string, width, height uint32, config []byte) []byte {
+	b := make([]byte, 78)
+	binary.BigEndian.PutUint16(b[6:], 1) // data_reference_index
+	binary.BigEndian.PutUint16(b[24:], uint16(width))
+	binary.BigEndian.PutUint16(b[26:], uint16(height))
+	binary.BigEndian.PutUint32(b[28:], 0x00480000)
+	binary.BigEndian.PutUint32(b[32:], 0x00480000)
+	binary.BigEndian.PutUint16(b[40:], 1) // frame_count
+	binary.BigEndian.PutUint16(b[74:], 0x0018)
+	binary.BigEndian.PutUint16(b[76:], 0xFFFF)
+	return Box(typ, b, config)
+}
+
+// AVCConfig returns an AVCDecoderConfigurationRecord, as defined in
+// ISO/IEC 14496-15.
+func AVCConfig(sps, pps []byte, info *gcodecs.SPSInfo) []byte {
+	b := []byte{
+		1, info.Profile, info.Compatibility, info.Level,
+		0xFF, // four-byte lengths
+		0xE1, // one SPS
+	}
+	b = append(b, U16(uint16(len(sps)))...)
+	b = append(b, sps...)
+	b = append(b, 1)
+	b = append(b, U16(uint16(len(pps)))...)
+	b = append(b, pps...)
+	if gcodecs.HasChromaInfo(info.Profile) {
+		b = append(b,
+			0xFC|byte(info.ChromaFormat),
+			0xF8|byte(info.BitDepthLuma),
+			0xF8|byte(info.BitDepthChroma),
+			0,
+		)
+	}
+	return b
+}
+
+// AVC1 returns a sample entry for H.264 with the given parameter sets.
+func AVC1(width, height uint32, sps, pps []byte, info *gcodecs.SPSInfo) []byte {
+	return VisualSampleEntry(
+		"avc1", width, height, Box("avcC", AVCConfig(sps, pps, info)),
+	)
+}
+
+// Opus returns a sample entry for Opus, as defined in "Encapsulation of
+// Opus in ISO Base Media File Format".
+func Opus(channels uint16) []byte {
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint16(b[6:], 1) // data_reference_index
+	binary.BigEndian.PutUint16(b[16:], channels)
+	binary.BigEndian.PutUint16(b[18:], 16)
+	binary.BigEndian.PutUint32(b[24:], 48000<<16)
+	dOps := []byte{
+		0,              // version
+		byte(channels), // output channel count
+		0, 0,           // pre-skip
+		0, 0, 0xBB, 0x80, // input sample rate
+		0, 0, // output gain
+		0, // channel mapping family
+	}
+	return Box("Opus", b, Box("dOps", dOps))
+}
+
+// Track returns a trak box with no samples, which are carried by the
+// fragments.
+func Track(id uint32, timescale uint32, audio bool, width, height uint32, entry []byte) []byte {
+	tkhd := make([]byte, 80)
+	binary.BigEndian.PutUint32(tkhd[8:], id)
+	if audio {
+		binary.BigEndian.PutUint16(tkhd[32:], 0x0100)
+	}
+	copy(tkhd[36:], unityMatrix)
+	binary.BigEndian.PutUint32(tkhd[72:], width<<16)
+	binary.BigEndian.PutUint32(tkhd[76:], height<<16)
+
+	mdhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mdhd[8:], timescale)
+	binary.BigEndian.PutUint16(mdhd[16:], 0x55C4) // "und"
+
+	hdlr := make([]byte, 20)
+	name := "VideoHandler\x00"
+	var header []byte
+	if audio {
+		copy(hdlr[4:], "soun")
+		name = "SoundHandler\x00"
+		header = FullBox("smhd", 0, 0, make([]byte, 4))
+	} else {
+		copy(hdlr[4:], "vide")
+		header = FullBox("vmhd", 0, 1, make([]byte, 8))
+	}
+
+	dref := FullBox("dref", 0, 0, U32(1), FullBox("url ", 0, 1))
+	empty := U32(0)
+	stbl := Box("stbl",
+		FullBox("stsd", 0, 0, U32(1), entry),
+		FullBox("stts", 0, 0, empty),
+		FullBox("stsc", 0, 0, empty),
+		FullBox("stsz", 0, 0, empty, empty),
+		FullBox("stco", 0, 0, empty),
+	)
+
+	return Box("trak",
+		FullBox("tkhd", 0, 3, tkhd),
+		Box("mdia",
+			FullBox("mdhd", 0, 0, mdhd),
+			FullBox("hdlr", 0, 0, hdlr, []byte(name)),
+			Box("minf", header, Box("dinf", dref), stbl),
+		),
+	)
+}
+
+// A Sample is a single frame of media.  The timestamp and the duration
+// are in the timescale of the track.
+type Sample struct {
+	Data     []byte
+	DTS      int64
+	Duration uint32
+	Keyframe bool
+}
+
+const (
+	flagsKeyframe    = 0x02000000
+	flagsNonKeyframe = 0x01010000
+)
+
+// A Run is the samples of a single track within a fragment.
+type Run struct {
+	ID      uint32
+	Samples []Sample
+}
+
+func traf(r *Run, offset uint32) []byte {
+	entries := make([]byte, 0, len(r.Samples)*12)
+	for _, s := range r.Samples {
+		flags := uint32(flagsNonKeyframe)
+		if s.Keyframe {
+			flags = flagsKeyframe
+		}
+		entries = append(entries, U32(s.Duration)...)
+		entries = append(entries, U32(uint32(len(s.Data)))...)
+		entries = append(entries, U32(flags)...)
+	}
+	return Box("traf",
+		FullBox("tfhd", 0, 0x020000, U32(r.ID)),
+		FullBox("tfdt", 1, 0, U64(uint64(r.Samples[0].DTS))),
+		FullBox("trun", 0, 0x000701,
+			U32(uint32(len(r.Samples))), U32(offset), entries,
+		),
+	)
+}
+
+// Fragment returns a fragment (moof and mdat) containing the given runs,
+// none of which may be empty.
+func Fragment(seqno uint32, runs []*Run) []byte {
+	moof := func(offsets []uint32) []byte {
+		contents := [][]byte{FullBox("mfhd", 0, 0, U32(seqno))}
+		for i, r := range runs {
+			contents = append(contents, traf(r, offsets[i]))
+		}
+		return Box("moof", contents...)
+	}
+
+	// the size of the moof doesn't depend on the offsets
+	offsets := make([]uint32, len(runs))
+	offset := uint32(len(moof(offsets))) + 8
+	var data [][]byte
+	for i, r := range runs {
+		offsets[i] = offset
+		for _, s := range r.Samples {
+			data = append(data, s.Data)
+			offset += uint32(len(s.Data))
+		}
+	}
+	return append(moof(offsets), Box("mdat", data...)...)
+}
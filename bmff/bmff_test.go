@@ -0,0 +1,125 @@
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+var containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true,
+	"dinf": true, "stbl": true, "mvex": true, "moof": true,
+	"traf": true,
+}
+
+// walk calls f for every box in data, with the path of the box, its
+// offset and its contents.
+func walk(t *testing.T, data []byte, prefix string, offset int, f func(string, int, []byte)) {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("%v: truncated box header", prefix)
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("%v: bad box size %v", prefix, size)
+		}
+		typ := string(data[4:8])
+		path := prefix + "/" + typ
+		f(path, offset, data[8:size])
+		if containers[typ] {
+			walk(t, data[8:size], path, offset+8, f)
+		}
+		data = data[size:]
+		offset += size
+	}
+}
+
+func TestBox(t *testing.T) {
+	b := FullBox("test", 1, 0x020304, []byte{5}, []byte{6, 7})
+	expected := []byte{0, 0, 0, 15, 't', 'e', 's', 't', 1, 2, 3, 4, 5, 6, 7}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("Expected %v, got %v", expected, b)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	paths := make(map[string]int)
+	walk(t, Track(3, 48000, true, 0, 0, Opus(2)), "", 0,
+		func(path string, offset int, contents []byte) {
+			paths[path]++
+			switch path {
+			case "/trak/tkhd":
+				if binary.BigEndian.Uint32(contents[12:]) != 3 {
+					t.Errorf("Bad track id")
+				}
+			case "/trak/mdia/hdlr":
+				if string(contents[8:12]) != "soun" {
+					t.Errorf("Bad handler")
+				}
+			case "/trak/mdia/minf/stbl/stsd":
+				if !bytes.Contains(contents, []byte("dOps")) {
+					t.Errorf("Bad sample description")
+				}
+			}
+		},
+	)
+	for _, p := range []string{
+		"/trak/tkhd", "/trak/mdia/mdhd", "/trak/mdia/hdlr",
+		"/trak/mdia/minf/smhd", "/trak/mdia/minf/stbl/stsd",
+	} {
+		if paths[p] != 1 {
+			t.Errorf("Missing box %v", p)
+		}
+	}
+}
+
+func TestFragment(t *testing.T) {
+	runs := []*Run{
+		{ID: 1, Samples: []Sample{
+			{Data: []byte{1, 2, 3}, DTS: 9000, Duration: 3000,
+				Keyframe: true},
+			{Data: []byte{4, 5}, DTS: 12000, Duration: 3000},
+		}},
+		{ID: 2, Samples: []Sample{
+			{Data: []byte{6}, DTS: 4800, Duration: 960,
+				Keyframe: true},
+		}},
+	}
+	data := Fragment(42, runs)
+
+	var moof int
+	var offsets []int
+	var mdat []byte
+	var mdatOffset int
+	walk(t, data, "", 0, func(path string, offset int, contents []byte) {
+		switch path {
+		case "/moof":
+			moof = offset
+		case "/moof/mfhd":
+			if binary.BigEndian.Uint32(contents[4:]) != 42 {
+				t.Errorf("Bad sequence number")
+			}
+		case "/moof/traf/tfdt":
+			if contents[0] != 1 {
+				t.Errorf("Expected version 1 tfdt")
+			}
+		case "/moof/traf/trun":
+			offsets = append(offsets,
+				int(binary.BigEndian.Uint32(contents[8:])))
+		case "/mdat":
+			mdat = contents
+			mdatOffset = offset + 8
+		}
+	})
+	if !strings.HasPrefix(string(data[4:8]), "moof") || moof != 0 {
+		t.Fatalf("Fragment doesn't start with moof")
+	}
+	if !bytes.Equal(mdat, []byte{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("Bad mdat %v", mdat)
+	}
+	if len(offsets) != 2 || offsets[0] != mdatOffset ||
+		offsets[1] != mdatOffset+5 {
+		t.Errorf("Bad data offsets %v (mdat at %v)", offsets, mdatOffset)
+	}
+}
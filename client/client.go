@@ -0,0 +1,644 @@
+// Package client implements a client for Galene's protocol, as described
+// in README.PROTOCOL.  It doesn't depend on the server, and is suitable
+// for writing bots, bridges and tests.
+package client
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// ErrClosed is returned when using a client that has been closed.
+var ErrClosed = errors.New("client closed")
+
+// A RedirectError is returned by Join when the group is served at
+// a different URL, for example by another instance of a cluster.
+type RedirectError struct {
+	URL string
+}
+
+func (err *RedirectError) Error() string {
+	return "group redirected to " + err.URL
+}
+
+// Handlers are called when the client receives a message from the
+// server.  Except for Track and KeyframeRequest, they are called in
+// order from the goroutine that reads from the server, and must not
+// block; they may call the methods of the client other than Close.  Any
+// of them may be nil.
+type Handlers struct {
+	Joined      func(j Joined)
+	User        func(e UserEvent)
+	Chat        func(m Chat)
+	UserMessage func(m UserMessage)
+	// Stream is called when the server offers a new stream.  The
+	// stream is refused if Stream returns false.  If Stream is nil,
+	// all streams are accepted.
+	Stream func(s *RemoteStream) bool
+	// Track is called from its own goroutine when a track is received
+	// on a stream.  It may block, typically while reading the track.
+	Track func(s *RemoteStream, t *webrtc.TrackRemote, r *webrtc.RTPReceiver)
+	// StreamClosed is called when a remote stream is closed by the
+	// server, replaced by another stream, or closed because
+	// negotiation failed.
+	StreamClosed func(s *RemoteStream)
+	// KeyframeRequest is called from its own goroutine when the
+	// server requests a keyframe on a track sent by the client.
+	KeyframeRequest func(s *LocalStream, t webrtc.TrackLocal)
+}
+
+// Config is the configuration of a client.
+type Config struct {
+	// the credentials used for joining a group; either Password or
+	// Token may be empty
+	Username string
+	Password string
+	Token    string
+	// the HTTP client used for requesting the group status; if nil,
+	// http.DefaultClient is used
+	HTTPClient *http.Client
+	// the WebSocket dialer; if nil, websocket.DefaultDialer is used
+	Dialer *websocket.Dialer
+	// the API used for creating peer connections; if nil, the
+	// default API of pion/webrtc is used
+	API *webrtc.API
+	// NewPeerConnection, if not nil, creates the peer connection of
+	// a remote stream instead of API, given the server's offer.  It
+	// may set its own OnTrack handler, in which case Handlers.Track
+	// must be nil.
+	NewPeerConnection func(s *RemoteStream, offer string) (*webrtc.PeerConnection, error)
+	// how long to wait for the server; defaults to 30 seconds
+	Timeout  time.Duration
+	Handlers Handlers
+}
+
+// A Client is a connection to a Galene server.
+type Client struct {
+	id     string
+	config Config
+	ws     *websocket.Conn
+	done   chan struct{}
+
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	closed      bool
+	err         error
+	group       string
+	username    string
+	permissions []string
+	rtcConfig   webrtc.Configuration
+	users       map[string]User
+	joinCh      chan Joined
+	up          map[string]*LocalStream
+	down        map[string]*RemoteStream
+	// the callers of Ping waiting for a pong, in order
+	pingChs []chan struct{}
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// GetStatus returns the status of the group at the given URL, which
+// contains the group's name and its WebSocket endpoint.
+func GetStatus(client *http.Client, groupURL string) (*Status, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u, err := url.Parse(groupURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path = u.Path + "/"
+	}
+	u = u.ResolveReference(&url.URL{Path: ".status"})
+
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	var status Status
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return nil, err
+	}
+	if status.Name == "" || status.Endpoint == "" {
+		return nil, errors.New("incomplete group status")
+	}
+	return &status, nil
+}
+
+// Connect connects to the server hosting the group at the given URL,
+// and joins the group.
+func Connect(groupURL string, config Config) (*Client, error) {
+	status, err := GetStatus(config.HTTPClient, groupURL)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Dial(status.Endpoint, config)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Join(status.Name)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dial connects to the server at the given WebSocket endpoint and
+// performs the protocol handshake.  The client must then join a group.
+func Dial(endpoint string, config Config) (*Client, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	dialer := config.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	ws, _, err := dialer.Dial(endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		id:       newId(),
+		config:   config,
+		ws:       ws,
+		done:     make(chan struct{}),
+		username: config.Username,
+		users:    make(map[string]User),
+		up:       make(map[string]*LocalStream),
+		down:     make(map[string]*RemoteStream),
+	}
+	err = c.Send(Message{
+		Type:    "handshake",
+		Version: []string{"2"},
+		Id:      c.id,
+	})
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// Id returns the client's id, which identifies it to the other clients.
+func (c *Client) Id() string {
+	return c.id
+}
+
+// Group returns the name of the current group.
+func (c *Client) Group() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.group
+}
+
+// Username returns the username assigned by the server.
+func (c *Client) Username() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.username
+}
+
+// Permissions returns the client's permissions in the current group.
+func (c *Client) Permissions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.permissions...)
+}
+
+// Users returns the members of the current group, indexed by id.
+func (c *Client) Users() map[string]User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	users := make(map[string]User, len(c.users))
+	for id, u := range c.users {
+		users[id] = u
+	}
+	return users
+}
+
+// Done returns a channel that is closed when the connection to the
+// server has terminated.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason why the connection terminated, or nil if it is
+// still running or was closed by Close.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Send sends a raw message to the server.
+func (c *Client) Send(m Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(c.config.Timeout))
+	return c.ws.WriteJSON(m)
+}
+
+// Join joins a group, and waits until the server has replied.
+func (c *Client) Join(group string) error {
+	ch := make(chan Joined, 1)
+	c.mu.Lock()
+	c.joinCh = ch
+	c.mu.Unlock()
+
+	m := Message{
+		Type:     "join",
+		Kind:     "join",
+		Group:    group,
+		Password: c.config.Password,
+		Token:    c.config.Token,
+	}
+	if c.config.Username != "" {
+		username := c.config.Username
+		m.Username = &username
+	}
+	err := c.Send(m)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(c.config.Timeout)
+	defer timer.Stop()
+	select {
+	case j := <-ch:
+		if j.Kind == "fail" {
+			if j.Value == "" {
+				return errors.New("join failed")
+			}
+			return errors.New(j.Value)
+		}
+		if j.Kind == "redirect" {
+			return &RedirectError{URL: j.Value}
+		}
+		return nil
+	case <-c.done:
+		if err := c.Err(); err != nil {
+			return err
+		}
+		return ErrClosed
+	case <-timer.C:
+		return errors.New("timeout waiting for server")
+	}
+}
+
+// Ping sends a ping to the server and waits for the reply.  Since the
+// server processes messages in order, any replies to the messages sent
+// before, including errors, have been passed to the handlers by the time
+// Ping returns.
+func (c *Client) Ping() error {
+	ch := make(chan struct{})
+	c.mu.Lock()
+	c.pingChs = append(c.pingChs, ch)
+	c.mu.Unlock()
+
+	err := c.Send(Message{Type: "ping"})
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(c.config.Timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-c.done:
+		if err := c.Err(); err != nil {
+			return err
+		}
+		return ErrClosed
+	case <-timer.C:
+		return errors.New("timeout waiting for server")
+	}
+}
+
+// Leave leaves the current group.
+func (c *Client) Leave() error {
+	c.mu.Lock()
+	group := c.group
+	c.mu.Unlock()
+	return c.Send(Message{
+		Type:  "join",
+		Kind:  "leave",
+		Group: group,
+	})
+}
+
+// Chat sends a chat message.  If dest is empty, the message is sent to
+// the whole group.  Kind is usually empty, or "me" for actions.
+func (c *Client) Chat(dest, kind, value string) error {
+	username := c.Username()
+	return c.Send(Message{
+		Type:     "chat",
+		Source:   c.id,
+		Dest:     dest,
+		Username: &username,
+		Kind:     kind,
+		Value:    value,
+	})
+}
+
+// UserMessage sends a user message to the given client, or to the
+// whole group if dest is empty.
+func (c *Client) UserMessage(kind, dest string, value interface{}) error {
+	username := c.Username()
+	return c.Send(Message{
+		Type:     "usermessage",
+		Source:   c.id,
+		Dest:     dest,
+		Username: &username,
+		Kind:     kind,
+		Value:    value,
+	})
+}
+
+// UserAction requests that an action be performed on a user, for
+// example "op" or "kick".
+func (c *Client) UserAction(kind, dest string, value interface{}) error {
+	username := c.Username()
+	return c.Send(Message{
+		Type:     "useraction",
+		Source:   c.id,
+		Dest:     dest,
+		Username: &username,
+		Kind:     kind,
+		Value:    value,
+	})
+}
+
+// GroupAction requests that an action be performed on the group, for
+// example "lock" or "record".
+func (c *Client) GroupAction(kind string, value interface{}) error {
+	username := c.Username()
+	return c.Send(Message{
+		Type:     "groupaction",
+		Source:   c.id,
+		Username: &username,
+		Kind:     kind,
+		Value:    value,
+	})
+}
+
+// Request indicates which streams the client wishes to receive.  It
+// maps labels to lists of track kinds, the empty label matching all
+// labels, for example {"": {"audio", "video"}}.
+func (c *Client) Request(request map[string][]string) error {
+	return c.Send(Message{
+		Type:    "request",
+		Request: request,
+	})
+}
+
+// Close closes the connection to the server, as well as all streams,
+// and waits for the client to terminate.  It is safe to call Close
+// multiple times.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.writeMu.Lock()
+	select {
+	case <-c.done:
+	default:
+		c.ws.Close()
+	}
+	c.writeMu.Unlock()
+	<-c.done
+	return nil
+}
+
+func (c *Client) readLoop() {
+	var err error
+	for {
+		var m Message
+		err = c.ws.ReadJSON(&m)
+		if err != nil {
+			break
+		}
+		err = c.handle(&m)
+		if err != nil {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	if !c.closed {
+		c.err = err
+	}
+	// nil maps indicate that the client has terminated
+	up := c.up
+	c.up = nil
+	down := c.down
+	c.down = nil
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	c.ws.Close()
+	close(c.done)
+	c.writeMu.Unlock()
+
+	for _, s := range up {
+		s.terminate()
+	}
+	for _, s := range down {
+		s.pc.Close()
+	}
+}
+
+func (c *Client) handle(m *Message) error {
+	h := &c.config.Handlers
+	switch m.Type {
+	case "handshake":
+	case "pong":
+		c.mu.Lock()
+		if len(c.pingChs) > 0 {
+			close(c.pingChs[0])
+			c.pingChs = c.pingChs[1:]
+		}
+		c.mu.Unlock()
+	case "ping":
+		return c.Send(Message{Type: "pong"})
+	case "joined":
+		j := Joined{
+			Kind:        m.Kind,
+			Group:       m.Group,
+			Username:    username(m),
+			Permissions: m.Permissions,
+			Status:      m.Status,
+			Error:       m.Error,
+			Value:       toString(m.Value),
+		}
+		c.mu.Lock()
+		switch m.Kind {
+		case "join", "change":
+			c.group = m.Group
+			c.username = j.Username
+			c.permissions = m.Permissions
+			if m.RTCConfiguration != nil {
+				c.rtcConfig = *m.RTCConfiguration
+			}
+		case "leave":
+			c.group = ""
+			c.permissions = nil
+			c.users = make(map[string]User)
+		}
+		ch := c.joinCh
+		if m.Kind == "join" || m.Kind == "fail" ||
+			m.Kind == "redirect" {
+			c.joinCh = nil
+		} else {
+			ch = nil
+		}
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- j
+		}
+		if h.Joined != nil {
+			h.Joined(j)
+		}
+	case "user":
+		u := User{
+			Id:          m.Id,
+			Username:    username(m),
+			Permissions: m.Permissions,
+			Data:        m.Data,
+		}
+		c.mu.Lock()
+		if m.Kind == "delete" {
+			delete(c.users, m.Id)
+		} else {
+			c.users[m.Id] = u
+		}
+		c.mu.Unlock()
+		if h.User != nil {
+			h.User(UserEvent{Kind: m.Kind, User: u})
+		}
+	case "chat", "chathistory":
+		if h.Chat != nil {
+			h.Chat(Chat{
+				Source:     m.Source,
+				Username:   username(m),
+				Dest:       m.Dest,
+				Privileged: m.Privileged,
+				Time:       parseTime(m.Time),
+				Kind:       m.Kind,
+				Value:      toString(m.Value),
+				History:    m.Type == "chathistory",
+			})
+		}
+	case "usermessage":
+		if h.UserMessage != nil {
+			h.UserMessage(UserMessage{
+				Source:     m.Source,
+				Username:   username(m),
+				Dest:       m.Dest,
+				Privileged: m.Privileged,
+				Kind:       m.Kind,
+				Error:      m.Error,
+				Value:      m.Value,
+			})
+		}
+	case "offer":
+		return c.gotOffer(m)
+	case "answer":
+		s := c.getUp(m.Id)
+		if s != nil {
+			err := s.pc.SetRemoteDescription(webrtc.SessionDescription{
+				Type: webrtc.SDPTypeAnswer,
+				SDP:  m.SDP,
+			})
+			if err != nil {
+				return s.close()
+			}
+		}
+	case "renegotiate":
+		s := c.getUp(m.Id)
+		if s != nil {
+			err := s.negotiate(true)
+			if err != nil {
+				return s.close()
+			}
+		}
+	case "ice":
+		if m.Candidate == nil {
+			return nil
+		}
+		var pc *webrtc.PeerConnection
+		if s := c.getUp(m.Id); s != nil {
+			pc = s.pc
+		} else if s := c.getDown(m.Id); s != nil {
+			pc = s.pc
+		}
+		if pc != nil {
+			// failing to add a candidate is not fatal
+			pc.AddICECandidate(*m.Candidate)
+		}
+	case "close":
+		c.closeDown(m.Id)
+	case "abort":
+		s := c.getUp(m.Id)
+		if s != nil {
+			return s.close()
+		}
+	}
+	return nil
+}
+
+func (c *Client) newPC(trickle func(webrtc.ICECandidateInit)) (*webrtc.PeerConnection, error) {
+	c.mu.Lock()
+	conf := c.rtcConfig
+	c.mu.Unlock()
+
+	var pc *webrtc.PeerConnection
+	var err error
+	if c.config.API != nil {
+		pc, err = c.config.API.NewPeerConnection(conf)
+	} else {
+		pc, err = webrtc.NewPeerConnection(conf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	onCandidate(pc, trickle)
+	return pc, nil
+}
+
+func onCandidate(pc *webrtc.PeerConnection, trickle func(webrtc.ICECandidateInit)) {
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			trickle(candidate.ToJSON())
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"encoding/json"
+	"go/build"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The client must be usable without pulling in the server.
+func TestImports(t *testing.T) {
+	pkg, err := build.ImportDir(".", 0)
+	if err != nil {
+		t.Fatalf("ImportDir: %v", err)
+	}
+	for _, p := range pkg.Imports {
+		if strings.HasPrefix(p, "github.com/jech/galene") {
+			t.Errorf("Client imports %v", p)
+		}
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/group/test/.status" {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(Status{
+				Name:     "test",
+				Endpoint: "ws://localhost/ws",
+			})
+		},
+	))
+	defer server.Close()
+
+	for _, u := range []string{"/group/test/", "/group/test"} {
+		status, err := GetStatus(server.Client(), server.URL+u)
+		if err != nil || status.Name != "test" ||
+			status.Endpoint != "ws://localhost/ws" {
+			t.Errorf("%v: got %v, %v", u, status, err)
+		}
+	}
+
+	_, err := GetStatus(server.Client(), server.URL+"/group/other/")
+	if err == nil {
+		t.Errorf("Expected error")
+	}
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Message is a protocol message, as described in README.PROTOCOL.
+type Message struct {
+	Type             string                   `json:"type"`
+	Version          []string                 `json:"version,omitempty"`
+	Features         []string                 `json:"features,omitempty"`
+	Kind             string                   `json:"kind,omitempty"`
+	Error            string                   `json:"error,omitempty"`
+	Field            string                   `json:"field,omitempty"`
+	Id               string                   `json:"id,omitempty"`
+	Replace          string                   `json:"replace,omitempty"`
+	Source           string                   `json:"source,omitempty"`
+	Dest             string                   `json:"dest,omitempty"`
+	Username         *string                  `json:"username,omitempty"`
+	Password         string                   `json:"password,omitempty"`
+	Token            string                   `json:"token,omitempty"`
+	Privileged       bool                     `json:"privileged,omitempty"`
+	Remote           bool                     `json:"remote,omitempty"`
+	Permissions      []string                 `json:"permissions,omitempty"`
+	Status           *Status                  `json:"status,omitempty"`
+	Data             map[string]interface{}   `json:"data,omitempty"`
+	Group            string                   `json:"group,omitempty"`
+	Value            interface{}              `json:"value,omitempty"`
+	NoEcho           bool                     `json:"noecho,omitempty"`
+	Time             string                   `json:"time,omitempty"`
+	SDP              string                   `json:"sdp,omitempty"`
+	Candidate        *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	Label            string                   `json:"label,omitempty"`
+	Request          interface{}              `json:"request,omitempty"`
+	RTCConfiguration *webrtc.Configuration    `json:"rtcConfiguration,omitempty"`
+}
+
+// Status is the public status of a group.
+type Status struct {
+	Name        string `json:"name"`
+	Redirect    string `json:"redirect,omitempty"`
+	Location    string `json:"location,omitempty"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+	Description string `json:"description,omitempty"`
+	AuthServer  string `json:"authServer,omitempty"`
+	AuthPortal  string `json:"authPortal,omitempty"`
+	Locked      bool   `json:"locked,omitempty"`
+	ClientCount *int   `json:"clientCount,omitempty"`
+}
+
+// Joined is sent by the server when the client joins or leaves a group,
+// when joining fails, and when the client's permissions change.
+type Joined struct {
+	// one of "join", "fail", "change" or "leave"
+	Kind        string
+	Group       string
+	Username    string
+	Permissions []string
+	Status      *Status
+	// for kind "fail", the reason why joining failed
+	Error string
+	Value string
+}
+
+// User is a member of the group.
+type User struct {
+	Id          string
+	Username    string
+	Permissions []string
+	Data        map[string]interface{}
+}
+
+// UserEvent indicates that a user has been added to the group, changed,
+// or removed from the group.
+type UserEvent struct {
+	// one of "add", "change" or "delete"
+	Kind string
+	User
+}
+
+// Chat is a chat message.  History is true if the message was sent
+// before the client joined.
+type Chat struct {
+	Source     string
+	Username   string
+	Dest       string
+	Privileged bool
+	Time       time.Time
+	Kind       string
+	Value      string
+	History    bool
+}
+
+// UserMessage is a message that is not displayed in the chat, such as
+// an error or a file transfer request.
+type UserMessage struct {
+	Source     string
+	Username   string
+	Dest       string
+	Privileged bool
+	Kind       string
+	Error      string
+	Value      interface{}
+}
+
+func username(m *Message) string {
+	if m.Username == nil {
+		return ""
+	}
+	return *m.Username
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,358 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// A LocalStream is a stream sent by the client to the server.
+type LocalStream struct {
+	Id    string
+	Label string
+
+	client *Client
+	pc     *webrtc.PeerConnection
+	done   chan struct{}
+
+	mu sync.Mutex
+	// candidates gathered before the offer was sent
+	pending []webrtc.ICECandidateInit
+	offered bool
+	closed  bool
+}
+
+// A RemoteStream is a stream sent by the server to the client.
+type RemoteStream struct {
+	Id    string
+	Label string
+	// the id and username of the client that is sending the stream
+	Source   string
+	Username string
+
+	client *Client
+	pc     *webrtc.PeerConnection
+}
+
+// Publish sends the given tracks to the server, in a stream with the
+// given label (usually "camera" or "screenshare").
+func (c *Client) Publish(label string, tracks ...webrtc.TrackLocal) (*LocalStream, error) {
+	s := &LocalStream{
+		Id:     newId(),
+		Label:  label,
+		client: c,
+		done:   make(chan struct{}),
+	}
+	pc, err := c.newPC(s.gotCandidate)
+	if err != nil {
+		return nil, err
+	}
+	s.pc = pc
+
+	for _, t := range tracks {
+		tr, err := pc.AddTransceiverFromTrack(t,
+			webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionSendonly,
+			},
+		)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		go s.readRTCP(tr.Sender(), t)
+	}
+
+	c.mu.Lock()
+	if c.up == nil {
+		c.mu.Unlock()
+		pc.Close()
+		return nil, ErrClosed
+	}
+	c.up[s.Id] = s
+	c.mu.Unlock()
+
+	err = s.negotiate(false)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// readRTCP reads the RTCP packets sent by the server, which is
+// required for the interceptors to work, and passes keyframe requests
+// to the KeyframeRequest handler.
+func (s *LocalStream) readRTCP(sender *webrtc.RTPSender, t webrtc.TrackLocal) {
+	for {
+		ps, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		h := s.client.config.Handlers.KeyframeRequest
+		if h == nil {
+			continue
+		}
+		for _, p := range ps {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				h(s, t)
+			}
+		}
+	}
+}
+
+// PeerConnection returns the peer connection that carries the stream.
+func (s *LocalStream) PeerConnection() *webrtc.PeerConnection {
+	return s.pc
+}
+
+// Done returns a channel that is closed when the stream is closed,
+// either by the client or by the server.
+func (s *LocalStream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *LocalStream) gotCandidate(candidate webrtc.ICECandidateInit) {
+	s.mu.Lock()
+	if !s.offered {
+		// the server doesn't know about the stream yet
+		s.pending = append(s.pending, candidate)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	s.client.Send(Message{
+		Type:      "ice",
+		Id:        s.Id,
+		Candidate: &candidate,
+	})
+}
+
+// negotiate sends an offer to the server.
+func (s *LocalStream) negotiate(restartIce bool) error {
+	offer, err := s.pc.CreateOffer(&webrtc.OfferOptions{
+		ICERestart: restartIce,
+	})
+	if err != nil {
+		return err
+	}
+	err = s.pc.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+	username := s.client.Username()
+	err = s.client.Send(Message{
+		Type:     "offer",
+		Id:       s.Id,
+		Label:    s.Label,
+		Username: &username,
+		SDP:      s.pc.LocalDescription().SDP,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.offered = true
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	for _, candidate := range pending {
+		candidate := candidate
+		err := s.client.Send(Message{
+			Type:      "ice",
+			Id:        s.Id,
+			Candidate: &candidate,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// terminate closes the peer connection without notifying the server.
+func (s *LocalStream) terminate() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.pc.Close()
+	close(s.done)
+}
+
+// close closes the stream and notifies the server.
+func (s *LocalStream) close() error {
+	c := s.client
+	c.mu.Lock()
+	found := c.up[s.Id] == s
+	if found {
+		delete(c.up, s.Id)
+	}
+	c.mu.Unlock()
+	s.terminate()
+	if !found {
+		return nil
+	}
+	return c.Send(Message{Type: "close", Id: s.Id})
+}
+
+// Close stops sending the stream.
+func (s *LocalStream) Close() error {
+	err := s.close()
+	if err == ErrClosed {
+		return nil
+	}
+	return err
+}
+
+// PeerConnection returns the peer connection that carries the stream.
+func (s *RemoteStream) PeerConnection() *webrtc.PeerConnection {
+	return s.pc
+}
+
+// RequestTracks indicates which tracks of the stream the client wishes
+// to receive, for example "audio", "video" or "video-low".
+func (s *RemoteStream) RequestTracks(kinds ...string) error {
+	if kinds == nil {
+		kinds = []string{}
+	}
+	return s.client.Send(Message{
+		Type:    "requestStream",
+		Id:      s.Id,
+		Request: kinds,
+	})
+}
+
+// Close asks the server to stop sending the stream.
+func (s *RemoteStream) Close() error {
+	c := s.client
+	c.mu.Lock()
+	found := c.down[s.Id] == s
+	if found {
+		delete(c.down, s.Id)
+	}
+	c.mu.Unlock()
+	s.pc.Close()
+	if !found {
+		return nil
+	}
+	err := c.Send(Message{Type: "abort", Id: s.Id})
+	if err == ErrClosed {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) getUp(id string) *LocalStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.up[id]
+}
+
+func (c *Client) getDown(id string) *RemoteStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.down[id]
+}
+
+// closeDown closes a remote stream at the server's request.
+func (c *Client) closeDown(id string) {
+	c.mu.Lock()
+	s := c.down[id]
+	delete(c.down, id)
+	c.mu.Unlock()
+	if s == nil {
+		return
+	}
+	s.pc.Close()
+	if h := c.config.Handlers.StreamClosed; h != nil {
+		h(s)
+	}
+}
+
+// abortDown closes a remote stream after negotiation failed.
+func (c *Client) abortDown(s *RemoteStream) error {
+	err := s.Close()
+	if h := c.config.Handlers.StreamClosed; h != nil {
+		h(s)
+	}
+	return err
+}
+
+// gotOffer handles an offer from the server, which either creates a new
+// remote stream or renegotiates an existing one.
+func (c *Client) gotOffer(m *Message) error {
+	s := c.getDown(m.Id)
+	if s == nil {
+		s = &RemoteStream{
+			Id:       m.Id,
+			Label:    m.Label,
+			Source:   m.Source,
+			Username: username(m),
+			client:   c,
+		}
+		h := c.config.Handlers
+		if h.Stream != nil && !h.Stream(s) {
+			return c.Send(Message{Type: "abort", Id: m.Id})
+		}
+		trickle := func(candidate webrtc.ICECandidateInit) {
+			c.Send(Message{
+				Type:      "ice",
+				Id:        m.Id,
+				Candidate: &candidate,
+			})
+		}
+		var pc *webrtc.PeerConnection
+		var err error
+		if c.config.NewPeerConnection != nil {
+			pc, err = c.config.NewPeerConnection(s, m.SDP)
+			if err == nil {
+				onCandidate(pc, trickle)
+			}
+		} else {
+			pc, err = c.newPC(trickle)
+		}
+		if err != nil {
+			return c.Send(Message{Type: "abort", Id: m.Id})
+		}
+		s.pc = pc
+		if h.Track != nil {
+			pc.OnTrack(func(t *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+				h.Track(s, t, r)
+			})
+		}
+		c.mu.Lock()
+		c.down[m.Id] = s
+		c.mu.Unlock()
+	}
+
+	if m.Replace != "" {
+		c.closeDown(m.Replace)
+	}
+
+	err := s.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  m.SDP,
+	})
+	if err != nil {
+		return c.abortDown(s)
+	}
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return c.abortDown(s)
+	}
+	err = s.pc.SetLocalDescription(answer)
+	if err != nil {
+		return c.abortDown(s)
+	}
+	return c.Send(Message{
+		Type: "answer",
+		Id:   m.Id,
+		SDP:  s.pc.LocalDescription().SDP,
+	})
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
+
+	"github.com/jech/galene/rtpheader"
 )
 
 var errTruncated = errors.New("truncated packet")
@@ -15,9 +17,14 @@ var errTruncated = errors.New("truncated packet")
 // definitely not the case, and (false, false) if the information cannot
 // be determined.
 func Keyframe(codec string, packet *rtp.Packet) (bool, bool) {
+	return KeyframePayload(codec, packet.Payload)
+}
+
+// KeyframePayload is like Keyframe, but takes the RTP payload.
+func KeyframePayload(codec string, payload []byte) (bool, bool) {
 	if strings.EqualFold(codec, "video/vp8") {
 		var vp8 codecs.VP8Packet
-		_, err := vp8.Unmarshal(packet.Payload)
+		_, err := vp8.Unmarshal(payload)
 		if err != nil || len(vp8.Payload) < 1 {
 			return false, false
 		}
@@ -28,7 +35,7 @@ func Keyframe(codec string, packet *rtp.Packet) (bool, bool) {
 		return false, true
 	} else if strings.EqualFold(codec, "video/vp9") {
 		var vp9 codecs.VP9Packet
-		_, err := vp9.Unmarshal(packet.Payload)
+		_, err := vp9.Unmarshal(payload)
 		if err != nil || len(vp9.Payload) < 1 {
 			return false, false
 		}
@@ -46,14 +53,14 @@ func Keyframe(codec string, packet *rtp.Packet) (bool, bool) {
 		}
 		return (vp9.Payload[0] & 0x6) == 0, true
 	} else if strings.EqualFold(codec, "video/av1") {
-		if len(packet.Payload) < 2 {
+		if len(payload) < 2 {
 			return false, true
 		}
 		// Z=0, N=1
-		if (packet.Payload[0] & 0x88) != 0x08 {
+		if (payload[0] & 0x88) != 0x08 {
 			return false, true
 		}
-		w := (packet.Payload[0] & 0x30) >> 4
+		w := (payload[0] & 0x30) >> 4
 
 		getObu := func(data []byte, last bool) ([]byte, int, bool) {
 			if last {
@@ -82,7 +89,7 @@ func Keyframe(codec string, packet *rtp.Packet) (bool, bool) {
 		i := 0
 		for {
 			obu, length, truncated :=
-				getObu(packet.Payload[offset:], int(w) == i+1)
+				getObu(payload[offset:], int(w) == i+1)
 			if len(obu) < 1 {
 				return false, false
 			}
@@ -116,10 +123,10 @@ func Keyframe(codec string, packet *rtp.Packet) (bool, bool) {
 			i++
 		}
 	} else if strings.EqualFold(codec, "video/h264") {
-		if len(packet.Payload) < 1 {
+		if len(payload) < 1 {
 			return false, false
 		}
-		nalu := packet.Payload[0] & 0x1F
+		nalu := payload[0] & 0x1F
 		if nalu == 0 {
 			// reserved
 			return false, false
@@ -133,14 +140,14 @@ func Keyframe(codec string, packet *rtp.Packet) (bool, bool) {
 				// skip DON
 				i += 2
 			}
-			for i < len(packet.Payload) {
-				if i+2 > len(packet.Payload) {
+			for i < len(payload) {
+				if i+2 > len(payload) {
 					return false, false
 				}
-				length := uint16(packet.Payload[i])<<8 |
-					uint16(packet.Payload[i+1])
+				length := uint16(payload[i])<<8 |
+					uint16(payload[i+1])
 				i += 2
-				if i+int(length) > len(packet.Payload) {
+				if i+int(length) > len(payload) {
 					return false, false
 				}
 				offset := 0
@@ -152,7 +159,7 @@ func Keyframe(codec string, packet *rtp.Packet) (bool, bool) {
 				if offset >= int(length) {
 					return false, false
 				}
-				n := packet.Payload[i+offset] & 0x1F
+				n := payload[i+offset] & 0x1F
 				if n == 7 {
 					return true, true
 				} else if n >= 24 {
@@ -161,20 +168,20 @@ func Keyframe(codec string, packet *rtp.Packet) (bool, bool) {
 				}
 				i += int(length)
 			}
-			if i == len(packet.Payload) {
+			if i == len(payload) {
 				return false, true
 			}
 			return false, false
 		} else if nalu == 28 || nalu == 29 {
 			// FU-A or FU-B
-			if len(packet.Payload) < 2 {
+			if len(payload) < 2 {
 				return false, false
 			}
-			if (packet.Payload[1] & 0x80) == 0 {
+			if (payload[1] & 0x80) == 0 {
 				// not a starting fragment
 				return false, true
 			}
-			return (packet.Payload[1]&0x1F == 7), true
+			return (payload[1]&0x1F == 7), true
 		}
 		return false, false
 	}
@@ -240,6 +247,10 @@ type Flags struct {
 	SidUpSync       bool
 	SidNonReference bool
 	Discardable     bool
+	// the highest spatial layer announced in the VP9 scalability
+	// structure, only valid if Scalability is set
+	Scalability bool
+	MaxSid      uint8
 }
 
 func PacketFlags(codec string, buf []byte) (Flags, error) {
@@ -253,19 +264,18 @@ func PacketFlags(codec string, buf []byte) (Flags, error) {
 	flags.Marker = (buf[1] & 0x80) != 0
 
 	if strings.EqualFold(codec, "video/vp8") {
-		var packet rtp.Packet
-		err := packet.Unmarshal(buf)
+		header, err := rtpheader.Parse(buf)
 		if err != nil {
 			return flags, err
 		}
 		var vp8 codecs.VP8Packet
-		_, err = vp8.Unmarshal(packet.Payload)
+		_, err = vp8.Unmarshal(header.Payload())
 		if err != nil {
 			return flags, err
 		}
 
 		flags.Start = vp8.S != 0 && vp8.PID == 0
-		flags.End = packet.Marker
+		flags.End = flags.Marker
 		flags.Keyframe = vp8.S != 0 && (vp8.Payload[0]&0x1) == 0
 		flags.Pid = vp8.PictureID
 		flags.Tid = vp8.TID
@@ -274,13 +284,12 @@ func PacketFlags(codec string, buf []byte) (Flags, error) {
 		flags.Discardable = vp8.N == 1
 		return flags, nil
 	} else if strings.EqualFold(codec, "video/vp9") {
-		var packet rtp.Packet
-		err := packet.Unmarshal(buf)
+		header, err := rtpheader.Parse(buf)
 		if err != nil {
 			return flags, err
 		}
 		var vp9 codecs.VP9Packet
-		_, err = vp9.Unmarshal(packet.Payload)
+		_, err = vp9.Unmarshal(header.Payload())
 		if err != nil {
 			return flags, err
 		}
@@ -298,12 +307,51 @@ func PacketFlags(codec string, buf []byte) (Flags, error) {
 		flags.Sid = vp9.SID
 		flags.TidUpSync = flags.Keyframe || vp9.U
 		flags.SidUpSync = flags.Keyframe || !vp9.P
-		flags.SidNonReference = (packet.Payload[0] & 0x01) != 0
+		flags.SidNonReference = (header.Payload()[0] & 0x01) != 0
+		if vp9.V {
+			flags.Scalability = true
+			flags.MaxSid = vp9.NS
+		}
+		return flags, nil
+	} else if strings.EqualFold(codec, "video/h264") {
+		header, err := rtpheader.Parse(buf)
+		if err != nil {
+			return flags, err
+		}
+		flags.Keyframe, _ = KeyframePayload(codec, header.Payload())
+		flags.End = flags.Marker
 		return flags, nil
 	}
 	return flags, nil
 }
 
+// REDPrimary returns the primary encoding of a RED payload, as defined
+// in RFC 2198.
+func REDPrimary(payload []byte) ([]byte, error) {
+	offset := 0
+	length := 0
+	for {
+		if offset >= len(payload) {
+			return nil, errTruncated
+		}
+		if (payload[offset] & 0x80) == 0 {
+			// the last header is just one byte
+			offset++
+			break
+		}
+		if offset+4 > len(payload) {
+			return nil, errTruncated
+		}
+		length += int(payload[offset+2]&0x03)<<8 |
+			int(payload[offset+3])
+		offset += 4
+	}
+	if offset+length > len(payload) {
+		return nil, errTruncated
+	}
+	return payload[offset+length:], nil
+}
+
 func RewritePacket(codec string, data []byte, setMarker bool, seqno uint16, delta uint16) error {
 	if len(data) < 12 {
 		return errTruncated
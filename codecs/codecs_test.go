@@ -1,6 +1,7 @@
 package codecs
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/pion/rtp"
@@ -125,6 +126,12 @@ func TestH264Keyframe(t *testing.T) {
 		if kf != (i == 0) || !kfKnown {
 			t.Errorf("Keyframe(p%v): %v %v", i, kf, kfKnown)
 		}
+
+		flags, err := PacketFlags("video/h264", p)
+		if err != nil || flags.Keyframe != (i == 0) {
+			t.Errorf("PacketFlags(p%v): %v (%v)",
+				i, flags.Keyframe, err)
+		}
 	}
 }
 
@@ -229,6 +236,36 @@ func TestPacketFlagsVP9(t *testing.T) {
 	}
 }
 
+// a VP9 keyframe with a scalability structure announcing three spatial
+// layers
+var vp9SS = []byte{
+	0x80, 0, 0, 42,
+	0, 0, 0, 0,
+	0, 0, 0, 0,
+
+	0x0a, 0x50,
+	0, 160, 0, 90,
+	1, 64, 0, 180,
+	2, 128, 1, 104,
+	0x80, 0, 0, 0,
+}
+
+func TestPacketFlagsVP9SS(t *testing.T) {
+	flags, err := PacketFlags("video/vp9", vp9SS)
+	if err != nil || !flags.Start || !flags.Keyframe ||
+		!flags.Scalability || flags.MaxSid != 2 {
+		t.Errorf("Got %v, %v, %v, %v (%v)",
+			flags.Start, flags.Keyframe,
+			flags.Scalability, flags.MaxSid, err,
+		)
+	}
+
+	flags, err = PacketFlags("video/vp9", vp9)
+	if err != nil || flags.Scalability {
+		t.Errorf("Got %v (%v)", flags.Scalability, err)
+	}
+}
+
 func TestRewriteVP9(t *testing.T) {
 	for i := uint16(0); i < 0x7fff; i++ {
 		buf := append([]byte{}, vp9...)
@@ -246,3 +283,37 @@ func TestRewriteVP9(t *testing.T) {
 		}
 	}
 }
+
+func TestREDPrimary(t *testing.T) {
+	tests := []struct {
+		payload, primary []byte
+	}{
+		{[]byte{111, 1, 2}, []byte{1, 2}},
+		{[]byte{0x80 | 111, 0x03, 0xc0, 2, 111, 1, 1, 2, 2, 2},
+			[]byte{2, 2, 2}},
+		{[]byte{0x80 | 111, 0, 0, 1, 0x80 | 111, 0, 0, 2, 111,
+			1, 2, 2, 3},
+			[]byte{3}},
+		{[]byte{111}, []byte{}},
+	}
+	for _, test := range tests {
+		primary, err := REDPrimary(test.payload)
+		if err != nil || !bytes.Equal(primary, test.primary) {
+			t.Errorf("%v: expected %v, got %v (%v)",
+				test.payload, test.primary, primary, err)
+		}
+	}
+
+	bad := [][]byte{
+		{},
+		{0x80 | 111, 0, 0},
+		{0x80 | 111, 0, 0, 4, 111, 1, 2, 3},
+		{0x80 | 111, 0, 0, 1},
+	}
+	for _, b := range bad {
+		_, err := REDPrimary(b)
+		if err == nil {
+			t.Errorf("%v: no error", b)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package codecs
+
+import (
+	"errors"
+)
+
+// DependencyDescriptorURI is the URI of the dependency descriptor header
+// extension, defined in the AV1 RTP payload specification.
+const DependencyDescriptorURI = "https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension"
+
+var errNoStructure = errors.New("no dependency structure")
+var errBadTemplate = errors.New("bad dependency template")
+
+// Decode target indications
+const (
+	DTINotPresent  = 0
+	DTIDiscardable = 1
+	DTISwitch      = 2
+	DTIRequired    = 3
+)
+
+// A DependencyStructure describes the frame templates of a stream.  It is
+// only sent from time to time, usually with keyframes, and needs to be
+// remembered by the receiver in order to interpret later descriptors.
+type DependencyStructure struct {
+	TemplateIdOffset uint8
+	DecodeTargets    int
+	// the spatial and temporal layer of each template
+	TemplateSid []uint8
+	TemplateTid []uint8
+	// the decode target indications of each template
+	TemplateDTI [][]uint8
+	// the layers of each decode target
+	DecodeTargetSid []uint8
+	DecodeTargetTid []uint8
+}
+
+// A DependencyDescriptor is a parsed dependency descriptor.
+type DependencyDescriptor struct {
+	StartOfFrame bool
+	EndOfFrame   bool
+	TemplateId   uint8
+	FrameNumber  uint16
+	// the structure carried by this descriptor, if any
+	Structure *DependencyStructure
+	// the frame's layers and decode target indications
+	Sid, Tid uint8
+	DTI      []uint8
+}
+
+// TidUpSync returns true if the frame is a switching point for a decode
+// target at the frame's own layers, in which case it is possible to
+// switch up to the frame's temporal layer.
+func (d *DependencyDescriptor) TidUpSync(s *DependencyStructure) bool {
+	for i, dti := range d.DTI {
+		if dti == DTISwitch &&
+			s.DecodeTargetSid[i] == d.Sid &&
+			s.DecodeTargetTid[i] == d.Tid {
+			return true
+		}
+	}
+	return false
+}
+
+type bitReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.offset >= len(r.data)*8 {
+			r.err = errTruncated
+			return 0
+		}
+		b := (r.data[r.offset/8] >> (7 - r.offset%8)) & 1
+		v = (v << 1) | uint32(b)
+		r.offset++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.bits(1) != 0
+}
+
+// ns reads a non-symmetric unsigned integer in the range [0, n).
+func (r *bitReader) ns(n uint32) uint32 {
+	w := 0
+	for x := n; x != 0; x >>= 1 {
+		w++
+	}
+	m := (uint32(1) << w) - n
+	v := r.bits(w - 1)
+	if v < m {
+		return v
+	}
+	return (v << 1) - m + r.bits(1)
+}
+
+// ParseDependencyDescriptor parses a dependency descriptor.  If the
+// descriptor doesn't carry a structure, the structure s received earlier
+// is used to determine the frame's layers.
+func ParseDependencyDescriptor(data []byte, s *DependencyStructure) (DependencyDescriptor, error) {
+	var d DependencyDescriptor
+	r := &bitReader{data: data}
+
+	d.StartOfFrame = r.flag()
+	d.EndOfFrame = r.flag()
+	d.TemplateId = uint8(r.bits(6))
+	d.FrameNumber = uint16(r.bits(16))
+	if r.err != nil {
+		return d, r.err
+	}
+
+	var customDTIs bool
+	if len(data) > 3 {
+		structurePresent := r.flag()
+		activePresent := r.flag()
+		customDTIs = r.flag()
+		r.flag() // custom_fdiffs_flag
+		r.flag() // custom_chains_flag
+		if structurePresent {
+			var err error
+			s, err = parseDependencyStructure(r)
+			if err != nil {
+				return d, err
+			}
+			d.Structure = s
+		}
+		if activePresent {
+			if s == nil {
+				return d, errNoStructure
+			}
+			r.bits(s.DecodeTargets)
+		}
+	}
+
+	if s == nil {
+		return d, errNoStructure
+	}
+	index := (int(d.TemplateId) + 64 - int(s.TemplateIdOffset)) % 64
+	if index >= len(s.TemplateSid) {
+		return d, errBadTemplate
+	}
+	d.Sid = s.TemplateSid[index]
+	d.Tid = s.TemplateTid[index]
+	if customDTIs {
+		d.DTI = make([]uint8, s.DecodeTargets)
+		for i := range d.DTI {
+			d.DTI[i] = uint8(r.bits(2))
+		}
+	} else {
+		d.DTI = s.TemplateDTI[index]
+	}
+	if r.err != nil {
+		return d, r.err
+	}
+	return d, nil
+}
+
+func parseDependencyStructure(r *bitReader) (*DependencyStructure, error) {
+	s := &DependencyStructure{}
+	s.TemplateIdOffset = uint8(r.bits(6))
+	s.DecodeTargets = int(r.bits(5)) + 1
+
+	// template_layers
+	var sid, tid uint8
+	for {
+		if len(s.TemplateSid) >= 64 {
+			return nil, errBadTemplate
+		}
+		s.TemplateSid = append(s.TemplateSid, sid)
+		s.TemplateTid = append(s.TemplateTid, tid)
+		next := r.bits(2)
+		if r.err != nil {
+			return nil, r.err
+		}
+		if next == 1 {
+			tid++
+		} else if next == 2 {
+			tid = 0
+			sid++
+		} else if next == 3 {
+			break
+		}
+	}
+	templates := len(s.TemplateSid)
+
+	// template_dtis
+	s.TemplateDTI = make([][]uint8, templates)
+	for i := range s.TemplateDTI {
+		s.TemplateDTI[i] = make([]uint8, s.DecodeTargets)
+		for j := range s.TemplateDTI[i] {
+			s.TemplateDTI[i][j] = uint8(r.bits(2))
+		}
+	}
+
+	// template_fdiffs
+	for i := 0; i < templates; i++ {
+		for r.flag() {
+			r.bits(4)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+
+	// template_chains
+	chains := r.ns(uint32(s.DecodeTargets) + 1)
+	if chains > 0 {
+		for i := 0; i < s.DecodeTargets; i++ {
+			r.ns(chains)
+		}
+		r.bits(4 * int(chains) * templates)
+	}
+
+	// decode_target_layers
+	s.DecodeTargetSid = make([]uint8, s.DecodeTargets)
+	s.DecodeTargetTid = make([]uint8, s.DecodeTargets)
+	for i := 0; i < s.DecodeTargets; i++ {
+		for j := 0; j < templates; j++ {
+			if s.TemplateDTI[j][i] == DTINotPresent {
+				continue
+			}
+			if s.TemplateSid[j] > s.DecodeTargetSid[i] {
+				s.DecodeTargetSid[i] = s.TemplateSid[j]
+			}
+			if s.TemplateTid[j] > s.DecodeTargetTid[i] {
+				s.DecodeTargetTid[i] = s.TemplateTid[j]
+			}
+		}
+	}
+
+	// render_resolutions
+	if r.flag() {
+		r.bits(32 * (int(sid) + 1))
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return s, nil
+}
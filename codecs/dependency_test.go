@@ -0,0 +1,84 @@
+package codecs
+
+import (
+	"testing"
+)
+
+// an L1T3 structure with template id offset 5, where the second template
+// is not a switching point
+var dd = []byte{
+	0xc5, 0x00, 0x01, 0x80, 0xa2, 0x5e, 0xa3,
+	0xc2, 0x41, 0x01, 0x02, 0x7f, 0x01, 0xdf,
+}
+
+func TestDependencyStructure(t *testing.T) {
+	d, err := ParseDependencyDescriptor(dd, nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	s := d.Structure
+	if !d.StartOfFrame || !d.EndOfFrame || d.FrameNumber != 1 ||
+		s == nil || s.TemplateIdOffset != 5 || s.DecodeTargets != 3 ||
+		len(s.TemplateTid) != 3 || s.TemplateTid[2] != 2 {
+		t.Fatalf("Got %#v %#v", d, s)
+	}
+	for i := 0; i < 3; i++ {
+		if s.DecodeTargetSid[i] != 0 ||
+			s.DecodeTargetTid[i] != uint8(i) {
+			t.Errorf("Decode target %v: got %v %v", i,
+				s.DecodeTargetSid[i], s.DecodeTargetTid[i])
+		}
+	}
+	if d.Sid != 0 || d.Tid != 0 || !d.TidUpSync(s) {
+		t.Errorf("Got %v %v %v", d.Sid, d.Tid, d.TidUpSync(s))
+	}
+}
+
+func TestDependencyDescriptor(t *testing.T) {
+	d, err := ParseDependencyDescriptor(dd, nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	s := d.Structure
+
+	_, err = ParseDependencyDescriptor([]byte{0x86, 0, 2}, nil)
+	if err != errNoStructure {
+		t.Errorf("Expected errNoStructure, got %v", err)
+	}
+
+	tests := []struct {
+		id     byte
+		tid    uint8
+		upsync bool
+	}{
+		{5, 0, true},
+		{6, 1, false},
+		{7, 2, true},
+	}
+	for _, tt := range tests {
+		d, err := ParseDependencyDescriptor(
+			[]byte{0x80 | tt.id, 0, 2}, s,
+		)
+		if err != nil || !d.StartOfFrame || d.EndOfFrame ||
+			d.FrameNumber != 2 || d.Structure != nil ||
+			d.Tid != tt.tid || d.TidUpSync(s) != tt.upsync {
+			t.Errorf("Template %v: got %#v (%v)", tt.id, d, err)
+		}
+	}
+
+	_, err = ParseDependencyDescriptor([]byte{0x88, 0, 2}, s)
+	if err != errBadTemplate {
+		t.Errorf("Expected errBadTemplate, got %v", err)
+	}
+
+	for i := 0; i < len(dd); i++ {
+		if i == 3 {
+			// a descriptor without extended fields
+			continue
+		}
+		_, err := ParseDependencyDescriptor(dd[:i], nil)
+		if err == nil {
+			t.Errorf("Truncated to %v: no error", i)
+		}
+	}
+}
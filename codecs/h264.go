@@ -0,0 +1,173 @@
+package codecs
+
+import (
+	"errors"
+)
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint32 {
+	zeroes := 0
+	for r.bits(1) == 0 {
+		if r.err != nil {
+			return 0
+		}
+		zeroes++
+		if zeroes > 31 {
+			r.err = errors.New("bad Exp-Golomb code")
+			return 0
+		}
+	}
+	return (1<<zeroes - 1) + r.bits(zeroes)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 != 0 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+// UnescapeNALU removes emulation prevention bytes from a NAL unit.
+func UnescapeNALU(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeroes := 0
+	for _, b := range nalu {
+		if zeroes >= 2 && b == 3 {
+			zeroes = 0
+			continue
+		}
+		if b == 0 {
+			zeroes++
+		} else {
+			zeroes = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// SPSInfo is the information from an H.264 sequence parameter set that
+// is needed in order to describe the stream in a container.
+type SPSInfo struct {
+	Profile, Compatibility, Level uint8
+	ChromaFormat                  uint32
+	BitDepthLuma, BitDepthChroma  uint32
+	Width, Height                 uint32
+}
+
+// HasChromaInfo returns true if the sequence parameter sets of the given
+// H.264 profile carry chroma format and bit depth information.
+func HasChromaInfo(profile uint8) bool {
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		return true
+	}
+	return false
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			delta := r.se()
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// ParseSPS parses an H.264 sequence parameter set, including the NAL
+// header.
+func ParseSPS(sps []byte) (*SPSInfo, error) {
+	if len(sps) < 4 {
+		return nil, errTruncated
+	}
+	if sps[0]&0x1F != 7 {
+		return nil, errors.New("not an SPS")
+	}
+	info := &SPSInfo{
+		Profile:       sps[1],
+		Compatibility: sps[2],
+		Level:         sps[3],
+		ChromaFormat:  1,
+	}
+	r := &bitReader{data: UnescapeNALU(sps[4:])}
+
+	r.ue() // seq_parameter_set_id
+	if HasChromaInfo(info.Profile) {
+		info.ChromaFormat = r.ue()
+		if info.ChromaFormat == 3 {
+			r.flag() // separate_colour_plane_flag
+		}
+		info.BitDepthLuma = r.ue()
+		info.BitDepthChroma = r.ue()
+		r.flag() // qpprime_y_zero_transform_bypass_flag
+		if r.flag() {
+			n := 8
+			if info.ChromaFormat == 3 {
+				n = 12
+			}
+			for i := 0; i < n && r.err == nil; i++ {
+				if r.flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.flag() // delta_pic_order_always_zero_flag
+		r.se()   // offset_for_non_ref_pic
+		r.se()   // offset_for_top_to_bottom_field
+		n := r.ue()
+		if n > 255 {
+			return nil, errors.New("bad SPS")
+		}
+		for i := uint32(0); i < n; i++ {
+			r.se()
+		}
+	}
+	r.ue()   // max_num_ref_frames
+	r.flag() // gaps_in_frame_num_value_allowed_flag
+	widthMbs := r.ue() + 1
+	heightMaps := r.ue() + 1
+	frameMbsOnly := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.flag() // mb_adaptive_frame_field_flag
+	}
+	r.flag() // direct_8x8_inference_flag
+	var left, right, top, bottom uint32
+	if r.flag() {
+		left, right, top, bottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	cropX, cropY := uint32(1), 2-frameMbsOnly
+	switch info.ChromaFormat {
+	case 1:
+		cropX, cropY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropX = 2
+	}
+	width := widthMbs * 16
+	height := (2 - frameMbsOnly) * heightMaps * 16
+	if (left+right)*cropX >= width || (top+bottom)*cropY >= height {
+		return nil, errors.New("bad cropping in SPS")
+	}
+	info.Width = width - (left+right)*cropX
+	info.Height = height - (top+bottom)*cropY
+	return info, nil
+}
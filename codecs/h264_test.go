@@ -0,0 +1,114 @@
+package codecs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bitWriter is used to build test parameter sets.
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) bit(b uint32) {
+	if w.n%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	if b != 0 {
+		w.data[len(w.data)-1] |= 0x80 >> (w.n % 8)
+	}
+	w.n++
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	l := 0
+	for (v >> l) > 1 {
+		l++
+	}
+	for i := 0; i < l; i++ {
+		w.bit(0)
+	}
+	for i := l; i >= 0; i-- {
+		w.bit((v >> i) & 1)
+	}
+}
+
+func makeSPS(profile uint8, widthMbs, heightMbs uint32, crop []uint32) []byte {
+	w := &bitWriter{}
+	w.ue(0) // seq_parameter_set_id
+	if HasChromaInfo(profile) {
+		w.ue(1) // chroma_format_idc
+		w.ue(0)
+		w.ue(0)
+		w.bit(0)
+		w.bit(0) // seq_scaling_matrix_present_flag
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(2) // pic_order_cnt_type
+	w.ue(1) // max_num_ref_frames
+	w.bit(0)
+	w.ue(widthMbs - 1)
+	w.ue(heightMbs - 1)
+	w.bit(1) // frame_mbs_only_flag
+	w.bit(1) // direct_8x8_inference_flag
+	if crop != nil {
+		w.bit(1)
+		for _, c := range crop {
+			w.ue(c)
+		}
+	} else {
+		w.bit(0)
+	}
+	w.bit(0) // vui_parameters_present_flag
+	w.bit(1) // rbsp_stop_one_bit
+	return append([]byte{0x67, profile, 0xe0, 0x1f}, w.data...)
+}
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		profile       uint8
+		w, h          uint32
+		crop          []uint32
+		width, height uint32
+	}{
+		{66, 40, 30, nil, 640, 480},
+		{66, 80, 45, nil, 1280, 720},
+		{66, 120, 68, []uint32{0, 0, 0, 4}, 1920, 1080},
+		{100, 120, 68, []uint32{0, 0, 0, 4}, 1920, 1080},
+	}
+	for _, tt := range tests {
+		sps := makeSPS(tt.profile, tt.w, tt.h, tt.crop)
+		info, err := ParseSPS(sps)
+		if err != nil {
+			t.Errorf("Parse %v: %v", sps, err)
+			continue
+		}
+		if info.Width != tt.width || info.Height != tt.height ||
+			info.Profile != tt.profile || info.Level != 0x1f {
+			t.Errorf("Expected %vx%v, got %v", tt.width, tt.height,
+				info)
+		}
+		for i := 4; i < len(sps)-1; i++ {
+			_, err := ParseSPS(sps[:i])
+			if err == nil {
+				t.Errorf("Parsed truncated SPS %v", sps[:i])
+			}
+		}
+	}
+
+	_, err := ParseSPS([]byte{0x68, 1, 2, 3})
+	if err == nil {
+		t.Errorf("Parsed PPS as SPS")
+	}
+}
+
+func TestUnescapeNALU(t *testing.T) {
+	in := []byte{1, 0, 0, 3, 1, 0, 0, 3, 0, 0, 3}
+	out := UnescapeNALU(in)
+	expected := []byte{1, 0, 0, 1, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("Expected %v, got %v", expected, out)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/ice"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/qualitylog"
+	"github.com/jech/galene/rtpconn"
+	"github.com/jech/galene/tracing"
+	"github.com/jech/galene/turnserver"
+	"github.com/jech/galene/upload"
+	"github.com/jech/galene/webserver"
+)
+
+// server settings that don't live in another package
+var httpAddr, rtmpAddr, srtAddr, udpRange, iceTCPAddr, udpMuxAddr string
+var relayOnly bool
+
+// A setting is a server setting in the configuration file.
+type setting struct {
+	// the key in config.json
+	key string
+	// the command-line flag that overrides it, if any
+	flag string
+	// whether it may be changed without restarting the server
+	runtime bool
+	get     func(conf *group.Configuration) interface{}
+	// apply sets the value used by the server
+	apply func(conf *group.Configuration) error
+}
+
+var settings = []setting{
+	{"admin", "", true,
+		func(c *group.Configuration) interface{} { return c.Admin },
+		nil},
+	{"publicServer", "", true,
+		func(c *group.Configuration) interface{} { return c.PublicServer },
+		nil},
+	{"canonicalHost", "", true,
+		func(c *group.Configuration) interface{} { return c.CanonicalHost },
+		nil},
+	{"proxyURL", "", true,
+		func(c *group.Configuration) interface{} { return c.ProxyURL },
+		nil},
+	{"http", "http", false,
+		func(c *group.Configuration) interface{} { return c.HTTP },
+		func(c *group.Configuration) error {
+			if c.HTTP != "" {
+				httpAddr = c.HTTP
+			}
+			return nil
+		}},
+	{"insecure", "insecure", false,
+		func(c *group.Configuration) interface{} { return c.Insecure },
+		func(c *group.Configuration) error {
+			webserver.Insecure = c.Insecure
+			return nil
+		}},
+	{"webTransport", "", false,
+		func(c *group.Configuration) interface{} { return c.WebTransport },
+		func(c *group.Configuration) error {
+			webserver.WebTransport = c.WebTransport
+			return nil
+		}},
+	{"static", "static", false,
+		func(c *group.Configuration) interface{} { return c.Static },
+		func(c *group.Configuration) error {
+			if c.Static != "" {
+				webserver.StaticRoot = c.Static
+			}
+			return nil
+		}},
+	{"groups", "groups", false,
+		func(c *group.Configuration) interface{} { return c.Groups },
+		func(c *group.Configuration) error {
+			if c.Groups != "" {
+				group.Directory = c.Groups
+			}
+			return nil
+		}},
+	{"recordings", "recordings", false,
+		func(c *group.Configuration) interface{} { return c.Recordings },
+		func(c *group.Configuration) error {
+			if c.Recordings != "" {
+				diskwriter.Directory = c.Recordings
+			}
+			return nil
+		}},
+	{"udpRange", "udp-range", false,
+		func(c *group.Configuration) interface{} { return c.UDPRange },
+		func(c *group.Configuration) error {
+			if c.UDPRange != "" {
+				udpRange = c.UDPRange
+			}
+			return nil
+		}},
+	{"mdns", "mdns", false,
+		func(c *group.Configuration) interface{} { return c.MDNS },
+		func(c *group.Configuration) error {
+			group.UseMDNS = c.MDNS
+			return nil
+		}},
+	{"turn", "turn", false,
+		func(c *group.Configuration) interface{} { return c.Turn },
+		func(c *group.Configuration) error {
+			if c.Turn != nil {
+				turnserver.Address = *c.Turn
+			}
+			return nil
+		}},
+	{"turnTLS", "", false,
+		func(c *group.Configuration) interface{} { return c.TurnTLS },
+		func(c *group.Configuration) error {
+			turnserver.TLSAddress = c.TurnTLS
+			return nil
+		}},
+	{"rtmp", "rtmp", false,
+		func(c *group.Configuration) interface{} { return c.RTMP },
+		func(c *group.Configuration) error {
+			if c.RTMP != "" {
+				rtmpAddr = c.RTMP
+			}
+			return nil
+		}},
+	{"srt", "", false,
+		func(c *group.Configuration) interface{} { return c.SRT },
+		func(c *group.Configuration) error {
+			srtAddr = c.SRT
+			return nil
+		}},
+	{"egressWorkers", "egress-workers", false,
+		func(c *group.Configuration) interface{} { return c.EgressWorkers },
+		func(c *group.Configuration) error {
+			if c.EgressWorkers != 0 {
+				rtpconn.EgressWorkers = c.EgressWorkers
+			}
+			return nil
+		}},
+	{"iceTCP", "", false,
+		func(c *group.Configuration) interface{} { return c.ICETCP },
+		func(c *group.Configuration) error {
+			iceTCPAddr = c.ICETCP
+			return nil
+		}},
+	{"udpMux", "", false,
+		func(c *group.Configuration) interface{} { return c.UDPMux },
+		func(c *group.Configuration) error {
+			udpMuxAddr = c.UDPMux
+			return nil
+		}},
+	{"ipFamily", "", false,
+		func(c *group.Configuration) interface{} { return c.IPFamily },
+		func(c *group.Configuration) error {
+			group.IPFamily = c.IPFamily
+			return nil
+		}},
+	{"relayOnly", "relay-only", true,
+		func(c *group.Configuration) interface{} { return c.RelayOnly },
+		func(c *group.Configuration) error {
+			relayOnly = c.RelayOnly
+			return nil
+		}},
+	{"iceServers", "", true,
+		func(c *group.Configuration) interface{} { return c.ICEServers },
+		func(c *group.Configuration) error {
+			ice.SetServers(c.ICEServers)
+			return nil
+		}},
+	{"groupDatabase", "", false,
+		func(c *group.Configuration) interface{} { return c.GroupDatabase },
+		nil},
+	{"sharedState", "", false,
+		func(c *group.Configuration) interface{} { return c.SharedState },
+		nil},
+	{"qualityLog", "", true,
+		func(c *group.Configuration) interface{} { return c.QualityLog },
+		func(c *group.Configuration) error {
+			return qualitylog.Configure(c.QualityLog)
+		}},
+	{"cluster", "", true,
+		func(c *group.Configuration) interface{} { return c.Cluster },
+		nil},
+	{"drainMessage", "", true,
+		func(c *group.Configuration) interface{} { return c.DrainMessage },
+		nil},
+	{"drainTimeout", "", true,
+		func(c *group.Configuration) interface{} { return c.DrainTimeout },
+		nil},
+	{"tracing", "", true,
+		func(c *group.Configuration) interface{} { return c.Tracing },
+		func(c *group.Configuration) error {
+			return tracing.Configure(c.Tracing)
+		}},
+	{"upload", "", true,
+		func(c *group.Configuration) interface{} { return c.Upload },
+		func(c *group.Configuration) error {
+			return upload.Configure(c.Upload)
+		}},
+	{"pprof", "", true,
+		func(c *group.Configuration) interface{} { return c.Pprof },
+		nil},
+	{"logFile", "", true,
+		func(c *group.Configuration) interface{} { return c.LogFile },
+		func(c *group.Configuration) error {
+			return openLog(c.LogFile)
+		}},
+}
+
+// checkConfiguration performs the checks that cannot be done when
+// parsing the configuration file.
+func checkConfiguration(conf *group.Configuration) error {
+	if conf.UDPRange != "" {
+		_, _, err := group.ParseUDPRange(conf.UDPRange)
+		if err != nil {
+			return fmt.Errorf("udpRange: %w", err)
+		}
+		if conf.UDPMux != "" {
+			return errors.New("udpRange and udpMux are incompatible")
+		}
+	}
+	switch conf.IPFamily {
+	case "", "ipv4", "ipv6":
+	default:
+		return errors.New("ipFamily: unknown value " + conf.IPFamily)
+	}
+	if conf.EgressWorkers < 0 {
+		return errors.New("egressWorkers: negative value")
+	}
+	for i, s := range conf.ICEServers {
+		if len(s.URLs) == 0 {
+			return fmt.Errorf("iceServers[%v]: no URLs", i)
+		}
+		err := ice.CheckServer(s)
+		if err != nil {
+			return fmt.Errorf("iceServers[%v]: %w", i, err)
+		}
+	}
+	if conf.QualityLog != nil {
+		err := qualitylog.Check(conf.QualityLog)
+		if err != nil {
+			return fmt.Errorf("qualityLog: %w", err)
+		}
+	}
+	if conf.Tracing != nil {
+		err := tracing.Check(conf.Tracing)
+		if err != nil {
+			return fmt.Errorf("tracing: %w", err)
+		}
+	}
+	if conf.Upload != nil {
+		err := upload.Check(conf.Upload)
+		if err != nil {
+			return fmt.Errorf("upload: %w", err)
+		}
+	}
+	if conf.DrainTimeout < 0 {
+		return errors.New("drainTimeout: negative value")
+	}
+	if conf.Cluster != nil {
+		err := conf.Cluster.Check()
+		if err != nil {
+			return fmt.Errorf("cluster: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyConfiguration applies the settings in the configuration file
+// that are not overridden by flags.  If all is false, only the settings
+// that can be changed at runtime are applied, and the changes relative
+// to old are logged.
+func applyConfiguration(old, conf *group.Configuration, flags map[string]bool, all bool) error {
+	for _, s := range settings {
+		if s.flag != "" && flags[s.flag] {
+			if all && !reflect.ValueOf(s.get(conf)).IsZero() {
+				logger.Infof("Configuration: %v is "+
+					"overridden by flag -%v",
+					s.key, s.flag)
+			}
+			continue
+		}
+		if !all {
+			if reflect.DeepEqual(s.get(old), s.get(conf)) {
+				continue
+			}
+			if !s.runtime {
+				logger.Infof("Configuration: %v changed, "+
+					"restart required", s.key)
+				continue
+			}
+		}
+		if s.apply != nil {
+			err := s.apply(conf)
+			if err != nil {
+				return fmt.Errorf("%v: %w", s.key, err)
+			}
+		}
+		if !all {
+			logger.Infof("Configuration: applied %v", s.key)
+		}
+	}
+	ice.SetRelayOnly(relayOnly)
+	return nil
+}
+
+// deprecatedFlags warns about flags that have an equivalent in the
+// configuration file.
+func deprecatedFlags(flags map[string]bool) {
+	for _, s := range settings {
+		if s.flag != "" && flags[s.flag] {
+			logger.Warnf("Flag -%v is deprecated, "+
+				"please set %v in config.json", s.flag, s.key)
+		}
+	}
+}
+
+// effectiveConfiguration returns the configuration in use, taking
+// flags into account.  Passwords are omitted.
+func effectiveConfiguration(conf *group.Configuration) *group.Configuration {
+	c := *conf
+	c.HTTP = httpAddr
+	c.Insecure = webserver.Insecure
+	c.WebTransport = webserver.WebTransport
+	c.Static = webserver.StaticRoot
+	c.Groups = group.Directory
+	c.Recordings = diskwriter.Directory
+	c.UDPRange = udpRange
+	c.MDNS = group.UseMDNS
+	turn := turnserver.Address
+	c.Turn = &turn
+	c.TurnTLS = turnserver.TLSAddress
+	c.RTMP = rtmpAddr
+	c.SRT = srtAddr
+	c.EgressWorkers = rtpconn.EgressWorkers
+	c.ICETCP = iceTCPAddr
+	c.UDPMux = udpMuxAddr
+	c.IPFamily = group.IPFamily
+	c.RelayOnly = relayOnly
+
+	c.Admin = make([]group.ClientPattern, len(conf.Admin))
+	for i, p := range conf.Admin {
+		c.Admin[i] = group.ClientPattern{Username: p.Username}
+	}
+	c.ICEServers = make([]ice.Server, len(conf.ICEServers))
+	for i, s := range conf.ICEServers {
+		s.Credential = nil
+		c.ICEServers[i] = s
+	}
+	if u, err := url.Parse(conf.SharedState); err == nil {
+		c.SharedState = u.Redacted()
+	}
+	if u, err := url.Parse(conf.GroupDatabase); err == nil {
+		c.GroupDatabase = u.Redacted()
+	}
+	if conf.Upload != nil {
+		u := *conf.Upload
+		u.SecretAccessKey = ""
+		u.Password = ""
+		c.Upload = &u
+	}
+	return &c
+}
+
+var logFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openLog directs logging to the given file, or to standard error if
+// filename is empty.  It may be called again in order to reopen the
+// file after it has been rotated.
+func openLog(filename string) error {
+	logFile.mu.Lock()
+	defer logFile.mu.Unlock()
+
+	var f *os.File
+	if filename != "" {
+		var err error
+		f, err = os.OpenFile(filename,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		logging.SetOutput(f)
+	} else {
+		logging.SetOutput(os.Stderr)
+	}
+	if logFile.file != nil {
+		logFile.file.Close()
+	}
+	logFile.file = f
+	return nil
+}
+
+// reloadConfiguration rereads the configuration file, applies the
+// settings that can be changed at runtime, and returns the new
+// configuration.  If the file is invalid, it returns old.
+func reloadConfiguration(old *group.Configuration, flags map[string]bool) *group.Configuration {
+	conf, err := group.GetConfiguration()
+	if err == nil {
+		err = checkConfiguration(conf)
+	}
+	if err != nil {
+		logger.Errorf("Configuration: %v, keeping previous settings", err)
+		return old
+	}
+
+	err = applyConfiguration(old, conf, flags, false)
+	if err != nil {
+		logger.Warnf("Configuration: %v", err)
+	}
+
+	// reopen the log file, in case it has been rotated
+	if conf.LogFile != "" && conf.LogFile == old.LogFile {
+		err := openLog(conf.LogFile)
+		if err != nil {
+			logger.Warnf("Configuration: logFile: %v", err)
+		}
+	}
+
+	ice.Update()
+	return conf
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/ice"
+	"github.com/jech/galene/logging"
+)
+
+func TestCheckConfiguration(t *testing.T) {
+	good := &group.Configuration{
+		UDPRange: "1000-2000",
+		ICEServers: []ice.Server{{
+			URLs:       []string{"turn:turn.example.org"},
+			Username:   "user",
+			Credential: "secret",
+		}},
+		QualityLog: &group.QualityLog{File: "quality.log"},
+		Cluster: &group.Cluster{
+			Self: "https://a.example.org:8443/",
+			Instances: []string{
+				"https://a.example.org:8443",
+				"https://b.example.org:8443",
+			},
+		},
+	}
+	if err := checkConfiguration(good); err != nil {
+		t.Errorf("checkConfiguration: %v", err)
+	}
+
+	bad := []*group.Configuration{
+		{UDPRange: "2000-1000"},
+		{UDPRange: "1000-2000", UDPMux: ":8445"},
+		{IPFamily: "ipv5"},
+		{EgressWorkers: -1},
+		{DrainTimeout: -1},
+		{ICEServers: []ice.Server{{}}},
+		{ICEServers: []ice.Server{{
+			URLs:           []string{"turn:turn.example.org"},
+			CredentialType: "unknown",
+		}}},
+		{QualityLog: &group.QualityLog{}},
+		{QualityLog: &group.QualityLog{File: "q", Interval: -1}},
+		{Cluster: &group.Cluster{}},
+		{Cluster: &group.Cluster{
+			Self:      "https://c.example.org",
+			Instances: []string{"https://a.example.org"},
+		}},
+		{Cluster: &group.Cluster{
+			Self:      "a.example.org",
+			Instances: []string{"a.example.org"},
+		}},
+		{Tracing: &group.Tracing{}},
+		{Tracing: &group.Tracing{Endpoint: "ftp://otel.example.org"}},
+		{Upload: &group.Upload{Type: "command"}},
+	}
+	for _, c := range bad {
+		if err := checkConfiguration(c); err == nil {
+			t.Errorf("%#v: accepted", c)
+		}
+	}
+}
+
+func TestApplyConfiguration(t *testing.T) {
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(nil)
+
+	httpAddr = ":8443"
+	relayOnly = false
+	defer func() {
+		httpAddr = ""
+		relayOnly = false
+	}()
+
+	old := &group.Configuration{HTTP: ":8443"}
+	conf := &group.Configuration{HTTP: ":443", RelayOnly: true}
+	err := applyConfiguration(old, conf, nil, false)
+	if err != nil {
+		t.Fatalf("applyConfiguration: %v", err)
+	}
+	if httpAddr != ":8443" {
+		t.Errorf("Applied http at runtime")
+	}
+	if !relayOnly {
+		t.Errorf("Didn't apply relayOnly")
+	}
+	out := buf.String()
+	if !strings.Contains(out, "http changed, restart required") ||
+		!strings.Contains(out, "applied relayOnly") {
+		t.Errorf("Bad log %v", out)
+	}
+
+	// flags take precedence
+	relayOnly = false
+	err = applyConfiguration(old, conf,
+		map[string]bool{"relay-only": true}, false,
+	)
+	if err != nil || relayOnly {
+		t.Errorf("Flag not honoured: %v", err)
+	}
+
+	err = applyConfiguration(nil, conf, nil, true)
+	if err != nil || httpAddr != ":443" || !relayOnly {
+		t.Errorf("Configuration not applied: %v", err)
+	}
+}
+
+func TestEffectiveConfiguration(t *testing.T) {
+	conf := &group.Configuration{
+		Admin: []group.ClientPattern{{
+			Username: "root",
+			Password: &group.Password{Key: "secret"},
+		}},
+		ICEServers: []ice.Server{{
+			URLs:       []string{"turn:turn.example.org"},
+			Credential: "secret",
+		}},
+	}
+	c := effectiveConfiguration(conf)
+	if c.Admin[0].Username != "root" || c.Admin[0].Password != nil ||
+		c.ICEServers[0].Credential != nil {
+		t.Errorf("Passwords not removed: %#v", c)
+	}
+	if conf.Admin[0].Password == nil ||
+		conf.ICEServers[0].Credential == nil {
+		t.Errorf("Original configuration modified")
+	}
+}
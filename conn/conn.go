@@ -27,6 +27,8 @@ type UpTrack interface {
 	Codec() webrtc.RTPCodecCapability
 	// GetPacket fetches a recent packet.  Returns 0 if the packet is
 	// not in cache, and, in that case, optionally schedules a NACK.
+	// When nack is true, a packet that is too old to be retransmitted
+	// is treated as missing, but is not nacked.
 	GetPacket(seqno uint16, result []byte, nack bool) uint16
 	RequestKeyframe() error
 }
@@ -5,18 +5,17 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/at-wat/ebml-go/mkvcore"
-	"github.com/at-wat/ebml-go/webm"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
 
 	"github.com/jech/samplebuilder"
@@ -24,9 +23,13 @@ import (
 	gcodecs "github.com/jech/galene/codecs"
 	"github.com/jech/galene/conn"
 	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/mixer"
 	"github.com/jech/galene/rtptime"
 )
 
+var logger = logging.New("diskwriter")
+
 const (
 	audioMaxLate = 32
 	videoMaxLate = 256
@@ -34,13 +37,46 @@ const (
 
 var Directory string
 
+// Finished, if not nil, is called with the name of every recording file
+// once it has been closed.  It must not block.
+var Finished func(filename string)
+
+func finished(filename string) {
+	if Finished != nil {
+		Finished(filename)
+	}
+}
+
 type Client struct {
-	group *group.Group
-	id    string
+	group  *group.Group
+	id     string
+	format string
+	// the duration of segments, 0 if recordings are not split
+	segment time.Duration
 
 	mu     sync.Mutex
 	down   map[string]*diskConn
 	closed bool
+
+	// for a mixed recording, the output, the time at which it was
+	// opened, and the subscription to the group's mixer
+	wav         *wavWriter
+	wavOpened   time.Time
+	unsubscribe func()
+}
+
+// Check returns an error if recordings cannot be written to Directory.
+func Check() error {
+	err := os.MkdirAll(Directory, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(Directory, ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
 
 func newId() string {
@@ -49,8 +85,127 @@ func newId() string {
 	return hex.EncodeToString(b)
 }
 
-func New(g *group.Group) *Client {
-	return &Client{group: g, id: newId()}
+// New returns a client that records each stream of a group to its own
+// file in the given format, "webm", "mp4" or "ogg", the latter recording
+// just the audio.  If format is empty, the group's default format is
+// used.
+func New(g *group.Group, format string) (*Client, error) {
+	if format == "" {
+		format = g.Description().RecordingFormat
+	}
+	switch format {
+	case "":
+		format = "webm"
+	case "webm", "mp4", "ogg":
+	default:
+		return nil, errors.New("unknown recording format " + format)
+	}
+	err := checkQuota(
+		filepath.Join(Directory, g.Name()),
+		g.Description().RecordingQuota,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		group:   g,
+		id:      newId(),
+		format:  format,
+		segment: segmentDuration(g),
+	}, nil
+}
+
+func segmentDuration(g *group.Group) time.Duration {
+	return time.Duration(g.Description().RecordingSegment) * time.Second
+}
+
+// NewMixed returns a client that records the output of the group's
+// audio mixer to a WAV file.
+func NewMixed(g *group.Group) (*Client, error) {
+	err := checkQuota(
+		filepath.Join(Directory, g.Name()),
+		g.Description().RecordingQuota,
+	)
+	if err != nil {
+		return nil, err
+	}
+	wav, err := openMixed(g)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{
+		group:     g,
+		id:        newId(),
+		segment:   segmentDuration(g),
+		wav:       wav,
+		wavOpened: time.Now(),
+	}
+	unsubscribe, err := mixer.Subscribe(g, client.writeMixed)
+	if err != nil {
+		name := wav.file.Name()
+		wav.close()
+		os.Remove(name)
+		return nil, err
+	}
+	client.unsubscribe = unsubscribe
+	return client, nil
+}
+
+func openMixed(g *group.Group) (*wavWriter, error) {
+	directory := filepath.Join(Directory, g.Name())
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := openDiskFile(directory, "mixed", "wav")
+	if err != nil {
+		return nil, err
+	}
+	wav, err := newWAVWriter(file, mixer.SampleRate)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return wav, nil
+}
+
+func (client *Client) writeMixed(samples []int16) {
+	client.mu.Lock()
+	var err error
+	if !client.closed && client.segment > 0 &&
+		time.Since(client.wavOpened) >= client.segment {
+		// start a new segment; the old one is only closed once
+		// the new one has been successfully opened
+		var wav *wavWriter
+		wav, err = openMixed(client.group)
+		if err == nil {
+			name := client.wav.file.Name()
+			client.wav.close()
+			finished(name)
+			client.wav = wav
+			client.wavOpened = time.Now()
+		}
+	}
+	wav := client.wav
+	client.mu.Unlock()
+
+	if err == nil {
+		err = wav.write(samples)
+	}
+	if err != nil {
+		client.mu.Lock()
+		closed := client.closed
+		client.mu.Unlock()
+		if !closed {
+			message := "Write to disk: " + err.Error()
+			logger.Warnf("%v", message)
+			client.group.WallOps(message)
+			client.group.Notify("error", "", message)
+			client.Close()
+			group.DelClient(client)
+		}
+	}
 }
 
 func (client *Client) Group() *group.Group {
@@ -77,6 +232,10 @@ func (client *Client) Permissions() []string {
 	return []string{"system"}
 }
 
+// Recorder implements group.Recorder.
+func (client *Client) Recorder() {
+}
+
 func (client *Client) Data() map[string]interface{} {
 	return nil
 }
@@ -97,6 +256,12 @@ func (client *Client) Close() error {
 		down.Close()
 	}
 	client.down = nil
+	if !client.closed && client.wav != nil {
+		client.unsubscribe()
+		name := client.wav.file.Name()
+		client.wav.close()
+		finished(name)
+	}
 	client.closed = true
 	return nil
 }
@@ -123,13 +288,18 @@ func (client *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []c
 		return errors.New("disk client is closed")
 	}
 
+	if client.wav != nil {
+		// mixed recordings get their audio from the mixer
+		return nil
+	}
+
 	if replace != "" {
 		rp := client.down[replace]
 		if rp != nil {
 			rp.Close()
 			delete(client.down, replace)
 		} else {
-			log.Printf("Disk writer: replacing unknown connection")
+			logger.Warnf("Disk writer: replacing unknown connection")
 		}
 	}
 
@@ -143,10 +313,18 @@ func (client *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []c
 		return nil
 	}
 
+	if client.format == "ogg" {
+		tracks = audioTracks(tracks)
+		if len(tracks) == 0 {
+			return nil
+		}
+	}
+
 	directory := filepath.Join(Directory, client.group.Name())
 	err := os.MkdirAll(directory, 0700)
 	if err != nil {
 		g.WallOps("Write to disk: " + err.Error())
+		g.Notify("error", "", "Write to disk: "+err.Error())
 		return err
 	}
 
@@ -157,6 +335,7 @@ func (client *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []c
 	down, err := newDiskConn(client, directory, up, tracks)
 	if err != nil {
 		g.WallOps("Write to disk: " + err.Error())
+		g.Notify("error", "", "Write to disk: "+err.Error())
 		return err
 	}
 
@@ -164,14 +343,30 @@ func (client *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []c
 	return nil
 }
 
+// audioTracks returns the audio tracks among tracks.
+func audioTracks(tracks []conn.UpTrack) []conn.UpTrack {
+	var audio []conn.UpTrack
+	for _, t := range tracks {
+		if t.Kind() == webrtc.RTPCodecTypeAudio {
+			audio = append(audio, t)
+		}
+	}
+	return audio
+}
+
 type diskConn struct {
 	client    *Client
 	directory string
 	username  string
+	format    string
+	segment   time.Duration
 	hasVideo  bool
+	// memory accounted to the group
+	buffered int64
 
 	mu            sync.Mutex
 	file          *os.File
+	opened        time.Time
 	remote        conn.Up
 	tracks        []*diskTrack
 	width, height uint32
@@ -186,8 +381,9 @@ func (conn *diskConn) warn(message string) {
 	if now.Sub(conn.lastWarning) < 10*time.Second {
 		return
 	}
-	log.Println(message)
+	logger.Warnf("%v", message)
 	conn.client.group.WallOps(message)
+	conn.client.group.Notify("error", "", message)
 	conn.lastWarning = now
 }
 
@@ -203,9 +399,34 @@ func (conn *diskConn) open(extension string) error {
 	}
 
 	conn.file = file
+	conn.opened = time.Now()
 	return nil
 }
 
+// segmentEnded returns true if the current file has reached the
+// duration of a segment.
+// Called locked.
+func (conn *diskConn) segmentEnded() bool {
+	return conn.segment > 0 && conn.file != nil &&
+		time.Since(conn.opened) >= conn.segment
+}
+
+// rollover closes the current file without resetting the origin, so
+// that the next file continues the recording without a gap.
+// Called locked.
+func (conn *diskConn) rollover() {
+	for _, t := range conn.tracks {
+		if t.writer != nil {
+			t.writer.Close()
+			t.writer = nil
+		}
+	}
+	if conn.file != nil {
+		finished(conn.file.Name())
+		conn.file = nil
+	}
+}
+
 // called locked
 func (conn *diskConn) close() []*diskTrack {
 	conn.originLocal = time.Time{}
@@ -221,12 +442,17 @@ func (conn *diskConn) close() []*diskTrack {
 		t.origin = none
 		tracks = append(tracks, t)
 	}
-	conn.file = nil
+	if conn.file != nil {
+		// writeBuffered may have closed the file already
+		finished(conn.file.Name())
+		conn.file = nil
+	}
 	return tracks
 }
 
 func (conn *diskConn) Close() error {
 	conn.remote.DelLocal(conn)
+	conn.client.group.Memory(group.MemoryRecording).Add(-conn.buffered)
 
 	conn.mu.Lock()
 	tracks := conn.close()
@@ -271,31 +497,43 @@ func openDiskFile(directory, username, extension string) (*os.File, error) {
 	return nil, errors.New("couldn't create file")
 }
 
-type maybeUint32 uint64
+type maybeInt64 struct {
+	value int64
+	valid bool
+}
+
+var none = maybeInt64{}
 
-const none maybeUint32 = 0
+func some(value int64) maybeInt64 {
+	return maybeInt64{value: value, valid: true}
+}
 
-func some(value uint32) maybeUint32 {
-	return maybeUint32(uint64(1<<32) | uint64(value))
+func valid(m maybeInt64) bool {
+	return m.valid
 }
 
-func valid(m maybeUint32) bool {
-	return (m & (1 << 32)) != 0
+func value(m maybeInt64) int64 {
+	return m.value
 }
 
-func value(m maybeUint32) uint32 {
-	return uint32(m)
+// A trackWriter writes the samples of a track to a file.  The timestamp
+// is in milliseconds.
+type trackWriter interface {
+	Write(keyframe bool, timestamp int64, data []byte) (int, error)
+	Close() error
 }
 
 type diskTrack struct {
 	remote conn.UpTrack
 	conn   *diskConn
 
-	writer    mkvcore.BlockWriteCloser
-	builder   *samplebuilder.SampleBuilder
-	lastSeqno maybeUint32
+	writer     trackWriter
+	builder    *samplebuilder.SampleBuilder
+	seqnos     rtptime.SeqnoExtender
+	timestamps rtptime.TimestampExtender
 
-	origin maybeUint32
+	// extended timestamp of the start of the file
+	origin maybeInt64
 
 	remoteNTP uint64
 	remoteRTP uint32
@@ -303,6 +541,9 @@ type diskTrack struct {
 	kfRequested time.Time
 	lastKf      time.Time
 	savedKf     *rtp.Packet
+
+	// the last parameter sets seen, for H.264
+	sps, pps []byte
 }
 
 func newDiskConn(client *Client, directory string, up conn.Up, remoteTracks []conn.UpTrack) (*diskConn, error) {
@@ -310,7 +551,8 @@ func newDiskConn(client *Client, directory string, up conn.Up, remoteTracks []co
 
 	for _, remote := range remoteTracks {
 		codec := remote.Codec().MimeType
-		if strings.EqualFold(codec, "audio/opus") {
+		if strings.EqualFold(codec, "audio/opus") ||
+			strings.EqualFold(codec, "audio/red") {
 			if audio == nil {
 				audio = remote
 			} else {
@@ -346,6 +588,8 @@ func newDiskConn(client *Client, directory string, up conn.Up, remoteTracks []co
 		client:    client,
 		directory: directory,
 		username:  username,
+		format:    client.format,
+		segment:   client.segment,
 		tracks:    make([]*diskTrack, 0, len(tracks)),
 		remote:    up,
 	}
@@ -358,6 +602,11 @@ func newDiskConn(client *Client, directory string, up conn.Up, remoteTracks []co
 				audioMaxLate,
 				&codecs.OpusPacket{}, codec.ClockRate,
 			)
+		} else if strings.EqualFold(codec.MimeType, "audio/red") {
+			builder = samplebuilder.New(
+				audioMaxLate,
+				&redPacket{}, codec.ClockRate,
+			)
 		} else if strings.EqualFold(codec.MimeType, "video/vp8") {
 			builder = samplebuilder.New(
 				videoMaxLate,
@@ -395,7 +644,7 @@ func newDiskConn(client *Client, directory string, up conn.Up, remoteTracks []co
 	for _, t := range conn.tracks {
 		err := t.remote.AddLocal(t)
 		if err != nil {
-			log.Printf("Couldn't add disk track: %v", err)
+			logger.Warnf("Couldn't add disk track: %v", err)
 			conn.warn("Couldn't add disk track: " + err.Error())
 		}
 	}
@@ -404,9 +653,38 @@ func newDiskConn(client *Client, directory string, up conn.Up, remoteTracks []co
 		return nil, err
 	}
 
+	for _, t := range conn.tracks {
+		conn.buffered += maxBuffered(t.remote.Codec().MimeType)
+	}
+	client.group.Memory(group.MemoryRecording).Add(conn.buffered)
+
 	return &conn, nil
 }
 
+// redPacket is a depacketizer for RED that only keeps the primary
+// encoding, which is assumed to be Opus.
+type redPacket struct {
+	codecs.OpusPacket
+}
+
+func (p *redPacket) Unmarshal(packet []byte) ([]byte, error) {
+	primary, err := gcodecs.REDPrimary(packet)
+	if err != nil {
+		return nil, err
+	}
+	return p.OpusPacket.Unmarshal(primary)
+}
+
+// maxBuffered returns an upper bound on the number of bytes retained by
+// the samplebuilder of a track.
+func maxBuffered(codec string) int64 {
+	if strings.EqualFold(codec, "audio/opus") ||
+		strings.EqualFold(codec, "audio/red") {
+		return audioMaxLate * 1504
+	}
+	return videoMaxLate * 1504
+}
+
 func (t *diskTrack) SetCname(string) {
 }
 
@@ -424,33 +702,30 @@ func (t *diskTrack) Write(buf []byte) (int, error) {
 	p := new(rtp.Packet)
 	err := p.Unmarshal(data)
 	if err != nil {
-		log.Printf("Diskwriter: %v", err)
+		logger.Warnf("Diskwriter: %v", err)
 		return 0, nil
 	}
 
-	if valid(t.lastSeqno) {
-		lastSeqno := uint16(value(t.lastSeqno))
-		if ((p.SequenceNumber - lastSeqno) & 0x8000) == 0 {
+	last, lastValid := t.seqnos.Highest()
+	seqno := t.seqnos.Extend(p.SequenceNumber)
+	if lastValid {
+		if seqno >= last {
 			// jump forward
-			count := p.SequenceNumber - lastSeqno
+			count := seqno - last
 			if count < 256 {
-				for i := uint16(1); i < count; i++ {
-					fetch(t, lastSeqno+i)
+				for i := int64(1); i < count; i++ {
+					fetch(t, uint16(last+i))
 				}
 			} else {
 				requestKeyframe(t)
 			}
-			t.lastSeqno = some(uint32(p.SequenceNumber))
 		} else {
 			// jump backward
-			count := lastSeqno - p.SequenceNumber
-			if count >= 512 {
-				t.lastSeqno = none
+			if last-seqno >= 512 {
+				t.seqnos.Reset()
 				requestKeyframe(t)
 			}
 		}
-	} else {
-		t.lastSeqno = some(uint32(p.SequenceNumber))
 	}
 
 	err = t.writeRTP(p)
@@ -486,6 +761,7 @@ func requestKeyframe(t *diskTrack) {
 // writeRTP writes the packet without fetching lost packets
 // Called locked.
 func (t *diskTrack) writeRTP(p *rtp.Packet) error {
+	ts := t.timestamps.Extend(p.Timestamp)
 	codec := t.remote.Codec().MimeType
 	if len(codec) > 6 && strings.EqualFold(codec[:6], "video/") {
 		kf, _ := gcodecs.Keyframe(codec, p)
@@ -494,7 +770,7 @@ func (t *diskTrack) writeRTP(p *rtp.Packet) error {
 			t.lastKf = time.Now()
 			if !valid(t.origin) {
 				t.setOrigin(
-					p.Timestamp, time.Now(),
+					ts, time.Now(),
 					t.remote.Codec().ClockRate,
 				)
 			}
@@ -506,7 +782,7 @@ func (t *diskTrack) writeRTP(p *rtp.Packet) error {
 	if !valid(t.origin) {
 		if !t.conn.hasVideo || !t.conn.originLocal.Equal(time.Time{}) {
 			t.setOrigin(
-				p.Timestamp, time.Now(),
+				ts, time.Now(),
 				t.remote.Codec().ClockRate,
 			)
 		}
@@ -525,23 +801,24 @@ func (t *diskTrack) writeBuffered(force bool) error {
 
 	for {
 		var sample *media.Sample
-		var ts uint32
+		var rtpts uint32
 		if !force {
-			sample, ts = t.builder.PopWithTimestamp()
+			sample, rtpts = t.builder.PopWithTimestamp()
 		} else {
-			sample, ts = t.builder.ForcePopWithTimestamp()
+			sample, rtpts = t.builder.ForcePopWithTimestamp()
 		}
 		if sample == nil {
 			return nil
 		}
+		ts := t.timestamps.Peek(rtpts)
 
-		if valid(t.origin) && int32(ts-value(t.origin)) < 0 {
+		if valid(t.origin) && ts < value(t.origin) {
 			if value(t.origin)-ts < 0x10000 {
 				// late packet before origin, drop
 				continue
 			}
-			// we've gone around 2^31 timestamps, force
-			// creating a new file to avoid wraparound
+			// the timestamps jumped backwards, which happens
+			// when the sender restarts; start a new file
 			t.conn.close()
 		}
 
@@ -550,13 +827,16 @@ func (t *diskTrack) writeBuffered(force bool) error {
 			if t.savedKf == nil {
 				keyframe = false
 			} else {
-				keyframe = (ts == t.savedKf.Timestamp)
+				keyframe = (rtpts == t.savedKf.Timestamp)
 			}
 
 			if keyframe {
 				w, h := gcodecs.KeyframeDimensions(
 					codec, t.savedKf,
 				)
+				if strings.EqualFold(codec, "video/h264") {
+					w, h = t.h264Dimensions(sample.Data)
+				}
 				err := t.conn.initWriter(w, h, t, ts)
 				if err != nil {
 					t.conn.warn(
@@ -564,10 +844,13 @@ func (t *diskTrack) writeBuffered(force bool) error {
 					)
 					return err
 				}
+			} else if t.conn.segmentEnded() {
+				// the next segment must start with a keyframe
+				requestKeyframe(t)
 			}
 		} else {
 			keyframe = true
-			if t.writer == nil {
+			if t.writer == nil || t.conn.segmentEnded() {
 				if !t.conn.hasVideo {
 					err := t.conn.initWriter(0, 0, t, ts)
 					if err != nil {
@@ -586,13 +869,13 @@ func (t *diskTrack) writeBuffered(force bool) error {
 		}
 
 		if !valid(t.origin) {
-			log.Println("Invalid origin")
+			logger.Warnf("Invalid origin")
 			return nil
 		}
 
 		tm := (ts - value(t.origin)) /
-			(t.remote.Codec().ClockRate / 1000)
-		_, err := t.writer.Write(keyframe, int64(tm), sample.Data)
+			int64(t.remote.Codec().ClockRate/1000)
+		_, err := t.writer.Write(keyframe, tm, sample.Data)
 		if err != nil {
 			return err
 		}
@@ -600,11 +883,11 @@ func (t *diskTrack) writeBuffered(force bool) error {
 }
 
 // setOrigin sets the origin of track t after receiving a packet with
-// timestamp ts at local time now.
+// extended timestamp ts at local time now.
 // called locked
-func (t *diskTrack) setOrigin(ts uint32, now time.Time, clockrate uint32) {
-	sub := func(a, b uint32, hz uint32) time.Duration {
-		return rtptime.ToDuration(int64(int32(a-b)), hz)
+func (t *diskTrack) setOrigin(ts int64, now time.Time, clockrate uint32) {
+	sub := func(a int64, b uint32, hz uint32) time.Duration {
+		return rtptime.ToDuration(a-rtptime.ExtendTimestamp(a, b), hz)
 	}
 
 	if t.conn.originLocal.Equal(time.Time{}) {
@@ -624,11 +907,11 @@ func (t *diskTrack) setOrigin(ts uint32, now time.Time, clockrate uint32) {
 		)
 		origin := rtptime.NTPToTime(t.conn.originRemote)
 		delta := rtptime.FromDuration(remote.Sub(origin), clockrate)
-		t.origin = some(ts - uint32(delta))
+		t.origin = some(ts - delta)
 	} else {
 		d := now.Sub(t.conn.originLocal)
 		delta := rtptime.FromDuration(d, clockrate)
-		t.origin = some(ts - uint32(delta))
+		t.origin = some(ts - delta)
 		if t.remoteNTP != 0 {
 			remote := rtptime.NTPToTime(t.remoteNTP).Add(
 				sub(ts, t.remoteRTP, clockrate),
@@ -651,7 +934,7 @@ func (t *diskTrack) SetTimeOffset(ntp uint64, rtp uint32) {
 func (t *diskTrack) setTimeOffset(ntp uint64, rtp uint32, clockrate uint32) {
 	if valid(t.origin) {
 		local := rtptime.ToDuration(
-			int64(int32(rtp-value(t.origin))), clockrate,
+			t.timestamps.Peek(rtp)-value(t.origin), clockrate,
 		)
 		if t.conn.originRemote == 0 {
 			t.conn.originRemote =
@@ -661,7 +944,7 @@ func (t *diskTrack) setTimeOffset(ntp uint64, rtp uint32, clockrate uint32) {
 			remote := rtptime.NTPToTime(ntp).Sub(
 				rtptime.NTPToTime(t.conn.originRemote))
 			delta := rtptime.FromDuration(remote-local, clockrate)
-			t.origin = some(value(t.origin) - uint32(delta))
+			t.origin = some(value(t.origin) - delta)
 		}
 	}
 
@@ -670,15 +953,15 @@ func (t *diskTrack) setTimeOffset(ntp uint64, rtp uint32, clockrate uint32) {
 }
 
 // adjustOrigin adjusts all origin-related fields of all tracks so that
-// the origin of track t is equal to ts.
+// the origin of track t is equal to the extended timestamp ts.
 // Called locked.
-func (t *diskTrack) adjustOrigin(ts uint32) {
+func (t *diskTrack) adjustOrigin(ts int64) {
 	if !valid(t.origin) || value(t.origin) == ts {
 		return
 	}
 
 	offset := rtptime.ToDuration(
-		int64(int32(ts-value(t.origin))), t.remote.Codec().ClockRate,
+		ts-value(t.origin), t.remote.Codec().ClockRate,
 	)
 
 	if !t.conn.originLocal.Equal(time.Time{}) {
@@ -696,93 +979,82 @@ func (t *diskTrack) adjustOrigin(ts uint32) {
 	for _, tt := range t.conn.tracks {
 		if valid(tt.origin) {
 			tt.origin = some(value(tt.origin) +
-				uint32(rtptime.FromDuration(
+				rtptime.FromDuration(
 					offset,
 					tt.remote.Codec().ClockRate,
-				)),
+				),
 			)
 		}
 	}
 }
 
+// h264Dimensions records the parameter sets contained in an H.264
+// keyframe, and returns the dimensions of the video.
+// Called locked.
+func (t *diskTrack) h264Dimensions(data []byte) (uint32, uint32) {
+	sps, pps := parameterSets(data)
+	if sps != nil && pps != nil {
+		t.sps = append([]byte(nil), sps...)
+		t.pps = append([]byte(nil), pps...)
+	}
+	if t.sps == nil {
+		return 0, 0
+	}
+	info, err := gcodecs.ParseSPS(t.sps)
+	if err != nil {
+		return 0, 0
+	}
+	return info.Width, info.Height
+}
+
 // called locked
-func (conn *diskConn) initWriter(width, height uint32, track *diskTrack, ts uint32) error {
+func (conn *diskConn) initWriter(width, height uint32, track *diskTrack, ts int64) error {
 	if conn.file != nil {
-		if width == conn.width && height == conn.height {
-			return nil
-		} else {
+		if width != conn.width || height != conn.height {
 			conn.close()
+		} else if conn.segmentEnded() {
+			conn.rollover()
+		} else {
+			return nil
 		}
 	}
 
-	isWebm := true
-	var desc []mkvcore.TrackDescription
-	for i, t := range conn.tracks {
-		var entry webm.TrackEntry
+	if conn.format == "ogg" {
+		return conn.initOggWriter(track, ts)
+	}
+
+	configs := make([]trackConfig, 0, len(conn.tracks))
+	for _, t := range conn.tracks {
 		codec := t.remote.Codec()
-		if strings.EqualFold(codec.MimeType, "audio/opus") {
-			entry = webm.TrackEntry{
-				Name:        "Audio",
-				TrackNumber: uint64(i + 1),
-				CodecID:     "A_OPUS",
-				TrackType:   2,
-				Audio: &webm.Audio{
-					SamplingFrequency: float64(codec.ClockRate),
-					Channels:          uint64(codec.Channels),
-				},
-			}
-		} else if strings.EqualFold(codec.MimeType, "video/vp8") {
-			entry = webm.TrackEntry{
-				Name:        "Video",
-				TrackNumber: uint64(i + 1),
-				CodecID:     "V_VP8",
-				TrackType:   1,
-				Video: &webm.Video{
-					PixelWidth:  uint64(width),
-					PixelHeight: uint64(height),
-				},
-			}
-		} else if strings.EqualFold(codec.MimeType, "video/vp9") {
-			entry = webm.TrackEntry{
-				Name:        "Video",
-				TrackNumber: uint64(i + 1),
-				CodecID:     "V_VP9",
-				TrackType:   1,
-				Video: &webm.Video{
-					PixelWidth:  uint64(width),
-					PixelHeight: uint64(height),
-				},
-			}
-		} else if strings.EqualFold(codec.MimeType, "video/h264") {
-			entry = webm.TrackEntry{
-				Name:        "Video",
-				TrackNumber: uint64(i + 1),
-				CodecID:     "V_MPEG4/ISO/AVC",
-				TrackType:   1,
-				Video: &webm.Video{
-					PixelWidth:  uint64(width),
-					PixelHeight: uint64(height),
-				},
-			}
-			isWebm = false
-		} else {
-			return errors.New("unknown track type")
+		if strings.EqualFold(codec.MimeType, "video/h264") &&
+			(t.sps == nil || t.pps == nil) {
+			// the file cannot be written without the
+			// parameter sets, wait for the next keyframe
+			requestKeyframe(t)
+			return nil
 		}
-		desc = append(desc,
-			mkvcore.TrackDescription{
-				TrackNumber: uint64(i + 1),
-				TrackEntry:  entry,
-			},
-		)
+		config := trackConfig{
+			codec:    codec.MimeType,
+			channels: codec.Channels,
+			sps:      t.sps,
+			pps:      t.pps,
+			profile:  fmtpProfile(codec.SDPFmtpLine),
+		}
+		if strings.HasPrefix(strings.ToLower(codec.MimeType), "video/") {
+			config.width = width
+			config.height = height
+		}
+		configs = append(configs, config)
 	}
 
-	extension := "webm"
-	header := webm.DefaultEBMLHeader
-	if !isWebm {
+	extension := "mp4"
+	newWriter := newMP4Writer
+	if conn.format != "mp4" {
 		extension = "mkv"
-		h := *header
-		h.DocType = "matroska"
-		header = &h
+		if isWebM(configs) {
+			extension = "webm"
+		}
+		newWriter = newMKVWriter
 	}
 
 	if track != nil {
@@ -794,35 +1066,14 @@ func (conn *diskConn) initWriter(width, height uint32, track *diskTrack, ts uint
 		return err
 	}
 
-	interceptor, err := mkvcore.NewMultiTrackBlockSorter(
-		// must be larger than the samplebuilder's MaxLate.
-		mkvcore.WithMaxDelayedPackets(videoMaxLate+16),
-		mkvcore.WithSortRule(mkvcore.BlockSorterWriteOutdated),
-	)
+	ws, err := newWriter(conn.file, configs)
 	if err != nil {
 		conn.file.Close()
+		os.Remove(conn.file.Name())
 		conn.file = nil
 		return err
 	}
 
-	ws, err := mkvcore.NewSimpleBlockWriter(
-		conn.file, desc,
-		mkvcore.WithEBMLHeader(header),
-		mkvcore.WithSegmentInfo(webm.DefaultSegmentInfo),
-		mkvcore.WithBlockInterceptor(interceptor),
-	)
-	if err != nil {
-		conn.file.Close()
-		conn.file = nil
-		return err
-	}
-
-	if len(ws) != len(conn.tracks) {
-		conn.file.Close()
-		conn.file = nil
-		return errors.New("unexpected number of writers")
-	}
-
 	conn.width = width
 	conn.height = height
 
@@ -832,6 +1083,47 @@ func (conn *diskConn) initWriter(width, height uint32, track *diskTrack, ts uint
 	return nil
 }
 
+// fmtpProfile returns the value of the profile-id parameter of a VP9
+// fmtp line.
+func fmtpProfile(fmtp string) uint8 {
+	profile, err := strconv.ParseUint(
+		group.FmtpValue(fmtp, "profile-id"), 10, 8,
+	)
+	if err != nil {
+		return 0
+	}
+	return uint8(profile)
+}
+
 func (t *diskTrack) GetMaxBitrate() (uint64, int, int) {
 	return ^uint64(0), -1, -1
 }
+
+// called locked
+func (conn *diskConn) initOggWriter(track *diskTrack, ts int64) error {
+	if len(conn.tracks) != 1 {
+		return errors.New("unexpected number of tracks")
+	}
+
+	if track != nil {
+		track.adjustOrigin(ts)
+	}
+
+	err := conn.open("ogg")
+	if err != nil {
+		return err
+	}
+
+	w, err := newOggWriter(
+		conn.file, conn.tracks[0].remote.Codec().Channels,
+	)
+	if err != nil {
+		conn.file.Close()
+		os.Remove(conn.file.Name())
+		conn.file = nil
+		return err
+	}
+
+	conn.tracks[0].writer = w
+	return nil
+}
@@ -1,9 +1,19 @@
 package diskwriter
 
 import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/jech/samplebuilder"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
 	"github.com/jech/galene/rtptime"
 )
 
@@ -155,3 +165,201 @@ func TestAdjustOriginLocalRemote(t *testing.T) {
 		t.Errorf("Expected 132, got %v", value(c.tracks[0].origin))
 	}
 }
+
+func TestTimeOffsetWraparound(t *testing.T) {
+	now := time.Now()
+
+	c := &diskConn{
+		tracks: []*diskTrack{
+			&diskTrack{},
+		},
+	}
+	for _, t := range c.tracks {
+		t.conn = c
+	}
+	tr := c.tracks[0]
+	origin := tr.timestamps.Extend(0xFFFFFF00)
+	tr.setOrigin(origin, now, 90000)
+
+	// a little over 13 hours later, the timestamp has wrapped around
+	// exactly once
+	for i := 1; i <= 4; i++ {
+		tr.timestamps.Extend(uint32(0xFFFFFF00 + i<<30))
+	}
+	later := now.Add(rtptime.ToDuration(1<<32, 90000))
+	tr.setTimeOffset(rtptime.TimeToNTP(later), 0xFFFFFF00, 90000)
+
+	d := now.Sub(rtptime.NTPToTime(c.originRemote))
+	if d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("Expected %v, got %v (delta %v)",
+			rtptime.TimeToNTP(now), c.originRemote, d)
+	}
+	if tr.origin != some(origin) {
+		t.Errorf("Expected %v, got %v", origin, value(tr.origin))
+	}
+}
+
+func TestWAVWriter(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.wav"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w, err := newWAVWriter(f, 8000)
+	if err != nil {
+		t.Fatalf("newWAVWriter: %v", err)
+	}
+	err = w.write([]int16{1, -1, 0x1234})
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	err = w.close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if w.write([]int16{0}) == nil {
+		t.Errorf("write succeeded after close")
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(data) != 44+6 {
+		t.Fatalf("Bad length %v", len(data))
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:16]) != "WAVEfmt " ||
+		string(data[36:40]) != "data" {
+		t.Errorf("Bad header %q", data[:44])
+	}
+	if v := binary.LittleEndian.Uint32(data[4:]); v != 36+6 {
+		t.Errorf("Bad RIFF size %v", v)
+	}
+	if v := binary.LittleEndian.Uint32(data[24:]); v != 8000 {
+		t.Errorf("Bad rate %v", v)
+	}
+	if v := binary.LittleEndian.Uint32(data[40:]); v != 6 {
+		t.Errorf("Bad data size %v", v)
+	}
+	expected := []byte{1, 0, 0xff, 0xff, 0x34, 0x12}
+	if !bytes.Equal(data[44:], expected) {
+		t.Errorf("Bad data %v", data[44:])
+	}
+}
+
+func TestREDPacket(t *testing.T) {
+	var p redPacket
+	data, err := p.Unmarshal([]byte{0x80 | 111, 0, 0, 1, 111, 1, 2, 3})
+	if err != nil || !bytes.Equal(data, []byte{2, 3}) {
+		t.Errorf("Expected [2 3], got %v (%v)", data, err)
+	}
+	_, err = p.Unmarshal([]byte{0x80 | 111, 0, 0, 4, 111, 1})
+	if err == nil {
+		t.Errorf("Truncated packet: no error")
+	}
+}
+
+type fakeTrack struct {
+	codec webrtc.RTPCodecCapability
+}
+
+func (t *fakeTrack) AddLocal(conn.DownTrack) error {
+	return nil
+}
+
+func (t *fakeTrack) DelLocal(conn.DownTrack) bool {
+	return false
+}
+
+func (t *fakeTrack) Kind() webrtc.RTPCodecType {
+	return webrtc.RTPCodecTypeAudio
+}
+
+func (t *fakeTrack) Label() string {
+	return ""
+}
+
+func (t *fakeTrack) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+func (t *fakeTrack) GetPacket(uint16, []byte, bool) uint16 {
+	return 0
+}
+
+func (t *fakeTrack) RequestKeyframe() error {
+	return nil
+}
+
+func TestSegments(t *testing.T) {
+	c := &diskConn{
+		directory: t.TempDir(),
+		format:    "ogg",
+		segment:   time.Minute,
+	}
+	track := &diskTrack{
+		remote: &fakeTrack{webrtc.RTPCodecCapability{
+			MimeType:  "audio/opus",
+			ClockRate: 48000,
+			Channels:  2,
+		}},
+		builder: samplebuilder.New(
+			audioMaxLate, &codecs.OpusPacket{}, 48000,
+		),
+		conn: c,
+	}
+	c.tracks = []*diskTrack{track}
+
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			// pretend that the segment is over
+			c.opened = c.opened.Add(-time.Hour)
+		}
+		err := track.writeRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    111,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 960),
+			},
+			Payload: []byte{0xfc, byte(i)},
+		})
+		if err != nil {
+			t.Fatalf("writeRTP: %v", err)
+		}
+	}
+	c.close()
+
+	files, err := filepath.Glob(filepath.Join(c.directory, "*.ogg"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 files, got %v (%v)", files, err)
+	}
+
+	// each packet is in exactly one segment, and each segment starts
+	// at time 0
+	seen := make(map[byte]bool)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		pages := readOggPages(t, data)
+		var packets [][]byte
+		for _, p := range pages[2:] {
+			packets = append(packets, p.packets...)
+		}
+		last := pages[len(pages)-1]
+		if last.granule != uint64(960*len(packets)) {
+			t.Errorf("%v: %v packets, granule %v",
+				f, len(packets), last.granule)
+		}
+		for _, p := range packets {
+			if len(p) != 2 || seen[p[1]] {
+				t.Errorf("Unexpected packet %v", p)
+			}
+			seen[p[1]] = true
+		}
+	}
+	if len(seen) != 100 {
+		t.Errorf("Expected 100 packets, got %v", len(seen))
+	}
+}
@@ -0,0 +1,824 @@
+package diskwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+
+	"github.com/jech/galene/bmff"
+	gcodecs "github.com/jech/galene/codecs"
+)
+
+// This file implements a Matroska (and WebM) writer.  Unlike a streaming
+// writer, it writes an index (the Cues) and the duration when the file
+// is closed, so that recordings are seekable.  Clusters are written
+// whole, and the size of the Segment is only filled in at the end, so
+// that a file interrupted by a crash remains playable, and can be
+// finalised by Recover.
+
+// clusters are cut at video keyframes, or when they span this many
+// milliseconds
+const clusterDuration = 5000
+
+// the timestamps of blocks are 16-bit offsets from that of the cluster
+const maxClusterSpan = 30000
+
+// Matroska element IDs
+const (
+	idEBML               = 0x1A45DFA3
+	idSegment            = 0x18538067
+	idSeekHead           = 0x114D9B74
+	idSeek               = 0x4DBB
+	idSeekID             = 0x53AB
+	idSeekPosition       = 0x53AC
+	idInfo               = 0x1549A966
+	idTimecodeScale      = 0x2AD7B1
+	idMuxingApp          = 0x4D80
+	idWritingApp         = 0x5741
+	idDuration           = 0x4489
+	idTracks             = 0x1654AE6B
+	idCluster            = 0x1F43B675
+	idTimecode           = 0xE7
+	idSimpleBlock        = 0xA3
+	idCues               = 0x1C53BB6B
+	idCuePoint           = 0xBB
+	idCueTime            = 0xB3
+	idCueTrackPositions  = 0xB7
+	idCueTrack           = 0xF7
+	idCueClusterPosition = 0xF1
+	idVoid               = 0xEC
+)
+
+// the size of a Segment that is still being written, on eight bytes
+const unknownSize = 0x01FFFFFFFFFFFFFF
+
+const muxingApp = "Galene"
+
+var errMalformed = errors.New("malformed Matroska file")
+
+func u16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func ebmlID(id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return u32(id)
+	case id >= 1<<16:
+		return u32(id)[1:]
+	case id >= 1<<8:
+		return u16(uint16(id))
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// ebmlSize encodes a variable-length integer in as few bytes as possible.
+func ebmlSize(size uint64) []byte {
+	n := 1
+	// the value with all bits set means unknown
+	for n < 8 && size >= 1<<(7*n)-1 {
+		n++
+	}
+	return u64(size | 1<<(7*n))[8-n:]
+}
+
+// ebmlElement returns an EBML element with the given contents.
+func ebmlElement(id uint32, contents ...[]byte) []byte {
+	size := 0
+	for _, c := range contents {
+		size += len(c)
+	}
+	b := append(ebmlID(id), ebmlSize(uint64(size))...)
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	b := u64(v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	return ebmlElement(id, u64(math.Float64bits(v)))
+}
+
+// readVint parses a variable-length integer, and returns its value, its
+// length, and whether all of its bits are set.
+func readVint(data []byte) (uint64, int, bool, error) {
+	if len(data) < 1 || data[0] == 0 {
+		return 0, 0, false, errMalformed
+	}
+	n := bits.LeadingZeros8(data[0]) + 1
+	if len(data) < n {
+		return 0, 0, false, io.ErrUnexpectedEOF
+	}
+	v := uint64(data[0] & (0xFF >> n))
+	ones := v == 0xFF>>n
+	for _, b := range data[1:n] {
+		v = v<<8 | uint64(b)
+		ones = ones && b == 0xFF
+	}
+	return v, n, ones, nil
+}
+
+// ebmlHeader parses the header of an EBML element, and returns its ID,
+// the size of its contents, or -1 if unknown, and the length of the
+// header.
+func ebmlHeader(data []byte) (uint32, int64, int, error) {
+	if len(data) < 1 || data[0] < 0x10 {
+		return 0, 0, 0, errMalformed
+	}
+	n := bits.LeadingZeros8(data[0]) + 1
+	if len(data) < n {
+		return 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	var id uint32
+	for _, b := range data[:n] {
+		id = id<<8 | uint32(b)
+	}
+	size, m, unknown, err := readVint(data[n:])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if unknown {
+		return id, -1, n + m, nil
+	}
+	if size > math.MaxInt64 {
+		return 0, 0, 0, errMalformed
+	}
+	return id, int64(size), n + m, nil
+}
+
+func ebmlUintValue(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// seekHead returns a SeekHead pointing at the Info, the Tracks and, if
+// cues is not negative, the Cues.  Its size is always the same, so that
+// it can be overwritten when the file is finalised.
+func seekHead(info, tracks, cues int64) []byte {
+	seek := func(id uint32, position int64) []byte {
+		return ebmlElement(idSeek,
+			ebmlElement(idSeekID, ebmlID(id)),
+			ebmlElement(idSeekPosition, u64(uint64(position))),
+		)
+	}
+	last := ebmlElement(idVoid, make([]byte, 19))
+	if cues >= 0 {
+		last = seek(idCues, cues)
+	}
+	return ebmlElement(idSeekHead,
+		seek(idInfo, info), seek(idTracks, tracks), last,
+	)
+}
+
+func simpleBlock(track uint64, timecode int64, keyframe bool, data []byte) []byte {
+	var flags byte
+	if keyframe {
+		flags = 0x80
+	}
+	header := append(ebmlSize(track), byte(timecode>>8), byte(timecode), flags)
+	return ebmlElement(idSimpleBlock, header, data)
+}
+
+// isWebM returns true if the given tracks can be written to a WebM file,
+// false if they require Matroska.
+func isWebM(configs []trackConfig) bool {
+	for _, c := range configs {
+		if strings.EqualFold(c.codec, "video/h264") {
+			return false
+		}
+	}
+	return true
+}
+
+// trackEntry returns the Matroska description of a track.
+func trackEntry(number uint64, c *trackConfig) (webm.TrackEntry, error) {
+	entry := webm.TrackEntry{
+		TrackNumber: number,
+		TrackUID:    number,
+	}
+	switch strings.ToLower(c.codec) {
+	case "audio/opus", "audio/red":
+		entry.Name = "Audio"
+		entry.CodecID = "A_OPUS"
+		entry.CodecPrivate = opusHead(c.channels)
+		entry.SeekPreRoll = 80000000
+		entry.TrackType = 2
+		entry.Audio = &webm.Audio{
+			SamplingFrequency: 48000,
+			Channels:          uint64(c.channels),
+		}
+		return entry, nil
+	case "video/vp8":
+		entry.CodecID = "V_VP8"
+	case "video/vp9":
+		entry.CodecID = "V_VP9"
+	case "video/h264":
+		if c.sps == nil || c.pps == nil {
+			return entry, errors.New("no H.264 parameter sets")
+		}
+		info, err := gcodecs.ParseSPS(c.sps)
+		if err != nil {
+			return entry, err
+		}
+		entry.CodecID = "V_MPEG4/ISO/AVC"
+		entry.CodecPrivate = bmff.AVCConfig(c.sps, c.pps, info)
+	default:
+		return entry, errors.New("cannot write " + c.codec + " to Matroska")
+	}
+	entry.Name = "Video"
+	entry.TrackType = 1
+	entry.Video = &webm.Video{
+		PixelWidth:  uint64(c.width),
+		PixelHeight: uint64(c.height),
+	}
+	return entry, nil
+}
+
+type mkvBlock struct {
+	track     *mkvTrack
+	timestamp int64
+	keyframe  bool
+	data      []byte
+}
+
+// An mkvWriter writes a Matroska file.  Blocks are buffered, and written
+// out as a cluster whenever a video keyframe is written or the buffered
+// blocks span clusterDuration.
+type mkvWriter struct {
+	file   *os.File
+	tracks []*mkvTrack
+	// the offset in the file of the contents of the Segment, relative
+	// to which positions are expressed
+	segment int64
+	// the positions of the Info and the Tracks
+	info, tracksPosition int64
+	// the offset in the file of the placeholder for the duration
+	durationOffset int64
+	// the size of the file
+	size int64
+	// the buffered blocks, the smallest of their timestamps, or -1,
+	// and whether they include video
+	blocks   []*mkvBlock
+	start    int64
+	buffered bool
+	// the end of the last block written, in milliseconds
+	duration int64
+	// the encoded cue points
+	cues     []byte
+	hasVideo bool
+	// the number of tracks that are not closed yet
+	open int
+	err  error
+}
+
+// An mkvTrack writes the blocks of a single track to an mkvWriter.
+type mkvTrack struct {
+	writer *mkvWriter
+	number uint64
+	video  bool
+	h264   bool
+	// the last buffered block
+	last *mkvBlock
+	// the timestamp of the last block written, or -1, and the interval
+	// before it
+	lastTimestamp, interval int64
+	closed                  bool
+}
+
+// newMKVWriter writes the header of a Matroska file with the given
+// tracks, and returns a writer for each track.  The file is closed when
+// all the track writers have been closed.
+func newMKVWriter(file *os.File, configs []trackConfig) ([]trackWriter, error) {
+	w := &mkvWriter{file: file, start: -1}
+
+	entries := make([]webm.TrackEntry, len(configs))
+	for i := range configs {
+		c := &configs[i]
+		number := uint64(i + 1)
+		entry, err := trackEntry(number, c)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = entry
+		w.tracks = append(w.tracks, &mkvTrack{
+			writer:        w,
+			number:        number,
+			video:         entry.TrackType == 1,
+			h264:          strings.EqualFold(c.codec, "video/h264"),
+			lastTimestamp: -1,
+		})
+		if entry.TrackType == 1 {
+			w.hasVideo = true
+		}
+	}
+
+	header := *webm.DefaultEBMLHeader
+	if !isWebM(configs) {
+		header.DocType = "matroska"
+	}
+	var buf bytes.Buffer
+	err := ebml.Marshal(&struct {
+		Header webm.EBMLHeader `ebml:"EBML"`
+	}{header}, &buf)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(ebmlID(idSegment))
+	buf.Write(u64(unknownSize))
+	w.segment = int64(buf.Len())
+
+	var tracks bytes.Buffer
+	err = ebml.Marshal(&struct {
+		Tracks webm.Tracks `ebml:"Tracks"`
+	}{webm.Tracks{TrackEntry: entries}}, &tracks)
+	if err != nil {
+		return nil, err
+	}
+
+	// the duration is filled in when the file is closed
+	info := ebmlElement(idInfo,
+		ebmlElement(idVoid, make([]byte, 9)),
+		ebmlUint(idTimecodeScale, 1000000),
+		ebmlElement(idMuxingApp, []byte(muxingApp)),
+		ebmlElement(idWritingApp, []byte(muxingApp)),
+	)
+	_, _, n, err := ebmlHeader(info)
+	if err != nil {
+		return nil, err
+	}
+
+	w.info = int64(len(seekHead(0, 0, -1)))
+	w.tracksPosition = w.info + int64(len(info))
+	w.durationOffset = w.segment + w.info + int64(n)
+	buf.Write(seekHead(w.info, w.tracksPosition, -1))
+	buf.Write(info)
+	buf.Write(tracks.Bytes())
+
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	w.size = int64(buf.Len())
+
+	w.open = len(w.tracks)
+	ws := make([]trackWriter, len(w.tracks))
+	for i, t := range w.tracks {
+		ws[i] = t
+	}
+	return ws, nil
+}
+
+func (w *mkvWriter) track(number uint64) *mkvTrack {
+	for _, t := range w.tracks {
+		if t.number == number {
+			return t
+		}
+	}
+	return nil
+}
+
+// index updates the duration and the cues after a cluster containing
+// the given blocks, sorted by timestamp, has been written at the given
+// position.  There is one cue point per cluster, at its first video
+// keyframe, or at its first block if there is no video.
+func (w *mkvWriter) index(position int64, blocks []*mkvBlock) {
+	cued := false
+	for _, b := range blocks {
+		t := b.track
+		if t.lastTimestamp >= 0 && b.timestamp > t.lastTimestamp {
+			t.interval = b.timestamp - t.lastTimestamp
+		}
+		if b.timestamp > t.lastTimestamp {
+			t.lastTimestamp = b.timestamp
+		}
+		if end := b.timestamp + t.interval; end > w.duration {
+			w.duration = end
+		}
+
+		if !cued && b.keyframe && (t.video || !w.hasVideo) {
+			w.cues = append(w.cues, ebmlElement(idCuePoint,
+				ebmlUint(idCueTime, uint64(b.timestamp)),
+				ebmlElement(idCueTrackPositions,
+					ebmlUint(idCueTrack, t.number),
+					ebmlUint(idCueClusterPosition,
+						uint64(position)),
+				),
+			)...)
+			cued = true
+		}
+	}
+}
+
+// flush writes the buffered blocks as a cluster.
+func (w *mkvWriter) flush() error {
+	blocks := w.blocks
+	w.blocks = nil
+	w.start = -1
+	w.buffered = false
+	for _, t := range w.tracks {
+		t.last = nil
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].timestamp < blocks[j].timestamp
+	})
+	timecode := blocks[0].timestamp
+	contents := make([][]byte, 0, len(blocks)+1)
+	contents = append(contents, ebmlUint(idTimecode, uint64(timecode)))
+	for _, b := range blocks {
+		contents = append(contents, simpleBlock(
+			b.track.number, b.timestamp-timecode, b.keyframe, b.data,
+		))
+	}
+	cluster := ebmlElement(idCluster, contents...)
+
+	position := w.size - w.segment
+	_, err := w.file.Write(cluster)
+	if err != nil {
+		return err
+	}
+	w.size += int64(len(cluster))
+	w.index(position, blocks)
+	return nil
+}
+
+// finish writes the cues, and fills in the duration, the seek head and,
+// last, the size of the Segment.
+func (w *mkvWriter) finish() error {
+	cues := int64(-1)
+	if len(w.cues) > 0 {
+		c := ebmlElement(idCues, w.cues)
+		_, err := w.file.WriteAt(c, w.size)
+		if err != nil {
+			return err
+		}
+		cues = w.size - w.segment
+		w.size += int64(len(c))
+	}
+
+	if w.duration > 0 {
+		_, err := w.file.WriteAt(
+			ebmlFloat(idDuration, float64(w.duration)),
+			w.durationOffset,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.file.WriteAt(
+		seekHead(w.info, w.tracksPosition, cues), w.segment,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.file.WriteAt(
+		u64(uint64(w.size-w.segment)|1<<56), w.segment-8,
+	)
+	return err
+}
+
+// Write writes a block with the given timestamp in milliseconds.  For
+// H.264, the block is in Annex B format.
+func (t *mkvTrack) Write(keyframe bool, timestamp int64, data []byte) (int, error) {
+	w := t.writer
+	if t.closed {
+		return 0, errors.New("track is closed")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if timestamp < 0 {
+		timestamp = 0
+	}
+	if t.h264 {
+		data = annexBToAVC(data)
+	}
+
+	if t.video && t.last != nil && timestamp == t.last.timestamp {
+		// a frame split across multiple samples, for example the
+		// parameter sets followed by an IDR
+		t.last.data = append(t.last.data, data...)
+		t.last.keyframe = t.last.keyframe || keyframe
+		return len(data), nil
+	}
+
+	// if there is video, clusters are cut by the video track, so
+	// that they start with a keyframe whenever possible
+	cut := t.video || !w.hasVideo
+	if w.start >= 0 && (timestamp-w.start >= maxClusterSpan ||
+		cut && (t.video && keyframe && w.buffered ||
+			timestamp-w.start >= clusterDuration)) {
+		w.err = w.flush()
+		if w.err != nil {
+			return 0, w.err
+		}
+	}
+
+	t.last = &mkvBlock{
+		track: t, timestamp: timestamp, keyframe: keyframe, data: data,
+	}
+	w.blocks = append(w.blocks, t.last)
+	w.buffered = w.buffered || t.video
+	if w.start < 0 || timestamp < w.start {
+		w.start = timestamp
+	}
+	return len(data), nil
+}
+
+// Close closes the track writer.  When the last track is closed, the
+// remaining blocks are written out, the file is finalised and closed.
+func (t *mkvTrack) Close() error {
+	w := t.writer
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	w.open--
+	if w.open > 0 {
+		return nil
+	}
+
+	if w.err == nil {
+		w.err = w.flush()
+	}
+	if w.err == nil {
+		w.err = w.finish()
+	}
+	err := w.file.Close()
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
+
+// clusterBlocks parses the contents of a cluster.
+func (w *mkvWriter) clusterBlocks(data []byte) ([]*mkvBlock, error) {
+	var timecode int64
+	var blocks []*mkvBlock
+	for len(data) > 0 {
+		id, size, n, err := ebmlHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 || int64(n)+size > int64(len(data)) {
+			return nil, errMalformed
+		}
+		contents := data[n : int64(n)+size]
+		data = data[int64(n)+size:]
+
+		switch id {
+		case idTimecode:
+			timecode = int64(ebmlUintValue(contents))
+		case idSimpleBlock:
+			number, m, _, err := readVint(contents)
+			if err != nil || len(contents) < m+3 {
+				return nil, errMalformed
+			}
+			t := w.track(number)
+			if t == nil {
+				continue
+			}
+			tc := int16(binary.BigEndian.Uint16(contents[m:]))
+			blocks = append(blocks, &mkvBlock{
+				track:     t,
+				timestamp: timecode + int64(tc),
+				keyframe:  contents[m+2]&0x80 != 0,
+			})
+		}
+	}
+	return blocks, nil
+}
+
+// parseInfo checks that the given Info was written by newMKVWriter, and
+// returns the offset of the placeholder for the duration within data.
+func parseInfo(data []byte) (int, bool) {
+	offset := -1
+	ours := false
+	for i := 0; i < len(data); {
+		id, size, n, err := ebmlHeader(data[i:])
+		if err != nil || size < 0 || int64(i+n)+size > int64(len(data)) {
+			return 0, false
+		}
+		if i == 0 && id == idVoid && size == 9 {
+			offset = 0
+		}
+		if id == idMuxingApp && string(data[i+n:i+n+int(size)]) == muxingApp {
+			ours = true
+		}
+		i += n + int(size)
+	}
+	return offset, offset >= 0 && ours
+}
+
+// scanMKV parses a Matroska file that was written by newMKVWriter but
+// not finalised, and returns a writer positioned after the last complete
+// cluster.  It returns nil if the file doesn't need to be finalised.
+func scanMKV(file *os.File) (*mkvWriter, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	buf := make([]byte, 12)
+	element := func(offset int64) (uint32, int64, int, error) {
+		n, err := file.ReadAt(buf, offset)
+		if n == 0 {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, 0, 0, err
+		}
+		id, s, n, err := ebmlHeader(buf[:n])
+		if err == nil && s >= 0 && offset+int64(n)+s > size {
+			err = io.ErrUnexpectedEOF
+		}
+		return id, s, n, err
+	}
+	contents := func(offset, s int64) ([]byte, error) {
+		data := make([]byte, s)
+		_, err := file.ReadAt(data, offset)
+		return data, err
+	}
+
+	id, s, n, err := element(0)
+	if err != nil || id != idEBML || s < 0 {
+		return nil, nil
+	}
+	offset := int64(n) + s
+	id, s, n, err = element(offset)
+	if err != nil || id != idSegment || s >= 0 {
+		return nil, nil
+	}
+
+	w := &mkvWriter{file: file, segment: offset + int64(n), start: -1}
+	offset = w.segment
+	info := false
+loop:
+	for offset < size {
+		id, s, n, err := element(offset)
+		if err != nil || s < 0 {
+			break
+		}
+		start := offset + int64(n)
+		switch id {
+		case idSeekHead:
+		case idInfo:
+			data, err := contents(start, s)
+			if err != nil {
+				return nil, err
+			}
+			o, ok := parseInfo(data)
+			if !ok {
+				return nil, nil
+			}
+			w.info = offset - w.segment
+			w.durationOffset = start + int64(o)
+			info = true
+		case idTracks:
+			data, err := contents(offset, int64(n)+s)
+			if err != nil {
+				return nil, err
+			}
+			var tracks struct {
+				Tracks webm.Tracks `ebml:"Tracks"`
+			}
+			err = ebml.Unmarshal(bytes.NewReader(data), &tracks)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range tracks.Tracks.TrackEntry {
+				w.tracks = append(w.tracks, &mkvTrack{
+					writer:        w,
+					number:        e.TrackNumber,
+					video:         e.TrackType == 1,
+					lastTimestamp: -1,
+				})
+				if e.TrackType == 1 {
+					w.hasVideo = true
+				}
+			}
+			w.tracksPosition = offset - w.segment
+		case idCluster:
+			if !info || w.tracks == nil {
+				return nil, nil
+			}
+			data, err := contents(start, s)
+			if err != nil {
+				return nil, err
+			}
+			blocks, err := w.clusterBlocks(data)
+			if err != nil {
+				break loop
+			}
+			sort.SliceStable(blocks, func(i, j int) bool {
+				return blocks[i].timestamp < blocks[j].timestamp
+			})
+			w.index(offset-w.segment, blocks)
+		default:
+			// for example the Cues written by an interrupted
+			// call to finish
+			break loop
+		}
+		offset = start + s
+	}
+
+	if !info || w.tracks == nil {
+		return nil, nil
+	}
+	w.size = offset
+	return w, nil
+}
+
+// recoverFile finalises a Matroska file that was interrupted by a crash,
+// and returns true if the file was modified.
+func recoverFile(filename string) (bool, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	w, err := scanMKV(file)
+	if err != nil || w == nil {
+		return false, err
+	}
+
+	// drop any incomplete cluster
+	err = file.Truncate(w.size)
+	if err != nil {
+		return false, err
+	}
+	err = w.finish()
+	if err != nil {
+		return false, err
+	}
+	return true, file.Close()
+}
+
+// Recover finalises the recordings in Directory that were interrupted
+// by a crash, so that they become seekable.  It must be called before
+// any recording is started.
+func Recover() {
+	if Directory == "" {
+		return
+	}
+	filepath.WalkDir(Directory,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			ext := filepath.Ext(path)
+			if ext != ".webm" && ext != ".mkv" {
+				return nil
+			}
+			recovered, err := recoverFile(path)
+			if err != nil {
+				logger.Warnf("Recover %v: %v", path, err)
+			} else if recovered {
+				logger.Infof("Finalised interrupted recording %v",
+					path)
+				finished(path)
+			}
+			return nil
+		},
+	)
+}
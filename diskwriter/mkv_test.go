@@ -0,0 +1,244 @@
+package diskwriter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+)
+
+func TestEBMLSize(t *testing.T) {
+	tests := []struct {
+		size    uint64
+		encoded []byte
+	}{
+		{0, []byte{0x80}},
+		{126, []byte{0xFE}},
+		{127, []byte{0x40, 0x7F}},
+		{16382, []byte{0x7F, 0xFE}},
+		{16383, []byte{0x20, 0x3F, 0xFF}},
+	}
+	for _, tt := range tests {
+		e := ebmlSize(tt.size)
+		if !bytes.Equal(e, tt.encoded) {
+			t.Errorf("%v: expected %x, got %x", tt.size, tt.encoded, e)
+		}
+		v, n, ones, err := readVint(e)
+		if err != nil || v != tt.size || n != len(e) || ones {
+			t.Errorf("%x: got %v %v %v %v", e, v, n, ones, err)
+		}
+	}
+
+	_, _, ones, err := readVint(u64(unknownSize))
+	if err != nil || !ones {
+		t.Errorf("Unknown size not recognised")
+	}
+}
+
+type mkvFile struct {
+	Header  webm.EBMLHeader `ebml:"EBML"`
+	Segment webm.Segment    `ebml:"Segment"`
+}
+
+// readMKV parses a finalised Matroska file, and checks that the seek
+// head and the cues point at the right elements.
+func readMKV(t *testing.T, filename string) *mkvFile {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var f mkvFile
+	err = ebml.Unmarshal(bytes.NewReader(data), &f)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	_, size, n, err := ebmlHeader(data)
+	if err != nil {
+		t.Fatalf("ebmlHeader: %v", err)
+	}
+	offset := n + int(size)
+	_, size, n, err = ebmlHeader(data[offset:])
+	if err != nil || size < 0 {
+		t.Fatalf("Bad segment %v %v", size, err)
+	}
+	segment := offset + n
+	if segment+int(size) != len(data) {
+		t.Errorf("Bad segment size %v", size)
+	}
+
+	at := func(position uint64, id uint32) bool {
+		return segment+int(position) < len(data) &&
+			bytes.HasPrefix(data[segment+int(position):], ebmlID(id))
+	}
+	if f.Segment.SeekHead == nil || len(f.Segment.SeekHead.Seek) != 3 {
+		t.Fatalf("Bad seek head")
+	}
+	for _, s := range f.Segment.SeekHead.Seek {
+		id := uint32(ebmlUintValue(s.SeekID))
+		if !at(s.SeekPosition, id) {
+			t.Errorf("Bad seek position for %x", id)
+		}
+	}
+	if f.Segment.Cues == nil {
+		t.Fatalf("No cues")
+	}
+	for _, c := range f.Segment.Cues.CuePoint {
+		p := c.CueTrackPositions[0].CueClusterPosition
+		if !at(p, idCluster) {
+			t.Errorf("Bad cluster position %v", p)
+		}
+	}
+	return &f
+}
+
+// writeMKV writes five seconds of media, with a keyframe every two
+// seconds, and returns the number of video frames.  It closes the tracks
+// if close is true.
+func writeMKV(t *testing.T, ws []trackWriter, close bool) int {
+	audio, video := ws[0], ws[1]
+	frames := 0
+	for tm := int64(0); tm < 5000; tm += 20 {
+		_, err := audio.Write(true, tm, []byte{0xfc})
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if tm%100 == 0 {
+			_, err := video.Write(
+				tm%2000 == 0, tm, []byte{0, 0, 0, 1, 0x41, 2},
+			)
+			if err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			frames++
+		}
+	}
+	if close {
+		video.Close()
+		audio.Close()
+	}
+	return frames
+}
+
+func TestMKVWriter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.mkv")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	ws, err := newMKVWriter(file, []trackConfig{
+		{codec: "audio/opus", channels: 2},
+		{codec: "video/H264", width: 640, height: 480,
+			sps: testSPS, pps: []byte{0x68, 0xce, 0x38, 0x80}},
+	})
+	if err != nil {
+		t.Fatalf("newMKVWriter: %v", err)
+	}
+	frames := writeMKV(t, ws, true)
+
+	f := readMKV(t, filename)
+	if f.Header.DocType != "matroska" {
+		t.Errorf("Bad doctype %v", f.Header.DocType)
+	}
+	if d := f.Segment.Info.Duration; d != 5000 {
+		t.Errorf("Expected duration 5000, got %v", d)
+	}
+	tracks := f.Segment.Tracks.TrackEntry
+	if len(tracks) != 2 || tracks[0].TrackUID == 0 ||
+		!bytes.HasPrefix(tracks[0].CodecPrivate, []byte("OpusHead")) ||
+		!bytes.Contains(tracks[1].CodecPrivate, testSPS) ||
+		tracks[1].Video.PixelWidth != 640 {
+		t.Errorf("Bad tracks")
+	}
+
+	if n := len(f.Segment.Cluster); n != 3 {
+		t.Errorf("Expected 3 clusters, got %v", n)
+	}
+	counts := make(map[uint64]int)
+	for _, c := range f.Segment.Cluster {
+		last := int64(-1)
+		for _, b := range c.SimpleBlock {
+			tm := int64(c.Timecode) + int64(b.Timecode)
+			if tm < last {
+				t.Errorf("Blocks are not sorted")
+			}
+			last = tm
+			counts[b.TrackNumber]++
+			if b.TrackNumber == 2 && !bytes.Equal(
+				b.Data[0], []byte{0, 0, 0, 2, 0x41, 2},
+			) {
+				t.Errorf("Block was not converted to AVC")
+			}
+		}
+		first := c.SimpleBlock[0]
+		if first.TrackNumber == 2 && !first.Keyframe {
+			t.Errorf("Cluster doesn't start with a keyframe")
+		}
+	}
+	if counts[1] != 250 || counts[2] != frames {
+		t.Errorf("Expected 250 and %v blocks, got %v", frames, counts)
+	}
+
+	cues := f.Segment.Cues.CuePoint
+	if len(cues) != 3 {
+		t.Fatalf("Expected 3 cue points, got %v", len(cues))
+	}
+	for i, c := range cues {
+		if c.CueTime != uint64(i)*2000 ||
+			c.CueTrackPositions[0].CueTrack != 2 {
+			t.Errorf("Bad cue point %v", c)
+		}
+	}
+}
+
+func TestMKVRecover(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.webm")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	ws, err := newMKVWriter(file, []trackConfig{
+		{codec: "audio/opus", channels: 2},
+		{codec: "video/VP8", width: 640, height: 480},
+	})
+	if err != nil {
+		t.Fatalf("newMKVWriter: %v", err)
+	}
+	writeMKV(t, ws, false)
+
+	// simulate a crash in the middle of writing a cluster
+	_, err = file.Write(ebmlElement(idCluster, make([]byte, 100))[:50])
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	file.Close()
+
+	recovered, err := recoverFile(filename)
+	if err != nil || !recovered {
+		t.Fatalf("recoverFile: %v %v", recovered, err)
+	}
+
+	f := readMKV(t, filename)
+	if f.Header.DocType != "webm" {
+		t.Errorf("Bad doctype %v", f.Header.DocType)
+	}
+	// the last cluster, starting at the keyframe at 4000ms, was never
+	// written, but the audio block at 4000ms was
+	if n := len(f.Segment.Cluster); n != 2 {
+		t.Errorf("Expected 2 clusters, got %v", n)
+	}
+	if d := f.Segment.Info.Duration; d != 4020 {
+		t.Errorf("Expected duration 4020, got %v", d)
+	}
+	if n := len(f.Segment.Cues.CuePoint); n != 2 {
+		t.Errorf("Expected 2 cue points, got %v", n)
+	}
+
+	recovered, err = recoverFile(filename)
+	if err != nil || recovered {
+		t.Errorf("Recovered a complete file: %v", err)
+	}
+}
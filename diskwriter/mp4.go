@@ -0,0 +1,339 @@
+package diskwriter
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/jech/galene/bmff"
+	gcodecs "github.com/jech/galene/codecs"
+)
+
+// This file implements a fragmented MP4 writer.  Unlike a plain MP4
+// file, a fragmented file doesn't need an index at the end, so that,
+// just like WebM, a recording interrupted by a crash remains playable.
+
+// fragments are no longer than this, in milliseconds
+const fragmentDuration = 2000
+
+// splitAnnexB splits an Annex B byte stream into NAL units.
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	i := 0
+	for i+2 < len(data) {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				for end > start && data[end-1] == 0 {
+					end--
+				}
+				nalus = append(nalus, data[start:end])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+// annexBToAVC converts a sample from Annex B to AVC format (four-byte
+// lengths), dropping access unit delimiters.
+func annexBToAVC(data []byte) []byte {
+	b := make([]byte, 0, len(data)+16)
+	for _, nalu := range splitAnnexB(data) {
+		if len(nalu) == 0 || nalu[0]&0x1F == 9 {
+			continue
+		}
+		b = append(b, u32(uint32(len(nalu)))...)
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+// parameterSets returns the SPS and PPS contained in an H.264 sample in
+// Annex B format, if any.
+func parameterSets(data []byte) (sps, pps []byte) {
+	for _, nalu := range splitAnnexB(data) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1F {
+		case 7:
+			sps = nalu
+		case 8:
+			pps = nalu
+		}
+	}
+	return
+}
+
+// trackConfig describes a track of an MP4 or Matroska file.
+type trackConfig struct {
+	codec         string
+	channels      uint16
+	width, height uint32
+	// the parameter sets, for H.264
+	sps, pps []byte
+	// the profile, for VP9
+	profile uint8
+}
+
+// vpx returns a sample entry for VP8 or VP9, as defined in "VP Codec
+// ISO Media File Format Binding".
+func vpx(typ string, c *trackConfig) []byte {
+	bitDepth := byte(8)
+	if c.profile >= 2 {
+		bitDepth = 10
+	}
+	// the level and the colour description are unspecified, and the
+	// chroma is 4:2:0 colocated, in studio range
+	vpcC := []byte{
+		c.profile, 0, bitDepth<<4 | 1<<1, 2, 2, 2,
+		0, 0, // codecInitializationDataSize
+	}
+	return bmff.VisualSampleEntry(
+		typ, c.width, c.height, bmff.FullBox("vpcC", 1, 0, vpcC),
+	)
+}
+
+// sampleEntry returns the sample entry and the timescale of a track.
+func sampleEntry(c *trackConfig) ([]byte, uint32, error) {
+	switch strings.ToLower(c.codec) {
+	case "audio/opus", "audio/red":
+		return bmff.Opus(c.channels), 48000, nil
+	case "video/vp8":
+		return vpx("vp08", c), 90000, nil
+	case "video/vp9":
+		return vpx("vp09", c), 90000, nil
+	case "video/h264":
+		if c.sps == nil || c.pps == nil {
+			return nil, 0, errors.New("no H.264 parameter sets")
+		}
+		info, err := gcodecs.ParseSPS(c.sps)
+		if err != nil {
+			return nil, 0, err
+		}
+		return bmff.AVC1(c.width, c.height, c.sps, c.pps, info), 90000, nil
+	}
+	return nil, 0, errors.New("cannot write " + c.codec + " to MP4")
+}
+
+// An mp4Writer writes a fragmented MP4 file.  Samples are buffered, and
+// written out as a fragment whenever a video keyframe is written or the
+// buffered samples span fragmentDuration.
+type mp4Writer struct {
+	file   *os.File
+	tracks []*mp4Track
+	seqno  uint32
+	// the offset in the file of the fragment_duration field of mehd
+	mehdOffset int64
+	// the timestamp of the first buffered sample in milliseconds,
+	// or -1 if nothing is buffered
+	start int64
+	// the end of the last fragment in milliseconds
+	duration int64
+	hasVideo bool
+	// the number of tracks that are not closed yet
+	open int
+	err  error
+}
+
+// An mp4Track writes the samples of a single track to an mp4Writer.
+type mp4Track struct {
+	writer    *mp4Writer
+	id        uint32
+	timescale uint32
+	video     bool
+	h264      bool
+	samples   []bmff.Sample
+	// the last sample, whose duration is not known yet
+	last *bmff.Sample
+	// the duration of the sample before last
+	duration uint32
+	closed   bool
+}
+
+// newMP4Writer writes the header of an MP4 file with the given tracks,
+// and returns a writer for each track.  The file is closed when all the
+// track writers have been closed.
+func newMP4Writer(file *os.File, configs []trackConfig) ([]trackWriter, error) {
+	w := &mp4Writer{file: file, start: -1}
+
+	ftyp := bmff.Box("ftyp",
+		[]byte("isom"), bmff.U32(0x200),
+		[]byte("isom"), []byte("iso6"), []byte("mp41"),
+	)
+
+	moov := [][]byte{bmff.MovieHeader(uint32(len(configs) + 1))}
+	// the duration is filled in when the file is closed
+	mvex := [][]byte{bmff.FullBox("mehd", 1, 0, bmff.U64(0))}
+	for i := range configs {
+		c := &configs[i]
+		entry, timescale, err := sampleEntry(c)
+		if err != nil {
+			return nil, err
+		}
+		id := uint32(i + 1)
+		audio := strings.HasPrefix(strings.ToLower(c.codec), "audio/")
+		moov = append(moov,
+			bmff.Track(id, timescale, audio, c.width, c.height, entry),
+		)
+		mvex = append(mvex, bmff.TrackExtends(id))
+		w.tracks = append(w.tracks, &mp4Track{
+			writer:    w,
+			id:        id,
+			timescale: timescale,
+			video:     !audio,
+			h264:      strings.EqualFold(c.codec, "video/h264"),
+		})
+		if !audio {
+			w.hasVideo = true
+		}
+	}
+	mvexBox := bmff.Box("mvex", mvex...)
+	moov = append(moov, mvexBox)
+
+	header := append(ftyp, bmff.Box("moov", moov...)...)
+	// mvex is the last box in the header; skip its header and the
+	// header, version and flags of mehd
+	w.mehdOffset = int64(len(header) - len(mvexBox) + 8 + 12)
+
+	_, err := file.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	w.open = len(w.tracks)
+	ws := make([]trackWriter, len(w.tracks))
+	for i, t := range w.tracks {
+		ws[i] = t
+	}
+	return ws, nil
+}
+
+// flush writes the complete buffered samples as a fragment.
+func (w *mp4Writer) flush() error {
+	var tracks []*mp4Track
+	for _, t := range w.tracks {
+		if len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	w.start = -1
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	w.seqno++
+	runs := make([]*bmff.Run, len(tracks))
+	for i, t := range tracks {
+		runs[i] = &bmff.Run{ID: t.id, Samples: t.samples}
+		s := t.samples[len(t.samples)-1]
+		end := (s.DTS + int64(s.Duration)) * 1000 / int64(t.timescale)
+		if end > w.duration {
+			w.duration = end
+		}
+	}
+
+	_, err := w.file.Write(bmff.Fragment(w.seqno, runs))
+	for _, t := range tracks {
+		t.samples = nil
+	}
+	return err
+}
+
+// Write writes a sample with the given timestamp in milliseconds.  For
+// H.264, the sample is in Annex B format.
+func (t *mp4Track) Write(keyframe bool, timestamp int64, data []byte) (int, error) {
+	w := t.writer
+	if t.closed {
+		return 0, errors.New("track is closed")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	dts := timestamp * int64(t.timescale) / 1000
+	if t.h264 {
+		data = annexBToAVC(data)
+	}
+
+	if t.video && t.last != nil && dts == t.last.DTS {
+		// a frame split across multiple samples, for example the
+		// parameter sets followed by an IDR
+		t.last.Data = append(t.last.Data, data...)
+		t.last.Keyframe = t.last.Keyframe || keyframe
+		return len(data), nil
+	}
+
+	if t.last != nil {
+		if dts < t.last.DTS {
+			dts = t.last.DTS
+		}
+		t.last.Duration = uint32(dts - t.last.DTS)
+		t.duration = t.last.Duration
+		t.samples = append(t.samples, *t.last)
+		t.last = nil
+	}
+
+	// if there is video, fragments are cut by the video track, so
+	// that they start with a keyframe whenever possible
+	cut := t.video || !w.hasVideo
+	if w.start >= 0 && cut && (t.video && keyframe ||
+		timestamp-w.start >= fragmentDuration) {
+		w.err = w.flush()
+		if w.err != nil {
+			return 0, w.err
+		}
+	}
+
+	t.last = &bmff.Sample{Data: data, DTS: dts, Keyframe: keyframe}
+	if w.start < 0 {
+		w.start = timestamp
+	}
+	return len(data), nil
+}
+
+// Close closes the track writer.  When the last track is closed, the
+// remaining samples are written out and the file is closed.
+func (t *mp4Track) Close() error {
+	w := t.writer
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if t.last != nil {
+		// assume the last sample is as long as the previous one
+		t.last.Duration = t.duration
+		if t.last.Duration == 0 {
+			t.last.Duration = t.timescale / 50
+		}
+		t.samples = append(t.samples, *t.last)
+		t.last = nil
+	}
+
+	w.open--
+	if w.open > 0 {
+		return nil
+	}
+
+	if w.err == nil {
+		w.err = w.flush()
+	}
+	if w.err == nil {
+		_, w.err = w.file.WriteAt(
+			bmff.U64(uint64(w.duration)), w.mehdOffset,
+		)
+	}
+	err := w.file.Close()
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package diskwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	data := []byte{0, 0, 0, 1, 0x67, 1, 0, 0, 1, 0x68, 2, 0, 0, 0, 1, 0x65}
+	nalus := splitAnnexB(data)
+	if len(nalus) != 3 ||
+		!bytes.Equal(nalus[0], []byte{0x67, 1}) ||
+		!bytes.Equal(nalus[1], []byte{0x68, 2}) ||
+		!bytes.Equal(nalus[2], []byte{0x65}) {
+		t.Errorf("Got %v", nalus)
+	}
+
+	avc := annexBToAVC(append([]byte{0, 0, 1, 9, 0xf0}, data...))
+	expected := []byte{
+		0, 0, 0, 2, 0x67, 1, 0, 0, 0, 2, 0x68, 2, 0, 0, 0, 1, 0x65,
+	}
+	if !bytes.Equal(avc, expected) {
+		t.Errorf("Expected %v, got %v", expected, avc)
+	}
+}
+
+func TestFmtpProfile(t *testing.T) {
+	if p := fmtpProfile("profile-id=2"); p != 2 {
+		t.Errorf("Expected 2, got %v", p)
+	}
+	if p := fmtpProfile("x=1; profile-id=1"); p != 1 {
+		t.Errorf("Expected 1, got %v", p)
+	}
+	if p := fmtpProfile(""); p != 0 {
+		t.Errorf("Expected 0, got %v", p)
+	}
+}
+
+var mp4Containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true,
+	"dinf": true, "stbl": true, "mvex": true, "moof": true,
+	"traf": true,
+}
+
+// mp4Boxes returns the contents of the boxes in data, indexed by path.
+func mp4Boxes(t *testing.T, data []byte, prefix string, m map[string][][]byte) {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("%v: truncated box header", prefix)
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("%v: bad box size %v", prefix, size)
+		}
+		path := prefix + "/" + string(data[4:8])
+		m[path] = append(m[path], data[8:size])
+		if mp4Containers[string(data[4:8])] {
+			mp4Boxes(t, data[8:size], path, m)
+		}
+		data = data[size:]
+	}
+}
+
+// a baseline SPS for 640x480
+var testSPS = []byte{0x67, 0x42, 0xe0, 0x1e, 0xda, 0x02, 0x80, 0xf6, 0x40}
+
+func TestMP4Writer(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.mp4")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	ws, err := newMP4Writer(file, []trackConfig{
+		{codec: "audio/opus", channels: 2},
+		{codec: "video/H264", width: 640, height: 480,
+			sps: testSPS, pps: []byte{0x68, 0xce, 0x38, 0x80}},
+	})
+	if err != nil {
+		t.Fatalf("newMP4Writer: %v", err)
+	}
+	audio, video := ws[0], ws[1]
+
+	// five seconds of media, with a keyframe every two seconds
+	frames := 0
+	for tm := int64(0); tm < 5000; tm += 20 {
+		_, err := audio.Write(true, tm, []byte{0xfc})
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if tm%100 == 0 {
+			var data []byte
+			kf := tm%2000 == 0
+			if kf {
+				// the parameter sets and the IDR are
+				// in different samples
+				_, err := video.Write(true, tm,
+					[]byte{0, 0, 0, 1, 0x67, 0, 0, 0, 1, 0x68},
+				)
+				if err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+				data = []byte{0, 0, 0, 1, 0x65, 1}
+			} else {
+				data = []byte{0, 0, 0, 1, 0x41, 2}
+			}
+			_, err := video.Write(kf, tm, data)
+			if err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			frames++
+		}
+	}
+	video.Close()
+	audio.Close()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	m := make(map[string][][]byte)
+	mp4Boxes(t, data, "", m)
+
+	if string(data[4:8]) != "ftyp" {
+		t.Errorf("File doesn't start with ftyp")
+	}
+	if len(m["/moov/trak"]) != 2 || len(m["/moov/mvex/trex"]) != 2 {
+		t.Errorf("Expected two tracks")
+	}
+	stsd := m["/moov/trak/mdia/minf/stbl/stsd"]
+	if !bytes.Contains(stsd[0], []byte("dOps")) ||
+		!bytes.Contains(stsd[1], []byte("avcC")) ||
+		!bytes.Contains(stsd[1], testSPS) {
+		t.Errorf("Bad sample descriptions")
+	}
+	tkhd := m["/moov/trak/tkhd"][1]
+	if binary.BigEndian.Uint32(tkhd[76:]) != 640<<16 ||
+		binary.BigEndian.Uint32(tkhd[80:]) != 480<<16 {
+		t.Errorf("Bad dimensions")
+	}
+
+	mehd := m["/moov/mvex/mehd"][0]
+	if d := binary.BigEndian.Uint64(mehd[4:]); d != 5000 {
+		t.Errorf("Expected duration 5000, got %v", d)
+	}
+
+	if n := len(m["/moof"]); n != 3 {
+		t.Errorf("Expected 3 fragments, got %v", n)
+	}
+	samples := make(map[uint32]int)
+	for i, traf := range m["/moof/traf/tfhd"] {
+		id := binary.BigEndian.Uint32(traf[4:])
+		trun := m["/moof/traf/trun"][i]
+		samples[id] += int(binary.BigEndian.Uint32(trun[4:]))
+	}
+	if samples[1] != 250 || samples[2] != frames {
+		t.Errorf("Expected 250 and %v samples, got %v",
+			frames, samples)
+	}
+
+	mdat := m["/mdat"][0]
+	kf := []byte{0, 0, 0, 1, 0x67, 0, 0, 0, 1, 0x68, 0, 0, 0, 2, 0x65, 1}
+	if !bytes.Contains(mdat, kf) {
+		t.Errorf("Keyframe was not converted to AVC format")
+	}
+}
@@ -0,0 +1,236 @@
+package diskwriter
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// This file implements an Ogg Opus writer (RFC 7845).
+
+// pages are written out when they hold this many samples at 48kHz
+const oggPageSamples = 48000
+
+var oggCRCTable [256]uint32
+
+func init() {
+	for i := range oggCRCTable {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = (r << 1) ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		oggCRCTable[i] = r
+	}
+}
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = (crc << 8) ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// opusSamples returns the number of samples at 48kHz in an Opus packet,
+// as described in Section 3.1 of RFC 6716, or 0 if the packet is
+// malformed.
+func opusSamples(packet []byte) int {
+	if len(packet) < 1 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var size int
+	switch {
+	case config < 12:
+		size = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		size = []int{480, 960}[config%2]
+	default:
+		size = []int{120, 240, 480, 960}[config%4]
+	}
+	var frames int
+	switch packet[0] & 3 {
+	case 0:
+		frames = 1
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+	return size * frames
+}
+
+// emptyFrame returns the TOC byte of a 20ms packet containing a single
+// empty frame, in the same mode and bandwidth as the packet with the
+// given TOC.
+func emptyFrame(toc byte) byte {
+	config := toc >> 3
+	switch {
+	case config < 12:
+		config = config&^3 | 1
+	case config < 16:
+		config = config | 1
+	default:
+		config = config | 3
+	}
+	return config<<3 | toc&0x04
+}
+
+// opusHead returns an Opus identification header with no pre-skip, as
+// defined in Section 5.1 of RFC 7845.
+func opusHead(channels uint16) []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, byte(channels))
+	head = binary.LittleEndian.AppendUint16(head, 0) // pre-skip
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = binary.LittleEndian.AppendUint16(head, 0) // output gain
+	head = append(head, 0)                           // mapping family
+	return head
+}
+
+// An oggWriter writes a single Opus stream to an Ogg file.  It
+// implements trackWriter.
+type oggWriter struct {
+	file   *os.File
+	serial uint32
+	seqno  uint32
+	// the number of samples written so far, including the packets
+	// in the current page
+	granule int64
+	// the packets of the current page
+	packets [][]byte
+	// the number of segments of the current page
+	segments int
+	// the number of samples at the start of the current page
+	start int64
+	err   error
+}
+
+func newOggWriter(file *os.File, channels uint16) (*oggWriter, error) {
+	var serial [4]byte
+	crand.Read(serial[:])
+	w := &oggWriter{
+		file:   file,
+		serial: binary.LittleEndian.Uint32(serial[:]),
+	}
+
+	err := w.writePage([][]byte{opusHead(channels)}, 0, 0x02)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []byte("OpusTags")
+	tags = binary.LittleEndian.AppendUint32(tags, 6)
+	tags = append(tags, "Galene"...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0)
+	err = w.writePage([][]byte{tags}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// writePage writes a page containing the given packets, which must not
+// require more than 255 segments.
+func (w *oggWriter) writePage(packets [][]byte, granule int64, flags byte) error {
+	page := []byte("OggS")
+	page = append(page, 0, flags)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = binary.LittleEndian.AppendUint32(page, w.serial)
+	page = binary.LittleEndian.AppendUint32(page, w.seqno)
+	page = binary.LittleEndian.AppendUint32(page, 0) // CRC
+	var lacing []byte
+	for _, p := range packets {
+		for i := 0; i < len(p)/255; i++ {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(len(p)%255))
+	}
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	for _, p := range packets {
+		page = append(page, p...)
+	}
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	w.seqno++
+	_, err := w.file.Write(page)
+	return err
+}
+
+func (w *oggWriter) flush(flags byte) error {
+	err := w.writePage(w.packets, w.granule, flags)
+	w.packets = nil
+	w.segments = 0
+	w.start = w.granule
+	return err
+}
+
+// add adds a packet to the current page, flushing the page first if it
+// is full.  The last page is only written by Close, which marks it as
+// the end of the stream.
+func (w *oggWriter) add(packet []byte, samples int) error {
+	segments := len(packet)/255 + 1
+	if w.segments+segments > 255 || w.granule-w.start >= oggPageSamples {
+		err := w.flush(0)
+		if err != nil {
+			return err
+		}
+	}
+	w.packets = append(w.packets, packet)
+	w.segments += segments
+	w.granule += int64(samples)
+	return nil
+}
+
+// Write writes an Opus packet with the given timestamp in milliseconds.
+// Since Ogg cannot represent discontinuities, gaps are filled with empty
+// frames, which the decoder treats as lost.
+func (w *oggWriter) Write(keyframe bool, timestamp int64, data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	samples := opusSamples(data)
+	if samples == 0 {
+		return 0, nil
+	}
+	empty := []byte{emptyFrame(data[0])}
+	for w.granule+960 <= timestamp*48 {
+		w.err = w.add(empty, 960)
+		if w.err != nil {
+			return 0, w.err
+		}
+	}
+	w.err = w.add(data, samples)
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(data), nil
+}
+
+// Close writes out the last page and closes the file.
+func (w *oggWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.err
+	if err == nil {
+		err = w.flush(0x04)
+	}
+	err2 := w.file.Close()
+	if err == nil {
+		err = err2
+	}
+	w.file = nil
+	if w.err == nil {
+		w.err = errors.New("file is closed")
+	}
+	return err
+}
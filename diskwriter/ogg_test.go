@@ -0,0 +1,177 @@
+package diskwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOggCRC(t *testing.T) {
+	// the check value of CRC-32/POSIX, without the final inversion
+	if crc := oggCRC([]byte("123456789")); crc != 0x765E7680^0xFFFFFFFF {
+		t.Errorf("Bad CRC %x", crc)
+	}
+}
+
+func TestOpusSamples(t *testing.T) {
+	tests := []struct {
+		packet  []byte
+		samples int
+	}{
+		{[]byte{0xfc}, 960},       // CELT FB 20ms
+		{[]byte{0xf8, 1}, 960},    // same, mono
+		{[]byte{0x08}, 960},       // SILK NB 20ms
+		{[]byte{0x18}, 2880},      // SILK NB 60ms
+		{[]byte{0x71}, 960},       // hybrid FB 10ms, two frames
+		{[]byte{0xe3, 0x05}, 600}, // CELT FB 2.5ms, five frames
+		{[]byte{0xe3}, 0},
+		{[]byte{}, 0},
+	}
+	for _, tt := range tests {
+		if s := opusSamples(tt.packet); s != tt.samples {
+			t.Errorf("%x: expected %v, got %v",
+				tt.packet, tt.samples, s)
+		}
+	}
+}
+
+func TestEmptyFrame(t *testing.T) {
+	for _, toc := range []byte{0x00, 0x1c, 0x28, 0x60, 0x74, 0x80, 0xe3} {
+		e := emptyFrame(toc)
+		if opusSamples([]byte{e}) != 960 {
+			t.Errorf("%x: bad duration", e)
+		}
+		if e&0x04 != toc&0x04 {
+			t.Errorf("%x: stereo flag not preserved", e)
+		}
+	}
+}
+
+type oggPage struct {
+	flags   byte
+	granule uint64
+	seqno   uint32
+	packets [][]byte
+}
+
+func readOggPages(t *testing.T, data []byte) []oggPage {
+	var pages []oggPage
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" {
+			t.Fatalf("Bad page header")
+		}
+		n := int(data[26])
+		if len(data) < 27+n {
+			t.Fatalf("Truncated page")
+		}
+		size := 27 + n
+		var packets [][]byte
+		var packet []byte
+		for _, l := range data[27 : 27+n] {
+			if len(data) < size+int(l) {
+				t.Fatalf("Truncated page")
+			}
+			packet = append(packet, data[size:size+int(l)]...)
+			size += int(l)
+			if l < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+		page := append([]byte(nil), data[:size]...)
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggCRC(page) != binary.LittleEndian.Uint32(data[22:]) {
+			t.Errorf("Bad CRC")
+		}
+		pages = append(pages, oggPage{
+			flags:   data[5],
+			granule: binary.LittleEndian.Uint64(data[6:]),
+			seqno:   binary.LittleEndian.Uint32(data[18:]),
+			packets: packets,
+		})
+		data = data[size:]
+	}
+	return pages
+}
+
+func TestOggWriter(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.ogg"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w, err := newOggWriter(f, 2)
+	if err != nil {
+		t.Fatalf("newOggWriter: %v", err)
+	}
+
+	// two seconds of audio, with a 100ms gap, and a large packet
+	big := make([]byte, 600)
+	big[0] = 0xfc
+	for tm := int64(0); tm < 2000; tm += 20 {
+		if tm >= 1000 && tm < 1100 {
+			continue
+		}
+		packet := []byte{0xfc, 1}
+		if tm == 1500 {
+			packet = big
+		}
+		_, err := w.Write(true, tm, packet)
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	_, err = w.Write(true, 2000, []byte{0xfc})
+	if err == nil {
+		t.Errorf("Write succeeded after close")
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	pages := readOggPages(t, data)
+	if len(pages) != 4 {
+		t.Fatalf("Expected 4 pages, got %v", len(pages))
+	}
+	for i, p := range pages {
+		if p.seqno != uint32(i) {
+			t.Errorf("Bad sequence number %v", p.seqno)
+		}
+	}
+	if pages[0].flags != 0x02 || len(pages[0].packets) != 1 ||
+		!bytes.HasPrefix(pages[0].packets[0], []byte("OpusHead")) ||
+		pages[0].packets[0][9] != 2 {
+		t.Errorf("Bad first page")
+	}
+	if !bytes.HasPrefix(pages[1].packets[0], []byte("OpusTags")) {
+		t.Errorf("Bad second page")
+	}
+	if pages[2].granule != 48000 || pages[3].flags != 0x04 ||
+		pages[3].granule != 96000 {
+		t.Errorf("Bad granule positions %v %v",
+			pages[2].granule, pages[3].granule)
+	}
+
+	var packets [][]byte
+	for _, p := range pages[2:] {
+		packets = append(packets, p.packets...)
+	}
+	if len(packets) != 100 {
+		t.Errorf("Expected 100 packets, got %v", len(packets))
+	}
+	for i, p := range packets {
+		empty := i >= 50 && i < 55
+		if empty != (len(p) == 1) {
+			t.Errorf("Packet %v: unexpected length %v", i, len(p))
+		}
+	}
+	if !bytes.Equal(packets[75], big) {
+		t.Errorf("Large packet was not preserved")
+	}
+}
@@ -0,0 +1,194 @@
+package diskwriter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+// This file implements recording quotas and retention.
+
+var ErrQuotaExceeded = errors.New("recording quota exceeded")
+
+// the groups that were over quota the last time Expire ran, in order to
+// warn the operators just once
+var overQuota struct {
+	mu     sync.Mutex
+	groups map[string]bool
+}
+
+func isRecording(name string) bool {
+	switch filepath.Ext(name) {
+	case ".webm", ".mkv", ".mp4", ".ogg", ".wav":
+		return true
+	}
+	return false
+}
+
+// recordings returns the recordings in a directory, not including those
+// of subgroups, which live in subdirectories.
+func recordings(directory string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isRecording(e.Name()) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, fi)
+	}
+	return files, nil
+}
+
+// usage returns the disk space used by the recordings in a directory.
+func usage(directory string) (int64, error) {
+	files, err := recordings(directory)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var size int64
+	for _, fi := range files {
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// checkQuota returns ErrQuotaExceeded if the recordings in a directory
+// use quota megabytes or more.
+func checkQuota(directory string, quota int) error {
+	if quota <= 0 {
+		return nil
+	}
+	used, err := usage(directory)
+	if err != nil {
+		return err
+	}
+	if used >= int64(quota)*1024*1024 {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// expireFiles removes the recordings in a directory that were last
+// modified before the given time, and returns the number of files
+// removed.
+func expireFiles(directory string, before time.Time) (int, error) {
+	files, err := recordings(directory)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, fi := range files {
+		if !fi.ModTime().Before(before) {
+			continue
+		}
+		err := os.Remove(filepath.Join(directory, fi.Name()))
+		if err != nil {
+			logger.Warnf("Expire recording: %v", err)
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// expireGroup applies the retention policy and checks the quota of the
+// group whose recordings are in directory.
+func expireGroup(name, directory string, desc *group.Description) {
+	var messages []string
+	if desc.RecordingRetention > 0 {
+		before := time.Now().Add(
+			-time.Duration(desc.RecordingRetention) * 24 * time.Hour,
+		)
+		n, err := expireFiles(directory, before)
+		if err != nil {
+			logger.Warnf("Expire recordings of %v: %v", name, err)
+		}
+		if n > 0 {
+			logger.Infof("Removed %v expired recordings of %v",
+				n, name)
+			messages = append(messages, fmt.Sprintf(
+				"Removed %v recordings older than %v days",
+				n, desc.RecordingRetention,
+			))
+		}
+	}
+
+	over := checkQuota(directory, desc.RecordingQuota) ==
+		ErrQuotaExceeded
+	overQuota.mu.Lock()
+	warn := over && !overQuota.groups[name]
+	if over {
+		if overQuota.groups == nil {
+			overQuota.groups = make(map[string]bool)
+		}
+		overQuota.groups[name] = true
+	} else {
+		delete(overQuota.groups, name)
+	}
+	overQuota.mu.Unlock()
+	if warn {
+		logger.Warnf("Recordings of %v exceed their quota", name)
+		messages = append(messages, fmt.Sprintf(
+			"Recordings exceed the quota of %v MB, "+
+				"new recordings will be refused",
+			desc.RecordingQuota,
+		))
+	}
+
+	if len(messages) == 0 {
+		return
+	}
+	g := group.Get(name)
+	if g == nil {
+		return
+	}
+	for _, m := range messages {
+		g.WallOps(m)
+		g.Notify("recordings", "", m)
+	}
+}
+
+// Expire removes the recordings that are older than the retention period
+// of their group, and warns the operators of groups whose recordings
+// exceed their quota.  It is meant to be called periodically.
+func Expire() {
+	if Directory == "" {
+		return
+	}
+	filepath.WalkDir(Directory,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(Directory, path)
+			if err != nil || rel == "." {
+				return nil
+			}
+			name := filepath.ToSlash(rel)
+			desc, err := group.GetDescription(name)
+			if err != nil {
+				// not a group, or a group that no longer
+				// exists; leave its recordings alone
+				return nil
+			}
+			expireGroup(name, path, desc)
+			return nil
+		},
+	)
+}
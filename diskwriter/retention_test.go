@@ -0,0 +1,75 @@
+package diskwriter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, f := range []struct {
+		name  string
+		size  int
+		mtime time.Time
+	}{
+		{"old.webm", 1024 * 1024, old},
+		{"old.txt", 10, old},
+		{"new.mp4", 512 * 1024, time.Now()},
+	} {
+		filename := filepath.Join(dir, f.name)
+		err := os.WriteFile(filename, make([]byte, f.size), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		err = os.Chtimes(filename, f.mtime, f.mtime)
+		if err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	// the recordings of a subgroup are not counted
+	err := os.Mkdir(filepath.Join(dir, "subgroup"), 0700)
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	err = os.WriteFile(
+		filepath.Join(dir, "subgroup", "a.webm"),
+		make([]byte, 1024*1024), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	used, err := usage(dir)
+	if err != nil || used != 1536*1024 {
+		t.Errorf("Expected %v, got %v %v", 1536*1024, used, err)
+	}
+	if err := checkQuota(dir, 0); err != nil {
+		t.Errorf("No quota: %v", err)
+	}
+	if err := checkQuota(dir, 1); err != ErrQuotaExceeded {
+		t.Errorf("Expected quota exceeded, got %v", err)
+	}
+	if err := checkQuota(dir, 2); err != nil {
+		t.Errorf("Below quota: %v", err)
+	}
+	if err := checkQuota(filepath.Join(dir, "none"), 1); err != nil {
+		t.Errorf("No directory: %v", err)
+	}
+
+	n, err := expireFiles(dir, time.Now().Add(-24*time.Hour))
+	if err != nil || n != 1 {
+		t.Errorf("Expected 1 file removed, got %v %v", n, err)
+	}
+	for _, f := range []string{"old.txt", "new.mp4", "subgroup/a.webm"} {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f)))
+		if err != nil {
+			t.Errorf("%v: %v", f, err)
+		}
+	}
+	if err := checkQuota(dir, 1); err != nil {
+		t.Errorf("Below quota after expiry: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package diskwriter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+)
+
+// A wavWriter writes mono 16-bit PCM to a WAV file.
+type wavWriter struct {
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	samples uint32
+	err     error
+}
+
+func newWAVWriter(file *os.File, rate uint32) (*wavWriter, error) {
+	w := &wavWriter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+	var header []byte
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, 36)
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, 1) // PCM
+	header = binary.LittleEndian.AppendUint16(header, 1) // mono
+	header = binary.LittleEndian.AppendUint32(header, rate)
+	header = binary.LittleEndian.AppendUint32(header, 2*rate)
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint16(header, 16)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, 0)
+	_, err := w.writer.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wavWriter) write(samples []int16) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.samples+uint32(len(samples)) > (1<<32-1-36)/2 {
+		w.err = errors.New("WAV file too large")
+		return w.err
+	}
+	var buf [2]byte
+	for _, v := range samples {
+		binary.LittleEndian.PutUint16(buf[:], uint16(v))
+		_, err := w.writer.Write(buf[:])
+		if err != nil {
+			w.err = err
+			return err
+		}
+	}
+	w.samples += uint32(len(samples))
+	return nil
+}
+
+// close fills in the sizes in the header, and closes the file.
+func (w *wavWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.writer.Flush()
+	if err == nil {
+		var buf [4]byte
+		size := 2 * w.samples
+		binary.LittleEndian.PutUint32(buf[:], 36+size)
+		_, err = w.file.WriteAt(buf[:], 4)
+		if err == nil {
+			binary.LittleEndian.PutUint32(buf[:], size)
+			_, err = w.file.WriteAt(buf[:], 40)
+		}
+	}
+	err2 := w.file.Close()
+	if err == nil {
+		err = err2
+	}
+	w.file = nil
+	if w.err == nil {
+		w.err = errors.New("file is closed")
+	}
+	return err
+}
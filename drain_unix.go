@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// the signals that cause the server to be drained
+var drainSignals = []os.Signal{syscall.SIGUSR1}
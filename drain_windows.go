@@ -0,0 +1,8 @@
+package main
+
+import (
+	"os"
+)
+
+// the signals that cause the server to be drained
+var drainSignals []os.Signal
@@ -27,6 +27,12 @@ func New(interval time.Duration) *Estimator {
 	return new(rtptime.Now(rtptime.JiffiesPerSec), interval)
 }
 
+// NewAt is like New, but takes the current time in jiffies.  It is
+// useful for processing captured traffic.
+func NewAt(now uint64, interval time.Duration) *Estimator {
+	return new(now, interval)
+}
+
 func new(now uint64, interval time.Duration) *Estimator {
 	return &Estimator{
 		interval: uint64(
@@ -94,6 +100,13 @@ func (e *Estimator) Estimate() (uint32, uint32) {
 	return e.estimate(rtptime.Now(rtptime.JiffiesPerSec))
 }
 
+// EstimateAt is like Estimate, but takes the current time in jiffies.
+func (e *Estimator) EstimateAt(now uint64) (uint32, uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.estimate(now)
+}
+
 // Totals returns the total number of bytes and packets accumulated.
 func (e *Estimator) Totals() (uint64, uint64) {
 	e.mu.Lock()
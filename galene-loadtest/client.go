@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	galene "github.com/jech/galene/client"
+	"github.com/jech/galene/rtpheader"
+)
+
+// A client is a synthetic client.
+type client struct {
+	index    int
+	username string
+	publish  bool
+	done     chan struct{}
+
+	mu   sync.Mutex
+	conn *galene.Client
+	// the time at which each remote stream was offered
+	starts map[string]time.Time
+}
+
+// wanted returns true if the client should subscribe to streams from
+// the given user.  Client i subscribes to publishers i+1 to i+fanout.
+func (c *client) wanted(username string) bool {
+	if config.fanout < 0 {
+		return true
+	}
+	if !strings.HasPrefix(username, config.username+"-") {
+		return false
+	}
+	n, err := strconv.Atoi(username[len(config.username)+1:])
+	if err != nil || n >= config.publishers {
+		return false
+	}
+	d := (n - c.index + config.publishers) % config.publishers
+	return d >= 1 && d <= config.fanout
+}
+
+// run connects to the server, joins the group, and waits until the
+// connection is closed.
+func (c *client) run(endpoint string, groupName string) {
+	stats.start()
+	start := time.Now()
+
+	conn, err := galene.Dial(endpoint, galene.Config{
+		Username:   c.username,
+		Password:   config.password,
+		HTTPClient: &httpClient,
+		Dialer:     &dialer,
+		API:        api,
+		Handlers: galene.Handlers{
+			UserMessage: func(m galene.UserMessage) {
+				if m.Kind == "error" || m.Kind == "warning" {
+					log.Printf("Client %v: %v: %v",
+						c.index, m.Kind, m.Value)
+				}
+			},
+			Stream:       c.gotStream,
+			Track:        c.gotTrack,
+			StreamClosed: c.streamClosed,
+		},
+	})
+	if err != nil {
+		stats.join(0, err)
+		log.Printf("Client %v: %v", c.index, err)
+		return
+	}
+	c.mu.Lock()
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	c.conn = conn
+	c.mu.Unlock()
+
+	err = conn.Join(groupName)
+	if err != nil {
+		stats.join(0, err)
+		log.Printf("Client %v: join failed: %v", c.index, err)
+		conn.Close()
+		return
+	}
+	stats.join(time.Since(start), nil)
+
+	err = c.joined(conn)
+	if err != nil {
+		log.Printf("Client %v: %v", c.index, err)
+	}
+
+	select {
+	case <-conn.Done():
+		if err := conn.Err(); err != nil {
+			log.Printf("Client %v: %v", c.index, err)
+		}
+	case <-c.done:
+	}
+}
+
+// joined is called after the client has joined the group.
+func (c *client) joined(conn *galene.Client) error {
+	if config.fanout != 0 {
+		err := conn.Request(map[string][]string{
+			"": {"audio", "video"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !c.publish {
+		return nil
+	}
+	present := false
+	for _, p := range conn.Permissions() {
+		if p == "present" {
+			present = true
+		}
+	}
+	if !present {
+		return errors.New("not allowed to present")
+	}
+	return c.publishStream(conn)
+}
+
+// publishStream sends the configured files to the server.
+func (c *client) publishStream(conn *galene.Client) error {
+	newTrack := func(mimeType, kind string) (*webrtc.TrackLocalStaticSample, error) {
+		return webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: mimeType},
+			kind, c.username,
+		)
+	}
+
+	var tracks []webrtc.TrackLocal
+	var audio, video *webrtc.TrackLocalStaticSample
+	var err error
+	if audioSamples != nil {
+		audio, err = newTrack(webrtc.MimeTypeOpus, "audio")
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, audio)
+	}
+	if videoSamples != nil {
+		video, err = newTrack(webrtc.MimeTypeVP8, "video")
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, video)
+	}
+
+	_, err = conn.Publish("camera", tracks...)
+	if err != nil {
+		return err
+	}
+
+	if audio != nil {
+		go play(audio, audioSamples, c.done)
+	}
+	if video != nil {
+		go play(video, videoSamples, c.done)
+	}
+	return nil
+}
+
+// gotStream is called when the server offers a stream.
+func (c *client) gotStream(s *galene.RemoteStream) bool {
+	if !c.wanted(s.Username) {
+		return false
+	}
+	c.mu.Lock()
+	c.starts[s.Id] = time.Now()
+	c.mu.Unlock()
+	return true
+}
+
+func (c *client) streamClosed(s *galene.RemoteStream) {
+	c.mu.Lock()
+	delete(c.starts, s.Id)
+	c.mu.Unlock()
+}
+
+func (c *client) gotTrack(s *galene.RemoteStream, track *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+	c.mu.Lock()
+	start, ok := c.starts[s.Id]
+	c.mu.Unlock()
+	if !ok {
+		start = time.Now()
+	}
+	readTrack(track, start)
+}
+
+// readTrack reads a remote track until it terminates, and records
+// statistics.
+func readTrack(track *webrtc.TrackRemote, start time.Time) {
+	t := stats.addTrack(track.Kind() == webrtc.RTPCodecTypeVideo)
+	var seqnos seqnoTracker
+	first := true
+	buf := make([]byte, 1504)
+	for {
+		n, _, err := track.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Read: %v", err)
+			}
+			return
+		}
+		h, err := rtpheader.Parse(buf[:n])
+		if err != nil {
+			continue
+		}
+		if first {
+			stats.firstPacket(time.Since(start))
+			first = false
+		}
+		t.received(n, seqnos.update(h.SequenceNumber()))
+	}
+}
+
+// close closes the connection to the server and all streams.
+func (c *client) close() {
+	c.mu.Lock()
+	close(c.done)
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,201 @@
+// Galene-loadtest connects a number of synthetic clients to a Galene
+// group in order to measure the capacity of a server.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+
+	galene "github.com/jech/galene/client"
+)
+
+var config struct {
+	username   string
+	password   string
+	clients    int
+	publishers int
+	fanout     int
+}
+
+var dialer = websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: 30 * time.Second,
+}
+var httpClient = http.Client{
+	Timeout: 30 * time.Second,
+}
+var api *webrtc.API
+var audioSamples, videoSamples []media.Sample
+
+func newAPI() (*webrtc.API, error) {
+	var m webrtc.MediaEngine
+	err := m.RegisterDefaultCodecs()
+	if err != nil {
+		return nil, err
+	}
+	var i interceptor.Registry
+	err = webrtc.RegisterDefaultInterceptors(&m, &i)
+	if err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(&m),
+		webrtc.WithInterceptorRegistry(&i),
+	), nil
+}
+
+func main() {
+	var audioFile, videoFile string
+	var adminUsername, adminPassword string
+	var insecure bool
+	var rampStep int
+	var rampInterval, duration time.Duration
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [option...] group-url\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.IntVar(&config.clients, "clients", 10, "`number` of clients")
+	flag.IntVar(&config.publishers, "publishers", -1,
+		"`number` of clients that publish (-1 means all)")
+	flag.IntVar(&config.fanout, "fanout", -1,
+		"`number` of publishers each client subscribes to "+
+			"(-1 means all)")
+	flag.StringVar(&config.username, "username", "load",
+		"username `prefix`, client n is called prefix-n")
+	flag.StringVar(&config.password, "password", "", "group `password`")
+	flag.StringVar(&audioFile, "audio", "",
+		"Opus `file` in Ogg format, one packet per page")
+	flag.StringVar(&videoFile, "video", "",
+		"VP8 `file` in IVF format")
+	flag.IntVar(&rampStep, "ramp-step", 0,
+		"`number` of clients added at each step (0 means all at once)")
+	flag.DurationVar(&rampInterval, "ramp-interval", 10*time.Second,
+		"`interval` between ramp steps")
+	flag.DurationVar(&duration, "duration", 30*time.Second,
+		"`duration` of the test once all clients have been started")
+	flag.StringVar(&adminUsername, "admin-username", "",
+		"administrator's `username`, for measuring the server's CPU usage")
+	flag.StringVar(&adminPassword, "admin-password", "",
+		"administrator's `password`")
+	flag.BoolVar(&insecure, "insecure", false,
+		"don't check server certificates")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if config.publishers < 0 || config.publishers > config.clients {
+		config.publishers = config.clients
+	}
+	if config.publishers > 0 && audioFile == "" && videoFile == "" {
+		log.Fatalf("Publishing requires -audio or -video")
+	}
+	if rampStep <= 0 {
+		rampStep = config.clients
+	}
+
+	if insecure {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		httpClient.Transport = t
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	var err error
+	if audioFile != "" {
+		audioSamples, err = loadOgg(audioFile)
+		if err != nil {
+			log.Fatalf("Load %v: %v", audioFile, err)
+		}
+	}
+	if videoFile != "" {
+		videoSamples, err = loadIVF(videoFile)
+		if err != nil {
+			log.Fatalf("Load %v: %v", videoFile, err)
+		}
+	}
+
+	api, err = newAPI()
+	if err != nil {
+		log.Fatalf("Create API: %v", err)
+	}
+
+	status, err := galene.GetStatus(&httpClient, flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Get group status: %v", err)
+	}
+
+	if adminUsername != "" {
+		stats.cpu, err = newCPUSampler(
+			flag.Arg(0), adminUsername, adminPassword,
+		)
+		if err != nil {
+			log.Fatalf("Get server statistics: %v", err)
+		}
+	}
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
+
+	clients := make([]*client, 0, config.clients)
+	defer func() {
+		for _, c := range clients {
+			c.close()
+		}
+	}()
+
+	wait := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-terminate:
+			return false
+		}
+	}
+
+	for len(clients) < config.clients {
+		n := config.clients - len(clients)
+		if n > rampStep {
+			n = rampStep
+		}
+		for i := 0; i < n; i++ {
+			index := len(clients)
+			c := &client{
+				index:    index,
+				username: fmt.Sprintf("%v-%v", config.username, index),
+				publish:  index < config.publishers,
+				done:     make(chan struct{}),
+				starts:   make(map[string]time.Time),
+			}
+			clients = append(clients, c)
+			go c.run(status.Endpoint, status.Name)
+		}
+		if len(clients) >= config.clients {
+			break
+		}
+		if !wait(rampInterval) {
+			stats.report(os.Stdout, true)
+			return
+		}
+		stats.report(os.Stdout, false)
+	}
+
+	wait(duration)
+	stats.report(os.Stdout, true)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// loadIVF reads a VP8 file in IVF format into memory.
+func loadIVF(filename string) ([]media.Sample, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		return nil, err
+	}
+	if header.FourCC != "VP80" {
+		return nil, errors.New("unsupported codec " + header.FourCC)
+	}
+	if header.TimebaseDenominator == 0 {
+		return nil, errors.New("bad timebase")
+	}
+	duration := time.Duration(header.TimebaseNumerator) * time.Second /
+		time.Duration(header.TimebaseDenominator)
+
+	var samples []media.Sample
+	for {
+		frame, _, err := reader.ParseNextFrame()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		samples = append(samples, media.Sample{
+			Data:     frame,
+			Duration: duration,
+		})
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("empty file")
+	}
+	return samples, nil
+}
+
+// loadOgg reads an Opus file in Ogg format into memory.  Every page must
+// contain a single Opus packet, as produced by ffmpeg's
+// "-page_duration 20000" option.
+func loadOgg(filename string) ([]media.Sample, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader, header, err := oggreader.NewWith(f)
+	if err != nil {
+		return nil, err
+	}
+	if header.SampleRate == 0 {
+		return nil, errors.New("bad sample rate")
+	}
+
+	var samples []media.Sample
+	var granule uint64
+	for {
+		page, pageHeader, err := reader.ParseNextPage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(page, []byte("OpusTags")) {
+			continue
+		}
+		// the granule position is always expressed at 48kHz
+		count := pageHeader.GranulePosition - granule
+		granule = pageHeader.GranulePosition
+		samples = append(samples, media.Sample{
+			Data:     page,
+			Duration: time.Duration(count) * time.Second / 48000,
+		})
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("empty file")
+	}
+	return samples, nil
+}
+
+// play sends samples in a loop until done is closed or the track fails.
+func play(track *webrtc.TrackLocalStaticSample, samples []media.Sample, done <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	next := time.Now()
+	for i := 0; ; i = (i + 1) % len(samples) {
+		err := track.WriteSample(samples[i])
+		if err != nil {
+			return
+		}
+		next = next.Add(samples[i].Duration)
+		timer.Reset(time.Until(next))
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackStats contains statistics about a received track.  The counters
+// are updated by the track's reader and read by the reporter.
+type trackStats struct {
+	video    bool
+	packets  uint64
+	bytes    uint64
+	expected uint64
+
+	// only accessed by the reporter
+	lastPackets, lastBytes, lastExpected uint64
+}
+
+// received records a packet.  Only called by the track's reader.
+func (t *trackStats) received(length int, expected uint64) {
+	atomic.AddUint64(&t.packets, 1)
+	atomic.AddUint64(&t.bytes, uint64(length))
+	atomic.StoreUint64(&t.expected, expected)
+}
+
+// seqnoTracker computes the number of expected packets from the
+// sequence numbers of received packets.
+type seqnoTracker struct {
+	started bool
+	first   uint64
+	highest uint64
+}
+
+func (s *seqnoTracker) update(seqno uint16) uint64 {
+	if !s.started {
+		s.started = true
+		s.first = uint64(seqno)
+		s.highest = uint64(seqno)
+	} else if delta := int16(seqno - uint16(s.highest)); delta > 0 {
+		s.highest += uint64(delta)
+	}
+	return s.highest - s.first + 1
+}
+
+// cpuSampler measures the CPU usage of the server, as reported in
+// /server-stats.json.
+type cpuSampler struct {
+	url                string
+	username, password string
+
+	first, last         time.Duration
+	firstTime, lastTime time.Time
+}
+
+func newCPUSampler(groupURL, username, password string) (*cpuSampler, error) {
+	u, err := url.Parse(groupURL)
+	if err != nil {
+		return nil, err
+	}
+	u = u.ResolveReference(&url.URL{Path: "/server-stats.json"})
+	s := &cpuSampler{
+		url:      u.String(),
+		username: username,
+		password: password,
+	}
+	cpu, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s.first, s.last = cpu, cpu
+	s.firstTime, s.lastTime = now, now
+	return s, nil
+}
+
+// get returns the CPU time consumed by the server.
+func (s *cpuSampler) get() (time.Duration, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.SetBasicAuth(s.username, s.password)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New(resp.Status)
+	}
+	var server struct {
+		// in milliseconds
+		CPU *float64 `json:"cpu"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&server)
+	if err != nil {
+		return 0, err
+	}
+	if server.CPU == nil {
+		return 0, errors.New("server doesn't report CPU usage")
+	}
+	return time.Duration(*server.CPU * float64(time.Millisecond)), nil
+}
+
+// sample returns the CPU usage of the server since the last call and
+// since the first sample, as fractions of one core.
+func (s *cpuSampler) sample() (float64, float64, error) {
+	cpu, err := s.get()
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now()
+	usage := func(cpu0 time.Duration, t0 time.Time) float64 {
+		if !now.After(t0) {
+			return 0
+		}
+		return float64(cpu-cpu0) / float64(now.Sub(t0))
+	}
+	recent, total := usage(s.last, s.lastTime), usage(s.first, s.firstTime)
+	s.last, s.lastTime = cpu, now
+	return recent, total, nil
+}
+
+type collector struct {
+	// if not nil, used for measuring the server's CPU usage
+	cpu *cpuSampler
+
+	mu           sync.Mutex
+	started      int
+	joined       int
+	failed       int
+	joins        []time.Duration
+	firstPackets []time.Duration
+	tracks       []*trackStats
+	lastReport   time.Time
+}
+
+var stats = collector{lastReport: time.Now()}
+
+func (c *collector) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started++
+}
+
+func (c *collector) join(d time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.failed++
+		return
+	}
+	c.joined++
+	c.joins = append(c.joins, d)
+}
+
+func (c *collector) firstPacket(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.firstPackets = append(c.firstPackets, d)
+}
+
+func (c *collector) addTrack(video bool) *trackStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &trackStats{video: video}
+	c.tracks = append(c.tracks, t)
+	return t
+}
+
+// percentile returns the p-th percentile of a sorted slice.
+func percentile(l []time.Duration, p int) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	i := (len(l) - 1) * p / 100
+	return l[i]
+}
+
+func sortedCopy(l []time.Duration) []time.Duration {
+	s := make([]time.Duration, len(l))
+	copy(s, l)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s
+}
+
+type rateSummary struct {
+	tracks        int
+	mean, minimum float64
+	loss          float64
+}
+
+// summarise computes the bitrates and loss over the interval since the
+// last call.  Called locked.
+func (c *collector) summarise(video bool, interval time.Duration) rateSummary {
+	var s rateSummary
+	var bits, packets, expected uint64
+	s.minimum = -1
+	for _, t := range c.tracks {
+		if t.video != video {
+			continue
+		}
+		p := atomic.LoadUint64(&t.packets)
+		b := atomic.LoadUint64(&t.bytes)
+		e := atomic.LoadUint64(&t.expected)
+		dp, db, de := p-t.lastPackets, b-t.lastBytes, e-t.lastExpected
+		t.lastPackets, t.lastBytes, t.lastExpected = p, b, e
+
+		s.tracks++
+		rate := float64(db*8) / interval.Seconds()
+		if s.minimum < 0 || rate < s.minimum {
+			s.minimum = rate
+		}
+		bits += db * 8
+		packets += dp
+		expected += de
+	}
+	if s.tracks > 0 {
+		s.mean = float64(bits) / interval.Seconds() / float64(s.tracks)
+	} else {
+		s.minimum = 0
+	}
+	if expected > packets {
+		s.loss = float64(expected-packets) / float64(expected)
+	}
+	return s
+}
+
+// report writes a summary of the interval since the last report.
+func (c *collector) report(w io.Writer, final bool) {
+	// don't hold the lock during the request
+	var cpu, totalCPU float64
+	var cpuErr error
+	if c.cpu != nil {
+		cpu, totalCPU, cpuErr = c.cpu.sample()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	interval := now.Sub(c.lastReport)
+	c.lastReport = now
+
+	joins := sortedCopy(c.joins)
+	audio := c.summarise(false, interval)
+	video := c.summarise(true, interval)
+
+	fmt.Fprintf(w, "%v clients (%v joined, %v failed), "+
+		"join p50 %v p95 %v, "+
+		"audio %v tracks %.0f kbit/s (min %.0f) loss %.2f%%, "+
+		"video %v tracks %.0f kbit/s (min %.0f) loss %.2f%%",
+		c.started, c.joined, c.failed,
+		percentile(joins, 50).Round(time.Millisecond),
+		percentile(joins, 95).Round(time.Millisecond),
+		audio.tracks, audio.mean/1000, audio.minimum/1000,
+		audio.loss*100,
+		video.tracks, video.mean/1000, video.minimum/1000,
+		video.loss*100,
+	)
+	if c.cpu != nil {
+		if cpuErr != nil {
+			fmt.Fprintf(w, ", server CPU unknown (%v)", cpuErr)
+		} else {
+			fmt.Fprintf(w, ", server CPU %.0f%%", cpu*100)
+		}
+	}
+	fmt.Fprintln(w)
+
+	if !final {
+		return
+	}
+
+	first := sortedCopy(c.firstPackets)
+	fmt.Fprintf(w, "Join latency: min %v, p50 %v, p95 %v, max %v\n",
+		percentile(joins, 0).Round(time.Millisecond),
+		percentile(joins, 50).Round(time.Millisecond),
+		percentile(joins, 95).Round(time.Millisecond),
+		percentile(joins, 100).Round(time.Millisecond),
+	)
+	fmt.Fprintf(w, "Time to first packet: min %v, p50 %v, p95 %v, max %v\n",
+		percentile(first, 0).Round(time.Millisecond),
+		percentile(first, 50).Round(time.Millisecond),
+		percentile(first, 95).Round(time.Millisecond),
+		percentile(first, 100).Round(time.Millisecond),
+	)
+	if c.cpu != nil && cpuErr == nil {
+		fmt.Fprintf(w, "Server CPU: %.0f%% on average\n", totalCPU*100)
+	}
+}
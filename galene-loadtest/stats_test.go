@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSeqnoTracker(t *testing.T) {
+	var s seqnoTracker
+	seqno := uint16(65000)
+	var expected uint64
+	for i := 0; i < 100000; i++ {
+		switch i % 10 {
+		case 9:
+			// lost
+		case 4:
+			// reordered with the next packet
+			s.update(seqno + 1)
+			expected = s.update(seqno)
+		case 5:
+		default:
+			expected = s.update(seqno)
+		}
+		seqno++
+	}
+	if expected != 100000-1 {
+		t.Errorf("Expected %v, got %v", 100000-1, expected)
+	}
+}
+
+func TestWanted(t *testing.T) {
+	config.username = "load"
+	config.publishers = 5
+	config.fanout = 2
+	defer func() {
+		config.fanout = -1
+	}()
+
+	c := &client{index: 4}
+	for _, u := range []string{"load-0", "load-1"} {
+		if !c.wanted(u) {
+			t.Errorf("%v not wanted", u)
+		}
+	}
+	for _, u := range []string{"load-2", "load-4", "load-7", "other-0", ""} {
+		if c.wanted(u) {
+			t.Errorf("%v wanted", u)
+		}
+	}
+}
+
+func TestCPUSampler(t *testing.T) {
+	cpu := 0.0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if r.URL.Path != "/server-stats.json" || !ok ||
+				username != "admin" || password != "pw" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(w, `{"cpu": %v, "egress": {}}`, cpu)
+		},
+	))
+	defer server.Close()
+
+	_, err := newCPUSampler(server.URL+"/group/test/", "admin", "wrong")
+	if err == nil {
+		t.Errorf("Wrong password accepted")
+	}
+
+	s, err := newCPUSampler(server.URL+"/group/test/", "admin", "pw")
+	if err != nil {
+		t.Fatalf("newCPUSampler: %v", err)
+	}
+	// pretend that the server consumed two cores during 100ms
+	s.firstTime = s.firstTime.Add(-100 * time.Millisecond)
+	s.lastTime = s.firstTime
+	cpu = 200
+	recent, total, err := s.sample()
+	if err != nil {
+		t.Fatalf("sample: %v", err)
+	}
+	if recent < 1.9 || recent > 2 || total != recent {
+		t.Errorf("Got %v %v", recent, total)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	recent, total, err = s.sample()
+	if err != nil || recent != 0 || total >= 2 {
+		t.Errorf("Got %v %v %v", recent, total, err)
+	}
+}
@@ -0,0 +1,308 @@
+// Galene-replay feeds the RTP packets contained in a pcap file to the
+// packet cache and to the receiver-side statistics and NACK logic used
+// by Galene, and prints the resulting decisions.  It is useful for
+// reproducing loss accounting and NACK bugs from captured traffic.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jech/galene/estimator"
+	"github.com/jech/galene/jitter"
+	"github.com/jech/galene/packetcache"
+	"github.com/jech/galene/rtpconn"
+	"github.com/jech/galene/rtpheader"
+	"github.com/jech/galene/rtptime"
+)
+
+type track struct {
+	ssrc   uint32
+	hz     uint32
+	cache  *packetcache.Cache
+	rate   *estimator.Estimator
+	jitter *jitter.Estimator
+	nacks  int
+	nacked int
+}
+
+// A replayer holds the state of the tracks being replayed.
+type replayer struct {
+	out       io.Writer
+	cacheSize int
+	clockRate uint32
+	// clock rates indexed by payload type, overriding clockRate
+	clockRates map[uint8]uint32
+	ssrc       uint32
+	port       uint16
+
+	start  time.Time
+	tracks map[uint32]*track
+}
+
+func newReplayer(out io.Writer) *replayer {
+	return &replayer{
+		out:       out,
+		cacheSize: 128,
+		clockRate: 90000,
+		tracks:    make(map[uint32]*track),
+	}
+}
+
+// parseClockRates parses a comma-separated list of clock rates, each of
+// which is either a default rate or of the form "pt:rate", and sets the
+// clock rates of r.
+func (r *replayer) parseClockRates(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		pt := -1
+		if i := strings.IndexByte(v, ':'); i >= 0 {
+			p, err := strconv.ParseUint(v[:i], 10, 7)
+			if err != nil {
+				return err
+			}
+			pt = int(p)
+			v = v[i+1:]
+		}
+		rate, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return err
+		}
+		if rate == 0 {
+			return errors.New("clock rate cannot be zero")
+		}
+		if pt < 0 {
+			r.clockRate = uint32(rate)
+			continue
+		}
+		if r.clockRates == nil {
+			r.clockRates = make(map[uint8]uint32)
+		}
+		r.clockRates[uint8(pt)] = uint32(rate)
+	}
+	return nil
+}
+
+// isRTP returns true if buf looks like an RTP packet.  This excludes
+// STUN, DTLS and RTCP.
+func isRTP(buf []byte) bool {
+	if len(buf) < 12 || buf[0]>>6 != 2 {
+		return false
+	}
+	// RTCP packet types 192 to 223 look like payload types 64 to 95
+	// with the marker bit set
+	pt := buf[1] & 0x7F
+	return pt < 64 || pt > 95
+}
+
+// packet processes a single RTP packet received at time tm, in the
+// same way as the reader loop of an up track.
+func (r *replayer) packet(tm time.Time, buf []byte) {
+	if r.start.IsZero() {
+		r.start = tm
+	}
+	elapsed := tm.Sub(r.start)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	// the time in jiffies, offset so that it is never zero
+	now := uint64(rtptime.FromDuration(
+		elapsed+time.Second, rtptime.JiffiesPerSec,
+	))
+
+	header, err := rtpheader.Parse(buf)
+	if err != nil {
+		return
+	}
+	ssrc := header.SSRC()
+	if r.ssrc != 0 && ssrc != r.ssrc {
+		return
+	}
+	t := r.tracks[ssrc]
+	if t == nil {
+		hz, ok := r.clockRates[header.PayloadType()]
+		if !ok {
+			hz = r.clockRate
+		}
+		t = &track{
+			ssrc:   ssrc,
+			hz:     hz,
+			cache:  packetcache.New(r.cacheSize, packetcache.MaxSize),
+			rate:   estimator.NewAt(now, time.Second),
+			jitter: jitter.New(hz),
+		}
+		r.tracks[ssrc] = t
+	}
+
+	t.rate.Accumulate(uint32(len(buf)))
+	seqno := header.SequenceNumber()
+	timestamp := header.Timestamp()
+	t.jitter.AccumulateAt(timestamp, uint32(rtptime.FromDuration(
+		elapsed+time.Second, t.hz,
+	)))
+
+	length := len(buf)
+	if header.HasExtension() {
+		length = header.StripExtension(buf)
+	}
+	first, _, err := t.cache.Store(
+		seqno, timestamp, false, header.Marker(), buf[:length],
+	)
+	if err != nil {
+		return
+	}
+
+	_, rate := t.rate.EstimateAt(now)
+	nacks := rtpconn.CheckNACK(t.cache, seqno, first, rate)
+	if len(nacks) > 0 {
+		t.nacks++
+		fmt.Fprintf(r.out, "%.3f %08x nack", elapsed.Seconds(), ssrc)
+		for _, nack := range nacks {
+			list := nack.PacketList()
+			t.nacked += len(list)
+			for _, s := range list {
+				fmt.Fprintf(r.out, " %v", s)
+			}
+		}
+		fmt.Fprintln(r.out)
+	}
+}
+
+// summary prints the statistics of each track.
+func (r *replayer) summary() {
+	ssrcs := make([]uint32, 0, len(r.tracks))
+	for ssrc := range r.tracks {
+		ssrcs = append(ssrcs, ssrc)
+	}
+	sort.Slice(ssrcs, func(i, j int) bool {
+		return ssrcs[i] < ssrcs[j]
+	})
+	for _, ssrc := range ssrcs {
+		t := r.tracks[ssrc]
+		s := t.cache.GetStats(false)
+		packets, _ := t.rate.Totals()
+		j := time.Duration(t.jitter.Jitter()) *
+			(time.Second / time.Duration(t.hz))
+		fmt.Fprintf(r.out,
+			"%08x: %v packets, %v received, %v expected, "+
+				"%v lost, jitter %v, %v NACKs for %v packets\n",
+			ssrc, packets, s.TotalReceived, s.TotalExpected,
+			int64(s.TotalExpected)-int64(s.TotalReceived),
+			j, t.nacks, t.nacked)
+		fmt.Fprintf(r.out,
+			"%08x: %v duplicates, %v reordered (max depth %v), "+
+				"max gap %v\n",
+			ssrc, s.Duplicates, s.Reordered, s.MaxReorder, s.MaxGap)
+	}
+}
+
+// replay replays all the RTP packets in a pcap file.  If realtime is
+// true, it respects the original timing.
+func (r *replayer) replay(in io.Reader, realtime bool) error {
+	p, err := newPcapReader(in)
+	if err != nil {
+		return err
+	}
+	var wallStart time.Time
+	for {
+		tm, data, err := p.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		src, dst, payload, ok := udpPayload(p.linkType, data)
+		if !ok || !isRTP(payload) {
+			continue
+		}
+		if r.port != 0 && src != r.port && dst != r.port {
+			continue
+		}
+		if realtime {
+			if wallStart.IsZero() {
+				wallStart = time.Now()
+			}
+			if !r.start.IsZero() {
+				time.Sleep(time.Until(
+					wallStart.Add(tm.Sub(r.start)),
+				))
+			}
+		}
+		r.packet(tm, payload)
+	}
+}
+
+func main() {
+	var ssrc, clockRates string
+	var port, cacheSize int
+	var realtime bool
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [option...] file.pcap\n",
+			os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&ssrc, "ssrc", "",
+		"only replay the stream with the given `SSRC` (in hex)")
+	flag.IntVar(&port, "port", 0,
+		"only replay packets from or to the given UDP `port`")
+	flag.IntVar(&cacheSize, "cache", 128,
+		"the size of the packet cache, in `packets`")
+	flag.StringVar(&clockRates, "clock-rate", "90000",
+		"the RTP clock `rates` used for computing jitter, "+
+			"a comma-separated list of rate or pt:rate")
+	flag.BoolVar(&realtime, "realtime", false,
+		"respect the original timing")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	var w io.Writer = out
+	if realtime {
+		// don't delay output when replaying in real time
+		w = os.Stdout
+	}
+	r := newReplayer(w)
+	r.cacheSize = cacheSize
+	err := r.parseClockRates(clockRates)
+	if err != nil {
+		log.Fatalf("Parse clock rate: %v", err)
+	}
+	r.port = uint16(port)
+	if ssrc != "" {
+		s, err := strconv.ParseUint(strings.TrimPrefix(ssrc, "0x"),
+			16, 32)
+		if err != nil {
+			log.Fatalf("Parse SSRC: %v", err)
+		}
+		r.ssrc = uint32(s)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	err = r.replay(bufio.NewReader(f), realtime)
+	if err != nil {
+		out.Flush()
+		log.Fatalf("Replay: %v", err)
+	}
+	r.summary()
+	out.Flush()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the expected outputs")
+
+// Each file testdata/name.pcap is replayed, and the output is compared
+// with testdata/name.out.  Run "go test -update" after changing the
+// NACK logic or the packet cache, and review the differences.
+func TestReplay(t *testing.T) {
+	// the clock rates of the captures
+	clockRates := map[string]string{
+		"loss": "111:48000",
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "*.pcap"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Glob: %v %v", files, err)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".pcap")
+		t.Run(name, func(t *testing.T) {
+			in, err := os.Open(file)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer in.Close()
+
+			var out bytes.Buffer
+			r := newReplayer(&out)
+			if rates := clockRates[name]; rates != "" {
+				err = r.parseClockRates(rates)
+				if err != nil {
+					t.Fatalf("parseClockRates: %v", err)
+				}
+			}
+			err = r.replay(in, false)
+			if err != nil {
+				t.Fatalf("Replay: %v", err)
+			}
+			r.summary()
+
+			outfile := filepath.Join("testdata", name+".out")
+			if *update {
+				err := os.WriteFile(outfile, out.Bytes(), 0o644)
+				if err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(outfile)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), expected) {
+				t.Errorf("Expected\n%s\ngot\n%s", expected, out.Bytes())
+			}
+		})
+	}
+}
+
+func TestParseClockRates(t *testing.T) {
+	r := newReplayer(nil)
+	err := r.parseClockRates("8000,0:8000,111:48000")
+	if err != nil {
+		t.Fatalf("parseClockRates: %v", err)
+	}
+	if r.clockRate != 8000 || len(r.clockRates) != 2 ||
+		r.clockRates[0] != 8000 || r.clockRates[111] != 48000 {
+		t.Errorf("Got %v %v", r.clockRate, r.clockRates)
+	}
+
+	for _, s := range []string{"", "0", "128:90000", "a:90000", "96:"} {
+		err := newReplayer(nil).parseClockRates(s)
+		if err == nil {
+			t.Errorf("%q: accepted", s)
+		}
+	}
+}
+
+func TestUDPPayload(t *testing.T) {
+	payload := []byte{1, 2, 3, 4}
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], 1234)
+	binary.BigEndian.PutUint16(udp[2:], 5678)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	ipv4 := make([]byte, 20)
+	ipv4[0] = 0x45
+	binary.BigEndian.PutUint16(ipv4[2:], uint16(20+len(udp)))
+	ipv4[9] = 17
+	ipv4 = append(ipv4, udp...)
+
+	ipv6 := make([]byte, 40)
+	ipv6[0] = 0x60
+	binary.BigEndian.PutUint16(ipv6[4:], uint16(len(udp)))
+	ipv6[6] = 17
+	ipv6 = append(ipv6, udp...)
+
+	vlan := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
+		0x81, 0x00, 0, 42, 0x86, 0xdd}
+	sll := make([]byte, 16)
+	fragment := append([]byte(nil), ipv4...)
+	fragment[6] = 0x20 // more fragments
+
+	tests := []struct {
+		linkType uint32
+		data     []byte
+		ok       bool
+	}{
+		{linkRaw, ipv4, true},
+		{linkIPv6, ipv6, true},
+		{linkEthernet, append(vlan, ipv6...), true},
+		{linkSLL, append(sll, ipv4...), true},
+		{linkNull, append([]byte{2, 0, 0, 0}, ipv4...), true},
+		{linkRaw, fragment, false},
+		{linkRaw, ipv4[:30], false},
+		{linkEthernet, vlan[:15], false},
+	}
+	for i, test := range tests {
+		src, dst, p, ok := udpPayload(test.linkType, test.data)
+		if ok != test.ok {
+			t.Errorf("%v: expected %v, got %v", i, test.ok, ok)
+			continue
+		}
+		if ok && (src != 1234 || dst != 5678 ||
+			!bytes.Equal(p, payload)) {
+			t.Errorf("%v: got %v %v %v", i, src, dst, p)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// link types, see https://www.tcpdump.org/linktypes.html
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+)
+
+// pcapReader reads files in the classic pcap format.
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var header [24]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	p := &pcapReader{r: r}
+	switch binary.LittleEndian.Uint32(header[:]) {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order = binary.LittleEndian
+		p.nano = true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order = binary.BigEndian
+		p.nano = true
+	case 0x0a0d0d0a:
+		return nil, errors.New(
+			"pcapng is not supported, " +
+				"please convert with \"editcap -F pcap\"",
+		)
+	default:
+		return nil, errors.New("not a pcap file")
+	}
+	p.linkType = p.order.Uint32(header[20:]) & 0x0FFFFFFF
+	switch p.linkType {
+	case linkNull, linkEthernet, linkRaw, linkSLL,
+		linkIPv4, linkIPv6, linkSLL2:
+	default:
+		return nil, fmt.Errorf("unsupported link type %v", p.linkType)
+	}
+	return p, nil
+}
+
+// next returns the next frame in the file, or io.EOF.
+func (p *pcapReader) next() (time.Time, []byte, error) {
+	var header [16]byte
+	_, err := io.ReadFull(p.r, header[:])
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	sec := p.order.Uint32(header[0:])
+	frac := p.order.Uint32(header[4:])
+	length := p.order.Uint32(header[8:])
+	if length > 256*1024 {
+		return time.Time{}, nil, errors.New("corrupted pcap file")
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(p.r, data)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return time.Time{}, nil, err
+	}
+	nsec := int64(frac) * 1000
+	if p.nano {
+		nsec = int64(frac)
+	}
+	return time.Unix(int64(sec), nsec), data, nil
+}
+
+// udpPayload returns the ports and the payload of a frame if it
+// contains a non-fragmented UDP datagram.
+func udpPayload(linkType uint32, data []byte) (uint16, uint16, []byte, bool) {
+	var ip []byte
+	switch linkType {
+	case linkNull:
+		if len(data) < 4 {
+			return 0, 0, nil, false
+		}
+		ip = data[4:]
+	case linkEthernet:
+		if len(data) < 14 {
+			return 0, 0, nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(data) < 4 {
+				return 0, 0, nil, false
+			}
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+		ip = data
+	case linkSLL:
+		if len(data) < 16 {
+			return 0, 0, nil, false
+		}
+		ip = data[16:]
+	case linkSLL2:
+		if len(data) < 20 {
+			return 0, 0, nil, false
+		}
+		ip = data[20:]
+	case linkRaw, linkIPv4, linkIPv6:
+		ip = data
+	default:
+		return 0, 0, nil, false
+	}
+
+	if len(ip) < 1 {
+		return 0, 0, nil, false
+	}
+	var udp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return 0, 0, nil, false
+		}
+		ihl := int(ip[0]&0x0F) * 4
+		length := int(binary.BigEndian.Uint16(ip[2:]))
+		fragment := binary.BigEndian.Uint16(ip[6:])
+		if ip[9] != 17 || fragment&0x3FFF != 0 ||
+			ihl < 20 || length < ihl || length > len(ip) {
+			return 0, 0, nil, false
+		}
+		udp = ip[ihl:length]
+	case 6:
+		if len(ip) < 40 {
+			return 0, 0, nil, false
+		}
+		length := int(binary.BigEndian.Uint16(ip[4:]))
+		if ip[6] != 17 || 40+length > len(ip) {
+			return 0, 0, nil, false
+		}
+		udp = ip[40 : 40+length]
+	default:
+		return 0, 0, nil, false
+	}
+
+	if len(udp) < 8 {
+		return 0, 0, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:]))
+	if length < 8 || length > len(udp) {
+		return 0, 0, nil, false
+	}
+	return binary.BigEndian.Uint16(udp[0:]),
+		binary.BigEndian.Uint16(udp[2:]),
+		udp[8:length], true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A dtmfDetector extracts digits from RFC 4733 telephone events.  All
+// the packets of an event carry the same timestamp, and the final packet
+// is usually sent three times, so a digit is reported once per timestamp.
+type dtmfDetector struct {
+	valid     bool
+	timestamp uint32
+}
+
+const dtmfDigits = "0123456789*#ABCD"
+
+// digit returns the digit carried by a telephone-event payload, or 0 if
+// the packet doesn't start a new digit.
+func (d *dtmfDetector) digit(timestamp uint32, payload []byte) byte {
+	if len(payload) < 4 {
+		return 0
+	}
+	if d.valid && d.timestamp == timestamp {
+		return 0
+	}
+	d.valid = true
+	d.timestamp = timestamp
+	event := payload[0]
+	if int(event) >= len(dtmfDigits) {
+		return 0
+	}
+	return dtmfDigits[event]
+}
+
+// audioLevel returns an estimate of the loudness of a packet.  We don't
+// decode Opus, so we use the packet size, which is small for silence.
+// The values for different codecs are not comparable.
+func audioLevel(c codec, payload []byte) float64 {
+	switch c.name {
+	case "PCMU", "PCMA":
+		if len(payload) == 0 {
+			return 0
+		}
+		sum := 0
+		for _, b := range payload {
+			var v int16
+			if c.name == "PCMU" {
+				v = ulawDecode(b)
+			} else {
+				v = alawDecode(b)
+			}
+			if v < 0 {
+				sum -= int(v)
+			} else {
+				sum += int(v)
+			}
+		}
+		return float64(sum) / float64(len(payload))
+	default:
+		return float64(len(payload))
+	}
+}
+
+func ulawDecode(b byte) int16 {
+	b = ^b
+	t := (int(b&0x0F) << 3) + 0x84
+	t <<= (b & 0x70) >> 4
+	if b&0x80 != 0 {
+		return int16(0x84 - t)
+	}
+	return int16(t - 0x84)
+}
+
+func alawDecode(b byte) int16 {
+	b ^= 0x55
+	t := int(b&0x0F) << 4
+	seg := (b & 0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if b&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// A speakerSelector chooses which of the group's audio tracks is sent to
+// a caller, since we don't mix.  It picks the loudest track, with some
+// hysteresis to avoid switching on every syllable.
+type speakerSelector struct {
+	mu       sync.Mutex
+	levels   map[string]*speakerLevel
+	current  string
+	switched time.Time
+}
+
+type speakerLevel struct {
+	level float64
+	last  time.Time
+}
+
+const (
+	speakerTimeout  = 500 * time.Millisecond
+	speakerMinDwell = time.Second
+)
+
+// update records the level of a packet from the given track, and
+// returns true if the packet should be forwarded.
+func (s *speakerSelector) update(id string, level float64, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.levels == nil {
+		s.levels = make(map[string]*speakerLevel)
+	}
+	l := s.levels[id]
+	if l == nil {
+		l = &speakerLevel{level: level}
+		s.levels[id] = l
+	}
+	l.level = 0.9*l.level + 0.1*level
+	l.last = now
+
+	cur := s.levels[s.current]
+	if cur == nil || now.Sub(cur.last) > speakerTimeout {
+		s.current = id
+		s.switched = now
+	} else if id != s.current && l.level > 1.5*cur.level &&
+		now.Sub(s.switched) > speakerMinDwell {
+		s.current = id
+		s.switched = now
+	}
+	return s.current == id
+}
+
+// remove forgets about a track.
+func (s *speakerSelector) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.levels, id)
+	if s.current == id {
+		s.current = ""
+	}
+}
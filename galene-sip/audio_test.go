@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDTMF(t *testing.T) {
+	var d dtmfDetector
+	// the first packet of an event, two updates, then the end packet
+	// three times
+	packets := []struct {
+		ts    uint32
+		event byte
+	}{
+		{1000, 5}, {1000, 5}, {1000, 5}, {1000, 5}, {1000, 5}, {1000, 5},
+		{2000, 10}, {2000, 10},
+		{3000, 11},
+		{4000, 42},
+	}
+	var digits []byte
+	for _, p := range packets {
+		digit := d.digit(p.ts, []byte{p.event, 0x0a, 0, 160})
+		if digit != 0 {
+			digits = append(digits, digit)
+		}
+	}
+	if string(digits) != "5*#" {
+		t.Errorf("Expected 5*#, got %q", digits)
+	}
+
+	if digit := d.digit(5000, []byte{1}); digit != 0 {
+		t.Errorf("Short packet gave %v", digit)
+	}
+}
+
+func TestG711(t *testing.T) {
+	tests := []struct {
+		b          byte
+		ulaw, alaw int16
+	}{
+		{0x00, -32124, -5504},
+		{0x80, 32124, 5504},
+		{0xFF, 0, 848},
+		{0x7F, 0, -848},
+		{0xD5, 716, 8},
+		{0x55, -716, -8},
+	}
+	for _, tt := range tests {
+		if v := ulawDecode(tt.b); v != tt.ulaw {
+			t.Errorf("ulaw %02x: expected %v, got %v", tt.b, tt.ulaw, v)
+		}
+		if v := alawDecode(tt.b); v != tt.alaw {
+			t.Errorf("alaw %02x: expected %v, got %v", tt.b, tt.alaw, v)
+		}
+	}
+
+	silence := make([]byte, 160)
+	for i := range silence {
+		silence[i] = 0xFF
+	}
+	if l := audioLevel(knownCodecs["pcmu"], silence); l != 0 {
+		t.Errorf("Silence has level %v", l)
+	}
+}
+
+func TestSpeakerSelector(t *testing.T) {
+	var s speakerSelector
+	now := time.Now()
+	tick := func() {
+		now = now.Add(20 * time.Millisecond)
+	}
+
+	if !s.update("a", 10, now) {
+		t.Errorf("First speaker not selected")
+	}
+	if s.update("b", 12, now) {
+		t.Errorf("Switched without hysteresis")
+	}
+
+	// b becomes much louder, but we switch only after the dwell time
+	switched := time.Time{}
+	for i := 0; i < 200; i++ {
+		tick()
+		s.update("a", 10, now)
+		if s.update("b", 100, now) {
+			switched = now
+			break
+		}
+	}
+	if switched.IsZero() {
+		t.Fatalf("Never switched")
+	}
+	if s.current != "b" {
+		t.Errorf("Expected b, got %v", s.current)
+	}
+
+	// a takes over immediately when b goes away
+	s.remove("b")
+	if !s.update("a", 1, now) {
+		t.Errorf("Didn't switch after remove")
+	}
+
+	// and when a falls silent, c takes over
+	s.update("c", 1, now)
+	now = now.Add(time.Second)
+	if !s.update("c", 1, now) {
+		t.Errorf("Didn't switch after timeout")
+	}
+}
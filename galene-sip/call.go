@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	pinTimeout = 30 * time.Second
+	maxPIN     = 16
+)
+
+// A call is a SIP dialog together with its RTP session and, once the
+// caller has chosen a group, the corresponding group member.
+type call struct {
+	gw       *gateway
+	id       string
+	invite   *sipMessage
+	groups   map[string]*groupConfig
+	peer     *net.UDPAddr
+	localTag string
+	media    *callMedia
+	rtp      *net.UDPConn
+	answer   *sipMessage
+
+	mu       sync.Mutex
+	acked    bool
+	closed   bool
+	done     chan struct{}
+	cseq     uint32
+	byeCseq  uint32
+	client   *client
+	pin      []byte
+	lastKey  byte
+	muted    bool
+	dtmf     dtmfDetector
+	rtpAddr  *net.UDPAddr
+	ssrc     uint32
+	seqno    uint16
+	lastTs   uint32
+	tsOffset uint32
+	source   string
+}
+
+func randomUint32() uint32 {
+	var b [4]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		log.Fatalf("rand.Read: %v", err)
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func newTag() string {
+	return fmt.Sprintf("%08x", randomUint32())
+}
+
+// frameTicks returns the duration of a 20ms frame in RTP clock units.
+func (c *call) frameTicks() uint32 {
+	return c.media.codec.clockRate / 50
+}
+
+// start answers the call and starts processing media.
+func (c *call) start() {
+	c.sendAnswer()
+	go c.retransmitAnswer()
+	go c.readRTP()
+
+	if g := c.groups[""]; g != nil {
+		c.join(g)
+		return
+	}
+	go func() {
+		timer := time.NewTimer(pinTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			c.mu.Lock()
+			joined := c.client != nil
+			c.mu.Unlock()
+			if !joined {
+				c.hangup("no PIN entered")
+			}
+		case <-c.done:
+		}
+	}()
+}
+
+func (c *call) sendAnswer() {
+	c.gw.send(c.answer, c.peer)
+}
+
+// retransmitAnswer resends the 200 response until it is acknowledged,
+// as required by RFC 3261 Section 13.3.1.4.
+func (c *call) retransmitAnswer() {
+	interval := 500 * time.Millisecond
+	deadline := time.Now().Add(32 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(interval):
+		case <-c.done:
+			return
+		}
+		c.mu.Lock()
+		acked := c.acked
+		c.mu.Unlock()
+		if acked {
+			return
+		}
+		c.sendAnswer()
+		interval *= 2
+		if interval > 4*time.Second {
+			interval = 4 * time.Second
+		}
+	}
+	c.hangup("no ACK received")
+}
+
+func (c *call) gotAck() {
+	c.mu.Lock()
+	c.acked = true
+	c.mu.Unlock()
+}
+
+// readRTP reads packets from the caller.
+func (c *call) readRTP() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := c.rtp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var p rtp.Packet
+		err = p.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		// latch onto the address the caller actually sends from,
+		// which may differ from the SDP when behind NAT
+		if c.rtpAddr == nil || !c.rtpAddr.IP.Equal(addr.IP) ||
+			c.rtpAddr.Port != addr.Port {
+			c.rtpAddr = addr
+		}
+		if c.media.dtmfPT >= 0 && int(p.PayloadType) == c.media.dtmfPT {
+			d := c.dtmf.digit(p.Timestamp, p.Payload)
+			c.mu.Unlock()
+			if d != 0 {
+				c.gotDigit(d)
+			}
+			continue
+		}
+		client := c.client
+		muted := c.muted
+		c.mu.Unlock()
+
+		if p.PayloadType != c.media.pt || client == nil || muted {
+			continue
+		}
+		client.writeAudio(&p)
+	}
+}
+
+// gotDigit handles a DTMF digit.  Before the caller has joined a group,
+// digits are a PIN terminated by "#"; afterwards, "*6" toggles mute.
+func (c *call) gotDigit(d byte) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	if c.client == nil {
+		if d != '#' {
+			if len(c.pin) < maxPIN {
+				c.pin = append(c.pin, d)
+			}
+			c.mu.Unlock()
+			return
+		}
+		pin := string(c.pin)
+		c.pin = nil
+		c.mu.Unlock()
+		g := c.groups[pin]
+		if g == nil {
+			log.Printf("Call %v: unknown PIN", c.id)
+			return
+		}
+		c.join(g)
+		return
+	}
+
+	last := c.lastKey
+	c.lastKey = d
+	if last == '*' && d == '6' {
+		c.muted = !c.muted
+		log.Printf("Call %v: muted %v", c.id, c.muted)
+		c.lastKey = 0
+	}
+	c.mu.Unlock()
+}
+
+// mute mutes the caller, who may unmute by dialing "*6".
+func (c *call) mute() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.muted {
+		c.muted = true
+		log.Printf("Call %v: muted by operator", c.id)
+	}
+}
+
+// join connects the caller to a group.
+func (c *call) join(g *groupConfig) {
+	c.mu.Lock()
+	if c.closed || c.client != nil {
+		c.mu.Unlock()
+		return
+	}
+	client := newClient(c, callerName(c.invite))
+	c.client = client
+	c.mu.Unlock()
+
+	go func() {
+		err := client.connect(g)
+		if err != nil {
+			c.hangup(fmt.Sprintf("join: %v", err))
+			return
+		}
+		log.Printf("Call %v: %v joined %v",
+			c.id, client.username, g.URL)
+	}()
+}
+
+// sendAudio sends a packet from the group to the caller.  Packets from
+// different sources are rewritten into a single stream with a continuous
+// sequence number and timestamp.
+func (c *call) sendAudio(source string, p *rtp.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	addr := c.rtpAddr
+	if addr == nil {
+		addr = c.media.addr
+	}
+
+	marker := p.Marker
+	if source != c.source {
+		c.tsOffset = c.lastTs + c.frameTicks() - p.Timestamp
+		c.source = source
+		marker = true
+	}
+	c.seqno++
+	c.lastTs = p.Timestamp + c.tsOffset
+
+	q := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			PayloadType:    c.media.pt,
+			SequenceNumber: c.seqno,
+			Timestamp:      c.lastTs,
+			SSRC:           c.ssrc,
+		},
+		Payload: p.Payload,
+	}
+	buf, err := q.Marshal()
+	if err != nil {
+		return
+	}
+	c.rtp.WriteToUDP(buf, addr)
+}
+
+// bye builds a BYE request for the dialog.
+func (c *call) bye() *sipMessage {
+	c.cseq++
+	c.byeCseq = c.cseq
+	contact := headerURI(c.invite.get("Contact"))
+	if contact == "" {
+		contact = headerURI(c.invite.get("From"))
+	}
+	m := &sipMessage{method: "BYE", uri: contact}
+	m.add("Via", fmt.Sprintf("SIP/2.0/UDP %v;branch=z9hG4bK%v;rport",
+		c.gw.localAddr(), newTag()))
+	m.add("Max-Forwards", "70")
+	m.add("From", c.answer.get("To"))
+	m.add("To", c.invite.get("From"))
+	m.add("Call-ID", c.id)
+	m.add("CSeq", fmt.Sprintf("%v BYE", c.byeCseq))
+	// we are the callee, so the route set is the Record-Route in order
+	for _, r := range c.invite.getAll("Record-Route") {
+		m.add("Route", r)
+	}
+	return m
+}
+
+// hangup terminates the call, sending a BYE to the caller.
+func (c *call) hangup(reason string) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	bye := c.bye()
+	c.mu.Unlock()
+
+	if !c.close() {
+		return
+	}
+	log.Printf("Call %v: hanging up: %v", c.id, reason)
+	go func() {
+		interval := 500 * time.Millisecond
+		for i := 0; i < 4; i++ {
+			c.gw.send(bye, c.peer)
+			time.Sleep(interval)
+			interval *= 2
+			c.mu.Lock()
+			done := c.byeCseq == 0
+			c.mu.Unlock()
+			if done {
+				break
+			}
+		}
+		c.gw.delCall(c.id)
+	}()
+}
+
+// gotByeResponse is called when the caller has answered our BYE.
+func (c *call) gotByeResponse(cseq uint32) {
+	c.mu.Lock()
+	if cseq == c.byeCseq {
+		c.byeCseq = 0
+	}
+	c.mu.Unlock()
+}
+
+// close releases the resources associated with a call.  The call is
+// removed from the gateway by the caller, since it may still need to
+// match responses to our BYE.  It returns false if the call was already
+// closed.
+func (c *call) close() bool {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	c.closed = true
+	close(c.done)
+	client := c.client
+	c.mu.Unlock()
+
+	if client != nil {
+		client.close()
+	}
+	c.rtp.Close()
+	return true
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	galene "github.com/jech/galene/client"
+)
+
+// A client is the participant in a Galene group that represents a
+// caller.
+type client struct {
+	call     *call
+	username string
+	codec    codec
+	selector speakerSelector
+
+	mu     sync.Mutex
+	conn   *galene.Client
+	track  *webrtc.TrackLocalStaticRTP
+	reason string
+	closed bool
+}
+
+func newClient(c *call, username string) *client {
+	return &client{
+		call:     c,
+		username: username,
+		codec:    c.media.codec,
+	}
+}
+
+// connect joins the group.  Messages are processed in a separate
+// goroutine, and the call is hung up when the connection to the server
+// is lost.
+func (c *client) connect(g *groupConfig) error {
+	status, err := galene.GetStatus(&httpClient, g.URL)
+	if err != nil {
+		return err
+	}
+	conn, err := galene.Dial(status.Endpoint, galene.Config{
+		Username:   c.username,
+		Password:   g.Password,
+		HTTPClient: &httpClient,
+		Dialer:     &dialer,
+		API:        api,
+		Handlers: galene.Handlers{
+			Joined:      c.gotJoined,
+			UserMessage: c.gotUserMessage,
+			Track: func(s *galene.RemoteStream, track *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+				if track.Kind() == webrtc.RTPCodecTypeAudio {
+					c.readTrack(track)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return errors.New("call terminated")
+	}
+	c.conn = conn
+	c.mu.Unlock()
+
+	err = conn.Join(status.Name)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	go func() {
+		<-conn.Done()
+		c.mu.Lock()
+		reason := c.reason
+		c.mu.Unlock()
+		if reason == "" {
+			reason = "connection closed"
+			if err := conn.Err(); err != nil {
+				reason = err.Error()
+			}
+		}
+		c.call.hangup(reason)
+	}()
+
+	err = c.joined(conn)
+	if err != nil {
+		log.Printf("Call %v: %v", c.call.id, err)
+	}
+	return nil
+}
+
+// terminate closes the connection to the server from a handler, which
+// must not wait for the client to terminate.
+func (c *client) terminate(reason string) {
+	c.mu.Lock()
+	if c.reason == "" {
+		c.reason = reason
+	}
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		go conn.Close()
+	}
+}
+
+func (c *client) gotJoined(j galene.Joined) {
+	if j.Kind == "leave" {
+		c.terminate("left group")
+	}
+}
+
+func (c *client) gotUserMessage(m galene.UserMessage) {
+	switch m.Kind {
+	case "kicked":
+		c.terminate(fmt.Sprintf("kicked: %v", m.Value))
+	case "mute":
+		c.call.mute()
+	case "error", "warning":
+		log.Printf("Call %v: %v: %v", c.call.id, m.Kind, m.Value)
+	}
+}
+
+// joined is called after the client has joined the group.
+func (c *client) joined(conn *galene.Client) error {
+	err := conn.Request(map[string][]string{
+		"": {"audio"},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range conn.Permissions() {
+		if p == "present" {
+			return c.publish(conn)
+		}
+	}
+	return errors.New("not allowed to speak")
+}
+
+// publish sends the caller's audio to the server.
+func (c *client) publish(conn *galene.Client) error {
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		c.codec.capability(), "audio", c.call.id,
+	)
+	if err != nil {
+		return err
+	}
+	s, err := conn.Publish("camera", track)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.track = track
+	c.mu.Unlock()
+
+	go func() {
+		<-s.Done()
+		select {
+		case <-conn.Done():
+		default:
+			log.Printf("Call %v: server refused audio", c.call.id)
+		}
+	}()
+	return nil
+}
+
+// writeAudio sends a packet from the caller to the group.
+func (c *client) writeAudio(p *rtp.Packet) {
+	c.mu.Lock()
+	track := c.track
+	c.mu.Unlock()
+	if track != nil {
+		track.WriteRTP(p)
+	}
+}
+
+// readTrack forwards the packets of a group member's audio track to the
+// caller whenever they are the selected speaker.
+func (c *client) readTrack(track *webrtc.TrackRemote) {
+	id := track.StreamID() + "/" + track.ID()
+	defer c.selector.remove(id)
+
+	if !strings.EqualFold(track.Codec().MimeType, c.codec.mimeType) {
+		log.Printf("Call %v: cannot forward %v to %v caller",
+			c.call.id, track.Codec().MimeType, c.codec.name)
+		// keep reading, or the sender would stall
+		buf := make([]byte, 1500)
+		for {
+			_, _, err := track.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Call %v: read: %v", c.call.id, err)
+			}
+			return
+		}
+		level := audioLevel(c.codec, p.Payload)
+		if c.selector.update(id, level, time.Now()) {
+			c.call.sendAudio(id, p)
+		}
+	}
+}
+
+// close leaves the group.
+func (c *client) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,441 @@
+// Galene-sip is a gateway that allows telephones to join Galene groups
+// as audio-only participants.  It accepts calls from a SIP trunk over
+// UDP, and forwards audio without transcoding.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// groupConfig is a group that callers may join.
+type groupConfig struct {
+	URL      string `json:"url"`
+	Password string `json:"password,omitempty"`
+}
+
+// configuration is the contents of the configuration file.  Groups are
+// indexed by PIN; the empty PIN means that callers join without being
+// asked for a PIN.  Numbers maps a dialled number to its own set of
+// groups, which replaces Groups for calls to that number.
+type configuration struct {
+	Groups  map[string]*groupConfig            `json:"groups,omitempty"`
+	Numbers map[string]map[string]*groupConfig `json:"numbers,omitempty"`
+}
+
+// groupsFor returns the groups reachable by dialling a given number.
+func (config *configuration) groupsFor(number string) map[string]*groupConfig {
+	if groups, ok := config.Numbers[number]; ok {
+		return groups
+	}
+	return config.Groups
+}
+
+func checkGroups(groups map[string]*groupConfig) error {
+	for pin, g := range groups {
+		if strings.Trim(pin, "0123456789*") != "" {
+			return fmt.Errorf("PIN %v: bad digit", pin)
+		}
+		if len(pin) > maxPIN {
+			return fmt.Errorf("PIN %v: too long", pin)
+		}
+		if g == nil || g.URL == "" {
+			return fmt.Errorf("PIN %v: no URL", pin)
+		}
+	}
+	return nil
+}
+
+func readConfig(filename string) (*configuration, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config configuration
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	err = d.Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Groups) == 0 && len(config.Numbers) == 0 {
+		return nil, errors.New("no groups configured")
+	}
+	err = checkGroups(config.Groups)
+	if err != nil {
+		return nil, err
+	}
+	for number, groups := range config.Numbers {
+		if len(groups) == 0 {
+			return nil, fmt.Errorf("number %v: no groups", number)
+		}
+		err = checkGroups(groups)
+		if err != nil {
+			return nil, fmt.Errorf("number %v: %w", number, err)
+		}
+	}
+	return &config, nil
+}
+
+// parseCodecs parses a comma-separated list of codec names.
+func parseCodecs(s string) ([]codec, error) {
+	var codecs []codec
+	for _, name := range strings.Split(s, ",") {
+		c, ok := knownCodecs[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown codec %v", name)
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs, nil
+}
+
+var dialer = websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: 30 * time.Second,
+}
+var httpClient = http.Client{
+	Timeout: 30 * time.Second,
+}
+var api *webrtc.API
+
+func newAPI() (*webrtc.API, error) {
+	var m webrtc.MediaEngine
+	err := m.RegisterDefaultCodecs()
+	if err != nil {
+		return nil, err
+	}
+	var i interceptor.Registry
+	err = webrtc.RegisterDefaultInterceptors(&m, &i)
+	if err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(&m),
+		webrtc.WithInterceptorRegistry(&i),
+	), nil
+}
+
+// A gateway is a SIP user agent server.
+type gateway struct {
+	conn   *net.UDPConn
+	ip     net.IP
+	codecs []codec
+	config *configuration
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// localAddr returns the address at which we receive SIP messages.
+func (gw *gateway) localAddr() string {
+	port := gw.conn.LocalAddr().(*net.UDPAddr).Port
+	return net.JoinHostPort(gw.ip.String(), strconv.Itoa(port))
+}
+
+// send sends a SIP message.  Responses are sent to the address the
+// request came from, which works behind NAT (RFC 3581).
+func (gw *gateway) send(m *sipMessage, addr *net.UDPAddr) {
+	_, err := gw.conn.WriteToUDP(m.marshal(), addr)
+	if err != nil {
+		log.Printf("Send to %v: %v", addr, err)
+	}
+}
+
+func (gw *gateway) reply(req *sipMessage, addr *net.UDPAddr, status int, reason string) {
+	gw.send(newResponse(req, status, reason, ""), addr)
+}
+
+func (gw *gateway) getCall(id string) *call {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.calls[id]
+}
+
+func (gw *gateway) delCall(id string) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	delete(gw.calls, id)
+}
+
+func (gw *gateway) serve() error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := gw.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		m, err := parseSIP(data)
+		if err != nil {
+			// keepalives are usually CRLF
+			if strings.TrimSpace(string(data)) != "" {
+				log.Printf("Receive from %v: %v", addr, err)
+			}
+			continue
+		}
+		if m.isRequest() {
+			gw.gotRequest(m, addr)
+		} else {
+			gw.gotResponse(m)
+		}
+	}
+}
+
+func (gw *gateway) gotRequest(m *sipMessage, addr *net.UDPAddr) {
+	id := m.get("Call-ID")
+	if id == "" || m.get("Via") == "" {
+		if m.method != "ACK" {
+			gw.reply(m, addr, 400, "Bad Request")
+		}
+		return
+	}
+
+	switch m.method {
+	case "INVITE":
+		gw.gotInvite(m, addr)
+	case "ACK":
+		if c := gw.getCall(id); c != nil {
+			c.gotAck()
+		}
+	case "BYE":
+		c := gw.getCall(id)
+		if c == nil {
+			gw.reply(m, addr, 481, "Call/Transaction Does Not Exist")
+			return
+		}
+		gw.reply(m, addr, 200, "OK")
+		if c.close() {
+			log.Printf("Call %v: caller hung up", id)
+		}
+		gw.delCall(id)
+	case "CANCEL":
+		// we answer immediately, so there is never anything to cancel
+		if gw.getCall(id) == nil {
+			gw.reply(m, addr, 481, "Call/Transaction Does Not Exist")
+			return
+		}
+		gw.reply(m, addr, 200, "OK")
+	case "OPTIONS":
+		r := newResponse(m, 200, "OK", newTag())
+		r.add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS")
+		r.add("Accept", "application/sdp")
+		gw.send(r, addr)
+	default:
+		r := newResponse(m, 501, "Not Implemented", "")
+		r.add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS")
+		gw.send(r, addr)
+	}
+}
+
+func (gw *gateway) gotResponse(m *sipMessage) {
+	n, method := m.cseq()
+	if method != "BYE" || m.status < 200 {
+		return
+	}
+	if c := gw.getCall(m.get("Call-ID")); c != nil {
+		c.gotByeResponse(n)
+	}
+}
+
+func (gw *gateway) gotInvite(m *sipMessage, addr *net.UDPAddr) {
+	id := m.get("Call-ID")
+	toTag := headerParam(m.get("To"), "tag")
+
+	if c := gw.getCall(id); c != nil {
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			gw.reply(m, addr, 481, "Call/Transaction Does Not Exist")
+			return
+		}
+		if toTag == "" {
+			// retransmission of the initial INVITE
+			c.sendAnswer()
+			return
+		}
+		// re-INVITE, typically a session refresh; we don't support
+		// changing the media, so we answer with the same SDP
+		r := newResponse(m, 200, "OK", c.localTag)
+		r.add("Contact", c.answer.get("Contact"))
+		r.add("Content-Type", "application/sdp")
+		r.body = c.answer.body
+		gw.send(r, addr)
+		return
+	}
+
+	if toTag != "" {
+		gw.reply(m, addr, 481, "Call/Transaction Does Not Exist")
+		return
+	}
+
+	groups := gw.config.groupsFor(uriUser(m.uri))
+	if len(groups) == 0 {
+		gw.reply(m, addr, 404, "Not Found")
+		return
+	}
+
+	if ct := m.get("Content-Type"); !strings.EqualFold(ct, "application/sdp") {
+		gw.reply(m, addr, 415, "Unsupported Media Type")
+		return
+	}
+	media, err := parseOffer(m.body, gw.codecs)
+	if err != nil {
+		log.Printf("Call %v: %v", id, err)
+		gw.reply(m, addr, 488, "Not Acceptable Here")
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		log.Printf("Call %v: %v", id, err)
+		gw.reply(m, addr, 500, "Server Internal Error")
+		return
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	c := &call{
+		gw:       gw,
+		id:       id,
+		invite:   m,
+		groups:   groups,
+		peer:     addr,
+		localTag: newTag(),
+		media:    media,
+		rtp:      conn,
+		done:     make(chan struct{}),
+		ssrc:     randomUint32(),
+		seqno:    uint16(randomUint32()),
+		lastTs:   randomUint32(),
+	}
+	c.cseq = randomUint32() >> 1
+	answer := newResponse(m, 200, "OK", c.localTag)
+	answer.add("Contact", "<sip:galene@"+gw.localAddr()+">")
+	answer.add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS")
+	answer.add("Content-Type", "application/sdp")
+	answer.body = answerSDP(media, gw.ip, port, uint64(randomUint32()))
+	c.answer = answer
+
+	gw.mu.Lock()
+	gw.calls[id] = c
+	gw.mu.Unlock()
+
+	log.Printf("Call %v: %v from %v using %v",
+		id, callerName(m), addr, media.codec.name)
+	c.start()
+}
+
+func main() {
+	var sipAddr, ip, configFile, codecs string
+	var insecure bool
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [option...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&sipAddr, "sip", ":5060",
+		"SIP listen `address`")
+	flag.StringVar(&ip, "ip", "",
+		"public IP `address` of this host, used in SIP and SDP")
+	flag.StringVar(&configFile, "config", "galene-sip.json",
+		"configuration `file`")
+	flag.StringVar(&codecs, "codecs", "opus,pcmu,pcma",
+		"comma-separated `list` of codecs, in order of preference")
+	flag.BoolVar(&insecure, "insecure", false,
+		"don't check server certificates")
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	publicIP := net.ParseIP(ip)
+	if publicIP == nil {
+		log.Fatalf("Option -ip is required")
+	}
+
+	config, err := readConfig(configFile)
+	if err != nil {
+		log.Fatalf("Read %v: %v", configFile, err)
+	}
+
+	preferred, err := parseCodecs(codecs)
+	if err != nil {
+		log.Fatalf("Parse codecs: %v", err)
+	}
+
+	if insecure {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		httpClient.Transport = t
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	api, err = newAPI()
+	if err != nil {
+		log.Fatalf("Create API: %v", err)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", sipAddr)
+	if err != nil {
+		log.Fatalf("Resolve %v: %v", sipAddr, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalf("Listen: %v", err)
+	}
+
+	gw := &gateway{
+		conn:   conn,
+		ip:     publicIP,
+		codecs: preferred,
+		config: config,
+		calls:  make(map[string]*call),
+	}
+
+	go func() {
+		err := gw.serve()
+		log.Fatalf("Serve: %v", err)
+	}()
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
+	<-terminate
+
+	gw.mu.Lock()
+	calls := make([]*call, 0, len(gw.calls))
+	for _, c := range gw.calls {
+		calls = append(calls, c)
+	}
+	gw.mu.Unlock()
+	for _, c := range calls {
+		c.hangup("shutting down")
+	}
+	if len(calls) > 0 {
+		// give the BYEs a chance to be delivered
+		time.Sleep(time.Second)
+	}
+}
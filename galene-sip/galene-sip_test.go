@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "galene-sip.json")
+	write := func(s string) {
+		err := os.WriteFile(filename, []byte(s), 0o600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	write(`{
+	    "groups": {"1234": {"url": "https://galene.example.org/group/a/"}},
+	    "numbers": {
+	        "+33123456789": {
+	            "": {"url": "https://galene.example.org/group/b/"}
+	        }
+	    }
+	}`)
+	config, err := readConfig(filename)
+	if err != nil {
+		t.Fatalf("readConfig: %v", err)
+	}
+	g := config.groupsFor("+33123456789")[""]
+	if g == nil || g.URL != "https://galene.example.org/group/b/" {
+		t.Errorf("Number: got %v", g)
+	}
+	g = config.groupsFor("+33987654321")["1234"]
+	if g == nil || g.URL != "https://galene.example.org/group/a/" {
+		t.Errorf("Default: got %v", g)
+	}
+
+	bad := []string{
+		`{}`,
+		`{"groups": {"12a": {"url": "https://galene.example.org/"}}}`,
+		`{"groups": {"1234": {}}}`,
+		`{"numbers": {"100": {}}}`,
+		`{"numbers": {"100": {"1": {"url": ""}}}}`,
+	}
+	for _, b := range bad {
+		write(b)
+		_, err := readConfig(filename)
+		if err == nil {
+			t.Errorf("readConfig(%v) succeeded", b)
+		}
+	}
+}
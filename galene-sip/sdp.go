@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// A codec is an audio codec that can be forwarded without transcoding.
+type codec struct {
+	name      string
+	mimeType  string
+	clockRate uint32
+	channels  uint16
+}
+
+var knownCodecs = map[string]codec{
+	"opus": {"opus", webrtc.MimeTypeOpus, 48000, 2},
+	"pcmu": {"PCMU", webrtc.MimeTypePCMU, 8000, 0},
+	"pcma": {"PCMA", webrtc.MimeTypePCMA, 8000, 0},
+}
+
+// capability returns the WebRTC capability of a codec.
+func (c codec) capability() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{
+		MimeType:  c.mimeType,
+		ClockRate: c.clockRate,
+		Channels:  c.channels,
+	}
+}
+
+// callMedia describes the audio stream negotiated with the caller.
+type callMedia struct {
+	addr   *net.UDPAddr
+	codec  codec
+	pt     uint8
+	dtmfPT int
+	// the clock rate of telephone events, which may differ from the
+	// codec's
+	dtmfRate string
+}
+
+var errNoCodec = errors.New("no common codec")
+
+// parseOffer parses the caller's SDP and chooses the first codec in
+// preferred that the caller supports.
+func parseOffer(body []byte, preferred []codec) (*callMedia, error) {
+	var s sdp.SessionDescription
+	err := s.Unmarshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range s.MediaDescriptions {
+		if m.MediaName.Media != "audio" || m.MediaName.Port.Value == 0 {
+			continue
+		}
+		if strings.Join(m.MediaName.Protos, "/") != "RTP/AVP" {
+			return nil, errors.New("unsupported media profile")
+		}
+
+		c := m.ConnectionInformation
+		if c == nil {
+			c = s.ConnectionInformation
+		}
+		if c == nil || c.Address == nil {
+			return nil, errors.New("no connection address")
+		}
+		ip := net.ParseIP(c.Address.Address)
+		if ip == nil {
+			return nil, errors.New("bad connection address")
+		}
+
+		// map payload types to lowercase encoding names and rates
+		names := make(map[int]string)
+		for _, f := range m.MediaName.Formats {
+			pt, err := strconv.Atoi(f)
+			if err != nil {
+				continue
+			}
+			switch pt {
+			case 0:
+				names[pt] = "pcmu/8000"
+			case 8:
+				names[pt] = "pcma/8000"
+			default:
+				names[pt] = ""
+			}
+		}
+		for _, a := range m.Attributes {
+			if a.Key != "rtpmap" {
+				continue
+			}
+			fields := strings.Fields(a.Value)
+			if len(fields) != 2 {
+				continue
+			}
+			pt, err := strconv.Atoi(fields[0])
+			if err != nil {
+				continue
+			}
+			if _, ok := names[pt]; ok {
+				names[pt] = strings.ToLower(fields[1])
+			}
+		}
+
+		media := &callMedia{
+			addr: &net.UDPAddr{
+				IP:   ip,
+				Port: m.MediaName.Port.Value,
+			},
+			dtmfPT: -1,
+		}
+		found := false
+	outer:
+		for _, cd := range preferred {
+			for _, f := range m.MediaName.Formats {
+				pt, _ := strconv.Atoi(f)
+				name := strings.SplitN(names[pt], "/", 2)[0]
+				if name == strings.ToLower(cd.name) {
+					media.codec = cd
+					media.pt = uint8(pt)
+					found = true
+					break outer
+				}
+			}
+		}
+		if !found {
+			return nil, errNoCodec
+		}
+
+		for _, f := range m.MediaName.Formats {
+			pt, _ := strconv.Atoi(f)
+			fields := strings.Split(names[pt], "/")
+			if fields[0] != "telephone-event" {
+				continue
+			}
+			// prefer the rate that matches the audio codec
+			rate := "8000"
+			if len(fields) > 1 {
+				rate = fields[1]
+			}
+			if media.dtmfPT < 0 ||
+				rate == fmt.Sprint(media.codec.clockRate) {
+				media.dtmfPT = pt
+				media.dtmfRate = rate
+			}
+		}
+		return media, nil
+	}
+	return nil, errors.New("no audio stream")
+}
+
+// answerSDP returns the SDP answer for media received at ip:port.
+func answerSDP(media *callMedia, ip net.IP, port int, session uint64) []byte {
+	family := "IP4"
+	if ip.To4() == nil {
+		family = "IP6"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\n")
+	fmt.Fprintf(&b, "o=galene-sip %v %v IN %v %v\r\n",
+		session, session, family, ip)
+	fmt.Fprintf(&b, "s=-\r\n")
+	fmt.Fprintf(&b, "c=IN %v %v\r\n", family, ip)
+	fmt.Fprintf(&b, "t=0 0\r\n")
+	if media.dtmfPT >= 0 {
+		fmt.Fprintf(&b, "m=audio %v RTP/AVP %v %v\r\n",
+			port, media.pt, media.dtmfPT)
+	} else {
+		fmt.Fprintf(&b, "m=audio %v RTP/AVP %v\r\n", port, media.pt)
+	}
+	if media.codec.channels > 0 {
+		fmt.Fprintf(&b, "a=rtpmap:%v %v/%v/%v\r\n", media.pt,
+			media.codec.name, media.codec.clockRate,
+			media.codec.channels)
+	} else {
+		fmt.Fprintf(&b, "a=rtpmap:%v %v/%v\r\n", media.pt,
+			media.codec.name, media.codec.clockRate)
+	}
+	if media.dtmfPT >= 0 {
+		fmt.Fprintf(&b, "a=rtpmap:%v telephone-event/%v\r\n",
+			media.dtmfPT, media.dtmfRate)
+		fmt.Fprintf(&b, "a=fmtp:%v 0-15\r\n", media.dtmfPT)
+	}
+	fmt.Fprintf(&b, "a=ptime:20\r\n")
+	fmt.Fprintf(&b, "a=sendrecv\r\n")
+	return []byte(b.String())
+}
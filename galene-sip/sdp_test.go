@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+const offer = "v=0\r\n" +
+	"o=- 1 1 IN IP4 192.0.2.1\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.0.2.1\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 4000 RTP/AVP 0 8 111 101 102\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=rtpmap:101 telephone-event/8000\r\n" +
+	"a=rtpmap:102 telephone-event/48000\r\n" +
+	"a=sendrecv\r\n"
+
+func TestParseOffer(t *testing.T) {
+	opus := knownCodecs["opus"]
+	pcmu := knownCodecs["pcmu"]
+	pcma := knownCodecs["pcma"]
+
+	m, err := parseOffer([]byte(offer), []codec{pcma, opus})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if m.codec != pcma || m.pt != 8 {
+		t.Errorf("Expected PCMA/8, got %v/%v", m.codec.name, m.pt)
+	}
+	if m.dtmfPT != 101 || m.dtmfRate != "8000" {
+		t.Errorf("Bad DTMF %v/%v", m.dtmfPT, m.dtmfRate)
+	}
+	if !m.addr.IP.Equal(net.ParseIP("192.0.2.1")) || m.addr.Port != 4000 {
+		t.Errorf("Bad address %v", m.addr)
+	}
+
+	m, err = parseOffer([]byte(offer), []codec{opus, pcmu})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if m.codec != opus || m.pt != 111 {
+		t.Errorf("Expected opus/111, got %v/%v", m.codec.name, m.pt)
+	}
+	if m.dtmfPT != 102 || m.dtmfRate != "48000" {
+		t.Errorf("Bad DTMF %v/%v", m.dtmfPT, m.dtmfRate)
+	}
+
+	noOpus := "v=0\r\no=- 1 1 IN IP4 192.0.2.1\r\ns=-\r\n" +
+		"c=IN IP4 192.0.2.1\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n"
+	_, err = parseOffer([]byte(noOpus), []codec{opus})
+	if err != errNoCodec {
+		t.Errorf("Expected errNoCodec, got %v", err)
+	}
+
+	srtp := "v=0\r\no=- 1 1 IN IP4 192.0.2.1\r\ns=-\r\n" +
+		"c=IN IP4 192.0.2.1\r\nt=0 0\r\nm=audio 4000 RTP/SAVP 0\r\n"
+	_, err = parseOffer([]byte(srtp), []codec{pcmu})
+	if err == nil {
+		t.Errorf("Accepted SRTP")
+	}
+}
+
+func TestAnswerSDP(t *testing.T) {
+	m, err := parseOffer([]byte(offer), []codec{knownCodecs["opus"]})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	answer := answerSDP(m, net.ParseIP("198.51.100.1"), 5000, 42)
+
+	// the answer must be acceptable as an offer
+	m2, err := parseOffer(answer, []codec{knownCodecs["opus"]})
+	if err != nil {
+		t.Fatalf("Parse answer: %v", err)
+	}
+	if m2.pt != m.pt || m2.dtmfPT != m.dtmfPT || m2.dtmfRate != m.dtmfRate {
+		t.Errorf("Mismatch: %v %v", m, m2)
+	}
+	if !m2.addr.IP.Equal(net.ParseIP("198.51.100.1")) ||
+		m2.addr.Port != 5000 {
+		t.Errorf("Bad address %v", m2.addr)
+	}
+}
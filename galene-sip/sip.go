@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A sipMessage is a SIP request or response.  Headers are kept in order
+// with their canonical names, which is required for Via and Record-Route.
+type sipMessage struct {
+	method string
+	uri    string
+	status int
+	reason string
+
+	headers []sipHeader
+	body    []byte
+}
+
+type sipHeader struct {
+	name, value string
+}
+
+var compactHeaders = map[string]string{
+	"c": "Content-Type",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"s": "Subject",
+	"t": "To",
+	"v": "Via",
+}
+
+var canonicalHeaders = map[string]string{
+	"call-id":          "Call-ID",
+	"cseq":             "CSeq",
+	"www-authenticate": "WWW-Authenticate",
+}
+
+func canonicalHeader(name string) string {
+	if c, ok := compactHeaders[strings.ToLower(name)]; ok {
+		return c
+	}
+	lower := strings.ToLower(name)
+	if c, ok := canonicalHeaders[lower]; ok {
+		return c
+	}
+	parts := strings.Split(lower, "-")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+var errMalformed = errors.New("malformed SIP message")
+
+// parseSIP parses a SIP message received over UDP.
+func parseSIP(data []byte) (*sipMessage, error) {
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+	sep := 4
+	if i < 0 {
+		i = bytes.Index(data, []byte("\n\n"))
+		sep = 2
+	}
+	if i < 0 {
+		return nil, errMalformed
+	}
+	head := strings.ReplaceAll(string(data[:i]), "\r\n", "\n")
+	body := data[i+sep:]
+
+	lines := strings.Split(head, "\n")
+	// unfold continuation lines
+	var unfolded []string
+	for _, l := range lines {
+		if len(unfolded) > 0 && (strings.HasPrefix(l, " ") ||
+			strings.HasPrefix(l, "\t")) {
+			unfolded[len(unfolded)-1] += " " + strings.TrimSpace(l)
+			continue
+		}
+		unfolded = append(unfolded, l)
+	}
+	if len(unfolded) == 0 {
+		return nil, errMalformed
+	}
+
+	m := &sipMessage{}
+	first := strings.SplitN(unfolded[0], " ", 3)
+	if len(first) != 3 {
+		return nil, errMalformed
+	}
+	if strings.HasPrefix(first[0], "SIP/") {
+		status, err := strconv.Atoi(first[1])
+		if err != nil || status < 100 || status > 699 {
+			return nil, errMalformed
+		}
+		m.status = status
+		m.reason = first[2]
+	} else {
+		if !strings.HasPrefix(first[2], "SIP/") {
+			return nil, errMalformed
+		}
+		m.method = strings.ToUpper(first[0])
+		m.uri = first[1]
+	}
+
+	for _, l := range unfolded[1:] {
+		colon := strings.IndexByte(l, ':')
+		if colon <= 0 {
+			return nil, errMalformed
+		}
+		m.headers = append(m.headers, sipHeader{
+			name:  canonicalHeader(strings.TrimSpace(l[:colon])),
+			value: strings.TrimSpace(l[colon+1:]),
+		})
+	}
+
+	if cl := m.get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > len(body) {
+			return nil, errMalformed
+		}
+		body = body[:n]
+	}
+	m.body = body
+	return m, nil
+}
+
+func (m *sipMessage) isRequest() bool {
+	return m.method != ""
+}
+
+// get returns the first value of the given header.
+func (m *sipMessage) get(name string) string {
+	name = canonicalHeader(name)
+	for _, h := range m.headers {
+		if h.name == name {
+			return h.value
+		}
+	}
+	return ""
+}
+
+// getAll returns all the values of the given header, in order.
+func (m *sipMessage) getAll(name string) []string {
+	name = canonicalHeader(name)
+	var values []string
+	for _, h := range m.headers {
+		if h.name == name {
+			values = append(values, h.value)
+		}
+	}
+	return values
+}
+
+func (m *sipMessage) add(name, value string) {
+	m.headers = append(m.headers, sipHeader{canonicalHeader(name), value})
+}
+
+// set replaces all values of the given header.
+func (m *sipMessage) set(name, value string) {
+	name = canonicalHeader(name)
+	for i, h := range m.headers {
+		if h.name == name {
+			m.headers[i].value = value
+			j := i + 1
+			for _, hh := range m.headers[i+1:] {
+				if hh.name != name {
+					m.headers[j] = hh
+					j++
+				}
+			}
+			m.headers = m.headers[:j]
+			return
+		}
+	}
+	m.add(name, value)
+}
+
+// cseq returns the sequence number and method of the CSeq header.
+func (m *sipMessage) cseq() (uint32, string) {
+	fields := strings.Fields(m.get("CSeq"))
+	if len(fields) != 2 {
+		return 0, ""
+	}
+	n, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, ""
+	}
+	return uint32(n), strings.ToUpper(fields[1])
+}
+
+func (m *sipMessage) marshal() []byte {
+	var b bytes.Buffer
+	if m.isRequest() {
+		fmt.Fprintf(&b, "%v %v SIP/2.0\r\n", m.method, m.uri)
+	} else {
+		fmt.Fprintf(&b, "SIP/2.0 %v %v\r\n", m.status, m.reason)
+	}
+	for _, h := range m.headers {
+		if h.name == "Content-Length" {
+			continue
+		}
+		fmt.Fprintf(&b, "%v: %v\r\n", h.name, h.value)
+	}
+	fmt.Fprintf(&b, "Content-Length: %v\r\n\r\n", len(m.body))
+	b.Write(m.body)
+	return b.Bytes()
+}
+
+// newResponse creates a response to a request.  If toTag is not empty
+// and the request has no To tag, it is added.
+func newResponse(req *sipMessage, status int, reason string, toTag string) *sipMessage {
+	r := &sipMessage{status: status, reason: reason}
+	for _, h := range req.headers {
+		switch h.name {
+		case "Via", "From", "Call-ID", "CSeq", "Record-Route":
+			r.headers = append(r.headers, h)
+		case "To":
+			v := h.value
+			if toTag != "" && headerParam(v, "tag") == "" {
+				v = v + ";tag=" + toTag
+			}
+			r.headers = append(r.headers, sipHeader{h.name, v})
+		}
+	}
+	return r
+}
+
+// headerParam returns the value of a parameter of an address header,
+// such as the tag of a From header.
+func headerParam(value, param string) string {
+	// parameters follow the address, which may contain semicolons
+	// when it is enclosed in angle brackets
+	if i := strings.LastIndexByte(value, '>'); i >= 0 {
+		value = value[i+1:]
+	} else if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[i:]
+	} else {
+		return ""
+	}
+	for _, p := range strings.Split(value, ";") {
+		p = strings.TrimSpace(p)
+		kv := strings.SplitN(p, "=", 2)
+		if strings.EqualFold(kv[0], param) {
+			if len(kv) == 2 {
+				return strings.Trim(kv[1], "\"")
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// headerURI returns the URI of an address header.
+func headerURI(value string) string {
+	if i := strings.IndexByte(value, '<'); i >= 0 {
+		j := strings.IndexByte(value[i:], '>')
+		if j < 0 {
+			return ""
+		}
+		return value[i+1 : i+j]
+	}
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// headerDisplayName returns the display name of an address header.
+func headerDisplayName(value string) string {
+	i := strings.IndexByte(value, '<')
+	if i <= 0 {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(value[:i]), "\"")
+}
+
+// uriUser returns the user part of a SIP URI.
+func uriUser(uri string) string {
+	if i := strings.IndexByte(uri, ':'); i >= 0 {
+		uri = uri[i+1:]
+	}
+	at := strings.IndexByte(uri, '@')
+	if at < 0 {
+		return ""
+	}
+	user := uri[:at]
+	if i := strings.IndexByte(user, ';'); i >= 0 {
+		user = user[:i]
+	}
+	return user
+}
+
+// callerName returns a human-readable name for the caller of an INVITE.
+func callerName(req *sipMessage) string {
+	from := req.get("From")
+	if name := headerDisplayName(from); name != "" {
+		return name
+	}
+	if user := uriUser(headerURI(from)); user != "" {
+		return user
+	}
+	return "phone"
+}
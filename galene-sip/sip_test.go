@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+const invite = "INVITE sip:1000@gw.example.org SIP/2.0\r\n" +
+	"v: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK776asdhds\r\n" +
+	"Via: SIP/2.0/UDP 192.0.2.2:5060;branch=z9hG4bK1234\r\n" +
+	"Max-Forwards: 70\r\n" +
+	"To: <sip:1000@gw.example.org>\r\n" +
+	"From: \"Alice Smith\" <sip:+15551234@trunk.example.org;user=phone>\r\n" +
+	" ;tag=1928301774\r\n" +
+	"i: a84b4c76e66710@pc33.example.org\r\n" +
+	"CSEQ: 314159 INVITE\r\n" +
+	"Contact: <sip:+15551234@192.0.2.1:5060>\r\n" +
+	"Record-Route: <sip:p1.example.org;lr>\r\n" +
+	"Record-Route: <sip:p2.example.org;lr>\r\n" +
+	"c: application/sdp\r\n" +
+	"l: 4\r\n" +
+	"\r\n" +
+	"v=0\r\ngarbage"
+
+func TestParseSIP(t *testing.T) {
+	m, err := parseSIP([]byte(invite))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if !m.isRequest() || m.method != "INVITE" ||
+		m.uri != "sip:1000@gw.example.org" {
+		t.Errorf("Bad request line %v %v", m.method, m.uri)
+	}
+	if id := m.get("call-id"); id != "a84b4c76e66710@pc33.example.org" {
+		t.Errorf("Bad Call-ID %v", id)
+	}
+	if n, method := m.cseq(); n != 314159 || method != "INVITE" {
+		t.Errorf("Bad CSeq %v %v", n, method)
+	}
+	if len(m.getAll("Via")) != 2 {
+		t.Errorf("Expected two Via, got %v", m.getAll("Via"))
+	}
+	if tag := headerParam(m.get("From"), "tag"); tag != "1928301774" {
+		t.Errorf("Bad From tag %v", tag)
+	}
+	if string(m.body) != "v=0\r" {
+		t.Errorf("Bad body %q", m.body)
+	}
+
+	r, err := parseSIP([]byte("SIP/2.0 200 OK\r\nCSeq: 2 BYE\r\n\r\n"))
+	if err != nil || r.isRequest() || r.status != 200 {
+		t.Errorf("Parse response: %v %v", r, err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"INVITE sip:x SIP/2.0",
+		"INVITE sip:x\r\n\r\n",
+		"SIP/2.0 42 Huh\r\n\r\n",
+		"INVITE sip:x SIP/2.0\r\nNoColon\r\n\r\n",
+		"INVITE sip:x SIP/2.0\r\nContent-Length: 10\r\n\r\nshort",
+	} {
+		_, err := parseSIP([]byte(bad))
+		if err == nil {
+			t.Errorf("Parsed %q", bad)
+		}
+	}
+}
+
+func TestNewResponse(t *testing.T) {
+	m, err := parseSIP([]byte(invite))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	r := newResponse(m, 200, "OK", "abc")
+	if tag := headerParam(r.get("To"), "tag"); tag != "abc" {
+		t.Errorf("Bad To tag %v", tag)
+	}
+	vias := r.getAll("Via")
+	if len(vias) != 2 || vias[0] != m.getAll("Via")[0] {
+		t.Errorf("Bad Via %v", vias)
+	}
+	if len(r.getAll("Record-Route")) != 2 {
+		t.Errorf("Bad Record-Route %v", r.getAll("Record-Route"))
+	}
+	if r.get("Contact") != "" || r.get("Max-Forwards") != "" {
+		t.Errorf("Unexpected header copied")
+	}
+
+	// an existing tag is preserved
+	r2 := newResponse(r2Request(r), 200, "OK", "def")
+	if tag := headerParam(r2.get("To"), "tag"); tag != "abc" {
+		t.Errorf("Tag was replaced: %v", tag)
+	}
+
+	r.body = []byte("body")
+	data := r.marshal()
+	if !bytes.HasPrefix(data, []byte("SIP/2.0 200 OK\r\n")) ||
+		!bytes.HasSuffix(data, []byte("Content-Length: 4\r\n\r\nbody")) {
+		t.Errorf("Bad marshalled response %q", data)
+	}
+	r3, err := parseSIP(data)
+	if err != nil || r3.get("Call-ID") != m.get("Call-ID") {
+		t.Errorf("Round trip: %v", err)
+	}
+}
+
+// r2Request returns a request with the headers of a response, which is
+// enough to check the handling of To tags.
+func r2Request(r *sipMessage) *sipMessage {
+	return &sipMessage{method: "INVITE", uri: "sip:x", headers: r.headers}
+}
+
+func TestSet(t *testing.T) {
+	m := &sipMessage{method: "OPTIONS", uri: "sip:x"}
+	m.add("Via", "a")
+	m.add("To", "b")
+	m.add("Via", "c")
+	m.set("via", "d")
+	if v := m.getAll("Via"); len(v) != 1 || v[0] != "d" {
+		t.Errorf("Bad Via %v", v)
+	}
+	if m.get("To") != "b" || len(m.headers) != 2 {
+		t.Errorf("Bad headers %v", m.headers)
+	}
+}
+
+func TestAddressHeaders(t *testing.T) {
+	tests := []struct {
+		value, uri, name, user string
+	}{
+		{"\"Alice\" <sip:alice@example.org;transport=udp>;tag=x",
+			"sip:alice@example.org;transport=udp", "Alice", "alice"},
+		{"Bob <sips:+1555@example.org>", "sips:+1555@example.org",
+			"Bob", "+1555"},
+		{"sip:carol@example.org;tag=y", "sip:carol@example.org",
+			"", "carol"},
+		{"<sip:example.org>", "sip:example.org", "", ""},
+	}
+	for _, tt := range tests {
+		if uri := headerURI(tt.value); uri != tt.uri {
+			t.Errorf("%v: URI %v", tt.value, uri)
+		}
+		if name := headerDisplayName(tt.value); name != tt.name {
+			t.Errorf("%v: name %v", tt.value, name)
+		}
+		if user := uriUser(tt.uri); user != tt.user {
+			t.Errorf("%v: user %v", tt.value, user)
+		}
+	}
+
+	m := &sipMessage{}
+	m.add("From", "<sip:example.org>;tag=z")
+	if name := callerName(m); name != "phone" {
+		t.Errorf("Expected phone, got %v", name)
+	}
+}
+
+func TestCanonicalHeader(t *testing.T) {
+	tests := map[string]string{
+		"v":              "Via",
+		"CALL-ID":        "Call-ID",
+		"record-route":   "Record-Route",
+		"content-length": "Content-Length",
+		"cseq":           "CSeq",
+	}
+	for h, c := range tests {
+		if cc := canonicalHeader(h); cc != c {
+			t.Errorf("%v: expected %v, got %v", h, c, cc)
+		}
+	}
+}
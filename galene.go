@@ -1,8 +1,8 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -14,16 +14,31 @@ import (
 
 	"github.com/jech/galene/diskwriter"
 	"github.com/jech/galene/group"
+	"github.com/jech/galene/groupdb"
 	"github.com/jech/galene/ice"
 	"github.com/jech/galene/limit"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/notify"
+	"github.com/jech/galene/qualitylog"
+	"github.com/jech/galene/rtmp"
+	"github.com/jech/galene/rtpconn"
+	"github.com/jech/galene/rtsp"
+	"github.com/jech/galene/shared"
+	"github.com/jech/galene/srt"
+	"github.com/jech/galene/systemd"
+	"github.com/jech/galene/testsource"
 	"github.com/jech/galene/token"
 	"github.com/jech/galene/turnserver"
+	"github.com/jech/galene/upload"
 	"github.com/jech/galene/webserver"
 )
 
+var logger = logging.New("galene")
+
 func main() {
-	var cpuprofile, memprofile, mutexprofile, httpAddr string
-	var udpRange string
+	var cpuprofile, memprofile, mutexprofile string
+	var checkConfig bool
+	var logLevel, logFormat string
 
 	flag.StringVar(&httpAddr, "http", ":8443", "web server `address`")
 	flag.StringVar(&webserver.StaticRoot, "static", "./static/",
@@ -44,32 +59,114 @@ func main() {
 		"store mutex profile in `file`")
 	flag.StringVar(&udpRange, "udp-range", "",
 		"UDP port `range`")
-	flag.BoolVar(&group.UseMDNS, "mdns", false, "gather mDNS addresses")
-	flag.BoolVar(&ice.ICERelayOnly, "relay-only", false,
+	flag.BoolVar(&group.UseMDNS, "mdns", false, "resolve mDNS candidates")
+	flag.BoolVar(&relayOnly, "relay-only", false,
 		"require use of TURN relays for all media traffic")
 	flag.StringVar(&turnserver.Address, "turn", "auto",
 		"built-in TURN server `address` (\"\" to disable)")
+	flag.StringVar(&rtmpAddr, "rtmp", "",
+		"RTMP ingest `address` (\"\" to disable)")
+	flag.IntVar(&rtpconn.EgressWorkers, "egress-workers", 0,
+		"`number` of goroutines used for sending media "+
+			"(0 means the number of CPUs)")
+	flag.Func("impair",
+		"simulate network `conditions` on down connections, "+
+			"e.g. user=bob,loss=5,reorder=1 (for debugging, "+
+			"may be repeated)",
+		func(s string) error {
+			i, err := rtpconn.ParseImpairment(s)
+			if err != nil {
+				return err
+			}
+			rtpconn.Impairments = append(rtpconn.Impairments, i)
+			return nil
+		})
+	flag.BoolVar(&checkConfig, "check-config", false,
+		"check the configuration, print it and exit")
+	flag.StringVar(&logLevel, "log-level", "info",
+		"log `level`, optionally followed by per-module levels, "+
+			"e.g. warn,rtpconn=debug")
+	flag.StringVar(&logFormat, "log-format", "text",
+		"log `format` (text or json)")
 	flag.Parse()
 
+	err := logging.SetLevels(logLevel)
+	if err == nil {
+		err = logging.SetFormat(logFormat)
+	}
+	if err != nil {
+		logger.Errorf("Logging: %v", err)
+		os.Exit(1)
+	}
+	// messages logged by libraries go through the same logger
+	log.SetFlags(0)
+	log.SetOutput(logging.Writer(""))
+
+	flags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		flags[f.Name] = true
+	})
+
+	conf, err := group.GetConfiguration()
+	if err == nil {
+		err = checkConfiguration(conf)
+	}
+	if err != nil {
+		logger.Errorf("Configuration: %v", err)
+		os.Exit(1)
+	}
+	err = applyConfiguration(nil, conf, flags, true)
+	if err != nil {
+		logger.Errorf("Configuration: %v", err)
+		os.Exit(1)
+	}
+	// flush the quality log on exit
+	defer qualitylog.Configure(nil)
+
 	if udpRange != "" {
-		var min, max uint16
-		n, err := fmt.Sscanf(udpRange, "%v-%v", &min, &max)
+		min, max, err := group.ParseUDPRange(udpRange)
 		if err != nil {
-			log.Printf("UDP range: %v", err)
-			os.Exit(1)
-		}
-		if n != 2 || min <= 0 || max <= 0 || min > max {
-			log.Printf("UDP range: bad range")
+			logger.Errorf("UDP range: %v", err)
 			os.Exit(1)
 		}
 		group.UDPMin = min
 		group.UDPMax = max
 	}
 
+	if checkConfig {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "    ")
+		err := e.Encode(effectiveConfiguration(conf))
+		if err != nil {
+			logger.Errorf("Configuration: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	deprecatedFlags(flags)
+
+	if udpMuxAddr != "" {
+		err := group.ListenICEUDP(udpMuxAddr)
+		if err != nil {
+			logger.Errorf("UDP mux: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if iceTCPAddr != "" {
+		err := group.ListenICETCP(iceTCPAddr)
+		if err != nil {
+			logger.Errorf("ICE-TCP: %v", err)
+			os.Exit(1)
+		}
+	}
+	defer group.CloseICEMux()
+
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
 		if err != nil {
-			log.Printf("Create(cpuprofile): %v", err)
+			logger.Errorf("Create(cpuprofile): %v", err)
 			return
 		}
 		pprof.StartCPUProfile(f)
@@ -83,7 +180,7 @@ func main() {
 		defer func() {
 			f, err := os.Create(memprofile)
 			if err != nil {
-				log.Printf("Create(memprofile): %v", err)
+				logger.Errorf("Create(memprofile): %v", err)
 				return
 			}
 			pprof.WriteHeapProfile(f)
@@ -96,7 +193,7 @@ func main() {
 		defer func() {
 			f, err := os.Create(mutexprofile)
 			if err != nil {
-				log.Printf("Create(mutexprofile): %v", err)
+				logger.Errorf("Create(mutexprofile): %v", err)
 				return
 			}
 			pprof.Lookup("mutex").WriteTo(f, 0)
@@ -106,9 +203,9 @@ func main() {
 
 	n, err := limit.Nofile(0xFFFF)
 	if err != nil {
-		log.Printf("Couldn't set file descriptor limit: %v", err)
+		logger.Warnf("Couldn't set file descriptor limit: %v", err)
 	} else if n < 0xFFFF {
-		log.Printf("File descriptor limit is %v, please increase it!", n)
+		logger.Warnf("File descriptor limit is %v, please increase it!", n)
 	}
 
 	ice.ICEFilename = filepath.Join(group.DataDirectory, "ice-servers.json")
@@ -119,8 +216,56 @@ func main() {
 		),
 	)
 
-	// make sure the list of public groups is updated early
-	go group.Update()
+	group.NotifyHook = notify.Notify
+	rtpconn.NewRestreamer = rtmp.NewPush
+	rtpconn.UpdateCameras = rtsp.Update
+	rtpconn.StartTestSource = testsource.Start
+	rtpconn.StopTestSource = testsource.Stop
+	diskwriter.Finished = upload.File
+
+	if conf.SharedState != "" {
+		store, err := shared.Open(conf.SharedState)
+		if err != nil {
+			logger.Warnf("Shared state: %v", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		group.SharedStore = store
+		token.SetStore(store)
+	}
+
+	if conf.GroupDatabase != "" {
+		db, err := groupdb.Open(conf.GroupDatabase)
+		if err != nil {
+			logger.Errorf("Group database: %v", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		group.Store = db
+	}
+
+	// this must happen before any recording is started
+	diskwriter.Recover()
+
+	// under systemd, a broken certificate causes startup to time out
+	certErr := webserver.CheckCertificate(group.DataDirectory)
+	if certErr != nil {
+		logger.Errorf("Certificate: %v", certErr)
+	}
+
+	listener, err := webserver.Listen(httpAddr)
+	if err != nil {
+		logger.Errorf("Listen: %v", err)
+		os.Exit(1)
+	}
+
+	// make sure the list of public groups is updated before we
+	// declare ourselves ready
+	group.Update()
+
+	if !webserver.Insecure {
+		turnserver.GetCertificate = webserver.GetCertificate
+	}
 
 	// causes the built-in server to start if required
 	ice.Update()
@@ -128,34 +273,131 @@ func main() {
 
 	serverDone := make(chan struct{})
 	go func() {
-		err := webserver.Serve(httpAddr, group.DataDirectory)
+		err := webserver.Serve(listener, group.DataDirectory)
 		if err != nil {
-			log.Printf("Server: %v", err)
+			logger.Errorf("Server: %v", err)
 		}
 		close(serverDone)
 	}()
 
+	if rtmpAddr != "" {
+		go func() {
+			err := rtmp.Serve(rtmpAddr)
+			if err != nil {
+				logger.Warnf("RTMP: %v", err)
+			}
+		}()
+		defer rtmp.Shutdown()
+	}
+
+	if srtAddr != "" {
+		go func() {
+			err := srt.Serve(srtAddr)
+			if err != nil {
+				logger.Warnf("SRT: %v", err)
+			}
+		}()
+		defer srt.Shutdown()
+	}
+
 	terminate := make(chan os.Signal, 1)
 	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
 
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	drain := make(chan os.Signal, 1)
+	if len(drainSignals) > 0 {
+		signal.Notify(drain, drainSignals...)
+	}
+	draining := group.Draining()
+	var drainCheck <-chan time.Time
+	var drainDeadline time.Time
+
+	if certErr == nil {
+		err = systemd.Notify("READY=1")
+		if err != nil {
+			logger.Warnf("Notify: %v", err)
+		}
+	}
+
+	var watchdog <-chan time.Time
+	if d := systemd.WatchdogInterval(); d > 0 {
+		watchdogTicker := time.NewTicker(d / 2)
+		defer watchdogTicker.Stop()
+		watchdog = watchdogTicker.C
+	}
+
 	go relayTest()
 
+	if group.Store == nil {
+		go func() {
+			err := group.Watch(nil)
+			if err != nil {
+				logger.Warnf(
+					"Couldn't watch groups directory: %v",
+					err,
+				)
+			}
+		}()
+	}
+
 	ticker := time.NewTicker(15 * time.Minute)
 	defer ticker.Stop()
 
 	slowTicker := time.NewTicker(12 * time.Hour)
 	defer slowTicker.Stop()
 
+	var sharedSync <-chan time.Time
+	if group.SharedStore != nil {
+		sharedTicker := time.NewTicker(group.SharedInterval)
+		defer sharedTicker.Stop()
+		sharedSync = sharedTicker.C
+	}
+
 	for {
 		select {
 		case <-ticker.C:
 			go func() {
 				group.Update()
+				rtpconn.UpdateCascades()
+				rtsp.UpdateAll()
 				token.Expire()
+				diskwriter.Expire()
 			}()
 		case <-slowTicker.C:
 			go relayTest()
+		case <-sharedSync:
+			group.SyncShared()
+		case <-hangup:
+			conf = reloadConfiguration(conf, flags)
+		case <-drain:
+			group.Drain(conf.DrainMessage)
+		case <-draining:
+			draining = nil
+			timeout := 30 * time.Minute
+			if conf.DrainTimeout > 0 {
+				timeout = time.Duration(conf.DrainTimeout) *
+					time.Second
+			}
+			logger.Infof("Draining, exiting in at most %v", timeout)
+			drainDeadline = time.Now().Add(timeout)
+			drainTicker := time.NewTicker(time.Second)
+			defer drainTicker.Stop()
+			drainCheck = drainTicker.C
+		case <-drainCheck:
+			if group.UserCount() > 0 &&
+				time.Now().Before(drainDeadline) {
+				continue
+			}
+			logger.Infof("Drained, exiting")
+			systemd.Notify("STOPPING=1")
+			webserver.Shutdown()
+			return
+		case <-watchdog:
+			systemd.Notify("WATCHDOG=1")
 		case <-terminate:
+			systemd.Notify("STOPPING=1")
 			webserver.Shutdown()
 			return
 		case <-serverDone:
@@ -168,9 +410,9 @@ func relayTest() {
 	now := time.Now()
 	d, err := ice.RelayTest(20 * time.Second)
 	if err != nil {
-		log.Printf("Relay test failed: %v", err)
-		log.Printf("Perhaps you didn't configure a TURN server?")
+		logger.Errorf("Relay test failed: %v", err)
+		logger.Errorf("Perhaps you didn't configure a TURN server?")
 		return
 	}
-	log.Printf("Relay test successful in %v, RTT = %v", time.Since(now), d)
+	logger.Infof("Relay test successful in %v, RTT = %v", time.Since(now), d)
 }
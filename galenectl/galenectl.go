@@ -0,0 +1,386 @@
+// Galenectl is a command-line client for administering a Galene server.
+// Statistics are read with the administrator's credentials, while
+// actions on a group are performed by joining it as an operator.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jech/galene/stats"
+)
+
+// configuration is the contents of the configuration file.  Each field
+// may be overridden by an environment variable.
+type configuration struct {
+	Server        string `json:"server"`
+	AdminUsername string `json:"admin-username,omitempty"`
+	AdminPassword string `json:"admin-password,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Insecure      bool   `json:"insecure,omitempty"`
+}
+
+var dialer = websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: 30 * time.Second,
+}
+var httpClient = http.Client{
+	Timeout: 30 * time.Second,
+}
+
+func defaultConfigFile() string {
+	if f := os.Getenv("GALENECTL_CONFIG"); f != "" {
+		return f
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "galene", "galenectl.json")
+}
+
+// readConfig reads the configuration file, which may be missing if
+// implicit, and applies the environment.
+func readConfig(filename string, implicit bool) (*configuration, error) {
+	var config configuration
+	f, err := os.Open(filename)
+	if err == nil {
+		defer f.Close()
+		d := json.NewDecoder(f)
+		d.DisallowUnknownFields()
+		err = d.Decode(&config)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", filename, err)
+		}
+	} else if !implicit || !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	env := func(name string, value *string) {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+	env("GALENECTL_SERVER", &config.Server)
+	env("GALENECTL_ADMIN_USERNAME", &config.AdminUsername)
+	env("GALENECTL_ADMIN_PASSWORD", &config.AdminPassword)
+	env("GALENECTL_USERNAME", &config.Username)
+	env("GALENECTL_PASSWORD", &config.Password)
+
+	if config.Server == "" {
+		return nil, errors.New("server URL not configured")
+	}
+	if config.Username == "" {
+		config.Username = "galenectl"
+	}
+	return &config, nil
+}
+
+// serverError returns the error returned by the server, which is the
+// body of the reply if it is plain text.
+func serverError(resp *http.Response) error {
+	ctype := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(ctype, "text/plain") {
+		return errors.New(resp.Status)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		return errors.New(resp.Status)
+	}
+	return errors.New(msg)
+}
+
+func getStats(config *configuration) ([]stats.GroupStats, error) {
+	u, err := url.JoinPath(config.Server, "stats.json")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(config.AdminUsername, config.AdminPassword)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, serverError(resp)
+	}
+	var ss []stats.GroupStats
+	err = json.NewDecoder(resp.Body).Decode(&ss)
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(v)
+}
+
+func countConns(cs []*stats.Client) (int, int) {
+	up, down := 0, 0
+	for _, c := range cs {
+		up += len(c.Up)
+		down += len(c.Down)
+	}
+	return up, down
+}
+
+func printGroups(w io.Writer, ss []stats.GroupStats) error {
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Name < ss[j].Name
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCLIENTS\tUP\tDOWN\tMEMORY")
+	for _, s := range ss {
+		up, down := countConns(s.Clients)
+		memory := s.Memory.Cache + s.Memory.History +
+			s.Memory.Queue + s.Memory.Recording
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n",
+			s.Name, len(s.Clients), up, down, memory)
+	}
+	return tw.Flush()
+}
+
+func printClients(w io.Writer, cs []*stats.Client) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUP\tDOWN")
+	for _, c := range cs {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", c.Id, len(c.Up), len(c.Down))
+	}
+	return tw.Flush()
+}
+
+func findGroup(ss []stats.GroupStats, name string) *stats.GroupStats {
+	for i := range ss {
+		if ss[i].Name == name {
+			return &ss[i]
+		}
+	}
+	return nil
+}
+
+func groupURL(config *configuration, name string) (string, error) {
+	return url.JoinPath(config.Server, "group", name)
+}
+
+// tokenURL returns the link that joins a group with a given token.
+func tokenURL(config *configuration, name, token string) (string, error) {
+	u, err := groupURL(config, name)
+	if err != nil {
+		return "", err
+	}
+	return u + "/?token=" + url.QueryEscape(token), nil
+}
+
+// groupCommand joins a group and runs f.
+func groupCommand(config *configuration, name string, f func(s *session) error) error {
+	u, err := groupURL(config, name)
+	if err != nil {
+		return err
+	}
+	s, err := join(u, config.Username, config.Password)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	return f(s)
+}
+
+// run runs a command.  It returns errUsage if the arguments are
+// incorrect.
+func run(config *configuration, jsonOutput bool, args []string) error {
+	nargs := func(lo, hi int) error {
+		if len(args)-1 < lo || len(args)-1 > hi {
+			return errUsage
+		}
+		return nil
+	}
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+
+	switch args[0] {
+	case "groups":
+		if err := nargs(0, 0); err != nil {
+			return err
+		}
+		ss, err := getStats(config)
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(os.Stdout, ss)
+		}
+		return printGroups(os.Stdout, ss)
+	case "clients":
+		if err := nargs(1, 1); err != nil {
+			return err
+		}
+		ss, err := getStats(config)
+		if err != nil {
+			return err
+		}
+		g := findGroup(ss, args[1])
+		if g == nil {
+			return errors.New("no such group")
+		}
+		if jsonOutput {
+			return printJSON(os.Stdout, g.Clients)
+		}
+		return printClients(os.Stdout, g.Clients)
+	case "kick":
+		if err := nargs(2, 3); err != nil {
+			return err
+		}
+		return groupCommand(config, args[1], func(s *session) error {
+			return s.kick(args[2], arg(3))
+		})
+	case "lock":
+		if err := nargs(1, 2); err != nil {
+			return err
+		}
+		return groupCommand(config, args[1], func(s *session) error {
+			return s.groupAction("lock", arg(2))
+		})
+	case "unlock", "unrecord":
+		if err := nargs(1, 1); err != nil {
+			return err
+		}
+		return groupCommand(config, args[1], func(s *session) error {
+			return s.groupAction(args[0], nil)
+		})
+	case "record":
+		if err := nargs(1, 2); err != nil {
+			return err
+		}
+		switch arg(2) {
+		case "", "mixed", "webm", "mp4", "ogg":
+		default:
+			return errUsage
+		}
+		return groupCommand(config, args[1], func(s *session) error {
+			var value interface{}
+			if arg(2) != "" {
+				value = arg(2)
+			}
+			return s.groupAction("record", value)
+		})
+	case "token":
+		if err := nargs(1, 3); err != nil {
+			return err
+		}
+		expires := 24 * time.Hour
+		if arg(3) != "" {
+			d, err := time.ParseDuration(arg(3))
+			if err != nil || d <= 0 {
+				return errUsage
+			}
+			expires = d
+		}
+		return groupCommand(config, args[1], func(s *session) error {
+			tok, err := s.makeToken(arg(2), expires)
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				return printJSON(os.Stdout, tok)
+			}
+			u, err := tokenURL(config, args[1], tok.Token)
+			if err != nil {
+				return err
+			}
+			fmt.Println(u)
+			return nil
+		})
+	default:
+		return errUsage
+	}
+}
+
+var errUsage = errors.New("bad usage")
+
+const commands = `Commands:
+  groups                          list the active groups
+  clients group                   list the clients in a group
+  kick group user [message]       kick a user (by username or id)
+  lock group [message]            lock a group
+  unlock group                    unlock a group
+  record group [mode]             start recording a group (mixed, webm,
+                                  mp4 or ogg)
+  unrecord group                  stop recording a group
+  token group [user] [duration]   create an invitation link (default 24h)
+`
+
+func main() {
+	var configFile string
+	var jsonOutput, insecure bool
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [option...] command [arg...]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), commands)
+	}
+	flag.StringVar(&configFile, "config", "",
+		"configuration `file` (default "+defaultConfigFile()+")")
+	flag.BoolVar(&jsonOutput, "json", false, "produce JSON output")
+	flag.BoolVar(&insecure, "insecure", false,
+		"don't check server certificates")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	implicit := configFile == ""
+	if implicit {
+		configFile = defaultConfigFile()
+	}
+	config, err := readConfig(configFile, implicit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	if insecure || config.Insecure {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		httpClient.Transport = t
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	err = run(config, jsonOutput, flag.Args())
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
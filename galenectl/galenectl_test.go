@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jech/galene/client"
+	"github.com/jech/galene/stats"
+)
+
+func TestReadConfig(t *testing.T) {
+	t.Setenv("GALENECTL_SERVER", "")
+	t.Setenv("GALENECTL_ADMIN_PASSWORD", "")
+	t.Setenv("GALENECTL_USERNAME", "")
+
+	filename := filepath.Join(t.TempDir(), "galenectl.json")
+	_, err := readConfig(filename, false)
+	if err == nil {
+		t.Errorf("Missing explicit file accepted")
+	}
+	_, err = readConfig(filename, true)
+	if err == nil {
+		t.Errorf("Missing server accepted")
+	}
+
+	err = os.WriteFile(filename, []byte(`{
+		"server": "https://galene.example.org:8443/",
+		"admin-username": "root",
+		"admin-password": "secret"
+	}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	t.Setenv("GALENECTL_ADMIN_PASSWORD", "other")
+	config, err := readConfig(filename, false)
+	if err != nil {
+		t.Fatalf("readConfig: %v", err)
+	}
+	if config.Server != "https://galene.example.org:8443/" ||
+		config.AdminUsername != "root" ||
+		config.AdminPassword != "other" ||
+		config.Username != "galenectl" {
+		t.Errorf("Bad configuration %#v", config)
+	}
+
+	err = os.WriteFile(filename, []byte(`{"servr": "x"}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	_, err = readConfig(filename, false)
+	if err == nil {
+		t.Errorf("Unknown field accepted")
+	}
+}
+
+func TestPrintGroups(t *testing.T) {
+	ss := []stats.GroupStats{
+		{
+			Name: "b",
+			Clients: []*stats.Client{
+				{Id: "1", Up: []stats.Conn{{Id: "u"}}},
+				{Id: "2", Down: []stats.Conn{{Id: "d1"}, {Id: "d2"}}},
+			},
+			Memory: stats.Memory{Cache: 1000, Queue: 24},
+		},
+		{Name: "a"},
+	}
+	var buf bytes.Buffer
+	err := printGroups(&buf, ss)
+	if err != nil {
+		t.Fatalf("printGroups: %v", err)
+	}
+	expected := "NAME  CLIENTS  UP  DOWN  MEMORY\n" +
+		"a     0        0   0     0\n" +
+		"b     2        1   2     1024\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%v, got\n%v", expected, buf.String())
+	}
+}
+
+// fakeServer implements just enough of the protocol to test sessions.
+// It records the messages it receives, and replies to kicks of unknown
+// users with an error.
+func fakeServer(t *testing.T, received chan<- client.Message) *httptest.Server {
+	var upgrader websocket.Upgrader
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/.status") {
+				json.NewEncoder(w).Encode(map[string]string{
+					"name": "test",
+					"endpoint": "ws" +
+						strings.TrimPrefix(server.URL, "http") +
+						"/ws",
+				})
+				return
+			}
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				t.Errorf("Upgrade: %v", err)
+				return
+			}
+			defer ws.Close()
+			bob, alice := "bob", "alice"
+			for {
+				var m client.Message
+				err := ws.ReadJSON(&m)
+				if err != nil {
+					return
+				}
+				var replies []client.Message
+				switch m.Type {
+				case "join":
+					if m.Password != "pw" {
+						replies = append(replies, client.Message{
+							Type:  "joined",
+							Kind:  "fail",
+							Value: "not authorised",
+						})
+						break
+					}
+					replies = append(replies,
+						client.Message{
+							Type:  "joined",
+							Kind:  "join",
+							Group: "test",
+							Permissions: []string{
+								"op", "present", "token",
+							},
+						},
+						client.Message{
+							Type:     "user",
+							Kind:     "add",
+							Id:       "bob-id",
+							Username: &bob,
+						},
+						client.Message{
+							Type:     "user",
+							Kind:     "add",
+							Id:       "alice-id",
+							Username: &alice,
+						},
+					)
+				case "ping":
+					replies = append(replies,
+						client.Message{Type: "pong"},
+					)
+				case "useraction", "groupaction":
+					received <- m
+					if m.Kind == "kick" && m.Dest != "bob-id" {
+						replies = append(replies, client.Message{
+							Type:  "usermessage",
+							Kind:  "error",
+							Value: "no such user",
+						})
+					}
+					if m.Kind == "maketoken" {
+						v := m.Value.(map[string]interface{})
+						if v["username"] == "bob" {
+							replies = append(replies, client.Message{
+								Type:  "usermessage",
+								Kind:  "token",
+								Error: "error",
+								Value: "that username is taken",
+							})
+							break
+						}
+						replies = append(replies, client.Message{
+							Type: "usermessage",
+							Kind: "token",
+							Value: map[string]interface{}{
+								"token":       "tok",
+								"group":       v["group"],
+								"username":    v["username"],
+								"permissions": v["permissions"],
+								"expires": time.Now().Add(
+									time.Hour,
+								).Format(time.RFC3339),
+							},
+						})
+					}
+				}
+				for _, reply := range replies {
+					ws.WriteJSON(reply)
+				}
+			}
+		},
+	))
+	return server
+}
+
+func TestSession(t *testing.T) {
+	received := make(chan client.Message, 10)
+	server := fakeServer(t, received)
+	defer server.Close()
+
+	_, err := join(server.URL+"/group/test/", "op", "wrong")
+	if err == nil || err.Error() != "not authorised" {
+		t.Errorf("Expected not authorised, got %v", err)
+	}
+
+	s, err := join(server.URL+"/group/test/", "op", "pw")
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer s.close()
+
+	err = s.kick("bob", "bye")
+	if err != nil {
+		t.Errorf("kick: %v", err)
+	}
+	m := <-received
+	if m.Kind != "kick" || m.Dest != "bob-id" || m.Value != "bye" ||
+		m.Source != s.client.Id() {
+		t.Errorf("Bad kick %#v", m)
+	}
+
+	err = s.kick("carol", "")
+	if err == nil || err.Error() != "no such user" {
+		t.Errorf("Expected no such user, got %v", err)
+	}
+
+	// the server's errors are returned verbatim
+	err = s.kick("alice", "")
+	if err == nil || err.Error() != "no such user" {
+		t.Errorf("Expected no such user, got %v", err)
+	}
+	m = <-received
+	if m.Dest != "alice-id" {
+		t.Errorf("Bad kick %#v", m)
+	}
+
+	err = s.groupAction("lock", "maintenance")
+	if err != nil {
+		t.Errorf("groupAction: %v", err)
+	}
+	m = <-received
+	if m.Type != "groupaction" || m.Kind != "lock" ||
+		m.Value != "maintenance" {
+		t.Errorf("Bad group action %#v", m)
+	}
+}
+
+func TestMakeToken(t *testing.T) {
+	received := make(chan client.Message, 10)
+	server := fakeServer(t, received)
+	defer server.Close()
+
+	s, err := join(server.URL+"/group/test/", "op", "pw")
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer s.close()
+
+	tok, err := s.makeToken("alice", time.Hour)
+	if err != nil {
+		t.Fatalf("makeToken: %v", err)
+	}
+	if tok.Token != "tok" || tok.Group != "test" ||
+		tok.Username == nil || *tok.Username != "alice" ||
+		len(tok.Permissions) != 1 || tok.Permissions[0] != "present" {
+		t.Errorf("Bad token %#v", tok)
+	}
+	m := <-received
+	v := m.Value.(map[string]interface{})
+	if m.Kind != "maketoken" || v["expires"] != float64(3600000) {
+		t.Errorf("Bad request %#v", m)
+	}
+
+	_, err = s.makeToken("bob", time.Hour)
+	if err == nil || err.Error() != "that username is taken" {
+		t.Errorf("Expected username taken, got %v", err)
+	}
+	<-received
+
+	u, err := tokenURL(&configuration{
+		Server: "https://galene.example.org:8443/",
+	}, "a/b", "x+y")
+	expected := "https://galene.example.org:8443/group/a/b/?token=x%2By"
+	if err != nil || u != expected {
+		t.Errorf("tokenURL: got %v %v, expected %v", u, err, expected)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/client"
+	"github.com/jech/galene/token"
+)
+
+// how long we wait for the server
+const sessionTimeout = 30 * time.Second
+
+// A session is a connection to a group as an ordinary client, which is
+// how operator actions are performed.
+type session struct {
+	client *client.Client
+
+	mu sync.Mutex
+	// the first error reported by the server since the last sync
+	err error
+	// the last token reply received from the server
+	token *tokenReply
+}
+
+type tokenReply struct {
+	token *token.Stateful
+	err   error
+}
+
+// parseTokenReply parses a usermessage of kind token.
+func parseTokenReply(m client.UserMessage) *tokenReply {
+	if m.Error != "" {
+		return &tokenReply{err: errors.New(fmt.Sprint(m.Value))}
+	}
+	data, err := json.Marshal(m.Value)
+	if err != nil {
+		return &tokenReply{err: err}
+	}
+	var tok token.Stateful
+	err = json.Unmarshal(data, &tok)
+	if err != nil {
+		return &tokenReply{err: err}
+	}
+	return &tokenReply{token: &tok}
+}
+
+// join joins a group, and returns once the list of users has been
+// received.
+func join(groupURL, username, password string) (*session, error) {
+	s := &session{}
+	c, err := client.Connect(groupURL, client.Config{
+		Username:   username,
+		Password:   password,
+		HTTPClient: &httpClient,
+		Dialer:     &dialer,
+		Timeout:    sessionTimeout,
+		Handlers: client.Handlers{
+			Joined:      s.joined,
+			UserMessage: s.userMessage,
+			Stream: func(*client.RemoteStream) bool {
+				return false
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.client = c
+
+	// the user list is sent right after we join
+	err = s.sync()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *session) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *session) joined(j client.Joined) {
+	if j.Kind == "leave" || j.Kind == "fail" {
+		s.setError(errors.New("left group"))
+	}
+}
+
+func (s *session) userMessage(m client.UserMessage) {
+	switch m.Kind {
+	case "error", "kicked":
+		s.setError(errors.New(fmt.Sprint(m.Value)))
+	case "token":
+		r := parseTokenReply(m)
+		s.mu.Lock()
+		s.token = r
+		s.mu.Unlock()
+	}
+}
+
+// sync waits until the server has processed all of the messages that we
+// have sent, and returns the first error reported by the server.
+func (s *session) sync() error {
+	err := s.client.Ping()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.err
+	s.err = nil
+	return err
+}
+
+// lookup returns the id of the user with a given id or username.
+func (s *session) lookup(user string) (string, error) {
+	users := s.client.Users()
+	if _, ok := users[user]; ok {
+		return user, nil
+	}
+	id := ""
+	for i, u := range users {
+		if u.Username == user && i != s.client.Id() {
+			if id != "" {
+				return "", errors.New(
+					"several users called " + user +
+						", please use an id",
+				)
+			}
+			id = i
+		}
+	}
+	if id == "" {
+		return "", errors.New("no such user")
+	}
+	return id, nil
+}
+
+// groupAction performs a group action, and waits for the server to
+// process it.
+func (s *session) groupAction(kind string, value interface{}) error {
+	err := s.client.GroupAction(kind, value)
+	if err != nil {
+		return err
+	}
+	return s.sync()
+}
+
+// kick kicks a user out of the group.
+func (s *session) kick(user, reason string) error {
+	id, err := s.lookup(user)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if reason != "" {
+		value = reason
+	}
+	err = s.client.UserAction("kick", id, value)
+	if err != nil {
+		return err
+	}
+	return s.sync()
+}
+
+// makeToken asks the server to create a stateful token for the group,
+// and returns the token created.  If username is empty, the token's
+// holder chooses a username.
+func (s *session) makeToken(username string, expires time.Duration) (*token.Stateful, error) {
+	// like the web client, we grant the permission to present if we
+	// have it ourselves
+	permissions := []string{}
+	for _, p := range s.client.Permissions() {
+		if p == "present" {
+			permissions = append(permissions, p)
+		}
+	}
+	value := map[string]interface{}{
+		"group":       s.client.Group(),
+		"permissions": permissions,
+		// relative expiration time, in milliseconds
+		"expires": expires.Milliseconds(),
+	}
+	if username != "" {
+		value["username"] = username
+	}
+	err := s.groupAction("maketoken", value)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	tok := s.token
+	s.token = nil
+	s.mu.Unlock()
+	if tok == nil {
+		return nil, errors.New("server didn't create a token")
+	}
+	if tok.err != nil {
+		return nil, tok.err
+	}
+	return tok.token, nil
+}
+
+func (s *session) close() {
+	s.client.Close()
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"hash"
+	"sync"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/pbkdf2"
@@ -109,3 +110,50 @@ type Client interface {
 	PushClient(group, kind, id, username string, perms []string, data map[string]interface{}) error
 	Kick(id string, user *string, message string) error
 }
+
+// A ClientUpdate is a change to the membership of a group, as pushed by
+// PushClient.  The same update is shared by all the clients it is
+// pushed to.
+type ClientUpdate struct {
+	Group       string
+	Kind        string
+	Id          string
+	Username    string
+	Permissions []string
+	Data        map[string]interface{}
+
+	once    sync.Once
+	encoded []byte
+	err     error
+}
+
+// Encode calls f the first time it is called, and returns the result
+// of this first call on subsequent calls.  This allows an update to be
+// encoded just once however many clients it is pushed to.
+func (u *ClientUpdate) Encode(f func(u *ClientUpdate) ([]byte, error)) ([]byte, error) {
+	u.once.Do(func() {
+		u.encoded, u.err = f(u)
+	})
+	return u.encoded, u.err
+}
+
+// An UpdatePusher is a client that is able to receive a shared
+// ClientUpdate, which is more efficient than calling PushClient.
+type UpdatePusher interface {
+	PushClientUpdate(u *ClientUpdate) error
+}
+
+// PushClientUpdate pushes u to all of the clients in cs.
+func PushClientUpdate(cs []Client, u *ClientUpdate) {
+	for _, c := range cs {
+		p, ok := c.(UpdatePusher)
+		if ok {
+			p.PushClientUpdate(u)
+		} else {
+			c.PushClient(
+				u.Group, u.Kind, u.Id, u.Username,
+				u.Permissions, u.Data,
+			)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package group
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// A Cluster is a set of instances of Galene that share the load by
+// serving each group on a single instance.
+type Cluster struct {
+	// the base URL of this instance
+	Self string `json:"self"`
+	// the base URLs of all instances, including this one
+	Instances []string `json:"instances"`
+}
+
+func checkInstance(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%v: bad scheme", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%v: no host", s)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return fmt.Errorf("%v: URL has a path", s)
+	}
+	return nil
+}
+
+func sameInstance(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// Check checks that the cluster configuration is consistent.
+func (c *Cluster) Check() error {
+	if len(c.Instances) == 0 {
+		return errors.New("no instances")
+	}
+	self := false
+	for _, i := range c.Instances {
+		err := checkInstance(i)
+		if err != nil {
+			return err
+		}
+		if sameInstance(i, c.Self) {
+			self = true
+		}
+	}
+	if !self {
+		return errors.New("self is not in instances")
+	}
+	return nil
+}
+
+// owner returns the instance that serves a given group.  We use
+// rendezvous hashing, so that adding or removing an instance only moves
+// the groups served by that instance.
+func (c *Cluster) owner(name string) string {
+	var owner string
+	var best uint64
+	for _, i := range c.Instances {
+		i = strings.TrimSuffix(i, "/")
+		h := sha256.Sum256([]byte(i + "\n" + name))
+		w := binary.BigEndian.Uint64(h[:8])
+		if owner == "" || w > best {
+			owner, best = i, w
+		}
+	}
+	return owner
+}
+
+// OwnerURL returns the URL of a group on the instance of the cluster that
+// serves it, or the empty string if the group is served locally.
+func OwnerURL(name string) string {
+	conf, err := GetConfiguration()
+	if err != nil || conf.Cluster == nil || len(conf.Cluster.Instances) == 0 {
+		return ""
+	}
+	owner := conf.Cluster.owner(name)
+	if sameInstance(owner, conf.Cluster.Self) {
+		return ""
+	}
+	return owner + path.Join("/group", name) + "/"
+}
@@ -0,0 +1,43 @@
+package group
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClusterOwner(t *testing.T) {
+	c := &Cluster{
+		Self: "https://a.example.org",
+		Instances: []string{
+			"https://a.example.org",
+			"https://b.example.org/",
+			"https://c.example.org",
+		},
+	}
+	if err := c.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	owners := make(map[string]string)
+	count := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("group%v", i)
+		owners[name] = c.owner(name)
+		count[owners[name]]++
+	}
+	if len(count) != 3 {
+		t.Errorf("Bad distribution %v", count)
+	}
+	if _, ok := count["https://b.example.org"]; !ok {
+		t.Errorf("Trailing slash not removed: %v", count)
+	}
+
+	// removing an instance only moves the groups that it served
+	c.Instances = c.Instances[:2]
+	for name, owner := range owners {
+		o := c.owner(name)
+		if owner != "https://c.example.org" && o != owner {
+			t.Errorf("%v moved from %v to %v", name, owner, o)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package group
+
+import (
+	"sync"
+)
+
+// ErrDraining is returned when attempting to join a group or to create
+// a new group while the server is being drained.
+var ErrDraining = UserError("the server is shutting down")
+
+var drain struct {
+	mu      sync.Mutex
+	started chan struct{}
+}
+
+func drainChannel() chan struct{} {
+	if drain.started == nil {
+		drain.started = make(chan struct{})
+	}
+	return drain.started
+}
+
+// Drain causes the server to stop accepting new clients and new groups,
+// and warns all connected clients with the given message.  It returns
+// false if the server was already being drained.
+func Drain(message string) bool {
+	if message == "" {
+		message = "The server is about to restart.  " +
+			"You may stay until the end of the meeting, " +
+			"but nobody else can join."
+	}
+
+	drain.mu.Lock()
+	ch := drainChannel()
+	select {
+	case <-ch:
+		drain.mu.Unlock()
+		return false
+	default:
+	}
+	close(ch)
+	drain.mu.Unlock()
+
+	Range(func(g *Group) bool {
+		g.Range(func(c Client) bool {
+			if w, ok := c.(warner); ok {
+				w.Warn(false, message)
+			}
+			return true
+		})
+		return true
+	})
+	return true
+}
+
+// Draining returns a channel that is closed when the server starts
+// being drained.
+func Draining() <-chan struct{} {
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+	return drainChannel()
+}
+
+func draining() bool {
+	select {
+	case <-Draining():
+		return true
+	default:
+		return false
+	}
+}
+
+// UserCount returns the number of clients in all groups, not counting
+// system clients.
+func UserCount() int {
+	count := 0
+	Range(func(g *Group) bool {
+		g.Range(func(c Client) bool {
+			if !member("system", c.Permissions()) {
+				count++
+			}
+			return true
+		})
+		return true
+	})
+	return count
+}
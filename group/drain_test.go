@@ -0,0 +1,93 @@
+package group
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type warnTestClient struct {
+	notifyTestClient
+	warnings []string
+}
+
+func (c *warnTestClient) Warn(oponly bool, message string) error {
+	c.warnings = append(c.warnings, message)
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	groups.groups = nil
+	defer func() {
+		drain.mu.Lock()
+		drain.started = nil
+		drain.mu.Unlock()
+	}()
+
+	dir := Directory
+	Directory = t.TempDir()
+	defer func() {
+		Directory = dir
+	}()
+	for _, name := range []string{"drain", "other"} {
+		err := os.WriteFile(filepath.Join(Directory, name+".json"),
+			[]byte(`{"presenter": [{}]}`), 0o600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	username := "alice"
+	creds := ClientCredentials{Username: &username}
+	alice := &warnTestClient{notifyTestClient: notifyTestClient{id: "a"}}
+	g, err := AddClient("drain", alice, creds)
+	if err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+	alice.group = g
+	system := &notifyTestClient{id: "s", group: g}
+	system.perms = []string{"system"}
+	_, err = AddClient("drain", system, ClientCredentials{System: true})
+	if err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+	if n := UserCount(); n != 1 {
+		t.Errorf("UserCount: got %v", n)
+	}
+
+	if !Drain("bye") || Drain("bye") {
+		t.Errorf("Drain returned the wrong value")
+	}
+	if len(alice.warnings) != 1 || alice.warnings[0] != "bye" {
+		t.Errorf("Warnings: %v", alice.warnings)
+	}
+
+	username = "bob"
+	bob := &notifyTestClient{id: "b", group: g}
+	_, err = AddClient("drain", bob, creds)
+	if !errors.Is(err, ErrDraining) {
+		t.Errorf("Joined existing group: %v", err)
+	}
+	_, err = Add("other", nil)
+	if !errors.Is(err, ErrDraining) {
+		t.Errorf("Created new group: %v", err)
+	}
+
+	// system clients and existing groups are not affected
+	_, err = Add("drain", nil)
+	if err != nil {
+		t.Errorf("Add: %v", err)
+	}
+	other := &notifyTestClient{id: "s2", group: g}
+	other.perms = []string{"system"}
+	_, err = AddClient("drain", other, ClientCredentials{System: true})
+	if err != nil {
+		t.Errorf("AddClient: %v", err)
+	}
+
+	DelClient(alice)
+	if n := UserCount(); n != 0 {
+		t.Errorf("UserCount: got %v", n)
+	}
+}
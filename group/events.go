@@ -0,0 +1,44 @@
+package group
+
+import (
+	"sync"
+)
+
+// the length of the channel returned by Subscribe
+const subscriberQueue = 256
+
+var subscribers struct {
+	mu       sync.Mutex
+	channels map[chan Event]struct{}
+}
+
+// Subscribe returns a channel that receives the events of all groups,
+// whether or not they have notifications configured, and a function that
+// unsubscribes.  Events are dropped if the receiver doesn't keep up.
+func Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberQueue)
+	subscribers.mu.Lock()
+	if subscribers.channels == nil {
+		subscribers.channels = make(map[chan Event]struct{})
+	}
+	subscribers.channels[ch] = struct{}{}
+	subscribers.mu.Unlock()
+
+	return ch, func() {
+		subscribers.mu.Lock()
+		delete(subscribers.channels, ch)
+		subscribers.mu.Unlock()
+	}
+}
+
+// publish sends an event to all subscribers.  It never blocks.
+func publish(e Event) {
+	subscribers.mu.Lock()
+	defer subscribers.mu.Unlock()
+	for ch := range subscribers.channels {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -4,13 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/fs"
-	"log"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,13 +18,32 @@ import (
 	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 
+	galenecodecs "github.com/jech/galene/codecs"
+	galeneice "github.com/jech/galene/ice"
+	"github.com/jech/galene/logging"
 	"github.com/jech/galene/token"
+	"github.com/jech/galene/twcc"
 )
 
+var logger = logging.New("group")
+
 var Directory, DataDirectory string
 var UseMDNS bool
 var UDPMin, UDPMax uint16
 
+// ParseUDPRange parses a range of UDP ports, such as "40000-44999".
+func ParseUDPRange(r string) (uint16, uint16, error) {
+	var min, max uint16
+	n, err := fmt.Sscanf(r, "%v-%v", &min, &max)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n != 2 || min <= 0 || max <= 0 || min > max {
+		return 0, 0, errors.New("bad range")
+	}
+	return min, max, nil
+}
+
 type NotAuthorisedError struct {
 	err error
 }
@@ -95,10 +113,23 @@ type Group struct {
 	mu          sync.Mutex
 	description *Description
 	locked      *string
+	lockShared  bool // the lock was set by an operator
 	clients     map[string]Client
 	history     []ChatHistoryEntry
 	timestamp   time.Time
 	data        map[string]interface{}
+	memory      [NumMemoryKinds]MemoryAccount
+	overMemory  bool
+	// state shared with other instances, see shared.go
+	remoteClients int
+	membersShared bool
+	historyDirty  bool
+	historyLoaded bool
+	// voice activity, indexed by client id
+	speakers      map[string]*speaker
+	activeSpeaker string
+	// client ids, most recent speakers first
+	speakerOrder []string
 }
 
 func (g *Group) Name() string {
@@ -116,12 +147,27 @@ func (g *Group) Locked() (bool, string) {
 }
 
 func (g *Group) SetLocked(locked bool, message string) {
+	g.setLocked(locked, message, true)
+	if SharedStore != nil {
+		g.publishLock(locked, message)
+	}
+}
+
+func (g *Group) setLocked(locked bool, message string, notify bool) {
 	g.mu.Lock()
 	if locked {
 		g.locked = &message
 	} else {
 		g.locked = nil
 	}
+	g.lockShared = locked && notify
+	if notify {
+		kind := "unlock"
+		if locked {
+			kind = "lock"
+		}
+		g.notifyUnlocked(kind, "", message)
+	}
 	clients := g.getClientsUnlocked(nil)
 	g.mu.Unlock()
 
@@ -189,15 +235,38 @@ var groups struct {
 func (g *Group) API() (*webrtc.API, error) {
 	g.mu.Lock()
 	codecs := g.description.Codecs
+	udpRange := g.description.UDPRange
+	g.mu.Unlock()
+
+	min, max := UDPMin, UDPMax
+	if udpRange != "" {
+		var err error
+		min, max, err = ParseUDPRange(udpRange)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return apiFromNames(codecs, min, max)
+}
+
+// ICEConfiguration returns the ICE configuration used by the group.
+func (g *Group) ICEConfiguration() *webrtc.Configuration {
+	g.mu.Lock()
+	servers := g.description.ICEServers
 	g.mu.Unlock()
 
-	return APIFromNames(codecs)
+	if len(servers) == 0 {
+		return galeneice.ICEConfiguration()
+	}
+	return galeneice.ServersConfiguration(servers)
 }
 
-func fmtpValue(fmtp, key string) string {
+// FmtpValue returns the value of the parameter key in the fmtp line of
+// a codec, or the empty string if it is not present.
+func FmtpValue(fmtp, key string) string {
 	fields := strings.Split(fmtp, ";")
 	for _, f := range fields {
-		k, v, found := strings.Cut(f, "=")
+		k, v, found := strings.Cut(strings.TrimSpace(f), "=")
 		if found && k == key {
 			return v
 		}
@@ -210,7 +279,7 @@ func CodecPayloadType(codec webrtc.RTPCodecCapability) (webrtc.PayloadType, erro
 	case "video/vp8":
 		return 96, nil
 	case "video/vp9":
-		profile := fmtpValue(codec.SDPFmtpLine, "profile-id")
+		profile := FmtpValue(codec.SDPFmtpLine, "profile-id")
 		switch profile {
 		case "", "0":
 			return 98, nil
@@ -223,7 +292,7 @@ func CodecPayloadType(codec webrtc.RTPCodecCapability) (webrtc.PayloadType, erro
 	case "video/av1":
 		return 35, nil
 	case "video/h264":
-		profile := fmtpValue(codec.SDPFmtpLine, "profile-level-id")
+		profile := FmtpValue(codec.SDPFmtpLine, "profile-level-id")
 		if profile == "" {
 			return 102, nil
 		}
@@ -240,8 +309,16 @@ func CodecPayloadType(codec webrtc.RTPCodecCapability) (webrtc.PayloadType, erro
 				"unknown H.264 profile %v", profile,
 			)
 		}
+	case "video/rtx":
+		apt, err := strconv.Atoi(FmtpValue(codec.SDPFmtpLine, "apt"))
+		if err != nil {
+			return 0, errors.New("malformed RTX apt")
+		}
+		return webrtc.PayloadType(apt + 1), nil
 	case "audio/opus":
 		return 111, nil
+	case "audio/red":
+		return 63, nil
 	case "audio/g722":
 		return 9, nil
 	case "audio/pcmu":
@@ -256,10 +333,14 @@ func CodecPayloadType(codec webrtc.RTPCodecCapability) (webrtc.PayloadType, erro
 func codecsFromName(name string) ([]webrtc.RTPCodecParameters, error) {
 	fb := []webrtc.RTCPFeedback{
 		{"goog-remb", ""},
+		{"transport-cc", ""},
 		{"nack", ""},
 		{"nack", "pli"},
 		{"ccm", "fir"},
 	}
+	afb := []webrtc.RTCPFeedback{
+		{"transport-cc", ""},
+	}
 
 	var codecs []webrtc.RTPCodecCapability
 
@@ -300,13 +381,26 @@ func codecsFromName(name string) ([]webrtc.RTPCodecParameters, error) {
 				"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
 				fb,
 			},
+			{
+				"video/H264", 90000, 0,
+				"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
+				fb,
+			},
 		}
 	case "opus":
 		codecs = []webrtc.RTPCodecCapability{
 			{
 				"audio/opus", 48000, 2,
 				"minptime=10;useinbandfec=1;stereo=1;sprop-stereo=1",
-				nil,
+				afb,
+			},
+		}
+	case "red":
+		codecs = []webrtc.RTPCodecCapability{
+			{
+				"audio/red", 48000, 2,
+				"111/111",
+				afb,
 			},
 		}
 	case "g722":
@@ -328,7 +422,7 @@ func codecsFromName(name string) ([]webrtc.RTPCodecParameters, error) {
 	case "pcma":
 		codecs = []webrtc.RTPCodecCapability{
 			{
-				"audio/PCMU", 8000, 1,
+				"audio/PCMA", 8000, 1,
 				"",
 				nil,
 			},
@@ -341,7 +435,7 @@ func codecsFromName(name string) ([]webrtc.RTPCodecParameters, error) {
 	for _, c := range codecs {
 		ptype, err := CodecPayloadType(c)
 		if err != nil {
-			log.Printf("Couldn't determine ptype for codec %v: %v",
+			logger.Warnf("Couldn't determine ptype for codec %v: %v",
 				c.MimeType, err)
 			continue
 		}
@@ -349,17 +443,41 @@ func codecsFromName(name string) ([]webrtc.RTPCodecParameters, error) {
 			RTPCodecCapability: c,
 			PayloadType:        ptype,
 		})
+		if strings.HasPrefix(strings.ToLower(c.MimeType), "video/") {
+			parms = append(parms, RTXCodec(ptype))
+		}
 	}
 	return parms, nil
 }
 
-func APIFromCodecs(codecs []webrtc.RTPCodecParameters) (*webrtc.API, error) {
+// RTXCodec returns the RTX codec (RFC 4588) associated with the video
+// codec with the given payload type.
+func RTXCodec(apt webrtc.PayloadType) webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    "video/rtx",
+			ClockRate:   90000,
+			SDPFmtpLine: fmt.Sprintf("apt=%d", apt),
+		},
+		PayloadType: apt + 1,
+	}
+}
+
+// REDPrimaryCodec returns the codec of the primary encoding carried by
+// redundant audio (RFC 2198).
+func REDPrimaryCodec() webrtc.RTPCodecParameters {
+	codecs, _ := codecsFromName("opus")
+	return codecs[0]
+}
+
+// APIFromCodecs returns an API that negotiates the given codecs and uses
+// UDP ports in the range [udpMin, udpMax], if non-zero, for media.
+func APIFromCodecs(codecs []webrtc.RTPCodecParameters, udpMin, udpMax uint16) (*webrtc.API, error) {
 	s := webrtc.SettingEngine{}
 	s.SetSRTPReplayProtectionWindow(512)
 	s.DisableActiveTCP(true)
-	if !UseMDNS {
-		s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
-	}
+	// mDNS candidates are resolved before being passed to the ICE agent
+	s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
 	m := webrtc.MediaEngine{}
 
 	for _, codec := range codecs {
@@ -369,20 +487,41 @@ func APIFromCodecs(codecs []webrtc.RTPCodecParameters) (*webrtc.API, error) {
 		}
 		err := m.RegisterCodec(codec, tpe)
 		if err != nil {
-			log.Printf("%v", err)
+			logger.Warnf("%v", err)
 			continue
 		}
 	}
 
-	if UDPMin > 0 && UDPMax > 0 {
-		s.SetEphemeralUDPPortRange(UDPMin, UDPMax)
+	if udpMin > 0 && udpMax > 0 {
+		s.SetEphemeralUDPPortRange(udpMin, udpMax)
 	}
+	setICENetwork(&s)
 	m.RegisterHeaderExtension(
 		webrtc.RTPHeaderExtensionCapability{sdp.SDESMidURI},
 		webrtc.RTPCodecTypeVideo)
 	m.RegisterHeaderExtension(
 		webrtc.RTPHeaderExtensionCapability{sdp.SDESRTPStreamIDURI},
 		webrtc.RTPCodecTypeVideo)
+	m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{
+			"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+		},
+		webrtc.RTPCodecTypeVideo)
+	m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{
+			galenecodecs.DependencyDescriptorURI,
+		},
+		webrtc.RTPCodecTypeVideo)
+	m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{sdp.AudioLevelURI},
+		webrtc.RTPCodecTypeAudio,
+		webrtc.RTPTransceiverDirectionRecvonly)
+	m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{twcc.URI},
+		webrtc.RTPCodecTypeAudio)
+	m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{twcc.URI},
+		webrtc.RTPCodecTypeVideo)
 
 	return webrtc.NewAPI(
 		webrtc.WithSettingEngine(s),
@@ -391,6 +530,10 @@ func APIFromCodecs(codecs []webrtc.RTPCodecParameters) (*webrtc.API, error) {
 }
 
 func APIFromNames(names []string) (*webrtc.API, error) {
+	return apiFromNames(names, UDPMin, UDPMax)
+}
+
+func apiFromNames(names []string, udpMin, udpMax uint16) (*webrtc.API, error) {
 	if len(names) == 0 {
 		names = []string{"vp8", "opus"}
 	}
@@ -398,13 +541,13 @@ func APIFromNames(names []string) (*webrtc.API, error) {
 	for _, n := range names {
 		cs, err := codecsFromName(n)
 		if err != nil {
-			log.Printf("Codec %v: %v", n, err)
+			logger.Warnf("Codec %v: %v", n, err)
 			continue
 		}
 		codecs = append(codecs, cs...)
 	}
 
-	return APIFromCodecs(codecs)
+	return APIFromCodecs(codecs, udpMin, udpMax)
 }
 
 func Add(name string, desc *Description) (*Group, error) {
@@ -445,6 +588,9 @@ func add(name string, desc *Description) (*Group, []Client, error) {
 
 	g := groups.groups[name]
 	if g == nil {
+		if draining() {
+			return nil, nil, ErrDraining
+		}
 		if desc == nil {
 			desc, err = readDescription(name)
 			if err != nil {
@@ -459,6 +605,9 @@ func add(name string, desc *Description) (*Group, []Client, error) {
 			timestamp:   time.Now(),
 		}
 		groups.groups[name] = g
+		g.mu.Lock()
+		g.notifyUnlocked("create", "", "")
+		g.mu.Unlock()
 	}
 
 	g.mu.Lock()
@@ -474,7 +623,7 @@ func add(name string, desc *Description) (*Group, []Client, error) {
 		desc, err = readDescription(name)
 		if err != nil {
 			if !os.IsNotExist(err) {
-				log.Printf("Reading group %v: %v", name, err)
+				logger.Warnf("Reading group %v: %v", name, err)
 			}
 			deleteUnlocked(g)
 			return nil, nil, err
@@ -591,6 +740,9 @@ func AddClient(group string, c Client, creds ClientCredentials) (*Group, error)
 	clients := g.getClientsUnlocked(nil)
 
 	if !member("system", c.Permissions()) {
+		if draining() {
+			return nil, ErrDraining
+		}
 		username, perms, err := g.getPermission(creds)
 		if err != nil {
 			return nil, err
@@ -641,7 +793,8 @@ func AddClient(group string, c Client, creds ClientCredentials) (*Group, error)
 		}
 
 		if !member("op", perms) && g.description.MaxClients > 0 {
-			if len(g.clients) >= g.description.MaxClients {
+			n := len(g.clients) + g.remoteClients
+			if n >= g.description.MaxClients {
 				return nil, UserError("too many users")
 			}
 		}
@@ -653,11 +806,26 @@ func AddClient(group string, c Client, creds ClientCredentials) (*Group, error)
 	if g.clients[id] != nil {
 		return nil, ProtocolError("duplicate client id")
 	}
+	if !member("system", c.Permissions()) {
+		if !g.hasUsers() {
+			g.notifyUnlocked("join", c.Username(), "")
+		}
+		g.notifyEventUnlocked(Event{
+			Kind:     "user-join",
+			Username: c.Username(),
+			Client:   id,
+		})
+	}
 	g.clients[id] = c
+	g.speakerOrder = append(g.speakerOrder, id)
 	g.timestamp = time.Now()
 
 	c.Joined(g.Name(), "join")
 
+	if g.description.Echo {
+		// clients don't see each other
+		clients = nil
+	}
 	u := c.Username()
 	p := c.Permissions()
 	s := c.Data()
@@ -666,8 +834,15 @@ func AddClient(group string, c Client, creds ClientCredentials) (*Group, error)
 		pp := cc.Permissions()
 		uu := cc.Username()
 		c.PushClient(g.Name(), "add", cc.Id(), uu, pp, cc.Data())
-		cc.PushClient(g.Name(), "add", id, u, p, s)
 	}
+	PushClientUpdate(clients, &ClientUpdate{
+		Group:       g.Name(),
+		Kind:        "add",
+		Id:          id,
+		Username:    u,
+		Permissions: p,
+		Data:        s,
+	})
 
 	return g, nil
 }
@@ -688,6 +863,8 @@ func autoLockKick(g *Group) {
 	if g.description.Autolock && g.locked == nil {
 		m := "this group is locked"
 		g.locked = &m
+		g.lockShared = false
+		g.notifyUnlocked("lock", "", "there are no operators")
 		for _, c := range clients {
 			c.Joined(g.Name(), "change")
 		}
@@ -705,21 +882,37 @@ func DelClient(c Client) {
 	}
 	g.mu.Lock()
 	if g.clients[c.Id()] != c {
-		log.Printf("Deleting unknown client")
+		logger.Warnf("Deleting unknown client")
 		g.mu.Unlock()
 		return
 	}
 	delete(g.clients, c.Id())
+	delete(g.speakers, c.Id())
+	g.speakerOrder = remove(c.Id(), g.speakerOrder)
+	if g.activeSpeaker == c.Id() {
+		g.activeSpeaker = ""
+	}
 	g.timestamp = time.Now()
-	clients := g.getClientsUnlocked(nil)
+	if !member("system", c.Permissions()) {
+		g.notifyEventUnlocked(Event{
+			Kind:     "user-leave",
+			Username: c.Username(),
+			Client:   c.Id(),
+		})
+		if !g.hasUsers() {
+			g.notifyUnlocked("empty", c.Username(), "")
+		}
+	}
+	clients := g.peersUnlocked(c)
 	g.mu.Unlock()
 
 	c.Joined(g.Name(), "leave")
-	for _, cc := range clients {
-		cc.PushClient(
-			g.Name(), "delete", c.Id(), c.Username(), nil, nil,
-		)
-	}
+	PushClientUpdate(clients, &ClientUpdate{
+		Group:    g.Name(),
+		Kind:     "delete",
+		Id:       c.Id(),
+		Username: c.Username(),
+	})
 	autoLockKick(g)
 }
 
@@ -739,6 +932,21 @@ func (g *Group) getClientsUnlocked(except Client) []Client {
 	return clients
 }
 
+// Peers returns the clients other than c that see c and its media.  In
+// an echo group, clients don't see each other, and Peers returns nil.
+func (g *Group) Peers(c Client) []Client {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.peersUnlocked(c)
+}
+
+func (g *Group) peersUnlocked(c Client) []Client {
+	if g.description.Echo {
+		return nil
+	}
+	return g.getClientsUnlocked(c)
+}
+
 func (g *Group) GetClient(id string) Client {
 	g.mu.Lock()
 	defer g.mu.Unlock()
@@ -774,7 +982,7 @@ func kickall(g *Group, message string) {
 
 func Shutdown(message string) {
 	Range(func(g *Group) bool {
-		g.SetLocked(true, message)
+		g.setLocked(true, message, false)
 		kickall(g, message)
 		return true
 	})
@@ -784,6 +992,71 @@ type warner interface {
 	Warn(oponly bool, message string) error
 }
 
+// An Event is something that happened in a group that an operator may
+// want to be notified about.
+type Event struct {
+	Kind     string
+	Group    string
+	Username string
+	// the user an action was performed on, and the id of the
+	// client that the event concerns
+	Target  string
+	Client  string
+	Message string
+	Time    time.Time
+}
+
+// NotifyHook, if not nil, is called with every event together with the
+// description of its group.  It is called with the group locked, and
+// must not block.
+var NotifyHook func(desc *Description, e Event)
+
+// Notify signals an event to the notification hook and to the
+// subscribers.
+func (g *Group) Notify(kind, username, message string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.notifyUnlocked(kind, username, message)
+}
+
+// NotifyEvent signals an event to the notification hook and to the
+// subscribers.  The fields Group and Time are filled in.
+func (g *Group) NotifyEvent(e Event) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.notifyEventUnlocked(e)
+}
+
+// called locked
+func (g *Group) notifyUnlocked(kind, username, message string) {
+	g.notifyEventUnlocked(Event{
+		Kind:     kind,
+		Username: username,
+		Message:  message,
+	})
+}
+
+// called locked
+func (g *Group) notifyEventUnlocked(e Event) {
+	e.Group = g.name
+	e.Time = time.Now()
+	publish(e)
+	if NotifyHook == nil || len(g.description.Notifications) == 0 {
+		return
+	}
+	NotifyHook(g.description, e)
+}
+
+// called locked
+func (g *Group) hasUsers() bool {
+	for _, c := range g.clients {
+		if !member("system", c.Permissions()) {
+			return true
+		}
+	}
+	return false
+}
+
 func (g *Group) WallOps(message string) {
 	clients := g.GetClients(nil)
 	for _, c := range clients {
@@ -793,54 +1066,110 @@ func (g *Group) WallOps(message string) {
 		}
 		err := w.Warn(true, message)
 		if err != nil {
-			log.Printf("WallOps: %v", err)
+			logger.Warnf("WallOps: %v", err)
 		}
 	}
 }
 
 const maxChatHistory = 50
 
+// historyEntryOverhead is an estimate of the memory used by a chat history
+// entry, not counting the strings it refers to.
+const historyEntryOverhead = 128
+
+// historyEntrySize returns an estimate of the memory used by a chat
+// history entry.
+func historyEntrySize(e *ChatHistoryEntry) int64 {
+	size := int64(historyEntryOverhead + len(e.Id) + len(e.Kind))
+	if e.User != nil {
+		size += int64(len(*e.User))
+	}
+	switch v := e.Value.(type) {
+	case nil:
+	case string:
+		size += int64(len(v))
+	default:
+		buf, err := json.Marshal(v)
+		if err == nil {
+			size += int64(len(buf))
+		}
+	}
+	return size
+}
+
+// dropHistory removes the first n entries of the chat history.
+// Called locked.
+func (g *Group) dropHistory(n int) {
+	var size int64
+	for i := 0; i < n; i++ {
+		size += historyEntrySize(&g.history[i])
+	}
+	g.memory[MemoryHistory].Add(-size)
+	copy(g.history, g.history[n:])
+	for i := len(g.history) - n; i < len(g.history); i++ {
+		g.history[i] = ChatHistoryEntry{}
+	}
+	g.history = g.history[:len(g.history)-n]
+}
+
 func (g *Group) ClearChatHistory() {
 	g.mu.Lock()
 	defer g.mu.Unlock()
+	g.dropHistory(len(g.history))
 	g.history = nil
+	g.historyDirty = true
 }
 
 func (g *Group) AddToChatHistory(id string, user *string, time time.Time, kind string, value interface{}) {
 	g.mu.Lock()
-	defer g.mu.Unlock()
 
 	if len(g.history) >= maxChatHistory {
-		copy(g.history, g.history[1:])
-		g.history = g.history[:len(g.history)-1]
+		g.dropHistory(1)
+	}
+
+	exceeded, changed := g.memoryExceeded()
+	if exceeded {
+		// shed load by dropping the oldest half of the history
+		g.dropHistory((len(g.history) + 1) / 2)
+	}
+
+	e := ChatHistoryEntry{
+		Id: id, User: user, Time: time, Kind: kind, Value: value,
+	}
+	g.memory[MemoryHistory].Add(historyEntrySize(&e))
+	g.history = append(g.history, e)
+	g.historyDirty = true
+	g.mu.Unlock()
+
+	if changed {
+		g.memoryNotify(exceeded)
 	}
-	g.history = append(g.history,
-		ChatHistoryEntry{Id: id, User: user, Time: time, Kind: kind, Value: value},
-	)
 }
 
-func discardObsoleteHistory(h []ChatHistoryEntry, duration time.Duration) []ChatHistoryEntry {
+// discardObsoleteHistory discards entries older than duration.
+// Called locked.
+func (g *Group) discardObsoleteHistory(duration time.Duration) {
 	i := 0
-	for i < len(h) {
-		if time.Since(h[i].Time) <= duration {
+	for i < len(g.history) {
+		if time.Since(g.history[i].Time) <= duration {
 			break
 		}
 		i++
 	}
 	if i > 0 {
-		copy(h, h[i:])
-		h = h[:len(h)-i]
+		g.dropHistory(i)
 	}
-	return h
 }
 
 func (g *Group) GetChatHistory() []ChatHistoryEntry {
+	if SharedStore != nil {
+		g.loadSharedHistory()
+	}
+
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	g.history = discardObsoleteHistory(
-		g.history, maxHistoryAge(g.description),
-	)
+	g.discardObsoleteHistory(maxHistoryAge(g.description))
 
 	h := make([]ChatHistoryEntry, len(g.history))
 	copy(h, g.history)
@@ -895,6 +1224,82 @@ type Configuration struct {
 	CanonicalHost string          `json:"canonicalHost"`
 	ProxyURL      string          `json:"proxyURL"`
 	Admin         []ClientPattern `json:"admin"`
+
+	// Server settings.  These may be overridden by command-line
+	// flags, and most of them require a restart.
+	HTTP          string             `json:"http,omitempty"`
+	Insecure      bool               `json:"insecure,omitempty"`
+	WebTransport  bool               `json:"webTransport,omitempty"`
+	Static        string             `json:"static,omitempty"`
+	Groups        string             `json:"groups,omitempty"`
+	GroupDatabase string             `json:"groupDatabase,omitempty"`
+	Recordings    string             `json:"recordings,omitempty"`
+	UDPRange      string             `json:"udpRange,omitempty"`
+	MDNS          bool               `json:"mdns,omitempty"`
+	Turn          *string            `json:"turn,omitempty"`
+	TurnTLS       string             `json:"turnTLS,omitempty"`
+	RTMP          string             `json:"rtmp,omitempty"`
+	SRT           string             `json:"srt,omitempty"`
+	EgressWorkers int                `json:"egressWorkers,omitempty"`
+	ICETCP        string             `json:"iceTCP,omitempty"`
+	UDPMux        string             `json:"udpMux,omitempty"`
+	IPFamily      string             `json:"ipFamily,omitempty"`
+	RelayOnly     bool               `json:"relayOnly,omitempty"`
+	ICEServers    []galeneice.Server `json:"iceServers,omitempty"`
+	LogFile       string             `json:"logFile,omitempty"`
+	SharedState   string             `json:"sharedState,omitempty"`
+	QualityLog    *QualityLog        `json:"qualityLog,omitempty"`
+	Cluster       *Cluster           `json:"cluster,omitempty"`
+	DrainMessage  string             `json:"drainMessage,omitempty"`
+	DrainTimeout  int                `json:"drainTimeout,omitempty"`
+	Tracing       *Tracing           `json:"tracing,omitempty"`
+	Upload        *Upload            `json:"upload,omitempty"`
+	Pprof         bool               `json:"pprof,omitempty"`
+}
+
+// QualityLog is the configuration of the quality log, which records
+// the statistics of every connection at regular intervals.
+type QualityLog struct {
+	// the name of the log file
+	File string `json:"file"`
+	// the interval between records, in seconds
+	Interval int `json:"interval,omitempty"`
+	// the file is rotated when it reaches this size, in bytes
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// the number of rotated files that are kept
+	MaxFiles int `json:"maxFiles,omitempty"`
+}
+
+// Tracing is the configuration of the export of traces to an
+// OpenTelemetry collector.
+type Tracing struct {
+	// the URL of the OTLP/HTTP traces endpoint
+	Endpoint string `json:"endpoint"`
+	// extra HTTP headers, typically used for authentication
+	Headers map[string]string `json:"headers,omitempty"`
+	// the service name, "galene" by default
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
+// Upload is the configuration of the upload of recordings once they
+// are complete.
+type Upload struct {
+	// "s3", "webdav" or "command"
+	Type string `json:"type"`
+	// the URL of the S3 bucket or of the WebDAV collection
+	URL string `json:"url,omitempty"`
+	// the S3 region, "us-east-1" by default
+	Region string `json:"region,omitempty"`
+	// the S3 credentials
+	AccessKeyId     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	// the WebDAV credentials, for basic authentication
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// the command and its arguments; the name of the file is appended
+	Command []string `json:"command,omitempty"`
+	// if true, the local copy is not removed after a successful upload
+	Keep bool `json:"keep,omitempty"`
 }
 
 func (conf Configuration) Zero() bool {
@@ -1078,6 +1483,9 @@ type Status struct {
 	AuthPortal  string `json:"authPortal,omitempty"`
 	Locked      bool   `json:"locked,omitempty"`
 	ClientCount *int   `json:"clientCount,omitempty"`
+
+	// the WebTransport endpoint, if the server accepts WebTransport
+	WebTransportEndpoint string `json:"webTransportEndpoint,omitempty"`
 }
 
 // Status returns a group's status.
@@ -1130,7 +1538,7 @@ func (g *Group) Status(authentified bool, base *url.URL) Status {
 	if authentified || desc.Public {
 		// these are considered private information
 		locked, _ := g.Locked()
-		count := g.ClientCount()
+		count := g.ClientCount() + g.RemoteClientCount()
 		d.Locked = locked
 		d.ClientCount = &count
 	}
@@ -1157,7 +1565,7 @@ func GetPublic(base *url.URL) []Status {
 func Update() {
 	_, err := GetConfiguration()
 	if err != nil {
-		log.Printf("%v: %v",
+		logger.Errorf("%v: %v",
 			filepath.Join(DataDirectory, "config.json"),
 			err,
 		)
@@ -1178,59 +1586,28 @@ func Update() {
 
 		// update group description
 		if !deleted {
-			Add(name, nil)
+			_, err := Add(name, nil)
+			if os.IsNotExist(err) {
+				// the group's definition was removed
+				kickall(g, "this group has been deleted")
+				Delete(name)
+			}
 		}
 	}
 
-	err = filepath.WalkDir(
-		Directory,
-		func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				log.Printf("Group file %v: %v", path, err)
-				return nil
-			}
-			if d.IsDir() {
-				base := filepath.Base(path)
-				if base[0] == '.' {
-					log.Printf(
-						"Ignoring group directory %v",
-						path,
-					)
-					return fs.SkipDir
-				}
-				return nil
-			}
-			filename, err := filepath.Rel(Directory, path)
-			if err != nil {
-				log.Printf("Group file %v: %v", path, err)
-				return nil
-			}
-			if !strings.HasSuffix(filename, ".json") {
-				log.Printf(
-					"Unexpected extension for group file %v",
-					path,
-				)
-				return nil
-			}
-			base := filepath.Base(filename)
-			if base[0] == '.' {
-				log.Printf("Ignoring group file %v", filename)
-				return nil
-			}
-			name := strings.TrimSuffix(filename, ".json")
-			desc, err := GetDescription(name)
-			if err != nil {
-				log.Printf("Group file %v: %v", path, err)
-				return nil
-			}
-			if desc.Public {
-				Add(name, desc)
-			}
-			return nil
-		},
-	)
-
+	names, err = store().Names()
 	if err != nil {
-		log.Printf("Couldn't read groups: %v", err)
+		logger.Warnf("Couldn't read groups: %v", err)
+		return
+	}
+	for _, name := range names {
+		desc, err := GetDescription(name)
+		if err != nil {
+			logger.Warnf("Group %v: %v", name, err)
+			continue
+		}
+		if desc.Public {
+			Add(name, desc)
+		}
 	}
 }
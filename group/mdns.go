@@ -0,0 +1,93 @@
+package group
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mdns"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsTimeout is the time we wait for an answer to an mDNS query.
+const mdnsTimeout = 3 * time.Second
+
+// mdnsConn is shared by all peer connections, so that we don't need
+// to open a multicast socket for each of them.
+var mdnsConn struct {
+	mu   sync.Mutex
+	conn *mdns.Conn
+}
+
+func getMDNSConn() (*mdns.Conn, error) {
+	mdnsConn.mu.Lock()
+	defer mdnsConn.mu.Unlock()
+
+	if mdnsConn.conn != nil {
+		return mdnsConn.conn, nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", mdns.DefaultAddress)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := mdns.Server(ipv4.NewPacketConn(l), &mdns.Config{})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	mdnsConn.conn = conn
+	return conn, nil
+}
+
+// candidateAddress is the index of the address in the fields of
+// a candidate, whether or not it has the "candidate:" prefix.
+const candidateAddress = 4
+
+// IsMDNSCandidate returns true if the address of the given candidate is
+// an mDNS hostname.
+func IsMDNSCandidate(candidate *webrtc.ICECandidateInit) bool {
+	fields := strings.Fields(candidate.Candidate)
+	if len(fields) <= candidateAddress {
+		return false
+	}
+	return strings.HasSuffix(fields[candidateAddress], ".local")
+}
+
+// ResolveMDNSCandidate returns a copy of the given candidate with its
+// mDNS hostname replaced by the address it resolves to.
+func ResolveMDNSCandidate(candidate *webrtc.ICECandidateInit) (webrtc.ICECandidateInit, error) {
+	fields := strings.Fields(candidate.Candidate)
+	if len(fields) <= candidateAddress {
+		return webrtc.ICECandidateInit{}, errors.New("bad candidate")
+	}
+
+	conn, err := getMDNSConn()
+	if err != nil {
+		return webrtc.ICECandidateInit{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mdnsTimeout)
+	defer cancel()
+	_, addr, err := conn.Query(ctx, fields[candidateAddress])
+	if err != nil {
+		return webrtc.ICECandidateInit{}, err
+	}
+	a, ok := addr.(*net.IPAddr)
+	if !ok {
+		return webrtc.ICECandidateInit{}, errors.New("unexpected address")
+	}
+
+	fields[candidateAddress] = a.IP.String()
+	c := *candidate
+	c.Candidate = strings.Join(fields, " ")
+	return c, nil
+}
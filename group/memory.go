@@ -0,0 +1,112 @@
+package group
+
+import (
+	"sync/atomic"
+)
+
+// MemoryKind identifies the allocations accounted to a group.
+type MemoryKind int
+
+const (
+	// packet caches of up tracks
+	MemoryCache MemoryKind = iota
+	// chat history
+	MemoryHistory
+	// packets queued for sending to subscribers
+	MemoryQueue
+	// media buffered by recorders and the HLS output
+	MemoryRecording
+	NumMemoryKinds
+)
+
+// ErrMemoryExceeded is returned when a group is over its memory limit.
+var ErrMemoryExceeded = UserError("this group is using too much memory")
+
+// A MemoryAccount counts the number of bytes allocated for a given
+// purpose.  A nil account ignores all updates.
+type MemoryAccount struct {
+	bytes int64
+}
+
+// Add adds delta (which may be negative) to the account.
+func (a *MemoryAccount) Add(delta int64) {
+	if a == nil {
+		return
+	}
+	atomic.AddInt64(&a.bytes, delta)
+}
+
+// Get returns the current value of the account.
+func (a *MemoryAccount) Get() int64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&a.bytes)
+}
+
+// Memory returns the account for the given kind of allocations.
+func (g *Group) Memory(kind MemoryKind) *MemoryAccount {
+	return &g.memory[kind]
+}
+
+// MemoryUsage returns the total number of bytes accounted to g.
+func (g *Group) MemoryUsage() int64 {
+	var total int64
+	for i := range g.memory {
+		total += g.memory[i].Get()
+	}
+	return total
+}
+
+// MaxMemory returns the memory limit of the group in bytes, or 0 if
+// there is no limit.
+func (g *Group) MaxMemory() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return maxMemory(g.description)
+}
+
+func maxMemory(desc *Description) int64 {
+	if desc == nil || desc.MaxMemory <= 0 {
+		return 0
+	}
+	return int64(desc.MaxMemory) * 1024 * 1024
+}
+
+// memoryExceeded returns true if g is over its memory limit.  The second
+// return value is true if the state has changed since the last call.
+// Called locked.
+func (g *Group) memoryExceeded() (bool, bool) {
+	max := maxMemory(g.description)
+	exceeded := max > 0 && g.MemoryUsage() > max
+	changed := exceeded != g.overMemory
+	g.overMemory = exceeded
+	return exceeded, changed
+}
+
+// memoryNotify informs the administrator and the group operators that
+// the memory state of a group has changed.
+func (g *Group) memoryNotify(exceeded bool) {
+	if exceeded {
+		logger.Warnf("Group %v is over its memory limit "+
+			"(%v bytes), shedding load",
+			g.name, g.MemoryUsage())
+		g.WallOps("This group is using too much memory, " +
+			"some features are temporarily disabled")
+	} else {
+		logger.Infof("Group %v is back under its memory limit",
+			g.name)
+	}
+}
+
+// MemoryExceeded returns true if g is over its memory limit.  Callers
+// should avoid performing new allocations on behalf of the group.
+func (g *Group) MemoryExceeded() bool {
+	g.mu.Lock()
+	exceeded, changed := g.memoryExceeded()
+	g.mu.Unlock()
+	if changed {
+		g.memoryNotify(exceeded)
+	}
+	return exceeded
+}
@@ -0,0 +1,66 @@
+package group
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryMemory(t *testing.T) {
+	g := Group{
+		description: &Description{},
+	}
+	user := "user"
+	for i := 0; i < 2*maxChatHistory; i++ {
+		g.AddToChatHistory("id", &user, time.Now(), "", "hello")
+	}
+	size := historyEntrySize(&g.history[0])
+	if m := g.Memory(MemoryHistory).Get(); m != maxChatHistory*size {
+		t.Errorf("Expected %v, got %v", maxChatHistory*size, m)
+	}
+	g.ClearChatHistory()
+	if m := g.Memory(MemoryHistory).Get(); m != 0 {
+		t.Errorf("Expected 0, got %v", m)
+	}
+}
+
+func TestMemoryExceeded(t *testing.T) {
+	g := Group{
+		description: &Description{MaxMemory: 1},
+	}
+	if g.MemoryExceeded() {
+		t.Errorf("Memory exceeded in empty group")
+	}
+
+	g.Memory(MemoryCache).Add(1024 * 1024)
+	if g.MemoryExceeded() {
+		t.Errorf("Memory exceeded at limit")
+	}
+
+	// history gets trimmed when the limit is exceeded
+	user := "user"
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 10; i++ {
+		g.AddToChatHistory("id", &user, time.Now(), "", value)
+	}
+	if !g.MemoryExceeded() {
+		t.Errorf("Memory not exceeded")
+	}
+	if len(g.history) >= 10 {
+		t.Errorf("History was not trimmed (%v entries)", len(g.history))
+	}
+
+	g.Memory(MemoryCache).Add(-1024 * 1024)
+	if g.MemoryExceeded() {
+		t.Errorf("Memory still exceeded")
+	}
+	if g.MemoryUsage() != g.Memory(MemoryHistory).Get() {
+		t.Errorf("Inconsistent usage")
+	}
+
+	g.description = &Description{}
+	g.Memory(MemoryQueue).Add(1 << 40)
+	if g.MemoryExceeded() {
+		t.Errorf("Memory exceeded in unlimited group")
+	}
+}
@@ -0,0 +1,103 @@
+package group
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// IPFamily restricts ICE to IPv4 if it is "ipv4", or to IPv6 if it is
+// "ipv6".  If it is empty, both address families are used.
+var IPFamily string
+
+// iceTCPMux multiplexes the ICE-TCP traffic of all peer connections on
+// a single port.  It is nil if ICE-TCP is disabled.
+var iceTCPMux ice.TCPMux
+
+// iceUDPMux multiplexes the ICE traffic over UDP of all peer connections
+// on a single port.  It is nil if each connection uses its own port.
+var iceUDPMux ice.UDPMux
+
+// ListenICETCP enables passive ICE-TCP candidates on the given address,
+// which allows clients behind firewalls that block UDP to connect
+// without going through a TURN relay.  It must be called before any
+// peer connection is created.
+func ListenICETCP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	iceTCPMux = webrtc.NewICETCPMux(nil, l, 8)
+	return nil
+}
+
+// ListenICEUDP causes all UDP media traffic to be multiplexed on
+// the given address rather than using one ephemeral port per
+// connection.  It must be called before any peer connection is created.
+func ListenICEUDP(addr string) error {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		// a single socket bound to the wildcard address cannot
+		// tell which local address a packet was sent to, so
+		// bind one socket per local address.
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return err
+		}
+		mux, err := ice.NewMultiUDPMuxFromPort(port)
+		if err != nil {
+			return err
+		}
+		iceUDPMux = mux
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	iceUDPMux = webrtc.NewICEUDPMux(nil, conn)
+	return nil
+}
+
+// CloseICEMux closes the ICE multiplexers.
+func CloseICEMux() {
+	if iceTCPMux != nil {
+		iceTCPMux.Close()
+		iceTCPMux = nil
+	}
+	if iceUDPMux != nil {
+		iceUDPMux.Close()
+		iceUDPMux = nil
+	}
+}
+
+// setICENetwork configures s to use the ICE multiplexers, if any, and
+// restricts the network types according to IPFamily.
+func setICENetwork(s *webrtc.SettingEngine) {
+	if iceUDPMux != nil {
+		s.SetICEUDPMux(iceUDPMux)
+	}
+	if iceTCPMux != nil {
+		s.SetICETCPMux(iceTCPMux)
+	}
+	var types []webrtc.NetworkType
+	if IPFamily != "ipv6" {
+		types = append(types, webrtc.NetworkTypeUDP4)
+		if iceTCPMux != nil {
+			types = append(types, webrtc.NetworkTypeTCP4)
+		}
+	}
+	if IPFamily != "ipv4" {
+		types = append(types, webrtc.NetworkTypeUDP6)
+		if iceTCPMux != nil {
+			types = append(types, webrtc.NetworkTypeTCP6)
+		}
+	}
+	s.SetNetworkTypes(types)
+}
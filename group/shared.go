@@ -0,0 +1,328 @@
+package group
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jech/galene/shared"
+)
+
+// SharedStore, if not nil, is used to share the lock status of groups,
+// the fact that they are being recorded, their members and their chat
+// history with other instances.  It is set at startup.
+var SharedStore shared.Store
+
+// SharedInterval is the interval at which SyncShared should be called.
+// Changes made on other instances become visible after this delay.
+const SharedInterval = 5 * time.Second
+
+// identifies this instance in recording and members keys
+var instanceId string
+
+func init() {
+	b := make([]byte, 8)
+	crand.Read(b)
+	instanceId = hex.EncodeToString(b)
+}
+
+// A Recorder is a client that records a group.
+type Recorder interface {
+	Client
+	Recorder()
+}
+
+type sharedLock struct {
+	Message string `json:"message"`
+}
+
+func lockKey(name string) string {
+	return "lock:" + name
+}
+
+func recordingKey(name string) string {
+	return "recording:" + name
+}
+
+func membersPrefix(name string) string {
+	return "members:" + name + ":"
+}
+
+func historyKey(name string) string {
+	return "history:" + name
+}
+
+type sharedMembers struct {
+	Users []string `json:"users"`
+}
+
+// publishLock stores the lock status of a group in the shared store.
+func (g *Group) publishLock(locked bool, message string) {
+	var err error
+	if locked {
+		var v []byte
+		v, err = json.Marshal(sharedLock{message})
+		if err == nil {
+			err = SharedStore.Set(lockKey(g.name), v, 0)
+		}
+	} else {
+		err = SharedStore.Delete(lockKey(g.name))
+	}
+	if err != nil {
+		logger.Warnf("Shared state: %v", err)
+		// don't let SyncShared undo the change
+		g.mu.Lock()
+		g.lockShared = false
+		g.mu.Unlock()
+	}
+}
+
+// applySharedLock applies the lock status found in the shared store.
+// Locks that were not set by an operator, such as autolock, are not
+// undone.
+func (g *Group) applySharedLock(v []byte) {
+	var lock *sharedLock
+	if v != nil {
+		var l sharedLock
+		err := json.Unmarshal(v, &l)
+		if err != nil {
+			logger.Warnf("Shared lock for %v: %v", g.name, err)
+			return
+		}
+		lock = &l
+	}
+
+	g.mu.Lock()
+	changed := false
+	if lock != nil {
+		if g.locked == nil || *g.locked != lock.Message ||
+			!g.lockShared {
+			m := lock.Message
+			g.locked = &m
+			g.lockShared = true
+			changed = true
+		}
+	} else if g.locked != nil && g.lockShared {
+		g.locked = nil
+		g.lockShared = false
+		changed = true
+	}
+	var clients []Client
+	if changed {
+		clients = g.getClientsUnlocked(nil)
+	}
+	g.mu.Unlock()
+
+	for _, c := range clients {
+		c.Joined(g.Name(), "change")
+	}
+}
+
+func (g *Group) isRecording() bool {
+	for _, c := range g.GetClients(nil) {
+		if _, ok := c.(Recorder); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordingElsewhere returns true if the group is being recorded by
+// another instance.
+func (g *Group) RecordingElsewhere() (bool, error) {
+	if SharedStore == nil {
+		return false, nil
+	}
+	v, err := SharedStore.Get(recordingKey(g.name))
+	if err != nil {
+		return false, err
+	}
+	return v != nil && string(v) != instanceId, nil
+}
+
+// RemoteClientCount returns the number of users of the group connected
+// to other instances, as of the last call to SyncShared.
+func (g *Group) RemoteClientCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.remoteClients
+}
+
+// syncMembers publishes the usernames of the local members of a group,
+// and counts the members connected to other instances.
+func (g *Group) syncMembers() error {
+	var users []string
+	for _, c := range g.GetClients(nil) {
+		if !member("system", c.Permissions()) {
+			users = append(users, c.Username())
+		}
+	}
+
+	g.mu.Lock()
+	shared := g.membersShared
+	g.membersShared = len(users) > 0
+	g.mu.Unlock()
+
+	prefix := membersPrefix(g.name)
+	if len(users) > 0 {
+		v, err := json.Marshal(sharedMembers{users})
+		if err != nil {
+			return err
+		}
+		err = SharedStore.Set(prefix+instanceId, v, 3*SharedInterval)
+		if err != nil {
+			return err
+		}
+	} else if shared {
+		err := SharedStore.Delete(prefix + instanceId)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := SharedStore.Keys(prefix)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, k := range keys {
+		instance := k[len(prefix):]
+		// the prefix of a group whose name contains a colon
+		if instance == instanceId || strings.Contains(instance, ":") {
+			continue
+		}
+		v, err := SharedStore.Get(k)
+		if err != nil {
+			return err
+		}
+		var m sharedMembers
+		if v == nil || json.Unmarshal(v, &m) != nil {
+			continue
+		}
+		count += len(m.Users)
+	}
+
+	g.mu.Lock()
+	g.remoteClients = count
+	g.mu.Unlock()
+	return nil
+}
+
+// publishHistory stores the chat history of a group if it has changed,
+// so that it survives the group moving to another instance.
+func (g *Group) publishHistory() error {
+	g.mu.Lock()
+	if !g.historyDirty {
+		g.mu.Unlock()
+		return nil
+	}
+	g.historyDirty = false
+	h := make([]ChatHistoryEntry, len(g.history))
+	copy(h, g.history)
+	age := maxHistoryAge(g.description)
+	g.mu.Unlock()
+
+	var err error
+	if len(h) == 0 {
+		err = SharedStore.Delete(historyKey(g.name))
+	} else {
+		var v []byte
+		v, err = json.Marshal(h)
+		if err == nil {
+			err = SharedStore.Set(historyKey(g.name), v, age)
+		}
+	}
+	if err != nil {
+		g.mu.Lock()
+		g.historyDirty = true
+		g.mu.Unlock()
+	}
+	return err
+}
+
+// loadSharedHistory loads the chat history stored by another instance,
+// the first time it is needed.
+func (g *Group) loadSharedHistory() {
+	g.mu.Lock()
+	loaded := g.historyLoaded
+	g.historyLoaded = true
+	g.mu.Unlock()
+	if loaded {
+		return
+	}
+
+	v, err := SharedStore.Get(historyKey(g.name))
+	if err != nil {
+		logger.Warnf("Shared state: %v", err)
+		return
+	}
+	if v == nil {
+		return
+	}
+	var h []ChatHistoryEntry
+	err = json.Unmarshal(v, &h)
+	if err != nil {
+		logger.Warnf("Shared history for %v: %v", g.name, err)
+		return
+	}
+	if len(h) > maxChatHistory {
+		h = h[len(h)-maxChatHistory:]
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.history) > 0 {
+		return
+	}
+	for i := range h {
+		g.memory[MemoryHistory].Add(historyEntrySize(&h[i]))
+	}
+	g.history = h
+}
+
+// SyncShared synchronises the state of the local groups with the
+// shared store.
+func SyncShared() {
+	if SharedStore == nil {
+		return
+	}
+
+	var gs []*Group
+	Range(func(g *Group) bool {
+		gs = append(gs, g)
+		return true
+	})
+
+	for _, g := range gs {
+		v, err := SharedStore.Get(lockKey(g.name))
+		if err != nil {
+			logger.Warnf("Shared state: %v", err)
+			return
+		}
+		g.applySharedLock(v)
+
+		key := recordingKey(g.name)
+		if g.isRecording() {
+			err = SharedStore.Set(
+				key, []byte(instanceId), 3*SharedInterval,
+			)
+		} else {
+			v, err = SharedStore.Get(key)
+			if err == nil && string(v) == instanceId {
+				err = SharedStore.Delete(key)
+			}
+		}
+		if err == nil {
+			err = g.syncMembers()
+		}
+		if err == nil {
+			err = g.publishHistory()
+		}
+		if err != nil {
+			logger.Warnf("Shared state: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package group
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/shared"
+)
+
+type recorderTestClient struct {
+	notifyTestClient
+}
+
+func (c *recorderTestClient) Recorder() {}
+
+func TestSharedLock(t *testing.T) {
+	groups.groups = nil
+	SharedStore = shared.NewMemory()
+	defer func() {
+		SharedStore = nil
+	}()
+
+	g, err := Add("shared", &Description{})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	g.SetLocked(true, "closed")
+	v, _ := SharedStore.Get(lockKey("shared"))
+	if string(v) != `{"message":"closed"}` {
+		t.Errorf("Bad shared lock %q", v)
+	}
+
+	// unlocked on another instance
+	SharedStore.Delete(lockKey("shared"))
+	SyncShared()
+	if locked, _ := g.Locked(); locked {
+		t.Errorf("Group is still locked")
+	}
+
+	// locked on another instance
+	SharedStore.Set(lockKey("shared"), []byte(`{"message":"remote"}`), 0)
+	SyncShared()
+	if locked, message := g.Locked(); !locked || message != "remote" {
+		t.Errorf("Expected remote lock, got %v %v", locked, message)
+	}
+
+	// local locks that were not set by an operator are preserved
+	SharedStore.Delete(lockKey("shared"))
+	SyncShared()
+	g.setLocked(true, "auto", false)
+	SyncShared()
+	if locked, message := g.Locked(); !locked || message != "auto" {
+		t.Errorf("Expected local lock, got %v %v", locked, message)
+	}
+}
+
+func TestSharedRecording(t *testing.T) {
+	groups.groups = nil
+	SharedStore = shared.NewMemory()
+	defer func() {
+		SharedStore = nil
+	}()
+
+	dir := Directory
+	Directory = t.TempDir()
+	defer func() {
+		Directory = dir
+	}()
+	err := os.WriteFile(filepath.Join(Directory, "recorded.json"),
+		[]byte(`{}`), 0o600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	g, err := Add("recorded", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	r := &recorderTestClient{notifyTestClient{id: "r", group: g}}
+	r.perms = []string{"system"}
+	_, err = AddClient("recorded", r, ClientCredentials{System: true})
+	if err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+	SyncShared()
+	v, _ := SharedStore.Get(recordingKey("recorded"))
+	if string(v) != instanceId {
+		t.Errorf("Bad recording key %q", v)
+	}
+	elsewhere, err := g.RecordingElsewhere()
+	if err != nil || elsewhere {
+		t.Errorf("RecordingElsewhere: %v %v", elsewhere, err)
+	}
+
+	DelClient(r)
+	SyncShared()
+	v, _ = SharedStore.Get(recordingKey("recorded"))
+	if v != nil {
+		t.Errorf("Recording key not deleted")
+	}
+
+	SharedStore.Set(recordingKey("recorded"), []byte("other"), 0)
+	SyncShared()
+	elsewhere, err = g.RecordingElsewhere()
+	if err != nil || !elsewhere {
+		t.Errorf("RecordingElsewhere: %v %v", elsewhere, err)
+	}
+}
+
+func TestSharedMembers(t *testing.T) {
+	groups.groups = nil
+	SharedStore = shared.NewMemory()
+	defer func() {
+		SharedStore = nil
+	}()
+
+	dir := Directory
+	Directory = t.TempDir()
+	defer func() {
+		Directory = dir
+	}()
+	err := os.WriteFile(filepath.Join(Directory, "members.json"),
+		[]byte(`{"presenter": [{}], "max-clients": 2}`), 0o600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	g, err := Add("members", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	username := "alice"
+	c := &notifyTestClient{id: "c", group: g}
+	_, err = AddClient("members", c, ClientCredentials{Username: &username})
+	if err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+	SyncShared()
+	v, _ := SharedStore.Get(membersPrefix("members") + instanceId)
+	if string(v) != `{"users":["alice"]}` {
+		t.Errorf("Bad members key %q", v)
+	}
+
+	SharedStore.Set(membersPrefix("members")+"other",
+		[]byte(`{"users":["bob"]}`), 0)
+	// a group whose name has the same prefix
+	SharedStore.Set(membersPrefix("members")+"x:other",
+		[]byte(`{"users":["carol"]}`), 0)
+	SyncShared()
+	if n := g.RemoteClientCount(); n != 1 {
+		t.Errorf("RemoteClientCount: got %v", n)
+	}
+	username = "dave"
+	d := &notifyTestClient{id: "d", group: g}
+	_, err = AddClient("members", d, ClientCredentials{Username: &username})
+	if err == nil || err.Error() != "too many users" {
+		t.Errorf("MaxClients ignored remote clients: %v", err)
+	}
+
+	DelClient(c)
+	SyncShared()
+	v, _ = SharedStore.Get(membersPrefix("members") + instanceId)
+	if v != nil {
+		t.Errorf("Members key not deleted")
+	}
+}
+
+func TestSharedHistory(t *testing.T) {
+	groups.groups = nil
+	SharedStore = shared.NewMemory()
+	defer func() {
+		SharedStore = nil
+	}()
+
+	g, err := Add("history", &Description{})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	user := "alice"
+	g.AddToChatHistory("id", &user, time.Now(), "", "hello")
+	SyncShared()
+	if v, _ := SharedStore.Get(historyKey("history")); v == nil {
+		t.Fatalf("History not published")
+	}
+
+	// the group is recreated, as if on a different instance
+	groups.groups = nil
+	g, err = Add("history", &Description{})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	h := g.GetChatHistory()
+	if len(h) != 1 || h[0].Value != "hello" || *h[0].User != "alice" {
+		t.Errorf("Bad history %v", h)
+	}
+
+	g.ClearChatHistory()
+	SyncShared()
+	if v, _ := SharedStore.Get(historyKey("history")); v != nil {
+		t.Errorf("History not deleted")
+	}
+}
@@ -0,0 +1,235 @@
+package group
+
+import (
+	"sort"
+	"time"
+)
+
+// Audio levels are in -dBov, as in RFC 6464: 0 is the loudest, and
+// Silence is the quietest.
+const Silence = 127
+
+const (
+	// a client starts speaking when its smoothed level goes above
+	// speakingOn, and stops when it goes below speakingOff
+	speakingOn  = 50
+	speakingOff = 60
+	// a stream whose smoothed level is below forgetLevel is forgotten
+	forgetLevel = 120
+	// the weight of the previous value when smoothing levels
+	levelSmoothing = 0.6
+	// a speaker only becomes the active speaker if they are louder
+	// than the current one by this many dB
+	speakerMargin = 6
+	// a client only counts as a recent speaker once they have been
+	// speaking for this long, so that a cough doesn't reorder last-N
+	speakerHold = time.Second
+)
+
+// speaker is the voice activity state of a client.
+type speaker struct {
+	// the smoothed level of each of the client's streams
+	levels   map[string]float64
+	level    float64
+	speaking bool
+	// when the client started speaking, and whether it was since
+	// moved to the front of the recent speakers
+	since  time.Time
+	recent bool
+}
+
+// A SpeakerPusher is a client that wants to be informed of changes to the
+// set of clients that are speaking.
+type SpeakerPusher interface {
+	// PushSpeakers is called with the id of the active speaker, which
+	// may be empty, and the ids of the clients currently speaking.  It
+	// is called with the group locked, and must not block.
+	PushSpeakers(group, active string, speaking []string) error
+}
+
+// SetAudioLevel records the audio level measured over a short interval on
+// the given stream of client c, and informs the clients of the group if
+// the set of speakers changed.
+func (g *Group) SetAudioLevel(c Client, stream string, level uint8) {
+	g.setAudioLevel(c, stream, level, time.Now())
+}
+
+func (g *Group) setAudioLevel(c Client, stream string, level uint8, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := c.Id()
+	if g.clients[id] != c {
+		return
+	}
+	s := g.speakers[id]
+	if s == nil {
+		if level >= Silence {
+			return
+		}
+		s = &speaker{
+			levels: make(map[string]float64),
+			level:  Silence,
+		}
+		if g.speakers == nil {
+			g.speakers = make(map[string]*speaker)
+		}
+		g.speakers[id] = s
+	}
+
+	l, ok := s.levels[stream]
+	if !ok {
+		l = Silence
+	}
+	l = levelSmoothing*l + (1-levelSmoothing)*float64(level)
+	if l > forgetLevel {
+		delete(s.levels, stream)
+	} else {
+		s.levels[stream] = l
+	}
+	g.updateSpeaker(id, s, now)
+}
+
+// DelAudioLevel forgets about a stream of client c, which should be
+// called when the stream is closed.
+func (g *Group) DelAudioLevel(c Client, stream string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s := g.speakers[c.Id()]
+	if s == nil || g.clients[c.Id()] != c {
+		return
+	}
+	delete(s.levels, stream)
+	g.updateSpeaker(c.Id(), s, time.Now())
+}
+
+// updateSpeaker recomputes the state of a speaker and the active speaker,
+// and pushes any changes.  Called locked.
+func (g *Group) updateSpeaker(id string, s *speaker, now time.Time) {
+	s.level = Silence
+	for _, l := range s.levels {
+		if l < s.level {
+			s.level = l
+		}
+	}
+
+	changed := false
+	if !s.speaking && s.level < speakingOn {
+		s.speaking = true
+		s.since = now
+		changed = true
+	} else if s.speaking && s.level > speakingOff {
+		s.speaking = false
+		s.recent = false
+		changed = true
+	}
+	if s.speaking && !s.recent && now.Sub(s.since) >= speakerHold {
+		s.recent = true
+		changed = true
+		g.speakerOrder = moveToFront(id, g.speakerOrder)
+	}
+	if !s.speaking && len(s.levels) == 0 {
+		delete(g.speakers, id)
+	}
+
+	// keep the active speaker until somebody else speaks noticeably
+	// louder, or the active speaker stops and somebody else speaks
+	var loudest string
+	for i, t := range g.speakers {
+		if t.speaking && i != g.activeSpeaker && (loudest == "" ||
+			t.level < g.speakers[loudest].level) {
+			loudest = i
+		}
+	}
+	if loudest != "" {
+		active := g.speakers[g.activeSpeaker]
+		if active == nil || !active.speaking ||
+			g.speakers[loudest].level+speakerMargin < active.level {
+			g.activeSpeaker = loudest
+			changed = true
+		}
+	}
+
+	if changed {
+		g.pushSpeakers()
+	}
+}
+
+// speakingUnlocked returns the ids of the clients currently speaking.
+// Called locked.
+func (g *Group) speakingUnlocked() []string {
+	speaking := make([]string, 0, len(g.speakers))
+	for id, s := range g.speakers {
+		if s.speaking {
+			speaking = append(speaking, id)
+		}
+	}
+	sort.Strings(speaking)
+	return speaking
+}
+
+// RecentSpeakers returns the ids of the n clients with the presenter
+// permission that spoke most recently, except the client except, most
+// recent first.  Only clients that spoke for speakerHold count.  If not
+// enough clients have spoken, the remaining ones are returned in the order
+// in which they joined.
+func (g *Group) RecentSpeakers(except Client, n int) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ids := make([]string, 0, n)
+	for _, id := range g.speakerOrder {
+		if len(ids) >= n {
+			break
+		}
+		c := g.clients[id]
+		if c == nil || c == except ||
+			!member("present", c.Permissions()) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func remove(v string, l []string) []string {
+	for i, w := range l {
+		if v == w {
+			return append(l[:i], l[i+1:]...)
+		}
+	}
+	return l
+}
+
+func moveToFront(v string, l []string) []string {
+	for i, w := range l {
+		if v == w {
+			copy(l[1:i+1], l[:i])
+			l[0] = v
+			break
+		}
+	}
+	return l
+}
+
+// Speakers returns the id of the active speaker, which may be empty, and
+// the ids of the clients currently speaking.
+func (g *Group) Speakers() (string, []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.activeSpeaker, g.speakingUnlocked()
+}
+
+// pushSpeakers informs the clients of the group about the set of
+// speakers.  Called locked.
+func (g *Group) pushSpeakers() {
+	speaking := g.speakingUnlocked()
+	for _, c := range g.clients {
+		p, ok := c.(SpeakerPusher)
+		if !ok {
+			continue
+		}
+		p.PushSpeakers(g.name, g.activeSpeaker, speaking)
+	}
+}
@@ -0,0 +1,152 @@
+package group
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type speakerTestClient struct {
+	notifyTestClient
+	active   string
+	speaking []string
+	pushes   int
+}
+
+func (c *speakerTestClient) PushSpeakers(group, active string, speaking []string) error {
+	c.active = active
+	c.speaking = speaking
+	c.pushes++
+	return nil
+}
+
+func TestSpeakers(t *testing.T) {
+	groups.groups = nil
+	dir := Directory
+	Directory = t.TempDir()
+	defer func() {
+		Directory = dir
+	}()
+	err := os.WriteFile(filepath.Join(Directory, "speakers.json"),
+		[]byte(`{"presenter": [{}]}`), 0o600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	g, err := Add("speakers", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	bob := &speakerTestClient{}
+	alice := &speakerTestClient{}
+	bob.id, alice.id = "b", "a"
+	bob.group, alice.group = g, g
+	for _, c := range []*speakerTestClient{bob, alice} {
+		username := c.id
+		_, err := AddClient("speakers", c,
+			ClientCredentials{Username: &username},
+		)
+		if err != nil {
+			t.Fatalf("AddClient: %v", err)
+		}
+	}
+
+	check := func(active string, speaking []string) {
+		t.Helper()
+		a, s := g.Speakers()
+		if a != active || !reflect.DeepEqual(s, speaking) {
+			t.Errorf("Expected %v %v, got %v %v",
+				active, speaking, a, s)
+		}
+		if alice.active != a || !reflect.DeepEqual(alice.speaking, s) {
+			t.Errorf("Pushed %v %v, expected %v %v",
+				alice.active, alice.speaking, a, s)
+		}
+	}
+
+	now := time.Now()
+	setLevel := func(c Client, stream string, level uint8) {
+		now = now.Add(speakerHold / 2)
+		g.setAudioLevel(c, stream, level, now)
+	}
+
+	recent := func(except Client, n int, expected []string) {
+		t.Helper()
+		r := g.RecentSpeakers(except, n)
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("Expected %v, got %v", expected, r)
+		}
+	}
+
+	// nobody spoke yet, join order
+	recent(nil, 1, []string{"b"})
+	recent(nil, 5, []string{"b", "a"})
+
+	// silence is ignored
+	setLevel(bob, "camera", Silence)
+	if len(g.speakers) != 0 || alice.pushes != 0 {
+		t.Errorf("Silence was recorded")
+	}
+
+	// a single loud packet is not enough
+	setLevel(bob, "camera", 30)
+	if alice.pushes != 0 {
+		t.Errorf("Pushed after a single report")
+	}
+	for i := 0; i < 5; i++ {
+		setLevel(bob, "camera", 30)
+	}
+	check("b", []string{"b"})
+
+	// a silent stream doesn't hide a loud one
+	for i := 0; i < 5; i++ {
+		setLevel(bob, "screenshare", Silence)
+		setLevel(bob, "camera", 30)
+	}
+	check("b", []string{"b"})
+
+	// alice is not louder than bob, bob remains the active speaker
+	for i := 0; i < 5; i++ {
+		setLevel(alice, "camera", 28)
+	}
+	check("b", []string{"a", "b"})
+	recent(nil, 1, []string{"a"})
+	recent(alice, 1, []string{"b"})
+
+	// bob stops talking, alice becomes the active speaker
+	for i := 0; i < 10; i++ {
+		setLevel(bob, "camera", Silence)
+		setLevel(alice, "camera", 28)
+	}
+	check("a", []string{"a"})
+
+	// bob speaks briefly, which doesn't make him a recent speaker
+	for i := 0; i < 4; i++ {
+		g.setAudioLevel(bob, "camera", 25, now)
+	}
+	check("a", []string{"a", "b"})
+	recent(nil, 1, []string{"a"})
+	now = now.Add(speakerHold)
+	g.setAudioLevel(bob, "camera", 25, now)
+	recent(nil, 1, []string{"b"})
+	for i := 0; i < 10; i++ {
+		setLevel(bob, "camera", Silence)
+	}
+	check("a", []string{"a"})
+
+	// alice closes her stream, but remains the active speaker
+	g.DelAudioLevel(alice, "camera")
+	check("a", []string{})
+
+	DelClient(alice)
+	if a, _ := g.Speakers(); a != "" {
+		t.Errorf("Active speaker left, got %v", a)
+	}
+	recent(nil, 5, []string{"b"})
+	DelClient(bob)
+	if len(g.speakers) != 0 {
+		t.Errorf("Speakers not cleaned up: %v", g.speakers)
+	}
+}
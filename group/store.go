@@ -0,0 +1,161 @@
+package group
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A DescriptionStore holds the definitions of groups, as JSON.  Group
+// names are validated before they are passed to a store.
+type DescriptionStore interface {
+	// Version returns an opaque string that changes whenever the
+	// definition of the given group changes.  It returns an error
+	// satisfying os.IsNotExist if the group is not defined.
+	Version(name string) (string, error)
+	// Get returns the definition of a group together with its
+	// version.
+	Get(name string) ([]byte, string, error)
+	// Put sets the definition of a group, and returns true if the
+	// group didn't exist before.
+	Put(name string, data []byte) (bool, error)
+	// Delete removes the definition of a group.
+	Delete(name string) error
+	// Names returns the names of all defined groups.
+	Names() ([]string, error)
+}
+
+// Store, if not nil, holds the group definitions.  If it is nil, they
+// are stored as JSON files in Directory.  It is set at startup.
+var Store DescriptionStore
+
+func store() DescriptionStore {
+	if Store != nil {
+		return Store
+	}
+	return dirStore{}
+}
+
+// dirStore stores each group definition in its own file under Directory.
+type dirStore struct{}
+
+func (dirStore) fileName(name string) string {
+	return filepath.Join(Directory, path.Clean("/"+name)+".json")
+}
+
+func fileVersion(fi os.FileInfo) string {
+	return fmt.Sprintf("%v-%v", fi.ModTime().UnixNano(), fi.Size())
+}
+
+func (s dirStore) Version(name string) (string, error) {
+	fi, err := os.Stat(s.fileName(name))
+	if err != nil {
+		return "", err
+	}
+	return fileVersion(fi), nil
+}
+
+func (s dirStore) Get(name string) ([]byte, string, error) {
+	f, err := os.Open(s.fileName(name))
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, fileVersion(fi), nil
+}
+
+func (s dirStore) Put(name string, data []byte) (bool, error) {
+	fileName := s.fileName(name)
+	_, err := os.Stat(fileName)
+	created := os.IsNotExist(err)
+
+	dir := filepath.Dir(fileName)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return false, err
+	}
+	// the leading dot causes the temporary file to be ignored
+	tmpfile, err := os.CreateTemp(dir, ".group-*.json")
+	if err != nil {
+		return false, err
+	}
+	_, err = tmpfile.Write(data)
+	if err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return false, err
+	}
+	err = tmpfile.Close()
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return false, err
+	}
+	err = os.Rename(tmpfile.Name(), fileName)
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return false, err
+	}
+	return created, nil
+}
+
+func (s dirStore) Delete(name string) error {
+	return os.Remove(s.fileName(name))
+}
+
+func (dirStore) Names() ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(
+		Directory,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				logger.Warnf("Group file %v: %v", path, err)
+				return nil
+			}
+			if d.IsDir() {
+				base := filepath.Base(path)
+				if base[0] == '.' {
+					logger.Infof(
+						"Ignoring group directory %v",
+						path,
+					)
+					return fs.SkipDir
+				}
+				return nil
+			}
+			filename, err := filepath.Rel(Directory, path)
+			if err != nil {
+				logger.Warnf("Group file %v: %v", path, err)
+				return nil
+			}
+			if !strings.HasSuffix(filename, ".json") {
+				logger.Warnf(
+					"Unexpected extension for group file %v",
+					path,
+				)
+				return nil
+			}
+			base := filepath.Base(filename)
+			if base[0] == '.' {
+				logger.Infof("Ignoring group file %v", filename)
+				return nil
+			}
+			names = append(names, filepath.ToSlash(
+				strings.TrimSuffix(filename, ".json"),
+			))
+			return nil
+		},
+	)
+	return names, err
+}
@@ -0,0 +1,29 @@
+package group
+
+import (
+	"time"
+)
+
+// WatchDelay is the time during which the groups directory must remain
+// unchanged before the groups are updated.  This avoids reading a file
+// that is being written, and coalesces bursts of changes.
+var WatchDelay = 500 * time.Millisecond
+
+// watchLoop calls Update once WatchDelay has elapsed after the last
+// notification on changed.  The function rewatch is called just before,
+// in order to take new directories into account.
+func watchLoop(done <-chan struct{}, changed <-chan struct{}, rewatch func()) error {
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-changed:
+			timer = time.After(WatchDelay)
+		case <-timer:
+			timer = nil
+			rewatch()
+			Update()
+		}
+	}
+}
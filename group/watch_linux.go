@@ -0,0 +1,120 @@
+//go:build linux
+// +build linux
+
+package group
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_CLOSE_WRITE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+// addWatches adds a watch to Directory and all its subdirectories that
+// are not hidden.  Adding a watch twice is harmless.
+func addWatches(fd int) error {
+	return filepath.WalkDir(Directory,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == Directory {
+					return err
+				}
+				return nil
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			if path != Directory && d.Name()[0] == '.' {
+				return fs.SkipDir
+			}
+			_, err = unix.InotifyAddWatch(fd, path, watchMask)
+			if err != nil && path == Directory {
+				return err
+			}
+			return nil
+		},
+	)
+}
+
+// relevant returns true if a buffer of inotify events contains an event
+// that might affect a group definition.
+func relevant(buf []byte) bool {
+	for len(buf) >= unix.SizeofInotifyEvent {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		end := unix.SizeofInotifyEvent + int(ev.Len)
+		if end > len(buf) {
+			break
+		}
+		name := buf[unix.SizeofInotifyEvent:end]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		buf = buf[end:]
+
+		if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+			return true
+		}
+		if len(name) == 0 || name[0] == '.' {
+			continue
+		}
+		if ev.Mask&unix.IN_ISDIR != 0 ||
+			strings.HasSuffix(string(name), ".json") {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch watches the groups directory, and calls Update shortly after a
+// group definition has been created, modified or removed.  It returns
+// when done is closed.
+func Watch(done <-chan struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// a non-blocking file is handled by the runtime poller, which
+	// causes Read to return when the file is closed
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+
+	err = addWatches(fd)
+	if err != nil {
+		return err
+	}
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					logger.Warnf("Watching groups: %v", err)
+				}
+				return
+			}
+			if relevant(buf[:n]) {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return watchLoop(done, changed, func() {
+		err := addWatches(fd)
+		if err != nil {
+			logger.Warnf("Watching groups: %v", err)
+		}
+	})
+}
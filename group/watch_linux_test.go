@@ -0,0 +1,123 @@
+package group
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type kickTestClient struct {
+	notifyTestClient
+	kicked chan string
+}
+
+func (c *kickTestClient) Kick(id string, user *string, message string) error {
+	select {
+	case c.kicked <- message:
+	default:
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	dir, dataDir, delay := Directory, DataDirectory, WatchDelay
+	Directory = t.TempDir()
+	DataDirectory = t.TempDir()
+	WatchDelay = 10 * time.Millisecond
+	defer func() {
+		Directory, DataDirectory, WatchDelay = dir, dataDir, delay
+	}()
+
+	write := func(name, desc string) {
+		t.Helper()
+		fileName := filepath.Join(Directory, name+".json")
+		err := os.MkdirAll(filepath.Dir(fileName), 0o700)
+		if err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		err = os.WriteFile(fileName, []byte(desc), 0o600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	// the watcher starts asynchronously, so we repeat the action
+	// until it takes effect
+	eventually := func(what string, action func(), cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			action()
+			time.Sleep(50 * time.Millisecond)
+			if cond() {
+				return
+			}
+		}
+		t.Fatalf("Timeout waiting for %v", what)
+	}
+
+	err := os.WriteFile(
+		filepath.Join(DataDirectory, "config.json"), []byte("{}"), 0o600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	write("watched", `{"max-clients": 1, "presenter": [{}]}`)
+	g, err := Add("watched", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	c := &kickTestClient{
+		notifyTestClient: notifyTestClient{id: "w", group: g},
+		kicked:           make(chan string, 1),
+	}
+	username := "bob"
+	_, err = AddClient("watched", c, ClientCredentials{Username: &username})
+	if err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+	defer DelClient(c)
+
+	done := make(chan struct{})
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- Watch(done)
+	}()
+
+	eventually("modification", func() {
+		write("watched", `{"max-clients": 2, "presenter": [{}]}`)
+	}, func() bool {
+		return g.Description().MaxClients == 2
+	})
+
+	eventually("new subdirectory", func() {
+		write("sub/dir/new", `{"public": true}`)
+	}, func() bool {
+		return Get("sub/dir/new") != nil
+	})
+
+	os.Remove(filepath.Join(Directory, "watched.json"))
+	select {
+	case <-c.kicked:
+	case <-time.After(10 * time.Second):
+		t.Errorf("Client was not kicked from deleted group")
+	}
+
+	close(done)
+	if err := <-watchDone; err != nil {
+		t.Errorf("Watch: %v", err)
+	}
+}
+
+func TestWatchNoDirectory(t *testing.T) {
+	dir := Directory
+	Directory = filepath.Join(t.TempDir(), "nonexistent")
+	defer func() {
+		Directory = dir
+	}()
+
+	if err := Watch(nil); err == nil {
+		t.Errorf("Watch succeeded on nonexistent directory")
+	}
+}
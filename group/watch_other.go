@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package group
+
+import (
+	"errors"
+)
+
+// Watch is not implemented on this platform; groups are only updated
+// periodically.
+func Watch(done <-chan struct{}) error {
+	return errors.New("watching the groups directory is not supported on this platform")
+}
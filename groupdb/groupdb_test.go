@@ -0,0 +1,202 @@
+package groupdb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/jech/galene/group"
+)
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url, kind, dsn string
+	}{
+		{"sqlite:/var/lib/galene/groups.db", "sqlite", "/var/lib/galene/groups.db"},
+		{"sqlite:groups.db", "sqlite", "groups.db"},
+		{"sqlite:///var/lib/galene/groups.db", "sqlite", "/var/lib/galene/groups.db"},
+		{"postgres://galene:pw@db.example.org/galene",
+			"postgres", "postgres://galene:pw@db.example.org/galene"},
+	}
+	for _, test := range tests {
+		kind, dsn, err := parseURL(test.url)
+		if err != nil || kind != test.kind || dsn != test.dsn {
+			t.Errorf("%v: got %v %v %v", test.url, kind, dsn, err)
+		}
+	}
+
+	for _, u := range []string{"sqlite:", "mysql://localhost/galene", ":"} {
+		_, _, err := parseURL(u)
+		if err == nil {
+			t.Errorf("%v: accepted", u)
+		}
+	}
+}
+
+func openTest(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open("sqlite:" + filepath.Join(t.TempDir(), "groups.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+func TestPutGet(t *testing.T) {
+	db := openTest(t)
+
+	_, _, err := db.Get("test")
+	if !os.IsNotExist(err) {
+		t.Errorf("Get: got %v", err)
+	}
+
+	def := `{
+		"max-clients": 10,
+		"op": [{"username": "jch", "password": "pw"}],
+		"presenter": [
+			{"username": "bob", "password": {"type": "bcrypt",
+			 "key": "$2a$10$xxx"}},
+			{}
+		]
+	}`
+	created, err := db.Put("test", []byte(def))
+	if err != nil || !created {
+		t.Fatalf("Put: %v %v", created, err)
+	}
+
+	data, version, err := db.Get("test")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	var expected, got interface{}
+	json.Unmarshal([]byte(def), &expected)
+	json.Unmarshal(data, &got)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got %v, expected %v", string(data), def)
+	}
+
+	v, err := db.Version("test")
+	if err != nil || v != version {
+		t.Errorf("Version: got %v %v, expected %v", v, err, version)
+	}
+
+	created, err = db.Put("test", []byte(`{"max-clients": 10}`))
+	if err != nil || created {
+		t.Errorf("Put: %v %v", created, err)
+	}
+	data, v, err = db.Get("test")
+	if err != nil || string(data) != `{"max-clients":10}` || v == version {
+		t.Errorf("Get: %v %v %v", string(data), v, err)
+	}
+
+	names, err := db.Names()
+	if err != nil || !reflect.DeepEqual(names, []string{"test"}) {
+		t.Errorf("Names: got %v %v", names, err)
+	}
+
+	err = db.Delete("test")
+	if err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	err = db.Delete("test")
+	if !os.IsNotExist(err) {
+		t.Errorf("Delete twice: got %v", err)
+	}
+	names, err = db.Names()
+	if err != nil || len(names) != 0 {
+		t.Errorf("Names: got %v %v", names, err)
+	}
+}
+
+// Users added directly to the database are merged into the definition.
+func TestRelational(t *testing.T) {
+	sqldb, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "groups.db"))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	db, err := New(sqldb)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Put("test", []byte(`{"public": true}`))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	_, version, err := db.Get("test")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	_, err = sqldb.Exec(
+		"INSERT INTO galene_users " +
+			"(group_name, role, position, username, password) " +
+			"VALUES ('test', 'op', 0, 'jch', '\"pw\"'), " +
+			"('test', 'other', 0, '', NULL)",
+	)
+	if err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	data, v, err := db.Get("test")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if v == version {
+		t.Errorf("Version didn't change")
+	}
+	expected := `{"op":[{"username":"jch","password":"pw"}],` +
+		`"other":[{}],"public":true}`
+	if string(data) != expected {
+		t.Errorf("Got %v, expected %v", string(data), expected)
+	}
+}
+
+func TestGroupStore(t *testing.T) {
+	db := openTest(t)
+	group.Store = db
+	defer func() {
+		group.Store = nil
+	}()
+
+	created, err := group.WriteDescription("db/test", &group.Description{
+		AllowSubgroups: true,
+		Op: []group.ClientPattern{{
+			Username: "jch",
+			Password: &group.Password{Key: "pw"},
+		}},
+	})
+	if err != nil || !created {
+		t.Fatalf("WriteDescription: %v %v", created, err)
+	}
+
+	desc, err := group.GetDescription("db/test/sub")
+	if err != nil {
+		t.Fatalf("GetDescription: %v", err)
+	}
+	if len(desc.Op) != 1 || desc.Op[0].Username != "jch" {
+		t.Errorf("Got %v", desc.Op)
+	}
+	_, err = group.OwnDescription("db/test/sub")
+	if !os.IsNotExist(err) {
+		t.Errorf("OwnDescription: got %v", err)
+	}
+
+	err = group.DeleteDescription("db/test")
+	if err != nil {
+		t.Errorf("DeleteDescription: %v", err)
+	}
+	_, err = group.GetDescription("db/test")
+	if !os.IsNotExist(err) {
+		t.Errorf("GetDescription: got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// link the PostgreSQL driver used by the group database
+import _ "github.com/lib/pq"
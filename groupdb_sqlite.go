@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// link the SQLite driver used by the group database
+import _ "modernc.org/sqlite"
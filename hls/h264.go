@@ -0,0 +1,25 @@
+package hls
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errTruncated = errors.New("truncated data")
+
+// splitAVC splits a sample in AVC format (four-byte lengths) into NAL units.
+func splitAVC(data []byte) ([][]byte, error) {
+	var nalus [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errTruncated
+		}
+		l := binary.BigEndian.Uint32(data)
+		if uint64(l) > uint64(len(data)-4) {
+			return nil, errTruncated
+		}
+		nalus = append(nalus, data[4:4+l])
+		data = data[4+l:]
+	}
+	return nalus, nil
+}
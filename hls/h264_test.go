@@ -0,0 +1,82 @@
+package hls
+
+import (
+	"bytes"
+	"testing"
+
+	gcodecs "github.com/jech/galene/codecs"
+)
+
+// bitWriter is used to build test parameter sets.
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) bit(b uint32) {
+	if w.n%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	if b != 0 {
+		w.data[len(w.data)-1] |= 0x80 >> (w.n % 8)
+	}
+	w.n++
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	l := 0
+	for (v >> l) > 1 {
+		l++
+	}
+	for i := 0; i < l; i++ {
+		w.bit(0)
+	}
+	for i := l; i >= 0; i-- {
+		w.bit((v >> i) & 1)
+	}
+}
+
+func makeSPS(profile uint8, widthMbs, heightMbs uint32, crop []uint32) []byte {
+	w := &bitWriter{}
+	w.ue(0) // seq_parameter_set_id
+	if gcodecs.HasChromaInfo(profile) {
+		w.ue(1) // chroma_format_idc
+		w.ue(0)
+		w.ue(0)
+		w.bit(0)
+		w.bit(0) // seq_scaling_matrix_present_flag
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(2) // pic_order_cnt_type
+	w.ue(1) // max_num_ref_frames
+	w.bit(0)
+	w.ue(widthMbs - 1)
+	w.ue(heightMbs - 1)
+	w.bit(1) // frame_mbs_only_flag
+	w.bit(1) // direct_8x8_inference_flag
+	if crop != nil {
+		w.bit(1)
+		for _, c := range crop {
+			w.ue(c)
+		}
+	} else {
+		w.bit(0)
+	}
+	w.bit(0) // vui_parameters_present_flag
+	w.bit(1) // rbsp_stop_one_bit
+	return append([]byte{0x67, profile, 0xe0, 0x1f}, w.data...)
+}
+
+func TestSplitAVC(t *testing.T) {
+	nalus, err := splitAVC([]byte{0, 0, 0, 1, 9, 0, 0, 0, 2, 0x65, 1})
+	if err != nil || len(nalus) != 2 ||
+		!bytes.Equal(nalus[0], []byte{9}) ||
+		!bytes.Equal(nalus[1], []byte{0x65, 1}) {
+		t.Errorf("Got %v %v", nalus, err)
+	}
+	_, err = splitAVC([]byte{0, 0, 0, 3, 1})
+	if err == nil {
+		t.Errorf("Split truncated data")
+	}
+}
@@ -0,0 +1,747 @@
+// Package hls implements low-latency HLS output of a group.  An HLS client
+// is a system client that subscribes to the group's streams, selects
+// the active speaker (or the designated presenter), and packages their
+// media into CMAF segments.
+package hls
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+
+	"github.com/jech/samplebuilder"
+
+	"github.com/jech/galene/bmff"
+	gcodecs "github.com/jech/galene/codecs"
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/rtptime"
+)
+
+var logger = logging.New("hls")
+
+const (
+	audioMaxLate = 32
+	videoMaxLate = 256
+	// the HLS client is stopped when nobody has fetched anything for
+	// this long
+	idleTimeout = 30 * time.Second
+)
+
+// UnavailableError is returned when HLS cannot be provided for a group.
+type UnavailableError string
+
+func (err UnavailableError) Error() string {
+	return string(err)
+}
+
+var clients struct {
+	mu      sync.Mutex
+	clients map[string]*Client
+}
+
+// Client is a group client that produces an HLS stream.
+type Client struct {
+	group  *group.Group
+	id     string
+	start  time.Time
+	stream *stream
+	done   chan struct{}
+
+	mu          sync.Mutex
+	closed      bool
+	presenter   string
+	conns       map[string]*hlsConn
+	selector    speakerSelector
+	current     *hlsConn
+	next        *hlsConn
+	unavailable string
+	lastAccess  time.Time
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Get returns the HLS client of a group, starting it if necessary.
+func Get(g *group.Group) (*Client, error) {
+	desc := g.Description()
+	if desc.HLS == nil {
+		return nil, ErrNotFound
+	}
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	c := clients.clients[g.Name()]
+	if c != nil && c.group == g && !c.isClosed() {
+		c.touch()
+		return c, nil
+	}
+
+	if g.MemoryExceeded() {
+		return nil, group.ErrMemoryExceeded
+	}
+
+	c = &Client{
+		group:      g,
+		id:         newId(),
+		start:      time.Now(),
+		done:       make(chan struct{}),
+		presenter:  desc.HLS.Presenter,
+		conns:      make(map[string]*hlsConn),
+		lastAccess: time.Now(),
+	}
+	c.stream = newStream(g.Memory(group.MemoryRecording).Add)
+	_, err := group.AddClient(g.Name(), c,
+		group.ClientCredentials{System: true},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if clients.clients == nil {
+		clients.clients = make(map[string]*Client)
+	}
+	clients.clients[g.Name()] = c
+	c.mu.Lock()
+	c.update()
+	c.mu.Unlock()
+	for _, cc := range g.GetClients(c) {
+		cc.RequestConns(c, g, "")
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *Client) Group() *group.Group {
+	return c.group
+}
+
+func (c *Client) Id() string {
+	return c.id
+}
+
+func (c *Client) Username() string {
+	return "HLS"
+}
+
+func (c *Client) SetUsername(string) {
+	return
+}
+
+func (c *Client) SetPermissions(perms []string) {
+	return
+}
+
+func (c *Client) Permissions() []string {
+	return []string{"system"}
+}
+
+func (c *Client) Data() map[string]interface{} {
+	return nil
+}
+
+func (c *Client) PushClient(group, kind, id, username string, perms []string, data map[string]interface{}) error {
+	return nil
+}
+
+func (c *Client) RequestConns(target group.Client, g *group.Group, id string) error {
+	return nil
+}
+
+func (c *Client) Joined(group, kind string) error {
+	return nil
+}
+
+func (c *Client) Kick(id string, user *string, message string) error {
+	return c.Close()
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Client) touch() {
+	c.mu.Lock()
+	c.lastAccess = time.Now()
+	c.mu.Unlock()
+}
+
+// Close stops the HLS client and removes it from its group.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conns := c.conns
+	c.conns = nil
+	c.current = nil
+	c.next = nil
+	c.mu.Unlock()
+
+	for _, hc := range conns {
+		hc.close()
+	}
+	c.stream.close()
+	group.DelClient(c)
+
+	clients.mu.Lock()
+	if clients.clients[c.group.Name()] == c {
+		delete(clients.clients, c.group.Name())
+	}
+	clients.mu.Unlock()
+	return nil
+}
+
+// run requests keyframes at regular intervals, and stops the client when
+// it is no longer used.
+func (c *Client) run() {
+	ticker := time.NewTicker(segmentTarget)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		desc := c.group.Description()
+		c.mu.Lock()
+		idle := time.Since(c.lastAccess) > idleTimeout
+		changed := desc.HLS == nil || desc.HLS.Presenter != c.presenter
+		var tracks []conn.UpTrack
+		for _, hc := range []*hlsConn{c.current, c.next} {
+			if hc != nil && hc.video != nil {
+				tracks = append(tracks, hc.video.remote)
+			}
+		}
+		c.mu.Unlock()
+
+		if idle || changed {
+			c.Close()
+			return
+		}
+		for _, t := range tracks {
+			t.RequestKeyframe()
+		}
+	}
+}
+
+func (c *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
+	if c.group != g {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New("HLS client is closed")
+	}
+
+	if replace != "" {
+		c.delConn(replace)
+	}
+	c.delConn(id)
+
+	if up != nil {
+		hc := newHlsConn(c, up, tracks)
+		c.conns[id] = hc
+		hc.open()
+	}
+
+	c.update()
+	return nil
+}
+
+// called locked
+func (c *Client) delConn(id string) {
+	hc := c.conns[id]
+	if hc == nil {
+		return
+	}
+	delete(c.conns, id)
+	c.selector.remove(id)
+	if c.current == hc {
+		c.current = nil
+	}
+	if c.next == hc {
+		c.next = nil
+	}
+	hc.close()
+}
+
+// candidate returns true if hc may be selected.  Called locked.
+func (c *Client) candidate(hc *hlsConn) bool {
+	if hc.incompatible != "" {
+		return false
+	}
+	if c.presenter == "" || hc.username == c.presenter {
+		return true
+	}
+	// fall back to the active speaker if the presenter isn't there
+	for _, hc2 := range c.conns {
+		if hc2.incompatible == "" && hc2.username == c.presenter {
+			return false
+		}
+	}
+	return true
+}
+
+// update selects a stream if none is selected, and recomputes the
+// availability of the group.  Called locked.
+func (c *Client) update() {
+	if c.current == nil && c.next == nil ||
+		c.current != nil && !c.candidate(c.current) && c.next == nil {
+		for _, hc := range c.conns {
+			if c.candidate(hc) {
+				c.switchTo(hc)
+				break
+			}
+		}
+	}
+
+	unavailable := ""
+	if !usesH264(c.group.Description().Codecs) {
+		unavailable = "this group doesn't use H.264"
+	} else if len(c.conns) > 0 {
+		var reasons []string
+		for _, hc := range c.conns {
+			if hc.incompatible == "" {
+				reasons = nil
+				break
+			}
+			reasons = append(reasons, hc.incompatible)
+		}
+		if len(reasons) > 0 {
+			unavailable = "no stream is compatible with HLS (" +
+				strings.Join(reasons, ", ") + ")"
+		}
+	}
+	if unavailable != c.unavailable {
+		if unavailable != "" {
+			logger.Warnf("HLS %v: %v", c.group.Name(), unavailable)
+		}
+		c.unavailable = unavailable
+	}
+}
+
+func usesH264(names []string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, "h264") {
+			return true
+		}
+	}
+	return false
+}
+
+// switchTo arranges for hc to become the current stream at its next
+// keyframe.  Called locked.
+func (c *Client) switchTo(hc *hlsConn) {
+	if c.next != nil && c.next != c.current {
+		c.next.deactivate()
+	}
+	if hc == c.current {
+		c.next = nil
+		return
+	}
+	c.next = hc
+	hc.activate()
+	if hc.video == nil {
+		c.startEpoch(nil)
+	} else {
+		hc.video.remote.RequestKeyframe()
+	}
+}
+
+// startEpoch makes c.next the current stream.  Called locked.
+func (c *Client) startEpoch(video *videoConfig) {
+	if c.current != nil && c.current != c.next {
+		c.current.deactivate()
+	}
+	c.current = c.next
+	c.next = nil
+	c.current.originLocal = time.Time{}
+	c.current.originRemote = time.Time{}
+	for _, t := range c.current.tracks() {
+		t.started = false
+		t.pending = nil
+	}
+	c.stream.newEpoch(video, c.current.audio != nil)
+}
+
+type hlsConn struct {
+	client   *Client
+	up       conn.Up
+	username string
+	// the reason why we cannot use this stream, if any
+	incompatible string
+	audio        *hlsTrack
+	video        *hlsTrack
+
+	// the local and remote times of the first sample of the epoch
+	originLocal  time.Time
+	originRemote time.Time
+}
+
+func newHlsConn(c *Client, up conn.Up, remoteTracks []conn.UpTrack) *hlsConn {
+	_, username := up.User()
+	hc := &hlsConn{client: c, up: up, username: username}
+	for _, remote := range remoteTracks {
+		codec := remote.Codec().MimeType
+		if strings.EqualFold(codec, "audio/opus") {
+			if hc.audio == nil {
+				hc.audio = &hlsTrack{conn: hc, remote: remote}
+			}
+		} else if strings.EqualFold(codec, "video/h264") {
+			if hc.video == nil || hc.video.remote.Label() == "l" {
+				hc.video = &hlsTrack{
+					conn: hc, remote: remote, video: true,
+				}
+			}
+		} else {
+			hc.incompatible = codec
+		}
+	}
+	if hc.incompatible == "" && hc.audio == nil && hc.video == nil {
+		hc.incompatible = "no tracks"
+	}
+	return hc
+}
+
+func (hc *hlsConn) tracks() []*hlsTrack {
+	var tracks []*hlsTrack
+	if hc.audio != nil {
+		tracks = append(tracks, hc.audio)
+	}
+	if hc.video != nil {
+		tracks = append(tracks, hc.video)
+	}
+	return tracks
+}
+
+// open subscribes to the tracks of hc.  We need the audio tracks of all
+// streams in order to determine the active speaker.
+func (hc *hlsConn) open() {
+	if hc.incompatible != "" {
+		return
+	}
+	for _, t := range hc.tracks() {
+		err := t.remote.AddLocal(t)
+		if err != nil {
+			logger.Warnf("HLS: %v", err)
+		}
+	}
+}
+
+func (hc *hlsConn) close() {
+	for _, t := range hc.tracks() {
+		t.remote.DelLocal(t)
+	}
+}
+
+// activate starts depacketising the media of hc.  Called locked.
+func (hc *hlsConn) activate() {
+	if hc.audio != nil && hc.audio.builder == nil {
+		hc.audio.builder = samplebuilder.New(
+			audioMaxLate, &codecs.OpusPacket{}, 48000,
+		)
+	}
+	if hc.video != nil && hc.video.builder == nil {
+		hc.video.builder = samplebuilder.New(
+			videoMaxLate, &codecs.H264Packet{IsAVC: true}, 90000,
+		)
+	}
+}
+
+// called locked
+func (hc *hlsConn) deactivate() {
+	for _, t := range hc.tracks() {
+		t.builder = nil
+		t.pending = nil
+	}
+}
+
+type hlsTrack struct {
+	conn   *hlsConn
+	remote conn.UpTrack
+	video  bool
+
+	builder    *samplebuilder.SampleBuilder
+	timestamps rtptime.TimestampExtender
+	sps, pps   []byte
+	badSPS     []byte
+	config     *videoConfig
+	pending    *bmff.Sample
+
+	// mapping from RTP time to decode time
+	started bool
+	origin  int64
+	base    int64
+
+	// AddLocal calls SetTimeOffset with the up track locked, so this
+	// is protected by its own mutex.
+	mu        sync.Mutex
+	remoteNTP uint64
+	remoteRTP uint32
+}
+
+func (t *hlsTrack) clockrate() uint32 {
+	if t.video {
+		return 90000
+	}
+	return 48000
+}
+
+func (t *hlsTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remoteNTP = ntp
+	t.remoteRTP = rtp
+}
+
+func (t *hlsTrack) SetCname(string) {
+}
+
+func (t *hlsTrack) GetMaxBitrate() (uint64, int, int) {
+	return ^uint64(0), -1, -1
+}
+
+func (t *hlsTrack) Write(buf []byte) (int, error) {
+	c := t.conn.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, nil
+	}
+
+	if t.builder == nil && t.video {
+		return len(buf), nil
+	}
+
+	// samplebuilder retains packets
+	data := make([]byte, len(buf))
+	copy(data, buf)
+	p := new(rtp.Packet)
+	err := p.Unmarshal(data)
+	if err != nil {
+		return 0, nil
+	}
+
+	now := time.Now()
+	if !t.video && c.candidate(t.conn) {
+		id := c.selector.update(t.conn.up.Id(), len(p.Payload), now)
+		hc := c.conns[id]
+		if hc != nil && hc != c.current && hc != c.next {
+			c.switchTo(hc)
+		}
+	}
+
+	if t.builder == nil {
+		return len(buf), nil
+	}
+
+	t.builder.Push(p)
+	for {
+		smp, ts := t.builder.PopWithTimestamp()
+		if smp == nil {
+			break
+		}
+		t.gotSample(smp.Data, ts, now)
+	}
+	return len(buf), nil
+}
+
+// gotSample processes a sample in AVC format or an Opus packet.
+// Called locked.
+func (t *hlsTrack) gotSample(data []byte, ts uint32, now time.Time) {
+	c := t.conn.client
+	keyframe := true
+	if t.video {
+		nalus, err := splitAVC(data)
+		if err != nil {
+			return
+		}
+		keyframe = false
+		var buf bytes.Buffer
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch nalu[0] & 0x1F {
+			case 5:
+				keyframe = true
+			case 7:
+				t.sps = append([]byte(nil), nalu...)
+				continue
+			case 8:
+				t.pps = append([]byte(nil), nalu...)
+				continue
+			case 9:
+				continue
+			}
+			buf.Write(bmff.U32(uint32(len(nalu))))
+			buf.Write(nalu)
+		}
+		data = buf.Bytes()
+
+		if keyframe && (t.config == nil ||
+			!bytes.Equal(t.sps, t.config.sps) ||
+			!bytes.Equal(t.pps, t.config.pps)) {
+			t.config = nil
+			if t.sps != nil && t.pps != nil {
+				info, err := gcodecs.ParseSPS(t.sps)
+				if err != nil {
+					if !bytes.Equal(t.sps, t.badSPS) {
+						logger.Warnf("HLS: %v", err)
+						t.badSPS = t.sps
+					}
+					return
+				}
+				t.config = &videoConfig{
+					sps: t.sps, pps: t.pps, info: info,
+				}
+			}
+			if t.config != nil && t.conn == c.current {
+				// parameters changed, abort any pending switch
+				if c.next != nil {
+					c.next.deactivate()
+				}
+				c.next = c.current
+				c.startEpoch(t.config)
+			}
+		}
+		if keyframe && t.config != nil && t.conn == c.next {
+			c.startEpoch(t.config)
+		}
+	}
+
+	if t.conn != c.current || len(data) == 0 {
+		return
+	}
+
+	clockrate := t.clockrate()
+	ext := t.timestamps.Extend(ts)
+	if !t.started {
+		t.start(ext, now)
+	}
+	dts := t.base + ext - t.origin
+	if dts < 0 {
+		return
+	}
+
+	if t.pending != nil {
+		d := dts - t.pending.DTS
+		if d <= 0 {
+			return
+		}
+		if d > int64(clockrate) {
+			d = int64(clockrate)
+		}
+		t.pending.Duration = uint32(d)
+		c.stream.writeSample(t.video, *t.pending)
+	}
+	t.pending = &bmff.Sample{
+		Data:     append([]byte(nil), data...),
+		DTS:      dts,
+		Keyframe: keyframe,
+	}
+}
+
+// start maps the extended timestamp ext, received at local time now, to
+// a decode time, using sender reports if possible.  Called locked.
+func (t *hlsTrack) start(ext int64, now time.Time) {
+	clockrate := t.clockrate()
+	hc := t.conn
+	t.mu.Lock()
+	remoteNTP, remoteRTP := t.remoteNTP, t.remoteRTP
+	t.mu.Unlock()
+	var remote time.Time
+	if remoteNTP != 0 {
+		remote = rtptime.NTPToTime(remoteNTP).Add(rtptime.ToDuration(
+			ext-rtptime.ExtendTimestamp(ext, remoteRTP), clockrate,
+		))
+	}
+
+	local := now
+	if hc.originLocal.IsZero() {
+		hc.originLocal = now
+		hc.originRemote = remote
+	} else if !hc.originRemote.IsZero() && !remote.IsZero() {
+		local = hc.originLocal.Add(remote.Sub(hc.originRemote))
+	}
+
+	t.started = true
+	t.origin = ext
+	t.base = rtptime.FromDuration(local.Sub(t.conn.client.start), clockrate)
+}
+
+// Playlist returns the media playlist.  If msn is not negative, it
+// blocks until part p of segment msn is available, or until segment msn
+// is complete if p is negative.
+func (c *Client) Playlist(ctx context.Context, query string, msn int64, p int) ([]byte, error) {
+	c.touch()
+
+	c.mu.Lock()
+	unavailable := c.unavailable
+	c.mu.Unlock()
+
+	if msn < 0 {
+		msn, p = 0, 0
+		if !c.stream.empty() {
+			return c.stream.playlist(query)
+		}
+		if unavailable != "" {
+			return nil, UnavailableError(unavailable)
+		}
+	}
+
+	err := c.stream.wait(ctx, uint64(msn), p)
+	if err != nil {
+		if err == ErrBadRequest {
+			return nil, err
+		}
+		if unavailable == "" {
+			unavailable = "no media is available"
+		}
+		return nil, UnavailableError(unavailable)
+	}
+	return c.stream.playlist(query)
+}
+
+// Init returns the initialisation segment for a given epoch.
+func (c *Client) Init(epoch uint64) ([]byte, error) {
+	c.touch()
+	return c.stream.getInit(epoch)
+}
+
+// Media returns a segment, or a part of a segment if p is not negative.
+// When requesting a part that is not available yet, it blocks until the
+// part is produced.
+func (c *Client) Media(ctx context.Context, msn uint64, p int) ([]byte, error) {
+	c.touch()
+	if p >= 0 {
+		err := c.stream.wait(ctx, msn, p)
+		if err != nil {
+			return nil, ErrNotFound
+		}
+	}
+	return c.stream.getMedia(msn, p)
+}
@@ -0,0 +1,49 @@
+package hls
+
+import (
+	"github.com/jech/galene/bmff"
+	gcodecs "github.com/jech/galene/codecs"
+)
+
+// This file produces CMAF fragmented MP4: an initialisation segment and
+// a sequence of fragments.
+
+const (
+	videoTrackId = 1
+	audioTrackId = 2
+)
+
+// videoConfig describes the video track of an initialisation segment.
+type videoConfig struct {
+	sps, pps []byte
+	info     *gcodecs.SPSInfo
+}
+
+// initSegment returns an initialisation segment with a video track if
+// video is not nil, and an audio track if audio is true.
+func initSegment(video *videoConfig, audio bool) []byte {
+	ftyp := bmff.Box("ftyp",
+		[]byte("iso6"), bmff.U32(0),
+		[]byte("iso6"), []byte("cmfc"), []byte("mp41"),
+	)
+
+	moov := [][]byte{bmff.MovieHeader(audioTrackId + 1)}
+	var trex [][]byte
+	if video != nil {
+		moov = append(moov, bmff.Track(videoTrackId, 90000, false,
+			video.info.Width, video.info.Height,
+			bmff.AVC1(video.info.Width, video.info.Height,
+				video.sps, video.pps, video.info),
+		))
+		trex = append(trex, bmff.TrackExtends(videoTrackId))
+	}
+	if audio {
+		moov = append(moov, bmff.Track(audioTrackId, 48000, true,
+			0, 0, bmff.Opus(2),
+		))
+		trex = append(trex, bmff.TrackExtends(audioTrackId))
+	}
+	moov = append(moov, bmff.Box("mvex", trex...))
+
+	return append(ftyp, bmff.Box("moov", moov...)...)
+}
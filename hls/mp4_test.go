@@ -0,0 +1,84 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	gcodecs "github.com/jech/galene/codecs"
+)
+
+var containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true,
+	"dinf": true, "stbl": true, "mvex": true, "moof": true,
+	"traf": true,
+}
+
+// walk calls f for every box in data, with the path of the box, its
+// offset and its contents.
+func walk(t *testing.T, data []byte, prefix string, offset int, f func(string, int, []byte)) {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("%v: truncated box header", prefix)
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("%v: bad box size %v", prefix, size)
+		}
+		typ := string(data[4:8])
+		path := prefix + "/" + typ
+		f(path, offset, data[8:size])
+		if containers[typ] {
+			walk(t, data[8:size], path, offset+8, f)
+		}
+		data = data[size:]
+		offset += size
+	}
+}
+
+func boxes(t *testing.T, data []byte) map[string][][]byte {
+	m := make(map[string][][]byte)
+	walk(t, data, "", 0, func(path string, offset int, contents []byte) {
+		m[path] = append(m[path], contents)
+	})
+	return m
+}
+
+func TestInitSegment(t *testing.T) {
+	sps := makeSPS(66, 80, 45, nil)
+	info, err := gcodecs.ParseSPS(sps)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	video := &videoConfig{sps: sps, pps: []byte{0x68, 1}, info: info}
+	m := boxes(t, initSegment(video, true))
+
+	for _, p := range []string{
+		"/ftyp", "/moov/mvhd", "/moov/mvex/trex",
+		"/moov/trak/tkhd", "/moov/trak/mdia/mdhd",
+		"/moov/trak/mdia/minf/stbl/stsd",
+	} {
+		if len(m[p]) == 0 {
+			t.Errorf("Missing box %v", p)
+		}
+	}
+	if len(m["/moov/trak"]) != 2 || len(m["/moov/mvex/trex"]) != 2 {
+		t.Errorf("Expected two tracks")
+	}
+	stsd := m["/moov/trak/mdia/minf/stbl/stsd"]
+	if !bytes.Contains(stsd[0], []byte("avc1")) ||
+		!bytes.Contains(stsd[0], sps) ||
+		!bytes.Contains(stsd[1], []byte("dOps")) {
+		t.Errorf("Bad sample descriptions")
+	}
+	tkhd := m["/moov/trak/tkhd"][0]
+	if binary.BigEndian.Uint32(tkhd[76:]) != 1280<<16 ||
+		binary.BigEndian.Uint32(tkhd[80:]) != 720<<16 {
+		t.Errorf("Bad dimensions")
+	}
+
+	m = boxes(t, initSegment(nil, true))
+	if len(m["/moov/trak"]) != 1 {
+		t.Errorf("Expected a single track")
+	}
+}
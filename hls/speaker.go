@@ -0,0 +1,60 @@
+package hls
+
+import (
+	"time"
+)
+
+// A speakerSelector chooses the active speaker.  Since we don't decode
+// audio, the level of a stream is estimated from the size of its Opus
+// packets, which is fairly reliable when the sender uses DTX or VBR.
+// Switching is expensive (it causes a discontinuity), so we use some
+// hysteresis and a minimum dwell time.
+type speakerSelector struct {
+	levels   map[string]*speakerLevel
+	current  string
+	switched time.Time
+}
+
+type speakerLevel struct {
+	level float64
+	last  time.Time
+}
+
+const (
+	speakerTimeout  = 2 * time.Second
+	speakerMinDwell = 3 * time.Second
+)
+
+// update records the size of a packet of the given stream, and returns
+// the currently selected stream.
+func (s *speakerSelector) update(id string, size int, now time.Time) string {
+	if s.levels == nil {
+		s.levels = make(map[string]*speakerLevel)
+	}
+	l := s.levels[id]
+	if l == nil {
+		l = &speakerLevel{}
+		s.levels[id] = l
+	}
+	l.level = 0.95*l.level + 0.05*float64(size)
+	l.last = now
+
+	cur := s.levels[s.current]
+	if cur == nil || now.Sub(cur.last) > speakerTimeout {
+		s.current = id
+		s.switched = now
+	} else if id != s.current && l.level > 1.5*cur.level &&
+		now.Sub(s.switched) > speakerMinDwell {
+		s.current = id
+		s.switched = now
+	}
+	return s.current
+}
+
+// remove forgets about a stream.
+func (s *speakerSelector) remove(id string) {
+	delete(s.levels, id)
+	if s.current == id {
+		s.current = ""
+	}
+}
@@ -0,0 +1,51 @@
+package hls
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpeakerSelector(t *testing.T) {
+	var s speakerSelector
+	now := time.Now()
+
+	// the first stream is selected
+	if id := s.update("a", 10, now); id != "a" {
+		t.Errorf("Expected a, got %v", id)
+	}
+
+	// a louder stream is selected after the dwell time
+	var id string
+	for i := 0; i < 500; i++ {
+		now = now.Add(10 * time.Millisecond)
+		s.update("a", 10, now)
+		id = s.update("b", 100, now)
+		if i < 200 && id != "a" {
+			t.Fatalf("Switched too early, at %v", i)
+		}
+	}
+	if id != "b" {
+		t.Errorf("Expected b, got %v", id)
+	}
+
+	// a similar level doesn't cause a switch
+	for i := 0; i < 500; i++ {
+		now = now.Add(10 * time.Millisecond)
+		s.update("b", 100, now)
+		id = s.update("a", 120, now)
+	}
+	if id != "b" {
+		t.Errorf("Expected b, got %v", id)
+	}
+
+	// a stream that stops sending is replaced
+	now = now.Add(3 * time.Second)
+	if id := s.update("a", 10, now); id != "a" {
+		t.Errorf("Expected a after timeout, got %v", id)
+	}
+
+	s.remove("a")
+	if id := s.update("b", 10, now); id != "b" {
+		t.Errorf("Expected b after remove, got %v", id)
+	}
+}
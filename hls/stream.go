@@ -0,0 +1,436 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/bmff"
+)
+
+const (
+	// the target duration of a segment, we request keyframes at this
+	// interval
+	segmentTarget = 2 * time.Second
+	// segments are cut at the first keyframe after this
+	segmentMin = 1500 * time.Millisecond
+	// segments are cut without a keyframe if they grow beyond this
+	segmentMax = 3500 * time.Millisecond
+	// the value of EXT-X-TARGETDURATION, in seconds
+	targetDuration = 4
+	// the duration at which we cut a part
+	partMin = 500 * time.Millisecond
+	// the value of PART-TARGET; parts can exceed partMin by one frame
+	partTarget = 600 * time.Millisecond
+	// the number of complete segments in the playlist
+	windowSize = 6
+	// the maximum number of audio samples in a part
+	maxPendingSamples = 256
+)
+
+var ErrNotFound = errors.New("not found")
+var ErrBadRequest = errors.New("bad request")
+
+// A part is an LL-HLS partial segment, a single CMAF chunk.
+type part struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+type segment struct {
+	msn           uint64
+	epoch         uint64
+	discontinuity bool
+	parts         []*part
+	duration      time.Duration
+	done          bool
+}
+
+// A stream is a sequence of segments and parts, together with the
+// playlist that describes them.
+type stream struct {
+	// called with the number of bytes retained by the stream
+	account func(delta int64)
+
+	mu      sync.Mutex
+	changed chan struct{}
+	// the current epoch, which changes at each discontinuity
+	epoch    uint64
+	inits    map[uint64][]byte
+	segments []*segment
+	// the number of discontinuities that have left the window
+	discontinuitySeq uint64
+	fragmentSeq      uint32
+
+	// the tracks of the current epoch
+	video, audio bool
+	// the part being built
+	runs [2]bmff.Run
+	// the duration of the part, in units of the master track's clock
+	partTicks   int64
+	independent bool
+	// the next sample will start a new segment
+	cut bool
+}
+
+func newStream(account func(int64)) *stream {
+	return &stream{
+		account: account,
+		changed: make(chan struct{}),
+		inits:   make(map[uint64][]byte),
+		runs:    [2]bmff.Run{{ID: videoTrackId}, {ID: audioTrackId}},
+	}
+}
+
+// called locked
+func (s *stream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *stream) last() *segment {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+// newEpoch starts a new epoch, a sequence of segments that share the
+// same initialisation segment.
+func (s *stream) newEpoch(video *videoConfig, audio bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.partTicks > 0 {
+		s.flushPart()
+	}
+	// drop any audio samples that follow the last video frame
+	for i := range s.runs {
+		s.runs[i].Samples = nil
+	}
+	s.epoch++
+	init := initSegment(video, audio)
+	s.inits[s.epoch] = init
+	s.account(int64(len(init)))
+	s.video = video != nil
+	s.audio = audio
+	s.cut = true
+}
+
+// called locked
+func (s *stream) startSegment() {
+	var msn uint64
+	discontinuity := false
+	if last := s.last(); last != nil {
+		if len(last.parts) == 0 {
+			// nothing was ever written to the last segment
+			s.segments = s.segments[:len(s.segments)-1]
+			msn = last.msn
+			discontinuity = last.discontinuity
+		} else {
+			last.done = true
+			msn = last.msn + 1
+		}
+		discontinuity = discontinuity || last.epoch != s.epoch
+	}
+
+	s.segments = append(s.segments, &segment{
+		msn:           msn,
+		epoch:         s.epoch,
+		discontinuity: discontinuity,
+	})
+
+	for len(s.segments) > windowSize+1 {
+		seg := s.segments[0]
+		s.segments = s.segments[1:]
+		if s.segments[0].discontinuity {
+			s.discontinuitySeq++
+		}
+		for _, p := range seg.parts {
+			s.account(-int64(len(p.data)))
+		}
+	}
+	for epoch, init := range s.inits {
+		if epoch < s.segments[0].epoch {
+			delete(s.inits, epoch)
+			s.account(-int64(len(init)))
+		}
+	}
+}
+
+// called locked
+func (s *stream) partDuration() time.Duration {
+	clock := int64(90000)
+	if !s.video {
+		clock = 48000
+	}
+	return time.Duration(s.partTicks) * time.Second /
+		time.Duration(clock)
+}
+
+// called locked
+func (s *stream) flushPart() {
+	var runs []*bmff.Run
+	for i := range s.runs {
+		if len(s.runs[i].Samples) > 0 {
+			runs = append(runs, &s.runs[i])
+		}
+	}
+	if len(runs) == 0 {
+		return
+	}
+	s.fragmentSeq++
+	p := &part{
+		data:        bmff.Fragment(s.fragmentSeq, runs),
+		duration:    s.partDuration(),
+		independent: s.independent,
+	}
+	s.account(int64(len(p.data)))
+	seg := s.last()
+	seg.parts = append(seg.parts, p)
+	seg.duration += p.duration
+	for i := range s.runs {
+		s.runs[i].Samples = nil
+	}
+	s.partTicks = 0
+	s.notify()
+}
+
+// writeSample adds a sample to the stream.  Video samples have
+// a timescale of 90kHz, audio samples of 48kHz.
+func (s *stream) writeSample(video bool, smp bmff.Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if video && !s.video || !video && !s.audio {
+		return
+	}
+
+	if s.cut && s.video && !(video && smp.Keyframe) {
+		// video segments start with a keyframe
+		return
+	}
+
+	// the track that drives the segmentation
+	master := video || !s.video
+	seg := s.last()
+
+	var duration time.Duration
+	if seg != nil {
+		duration = seg.duration + s.partDuration()
+	}
+	if s.cut || (master && smp.Keyframe && duration >= segmentMin) ||
+		duration >= segmentMax {
+		// samples of the other track that precede the first
+		// sample of the master track go into the new segment
+		if s.partTicks > 0 {
+			s.flushPart()
+		}
+		s.startSegment()
+		s.cut = false
+	}
+
+	i := 1
+	if video {
+		i = 0
+	}
+	if master && len(s.runs[i].Samples) == 0 {
+		s.independent = smp.Keyframe
+	}
+	if !master && len(s.runs[i].Samples) >= maxPendingSamples {
+		// the video has stalled
+		return
+	}
+	s.runs[i].Samples = append(s.runs[i].Samples, smp)
+	if master {
+		s.partTicks += int64(smp.Duration)
+		if s.partDuration() >= partMin {
+			s.flushPart()
+		}
+	}
+}
+
+// close releases the memory retained by the stream.
+func (s *stream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segments {
+		for _, p := range seg.parts {
+			s.account(-int64(len(p.data)))
+		}
+	}
+	for _, init := range s.inits {
+		s.account(-int64(len(init)))
+	}
+	s.segments = nil
+	s.inits = make(map[uint64][]byte)
+}
+
+// has returns true if part p of segment msn is available, or, if p is
+// negative, if the whole segment is.  Called locked.
+func (s *stream) has(msn uint64, p int) bool {
+	last := s.last()
+	if last == nil || msn > last.msn {
+		return false
+	}
+	if msn < last.msn {
+		return true
+	}
+	if p < 0 {
+		return last.done
+	}
+	return p < len(last.parts)
+}
+
+// wait waits until part p of segment msn is available.
+func (s *stream) wait(ctx context.Context, msn uint64, p int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*targetDuration*time.Second)
+	defer cancel()
+
+	s.mu.Lock()
+	for {
+		last := s.last()
+		if last != nil && msn > last.msn+2 {
+			s.mu.Unlock()
+			return ErrBadRequest
+		}
+		if s.has(msn, p) {
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.mu.Lock()
+	}
+}
+
+func (s *stream) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) == 0
+}
+
+// called locked
+func (s *stream) getSegment(msn uint64) *segment {
+	if len(s.segments) == 0 || msn < s.segments[0].msn {
+		return nil
+	}
+	i := msn - s.segments[0].msn
+	if i >= uint64(len(s.segments)) {
+		return nil
+	}
+	return s.segments[i]
+}
+
+// getInit returns the initialisation segment of a given epoch.
+func (s *stream) getInit(epoch uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	init := s.inits[epoch]
+	if init == nil {
+		return nil, ErrNotFound
+	}
+	return init, nil
+}
+
+// getMedia returns a complete segment, or a part if p is not negative.
+func (s *stream) getMedia(msn uint64, p int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg := s.getSegment(msn)
+	if seg == nil {
+		return nil, ErrNotFound
+	}
+	if p >= 0 {
+		if p >= len(seg.parts) {
+			return nil, ErrNotFound
+		}
+		return seg.parts[p].data, nil
+	}
+	if !seg.done {
+		return nil, ErrNotFound
+	}
+	var buf bytes.Buffer
+	for _, p := range seg.parts {
+		buf.Write(p.data)
+	}
+	return buf.Bytes(), nil
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// playlist returns the media playlist.  The query, if not empty, is
+// appended to all URIs.
+func (s *stream) playlist(query string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if query != "" {
+		query = "?" + query
+	}
+
+	first := 0
+	for first < len(s.segments) && len(s.segments[first].parts) == 0 {
+		first++
+	}
+	if first >= len(s.segments) {
+		return nil, ErrNotFound
+	}
+	segments := s.segments[first:]
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%v\n", targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,"+
+		"PART-HOLD-BACK=%v\n", seconds(3*partTarget))
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%v\n",
+		seconds(partTarget))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%v\n", segments[0].msn)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%v\n",
+		s.discontinuitySeq)
+
+	for i, seg := range segments {
+		if i > 0 && seg.discontinuity {
+			fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY\n")
+		}
+		if i == 0 || seg.epoch != segments[i-1].epoch {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%v.mp4%v\"\n",
+				seg.epoch, query)
+		}
+		for j, p := range seg.parts {
+			independent := ""
+			if p.independent {
+				independent = ",INDEPENDENT=YES"
+			}
+			fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%v,"+
+				"URI=\"part-%v.%v.m4s%v\"%v\n",
+				seconds(p.duration), seg.msn, j, query,
+				independent)
+		}
+		if seg.done {
+			fmt.Fprintf(&b, "#EXTINF:%v,\nseg-%v.m4s%v\n",
+				seconds(seg.duration), seg.msn, query)
+		}
+	}
+
+	last := segments[len(segments)-1]
+	msn, p := last.msn, len(last.parts)
+	if last.done {
+		msn, p = msn+1, 0
+	}
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,"+
+		"URI=\"part-%v.%v.m4s%v\"\n", msn, p, query)
+	return b.Bytes(), nil
+}
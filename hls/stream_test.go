@@ -0,0 +1,187 @@
+package hls
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/bmff"
+	gcodecs "github.com/jech/galene/codecs"
+)
+
+func testVideoConfig(t *testing.T) *videoConfig {
+	sps := makeSPS(66, 40, 30, nil)
+	info, err := gcodecs.ParseSPS(sps)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return &videoConfig{sps: sps, pps: []byte{0x68, 1}, info: info}
+}
+
+// feed writes duration worth of 30fps video and 20ms audio, starting at
+// time start, with a keyframe every kf.
+func feed(s *stream, start, duration, kf time.Duration) {
+	for tm := start; tm < start+duration; tm += 10 * time.Millisecond {
+		if tm%(20*time.Millisecond) == 0 {
+			s.writeSample(false, bmff.Sample{
+				Data:     []byte{1},
+				DTS:      int64(tm * 48000 / time.Second),
+				Duration: 960,
+				Keyframe: true,
+			})
+		}
+		if tm%(100*time.Millisecond/3) < 10*time.Millisecond {
+			s.writeSample(true, bmff.Sample{
+				Data:     []byte{2},
+				DTS:      int64(tm * 90000 / time.Second),
+				Duration: 3000,
+				Keyframe: tm%kf < 10*time.Millisecond,
+			})
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	var memory int64
+	s := newStream(func(delta int64) { memory += delta })
+
+	_, err := s.playlist("")
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	s.newEpoch(testVideoConfig(t), true)
+	feed(s, 0, 7*time.Second, 2*time.Second)
+
+	if len(s.segments) != 4 {
+		t.Fatalf("Expected 4 segments, got %v", len(s.segments))
+	}
+	for _, seg := range s.segments[:3] {
+		d := seg.duration - 2*time.Second
+		if !seg.done || d < -time.Millisecond || d > time.Millisecond ||
+			len(seg.parts) != 4 {
+			t.Errorf("Bad segment %v %v %v",
+				seg.done, seg.duration, len(seg.parts))
+		}
+		for i, p := range seg.parts {
+			if p.independent != (i == 0) {
+				t.Errorf("Part %v: independent is %v",
+					i, p.independent)
+			}
+			if p.duration > partTarget {
+				t.Errorf("Part too long: %v", p.duration)
+			}
+		}
+	}
+
+	pl, err := s.playlist("token=x")
+	if err != nil {
+		t.Fatalf("Playlist: %v", err)
+	}
+	playlist := string(pl)
+	for _, l := range []string{
+		"#EXT-X-TARGETDURATION:4\n",
+		"#EXT-X-PART-INF:PART-TARGET=0.600\n",
+		"#EXT-X-MEDIA-SEQUENCE:0\n",
+		"#EXT-X-MAP:URI=\"init-1.mp4?token=x\"\n",
+		"#EXT-X-PART:DURATION=0.500,URI=\"part-1.0.m4s?token=x\"," +
+			"INDEPENDENT=YES\n",
+		"#EXT-X-PART:DURATION=0.500,URI=\"part-1.1.m4s?token=x\"\n",
+		"#EXTINF:2.000,\nseg-2.m4s?token=x\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-3.2.m4s?token=x\"\n",
+	} {
+		if !strings.Contains(playlist, l) {
+			t.Errorf("Missing %q in playlist", l)
+		}
+	}
+	if strings.Contains(playlist, "DISCONTINUITY\n") {
+		t.Errorf("Unexpected discontinuity")
+	}
+
+	seg, err := s.getMedia(1, -1)
+	if err != nil || len(seg) == 0 {
+		t.Errorf("Segment: %v", err)
+	}
+	_, err = s.getMedia(3, -1)
+	if err != ErrNotFound {
+		t.Errorf("Incomplete segment: %v", err)
+	}
+	_, err = s.getMedia(3, 1)
+	if err != nil {
+		t.Errorf("Part: %v", err)
+	}
+
+	// a new speaker, with no video
+	s.newEpoch(nil, true)
+	feed(s, 7*time.Second, 3*time.Second, 2*time.Second)
+	pl, _ = s.playlist("")
+	playlist = string(pl)
+	if !strings.Contains(playlist,
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init-2.mp4\"\n") {
+		t.Errorf("Missing discontinuity in %v", playlist)
+	}
+	_, err = s.getInit(2)
+	if err != nil {
+		t.Errorf("Init: %v", err)
+	}
+
+	// slide the discontinuity out of the window
+	feed(s, 10*time.Second, 20*time.Second, 2*time.Second)
+	if len(s.segments) != windowSize+1 {
+		t.Errorf("Expected %v segments, got %v",
+			windowSize+1, len(s.segments))
+	}
+	pl, _ = s.playlist("")
+	playlist = string(pl)
+	if !strings.Contains(playlist, "#EXT-X-DISCONTINUITY-SEQUENCE:1\n") ||
+		strings.Contains(playlist, "init-1.mp4") {
+		t.Errorf("Bad playlist %v", playlist)
+	}
+	_, err = s.getInit(1)
+	if err != ErrNotFound {
+		t.Errorf("Expected init-1 to be dropped, got %v", err)
+	}
+
+	s.close()
+	if memory != 0 {
+		t.Errorf("Memory leak: %v", memory)
+	}
+}
+
+func TestStreamWait(t *testing.T) {
+	s := newStream(func(int64) {})
+	s.newEpoch(nil, true)
+
+	done := make(chan error)
+	go func() {
+		done <- s.wait(context.Background(), 0, 1)
+	}()
+	feed(s, 0, 600*time.Millisecond, time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("Wait returned early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	feed(s, 600*time.Millisecond, 600*time.Millisecond, time.Second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Wait didn't return")
+	}
+
+	err := s.wait(context.Background(), 10, 0)
+	if err != ErrBadRequest {
+		t.Errorf("Expected ErrBadRequest, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.wait(ctx, 2, 0)
+	if err == nil {
+		t.Errorf("Wait didn't fail")
+	}
+}
@@ -7,17 +7,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/pion/webrtc/v3"
 
+	"github.com/jech/galene/logging"
 	"github.com/jech/galene/turnserver"
 )
 
+var logger = logging.New("ice")
+
 type timeoutError struct{}
 
 func (e timeoutError) Error() string {
@@ -30,13 +33,24 @@ func (e timeoutError) Timeout() bool {
 
 var errTimeout = timeoutError{}
 
+// Server describes an ICE server.  Lifetime is the lifetime in seconds
+// of the credentials generated for servers of type hmac-sha1.
 type Server struct {
 	URLs           []string    `json:"urls"`
 	Username       string      `json:"username,omitempty"`
 	Credential     interface{} `json:"credential,omitempty"`
 	CredentialType string      `json:"credentialType,omitempty"`
+	Lifetime       int         `json:"lifetime,omitempty"`
 }
 
+// defaultLifetime is the lifetime of hmac-sha1 credentials if none
+// is specified.  Since the ICE configuration is cached for a few minutes,
+// the lifetime may not be smaller than minLifetime.
+const (
+	defaultLifetime = 24 * time.Hour
+	minLifetime     = 10 * time.Minute
+)
+
 func getServer(server Server) (webrtc.ICEServer, error) {
 	s := webrtc.ICEServer{
 		URLs:       server.URLs,
@@ -54,7 +68,15 @@ func getServer(server Server) (webrtc.ICEServer, error) {
 			return webrtc.ICEServer{},
 				errors.New("credential is not a string")
 		}
-		ts := time.Now().Unix() + 86400
+		lifetime := defaultLifetime
+		if server.Lifetime != 0 {
+			lifetime = time.Duration(server.Lifetime) * time.Second
+			if lifetime < minLifetime {
+				return webrtc.ICEServer{},
+					errors.New("lifetime too short")
+			}
+		}
+		ts := time.Now().Add(lifetime).Unix()
 		var username string
 		if server.Username == "" {
 			username = fmt.Sprintf("%d", ts)
@@ -76,8 +98,36 @@ func getServer(server Server) (webrtc.ICEServer, error) {
 	return s, nil
 }
 
+// CheckServer returns an error if a server description is invalid.
+func CheckServer(server Server) error {
+	_, err := getServer(server)
+	return err
+}
+
 var ICEFilename string
-var ICERelayOnly bool
+
+// settings that may be changed at runtime
+var settings struct {
+	mu        sync.Mutex
+	servers   []Server
+	relayOnly bool
+}
+
+// SetServers sets the list of ICE servers.  If servers is nil, the
+// servers are read from ICEFilename.
+func SetServers(servers []Server) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	settings.servers = servers
+}
+
+// SetRelayOnly determines whether clients are required to use a TURN
+// relay.
+func SetRelayOnly(relayOnly bool) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	settings.relayOnly = relayOnly
+}
 
 type configuration struct {
 	conf      webrtc.Configuration
@@ -90,43 +140,50 @@ func Update() *configuration {
 	now := time.Now()
 	var cf webrtc.Configuration
 
+	settings.mu.Lock()
+	servers := settings.servers
+	relayOnly := settings.relayOnly
+	settings.mu.Unlock()
+
 	found := false
-	if ICEFilename != "" {
+	if servers != nil {
+		found = true
+	} else if ICEFilename != "" {
 		found = true
 		file, err := os.Open(ICEFilename)
 		if err != nil {
 			if !os.IsNotExist(err) {
-				log.Printf("Open %v: %v", ICEFilename, err)
+				logger.Warnf("Open %v: %v", ICEFilename, err)
 			} else {
 				found = false
 			}
 		} else {
 			defer file.Close()
 			d := json.NewDecoder(file)
-			var servers []Server
 			err = d.Decode(&servers)
 			if err != nil {
-				log.Printf("Get ICE configuration: %v", err)
-			}
-			for _, s := range servers {
-				ss, err := getServer(s)
-				if err != nil {
-					log.Printf("parse ICE server: %v", err)
-					continue
-				}
-				cf.ICEServers = append(cf.ICEServers, ss)
+				logger.Warnf("Get ICE configuration: %v", err)
 			}
 		}
 	}
 
+	for _, s := range servers {
+		ss, err := getServer(s)
+		if err != nil {
+			logger.Warnf("parse ICE server: %v", err)
+			continue
+		}
+		cf.ICEServers = append(cf.ICEServers, ss)
+	}
+
 	err := turnserver.StartStop(!found)
 	if err != nil {
-		log.Printf("TURN: %v", err)
+		logger.Warnf("TURN: %v", err)
 	}
 
 	cf.ICEServers = append(cf.ICEServers, turnserver.ICEServers()...)
 
-	if ICERelayOnly {
+	if relayOnly {
 		cf.ICETransportPolicy = webrtc.ICETransportPolicyRelay
 	}
 
@@ -138,6 +195,29 @@ func Update() *configuration {
 	return &iceConf
 }
 
+// ServersConfiguration returns an ICE configuration that uses the given
+// servers instead of the server-wide ones.  It honours the relay-only
+// setting, but does not include the built-in TURN server.
+func ServersConfiguration(servers []Server) *webrtc.Configuration {
+	settings.mu.Lock()
+	relayOnly := settings.relayOnly
+	settings.mu.Unlock()
+
+	var cf webrtc.Configuration
+	for _, s := range servers {
+		ss, err := getServer(s)
+		if err != nil {
+			logger.Warnf("parse ICE server: %v", err)
+			continue
+		}
+		cf.ICEServers = append(cf.ICEServers, ss)
+	}
+	if relayOnly {
+		cf.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	return &cf
+}
+
 func ICEConfiguration() *webrtc.Configuration {
 	conf, ok := conf.Load().(*configuration)
 	if !ok || time.Since(conf.timestamp) > 5*time.Minute {
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -94,3 +95,43 @@ func TestRelayTest(t *testing.T) {
 		t.Errorf("Relay test returned %v", err)
 	}
 }
+
+func TestHMACLifetime(t *testing.T) {
+	s := Server{
+		URLs:           []string{"turn:turn.example.org"},
+		Credential:     "secret",
+		CredentialType: "hmac-sha1",
+		Lifetime:       600,
+	}
+
+	ss, err := getServer(s)
+	if err != nil {
+		t.Fatalf("getServer: %v", err)
+	}
+	ts, err := strconv.ParseInt(ss.Username, 10, 64)
+	if err != nil {
+		t.Fatalf("ParseInt: %v", err)
+	}
+	d := ts - time.Now().Unix()
+	if d < 590 || d > 600 {
+		t.Errorf("Expected 600, got %v", d)
+	}
+
+	for _, l := range []int{-1, 60} {
+		s.Lifetime = l
+		if CheckServer(s) == nil {
+			t.Errorf("Lifetime %v accepted", l)
+		}
+	}
+}
+
+func TestServersConfiguration(t *testing.T) {
+	conf := ServersConfiguration([]Server{
+		{URLs: []string{"turn:turn.example.org"}, Credential: "secret"},
+		{URLs: []string{"turn:bad.example.org"}, CredentialType: "bad"},
+	})
+	if len(conf.ICEServers) != 1 ||
+		conf.ICEServers[0].URLs[0] != "turn:turn.example.org" {
+		t.Errorf("Got %v", conf.ICEServers)
+	}
+}
@@ -0,0 +1,231 @@
+// Package ingest sends media received by some other protocol than WebRTC,
+// such as RTMP, SRT or RTSP, to a group.  The media is sent to the server
+// over a local WebRTC connection, so that it goes through the same
+// machinery as media from other clients.
+package ingest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/rtpconn"
+)
+
+var logger = logging.New("ingest")
+
+// the parameters that Galene uses for H.264, see group.codecsFromName
+var h264Capability = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeH264,
+	ClockRate:   90000,
+	SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+}
+
+var opusCapability = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeOpus,
+	ClockRate:   48000,
+	Channels:    2,
+	SDPFmtpLine: "minptime=10;useinbandfec=1",
+}
+
+var api struct {
+	once sync.Once
+	api  *webrtc.API
+	err  error
+}
+
+func getAPI() (*webrtc.API, error) {
+	api.once.Do(func() {
+		var m webrtc.MediaEngine
+		err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: h264Capability,
+			PayloadType:        102,
+		}, webrtc.RTPCodecTypeVideo)
+		if err == nil {
+			err = m.RegisterCodec(webrtc.RTPCodecParameters{
+				RTPCodecCapability: opusCapability,
+				PayloadType:        111,
+			}, webrtc.RTPCodecTypeAudio)
+		}
+		if err != nil {
+			api.err = err
+			return
+		}
+		var i interceptor.Registry
+		err = webrtc.RegisterDefaultInterceptors(&m, &i)
+		if err != nil {
+			api.err = err
+			return
+		}
+		// the connection is local, and may need to go over the
+		// loopback interface
+		var s webrtc.SettingEngine
+		s.SetIncludeLoopbackCandidate(true)
+		s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+		api.api = webrtc.NewAPI(
+			webrtc.WithMediaEngine(&m),
+			webrtc.WithInterceptorRegistry(&i),
+			webrtc.WithSettingEngine(s),
+		)
+	})
+	return api.api, api.err
+}
+
+// A Publisher sends H.264 video and, optionally, Opus audio to the server
+// on behalf of an IngestClient.
+type Publisher struct {
+	pc           *webrtc.PeerConnection
+	video, audio *webrtc.TrackLocalStaticRTP
+	payloader    codecs.H264Payloader
+
+	videoSeqno, audioSeqno uint16
+}
+
+// NewPublisher establishes the local connection for the client c, which
+// must already have joined its group.  If withAudio is false, the
+// connection only carries video.
+func NewPublisher(ctx context.Context, c *rtpconn.IngestClient, withAudio bool) (*Publisher, error) {
+	api, err := getAPI()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	p := &Publisher{pc: pc}
+
+	p.video, err = webrtc.NewTrackLocalStaticRTP(
+		h264Capability, "video", c.Id(),
+	)
+	if err == nil && withAudio {
+		p.audio, err = webrtc.NewTrackLocalStaticRTP(
+			opusCapability, "audio", c.Id(),
+		)
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	tracks := []*webrtc.TrackLocalStaticRTP{p.video}
+	if p.audio != nil {
+		tracks = append(tracks, p.audio)
+	}
+	for _, t := range tracks {
+		sender, err := pc.AddTrack(t)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		// we cannot honour keyframe requests, so just drain RTCP
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				_, _, err := sender.Read(buf)
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	err = pc.SetLocalDescription(offer)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		pc.Close()
+		return nil, ctx.Err()
+	}
+
+	answer, err := c.Connect(ctx, []byte(pc.LocalDescription().SDP))
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	})
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	var a sdp.SessionDescription
+	if a.Unmarshal(answer) == nil {
+		for _, m := range a.MediaDescriptions {
+			if m.MediaName.Port.Value == 0 {
+				logger.Warnf("%v: group %v doesn't accept %v",
+					c.Username(), c.Group().Name(),
+					m.MediaName.Media)
+			}
+		}
+	}
+	return p, nil
+}
+
+// WriteVideo sends an access unit in Annex B format.  The timestamp is
+// in milliseconds.
+func (p *Publisher) WriteVideo(timestamp uint32, data []byte) {
+	payloads := p.payloader.Payload(1200, data)
+	for i, payload := range payloads {
+		p.videoSeqno++
+		p.video.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: p.videoSeqno,
+				Timestamp:      timestamp * 90,
+			},
+			Payload: payload,
+		})
+	}
+}
+
+// WriteVideoRTP sends a video packet that is already packetised.  The
+// packet's sequence number is overwritten, so that packets sent by
+// WriteVideo and WriteVideoRTP may be mixed.
+func (p *Publisher) WriteVideoRTP(packet *rtp.Packet) {
+	p.videoSeqno++
+	packet.SequenceNumber = p.videoSeqno
+	p.video.WriteRTP(packet)
+}
+
+// WriteAudio sends an Opus packet.  The timestamp is in milliseconds.
+// It does nothing if the publisher doesn't carry audio.
+func (p *Publisher) WriteAudio(timestamp uint32, data []byte) {
+	if p.audio == nil {
+		return
+	}
+	p.audioSeqno++
+	p.audio.WriteRTP(&rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: p.audioSeqno,
+			Timestamp:      timestamp * 48,
+		},
+		Payload: data,
+	})
+}
+
+// Close tears down the local connection.
+func (p *Publisher) Close() {
+	p.pc.Close()
+}
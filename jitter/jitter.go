@@ -43,6 +43,12 @@ func (e *Estimator) Accumulate(timestamp uint32) {
 	e.accumulate(timestamp, uint32(rtptime.Now(e.hz)))
 }
 
+// AccumulateAt is like Accumulate, but takes the current time in units
+// of 1/hz seconds.
+func (e *Estimator) AccumulateAt(timestamp, now uint32) {
+	e.accumulate(timestamp, now)
+}
+
 // Jitter returns the estimated jitter, in units of 1/hz seconds.
 // This function is safe to call concurrently.
 func (e *Estimator) Jitter() uint32 {
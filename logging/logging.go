@@ -0,0 +1,293 @@
+// Package logging implements levelled, structured logging.  Each package
+// has its own logger, the verbosity of which may be set independently,
+// and log lines carry key-value pairs, such as the group and the client
+// that they concern.  Lines are written either as text or as JSON.
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Level is the severity of a log line.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "level" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %v", s)
+}
+
+type settings struct {
+	json    bool
+	level   Level
+	modules map[string]Level
+}
+
+var current atomic.Pointer[settings]
+
+var output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func getSettings() *settings {
+	s := current.Load()
+	if s == nil {
+		return &settings{level: LevelInfo}
+	}
+	return s
+}
+
+// ParseLevels parses a verbosity specification, which is a default level
+// optionally followed by per-module levels, for example
+// "warn,rtpconn=debug,webserver=info".
+func ParseLevels(spec string) (Level, map[string]Level, error) {
+	level := LevelInfo
+	var modules map[string]Level
+	for i, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		m, l, found := strings.Cut(f, "=")
+		if !found {
+			if i > 0 {
+				return 0, nil, errors.New(
+					"default level must come first",
+				)
+			}
+			l = m
+		}
+		v, err := ParseLevel(l)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !found {
+			level = v
+			continue
+		}
+		if m == "" {
+			return 0, nil, errors.New("empty module name")
+		}
+		if modules == nil {
+			modules = make(map[string]Level)
+		}
+		modules[m] = v
+	}
+	return level, modules, nil
+}
+
+// SetLevels sets the verbosity, as described in ParseLevels.
+func SetLevels(spec string) error {
+	level, modules, err := ParseLevels(spec)
+	if err != nil {
+		return err
+	}
+	s := *getSettings()
+	s.level = level
+	s.modules = modules
+	current.Store(&s)
+	return nil
+}
+
+// SetFormat sets the format of log lines, either "text" or "json".
+func SetFormat(format string) error {
+	s := *getSettings()
+	switch format {
+	case "text":
+		s.json = false
+	case "json":
+		s.json = true
+	default:
+		return fmt.Errorf("unknown log format %v", format)
+	}
+	current.Store(&s)
+	return nil
+}
+
+// SetOutput sets the destination of log lines.  The default is standard
+// error.
+func SetOutput(w io.Writer) {
+	output.mu.Lock()
+	output.w = w
+	output.mu.Unlock()
+}
+
+// A Logger writes log lines on behalf of a module.
+type Logger struct {
+	module string
+	fields []string
+}
+
+// New returns a logger for the given module.
+func New(module string) *Logger {
+	return &Logger{module: module}
+}
+
+// With returns a logger that adds the given key-value pairs to every log
+// line.  Pairs with an empty value are omitted.
+func (l *Logger) With(kv ...string) *Logger {
+	fields := make([]string, len(l.fields), len(l.fields)+len(kv))
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] != "" {
+			fields = append(fields, kv[i], kv[i+1])
+		}
+	}
+	return &Logger{module: l.module, fields: fields}
+}
+
+// Enabled returns true if lines of the given level are being logged.
+func (l *Logger) Enabled(level Level) bool {
+	s := getSettings()
+	if m, ok := s.modules[l.module]; ok {
+		return level >= m
+	}
+	return level >= s.level
+}
+
+// Debugf logs a line at level debug.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof logs a line at level info.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a line at level warn.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs a line at level error.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+// Fatalf logs at level error and exits.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.write(time.Now(), level, fmt.Sprintf(format, args...))
+}
+
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (l *Logger) format(now time.Time, level Level, msg string, asJSON bool) []byte {
+	var b []byte
+	if asJSON {
+		b = append(b, `{"time":`...)
+		b = appendJSON(b, now.Format(time.RFC3339Nano))
+		b = append(b, `,"level":`...)
+		b = appendJSON(b, level.String())
+		if l.module != "" {
+			b = append(b, `,"module":`...)
+			b = appendJSON(b, l.module)
+		}
+		b = append(b, `,"msg":`...)
+		b = appendJSON(b, msg)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			b = append(b, ',')
+			b = appendJSON(b, l.fields[i])
+			b = append(b, ':')
+			b = appendJSON(b, l.fields[i+1])
+		}
+		b = append(b, "}\n"...)
+		return b
+	}
+
+	b = now.AppendFormat(b, "2006/01/02 15:04:05 ")
+	b = append(b, strings.ToUpper(level.String())...)
+	b = append(b, ' ')
+	if l.module != "" {
+		b = append(b, l.module...)
+		b = append(b, ": "...)
+	}
+	b = append(b, strings.TrimSuffix(msg, "\n")...)
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		b = append(b, ' ')
+		b = append(b, l.fields[i]...)
+		b = append(b, '=')
+		b = append(b, quote(l.fields[i+1])...)
+	}
+	b = append(b, '\n')
+	return b
+}
+
+func appendJSON(b []byte, s string) []byte {
+	v, err := json.Marshal(s)
+	if err != nil {
+		return append(b, `""`...)
+	}
+	return append(b, v...)
+}
+
+func (l *Logger) write(now time.Time, level Level, msg string) {
+	b := l.format(now, level, msg, getSettings().json)
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	w := output.w
+	if w == nil {
+		w = os.Stderr
+	}
+	w.Write(b)
+}
+
+type writer struct {
+	logger *Logger
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	w.logger.logf(LevelInfo, "%s", msg)
+	return len(p), nil
+}
+
+// Writer returns a writer that logs each write as a line of level info.
+// It is meant to be passed to log.SetOutput, so that the messages logged
+// by the standard library and by other packages have the same format.
+func Writer(module string) io.Writer {
+	return writer{New(module)}
+}
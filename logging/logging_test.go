@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevels(t *testing.T) {
+	level, modules, err := ParseLevels("warn,rtpconn=debug, group=error")
+	if err != nil {
+		t.Fatalf("ParseLevels: %v", err)
+	}
+	if level != LevelWarn {
+		t.Errorf("Level: got %v", level)
+	}
+	if len(modules) != 2 ||
+		modules["rtpconn"] != LevelDebug ||
+		modules["group"] != LevelError {
+		t.Errorf("Modules: got %v", modules)
+	}
+
+	level, modules, err = ParseLevels("rtpconn=debug")
+	if err != nil || level != LevelInfo || modules["rtpconn"] != LevelDebug {
+		t.Errorf("ParseLevels: %v %v %v", level, modules, err)
+	}
+
+	for _, spec := range []string{"", "loud", "rtpconn=debug,warn", "=info"} {
+		_, _, err := ParseLevels(spec)
+		if err == nil {
+			t.Errorf("%#v: accepted", spec)
+		}
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	defer SetLevels("info")
+
+	err := SetLevels("warn,rtpconn=debug")
+	if err != nil {
+		t.Fatalf("SetLevels: %v", err)
+	}
+	if New("group").Enabled(LevelInfo) || !New("group").Enabled(LevelWarn) {
+		t.Errorf("Default level not honoured")
+	}
+	if !New("rtpconn").Enabled(LevelDebug) {
+		t.Errorf("Module level not honoured")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	now := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+	l := New("rtpconn").With(
+		"group", "my group", "client", "abc", "conn", "",
+	)
+
+	text := string(l.format(now, LevelWarn, "ICE: failed", false))
+	expected := "2024/03/09 12:00:00 WARN rtpconn: ICE: failed " +
+		"group=\"my group\" client=abc\n"
+	if text != expected {
+		t.Errorf("Got %#v, expected %#v", text, expected)
+	}
+
+	b := l.format(now, LevelWarn, "ICE: \"failed\"", true)
+	var m map[string]string
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		t.Fatalf("Unmarshal %v: %v", string(b), err)
+	}
+	if m["level"] != "warn" || m["module"] != "rtpconn" ||
+		m["msg"] != "ICE: \"failed\"" || m["group"] != "my group" ||
+		m["client"] != "abc" || len(m) != 6 {
+		t.Errorf("Got %v", m)
+	}
+	if !strings.HasPrefix(m["time"], "2024-03-09T12:00:00") {
+		t.Errorf("Time: got %v", m["time"])
+	}
+}
+
+func TestOutput(t *testing.T) {
+	defer SetOutput(nil)
+	defer SetFormat("text")
+	defer SetLevels("info")
+
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetFormat("json")
+	SetLevels("info")
+
+	l := New("test")
+	l.Debugf("hidden")
+	l.Infof("shown %v", 42)
+	Writer("").Write([]byte("from the log package\n"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Got %v", lines)
+	}
+	var m map[string]string
+	json.Unmarshal([]byte(lines[0]), &m)
+	if m["msg"] != "shown 42" || m["level"] != "info" {
+		t.Errorf("Got %v", m)
+	}
+	m = nil
+	json.Unmarshal([]byte(lines[1]), &m)
+	if m["msg"] != "from the log package" {
+		t.Errorf("Got %v", m)
+	}
+	if _, ok := m["module"]; ok {
+		t.Errorf("Got module %v", m["module"])
+	}
+}
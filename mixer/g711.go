@@ -0,0 +1,76 @@
+package mixer
+
+// G.711 codecs, as defined in ITU-T G.711.
+
+func ulawDecode(b byte) int16 {
+	b = ^b
+	t := (int(b&0x0F) << 3) + 0x84
+	t <<= (b & 0x70) >> 4
+	if b&0x80 != 0 {
+		return int16(0x84 - t)
+	}
+	return int16(t - 0x84)
+}
+
+func ulawEncode(v int16) byte {
+	const bias = 0x84
+	const clip = 32635
+	sign := byte(0)
+	s := int(v)
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > clip {
+		s = clip
+	}
+	s += bias
+	exponent := byte(7)
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := byte(s>>(exponent+3)) & 0x0F
+	return ^(sign | exponent<<4 | mantissa)
+}
+
+func alawDecode(b byte) int16 {
+	b ^= 0x55
+	t := int(b&0x0F) << 4
+	seg := (b & 0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if b&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+func alawEncode(v int16) byte {
+	sign := byte(0x80)
+	s := int(v)
+	if s < 0 {
+		s = -s - 1
+		sign = 0
+	}
+	if s > 32767 {
+		s = 32767
+	}
+	var b byte
+	if s < 256 {
+		b = byte(s >> 4)
+	} else {
+		exponent := byte(7)
+		for mask := 0x4000; s&mask == 0; mask >>= 1 {
+			exponent--
+		}
+		b = exponent<<4 | byte(s>>(exponent+3))&0x0F
+	}
+	return (sign | b) ^ 0x55
+}
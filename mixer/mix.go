@@ -0,0 +1,69 @@
+package mixer
+
+import (
+	"sort"
+)
+
+const (
+	// the sample rate of the mix, in Hz
+	SampleRate = 8000
+	// the number of samples in a frame, 20ms
+	frameSamples = 160
+)
+
+// energy returns the energy of a frame.
+func energy(frame []int16) int64 {
+	var e int64
+	for _, v := range frame {
+		e += int64(v) * int64(v)
+	}
+	return e
+}
+
+// mix returns the sum of the k loudest frames.  The gain is reduced
+// immediately whenever the sum would clip, and then recovers slowly
+// towards unity; mix returns the new gain.
+func mix(frames [][]int16, k int, gain float64) ([]int16, float64) {
+	if k > 0 && len(frames) > k {
+		frames = append([][]int16(nil), frames...)
+		sort.SliceStable(frames, func(i, j int) bool {
+			return energy(frames[i]) > energy(frames[j])
+		})
+		frames = frames[:k]
+	}
+
+	var sum [frameSamples]int32
+	for _, f := range frames {
+		for i, v := range f {
+			if i < frameSamples {
+				sum[i] += int32(v)
+			}
+		}
+	}
+
+	peak := int32(0)
+	for _, v := range sum {
+		if v > peak {
+			peak = v
+		} else if -v > peak {
+			peak = -v
+		}
+	}
+	if float64(peak)*gain > 32767 {
+		gain = 32767 / float64(peak)
+	}
+
+	out := make([]int16, frameSamples)
+	for i, v := range sum {
+		s := float64(v) * gain
+		if s > 32767 {
+			s = 32767
+		} else if s < -32768 {
+			s = -32768
+		}
+		out[i] = int16(s)
+	}
+
+	gain += (1 - gain) * 0.05
+	return out, gain
+}
@@ -0,0 +1,444 @@
+// Package mixer implements the G.711 audio mixer used for mixed
+// recordings.  A mixer is a system client that subscribes to the G.711
+// audio tracks of a group, and produces a single stream of PCM frames
+// that is delivered to its consumers, in practice mixed recordings.  It
+// runs only while it has consumers.
+//
+// Since we don't have an Opus codec, tracks in other codecs are ignored.
+package mixer
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+)
+
+var logger = logging.New("mixer")
+
+const (
+	// the number of speakers mixed if the group doesn't say
+	defaultSpeakers = 3
+	// a track is only mixed once it has this many samples buffered
+	prebuffer = 2 * frameSamples
+	// older samples are dropped beyond this
+	maxBuffered = 10 * frameSamples
+)
+
+var ErrNotFound = errors.New("this group doesn't have a mixer")
+
+var clients struct {
+	mu      sync.Mutex
+	clients map[string]*Client
+}
+
+// Stats contains statistics about a mixer.
+type Stats struct {
+	// the number of tracks being mixed
+	Inputs int
+	// the number of tracks that cannot be mixed
+	Unsupported int
+	Consumers   int
+	// the number of packets decoded
+	Decoded uint64
+	// the number of frames mixed
+	Frames uint64
+	// the number of times a track ran out of samples
+	Underruns uint64
+	// the number of samples dropped because a track was too far ahead
+	Overruns uint64
+	// the time spent producing and delivering frames
+	Busy time.Duration
+}
+
+// Client is a group client that mixes the group's audio.
+type Client struct {
+	group    *group.Group
+	id       string
+	speakers int
+	done     chan struct{}
+
+	decoded   uint64
+	underruns uint64
+	overruns  uint64
+
+	mu          sync.Mutex
+	closed      bool
+	down        map[string][]*mixerTrack
+	unsupported map[string]int
+	consumers   map[int]func([]int16)
+	nextId      int
+	gain        float64
+	frames      uint64
+	busy        time.Duration
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Subscribe arranges for f to be called with every frame of the mix of
+// the group's audio, which is 20ms of mono audio at 8kHz.  The mixer is
+// started if necessary.  The function f is called from the mixer's
+// goroutine, and must not block.  Subscribe returns a function that
+// cancels the subscription; the mixer stops after its last consumer
+// has gone.
+func Subscribe(g *group.Group, f func([]int16)) (func(), error) {
+	desc := g.Description()
+	if desc.Mixer == nil {
+		return nil, ErrNotFound
+	}
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	c := clients.clients[g.Name()]
+	id, ok := -1, false
+	if c != nil && c.group == g {
+		id, ok = c.addConsumer(f)
+	}
+	if !ok {
+		speakers := desc.Mixer.Speakers
+		if speakers <= 0 {
+			speakers = defaultSpeakers
+		}
+		c = &Client{
+			group:       g,
+			id:          newId(),
+			speakers:    speakers,
+			done:        make(chan struct{}),
+			down:        make(map[string][]*mixerTrack),
+			unsupported: make(map[string]int),
+			consumers:   make(map[int]func([]int16)),
+			gain:        1,
+		}
+		id, _ = c.addConsumer(f)
+		_, err := group.AddClient(g.Name(), c,
+			group.ClientCredentials{System: true},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if clients.clients == nil {
+			clients.clients = make(map[string]*Client)
+		}
+		clients.clients[g.Name()] = c
+		for _, cc := range g.GetClients(c) {
+			cc.RequestConns(c, g, "")
+		}
+		go c.run()
+	}
+
+	return func() {
+		c.mu.Lock()
+		delete(c.consumers, id)
+		empty := len(c.consumers) == 0
+		c.mu.Unlock()
+		if empty {
+			c.Close()
+		}
+	}, nil
+}
+
+// GetStats returns statistics about the mixer of a group, or nil if it
+// is not running.
+func GetStats(g *group.Group) *Stats {
+	clients.mu.Lock()
+	c := clients.clients[g.Name()]
+	clients.mu.Unlock()
+	if c == nil || c.group != g {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	s := &Stats{
+		Consumers: len(c.consumers),
+		Decoded:   atomic.LoadUint64(&c.decoded),
+		Frames:    c.frames,
+		Underruns: atomic.LoadUint64(&c.underruns),
+		Overruns:  atomic.LoadUint64(&c.overruns),
+		Busy:      c.busy,
+	}
+	for _, tracks := range c.down {
+		s.Inputs += len(tracks)
+	}
+	for _, n := range c.unsupported {
+		s.Unsupported += n
+	}
+	return s
+}
+
+func (c *Client) Group() *group.Group {
+	return c.group
+}
+
+func (c *Client) Id() string {
+	return c.id
+}
+
+func (c *Client) Username() string {
+	return "MIXER"
+}
+
+func (c *Client) SetUsername(string) {
+	return
+}
+
+func (c *Client) SetPermissions(perms []string) {
+	return
+}
+
+func (c *Client) Permissions() []string {
+	return []string{"system"}
+}
+
+func (c *Client) Data() map[string]interface{} {
+	return nil
+}
+
+func (c *Client) PushClient(group, kind, id, username string, perms []string, data map[string]interface{}) error {
+	return nil
+}
+
+func (c *Client) RequestConns(target group.Client, g *group.Group, id string) error {
+	return nil
+}
+
+func (c *Client) Joined(group, kind string) error {
+	return nil
+}
+
+func (c *Client) Kick(id string, user *string, message string) error {
+	return c.Close()
+}
+
+// addConsumer returns false if the mixer is closed.
+func (c *Client) addConsumer(f func([]int16)) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return -1, false
+	}
+	id := c.nextId
+	c.nextId++
+	c.consumers[id] = f
+	return id, true
+}
+
+// Close stops the mixer and removes it from its group.  Any remaining
+// consumers stop receiving frames.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	down := c.down
+	c.down = nil
+	c.consumers = nil
+	c.mu.Unlock()
+
+	for _, tracks := range down {
+		for _, t := range tracks {
+			t.remote.DelLocal(t)
+		}
+	}
+	group.DelClient(c)
+
+	clients.mu.Lock()
+	if clients.clients[c.group.Name()] == c {
+		delete(clients.clients, c.group.Name())
+	}
+	clients.mu.Unlock()
+	return nil
+}
+
+func (c *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
+	if c.group != g {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New("mixer is closed")
+	}
+
+	for _, i := range []string{replace, id} {
+		if i == "" {
+			continue
+		}
+		for _, t := range c.down[i] {
+			t.remote.DelLocal(t)
+		}
+		delete(c.down, i)
+		delete(c.unsupported, i)
+	}
+
+	if up == nil {
+		return nil
+	}
+
+	var mts []*mixerTrack
+	for _, t := range tracks {
+		if t.Kind() != webrtc.RTPCodecTypeAudio {
+			continue
+		}
+		var decode func(byte) int16
+		codec := t.Codec().MimeType
+		if strings.EqualFold(codec, webrtc.MimeTypePCMU) {
+			decode = ulawDecode
+		} else if strings.EqualFold(codec, webrtc.MimeTypePCMA) {
+			decode = alawDecode
+		} else {
+			c.unsupported[id]++
+			logger.Warnf("Mixer %v: cannot mix %v", g.Name(), codec)
+			continue
+		}
+		mts = append(mts, &mixerTrack{
+			client: c,
+			remote: t,
+			decode: decode,
+		})
+	}
+	for _, t := range mts {
+		err := t.remote.AddLocal(t)
+		if err != nil {
+			logger.Warnf("Mixer: %v", err)
+		}
+	}
+	if len(mts) > 0 {
+		c.down[id] = mts
+	}
+	return nil
+}
+
+// run produces a frame every 20ms.
+func (c *Client) run() {
+	ticker := time.NewTicker(frameSamples * time.Second / SampleRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		c.mu.Lock()
+		var tracks []*mixerTrack
+		for _, ts := range c.down {
+			tracks = append(tracks, ts...)
+		}
+		speakers := c.speakers
+		gain := c.gain
+		c.mu.Unlock()
+
+		var frames [][]int16
+		for _, t := range tracks {
+			f := t.frame()
+			if f != nil {
+				frames = append(frames, f)
+			}
+		}
+		out, gain := mix(frames, speakers, gain)
+
+		c.mu.Lock()
+		c.gain = gain
+		c.frames++
+		consumers := make([]func([]int16), 0, len(c.consumers))
+		for _, f := range c.consumers {
+			consumers = append(consumers, f)
+		}
+		c.mu.Unlock()
+
+		for _, f := range consumers {
+			f(out)
+		}
+
+		c.mu.Lock()
+		c.busy += time.Since(start)
+		c.mu.Unlock()
+	}
+}
+
+type mixerTrack struct {
+	client *Client
+	remote conn.UpTrack
+	decode func(byte) int16
+
+	mu      sync.Mutex
+	samples []int16
+	started bool
+}
+
+func (t *mixerTrack) Write(buf []byte) (int, error) {
+	var p rtp.Packet
+	err := p.Unmarshal(buf)
+	if err != nil {
+		return 0, nil
+	}
+	atomic.AddUint64(&t.client.decoded, 1)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range p.Payload {
+		t.samples = append(t.samples, t.decode(b))
+	}
+	if len(t.samples) > maxBuffered {
+		n := len(t.samples) - maxBuffered
+		atomic.AddUint64(&t.client.overruns, uint64(n))
+		t.samples = append(t.samples[:0], t.samples[n:]...)
+	}
+	return len(buf), nil
+}
+
+// frame returns the next frame of a track, or nil if there isn't one.
+func (t *mixerTrack) frame() []int16 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.started {
+		if len(t.samples) < prebuffer {
+			return nil
+		}
+		t.started = true
+	}
+	if len(t.samples) < frameSamples {
+		atomic.AddUint64(&t.client.underruns, 1)
+		t.started = false
+		return nil
+	}
+	f := make([]int16, frameSamples)
+	copy(f, t.samples)
+	t.samples = append(t.samples[:0], t.samples[frameSamples:]...)
+	return f
+}
+
+func (t *mixerTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+}
+
+func (t *mixerTrack) SetCname(string) {
+}
+
+func (t *mixerTrack) GetMaxBitrate() (uint64, int, int) {
+	return ^uint64(0), -1, -1
+}
@@ -0,0 +1,116 @@
+package mixer
+
+import (
+	"testing"
+)
+
+func TestG711(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		b := byte(i)
+		v := ulawDecode(b)
+		if w := ulawDecode(ulawEncode(v)); w != v {
+			t.Errorf("ulaw %02x: %v, re-encoded %v", b, v, w)
+		}
+		v = alawDecode(b)
+		if w := alawDecode(alawEncode(v)); w != v {
+			t.Errorf("alaw %02x: %v, re-encoded %v", b, v, w)
+		}
+	}
+
+	for _, v := range []int16{0, 100, -100, 1000, -1000, 32767, -32768} {
+		for _, c := range []struct {
+			name   string
+			encode func(int16) byte
+			decode func(byte) int16
+		}{
+			{"ulaw", ulawEncode, ulawDecode},
+			{"alaw", alawEncode, alawDecode},
+		} {
+			w := c.decode(c.encode(v))
+			d := int(w) - int(v)
+			if d < 0 {
+				d = -d
+			}
+			a := int(v)
+			if a < 0 {
+				a = -a
+			}
+			if d > 16+a/16 {
+				t.Errorf("%v %v: got %v", c.name, v, w)
+			}
+		}
+	}
+}
+
+func constant(v int16) []int16 {
+	f := make([]int16, frameSamples)
+	for i := range f {
+		f[i] = v
+	}
+	return f
+}
+
+func TestMix(t *testing.T) {
+	out, gain := mix([][]int16{constant(100), constant(200)}, 3, 1)
+	if out[0] != 300 || out[frameSamples-1] != 300 {
+		t.Errorf("Expected 300, got %v", out[0])
+	}
+	if gain != 1 {
+		t.Errorf("Expected gain 1, got %v", gain)
+	}
+
+	out, _ = mix(nil, 3, 1)
+	if len(out) != frameSamples || out[0] != 0 {
+		t.Errorf("Expected silence, got %v", out[0])
+	}
+}
+
+func TestMixLoudest(t *testing.T) {
+	frames := [][]int16{
+		constant(1), constant(1000), constant(10), constant(100),
+	}
+	out, _ := mix(frames, 2, 1)
+	if out[0] != 1100 {
+		t.Errorf("Expected 1100, got %v", out[0])
+	}
+	if frames[0][0] != 1 || frames[1][0] != 1000 {
+		t.Errorf("Input was modified")
+	}
+}
+
+func TestMixClipping(t *testing.T) {
+	frames := [][]int16{constant(30000), constant(30000)}
+	out, gain := mix(frames, 3, 1)
+	if out[0] != 32767 {
+		t.Errorf("Expected 32767, got %v", out[0])
+	}
+	if gain >= 1 {
+		t.Errorf("Gain was not reduced: %v", gain)
+	}
+	g := gain
+	for i := 0; i < 100; i++ {
+		_, g = mix([][]int16{constant(100)}, 3, g)
+	}
+	if g < 0.99 {
+		t.Errorf("Gain didn't recover: %v", g)
+	}
+}
+
+func TestTrackFrame(t *testing.T) {
+	c := &Client{}
+	mt := &mixerTrack{client: c, decode: ulawDecode}
+	mt.samples = make([]int16, frameSamples)
+	if mt.frame() != nil {
+		t.Errorf("Got frame before prebuffering")
+	}
+	mt.samples = make([]int16, prebuffer+frameSamples/2)
+	if mt.frame() == nil || mt.frame() == nil {
+		t.Errorf("Didn't get frames")
+	}
+	if mt.frame() != nil {
+		t.Errorf("Got frame on underrun")
+	}
+	if c.underruns != 1 {
+		t.Errorf("Expected 1 underrun, got %v", c.underruns)
+	}
+}
@@ -0,0 +1,395 @@
+// Package notify sends notifications of group events to webhooks and
+// Matrix rooms.  Notifications are delivered asynchronously, one
+// destination at a time, and events that cannot be delivered are
+// appended to a dead-letter file.
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+)
+
+var logger = logging.New("notify")
+
+const (
+	// the number of events queued for each destination
+	queueLength = 1024
+	// the number of delivery attempts for each event
+	maxAttempts = 5
+	// events sent to Matrix are dropped beyond this rate
+	burst    = 10
+	interval = 6 * time.Second
+	// a destination's worker exits after this
+	idleTimeout = time.Minute
+)
+
+// the delay before the first retry, doubled at each attempt
+var initialBackoff = time.Second
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// Event is the JSON representation of an event.
+type Event struct {
+	Type     string    `json:"type"`
+	Group    string    `json:"group"`
+	Username string    `json:"username,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// A destination is a webhook or a Matrix room, together with the queue
+// of events that are waiting to be sent to it.
+type destination struct {
+	config group.Notification
+	queue  chan Event
+
+	// the token bucket, protected by destinations.mu
+	tokens float64
+	last   time.Time
+}
+
+var destinations struct {
+	mu           sync.Mutex
+	destinations map[string]*destination
+}
+
+// NewEvent returns the JSON representation of a group event.
+func NewEvent(e group.Event) Event {
+	return Event{
+		Type:     e.Kind,
+		Group:    e.Group,
+		Username: e.Username,
+		Target:   e.Target,
+		Client:   e.Client,
+		Message:  e.Message,
+		Time:     e.Time,
+	}
+}
+
+// Notify queues an event for all of the destinations of a group that
+// want it.  It never blocks.
+func Notify(desc *group.Description, e group.Event) {
+	ev := NewEvent(e)
+
+	destinations.mu.Lock()
+	defer destinations.mu.Unlock()
+
+	for _, n := range desc.Notifications {
+		if !n.Wants(e.Kind) {
+			continue
+		}
+		key := n.Type + " " + n.URL + " " + n.Room
+		d := destinations.destinations[key]
+		if d == nil || d.config.Secret != n.Secret ||
+			d.config.AccessToken != n.AccessToken {
+			if d != nil {
+				// the configuration changed, let the old
+				// worker drain its queue
+				close(d.queue)
+			}
+			d = &destination{
+				config: n,
+				queue:  make(chan Event, queueLength),
+				tokens: burst,
+				last:   e.Time,
+			}
+			if destinations.destinations == nil {
+				destinations.destinations =
+					make(map[string]*destination)
+			}
+			destinations.destinations[key] = d
+			go d.run(key)
+		}
+
+		// webhooks are meant for programs, which can cope with
+		// bursts of events
+		if n.Type == "matrix" && !d.take(e.Time) {
+			go deadLetter(n, ev, errors.New("rate limit exceeded"))
+			continue
+		}
+		select {
+		case d.queue <- ev:
+		default:
+			go deadLetter(n, ev, errors.New("queue full"))
+		}
+	}
+}
+
+// take returns true if the rate limit allows sending an event.  Called
+// with destinations.mu held.
+func (d *destination) take(now time.Time) bool {
+	d.tokens += float64(now.Sub(d.last)) / float64(interval)
+	if d.tokens > burst {
+		d.tokens = burst
+	}
+	d.last = now
+	if d.tokens < 1 {
+		return false
+	}
+	d.tokens--
+	return true
+}
+
+func (d *destination) run(key string) {
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case e, ok := <-d.queue:
+			if !ok {
+				return
+			}
+			err := d.deliver(e)
+			if err != nil {
+				deadLetter(d.config, e, err)
+			}
+			timer.Reset(idleTimeout)
+		case <-timer.C:
+			destinations.mu.Lock()
+			if len(d.queue) > 0 {
+				destinations.mu.Unlock()
+				timer.Reset(idleTimeout)
+				continue
+			}
+			if destinations.destinations[key] == d {
+				delete(destinations.destinations, key)
+			}
+			destinations.mu.Unlock()
+			return
+		}
+	}
+}
+
+// permanentError is returned for errors that are not worth
+// retrying.
+type permanentError struct {
+	err error
+}
+
+func (err permanentError) Error() string {
+	return err.err.Error()
+}
+
+func (err permanentError) Unwrap() error {
+	return err.err
+}
+
+// deliver sends an event, retrying with exponential backoff.
+func (d *destination) deliver(e Event) error {
+	var send func() error
+	switch d.config.Type {
+	case "webhook":
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		send = func() error {
+			return sendWebhook(d.config, e.Type, body)
+		}
+	case "matrix":
+		// the transaction id makes retries idempotent
+		b := make([]byte, 8)
+		crand.Read(b)
+		txn := hex.EncodeToString(b)
+		text := describe(e)
+		send = func() error {
+			return sendMatrix(d.config, txn, text)
+		}
+	default:
+		return errors.New("unknown notification type")
+	}
+
+	backoff := initialBackoff
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = send()
+		if err == nil {
+			return nil
+		}
+		var perr permanentError
+		if errors.As(err, &perr) {
+			break
+		}
+	}
+	return err
+}
+
+func checkResponse(resp *http.Response) error {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := errors.New("server replied " + resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusTooManyRequests &&
+		resp.StatusCode != http.StatusRequestTimeout {
+		return permanentError{err}
+	}
+	return err
+}
+
+// Signature returns the value of the X-Galene-Signature header of
+// a webhook request.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func sendWebhook(n group.Notification, kind string, body []byte) error {
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Galene-Event", kind)
+	if n.Secret != "" {
+		req.Header.Set("X-Galene-Signature", Signature(n.Secret, body))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
+
+func sendMatrix(n group.Notification, txn, text string) error {
+	body, err := json.Marshal(map[string]string{
+		"msgtype": "m.notice",
+		"body":    text,
+	})
+	if err != nil {
+		return permanentError{err}
+	}
+	u := strings.TrimSuffix(n.URL, "/") +
+		"/_matrix/client/v3/rooms/" + url.PathEscape(n.Room) +
+		"/send/m.room.message/" + txn
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+n.AccessToken)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
+
+// describe returns a human-readable description of an event.
+func describe(e Event) string {
+	user := e.Username
+	if user == "" {
+		user = "(anonymous)"
+	}
+	var s string
+	switch e.Type {
+	case "join":
+		s = fmt.Sprintf("%v joined empty group %v", user, e.Group)
+	case "empty":
+		s = fmt.Sprintf("group %v is now empty", e.Group)
+	case "record":
+		s = fmt.Sprintf("%v started recording group %v", user, e.Group)
+	case "unrecord":
+		s = fmt.Sprintf("%v stopped recording group %v", user, e.Group)
+	case "lock":
+		s = fmt.Sprintf("group %v was locked", e.Group)
+	case "unlock":
+		s = fmt.Sprintf("group %v was unlocked", e.Group)
+	case "error":
+		s = fmt.Sprintf("error in group %v", e.Group)
+	case "recordings":
+		s = fmt.Sprintf("recordings of group %v", e.Group)
+	case "create":
+		s = fmt.Sprintf("group %v was created", e.Group)
+	case "user-join":
+		s = fmt.Sprintf("%v joined group %v", user, e.Group)
+	case "user-leave":
+		s = fmt.Sprintf("%v left group %v", user, e.Group)
+	case "op", "unop", "present", "unpresent", "kick", "mute":
+		target := e.Target
+		if target == "" {
+			target = "(anonymous)"
+		}
+		formats := map[string]string{
+			"op":        "%v made %v an operator",
+			"unop":      "%v removed %v from the operators",
+			"present":   "%v allowed %v to present",
+			"unpresent": "%v disallowed %v from presenting",
+			"kick":      "%v kicked %v",
+			"mute":      "%v muted %v",
+		}
+		s = fmt.Sprintf(formats[e.Type], user, target) +
+			" in group " + e.Group
+	case "clearchat":
+		s = fmt.Sprintf("%v cleared the chat of group %v", user, e.Group)
+	default:
+		s = fmt.Sprintf("%v in group %v", e.Type, e.Group)
+	}
+	if e.Message != "" {
+		s = s + ": " + e.Message
+	}
+	return s
+}
+
+var deadLetters sync.Mutex
+
+// deadLetter logs an event that couldn't be delivered, and appends it
+// to the file undelivered.jsonl in the data directory.
+func deadLetter(n group.Notification, e Event, reason error) {
+	logger.Warnf("Couldn't deliver %v notification for group %v to %v: %v",
+		e.Type, e.Group, n.URL, reason)
+
+	b, err := json.Marshal(struct {
+		Event
+		Destination string `json:"destination"`
+		Error       string `json:"error"`
+	}{e, n.URL, reason.Error()})
+	if err != nil {
+		logger.Warnf("Notification dead letter: %v", err)
+		return
+	}
+
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	f, err := os.OpenFile(
+		filepath.Join(group.DataDirectory, "undelivered.jsonl"),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600,
+	)
+	if err != nil {
+		logger.Warnf("Notification dead letter: %v", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		logger.Warnf("Notification dead letter: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+// Workers outlive the tests, so these are set just once.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "galene-notify-test")
+	if err != nil {
+		panic(err)
+	}
+	group.DataDirectory = dir
+	initialBackoff = time.Millisecond
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func event(kind string) group.Event {
+	return group.Event{
+		Kind:     kind,
+		Group:    "test",
+		Username: "bob",
+		Time:     time.Now(),
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	done := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			attempts++
+			n := attempts
+			mu.Unlock()
+			if n < 3 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			sig := r.Header.Get("X-Galene-Signature")
+			if sig != Signature("secret", body) {
+				t.Errorf("Bad signature %v", sig)
+			}
+			if k := r.Header.Get("X-Galene-Event"); k != "join" {
+				t.Errorf("Bad event header %v", k)
+			}
+			var e Event
+			err := json.Unmarshal(body, &e)
+			if err != nil {
+				t.Errorf("Unmarshal: %v", err)
+			}
+			done <- e
+		},
+	))
+	defer server.Close()
+
+	desc := &group.Description{
+		Notifications: []group.Notification{{
+			Type:   "webhook",
+			URL:    server.URL,
+			Secret: "secret",
+			Events: []string{"join"},
+		}},
+	}
+	Notify(desc, event("lock"))
+	Notify(desc, event("join"))
+
+	select {
+	case e := <-done:
+		if e.Type != "join" || e.Group != "test" || e.Username != "bob" {
+			t.Errorf("Bad event %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout")
+	}
+	mu.Lock()
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %v", attempts)
+	}
+	mu.Unlock()
+}
+
+// readDeadLetters waits until there are at least n dead letters for
+// a given destination.
+func readDeadLetters(t *testing.T, dest string, n int) []string {
+	filename := filepath.Join(group.DataDirectory, "undelivered.jsonl")
+	for i := 0; i < 500; i++ {
+		data, err := os.ReadFile(filename)
+		if err == nil {
+			var lines []string
+			for _, l := range strings.Split(string(data), "\n") {
+				if strings.Contains(l, `"`+dest+`"`) {
+					lines = append(lines, l)
+				}
+			}
+			if len(lines) >= n {
+				return lines
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for dead letters")
+	return nil
+}
+
+func TestDeadLetter(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			attempts++
+			mu.Unlock()
+			http.Error(w, "go away", http.StatusForbidden)
+		},
+	))
+	defer server.Close()
+
+	desc := &group.Description{
+		Notifications: []group.Notification{{
+			Type: "webhook",
+			URL:  server.URL,
+		}},
+	}
+	Notify(desc, event("record"))
+
+	lines := readDeadLetters(t, server.URL, 1)
+	var e struct {
+		Type        string `json:"type"`
+		Destination string `json:"destination"`
+		Error       string `json:"error"`
+	}
+	err := json.Unmarshal([]byte(lines[0]), &e)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if e.Type != "record" || e.Destination != server.URL ||
+		!strings.Contains(e.Error, "403") {
+		t.Errorf("Bad dead letter %v", lines[0])
+	}
+	mu.Lock()
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %v", attempts)
+	}
+	mu.Unlock()
+}
+
+func TestRateLimit(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-unblock
+		},
+	))
+	defer server.Close()
+	defer close(unblock)
+
+	desc := &group.Description{
+		Notifications: []group.Notification{{
+			Type:        "matrix",
+			URL:         server.URL,
+			Room:        "!room:example.org",
+			AccessToken: "token",
+		}},
+	}
+	for i := 0; i < burst+2; i++ {
+		Notify(desc, event("error"))
+	}
+	lines := readDeadLetters(t, server.URL, 2)
+	if len(lines) != 2 || !strings.Contains(lines[0], "rate limit") {
+		t.Errorf("Bad dead letters %v", lines)
+	}
+}
+
+// Webhooks are not rate-limited, and receive the events that concern
+// individual users if they ask for them.
+func TestWebhookBurst(t *testing.T) {
+	events := make(chan Event, 2*burst)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var e Event
+			json.NewDecoder(r.Body).Decode(&e)
+			events <- e
+		},
+	))
+	defer server.Close()
+
+	desc := &group.Description{
+		Notifications: []group.Notification{{
+			Type:   "webhook",
+			URL:    server.URL,
+			Events: []string{"user-join", "kick"},
+		}},
+	}
+	for i := 0; i < 2*burst-1; i++ {
+		Notify(desc, event("user-join"))
+	}
+	e := event("kick")
+	e.Target = "alice"
+	e.Client = "1234"
+	Notify(desc, e)
+	Notify(desc, event("user-leave"))
+
+	for i := 0; i < 2*burst; i++ {
+		select {
+		case e := <-events:
+			if i < 2*burst-1 && e.Type != "user-join" {
+				t.Errorf("Bad event %v", e)
+			}
+			if i == 2*burst-1 && (e.Type != "kick" ||
+				e.Target != "alice" || e.Client != "1234") {
+				t.Errorf("Bad event %v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout after %v events", i)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	e := Event{
+		Type: "unpresent", Group: "test",
+		Username: "bob", Target: "alice",
+	}
+	if d := describe(e); d != "bob disallowed alice from presenting in group test" {
+		t.Errorf("Got %v", d)
+	}
+	e = Event{Type: "user-leave", Group: "test"}
+	if d := describe(e); d != "(anonymous) left group test" {
+		t.Errorf("Got %v", d)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	done := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			paths = append(paths, r.URL.EscapedPath())
+			n := len(paths)
+			mu.Unlock()
+			if r.Method != "PUT" {
+				t.Errorf("Bad method %v", r.Method)
+			}
+			if a := r.Header.Get("Authorization"); a != "Bearer token" {
+				t.Errorf("Bad authorization %v", a)
+			}
+			if n < 2 {
+				http.Error(w, "busy", http.StatusTooManyRequests)
+				return
+			}
+			var m map[string]string
+			json.NewDecoder(r.Body).Decode(&m)
+			done <- m["body"]
+		},
+	))
+	defer server.Close()
+
+	desc := &group.Description{
+		Notifications: []group.Notification{{
+			Type:        "matrix",
+			URL:         server.URL + "/",
+			Room:        "!room:example.org",
+			AccessToken: "token",
+		}},
+	}
+	Notify(desc, event("join"))
+
+	select {
+	case body := <-done:
+		if body != "bob joined empty group test" {
+			t.Errorf("Bad body %v", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	prefix := "/_matrix/client/v3/rooms/%21room:example.org/" +
+		"send/m.room.message/"
+	if len(paths) != 2 || !strings.HasPrefix(paths[0], prefix) {
+		t.Errorf("Bad paths %v", paths)
+	} else if paths[0] != paths[1] {
+		t.Errorf("Transaction id changed: %v", paths)
+	}
+}
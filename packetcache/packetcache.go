@@ -1,31 +1,96 @@
 // Package packetcache implement a packet cache that maintains a history
-// of recently seen packets, the last keyframe, and a number of statistics
-// that are needed for sending receiver reports.
+// of recently seen packets, the location of keyframes, and a number of
+// statistics that are needed for sending receiver reports.
 package packetcache
 
 import (
+	"errors"
 	"math/bits"
 	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/rtptime"
 )
 
-// The maximum size of packets stored in the cache.  Chosen to be
-// a multiple of 8.
+// A buffer size that is enough for packets received over UDP.  Chosen to
+// be a multiple of 8.
 const BufSize = 1504
 
+// MaxSize is the largest packet size supported by the cache.
+const MaxSize = lengthMask
+
+// ErrTooLarge is returned when storing a packet larger than the maximum
+// size of the cache.
+var ErrTooLarge = errors.New("packet too large")
+
+// Packets are stored in slots of a few fixed sizes, which are shared
+// between all caches through one pool per size.  Most audio packets fit
+// in the smallest slots.
+var slotSizes = [...]int{128, 256, 512, 1024, BufSize, 4096, MaxSize}
+
+var slotPools [len(slotSizes)]sync.Pool
+
+func init() {
+	for i := range slotPools {
+		size := slotSizes[i]
+		slotPools[i].New = func() interface{} {
+			slot := make([]byte, size)
+			return &slot
+		}
+	}
+}
+
+// slotClass returns the index of the smallest slot size that can hold
+// length bytes.
+func slotClass(length int) int {
+	for i, size := range slotSizes {
+		if length <= size {
+			return i
+		}
+	}
+	return len(slotSizes) - 1
+}
+
+func getSlot(class int) *[]byte {
+	return slotPools[class].Get().(*[]byte)
+}
+
+func putSlot(slot *[]byte) {
+	slotPools[slotClass(len(*slot))].Put(slot)
+}
+
+const (
+	markerBit   = 0x8000
+	keyframeBit = 0x4000
+	lengthMask  = 0x3FFF
+)
+
 // entry represents a cached packet.
 type entry struct {
-	seqno           uint16
-	lengthAndMarker uint16 // 1 bit of marker, 15 bits of length
-	timestamp       uint32
-	buf             [BufSize]byte
+	seqno uint16
+	// 1 bit of marker, 1 bit of keyframe, 14 bits of length
+	lengthAndFlags uint16
+	timestamp      uint32
+	// the time at which the packet was stored, in jiffies
+	time uint64
+	// nil if the entry has never been used or has been released
+	buf   *[]byte
+	layer Layer
 }
 
 func (e *entry) length() uint16 {
-	return e.lengthAndMarker & 0x7FFF
+	return e.lengthAndFlags & lengthMask
 }
 
 func (e *entry) marker() bool {
-	return (e.lengthAndMarker & 0x8000) != 0
+	return (e.lengthAndFlags & markerBit) != 0
+}
+
+// keyframe returns true if the packet is the first packet of a keyframe.
+func (e *entry) keyframe() bool {
+	return (e.lengthAndFlags & keyframeBit) != 0
 }
 
 // bitmap keeps track of recent loss history
@@ -35,34 +100,79 @@ type bitmap struct {
 	bitmap uint32
 }
 
+// frame tracks the packets of a keyframe.
+type frame struct {
+	valid     bool
+	timestamp uint32
+	first     uint16
+	// for a complete keyframe, the seqno of its last packet; for a
+	// keyframe being received, the first seqno not known to be cached
+	end uint16
+}
+
+// A Cache holds the packets of a single RTP stream.  The loss bitmap and
+// the statistics assume a single seqno space, so the layers of a
+// simulcast track must each use their own cache; the memory used to
+// store packets is shared between all caches.
 type Cache struct {
 	mu sync.Mutex
 	//stats
-	last          uint16
-	cycle         uint16
-	lastValid     bool
+	seqnos        rtptime.SeqnoExtender
 	expected      uint32
 	totalExpected uint32
 	received      uint32
 	totalReceived uint32
-	// last seen keyframe
-	keyframe      uint16
-	keyframeValid bool
+	duplicates    uint32
+	reordered     uint32
+	maxReorder    uint32
+	maxGap        uint32
 	// bitmap
 	bitmap bitmap
+	// the most recent complete keyframe, and a more recent keyframe
+	// that is still being received
+	keyframe, pending frame
 	// the actual cache
 	tail    uint16
 	entries []entry
+	// the index of the entry holding each seqno, indexed by the low
+	// bits of the seqno; must be checked against the entry
+	index []uint16
+	// the total size of the slots held by the entries
+	bytes int
+	// the age after which Get refuses to return a packet, in jiffies,
+	// or 0 if packets don't expire
+	maxAge uint64
+	// the size of the largest packet that may be stored
+	maxSize int
+	// usage statistics
+	overwritten           uint64
+	hits, misses, expired uint64
+	grown, shrunk         uint32
 }
 
-// New creates a cache with the given capacity.
-func New(capacity int) *Cache {
-	if capacity > int(^uint16(0)) {
+// New creates a cache with the given capacity that holds packets of up
+// to maxSize bytes, usually BufSize.  Memory is allocated as packets are
+// stored, in proportion to their size.
+func New(capacity int, maxSize int) *Cache {
+	if capacity > int(^uint16(0)) || maxSize > MaxSize {
 		return nil
 	}
 	return &Cache{
 		entries: make([]entry, capacity),
+		index:   make([]uint16, indexSize(capacity)),
+		maxSize: maxSize,
+	}
+}
+
+// indexSize returns the size of the index for a cache of the given
+// capacity.  This is a power of two large enough that the seqnos of
+// recent packets don't collide.
+func indexSize(capacity int) int {
+	size := 1
+	for size < 2*capacity {
+		size <<= 1
 	}
+	return size
 }
 
 // compare performs comparison modulo 2^16.
@@ -152,57 +262,199 @@ func (bitmap *bitmap) get(next uint16) (bool, uint16, uint16) {
 	return true, first, uint16(bm >> 1)
 }
 
+// ToNACKs shifts all the bits before next out of the bitmap, and returns
+// a list of NACK pairs that covers all the 0 bits among them.
+func (cache *Cache) ToNACKs(next uint16) []rtcp.NackPair {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	var nacks []rtcp.NackPair
+	for compare(cache.bitmap.first, next) < 0 {
+		found, first, bitmap := cache.bitmap.get(next)
+		if found {
+			nacks = append(nacks, rtcp.NackPair{
+				PacketID:    first,
+				LostPackets: rtcp.PacketBitmap(bitmap),
+			})
+		}
+	}
+	return nacks
+}
+
+// slot returns the slot of the entry at the tail, making sure that it
+// is of the right size for a packet of the given length.  Called locked.
+func (cache *Cache) slot(length int) []byte {
+	e := &cache.entries[cache.tail]
+	class := slotClass(length)
+	if e.buf != nil && len(*e.buf) == slotSizes[class] {
+		return *e.buf
+	}
+	if e.buf != nil {
+		cache.bytes -= len(*e.buf)
+		putSlot(e.buf)
+	}
+	e.buf = getSlot(class)
+	cache.bytes += len(*e.buf)
+	return *e.buf
+}
+
 // Store stores a packet in the cache.  It returns the first seqno in the
-// bitmap, and the index at which the packet was stored.
-func (cache *Cache) Store(seqno uint16, timestamp uint32, keyframe bool, marker bool, buf []byte) (uint16, uint16) {
+// bitmap, and the index at which the packet was stored.  It returns
+// ErrTooLarge if the packet is larger than the cache's maximum size.
+func (cache *Cache) Store(seqno uint16, timestamp uint32, keyframe bool, marker bool, buf []byte) (uint16, uint16, error) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
-	if !cache.lastValid || seqnoInvalid(seqno, cache.last) {
-		cache.last = seqno
-		cache.lastValid = true
+	if len(buf) > cache.maxSize {
+		return 0, 0, ErrTooLarge
+	}
+	copy(cache.slot(len(buf)), buf)
+	first, i := cache.store(seqno, timestamp, keyframe, marker, len(buf))
+	return first, i, nil
+}
+
+// store updates the statistics and the entry at the tail, whose buffer
+// has already been filled in.  Called locked.
+func (cache *Cache) store(seqno uint16, timestamp uint32, keyframe bool, marker bool, length int) (uint16, uint16) {
+	_, duplicate := cache.lookup(seqno)
+	if duplicate {
+		cache.duplicates++
+	}
+
+	var xseqno int64
+	last, lastValid := cache.seqnos.Highest()
+	if !lastValid || seqnoInvalid(seqno, uint16(last)) {
+		xseqno = cache.seqnos.Resync(seqno)
+		cache.keyframe.valid = false
+		cache.pending.valid = false
 		cache.expected++
 		cache.received++
 	} else {
-		cmp := compare(cache.last, seqno)
-		if cmp < 0 {
+		xseqno = cache.seqnos.Extend(seqno)
+		if xseqno > last {
 			cache.received++
-			cache.expected += uint32(seqno - cache.last)
-			if seqno < cache.last {
-				cache.cycle++
-			}
-			cache.last = seqno
-			if cache.keyframeValid &&
-				compare(cache.keyframe, seqno) > 0 {
-				cache.keyframeValid = false
+			cache.expected += uint32(xseqno - last)
+			if gap := uint32(xseqno - last - 1); gap > cache.maxGap {
+				cache.maxGap = gap
 			}
-		} else if cmp > 0 {
+		} else if xseqno < last {
 			if cache.received < cache.expected {
 				cache.received++
 			}
+			if !duplicate {
+				cache.reordered++
+				depth := uint32(last - xseqno)
+				if depth > cache.maxReorder {
+					cache.maxReorder = depth
+				}
+			}
 		}
 	}
 	cache.bitmap.set(seqno)
 
-	if keyframe {
-		cache.keyframe = seqno
-		cache.keyframeValid = true
-	}
-
 	i := cache.tail
+	if cache.entries[i].lengthAndFlags != 0 {
+		cache.overwritten++
+		cache.evict(i)
+	}
 	cache.entries[i].seqno = seqno
-	copy(cache.entries[i].buf[:], buf)
-	lam := uint16(len(buf))
+	cache.index[int(seqno)&(len(cache.index)-1)] = i
+	laf := uint16(length)
 	if marker {
-		lam |= 0x8000
+		laf |= markerBit
+	}
+	if keyframe {
+		laf |= keyframeBit
 	}
-	cache.entries[i].lengthAndMarker = lam
+	cache.entries[i].lengthAndFlags = laf
 	cache.entries[i].timestamp = timestamp
+	cache.entries[i].time = rtptime.Jiffies()
+	cache.entries[i].layer = Layer{}
 	cache.tail = (i + 1) % uint16(len(cache.entries))
 
+	if keyframe && (!cache.pending.valid ||
+		compare(seqno, cache.pending.first) > 0) &&
+		(!cache.keyframe.valid ||
+			compare(seqno, cache.keyframe.first) > 0) {
+		cache.pending = frame{
+			valid:     true,
+			timestamp: timestamp,
+			first:     seqno,
+			end:       seqno,
+		}
+	}
+	if cache.pending.valid && seqno == cache.pending.end {
+		cache.advance()
+	}
+
 	return cache.bitmap.first, i
 }
 
+// advance checks the packets of the pending keyframe that follow the
+// ones already known to be cached, and promotes it to the most recent
+// complete keyframe once its last packet is reached.  Since packets
+// mostly arrive in order, each packet is usually checked just once.
+// Called locked.
+func (cache *Cache) advance() {
+	p := &cache.pending
+	for p.end-p.first < uint16(len(cache.entries)) {
+		i, found := cache.lookup(p.end)
+		if !found || cache.entries[i].timestamp != p.timestamp {
+			return
+		}
+		if cache.entries[i].marker() {
+			cache.keyframe = *p
+			cache.pending.valid = false
+			return
+		}
+		p.end++
+	}
+	// too large for the cache, it will never be complete
+	p.valid = false
+}
+
+// evict is called before the entry at index i is overwritten, and
+// forgets any keyframe that the packet belongs to.  Called locked.
+func (cache *Cache) evict(i uint16) {
+	e := &cache.entries[i]
+	if j, found := cache.lookup(e.seqno); !found || j != i {
+		// a more recent copy of the packet is cached
+		return
+	}
+	k := &cache.keyframe
+	if k.valid && e.timestamp == k.timestamp &&
+		e.seqno-k.first <= k.end-k.first {
+		k.valid = false
+	}
+	p := &cache.pending
+	if p.valid && e.timestamp == p.timestamp &&
+		e.seqno-p.first < p.end-p.first {
+		p.valid = false
+	}
+}
+
+// recheck forgets the keyframes some of whose packets are no longer
+// cached.  Called locked after entries have been released.
+func (cache *Cache) recheck() {
+	present := func(f *frame, end uint16) bool {
+		for s := f.first; s != end; s++ {
+			i, found := cache.lookup(s)
+			if !found || cache.entries[i].timestamp != f.timestamp {
+				return false
+			}
+		}
+		return true
+	}
+	if cache.keyframe.valid &&
+		!present(&cache.keyframe, cache.keyframe.end+1) {
+		cache.keyframe.valid = false
+	}
+	if cache.pending.valid &&
+		!present(&cache.pending, cache.pending.end) {
+		cache.pending.valid = false
+	}
+}
+
 // Expect records that we expect n additional packets.
 func (cache *Cache) Expect(n int) {
 	if n <= 0 {
@@ -213,99 +465,255 @@ func (cache *Cache) Expect(n int) {
 	cache.expected += uint32(n)
 }
 
-// get retrieves a packet from a slice of entries.
-func get(seqno uint16, entries []entry, result []byte) (uint16, uint32, bool) {
-	for i := range entries {
-		if entries[i].lengthAndMarker == 0 || entries[i].seqno != seqno {
-			continue
-		}
-		var n uint16
-		if len(result) > 0 {
-			n = uint16(copy(
-				result[:entries[i].length()],
-				entries[i].buf[:]))
-		} else {
-			n = entries[i].length()
+// lookup returns the index of the entry holding a given seqno.  After
+// a discontinuity in the seqnos, older packets might not be found.
+// Called locked.
+func (cache *Cache) lookup(seqno uint16) (uint16, bool) {
+	i := cache.index[int(seqno)&(len(cache.index)-1)]
+	if int(i) >= len(cache.entries) ||
+		cache.entries[i].lengthAndFlags == 0 ||
+		cache.entries[i].seqno != seqno {
+		return 0, false
+	}
+	return i, true
+}
+
+// reindex rebuilds the index, from the oldest to the newest entry so
+// that the most recent packet wins in case of collision.  Called locked.
+func (cache *Cache) reindex() {
+	cache.index = make([]uint16, indexSize(len(cache.entries)))
+	mask := len(cache.index) - 1
+	for j := range cache.entries {
+		i := (int(cache.tail) + j) % len(cache.entries)
+		if cache.entries[i].lengthAndFlags != 0 {
+			cache.index[int(cache.entries[i].seqno)&mask] = uint16(i)
 		}
-		return n, entries[i].timestamp, entries[i].marker()
 	}
-	return 0, 0, false
+}
+
+// PacketInfo is the RTP metadata stored with a packet.
+type PacketInfo struct {
+	Timestamp uint32
+	Marker    bool
+	Keyframe  bool
+	Layer     Layer
+	// the time at which the packet was stored, in jiffies
+	Time uint64
+}
+
+// Layer is the scalability information of a packet, when it is carried
+// out of band, for example in an AV1 dependency descriptor.
+type Layer struct {
+	Valid      bool
+	Sid, Tid   uint8
+	Start, End bool
+	// it is possible to switch up to temporal layer Tid at this packet
+	TidUpSync bool
+}
+
+// getAt copies the packet at index i into result, which is truncated if
+// result is too small.  If result is of length 0, returns the size of
+// the packet.  Called locked.
+func (cache *Cache) getAt(i uint16, result []byte) (uint16, PacketInfo) {
+	e := &cache.entries[i]
+	info := PacketInfo{
+		Timestamp: e.timestamp,
+		Marker:    e.marker(),
+		Keyframe:  e.keyframe(),
+		Layer:     e.layer,
+		Time:      e.time,
+	}
+	if len(result) == 0 {
+		return e.length(), info
+	}
+	return uint16(copy(result, (*e.buf)[:e.length()])), info
+}
+
+// SetMaxAge sets the age after which Get and GetInfo no longer return
+// a packet, since retransmitting it would be useless.  A value of 0
+// means that packets don't expire.  The maximum age only applies to
+// retransmissions; use GetAny to replay packets to a new receiver.
+func (cache *Cache) SetMaxAge(age time.Duration) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if age <= 0 {
+		cache.maxAge = 0
+		return
+	}
+	cache.maxAge = uint64(rtptime.FromDuration(age, rtptime.JiffiesPerSec))
+}
+
+// Has returns true if the given packet is in the cache, even if it has
+// expired.
+func (cache *Cache) Has(seqno uint16) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	_, found := cache.lookup(seqno)
+	return found
 }
 
 // Get retrieves a packet from the cache, returns the number of bytes
 // copied.  If result is of length 0, returns the size of the packet.
+// Returns 0 if the packet has expired.
 func (cache *Cache) Get(seqno uint16, result []byte) uint16 {
+	n, _ := cache.GetInfo(seqno, result)
+	return n
+}
+
+// GetInfo is like Get, but also returns the packet's metadata, which
+// avoids parsing the packet.
+func (cache *Cache) GetInfo(seqno uint16, result []byte) (uint16, PacketInfo) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
-	n, _, _ := get(seqno, cache.entries, result)
-	if n > 0 {
-		return n
+	i, found := cache.lookup(seqno)
+	if !found {
+		cache.misses++
+		return 0, PacketInfo{}
 	}
+	if cache.maxAge > 0 &&
+		rtptime.Jiffies()-cache.entries[i].time > cache.maxAge {
+		cache.expired++
+		return 0, PacketInfo{}
+	}
+	cache.hits++
+	return cache.getAt(i, result)
+}
 
-	return 0
+// GetAny is like Get, but returns a packet however old it is.  It is
+// used when replaying the most recent keyframe to a new receiver, which
+// is useful whatever the age of the keyframe.  It doesn't count towards
+// the statistics.
+func (cache *Cache) GetAny(seqno uint16, result []byte) uint16 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	i, found := cache.lookup(seqno)
+	if !found {
+		return 0
+	}
+	n, _ := cache.getAt(i, result)
+	return n
+}
+
+// Info returns the metadata of a packet without copying it.  Unlike
+// GetInfo, it returns the metadata of expired packets, and doesn't
+// count towards the statistics.
+func (cache *Cache) Info(seqno uint16) (PacketInfo, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	i, found := cache.lookup(seqno)
+	if !found {
+		return PacketInfo{}, false
+	}
+	_, info := cache.getAt(i, nil)
+	return info, true
+}
+
+// SetLayer records the scalability information of a packet that has
+// already been stored.
+func (cache *Cache) SetLayer(seqno uint16, layer Layer) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	i, found := cache.lookup(seqno)
+	if !found {
+		return false
+	}
+	cache.entries[i].layer = layer
+	return true
 }
 
 func (cache *Cache) Last() (uint16, bool) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
-	if !cache.lastValid {
+	last, valid := cache.seqnos.Highest()
+	if !valid {
 		return 0, false
 	}
-	return cache.last, true
+	return uint16(last), true
 }
 
 // GetAt retrieves a packet from the cache assuming it is at the given index.
 func (cache *Cache) GetAt(seqno uint16, index uint16, result []byte) uint16 {
+	n, _ := cache.GetAtInfo(seqno, index, result)
+	return n
+}
+
+// GetAtInfo is like GetAt, but also returns the packet's metadata.
+func (cache *Cache) GetAtInfo(seqno uint16, index uint16, result []byte) (uint16, PacketInfo) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
 	if int(index) >= len(cache.entries) {
-		return 0
+		return 0, PacketInfo{}
 	}
-	if cache.entries[index].seqno != seqno {
-		return 0
+	if cache.entries[index].lengthAndFlags == 0 ||
+		cache.entries[index].seqno != seqno {
+		return 0, PacketInfo{}
 	}
-	return uint16(copy(
-		result[:cache.entries[index].length()],
-		cache.entries[index].buf[:]),
-	)
+	return cache.getAt(index, result)
 }
 
-// Keyframe returns the seqno of the last seen keyframe
-func (cache *Cache) Keyframe() (uint16, bool) {
+// Keyframe returns the first and last seqnos of the most recent keyframe
+// all of whose packets are in the cache.  The last packet of a keyframe
+// is the one with the marker bit set.  The keyframe is tracked as
+// packets are stored, so this is cheap.
+func (cache *Cache) Keyframe() (uint16, uint16, bool) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
-	if !cache.keyframeValid {
-		return 0, false
+	if !cache.keyframe.valid {
+		return 0, 0, false
+	}
+	return cache.keyframe.first, cache.keyframe.end, true
+}
+
+// release returns the slots of a range of entries that are being
+// evicted to the pool.  Called locked.
+func (cache *Cache) release(entries []entry) {
+	for i := range entries {
+		if entries[i].buf != nil {
+			cache.bytes -= len(*entries[i].buf)
+			putSlot(entries[i].buf)
+			entries[i].buf = nil
+		}
 	}
-	return cache.keyframe, true
 }
 
 func (cache *Cache) resize(capacity int) {
 	if len(cache.entries) == capacity {
 		return
 	}
+	if capacity > len(cache.entries) {
+		cache.grown++
+	} else {
+		cache.shrunk++
+	}
 
 	entries := make([]entry, capacity)
-
-	if capacity > len(cache.entries) {
-		copy(entries, cache.entries[:cache.tail])
-		copy(entries[int(cache.tail)+capacity-len(cache.entries):],
-			cache.entries[cache.tail:])
-	} else if capacity > int(cache.tail) {
-		copy(entries, cache.entries[:cache.tail])
-		copy(entries[cache.tail:],
-			cache.entries[int(cache.tail)+
-				len(cache.entries)-capacity:])
+	old := cache.entries
+	tail := int(cache.tail)
+
+	if capacity > len(old) {
+		copy(entries, old[:tail])
+		copy(entries[tail+capacity-len(old):], old[tail:])
+	} else if capacity > tail {
+		copy(entries, old[:tail])
+		copy(entries[tail:], old[tail+len(old)-capacity:])
+		cache.release(old[tail : tail+len(old)-capacity])
 	} else {
 		// too bad, invalidate all indices
-		copy(entries,
-			cache.entries[int(cache.tail)-capacity:cache.tail])
+		copy(entries, old[tail-capacity:tail])
+		cache.release(old[:tail-capacity])
+		cache.release(old[tail:])
 		cache.tail = 0
 	}
+
 	cache.entries = entries
+	cache.reindex()
+	cache.recheck()
 }
 
 // Resize resizes the cache to the given capacity.  This might invalidate
@@ -339,25 +747,109 @@ func (cache *Cache) ResizeCond(capacity int) bool {
 	return true
 }
 
+// Capacity returns the number of packets that the cache can hold.
+func (cache *Cache) Capacity() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return len(cache.entries)
+}
+
+// Bytes returns the amount of memory used to store packets.
+func (cache *Cache) Bytes() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.bytes
+}
+
+// Clear removes all packets from the cache, which invalidates all indices.
+// Statistics are preserved.
+func (cache *Cache) Clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for i := range cache.entries {
+		cache.entries[i].seqno = 0
+		cache.entries[i].lengthAndFlags = 0
+		cache.entries[i].timestamp = 0
+		cache.entries[i].time = 0
+		cache.entries[i].layer = Layer{}
+	}
+	cache.release(cache.entries)
+	cache.tail = 0
+	cache.keyframe.valid = false
+	cache.pending.valid = false
+}
+
+// Usage contains statistics about the use of the cache itself, which
+// indicate whether its capacity is adequate.
+type Usage struct {
+	// the number of packets that the cache can hold, and currently holds
+	Capacity, Occupied int
+	// the amount of memory used to store packets
+	Bytes int
+	// the number of packets evicted in order to store a new packet
+	Overwritten uint64
+	// the results of calls to Get and GetInfo
+	Hits, Misses, Expired uint64
+	// the number of times the cache was grown or shrunk
+	Grown, Shrunk uint32
+}
+
+// GetUsage returns statistics about the use of the cache.
+func (cache *Cache) GetUsage() Usage {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	occupied := 0
+	for i := range cache.entries {
+		if cache.entries[i].lengthAndFlags != 0 {
+			occupied++
+		}
+	}
+	return Usage{
+		Capacity:    len(cache.entries),
+		Occupied:    occupied,
+		Bytes:       cache.bytes,
+		Overwritten: cache.overwritten,
+		Hits:        cache.hits,
+		Misses:      cache.misses,
+		Expired:     cache.expired,
+		Grown:       cache.grown,
+		Shrunk:      cache.shrunk,
+	}
+}
+
 // Stats contains cache statistics
 type Stats struct {
 	Received, TotalReceived uint32
 	Expected, TotalExpected uint32
 	ESeqno                  uint32
+	// the number of packets received twice, and received out of order
+	Duplicates, Reordered uint32
+	// the largest distance by which a packet arrived late, and the
+	// largest run of missing seqnos
+	MaxReorder, MaxGap uint32
 }
 
 // GetStats returns statistics about received packets.  If reset is true,
-// the statistics are reset.
+// the statistics are reset, except for the duplicate and reordering
+// statistics, which are cumulative.
 func (cache *Cache) GetStats(reset bool) Stats {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
+	last, _ := cache.seqnos.Highest()
+
 	s := Stats{
 		Received:      cache.received,
 		TotalReceived: cache.totalReceived + cache.received,
 		Expected:      cache.expected,
 		TotalExpected: cache.totalExpected + cache.expected,
-		ESeqno:        uint32(cache.cycle)<<16 | uint32(cache.last),
+		ESeqno:        uint32(last),
+		Duplicates:    cache.duplicates,
+		Reordered:     cache.reordered,
+		MaxReorder:    cache.maxReorder,
+		MaxGap:        cache.maxGap,
 	}
 
 	if reset {
@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/pion/rtcp"
 )
@@ -20,15 +21,15 @@ func randomBuf() []byte {
 func TestCache(t *testing.T) {
 	buf1 := randomBuf()
 	buf2 := randomBuf()
-	cache := New(16)
+	cache := New(16, BufSize)
 
 	_, found := cache.Last()
 	if found {
 		t.Errorf("Found in empty cache")
 	}
 
-	_, i1 := cache.Store(13, 42, false, false, buf1)
-	_, i2 := cache.Store(17, 42, false, false, buf2)
+	_, i1, _ := cache.Store(13, 42, false, false, buf1)
+	_, i2, _ := cache.Store(17, 42, false, false, buf2)
 
 	seqno, found := cache.Last()
 	if !found {
@@ -78,7 +79,7 @@ func TestCache(t *testing.T) {
 }
 
 func TestCacheOverflow(t *testing.T) {
-	cache := New(16)
+	cache := New(16, BufSize)
 
 	for i := 0; i < 32; i++ {
 		cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
@@ -100,7 +101,7 @@ func TestCacheOverflow(t *testing.T) {
 }
 
 func TestCacheGrow(t *testing.T) {
-	cache := New(16)
+	cache := New(16, BufSize)
 
 	for i := 0; i < 24; i++ {
 		cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
@@ -123,7 +124,7 @@ func TestCacheGrow(t *testing.T) {
 }
 
 func TestCacheShrink(t *testing.T) {
-	cache := New(16)
+	cache := New(16, BufSize)
 
 	for i := 0; i < 24; i++ {
 		cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
@@ -142,8 +143,323 @@ func TestCacheShrink(t *testing.T) {
 	}
 }
 
+func TestCacheResizeGet(t *testing.T) {
+	cache := New(16, BufSize)
+
+	for i := 0; i < 25; i++ {
+		cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
+	}
+
+	buf := make([]byte, BufSize)
+	for i := 0; i < 25; i++ {
+		l := cache.Get(uint16(i), buf)
+		if i < 9 {
+			if l > 0 {
+				t.Errorf("Creation ex nihilo: %v", i)
+			}
+		} else {
+			if l != 1 || buf[0] != uint8(i) {
+				t.Errorf("Expected [%v], got %v", i, buf[:l])
+			}
+		}
+	}
+
+	cache.Resize(8)
+	for i := 0; i < 25; i++ {
+		l := cache.Get(uint16(i), buf)
+		if i < 17 {
+			if l > 0 {
+				t.Errorf("Creation ex nihilo: %v", i)
+			}
+		} else {
+			if l != 1 || buf[0] != uint8(i) {
+				t.Errorf("Expected [%v], got %v", i, buf[:l])
+			}
+		}
+	}
+
+	cache.Clear()
+	for i := range cache.entries {
+		if cache.entries[i].buf != nil {
+			t.Errorf("Entry %v was not released", i)
+		}
+	}
+	if l := cache.Get(24, buf); l != 0 {
+		t.Errorf("Got packet after Clear")
+	}
+	if l := cache.GetAt(0, 0, buf); l != 0 {
+		t.Errorf("Got packet after Clear")
+	}
+}
+
+func TestCacheInfo(t *testing.T) {
+	cache := New(16, BufSize)
+	cache.Store(13, 42, true, false, []byte{13})
+	_, i, _ := cache.Store(14, 42, false, true, []byte{14, 14})
+
+	buf := make([]byte, BufSize)
+	l, info := cache.GetInfo(13, buf)
+	if info.Time == 0 {
+		t.Errorf("Packet has no time")
+	}
+	info.Time = 0
+	expected := PacketInfo{Timestamp: 42, Keyframe: true}
+	if l != 1 || buf[0] != 13 || info != expected {
+		t.Errorf("Expected 1 %v, got %v %v", expected, l, info)
+	}
+
+	l, info = cache.GetAtInfo(14, i, nil)
+	info.Time = 0
+	expected = PacketInfo{Timestamp: 42, Marker: true}
+	if l != 2 || info != expected {
+		t.Errorf("Expected 2 %v, got %v %v", expected, l, info)
+	}
+
+	l, info = cache.GetInfo(15, buf)
+	if l != 0 || info != (PacketInfo{}) {
+		t.Errorf("Creation ex nihilo: %v %v", l, info)
+	}
+}
+
+func TestCacheLayer(t *testing.T) {
+	cache := New(4, BufSize)
+	cache.Store(13, 42, true, false, []byte{13})
+	layer := Layer{Valid: true, Tid: 2, Start: true}
+	if !cache.SetLayer(13, layer) {
+		t.Errorf("SetLayer failed")
+	}
+	if cache.SetLayer(14, layer) {
+		t.Errorf("SetLayer succeeded on missing packet")
+	}
+
+	info, ok := cache.Info(13)
+	if !ok || info.Layer != layer || !info.Keyframe {
+		t.Errorf("Expected %v, got %v %v", layer, info, ok)
+	}
+	if u := cache.GetUsage(); u.Hits != 0 || u.Misses != 0 {
+		t.Errorf("Info counted in statistics: %v", u)
+	}
+
+	// the layer must not survive the entry being reused
+	for i := uint16(14); i < 18; i++ {
+		cache.Store(i, 42, false, false, []byte{uint8(i)})
+	}
+	info, ok = cache.Info(17)
+	if !ok || info.Layer.Valid {
+		t.Errorf("Stale layer: %v %v", info, ok)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	cache := New(16, BufSize)
+	cache.SetMaxAge(50 * time.Millisecond)
+	cache.Store(13, 0, false, false, []byte{13})
+
+	buf := make([]byte, BufSize)
+	if l := cache.Get(13, buf); l != 1 {
+		t.Errorf("Expected 1, got %v", l)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	cache.Store(14, 0, false, false, []byte{14})
+	if l := cache.Get(13, buf); l != 0 {
+		t.Errorf("Got expired packet")
+	}
+	if !cache.Has(13) {
+		t.Errorf("Expired packet is missing")
+	}
+	if l := cache.GetAny(13, buf); l != 1 || buf[0] != 13 {
+		t.Errorf("Expected 1, got %v", l)
+	}
+	if l := cache.Get(14, buf); l != 1 {
+		t.Errorf("Expected 1, got %v", l)
+	}
+
+	cache.SetMaxAge(0)
+	if l := cache.Get(13, buf); l != 1 {
+		t.Errorf("Expected 1, got %v", l)
+	}
+}
+
+func TestCacheUsage(t *testing.T) {
+	cache := New(16, BufSize)
+	for i := 0; i < 20; i++ {
+		cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
+	}
+	buf := make([]byte, BufSize)
+	cache.Get(19, buf)
+	cache.Get(18, nil)
+	cache.Get(2, buf)
+	cache.Resize(32)
+	cache.Resize(8)
+
+	u := cache.GetUsage()
+	expected := Usage{
+		Capacity:    8,
+		Occupied:    8,
+		Bytes:       8 * 128,
+		Overwritten: 4,
+		Hits:        2,
+		Misses:      1,
+		Grown:       1,
+		Shrunk:      1,
+	}
+	if u != expected {
+		t.Errorf("Expected %v, got %v", expected, u)
+	}
+}
+
+func TestCacheMaxSize(t *testing.T) {
+	if New(16, MaxSize+1) != nil {
+		t.Errorf("Created cache with excessive size")
+	}
+
+	cache := New(16, BufSize)
+	_, _, err := cache.Store(13, 0, false, false, make([]byte, BufSize+1))
+	if err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+	if cache.Get(13, nil) != 0 {
+		t.Errorf("Oversized packet was stored")
+	}
+
+	cache = New(16, 9000)
+	jumbo := make([]byte, 9000)
+	rand.Read(jumbo)
+	_, _, err = cache.Store(13, 0, false, false, jumbo)
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	buf := make([]byte, 9000)
+	l := cache.Get(13, buf)
+	if !bytes.Equal(buf[:l], jumbo) {
+		t.Errorf("Couldn't get jumbo packet")
+	}
+	if l := cache.Get(13, nil); l != 9000 {
+		t.Errorf("Expected 9000, got %v", l)
+	}
+	// a short buffer yields a truncated packet
+	buf = make([]byte, BufSize)
+	if l := cache.Get(13, buf); l != BufSize {
+		t.Errorf("Expected %v, got %v", BufSize, l)
+	}
+}
+
+func TestCacheReorder(t *testing.T) {
+	cache := New(16, BufSize)
+	for _, seqno := range []uint16{0, 1, 2, 5, 4, 3, 3, 10, 6} {
+		cache.Store(seqno, 0, false, false, []byte{uint8(seqno)})
+	}
+	s := cache.GetStats(true)
+	if s.Duplicates != 1 || s.Reordered != 3 ||
+		s.MaxReorder != 4 || s.MaxGap != 4 {
+		t.Errorf("Got %v %v %v %v",
+			s.Duplicates, s.Reordered, s.MaxReorder, s.MaxGap)
+	}
+
+	// cumulative
+	s = cache.GetStats(false)
+	if s.Duplicates != 1 || s.Reordered != 3 {
+		t.Errorf("Got %v %v", s.Duplicates, s.Reordered)
+	}
+}
+
+func TestCacheLookup(t *testing.T) {
+	cache := New(16, BufSize)
+	seqnos := []uint16{65530, 65532, 65531, 65533, 65535, 0, 2, 1, 3}
+	for _, seqno := range seqnos {
+		cache.Store(seqno, 0, false, false, []byte{uint8(seqno)})
+	}
+
+	check := func(present []uint16, absent []uint16) {
+		t.Helper()
+		buf := make([]byte, BufSize)
+		for _, seqno := range present {
+			l := cache.Get(seqno, buf)
+			if l != 1 || buf[0] != uint8(seqno) {
+				t.Errorf("Expected [%v], got %v", seqno, buf[:l])
+			}
+		}
+		for _, seqno := range absent {
+			if l := cache.Get(seqno, buf); l != 0 {
+				t.Errorf("Creation ex nihilo: %v", seqno)
+			}
+		}
+	}
+
+	check(seqnos, []uint16{65534, 4, 26})
+
+	cache.Resize(64)
+	check(seqnos, []uint16{65534, 4})
+
+	cache.Resize(4)
+	check([]uint16{0, 2, 1, 3}, []uint16{65535})
+
+	// a discontinuity, which hides the older packet
+	cache.Store(3+8, 0, false, false, []byte{3 + 8})
+	check([]uint16{3 + 8, 2, 1}, []uint16{0, 3})
+
+	cache.Clear()
+	check(nil, []uint16{3 + 8, 2, 1})
+}
+
+func TestCacheBytes(t *testing.T) {
+	cache := New(16, BufSize)
+	if b := cache.Bytes(); b != 0 {
+		t.Errorf("Expected 0, got %v", b)
+	}
+
+	small := make([]byte, 100)
+	for i := 0; i < 16; i++ {
+		cache.Store(uint16(i), 0, false, false, small)
+	}
+	if b := cache.Bytes(); b != 16*128 {
+		t.Errorf("Expected %v, got %v", 16*128, b)
+	}
+
+	// overwrite half of the entries with large packets
+	large := make([]byte, 1200)
+	for i := 16; i < 24; i++ {
+		cache.Store(uint16(i), 0, false, false, large)
+	}
+	if b := cache.Bytes(); b != 8*128+8*BufSize {
+		t.Errorf("Expected %v, got %v", 8*128+8*BufSize, b)
+	}
+	buf := make([]byte, BufSize)
+	if l := cache.Get(20, buf); l != 1200 {
+		t.Errorf("Expected 1200, got %v", l)
+	}
+
+	cache.Resize(4)
+	if b := cache.Bytes(); b != 4*BufSize {
+		t.Errorf("Expected %v, got %v", 4*BufSize, b)
+	}
+
+	cache.Clear()
+	if b := cache.Bytes(); b != 0 {
+		t.Errorf("Expected 0, got %v", b)
+	}
+}
+
+func TestCacheShrinkContents(t *testing.T) {
+	cache := New(16, BufSize)
+
+	for i := 0; i < 24; i++ {
+		cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
+	}
+
+	cache.Resize(12)
+	buf := make([]byte, BufSize)
+	for i := 12; i < 24; i++ {
+		l := cache.Get(uint16(i), buf)
+		if l != 1 || buf[0] != uint8(i) {
+			t.Errorf("Expected [%v], got %v", i, buf[:l])
+		}
+	}
+}
+
 func TestCacheGrowCond(t *testing.T) {
-	cache := New(16)
+	cache := New(16, BufSize)
 	if len(cache.entries) != 16 {
 		t.Errorf("Expected 16, got %v", len(cache.entries))
 	}
@@ -173,12 +489,12 @@ func TestBitmap(t *testing.T) {
 	value := uint64(0xcdd58f1e035379c0)
 	packet := make([]byte, 1)
 
-	cache := New(16)
+	cache := New(16, BufSize)
 
 	var first uint16
 	for i := 0; i < 64; i++ {
 		if (value & (1 << i)) != 0 {
-			first, _ = cache.Store(uint16(42+i), 0, false, false, packet)
+			first, _, _ = cache.Store(uint16(42+i), 0, false, false, packet)
 		}
 	}
 
@@ -192,7 +508,7 @@ func TestBitmapWrap(t *testing.T) {
 	value := uint64(0xcdd58f1e035379c0)
 	packet := make([]byte, 1)
 
-	cache := New(16)
+	cache := New(16, BufSize)
 
 	cache.Store(0x7000, 0, false, false, packet)
 	cache.Store(0xA000, 0, false, false, packet)
@@ -200,7 +516,7 @@ func TestBitmapWrap(t *testing.T) {
 	var first uint16
 	for i := 0; i < 64; i++ {
 		if (value & (1 << i)) != 0 {
-			first, _ = cache.Store(uint16(42+i), 0, false, false, packet)
+			first, _, _ = cache.Store(uint16(42+i), 0, false, false, packet)
 		}
 	}
 
@@ -214,7 +530,7 @@ func TestBitmapGet(t *testing.T) {
 	value := uint64(0xcdd58f1e035379c0)
 	packet := make([]byte, 1)
 
-	cache := New(16)
+	cache := New(16, BufSize)
 
 	for i := 0; i < 64; i++ {
 		if (value & (1 << i)) != 0 {
@@ -256,7 +572,7 @@ func TestBitmapPacket(t *testing.T) {
 	value := uint64(0xcdd58f1e035379c0)
 	packet := make([]byte, 1)
 
-	cache := New(16)
+	cache := New(16, BufSize)
 
 	for i := 0; i < 64; i++ {
 		if (value & (1 << i)) != 0 {
@@ -281,6 +597,42 @@ func TestBitmapPacket(t *testing.T) {
 	})
 }
 
+func TestToNACKs(t *testing.T) {
+	// the first packet must be present
+	value := uint32(0xcdd58f1f)
+	packet := make([]byte, 1)
+
+	cache := New(16, BufSize)
+
+	// wraps around
+	start := uint16(65530)
+	var missing []uint16
+	for i := 0; i < 32; i++ {
+		if (value & (1 << i)) != 0 {
+			cache.Store(start+uint16(i), 0, false, false, packet)
+		} else {
+			missing = append(missing, start+uint16(i))
+		}
+	}
+
+	nacks := cache.ToNACKs(start + 32)
+	if len(nacks) < 2 {
+		t.Errorf("Expected at least 2 NACKs, got %v", nacks)
+	}
+	var list []uint16
+	for _, nack := range nacks {
+		list = append(list, nack.PacketList()...)
+	}
+	if !reflect.DeepEqual(list, missing) {
+		t.Errorf("Expected %v, got %v", missing, list)
+	}
+
+	nacks = cache.ToNACKs(start + 32)
+	if len(nacks) != 0 {
+		t.Errorf("Expected no NACKs, got %v", nacks)
+	}
+}
+
 func BenchmarkCachePutGet(b *testing.B) {
 	n := 10
 	chans := make([]chan uint16, n)
@@ -288,7 +640,7 @@ func BenchmarkCachePutGet(b *testing.B) {
 		chans[i] = make(chan uint16, 8)
 	}
 
-	cache := New(96)
+	cache := New(96, BufSize)
 
 	var wg sync.WaitGroup
 	wg.Add(len(chans))
@@ -328,6 +680,61 @@ func BenchmarkCachePutGet(b *testing.B) {
 	wg.Wait()
 }
 
+func benchmarkCacheGet(b *testing.B, capacity int, reorder bool) {
+	cache := New(capacity, BufSize)
+	packet := make([]byte, 1200)
+	for i := 0; i < capacity; i++ {
+		seqno := uint16(i)
+		if reorder && i%16 == 1 {
+			seqno++
+		} else if reorder && i%16 == 2 {
+			seqno--
+		}
+		cache.Store(seqno, 0, false, false, packet)
+	}
+
+	buf := make([]byte, BufSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		seqno := uint16(capacity - 1 - i%(capacity/2))
+		l := cache.Get(seqno, buf)
+		if l == 0 {
+			b.Errorf("Couldn't get %v", seqno)
+		}
+	}
+}
+
+func BenchmarkCacheGet64(b *testing.B) {
+	benchmarkCacheGet(b, 64, false)
+}
+
+func BenchmarkCacheGet1024(b *testing.B) {
+	benchmarkCacheGet(b, 1024, false)
+}
+
+func BenchmarkCacheGetReordered(b *testing.B) {
+	benchmarkCacheGet(b, 1024, true)
+}
+
+func BenchmarkCacheGetMissing(b *testing.B) {
+	cache := New(1024, BufSize)
+	packet := make([]byte, 1200)
+	for i := 0; i < 1024; i++ {
+		if i%2 == 0 {
+			cache.Store(uint16(i), 0, false, false, packet)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		cache.Get(uint16(1023-2*(i%256)), nil)
+	}
+}
+
 type is struct {
 	index, seqno uint16
 }
@@ -339,7 +746,7 @@ func BenchmarkCachePutGetAt(b *testing.B) {
 		chans[i] = make(chan is, 8)
 	}
 
-	cache := New(96)
+	cache := New(96, BufSize)
 
 	var wg sync.WaitGroup
 	wg.Add(len(chans))
@@ -368,7 +775,7 @@ func BenchmarkCachePutGetAt(b *testing.B) {
 
 	for i := 0; i < b.N; i++ {
 		seqno := uint16(i)
-		_, index := cache.Store(seqno, 0, false, false, buf)
+		_, index, _ := cache.Store(seqno, 0, false, false, buf)
 		for _, ch := range chans {
 			ch <- is{index, seqno}
 		}
@@ -379,6 +786,23 @@ func BenchmarkCachePutGetAt(b *testing.B) {
 	wg.Wait()
 }
 
+func BenchmarkCacheStore(b *testing.B) {
+	cache := New(512, BufSize)
+	packet := make([]byte, 1200)
+	rand.Read(packet)
+	buf := make([]byte, BufSize)
+
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// simulate reading from the network
+		n := copy(buf, packet)
+		cache.Store(uint16(i), 0, false, false, buf[:n])
+	}
+}
+
 func TestToBitmap(t *testing.T) {
 	l := []uint16{18, 19, 32, 38}
 	bb := uint16(1 | 1<<(32-18-1))
@@ -416,7 +840,7 @@ func TestToBitmapNack(t *testing.T) {
 }
 
 func TestCacheStatsFull(t *testing.T) {
-	cache := New(16)
+	cache := New(16, BufSize)
 	for i := 0; i < 32; i++ {
 		cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
 	}
@@ -431,7 +855,7 @@ func TestCacheStatsFull(t *testing.T) {
 }
 
 func TestCacheStatsDrop(t *testing.T) {
-	cache := New(16)
+	cache := New(16, BufSize)
 	for i := 0; i < 32; i++ {
 		if i != 8 && i != 10 {
 			cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
@@ -448,7 +872,7 @@ func TestCacheStatsDrop(t *testing.T) {
 }
 
 func TestCacheStatsUnordered(t *testing.T) {
-	cache := New(16)
+	cache := New(16, BufSize)
 	for i := 0; i < 32; i++ {
 		if i != 8 && i != 10 {
 			cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
@@ -467,7 +891,7 @@ func TestCacheStatsUnordered(t *testing.T) {
 }
 
 func TestCacheStatsNack(t *testing.T) {
-	cache := New(16)
+	cache := New(16, BufSize)
 	for i := 0; i < 32; i++ {
 		if i != 8 && i != 10 {
 			cache.Store(uint16(i), 0, false, false, []byte{uint8(i)})
@@ -485,3 +909,80 @@ func TestCacheStatsNack(t *testing.T) {
 		t.Errorf("Expected 32, 32, 34, 34, 31, got %v", stats)
 	}
 }
+
+func TestKeyframe(t *testing.T) {
+	cache := New(16, BufSize)
+	store := func(seqno uint16, timestamp uint32, kf, marker bool) {
+		cache.Store(seqno, timestamp, kf, marker, []byte{uint8(seqno)})
+	}
+	check := func(first, last uint16, found bool) {
+		t.Helper()
+		f, l, ok := cache.Keyframe()
+		if ok != found || (found && (f != first || l != last)) {
+			t.Errorf("Expected %v %v %v, got %v %v %v",
+				first, last, found, f, l, ok)
+		}
+	}
+
+	check(0, 0, false)
+	store(10, 100, true, false)
+	store(11, 100, false, false)
+	check(0, 0, false)
+	store(12, 100, false, true)
+	check(10, 12, true)
+	store(13, 200, false, true)
+	check(10, 12, true)
+
+	// an incomplete keyframe is skipped
+	store(14, 300, true, false)
+	store(16, 300, false, true)
+	check(10, 12, true)
+	store(15, 300, false, false)
+	check(14, 16, true)
+
+	// a keyframe is lost when its first packet is evicted
+	for i := uint16(17); i < 31; i++ {
+		store(i, 400, false, i == 30)
+	}
+	check(0, 0, false)
+
+	store(0xFFFE, 500, true, false)
+	store(0xFFFF, 500, false, false)
+	store(0, 500, false, true)
+	check(0xFFFE, 0, true)
+
+	// or when shrinking the cache drops one of its packets
+	cache.Resize(2)
+	check(0, 0, false)
+
+	store(1, 600, true, false)
+	store(2, 600, false, true)
+	check(1, 2, true)
+
+	cache.Clear()
+	check(0, 0, false)
+}
+
+func TestCacheStatsWraparound(t *testing.T) {
+	cache := New(16, BufSize)
+	seqno := uint16(0xFFF0)
+	n := 5*0x10000 + 96
+	for i := 0; i < n; i++ {
+		// swap every eighth packet with the next one
+		s := seqno
+		if i%8 == 3 {
+			s++
+		} else if i%8 == 4 {
+			s--
+		}
+		cache.Store(s, 0, false, false, []byte{uint8(s)})
+		seqno++
+	}
+	stats := cache.GetStats(false)
+	last := uint32(0xFFF0 + n - 1)
+	if stats.Received != uint32(n) ||
+		stats.Expected != uint32(n) ||
+		stats.ESeqno != last {
+		t.Errorf("Expected %v, %v, %v, got %v", n, n, last, stats)
+	}
+}
@@ -3,23 +3,27 @@ package packetmap
 
 import (
 	"sync"
+
+	"github.com/jech/galene/rtptime"
 )
 
 const maxEntries = 128
 
+// Map keeps track of extended seqnos internally, and only converts to
+// 16-bit seqnos at the interface.
 type Map struct {
 	mu        sync.Mutex
-	next      uint16
+	next      int64
 	nextPid   uint16
-	delta     uint16
+	delta     int64
 	pidDelta  uint16
 	lastEntry uint16
 	entries   []entry
 }
 
 type entry struct {
-	first, count uint16
-	delta        uint16
+	first, count int64
+	delta        int64
 	pidDelta     uint16
 }
 
@@ -29,36 +33,37 @@ func (m *Map) Map(seqno uint16, pid uint16) (bool, uint16, uint16) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	s := rtptime.ExtendSeqno(m.next, seqno)
+
 	if m.delta == 0 && m.entries == nil {
-		if compare(m.next, seqno) <= 0 ||
-			uint16(m.next - seqno) > 8 * 1024 {
-			m.next = seqno + 1
+		if s >= m.next || m.next-s > 8*1024 {
+			m.next = s + 1
 			m.nextPid = pid
 		}
 		return true, seqno, 0
 	}
 
-	if compare(m.next, seqno) <= 0 {
-		if uint16(seqno-m.next) > 8*1024 {
+	if s >= m.next {
+		if s-m.next > 8*1024 {
 			m.reset()
-			m.next = seqno + 1
+			m.next = s + 1
 			m.nextPid = pid
 			return true, seqno, 0
 		}
-		addMapping(m, seqno, m.delta, m.pidDelta)
-		m.next = seqno + 1
+		addMapping(m, s, m.delta, m.pidDelta)
+		m.next = s + 1
 		m.nextPid = pid
-		return true, seqno + m.delta, m.pidDelta
+		return true, uint16(s + m.delta), m.pidDelta
 	}
 
-	if uint16(m.next-seqno) > 8*1024 {
+	if m.next-s > 8*1024 {
 		m.reset()
-		m.next = seqno + 1
+		m.next = s + 1
 		m.nextPid = pid
 		return true, seqno, 0
 	}
 
-	return m.direct(seqno)
+	return m.direct(s)
 }
 
 func (m *Map) reset() {
@@ -70,7 +75,7 @@ func (m *Map) reset() {
 	m.entries = nil
 }
 
-func addMapping(m *Map, seqno, delta, pidDelta uint16) {
+func addMapping(m *Map, seqno int64, delta int64, pidDelta uint16) {
 	if len(m.entries) == 0 {
 		// this shouldn't happen
 		return
@@ -88,7 +93,7 @@ func addMapping(m *Map, seqno, delta, pidDelta uint16) {
 	// targets don't overlap.
 	if d < 8192 {
 		ff := m.entries[i].first + m.entries[i].count + d
-		if compare(ff, seqno) < 0 {
+		if ff < seqno {
 			f = ff
 		}
 	}
@@ -110,20 +115,20 @@ func addMapping(m *Map, seqno, delta, pidDelta uint16) {
 	m.lastEntry = j
 }
 
-// direct maps a seqno to a target seqno.  It returns true if the seqno
-// could be mapped, the target seqno, and the pid delta to apply.
+// direct maps an extended seqno to a target seqno.  It returns true if
+// the seqno could be mapped, the target seqno, and the pid delta to apply.
 // Called with m.mu taken.
-func (m *Map) direct(seqno uint16) (bool, uint16, uint16) {
+func (m *Map) direct(seqno int64) (bool, uint16, uint16) {
 	if len(m.entries) == 0 {
 		return false, 0, 0
 	}
 	i := m.lastEntry
 	for {
 		f := m.entries[i].first
-		if compare(seqno, f) >= 0 {
-			if compare(seqno, f+m.entries[i].count) < 0 {
+		if seqno >= f {
+			if seqno < f+m.entries[i].count {
 				return true,
-					seqno + m.entries[i].delta,
+					uint16(seqno + m.entries[i].delta),
 					m.entries[i].pidDelta
 			}
 			return false, 0, 0
@@ -157,13 +162,14 @@ func (m *Map) Reverse(seqno uint16) (bool, uint16, uint16) {
 		return false, 0, 0
 	}
 
+	t := rtptime.ExtendSeqno(m.next+m.delta, seqno)
 	i := m.lastEntry
 	for {
 		f := m.entries[i].first + m.entries[i].delta
-		if compare(seqno, f) >= 0 {
-			if compare(seqno, f+m.entries[i].count) < 0 {
+		if t >= f {
+			if t < f+m.entries[i].count {
 				return true,
-					seqno - m.entries[i].delta,
+					uint16(t - m.entries[i].delta),
 					m.entries[i].pidDelta
 			}
 			return false, 0, 0
@@ -186,14 +192,14 @@ func (m *Map) Drop(seqno uint16, pid uint16) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if seqno != m.next {
+	if seqno != uint16(m.next) {
 		return false
 	}
 
 	if len(m.entries) == 0 {
 		m.entries = []entry{
 			entry{
-				first:    seqno - 8192,
+				first:    m.next - 8192,
 				count:    8192,
 				delta:    0,
 				pidDelta: 0,
@@ -205,17 +211,6 @@ func (m *Map) Drop(seqno uint16, pid uint16) bool {
 	m.nextPid = pid
 
 	m.delta--
-	m.next = seqno + 1
+	m.next++
 	return true
 }
-
-// compare performs comparison modulo 2^16.
-func compare(s1, s2 uint16) int {
-	if s1 == s2 {
-		return 0
-	}
-	if ((s2 - s1) & 0x8000) != 0 {
-		return 1
-	}
-	return -1
-}
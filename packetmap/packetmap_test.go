@@ -1,6 +1,7 @@
 package packetmap
 
 import (
+	"math/rand"
 	"testing"
 )
 
@@ -258,3 +259,43 @@ func TestReset(t *testing.T) {
 		t.Errorf("Expected 32001, 0, got %v, %v, %v", ok, s, p)
 	}
 }
+
+func TestRandomDrops(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	m := Map{}
+	seqno := uint16(r.Intn(0x10000))
+	target := seqno
+	dropped := uint16(0)
+	// many wraps, with the mapping of recent packets checked at each step
+	for i := 0; i < 300000; i++ {
+		if r.Intn(10) == 0 && m.Drop(seqno, seqno) {
+			dropped++
+			seqno++
+			continue
+		}
+		ok, s, p := m.Map(seqno, seqno)
+		if !ok || s != target || p != dropped {
+			t.Fatalf("Packet %v: expected %v, %v, got %v, %v, %v",
+				i, target, dropped, ok, s, p)
+		}
+		ok, s, p = m.Reverse(target)
+		if !ok || s != seqno || p != dropped {
+			t.Fatalf("Reverse %v: expected %v, %v, got %v, %v, %v",
+				i, seqno, dropped, ok, s, p)
+		}
+		// map an earlier packet again, as if it were retransmitted
+		if i > 100 && r.Intn(4) == 0 {
+			back := uint16(r.Intn(50))
+			ok, s, _ = m.Map(seqno-back, seqno-back)
+			if ok {
+				ok2, s2, _ := m.Reverse(s)
+				if !ok2 || s2 != seqno-back {
+					t.Fatalf("Round trip %v: expected %v, got %v",
+						i, seqno-back, s2)
+				}
+			}
+		}
+		target++
+		seqno++
+	}
+}
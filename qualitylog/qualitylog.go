@@ -0,0 +1,272 @@
+// Package qualitylog periodically appends the statistics of every
+// connection to a file, in NDJSON format, for offline analysis.
+// Records are written asynchronously, and the file is rotated when it
+// reaches a given size.
+package qualitylog
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/stats"
+)
+
+var logger = logging.New("qualitylog")
+
+const (
+	defaultInterval = 10 * time.Second
+	defaultMaxSize  = 16 * 1024 * 1024
+	defaultMaxFiles = 4
+	// the number of records waiting to be written
+	queueLength = 1024
+)
+
+// Record is the JSON representation of the statistics of a single
+// connection.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Group     string    `json:"group"`
+	Client    string    `json:"client"`
+	Username  string    `json:"username,omitempty"`
+	Direction string    `json:"direction"`
+	stats.Conn
+}
+
+// Records returns the records for the given statistics.
+func Records(now time.Time, gs []stats.GroupStats) []Record {
+	var records []Record
+	for _, g := range gs {
+		for _, c := range g.Clients {
+			add := func(direction string, conns []stats.Conn) {
+				for _, conn := range conns {
+					records = append(records, Record{
+						Time:      now,
+						Group:     g.Name,
+						Client:    c.Id,
+						Username:  c.Username,
+						Direction: direction,
+						Conn:      conn,
+					})
+				}
+			}
+			add("up", c.Up)
+			add("down", c.Down)
+		}
+	}
+	return records
+}
+
+// Check checks a configuration.
+func Check(c *group.QualityLog) error {
+	if c.File == "" {
+		return errors.New("no file")
+	}
+	if c.Interval < 0 || c.MaxSize < 0 || c.MaxFiles < 0 {
+		return errors.New("negative value")
+	}
+	return nil
+}
+
+var state struct {
+	mu     sync.Mutex
+	config *group.QualityLog
+	cancel chan struct{}
+	done   chan struct{}
+}
+
+// Configure starts, stops or reconfigures the quality log.  If c is
+// nil, the log is stopped, after all pending records have been written.
+func Configure(c *group.QualityLog) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if c != nil && state.config != nil && *c == *state.config {
+		return nil
+	}
+
+	if state.cancel != nil {
+		close(state.cancel)
+		<-state.done
+		state.config = nil
+		state.cancel = nil
+		state.done = nil
+	}
+
+	if c == nil {
+		return nil
+	}
+
+	err := Check(c)
+	if err != nil {
+		return err
+	}
+
+	interval := time.Duration(c.Interval) * time.Second
+	if interval == 0 {
+		interval = defaultInterval
+	}
+	maxSize := c.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultMaxSize
+	}
+	maxFiles := c.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultMaxFiles
+	}
+
+	f, err := openRotating(c.File, maxSize, maxFiles)
+	if err != nil {
+		return err
+	}
+
+	config := *c
+	state.config = &config
+	state.cancel = make(chan struct{})
+	state.done = make(chan struct{})
+	queue := make(chan []byte, queueLength)
+	go collect(interval, queue, state.cancel)
+	go write(f, queue, state.done)
+	return nil
+}
+
+// collect queues the records at each interval.  It closes queue when
+// cancel is closed.
+func collect(interval time.Duration, queue chan<- []byte, cancel <-chan struct{}) {
+	defer close(queue)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			dropped := 0
+			for _, r := range Records(now, stats.GetGroups()) {
+				b, err := json.Marshal(r)
+				if err != nil {
+					logger.Warnf("Quality log: %v", err)
+					continue
+				}
+				select {
+				case queue <- append(b, '\n'):
+				default:
+					dropped++
+				}
+			}
+			if dropped > 0 {
+				logger.Warnf("Quality log: dropped %v records",
+					dropped)
+			}
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// write writes the records in queue to f, then closes f and done.
+func write(f *rotatingFile, queue <-chan []byte, done chan<- struct{}) {
+	defer close(done)
+	failed := false
+	for b := range queue {
+		err := f.Write(b)
+		if err != nil {
+			// avoid filling the log with identical messages
+			if !failed {
+				logger.Warnf("Quality log: %v", err)
+			}
+			failed = true
+			continue
+		}
+		failed = false
+	}
+	err := f.Close()
+	if err != nil {
+		logger.Warnf("Quality log: %v", err)
+	}
+}
+
+// A rotatingFile is a file that is renamed to name.1 when it reaches
+// maxSize, name.1 being renamed to name.2, and so on up to maxFiles.
+type rotatingFile struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotating(name string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		name:     name,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = fi.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	rotated := func(i int) string {
+		if i == 0 {
+			return f.name
+		}
+		return f.name + "." + strconv.Itoa(i)
+	}
+	for i := f.maxFiles; i > 0; i-- {
+		err := os.Rename(rotated(i-1), rotated(i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return f.open()
+}
+
+// Write writes b, which must be a single record, rotating the file
+// first if necessary.
+func (f *rotatingFile) Write(b []byte) error {
+	if f.file == nil || (f.size > 0 && f.size+int64(len(b)) > f.maxSize) {
+		err := f.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
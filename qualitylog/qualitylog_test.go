@@ -0,0 +1,145 @@
+package qualitylog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/stats"
+)
+
+func TestRecords(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tid := uint8(1)
+	gs := []stats.GroupStats{{
+		Name: "test",
+		Clients: []*stats.Client{{
+			Id:       "c1",
+			Username: "bob",
+			Up: []stats.Conn{{
+				Id: "u1",
+				Transport: &stats.Transport{
+					Protocol: "udp",
+					Local:    "host",
+					Remote:   "srflx",
+				},
+				Tracks: []stats.Track{{Bitrate: 1000, Loss: 0.5}},
+			}},
+			Down: []stats.Conn{{
+				Id:     "d1",
+				Tracks: []stats.Track{{Tid: &tid}},
+			}},
+		}},
+	}}
+
+	records := Records(now, gs)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %v", len(records))
+	}
+
+	b, err := json.Marshal(records[0])
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	expected := `{"time":"2024-03-01T12:00:00Z","group":"test",` +
+		`"client":"c1","username":"bob","direction":"up","id":"u1",` +
+		`"transport":{"protocol":"udp","local":"host","remote":"srflx"},` +
+		`"tracks":[{"bitrate":1000,"loss":0.5}]}`
+	if string(b) != expected {
+		t.Errorf("Expected %v, got %v", expected, string(b))
+	}
+
+	if records[1].Direction != "down" || records[1].Id != "d1" ||
+		*records[1].Tracks[0].Tid != 1 {
+		t.Errorf("Bad record %v", records[1])
+	}
+}
+
+func TestRotate(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "quality.log")
+	f, err := openRotating(name, 10, 2)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for _, r := range []string{"aaaa\n", "bbbb\n", "cccc\n",
+		"dddd\n", "eeee\n", "fffffffffffff\n", "gggg\n"} {
+		err := f.Write([]byte(r))
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	expected := map[string]string{
+		"":   "gggg\n",
+		".1": "fffffffffffff\n",
+		".2": "eeee\n",
+	}
+	for suffix, e := range expected {
+		b, err := os.ReadFile(name + suffix)
+		if err != nil || string(b) != e {
+			t.Errorf("%v: expected %q, got %q (%v)",
+				suffix, e, b, err)
+		}
+	}
+	_, err = os.Stat(name + ".3")
+	if !os.IsNotExist(err) {
+		t.Errorf("Too many files: %v", err)
+	}
+
+	// an existing file is appended to
+	f, err = openRotating(name, 10, 2)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	f.Write([]byte("h\n"))
+	f.Close()
+	b, _ := os.ReadFile(name)
+	if string(b) != "gggg\nh\n" {
+		t.Errorf("Expected append, got %q", b)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "quality.log")
+
+	err := Configure(&group.QualityLog{})
+	if err == nil {
+		t.Errorf("Configure succeeded without a file")
+	}
+
+	err = Configure(&group.QualityLog{File: name})
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	err = Configure(&group.QualityLog{File: name})
+	if err != nil {
+		t.Errorf("Configure: %v", err)
+	}
+	err = Configure(nil)
+	if err != nil {
+		t.Errorf("Configure: %v", err)
+	}
+	if state.cancel != nil {
+		t.Errorf("Logger is still running")
+	}
+	_, err = os.Stat(name)
+	if err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+
+	err = Configure(&group.QualityLog{
+		File: filepath.Join(name, "impossible"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "impossible") {
+		t.Errorf("Expected error, got %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// AMF0 type markers
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0A
+	amfDate        = 0x0B
+	amfLongString  = 0x0C
+)
+
+var errAMF = errors.New("malformed AMF data")
+
+// amfObjectValue is an AMF0 object or ECMA array.
+type amfObjectValue map[string]interface{}
+
+// amfNullValue represents both null and undefined.
+type amfNullValue struct{}
+
+// decodeAMF decodes a sequence of AMF0 values.  Numbers are decoded as
+// float64, and objects as amfObjectValue.
+func decodeAMF(data []byte) ([]interface{}, error) {
+	r := bytes.NewReader(data)
+	var values []interface{}
+	for r.Len() > 0 {
+		v, err := decodeAMFValue(r)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func readAMFString(r *bytes.Reader, long bool) (string, error) {
+	var n uint32
+	if long {
+		err := binary.Read(r, binary.BigEndian, &n)
+		if err != nil {
+			return "", errAMF
+		}
+	} else {
+		var n16 uint16
+		err := binary.Read(r, binary.BigEndian, &n16)
+		if err != nil {
+			return "", errAMF
+		}
+		n = uint32(n16)
+	}
+	if int64(n) > int64(r.Len()) {
+		return "", errAMF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return "", errAMF
+	}
+	return string(b), nil
+}
+
+func decodeAMFObject(r *bytes.Reader) (amfObjectValue, error) {
+	o := make(amfObjectValue)
+	for {
+		key, err := readAMFString(r, false)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			m, err := r.ReadByte()
+			if err != nil || m != amfObjectEnd {
+				return nil, errAMF
+			}
+			return o, nil
+		}
+		v, err := decodeAMFValue(r)
+		if err != nil {
+			return nil, err
+		}
+		o[key] = v
+	}
+}
+
+func decodeAMFValue(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, errAMF
+	}
+	switch marker {
+	case amfNumber:
+		var v float64
+		err := binary.Read(r, binary.BigEndian, &v)
+		if err != nil {
+			return nil, errAMF
+		}
+		return v, nil
+	case amfBoolean:
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errAMF
+		}
+		return b != 0, nil
+	case amfString:
+		return readAMFString(r, false)
+	case amfLongString:
+		return readAMFString(r, true)
+	case amfObject:
+		return decodeAMFObject(r)
+	case amfNull, amfUndefined:
+		return amfNullValue{}, nil
+	case amfECMAArray:
+		// the count is only a hint, the array is terminated like an
+		// object
+		var count uint32
+		err := binary.Read(r, binary.BigEndian, &count)
+		if err != nil {
+			return nil, errAMF
+		}
+		return decodeAMFObject(r)
+	case amfStrictArray:
+		var count uint32
+		err := binary.Read(r, binary.BigEndian, &count)
+		if err != nil || int64(count) > int64(r.Len()) {
+			return nil, errAMF
+		}
+		a := make([]interface{}, 0, count)
+		for i := uint32(0); i < count; i++ {
+			v, err := decodeAMFValue(r)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case amfDate:
+		var v float64
+		var tz int16
+		err := binary.Read(r, binary.BigEndian, &v)
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, &tz)
+		}
+		if err != nil {
+			return nil, errAMF
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported AMF type %v", marker)
+	}
+}
+
+func writeAMFString(b *bytes.Buffer, s string) {
+	if len(s) > 0xFFFF {
+		b.WriteByte(amfLongString)
+		binary.Write(b, binary.BigEndian, uint32(len(s)))
+	} else {
+		b.WriteByte(amfString)
+		binary.Write(b, binary.BigEndian, uint16(len(s)))
+	}
+	b.WriteString(s)
+}
+
+// encodeAMF encodes a sequence of values.  Only the types returned by
+// decodeAMF, and int, are supported.
+func encodeAMF(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		encodeAMFValue(&b, v)
+	}
+	return b.Bytes()
+}
+
+func encodeAMFValue(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case float64:
+		b.WriteByte(amfNumber)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case int:
+		encodeAMFValue(b, float64(v))
+	case bool:
+		b.WriteByte(amfBoolean)
+		if v {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case string:
+		writeAMFString(b, v)
+	case amfObjectValue:
+		b.WriteByte(amfObject)
+		// sort the keys, which makes the output deterministic
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			binary.Write(b, binary.BigEndian, uint16(len(k)))
+			b.WriteString(k)
+			encodeAMFValue(b, v[k])
+		}
+		b.Write([]byte{0, 0, amfObjectEnd})
+	case []interface{}:
+		b.WriteByte(amfStrictArray)
+		binary.Write(b, binary.BigEndian, uint32(len(v)))
+		for _, w := range v {
+			encodeAMFValue(b, w)
+		}
+	default:
+		b.WriteByte(amfNull)
+	}
+}
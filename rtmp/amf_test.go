@@ -0,0 +1,66 @@
+package rtmp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAMFRoundTrip(t *testing.T) {
+	values := []interface{}{
+		"connect",
+		1.0,
+		amfObjectValue{
+			"app":   "group",
+			"flash": "FMLE/3.0",
+			"audio": true,
+			"nested": amfObjectValue{
+				"x": 42.0,
+			},
+		},
+		amfNullValue{},
+		[]interface{}{"a", 2.0},
+	}
+	data := encodeAMF(values...)
+	decoded, err := decodeAMF(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !reflect.DeepEqual(values, decoded) {
+		t.Errorf("Expected %v, got %v", values, decoded)
+	}
+}
+
+func TestAMFECMAArray(t *testing.T) {
+	// onMetaData as sent by ffmpeg, truncated to two properties
+	data := []byte{
+		amfString, 0, 10,
+		'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a',
+		amfECMAArray, 0, 0, 0, 2,
+		0, 5, 't', 'i', 't', 'l', 'e',
+		amfString, 0, 3, 'f', 'o', 'o',
+		0, 5, 'w', 'i', 'd', 't', 'h',
+		amfNumber, 0x40, 0x94, 0, 0, 0, 0, 0, 0,
+		0, 0, amfObjectEnd,
+	}
+	values, err := decodeAMF(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	expected := []interface{}{
+		"onMetaData",
+		amfObjectValue{"title": "foo", "width": 1280.0},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+}
+
+func TestAMFTruncated(t *testing.T) {
+	data := encodeAMF("connect", 1.0, amfObjectValue{"app": "group"})
+	for i := 1; i < len(data); i++ {
+		values, err := decodeAMF(data[:i])
+		if err == nil && len(values) == 3 {
+			t.Errorf("Decoded truncated data %v", data[:i])
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// message types
+const (
+	msgSetChunkSize     = 1
+	msgAbort            = 2
+	msgAck              = 3
+	msgUserControl      = 4
+	msgWindowAckSize    = 5
+	msgSetPeerBandwidth = 6
+	msgAudio            = 8
+	msgVideo            = 9
+	msgDataAMF3         = 15
+	msgCommandAMF3      = 17
+	msgDataAMF0         = 18
+	msgCommandAMF0      = 20
+)
+
+const maxMessageSize = 8 * 1024 * 1024
+
+var errMessageTooLarge = errors.New("RTMP message too large")
+
+// A message is a complete RTMP message.
+type message struct {
+	typ       uint8
+	stream    uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// chunkStream is the state of a chunk stream on input.
+type chunkStream struct {
+	typ       uint8
+	stream    uint32
+	length    uint32
+	timestamp uint32
+	// the timestamp field of the last chunk header, which is a delta
+	// except in type 0 headers
+	tsField  uint32
+	extended bool
+	buf      []byte
+}
+
+// A chunkReader splits the input into messages.
+type chunkReader struct {
+	r         *bufio.Reader
+	chunkSize uint32
+	streams   map[uint32]*chunkStream
+	// the number of bytes read, for acknowledgements
+	bytes uint64
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{
+		r:         bufio.NewReader(r),
+		chunkSize: 128,
+		streams:   make(map[uint32]*chunkStream),
+	}
+}
+
+func (cr *chunkReader) read(buf []byte) error {
+	n, err := io.ReadFull(cr.r, buf)
+	cr.bytes += uint64(n)
+	return err
+}
+
+func get24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func put24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+// readMessage returns the next complete message.
+func (cr *chunkReader) readMessage() (*message, error) {
+	var buf [11]byte
+	for {
+		err := cr.read(buf[:1])
+		if err != nil {
+			return nil, err
+		}
+		format := buf[0] >> 6
+		csid := uint32(buf[0] & 0x3F)
+		switch csid {
+		case 0:
+			err = cr.read(buf[:1])
+			csid = 64 + uint32(buf[0])
+		case 1:
+			err = cr.read(buf[:2])
+			csid = 64 + uint32(buf[0]) + uint32(buf[1])*256
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		cs := cr.streams[csid]
+		if cs == nil {
+			if format != 0 {
+				return nil, errors.New("RTMP chunk stream " +
+					"doesn't start with a full header")
+			}
+			cs = &chunkStream{}
+			cr.streams[csid] = cs
+		}
+
+		switch format {
+		case 0:
+			err = cr.read(buf[:11])
+			if err != nil {
+				return nil, err
+			}
+			cs.tsField = get24(buf[0:3])
+			cs.length = get24(buf[3:6])
+			cs.typ = buf[6]
+			cs.stream = binary.LittleEndian.Uint32(buf[7:11])
+		case 1:
+			err = cr.read(buf[:7])
+			if err != nil {
+				return nil, err
+			}
+			cs.tsField = get24(buf[0:3])
+			cs.length = get24(buf[3:6])
+			cs.typ = buf[6]
+		case 2:
+			err = cr.read(buf[:3])
+			if err != nil {
+				return nil, err
+			}
+			cs.tsField = get24(buf[0:3])
+		}
+		if format != 3 {
+			cs.extended = cs.tsField == 0xFFFFFF
+		}
+		ts := cs.tsField
+		if cs.extended {
+			err = cr.read(buf[:4])
+			if err != nil {
+				return nil, err
+			}
+			ts = binary.BigEndian.Uint32(buf[:4])
+			if format != 3 {
+				cs.tsField = 0xFFFFFF
+			}
+		}
+
+		if len(cs.buf) == 0 {
+			// first chunk of a message
+			if format == 0 {
+				cs.timestamp = ts
+			} else {
+				cs.timestamp += ts
+			}
+			if cs.length > maxMessageSize {
+				return nil, errMessageTooLarge
+			}
+			// don't trust the length to preallocate the buffer
+			if cs.buf == nil {
+				cs.buf = []byte{}
+			}
+		}
+
+		n := cs.length - uint32(len(cs.buf))
+		if n > cr.chunkSize {
+			n = cr.chunkSize
+		}
+		start := len(cs.buf)
+		cs.buf = append(cs.buf, make([]byte, n)...)
+		err = cr.read(cs.buf[start:])
+		if err != nil {
+			return nil, err
+		}
+
+		if uint32(len(cs.buf)) >= cs.length {
+			m := &message{
+				typ:       cs.typ,
+				stream:    cs.stream,
+				timestamp: cs.timestamp,
+				payload:   cs.buf,
+			}
+			cs.buf = nil
+			return m, nil
+		}
+	}
+}
+
+// abort discards a partially received message.
+func (cr *chunkReader) abort(csid uint32) {
+	if cs := cr.streams[csid]; cs != nil {
+		cs.buf = nil
+	}
+}
+
+// A chunkWriter writes messages as chunks.
+type chunkWriter struct {
+	w         *bufio.Writer
+	chunkSize uint32
+}
+
+func newChunkWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{
+		w:         bufio.NewWriter(w),
+		chunkSize: 128,
+	}
+}
+
+// writeMessage writes a message.  We always use full headers, which is
+// wasteful but simple; the overhead is small compared to media.
+func (cw *chunkWriter) writeMessage(csid uint8, m *message) error {
+	var header [12]byte
+	header[0] = csid & 0x3F
+	ts := m.timestamp
+	if ts >= 0xFFFFFF {
+		put24(header[1:4], 0xFFFFFF)
+	} else {
+		put24(header[1:4], ts)
+	}
+	put24(header[4:7], uint32(len(m.payload)))
+	header[7] = m.typ
+	binary.LittleEndian.PutUint32(header[8:12], m.stream)
+	_, err := cw.w.Write(header[:])
+	if err != nil {
+		return err
+	}
+	var ext [4]byte
+	binary.BigEndian.PutUint32(ext[:], ts)
+	if ts >= 0xFFFFFF {
+		cw.w.Write(ext[:])
+	}
+
+	payload := m.payload
+	for {
+		n := uint32(len(payload))
+		if n > cw.chunkSize {
+			n = cw.chunkSize
+		}
+		_, err := cw.w.Write(payload[:n])
+		if err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+		cw.w.WriteByte(0xC0 | (csid & 0x3F))
+		if ts >= 0xFFFFFF {
+			cw.w.Write(ext[:])
+		}
+	}
+	return cw.w.Flush()
+}
@@ -0,0 +1,89 @@
+package rtmp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	w := newChunkWriter(&b)
+	w.chunkSize = 100
+	messages := []*message{
+		{typ: msgVideo, stream: 1, timestamp: 10,
+			payload: bytes.Repeat([]byte{1}, 250)},
+		{typ: msgAudio, stream: 1, timestamp: 0x1000000,
+			payload: bytes.Repeat([]byte{2}, 300)},
+		{typ: msgCommandAMF0, stream: 0, timestamp: 0,
+			payload: []byte{}},
+	}
+	for _, m := range messages {
+		err := w.writeMessage(4, m)
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	r := newChunkReader(&b)
+	r.chunkSize = 100
+	for _, m := range messages {
+		mm, err := r.readMessage()
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if !reflect.DeepEqual(m, mm) {
+			t.Errorf("Expected %v, got %v", m, mm)
+		}
+	}
+	if r.bytes == 0 {
+		t.Errorf("Bytes not counted")
+	}
+}
+
+func TestChunkHeaders(t *testing.T) {
+	data := []byte{
+		// type 0, csid 6, ts 100, length 2, video, stream 1
+		0x06, 0, 0, 100, 0, 0, 2, msgVideo, 1, 0, 0, 0,
+		1, 2,
+		// type 1, delta 40, length 1, audio
+		0x46, 0, 0, 40, 0, 0, 1, msgAudio,
+		3,
+		// type 2, delta 20
+		0x86, 0, 0, 20,
+		4,
+		// type 3, same delta
+		0xC6,
+		5,
+		// type 0 with a two-byte chunk stream id 64 + 1
+		0x00, 1, 0, 0, 0, 0, 0, 1, msgVideo, 1, 0, 0, 0,
+		6,
+	}
+	expected := []message{
+		{msgVideo, 1, 100, []byte{1, 2}},
+		{msgAudio, 1, 140, []byte{3}},
+		{msgAudio, 1, 160, []byte{4}},
+		{msgAudio, 1, 180, []byte{5}},
+		{msgVideo, 1, 0, []byte{6}},
+	}
+
+	r := newChunkReader(bytes.NewReader(data))
+	for _, e := range expected {
+		m, err := r.readMessage()
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if !reflect.DeepEqual(*m, e) {
+			t.Errorf("Expected %v, got %v", e, *m)
+		}
+	}
+}
+
+func TestChunkTooLarge(t *testing.T) {
+	data := []byte{0x06, 0, 0, 0, 0xFF, 0xFF, 0xFF, msgVideo, 1, 0, 0, 0}
+	r := newChunkReader(bytes.NewReader(data))
+	_, err := r.readMessage()
+	if err != errMessageTooLarge {
+		t.Errorf("Expected errMessageTooLarge, got %v", err)
+	}
+}
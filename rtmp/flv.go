@@ -0,0 +1,220 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errTruncated = errors.New("truncated FLV data")
+
+// avcConfig is the contents of an AVCDecoderConfigurationRecord.
+type avcConfig struct {
+	lengthSize int
+	sps, pps   [][]byte
+}
+
+// parseAVCConfig parses an AVCDecoderConfigurationRecord, ISO/IEC
+// 14496-15 Section 5.2.4.1.
+func parseAVCConfig(data []byte) (*avcConfig, error) {
+	if len(data) < 6 {
+		return nil, errTruncated
+	}
+	if data[0] != 1 {
+		return nil, errors.New("unknown AVC configuration version")
+	}
+	config := &avcConfig{lengthSize: int(data[4]&3) + 1}
+	if config.lengthSize == 3 {
+		return nil, errors.New("bad NAL length size")
+	}
+
+	readSets := func(data []byte, count int) ([][]byte, []byte, error) {
+		var sets [][]byte
+		for i := 0; i < count; i++ {
+			if len(data) < 2 {
+				return nil, nil, errTruncated
+			}
+			n := int(binary.BigEndian.Uint16(data))
+			if len(data) < 2+n {
+				return nil, nil, errTruncated
+			}
+			sets = append(sets, data[2:2+n])
+			data = data[2+n:]
+		}
+		return sets, data, nil
+	}
+
+	var err error
+	rest := data[6:]
+	config.sps, rest, err = readSets(rest, int(data[5]&0x1F))
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < 1 {
+		return nil, errTruncated
+	}
+	config.pps, _, err = readSets(rest[1:], int(rest[0]))
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// splitNALUs splits length-prefixed NAL units.
+func splitNALUs(data []byte, lengthSize int) ([][]byte, error) {
+	var nalus [][]byte
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nil, errTruncated
+		}
+		n := 0
+		for i := 0; i < lengthSize; i++ {
+			n = n<<8 | int(data[i])
+		}
+		data = data[lengthSize:]
+		if n > len(data) {
+			return nil, errTruncated
+		}
+		if n > 0 {
+			nalus = append(nalus, data[:n])
+		}
+		data = data[n:]
+	}
+	return nalus, nil
+}
+
+// annexB converts an access unit to Annex B format.  Unlike in RTP, FLV
+// streams usually carry the parameter sets in the decoder configuration
+// only, so we insert them before IDR frames.
+func annexB(nalus [][]byte, config *avcConfig) []byte {
+	idr := false
+	haveSPS := false
+	for _, n := range nalus {
+		switch n[0] & 0x1F {
+		case 5:
+			idr = true
+		case 7:
+			haveSPS = true
+		}
+	}
+
+	var out []byte
+	startCode := []byte{0, 0, 0, 1}
+	if idr && !haveSPS && config != nil {
+		for _, s := range config.sps {
+			out = append(out, startCode...)
+			out = append(out, s...)
+		}
+		for _, p := range config.pps {
+			out = append(out, startCode...)
+			out = append(out, p...)
+		}
+	}
+	for _, n := range nalus {
+		out = append(out, startCode...)
+		out = append(out, n...)
+	}
+	return out
+}
+
+// videoTag is a parsed FLV video tag.
+type videoTag struct {
+	keyframe bool
+	// true for a decoder configuration, false for coded frames
+	config bool
+	// the difference between presentation and decoding times, in ms
+	compositionTime int32
+	data            []byte
+}
+
+var errUnsupportedCodec = errors.New("unsupported codec")
+
+func getSI24(b []byte) int32 {
+	v := int32(get24(b))
+	if v&0x800000 != 0 {
+		v -= 0x1000000
+	}
+	return v
+}
+
+// parseVideoTag parses the body of an H.264 video tag, in either the
+// legacy format or the Enhanced RTMP format.  Other codecs yield
+// errUnsupportedCodec, and tags that carry no frames yield nil.
+func parseVideoTag(data []byte) (*videoTag, error) {
+	if len(data) < 1 {
+		return nil, errTruncated
+	}
+	if data[0]&0x80 == 0 {
+		// legacy format
+		if data[0]&0x0F != 7 {
+			return nil, errUnsupportedCodec
+		}
+		if len(data) < 5 {
+			return nil, errTruncated
+		}
+		switch data[1] {
+		case 0, 1:
+			return &videoTag{
+				keyframe:        data[0]>>4 == 1,
+				config:          data[1] == 0,
+				compositionTime: getSI24(data[2:5]),
+				data:            data[5:],
+			}, nil
+		default:
+			// end of sequence
+			return nil, nil
+		}
+	}
+
+	// Enhanced RTMP
+	if len(data) < 5 {
+		return nil, errTruncated
+	}
+	if string(data[1:5]) != "avc1" {
+		return nil, errUnsupportedCodec
+	}
+	frameType := (data[0] >> 4) & 0x07
+	tag := &videoTag{keyframe: frameType == 1}
+	switch data[0] & 0x0F {
+	case 0:
+		tag.config = true
+		tag.data = data[5:]
+	case 1:
+		if len(data) < 8 {
+			return nil, errTruncated
+		}
+		tag.compositionTime = getSI24(data[5:8])
+		tag.data = data[8:]
+	case 3:
+		tag.data = data[5:]
+	default:
+		return nil, nil
+	}
+	if frameType == 5 {
+		// command frame, carries no video
+		return nil, nil
+	}
+	return tag, nil
+}
+
+// parseAudioTag parses the body of an audio tag, and returns the Opus
+// packet it contains, if any.  Opus is only supported in the Enhanced
+// RTMP format.
+func parseAudioTag(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errTruncated
+	}
+	if data[0]>>4 != 9 {
+		return nil, errUnsupportedCodec
+	}
+	if len(data) < 5 {
+		return nil, errTruncated
+	}
+	if string(data[1:5]) != "Opus" {
+		return nil, errUnsupportedCodec
+	}
+	if data[0]&0x0F != 1 {
+		// sequence start or end, which we don't need
+		return nil, nil
+	}
+	return data[5:], nil
+}
@@ -0,0 +1,116 @@
+package rtmp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var sps = []byte{0x67, 0x42, 0xe0, 0x1f}
+var pps = []byte{0x68, 0xce, 0x3c, 0x80}
+
+var avcConfigRecord = []byte{
+	1, 0x42, 0xe0, 0x1f, 0xFF, 0xE1,
+	0, 4, 0x67, 0x42, 0xe0, 0x1f,
+	1,
+	0, 4, 0x68, 0xce, 0x3c, 0x80,
+}
+
+func TestParseAVCConfig(t *testing.T) {
+	config, err := parseAVCConfig(avcConfigRecord)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if config.lengthSize != 4 ||
+		!reflect.DeepEqual(config.sps, [][]byte{sps}) ||
+		!reflect.DeepEqual(config.pps, [][]byte{pps}) {
+		t.Errorf("Bad config %v", config)
+	}
+
+	for i := 0; i < len(avcConfigRecord); i++ {
+		_, err := parseAVCConfig(avcConfigRecord[:i])
+		if err == nil {
+			t.Errorf("Parsed truncated record of length %v", i)
+		}
+	}
+}
+
+func TestAnnexB(t *testing.T) {
+	config, err := parseAVCConfig(avcConfigRecord)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	data := []byte{
+		0, 0, 0, 2, 0x09, 0xF0,
+		0, 0, 0, 3, 0x65, 1, 2,
+	}
+	nalus, err := splitNALUs(data, 4)
+	if err != nil || len(nalus) != 2 {
+		t.Fatalf("Split: %v %v", nalus, err)
+	}
+	out := annexB(nalus, config)
+	expected := bytes.Join([][]byte{
+		nil, sps, pps, {0x09, 0xF0}, {0x65, 1, 2},
+	}, []byte{0, 0, 0, 1})
+	if !bytes.Equal(out, expected) {
+		t.Errorf("Expected %v, got %v", expected, out)
+	}
+
+	// no parameter sets before non-IDR frames
+	nalus = [][]byte{{0x41, 1}}
+	out = annexB(nalus, config)
+	if !bytes.Equal(out, []byte{0, 0, 0, 1, 0x41, 1}) {
+		t.Errorf("Got %v", out)
+	}
+
+	_, err = splitNALUs([]byte{0, 0, 0, 5, 1}, 4)
+	if err == nil {
+		t.Errorf("Split truncated data")
+	}
+}
+
+func TestParseVideoTag(t *testing.T) {
+	tests := []struct {
+		data []byte
+		tag  *videoTag
+		err  error
+	}{
+		{[]byte{0x17, 0, 0, 0, 0, 1, 2},
+			&videoTag{true, true, 0, []byte{1, 2}}, nil},
+		{[]byte{0x27, 1, 0xFF, 0xFF, 0xFE, 3},
+			&videoTag{false, false, -2, []byte{3}}, nil},
+		{[]byte{0x17, 2, 0, 0, 0}, nil, nil},
+		{[]byte{0x12, 0, 0, 0, 0}, nil, errUnsupportedCodec},
+		{[]byte{0x17, 1}, nil, errTruncated},
+		// Enhanced RTMP
+		{[]byte{0x90, 'a', 'v', 'c', '1', 1, 2},
+			&videoTag{true, true, 0, []byte{1, 2}}, nil},
+		{[]byte{0xA1, 'a', 'v', 'c', '1', 0, 0, 40, 3},
+			&videoTag{false, false, 40, []byte{3}}, nil},
+		{[]byte{0x93, 'a', 'v', 'c', '1', 4},
+			&videoTag{true, false, 0, []byte{4}}, nil},
+		{[]byte{0x91, 'h', 'v', 'c', '1'}, nil, errUnsupportedCodec},
+	}
+	for _, tt := range tests {
+		tag, err := parseVideoTag(tt.data)
+		if err != tt.err || !reflect.DeepEqual(tag, tt.tag) {
+			t.Errorf("%v: expected %v %v, got %v %v",
+				tt.data, tt.tag, tt.err, tag, err)
+		}
+	}
+}
+
+func TestParseAudioTag(t *testing.T) {
+	data, err := parseAudioTag([]byte{0x91, 'O', 'p', 'u', 's', 1, 2})
+	if err != nil || !bytes.Equal(data, []byte{1, 2}) {
+		t.Errorf("Got %v %v", data, err)
+	}
+	data, err = parseAudioTag([]byte{0x90, 'O', 'p', 'u', 's', 1, 2})
+	if err != nil || data != nil {
+		t.Errorf("Sequence start: got %v %v", data, err)
+	}
+	_, err = parseAudioTag([]byte{0xAF, 1, 2})
+	if err != errUnsupportedCodec {
+		t.Errorf("AAC: got %v", err)
+	}
+}
@@ -0,0 +1,770 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/samplebuilder"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtpconn"
+	"github.com/jech/galene/rtptime"
+)
+
+const (
+	pushQueueLength = 512
+	pushChunkSize   = 4096
+	videoMaxLate    = 256
+	// the interval between keyframe requests, which bounds the time
+	// viewers wait before they can start decoding
+	pushKeyframeInterval = 2 * time.Second
+)
+
+// a pushMessage is a media message waiting to be sent
+type pushMessage struct {
+	typ       uint8
+	timestamp uint32
+	payload   []byte
+}
+
+// Push is a group client that publishes the streams of one user of
+// the group to an RTMP server, such as a live-streaming platform.
+type Push struct {
+	group  *group.Group
+	id     string
+	name   string
+	config group.Restream
+	queue  chan pushMessage
+	done   chan struct{}
+	start  time.Time
+	// set when a message has been dropped, until the next keyframe
+	dropped uint32
+
+	mu        sync.Mutex
+	closed    bool
+	conn      net.Conn
+	conns     map[string]*pushConn
+	current   *pushConn
+	audioSeen bool
+	sps, pps  []byte
+	sentSPS   []byte
+	sentPPS   []byte
+	lastTS    [2]uint32
+}
+
+// NewPush starts restreaming to the RTMP server with the given name in
+// the group's description.  The user, if not empty, selects the user
+// whose streams are sent.
+func NewPush(g *group.Group, name, user string) (rtpconn.Restreamer, error) {
+	config, ok := g.Description().Restreams[name]
+	if !ok {
+		return nil, group.UserError("unknown restream " + name)
+	}
+	if user != "" {
+		config.User = user
+	}
+	if !usesH264(g.Description().Codecs) {
+		return nil, group.UserError("this group doesn't use H.264")
+	}
+	c := &Push{
+		group:  g,
+		id:     newId(),
+		name:   name,
+		config: config,
+		queue:  make(chan pushMessage, pushQueueLength),
+		done:   make(chan struct{}),
+		start:  time.Now(),
+		conns:  make(map[string]*pushConn),
+	}
+	go c.run()
+	return c, nil
+}
+
+func usesH264(names []string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, "h264") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Push) Group() *group.Group {
+	return c.group
+}
+
+func (c *Push) Id() string {
+	return c.id
+}
+
+func (c *Push) RestreamName() string {
+	return c.name
+}
+
+func (c *Push) Username() string {
+	return "RTMP " + c.name
+}
+
+func (c *Push) SetUsername(string) {
+	return
+}
+
+func (c *Push) Permissions() []string {
+	return []string{"system"}
+}
+
+func (c *Push) SetPermissions(perms []string) {
+	return
+}
+
+func (c *Push) Data() map[string]interface{} {
+	return nil
+}
+
+func (c *Push) PushClient(group, kind, id, username string, perms []string, data map[string]interface{}) error {
+	return nil
+}
+
+func (c *Push) RequestConns(target group.Client, g *group.Group, id string) error {
+	return nil
+}
+
+func (c *Push) Joined(group, kind string) error {
+	return nil
+}
+
+func (c *Push) Kick(id string, user *string, message string) error {
+	err := c.Close()
+	group.DelClient(c)
+	return err
+}
+
+// Close stops restreaming.  The caller should then remove the client
+// from its group.
+func (c *Push) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conns := c.conns
+	c.conns = nil
+	c.current = nil
+	cn := c.conn
+	c.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.close()
+	}
+	if cn != nil {
+		cn.Close()
+	}
+	return nil
+}
+
+// fail is called when the connection to the server fails.
+func (c *Push) fail(err error) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	logger.Warnf("Restream %v/%v: %v", c.group.Name(), c.name, err)
+	c.group.WallOps("Restream " + c.name + " stopped: " + err.Error())
+	c.Close()
+	group.DelClient(c)
+}
+
+func (c *Push) run() {
+	cn, stream, err := c.connect()
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		cn.Close()
+		return
+	}
+	c.conn = cn
+	c.mu.Unlock()
+
+	logger.Infof("Restream %v/%v: publishing", c.group.Name(), c.name)
+
+	// we must keep reading, both to detect that the server has gone
+	// away and to prevent it from blocking
+	go func() {
+		_, err := io.Copy(io.Discard, cn)
+		if err == nil {
+			err = io.EOF
+		}
+		c.fail(err)
+	}()
+
+	w := newChunkWriter(cn)
+	w.chunkSize = pushChunkSize
+	ticker := time.NewTicker(pushKeyframeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.requestKeyframe()
+		case m := <-c.queue:
+			csid := uint8(4)
+			if m.typ == msgVideo {
+				csid = 6
+			}
+			cn.SetWriteDeadline(time.Now().Add(readTimeout))
+			err := w.writeMessage(csid, &message{
+				typ:       m.typ,
+				stream:    stream,
+				timestamp: m.timestamp,
+				payload:   m.payload,
+			})
+			if err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// clientHandshake performs the simple handshake from the client side.
+func clientHandshake(cn net.Conn) error {
+	c0c1 := make([]byte, 1+1536)
+	c0c1[0] = 3
+	_, err := rand.Read(c0c1[9:])
+	if err != nil {
+		return err
+	}
+	_, err = cn.Write(c0c1)
+	if err != nil {
+		return err
+	}
+	s0s1s2 := make([]byte, 1+1536+1536)
+	_, err = io.ReadFull(cn, s0s1s2)
+	if err != nil {
+		return err
+	}
+	if s0s1s2[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %v", s0s1s2[0])
+	}
+	_, err = cn.Write(s0s1s2[1 : 1+1536])
+	return err
+}
+
+// connect connects to the server and starts publishing.  It returns the
+// connection and the message stream id.
+func (c *Push) connect() (net.Conn, uint32, error) {
+	scheme, address, app, key, err := c.config.ParseURL()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dialer := &net.Dialer{Timeout: readTimeout}
+	var cn net.Conn
+	if scheme == "rtmps" {
+		cn, err = tls.DialWithDialer(dialer, "tcp", address, nil)
+	} else {
+		cn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stream, err := c.publish(cn, scheme+"://"+address+"/"+app, app, key)
+	if err != nil {
+		cn.Close()
+		return nil, 0, err
+	}
+	cn.SetDeadline(time.Time{})
+	return cn, stream, nil
+}
+
+// publish performs the RTMP handshake, and publishes a stream.
+func (c *Push) publish(cn net.Conn, tcURL, app, key string) (uint32, error) {
+	cn.SetDeadline(time.Now().Add(readTimeout))
+	err := clientHandshake(cn)
+	if err != nil {
+		return 0, err
+	}
+
+	r := newChunkReader(cn)
+	w := newChunkWriter(cn)
+
+	write := func(typ uint8, stream uint32, payload []byte) error {
+		return w.writeMessage(3, &message{
+			typ: typ, stream: stream, payload: payload,
+		})
+	}
+	command := func(stream uint32, values ...interface{}) error {
+		return write(msgCommandAMF0, stream, encodeAMF(values...))
+	}
+
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], pushChunkSize)
+	err = write(msgSetChunkSize, 0, b[:])
+	if err != nil {
+		return 0, err
+	}
+	w.chunkSize = pushChunkSize
+
+	err = command(0, "connect", 1, amfObjectValue{
+		"app":      app,
+		"type":     "nonprivate",
+		"flashVer": "FMLE/3.0 (compatible; Galene)",
+		"tcUrl":    tcURL,
+	})
+	if err == nil {
+		err = command(0, "releaseStream", 2, nil, key)
+	}
+	if err == nil {
+		err = command(0, "FCPublish", 3, nil, key)
+	}
+	if err == nil {
+		err = command(0, "createStream", 4, nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var stream uint32
+	publishing := false
+	for !publishing {
+		m, err := r.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		switch m.typ {
+		case msgSetChunkSize:
+			if len(m.payload) < 4 {
+				return 0, errTruncated
+			}
+			size := binary.BigEndian.Uint32(m.payload) & 0x7FFFFFFF
+			if size < 1 || size > maxMessageSize {
+				return 0, errors.New("bad chunk size")
+			}
+			r.chunkSize = size
+		case msgCommandAMF0:
+			values, err := decodeAMF(m.payload)
+			if err != nil {
+				return 0, err
+			}
+			if len(values) < 2 {
+				continue
+			}
+			name, _ := values[0].(string)
+			txid, _ := values[1].(float64)
+			switch name {
+			case "_error":
+				return 0, errors.New("server rejected command")
+			case "_result":
+				if txid != 4 {
+					continue
+				}
+				if len(values) < 4 {
+					return 0, errors.New("no stream id")
+				}
+				id, ok := values[3].(float64)
+				if !ok {
+					return 0, errors.New("bad stream id")
+				}
+				stream = uint32(id)
+				err = command(stream, "publish", 5, nil, key, "live")
+				if err != nil {
+					return 0, err
+				}
+			case "onStatus":
+				var info amfObjectValue
+				if len(values) >= 4 {
+					info, _ = values[3].(amfObjectValue)
+				}
+				level, _ := info["level"].(string)
+				code, _ := info["code"].(string)
+				if level == "error" {
+					return 0, errors.New(code)
+				}
+				if code == "NetStream.Publish.Start" {
+					publishing = true
+				}
+			}
+		}
+	}
+
+	err = w.writeMessage(4, &message{
+		typ:    msgDataAMF0,
+		stream: stream,
+		payload: encodeAMF("@setDataFrame", "onMetaData",
+			amfObjectValue{
+				"videocodecid": 7,
+				"encoder":      "Galene",
+			},
+		),
+	})
+	return stream, err
+}
+
+// send queues a message, and never blocks.  If the queue is full, the
+// message is dropped, and video is suspended until the next keyframe.
+func (c *Push) send(typ uint8, ts uint32, payload []byte) {
+	select {
+	case c.queue <- pushMessage{typ, ts, payload}:
+	default:
+		atomic.StoreUint32(&c.dropped, 1)
+	}
+}
+
+func (c *Push) requestKeyframe() {
+	c.mu.Lock()
+	pc := c.current
+	c.mu.Unlock()
+	if pc != nil && pc.video != nil {
+		pc.video.remote.RequestKeyframe()
+	}
+}
+
+func (c *Push) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
+	if c.group != g {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New("restream is closed")
+	}
+
+	if replace != "" {
+		c.delConn(replace)
+	}
+	c.delConn(id)
+
+	if up != nil {
+		_, username := up.User()
+		if c.config.User == "" || username == c.config.User {
+			pc := newPushConn(c, tracks)
+			if pc != nil {
+				c.conns[id] = pc
+			}
+		}
+	}
+
+	if c.current == nil {
+		for _, pc := range c.conns {
+			c.switchTo(pc)
+			break
+		}
+	}
+	return nil
+}
+
+// called locked
+func (c *Push) delConn(id string) {
+	pc := c.conns[id]
+	if pc == nil {
+		return
+	}
+	delete(c.conns, id)
+	if c.current == pc {
+		c.current = nil
+	}
+	pc.close()
+}
+
+// switchTo starts sending the streams of pc.  Called locked.
+func (c *Push) switchTo(pc *pushConn) {
+	c.current = pc
+	c.sps = nil
+	c.pps = nil
+	atomic.StoreUint32(&c.dropped, 1)
+	for _, t := range pc.tracks() {
+		err := t.remote.AddLocal(t)
+		if err != nil {
+			logger.Warnf("Restream: %v", err)
+		}
+	}
+	if pc.video != nil {
+		pc.video.remote.RequestKeyframe()
+	}
+}
+
+// timestamp returns the RTMP timestamp of a message of the given type,
+// which is never smaller than that of the previous message of that type.
+// Called locked.
+func (c *Push) timestamp(video bool, ms int64) uint32 {
+	i := 0
+	if video {
+		i = 1
+	}
+	ts := uint32(ms)
+	if ms < 0 || int32(ts-c.lastTS[i]) < 0 {
+		ts = c.lastTS[i]
+	}
+	c.lastTS[i] = ts
+	return ts
+}
+
+// A pushConn is a stream that may be restreamed.
+type pushConn struct {
+	client       *Push
+	audio, video *pushTrack
+}
+
+// newPushConn returns a pushConn for the given tracks, or nil if none of
+// them is suitable.
+func newPushConn(c *Push, tracks []conn.UpTrack) *pushConn {
+	pc := &pushConn{client: c}
+	for _, t := range tracks {
+		codec := t.Codec().MimeType
+		switch {
+		case codec == webrtc.MimeTypeOpus:
+			if pc.audio == nil {
+				pc.audio = &pushTrack{conn: pc, remote: t}
+			}
+		case codec == webrtc.MimeTypeH264:
+			// with simulcast, prefer the highest layer
+			if pc.video == nil || pc.video.remote.Label() == "l" {
+				pc.video = &pushTrack{
+					conn: pc, remote: t, video: true,
+					builder: samplebuilder.New(
+						videoMaxLate,
+						&codecs.H264Packet{IsAVC: true},
+						90000,
+					),
+				}
+			}
+		}
+	}
+	if pc.video == nil {
+		return nil
+	}
+	return pc
+}
+
+func (pc *pushConn) tracks() []*pushTrack {
+	var tracks []*pushTrack
+	if pc.audio != nil {
+		tracks = append(tracks, pc.audio)
+	}
+	if pc.video != nil {
+		tracks = append(tracks, pc.video)
+	}
+	return tracks
+}
+
+func (pc *pushConn) close() {
+	for _, t := range pc.tracks() {
+		t.remote.DelLocal(t)
+	}
+}
+
+type pushTrack struct {
+	conn    *pushConn
+	remote  conn.UpTrack
+	video   bool
+	builder *samplebuilder.SampleBuilder
+
+	// mapping from RTP time to RTMP time, protected by the client's
+	// mutex
+	timestamps rtptime.TimestampExtender
+	started    bool
+	origin     int64
+	base       int64
+}
+
+func (t *pushTrack) Write(buf []byte) (int, error) {
+	c := t.conn.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.current != t.conn {
+		return len(buf), nil
+	}
+
+	// samplebuilder retains packets
+	data := make([]byte, len(buf))
+	copy(data, buf)
+	p := new(rtp.Packet)
+	err := p.Unmarshal(data)
+	if err != nil {
+		return 0, nil
+	}
+
+	now := time.Now()
+	if !t.video {
+		if len(p.Payload) > 0 {
+			t.gotAudio(p.Payload, p.Timestamp, now)
+		}
+		return len(buf), nil
+	}
+
+	t.builder.Push(p)
+	for {
+		smp, ts := t.builder.PopWithTimestamp()
+		if smp == nil {
+			break
+		}
+		t.gotVideo(smp.Data, ts, now)
+	}
+	return len(buf), nil
+}
+
+// rtmpTime returns the RTMP time, in milliseconds, of an RTP timestamp.
+// Called locked.
+func (t *pushTrack) rtmpTime(ts uint32, now time.Time) int64 {
+	clockrate := int64(48000)
+	if t.video {
+		clockrate = 90000
+	}
+	ext := t.timestamps.Extend(ts)
+	if !t.started {
+		t.started = true
+		t.origin = ext
+		t.base = int64(now.Sub(t.conn.client.start) / time.Millisecond)
+	}
+	return t.base + (ext-t.origin)*1000/clockrate
+}
+
+// gotAudio sends an Opus packet.  Called locked.
+func (t *pushTrack) gotAudio(data []byte, ts uint32, now time.Time) {
+	c := t.conn.client
+	ms := c.timestamp(false, t.rtmpTime(ts, now))
+	if !c.audioSeen {
+		c.audioSeen = true
+		c.send(msgAudio, ms, opusSequenceStart())
+	}
+	c.send(msgAudio, ms, opusTag(data))
+}
+
+// gotVideo sends an access unit in AVC format.  Called locked.
+func (t *pushTrack) gotVideo(data []byte, ts uint32, now time.Time) {
+	c := t.conn.client
+	nalus, err := splitNALUs(data, 4)
+	if err != nil {
+		return
+	}
+	keyframe := false
+	var frame [][]byte
+	for _, nalu := range nalus {
+		switch nalu[0] & 0x1F {
+		case 5:
+			keyframe = true
+		case 7:
+			c.sps = append([]byte(nil), nalu...)
+			continue
+		case 8:
+			c.pps = append([]byte(nil), nalu...)
+			continue
+		case 9:
+			continue
+		}
+		frame = append(frame, nalu)
+	}
+	if len(frame) == 0 {
+		return
+	}
+
+	if !keyframe && atomic.LoadUint32(&c.dropped) != 0 {
+		return
+	}
+	if keyframe {
+		if c.sps == nil || c.pps == nil {
+			return
+		}
+		atomic.StoreUint32(&c.dropped, 0)
+	}
+
+	ms := c.timestamp(true, t.rtmpTime(ts, now))
+	if keyframe && (!bytes.Equal(c.sps, c.sentSPS) ||
+		!bytes.Equal(c.pps, c.sentPPS)) {
+		c.sentSPS = c.sps
+		c.sentPPS = c.pps
+		c.send(msgVideo, ms, avcSequenceHeader(c.sps, c.pps))
+	}
+	c.send(msgVideo, ms, avcTag(keyframe, frame))
+}
+
+func (t *pushTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+}
+
+func (t *pushTrack) SetCname(string) {
+}
+
+func (t *pushTrack) GetMaxBitrate() (uint64, int, int) {
+	return ^uint64(0), -1, -1
+}
+
+// makeAVCConfig returns an AVCDecoderConfigurationRecord with 4-byte
+// NALU lengths.
+func makeAVCConfig(sps, pps []byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(len(sps)))
+	b.Write(sps)
+	b.WriteByte(1)
+	binary.Write(&b, binary.BigEndian, uint16(len(pps)))
+	b.Write(pps)
+	return b.Bytes()
+}
+
+// avcSequenceHeader returns the body of a video tag in the legacy format
+// that carries the decoder configuration.
+func avcSequenceHeader(sps, pps []byte) []byte {
+	return append([]byte{0x17, 0, 0, 0, 0}, makeAVCConfig(sps, pps)...)
+}
+
+// avcTag returns the body of a video tag in the legacy format that
+// carries a single access unit.
+func avcTag(keyframe bool, nalus [][]byte) []byte {
+	var b bytes.Buffer
+	if keyframe {
+		b.WriteByte(0x17)
+	} else {
+		b.WriteByte(0x27)
+	}
+	b.Write([]byte{1, 0, 0, 0})
+	for _, nalu := range nalus {
+		binary.Write(&b, binary.BigEndian, uint32(len(nalu)))
+		b.Write(nalu)
+	}
+	return b.Bytes()
+}
+
+// opusSequenceStart returns the body of an audio tag in the Enhanced
+// RTMP format that carries the Opus identification header.
+func opusSequenceStart() []byte {
+	b := []byte{0x90, 'O', 'p', 'u', 's'}
+	b = append(b, "OpusHead"...)
+	b = append(b, 1, 2)
+	b = binary.LittleEndian.AppendUint16(b, 312)
+	b = binary.LittleEndian.AppendUint32(b, 48000)
+	return append(b, 0, 0, 0)
+}
+
+// opusTag returns the body of an audio tag in the Enhanced RTMP format
+// that carries an Opus packet.
+func opusTag(data []byte) []byte {
+	return append([]byte{0x91, 'O', 'p', 'u', 's'}, data...)
+}
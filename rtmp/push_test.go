@@ -0,0 +1,78 @@
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAVCSequenceHeader(t *testing.T) {
+	if !bytes.Equal(makeAVCConfig(sps, pps), avcConfigRecord) {
+		t.Errorf("Bad record %v", makeAVCConfig(sps, pps))
+	}
+
+	tag, err := parseVideoTag(avcSequenceHeader(sps, pps))
+	if err != nil || !tag.config || !tag.keyframe {
+		t.Fatalf("Got %v %v", tag, err)
+	}
+	config, err := parseAVCConfig(tag.data)
+	if err != nil || !reflect.DeepEqual(config.sps, [][]byte{sps}) {
+		t.Errorf("Got %v %v", config, err)
+	}
+}
+
+func TestAVCTag(t *testing.T) {
+	nalus := [][]byte{{0x65, 1, 2, 3}, {0x65, 4, 5}}
+	for _, keyframe := range []bool{false, true} {
+		tag, err := parseVideoTag(avcTag(keyframe, nalus))
+		if err != nil || tag.config || tag.keyframe != keyframe {
+			t.Fatalf("Got %v %v", tag, err)
+		}
+		n, err := splitNALUs(tag.data, 4)
+		if err != nil || !reflect.DeepEqual(n, nalus) {
+			t.Errorf("Got %v %v", n, err)
+		}
+	}
+}
+
+func TestOpusTag(t *testing.T) {
+	data, err := parseAudioTag(opusSequenceStart())
+	if err != nil || data != nil {
+		t.Errorf("Got %v %v", data, err)
+	}
+	packet := []byte{0xFC, 1, 2, 3}
+	data, err = parseAudioTag(opusTag(packet))
+	if err != nil || !bytes.Equal(data, packet) {
+		t.Errorf("Got %v %v", data, err)
+	}
+}
+
+func TestPushPublish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		server, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s := &session{conn: server}
+		s.run()
+	}()
+
+	cn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer cn.Close()
+
+	c := &Push{}
+	stream, err := c.publish(cn, "rtmp://"+l.Addr().String()+"/group",
+		"group", "key")
+	if err != nil || stream != 1 {
+		t.Errorf("Got %v %v", stream, err)
+	}
+}
@@ -0,0 +1,535 @@
+// Package rtmp implements RTMP ingest: a stream published over RTMP is
+// injected into a group as if it came from an ordinary client.  It also
+// implements restreaming, where the media of a group is published to an
+// external RTMP server.
+package rtmp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/ingest"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/rtpconn"
+)
+
+var logger = logging.New("rtmp")
+
+// time after which an idle connection is dropped
+const readTimeout = 10 * time.Second
+
+var server struct {
+	mu       sync.Mutex
+	listener net.Listener
+	sessions map[*session]struct{}
+}
+
+// Serve listens for RTMP connections on the given address.  It returns
+// when the listener is closed by Shutdown.
+func Serve(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server.mu.Lock()
+	server.listener = listener
+	server.sessions = make(map[*session]struct{})
+	server.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s := &session{conn: conn}
+		server.mu.Lock()
+		server.sessions[s] = struct{}{}
+		server.mu.Unlock()
+		go func() {
+			err := s.run()
+			if err != nil && !errors.Is(err, io.EOF) &&
+				!errors.Is(err, net.ErrClosed) {
+				logger.Warnf("RTMP %v: %v", conn.RemoteAddr(), err)
+			}
+			server.mu.Lock()
+			delete(server.sessions, s)
+			server.mu.Unlock()
+		}()
+	}
+}
+
+// Shutdown closes the listener and all sessions.
+func Shutdown() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.listener != nil {
+		server.listener.Close()
+		server.listener = nil
+	}
+	for s := range server.sessions {
+		s.conn.Close()
+	}
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		logger.Fatalf("rand.Read: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// A session is an RTMP connection.
+type session struct {
+	conn net.Conn
+	r    *chunkReader
+	w    *chunkWriter
+
+	ackWindow uint32
+	lastAck   uint64
+
+	app        string
+	groupName  string
+	key        string
+	publishing bool
+	metadata   amfObjectValue
+
+	client    *rtpconn.IngestClient
+	publisher *ingest.Publisher
+	avc       *avcConfig
+	warned    map[string]bool
+}
+
+// warn logs a message once per session.
+func (s *session) warn(format string, args ...interface{}) {
+	m := fmt.Sprintf(format, args...)
+	if s.warned[m] {
+		return
+	}
+	if s.warned == nil {
+		s.warned = make(map[string]bool)
+	}
+	s.warned[m] = true
+	logger.Warnf("RTMP %v: %v", s.conn.RemoteAddr(), m)
+}
+
+// handshake performs the simple handshake, which is accepted by all
+// the publishing clients we know of.
+func (s *session) handshake() error {
+	c0c1 := make([]byte, 1+1536)
+	_, err := io.ReadFull(s.conn, c0c1)
+	if err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %v", c0c1[0])
+	}
+
+	s0s1s2 := make([]byte, 1+1536+1536)
+	s0s1s2[0] = 3
+	s1 := s0s1s2[1 : 1+1536]
+	binary.BigEndian.PutUint32(s1[0:4],
+		uint32(time.Now().UnixNano()/int64(time.Millisecond)))
+	// a zero version indicates that we don't do the digest handshake
+	_, err = rand.Read(s1[8:])
+	if err != nil {
+		return err
+	}
+	copy(s0s1s2[1+1536:], c0c1[1:])
+	_, err = s.conn.Write(s0s1s2)
+	if err != nil {
+		return err
+	}
+
+	c2 := make([]byte, 1536)
+	_, err = io.ReadFull(s.conn, c2)
+	return err
+}
+
+func (s *session) run() error {
+	defer s.close()
+
+	s.conn.SetDeadline(time.Now().Add(readTimeout))
+	err := s.handshake()
+	if err != nil {
+		return err
+	}
+	s.conn.SetDeadline(time.Time{})
+	if tcp, ok := s.conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(readTimeout)
+	}
+
+	s.r = newChunkReader(s.conn)
+	s.w = newChunkWriter(s.conn)
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		m, err := s.r.readMessage()
+		if err != nil {
+			return err
+		}
+		if s.ackWindow > 0 && s.r.bytes-s.lastAck >= uint64(s.ackWindow) {
+			s.lastAck = s.r.bytes
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(s.r.bytes))
+			err := s.write(2, msgAck, 0, b[:])
+			if err != nil {
+				return err
+			}
+		}
+		err = s.gotMessage(m)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) write(csid uint8, typ uint8, stream uint32, payload []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(readTimeout))
+	return s.w.writeMessage(csid, &message{
+		typ:     typ,
+		stream:  stream,
+		payload: payload,
+	})
+}
+
+func (s *session) writeCommand(stream uint32, values ...interface{}) error {
+	return s.write(3, msgCommandAMF0, stream, encodeAMF(values...))
+}
+
+func (s *session) writeStatus(level, code, description string) error {
+	return s.writeCommand(1, "onStatus", 0, nil, amfObjectValue{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	})
+}
+
+var errUnpublished = errors.New("stream unpublished")
+
+func (s *session) gotMessage(m *message) error {
+	switch m.typ {
+	case msgSetChunkSize:
+		if len(m.payload) < 4 {
+			return errTruncated
+		}
+		size := binary.BigEndian.Uint32(m.payload) & 0x7FFFFFFF
+		if size < 1 || size > maxMessageSize {
+			return errors.New("bad chunk size")
+		}
+		s.r.chunkSize = size
+	case msgAbort:
+		if len(m.payload) >= 4 {
+			s.r.abort(binary.BigEndian.Uint32(m.payload))
+		}
+	case msgWindowAckSize:
+		if len(m.payload) >= 4 {
+			s.ackWindow = binary.BigEndian.Uint32(m.payload)
+		}
+	case msgAck, msgUserControl, msgSetPeerBandwidth:
+	case msgCommandAMF0, msgCommandAMF3:
+		payload := m.payload
+		if m.typ == msgCommandAMF3 && len(payload) > 0 {
+			// AMF3 commands start with a format byte, and are
+			// encoded in AMF0 in practice
+			payload = payload[1:]
+		}
+		values, err := decodeAMF(payload)
+		if err != nil {
+			return err
+		}
+		return s.gotCommand(values)
+	case msgDataAMF0, msgDataAMF3:
+		payload := m.payload
+		if m.typ == msgDataAMF3 && len(payload) > 0 {
+			payload = payload[1:]
+		}
+		values, err := decodeAMF(payload)
+		if err != nil {
+			return err
+		}
+		if len(values) > 0 && values[0] == "@setDataFrame" {
+			values = values[1:]
+		}
+		if len(values) >= 2 && values[0] == "onMetaData" {
+			if o, ok := values[1].(amfObjectValue); ok {
+				s.metadata = o
+			}
+			if s.publishing && s.client == nil {
+				return s.join()
+			}
+		}
+	case msgVideo:
+		return s.gotVideo(m)
+	case msgAudio:
+		return s.gotAudio(m)
+	}
+	return nil
+}
+
+func (s *session) gotCommand(values []interface{}) error {
+	if len(values) < 2 {
+		return errors.New("malformed command")
+	}
+	name, _ := values[0].(string)
+	txid, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		if len(values) >= 3 {
+			if o, ok := values[2].(amfObjectValue); ok {
+				s.app, _ = o["app"].(string)
+			}
+		}
+		var b [5]byte
+		binary.BigEndian.PutUint32(b[:4], 2500000)
+		err := s.write(2, msgWindowAckSize, 0, b[:4])
+		if err != nil {
+			return err
+		}
+		b[4] = 2 // dynamic
+		err = s.write(2, msgSetPeerBandwidth, 0, b[:5])
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(b[:4], 4096)
+		err = s.write(2, msgSetChunkSize, 0, b[:4])
+		if err != nil {
+			return err
+		}
+		s.w.chunkSize = 4096
+		return s.writeCommand(0, "_result", txid,
+			amfObjectValue{
+				"fmsVer":       "FMS/3,0,1,123",
+				"capabilities": 31,
+			},
+			amfObjectValue{
+				"level":          "status",
+				"code":           "NetConnection.Connect.Success",
+				"description":    "Connection succeeded.",
+				"objectEncoding": 0,
+			},
+		)
+	case "releaseStream", "FCPublish":
+		return s.writeCommand(0, "_result", txid, nil)
+	case "createStream":
+		return s.writeCommand(0, "_result", txid, nil, 1)
+	case "publish":
+		if s.publishing {
+			return errors.New("duplicate publish")
+		}
+		var stream string
+		if len(values) >= 4 {
+			stream, _ = values[3].(string)
+		}
+		groupName, key, err := parsePath(s.app, stream)
+		if err != nil {
+			s.writeStatus("error", "NetStream.Publish.BadName",
+				err.Error())
+			return err
+		}
+		s.groupName = groupName
+		s.key = key
+		s.publishing = true
+
+		// StreamBegin
+		var b [6]byte
+		binary.BigEndian.PutUint32(b[2:], 1)
+		err = s.write(2, msgUserControl, 0, b[:])
+		if err != nil {
+			return err
+		}
+		return s.writeStatus("status", "NetStream.Publish.Start",
+			"Publishing "+groupName+".")
+	case "FCUnpublish", "deleteStream", "closeStream":
+		return errUnpublished
+	}
+	return nil
+}
+
+// parsePath returns the group name and the key from the application name
+// and the stream name.  Clients don't agree on where to split a URL of
+// the form rtmp://server/group/key, and the group name may contain
+// slashes, so we join the two and split at the last slash.
+func parsePath(app, stream string) (string, string, error) {
+	strip := func(s string) string {
+		if i := strings.IndexByte(s, '?'); i >= 0 {
+			s = s[:i]
+		}
+		return strings.Trim(s, "/")
+	}
+	p := strings.Trim(strip(app)+"/"+strip(stream), "/")
+	i := strings.LastIndexByte(p, '/')
+	if i <= 0 || i == len(p)-1 {
+		return "", "", errors.New("the stream must be group/key")
+	}
+	return p[:i], p[i+1:], nil
+}
+
+// username returns the name under which the stream appears in the group.
+func (s *session) username() string {
+	for _, k := range []string{"title", "name", "encoder"} {
+		if v, ok := s.metadata[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	return "RTMP"
+}
+
+func canPresent(perms []string) bool {
+	for _, p := range perms {
+		if p == "present" {
+			return true
+		}
+	}
+	return false
+}
+
+// join adds the stream to the group.  We wait for the metadata, or the
+// first media, so that we know the username.
+func (s *session) join() error {
+	g, err := group.Add(s.groupName, nil)
+	if err != nil {
+		s.writeStatus("error", "NetStream.Publish.BadName", err.Error())
+		return err
+	}
+
+	username := s.username()
+	creds := group.ClientCredentials{
+		Username: &username,
+		Token:    s.key,
+	}
+	c := rtpconn.NewIngestClient(g, newId())
+	_, err = group.AddClient(g.Name(), c, creds)
+	if err != nil {
+		s.writeStatus("error", "NetStream.Publish.Unauthorized",
+			err.Error())
+		return err
+	}
+	if !canPresent(c.Permissions()) {
+		group.DelClient(c)
+		s.writeStatus("error", "NetStream.Publish.Unauthorized",
+			"not allowed to present")
+		return errors.New("not allowed to present")
+	}
+	s.client = c
+
+	ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+	defer cancel()
+	p, err := ingest.NewPublisher(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	s.publisher = p
+
+	// close the connection when the client is kicked
+	conn := s.conn
+	go func() {
+		<-c.Done()
+		conn.Close()
+	}()
+
+	logger.Infof("RTMP %v: publishing to %v as %v",
+		s.conn.RemoteAddr(), g.Name(), c.Username())
+	return nil
+}
+
+func (s *session) gotVideo(m *message) error {
+	if !s.publishing {
+		return nil
+	}
+	if s.client == nil {
+		err := s.join()
+		if err != nil {
+			return err
+		}
+	}
+
+	tag, err := parseVideoTag(m.payload)
+	if err == errUnsupportedCodec {
+		s.warn("unsupported video codec, only H.264 is supported")
+		return nil
+	}
+	if err != nil || tag == nil {
+		return err
+	}
+	if tag.config {
+		config, err := parseAVCConfig(tag.data)
+		if err != nil {
+			return err
+		}
+		s.avc = config
+		return nil
+	}
+	if s.avc == nil {
+		s.warn("no AVC configuration")
+		return nil
+	}
+	nalus, err := splitNALUs(tag.data, s.avc.lengthSize)
+	if err != nil {
+		return err
+	}
+	if len(nalus) == 0 {
+		return nil
+	}
+	pts := uint32(int64(m.timestamp) + int64(tag.compositionTime))
+	s.publisher.WriteVideo(pts, annexB(nalus, s.avc))
+	return nil
+}
+
+func (s *session) gotAudio(m *message) error {
+	if !s.publishing {
+		return nil
+	}
+	if s.client == nil {
+		err := s.join()
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := parseAudioTag(m.payload)
+	if err == errUnsupportedCodec {
+		s.warn("unsupported audio codec, audio will be dropped; " +
+			"only Opus is supported")
+		return nil
+	}
+	if err != nil || data == nil {
+		return err
+	}
+	s.publisher.WriteAudio(m.timestamp, data)
+	return nil
+}
+
+func (s *session) close() {
+	s.conn.Close()
+	if s.publisher != nil {
+		s.publisher.Close()
+	}
+	if s.client != nil {
+		s.client.Close()
+		logger.Infof("RTMP %v: done publishing to %v",
+			s.conn.RemoteAddr(), s.groupName)
+	}
+}
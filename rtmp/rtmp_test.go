@@ -0,0 +1,146 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		app, stream, group, key string
+	}{
+		{"group", "key", "group", "key"},
+		{"group/sub", "key", "group/sub", "key"},
+		{"group", "sub/key", "group/sub", "key"},
+		{"group/", "key?foo=bar", "group", "key"},
+		{"group?x=y", "/key", "group", "key"},
+	}
+	for _, tt := range tests {
+		g, k, err := parsePath(tt.app, tt.stream)
+		if err != nil || g != tt.group || k != tt.key {
+			t.Errorf("%v %v: got %v %v %v",
+				tt.app, tt.stream, g, k, err)
+		}
+	}
+	for _, bad := range [][2]string{{"group", ""}, {"", "key"}, {"", ""}} {
+		_, _, err := parsePath(bad[0], bad[1])
+		if err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
+
+// testClient is the publishing side of an RTMP connection.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *chunkReader
+	w    *chunkWriter
+}
+
+func (c *testClient) command(values ...interface{}) {
+	err := c.w.writeMessage(3, &message{
+		typ:     msgCommandAMF0,
+		payload: encodeAMF(values...),
+	})
+	if err != nil {
+		c.t.Fatalf("Write: %v", err)
+	}
+}
+
+// result returns the next command sent by the server.
+func (c *testClient) result() []interface{} {
+	for {
+		m, err := c.r.readMessage()
+		if err != nil {
+			c.t.Fatalf("Read: %v", err)
+		}
+		switch m.typ {
+		case msgSetChunkSize:
+			c.r.chunkSize = binary.BigEndian.Uint32(m.payload)
+		case msgCommandAMF0:
+			values, err := decodeAMF(m.payload)
+			if err != nil {
+				c.t.Fatalf("Decode: %v", err)
+			}
+			return values
+		}
+	}
+}
+
+func (c *testClient) status() string {
+	values := c.result()
+	if len(values) < 4 || values[0] != "onStatus" {
+		c.t.Fatalf("Expected onStatus, got %v", values)
+	}
+	code, _ := values[3].(amfObjectValue)["code"].(string)
+	return code
+}
+
+func newTestClient(t *testing.T) *testClient {
+	client, server := net.Pipe()
+	s := &session{conn: server}
+	go s.run()
+
+	c0c1 := make([]byte, 1+1536)
+	c0c1[0] = 3
+	_, err := client.Write(c0c1)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	s0s1s2 := make([]byte, 1+2*1536)
+	_, err = io.ReadFull(client, s0s1s2)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if s0s1s2[0] != 3 {
+		t.Errorf("Bad version %v", s0s1s2[0])
+	}
+	_, err = client.Write(s0s1s2[1 : 1+1536])
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	c := &testClient{
+		t:    t,
+		conn: client,
+		r:    newChunkReader(client),
+		w:    newChunkWriter(client),
+	}
+	c.command("connect", 1, amfObjectValue{"app": "group"})
+	values := c.result()
+	if len(values) < 4 || values[0] != "_result" || values[1] != 1.0 {
+		t.Fatalf("Bad connect result %v", values)
+	}
+	code := values[3].(amfObjectValue)["code"]
+	if code != "NetConnection.Connect.Success" {
+		t.Errorf("Connect: %v", code)
+	}
+
+	c.command("createStream", 2, nil)
+	values = c.result()
+	if len(values) < 4 || values[0] != "_result" || values[3] != 1.0 {
+		t.Fatalf("Bad createStream result %v", values)
+	}
+	return c
+}
+
+func TestPublish(t *testing.T) {
+	c := newTestClient(t)
+	defer c.conn.Close()
+	c.command("publish", 3, nil, "key", "live")
+	if code := c.status(); code != "NetStream.Publish.Start" {
+		t.Errorf("Publish: %v", code)
+	}
+}
+
+func TestPublishBadName(t *testing.T) {
+	c := newTestClient(t)
+	defer c.conn.Close()
+	c.command("publish", 3, nil, "", "live")
+	if code := c.status(); code != "NetStream.Publish.BadName" {
+		t.Errorf("Publish: %v", code)
+	}
+}
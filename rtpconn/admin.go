@@ -0,0 +1,117 @@
+package rtpconn
+
+import (
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/group"
+)
+
+// StartRecording starts recording a group on behalf of the user by.  If
+// mixed is true, the audio of all participants is mixed into a single
+// file.  Otherwise, each stream is recorded in the given format, or in
+// the group's default format if format is empty.
+func StartRecording(g *group.Group, mixed bool, format string, by string) error {
+	for _, c := range g.GetClients(nil) {
+		_, ok := c.(*diskwriter.Client)
+		if ok {
+			return group.UserError("already recording")
+		}
+	}
+	elsewhere, err := g.RecordingElsewhere()
+	if err != nil {
+		logger.With("group", g.Name()).Warnf("Shared state: %v", err)
+	} else if elsewhere {
+		return group.UserError("already recording on another server")
+	}
+	var disk *diskwriter.Client
+	if mixed {
+		disk, err = diskwriter.NewMixed(g)
+		if err != nil {
+			return group.UserError("couldn't record: " + err.Error())
+		}
+	} else {
+		disk, err = diskwriter.New(g, format)
+		if err != nil {
+			return group.UserError("couldn't record: " + err.Error())
+		}
+	}
+	_, err = group.AddClient(g.Name(), disk,
+		group.ClientCredentials{
+			System: true,
+		},
+	)
+	if err != nil {
+		disk.Close()
+		return err
+	}
+	requestConns(disk, g, "")
+	g.Notify("record", by, "")
+	return nil
+}
+
+// StopRecording stops recording a group on behalf of the user by.  It
+// returns false if the group was not being recorded.
+func StopRecording(g *group.Group, by string) bool {
+	recording := false
+	for _, c := range g.GetClients(nil) {
+		disk, ok := c.(*diskwriter.Client)
+		if ok {
+			disk.Close()
+			group.DelClient(disk)
+			recording = true
+		}
+	}
+	if recording {
+		g.Notify("unrecord", by, "")
+	}
+	return recording
+}
+
+// Mute asks the client with the given id to mute its microphone.  The
+// username by is displayed to the user.
+func Mute(g *group.Group, id string, by string) error {
+	client := g.GetClient(id)
+	if client == nil {
+		return group.UserError("no such user")
+	}
+	c, ok := client.(*webClient)
+	if !ok {
+		return group.UserError("this is not a real user")
+	}
+	var username *string
+	if by != "" {
+		username = &by
+	}
+	notifyAction(g, "mute", by, id, "")
+	return c.write(clientMessage{
+		Type:       "usermessage",
+		Kind:       "mute",
+		Dest:       id,
+		Username:   username,
+		Privileged: true,
+	})
+}
+
+// Kick kicks the client with the given id on behalf of the user by.
+func Kick(g *group.Group, id string, by string, message string) error {
+	var username *string
+	if by != "" {
+		username = &by
+	}
+	return kickClient(g, "", username, id, message)
+}
+
+// notifyAction notifies an action performed by the user by on the
+// client with the given id.
+func notifyAction(g *group.Group, kind, by, id, message string) {
+	target := ""
+	if c := g.GetClient(id); c != nil {
+		target = c.Username()
+	}
+	g.NotifyEvent(group.Event{
+		Kind:     kind,
+		Username: by,
+		Target:   target,
+		Client:   id,
+		Message:  message,
+	})
+}
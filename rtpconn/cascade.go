@@ -0,0 +1,761 @@
+package rtpconn
+
+import (
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/client"
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+)
+
+// A CascadeClient receives the media of a group on another server, and
+// republishes it in a local group.  If the upstream declares it, the
+// streams published locally are sent to the upstream server too.  It is
+// active as long as there are web clients in the local group.
+type CascadeClient struct {
+	group    *group.Group
+	id       string
+	upstream group.Upstream
+	done     chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	remote *client.Client
+	// the reason why the upstream server terminated the connection
+	err     error
+	status  string
+	up      map[string]*rtpUpConnection
+	down    map[string]*cascadeDown
+	present bool
+}
+
+var cascadeMu sync.Mutex
+
+func newCascadeClient(g *group.Group, upstream group.Upstream) *CascadeClient {
+	buf := make([]byte, 16)
+	crand.Read(buf)
+	return &CascadeClient{
+		group:    g,
+		id:       base64.RawURLEncoding.EncodeToString(buf),
+		upstream: upstream,
+		done:     make(chan struct{}),
+		status:   "connecting",
+		up:       make(map[string]*rtpUpConnection),
+		down:     make(map[string]*cascadeDown),
+	}
+}
+
+func (c *CascadeClient) log() *logging.Logger {
+	return clientLogger(c, "")
+}
+
+func (c *CascadeClient) Group() *group.Group {
+	return c.group
+}
+
+func (c *CascadeClient) Id() string {
+	return c.id
+}
+
+func (c *CascadeClient) Username() string {
+	return "UPSTREAM"
+}
+
+func (c *CascadeClient) SetUsername(string) {
+}
+
+func (c *CascadeClient) Permissions() []string {
+	return []string{"system"}
+}
+
+func (c *CascadeClient) SetPermissions([]string) {
+}
+
+func (c *CascadeClient) Data() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"upstream": c.upstream.URL,
+		"status":   c.status,
+	}
+}
+
+// PushConn is called for the streams published in the local group, which
+// are sent upstream if the upstream declares it.
+func (c *CascadeClient) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
+	if g != c.group || !c.upstream.Publish {
+		return nil
+	}
+
+	if replace != "" {
+		c.unpublish(replace)
+	}
+	c.unpublish(id)
+
+	if up == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	ours := c.up[id] != nil
+	ready := c.remote != nil && c.present && !c.closed
+	c.mu.Unlock()
+	if ours || !ready {
+		return nil
+	}
+
+	go func() {
+		err := c.publish(id, up.Label(), tracks)
+		if err != nil {
+			c.log().Warnf("Cascade: publish: %v", err)
+			c.unpublish(id)
+		}
+	}()
+	return nil
+}
+
+func (c *CascadeClient) RequestConns(target group.Client, g *group.Group, id string) error {
+	if g != c.group {
+		return nil
+	}
+
+	c.mu.Lock()
+	up := make([]*rtpUpConnection, 0, len(c.up))
+	for _, u := range c.up {
+		up = append(up, u)
+	}
+	c.mu.Unlock()
+
+	for _, u := range up {
+		if id != "" && u.Id() != id {
+			continue
+		}
+		tracks := u.getTracks()
+		ts := make([]conn.UpTrack, len(tracks))
+		for i, t := range tracks {
+			ts[i] = t
+		}
+		target.PushConn(g, u.Id(), u, ts, "")
+	}
+	return nil
+}
+
+func (c *CascadeClient) Joined(group, kind string) error {
+	return nil
+}
+
+func (c *CascadeClient) PushClient(group, kind, id, username string, permissions []string, data map[string]interface{}) error {
+	return nil
+}
+
+// Kick closes the client asynchronously, since it may be called with
+// the group locked.
+func (c *CascadeClient) Kick(id string, user *string, message string) error {
+	go c.Close()
+	return nil
+}
+
+// Close disconnects from the upstream server and leaves the local group.
+func (c *CascadeClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	remote := c.remote
+	c.mu.Unlock()
+
+	if remote != nil {
+		remote.Close()
+	}
+	c.closeUp()
+	c.closeDown()
+	group.DelClient(c)
+	return nil
+}
+
+func (c *CascadeClient) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// setStatus updates the status shown in the local user list.
+func (c *CascadeClient) setStatus(status string) {
+	c.mu.Lock()
+	if c.status == status {
+		c.mu.Unlock()
+		return
+	}
+	c.status = status
+	c.mu.Unlock()
+
+	g := c.group
+	group.PushClientUpdate(g.GetClients(c), &group.ClientUpdate{
+		Group:       g.Name(),
+		Kind:        "change",
+		Id:          c.id,
+		Username:    c.Username(),
+		Permissions: c.Permissions(),
+		Data:        c.Data(),
+	})
+}
+
+// run connects to the upstream server, and reconnects whenever the
+// connection is lost, until the client is closed.
+func (c *CascadeClient) run() {
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := c.connect()
+		c.closeUp()
+		c.closeDown()
+		if c.isClosed() {
+			return
+		}
+		c.log().Warnf("Cascade: %v", err)
+		c.setStatus("disconnected")
+		c.group.WallOps(fmt.Sprintf(
+			"Lost connection to upstream server: %v", err,
+		))
+
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return
+		}
+		delay *= 2
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+		c.setStatus("connecting")
+	}
+}
+
+// connect connects to the upstream server and waits until the
+// connection is lost.
+func (c *CascadeClient) connect() error {
+	var tlsConfig *tls.Config
+	if c.upstream.Insecure {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	httpClient := &http.Client{
+		Transport: transport,
+		Timeout:   30 * time.Second,
+	}
+
+	status, err := client.GetStatus(httpClient, c.upstream.URL)
+	if err != nil {
+		return err
+	}
+
+	api, err := c.group.API()
+	if err != nil {
+		return err
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 30 * time.Second,
+		TLSClientConfig:  tlsConfig,
+	}
+	remote, err := client.Dial(status.Endpoint, client.Config{
+		Username:          c.upstream.Username,
+		Password:          c.upstream.Password,
+		HTTPClient:        httpClient,
+		Dialer:            &dialer,
+		API:               api,
+		Timeout:           30 * time.Second,
+		NewPeerConnection: c.newUpConn,
+		Handlers: client.Handlers{
+			Joined:          c.gotJoined,
+			Chat:            c.gotChat,
+			UserMessage:     c.gotUserMessage,
+			Stream:          c.gotStream,
+			StreamClosed:    c.gotStreamClosed,
+			KeyframeRequest: c.gotKeyframeRequest,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.remote = remote
+	c.err = nil
+	c.present = false
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.remote = nil
+		c.mu.Unlock()
+	}()
+
+	err = remote.Join(status.Name)
+	if err != nil {
+		var redirect *client.RedirectError
+		if errors.As(err, &redirect) {
+			return fmt.Errorf("upstream group redirects to %v",
+				redirect.URL)
+		}
+		return fmt.Errorf("couldn't join upstream group: %v", err)
+	}
+
+	err = remote.Request(map[string][]string{
+		"": {"audio", "video"},
+	})
+	if err != nil {
+		return err
+	}
+	c.setStatus("connected")
+	c.log().Infof("Cascade: connected to %v", c.upstream.URL)
+	if c.upstream.Publish {
+		present := member("present", remote.Permissions())
+		if !present {
+			c.log().Warnf("Cascade: not allowed to publish upstream")
+		}
+		c.mu.Lock()
+		c.present = present
+		c.mu.Unlock()
+		if present {
+			go requestConns(c, c.group, "")
+		}
+	}
+
+	select {
+	case <-remote.Done():
+	case <-c.done:
+		return nil
+	}
+	c.mu.Lock()
+	err = c.err
+	c.mu.Unlock()
+	if err == nil {
+		err = remote.Err()
+	}
+	if err == nil {
+		err = errors.New("connection closed")
+	}
+	return err
+}
+
+// getRemote returns the connection to the upstream server, or nil if
+// there is none.
+func (c *CascadeClient) getRemote() *client.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// terminate closes the connection to the upstream server from one of
+// its handlers, which must not wait for it to terminate.
+func (c *CascadeClient) terminate(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	remote := c.remote
+	c.mu.Unlock()
+	if remote != nil {
+		go remote.Close()
+	}
+}
+
+func (c *CascadeClient) gotJoined(j client.Joined) {
+	if j.Kind == "leave" {
+		c.terminate(errors.New("left upstream group"))
+	}
+}
+
+func (c *CascadeClient) gotUserMessage(m client.UserMessage) {
+	switch m.Kind {
+	case "error", "warning":
+		c.log().Warnf("Cascade: %v: %v", m.Kind, m.Value)
+	case "kicked":
+		c.terminate(fmt.Errorf("kicked out of upstream group: %v",
+			m.Value))
+	}
+}
+
+// gotStream is called when the upstream server offers a stream.
+func (c *CascadeClient) gotStream(s *client.RemoteStream) bool {
+	// don't receive back the streams that we publish upstream
+	remote := c.getRemote()
+	return remote == nil || s.Source == "" || s.Source != remote.Id()
+}
+
+// newUpConn creates the local connection that carries a stream sent by
+// the upstream server.
+func (c *CascadeClient) newUpConn(s *client.RemoteStream, offer string) (*webrtc.PeerConnection, error) {
+	if s.Id == "" {
+		return nil, errEmptyId
+	}
+	source := s.Source
+	if source == "" {
+		source = s.Id
+	}
+	up, err := newUpConnFrom(c, s.Id, s.Label, offer, source, s.Username)
+	if err != nil {
+		c.log().Warnf("Cascade: offer: %v", err)
+		return nil, err
+	}
+	id := s.Id
+	up.pc.OnICEConnectionStateChange(
+		func(state webrtc.ICEConnectionState) {
+			if state == webrtc.ICEConnectionStateFailed {
+				c.delUp(id)
+				s.Close()
+			}
+		},
+	)
+
+	c.mu.Lock()
+	if c.closed || c.up[id] != nil {
+		c.mu.Unlock()
+		up.pc.Close()
+		return nil, errors.New("duplicate connection")
+	}
+	c.up[id] = up
+	c.mu.Unlock()
+	return up.pc, nil
+}
+
+func (c *CascadeClient) gotStreamClosed(s *client.RemoteStream) {
+	c.delUp(s.Id)
+}
+
+// delUp closes a cascaded connection and notifies local clients.
+func (c *CascadeClient) delUp(id string) {
+	c.mu.Lock()
+	up := c.up[id]
+	delete(c.up, id)
+	c.mu.Unlock()
+	if up != nil {
+		c.closeUpConn(up)
+	}
+}
+
+// closeUp closes all cascaded connections.
+func (c *CascadeClient) closeUp() {
+	c.mu.Lock()
+	up := c.up
+	c.up = make(map[string]*rtpUpConnection)
+	c.mu.Unlock()
+
+	for _, u := range up {
+		c.closeUpConn(u)
+	}
+}
+
+func (c *CascadeClient) closeUpConn(up *rtpUpConnection) {
+	up.mu.Lock()
+	up.closed = true
+	up.mu.Unlock()
+
+	up.pc.OnICEConnectionStateChange(nil)
+	up.pc.Close()
+
+	g := c.group
+	for _, cc := range g.GetClients(c) {
+		err := cc.PushConn(g, up.id, nil, nil, "")
+		if err != nil {
+			c.log().Warnf("PushConn: %v", err)
+		}
+	}
+}
+
+// chatMode returns the effective chat bridging mode.
+func (c *CascadeClient) chatMode() string {
+	if c.upstream.Chat == "" {
+		return "read-only"
+	}
+	return c.upstream.Chat
+}
+
+// gotChat forwards a chat message from the upstream group to local
+// clients.
+func (c *CascadeClient) gotChat(m client.Chat) {
+	if m.History || m.Dest != "" || c.chatMode() == "none" {
+		return
+	}
+
+	remote := c.getRemote()
+	if remote == nil || m.Source == remote.Id() {
+		return
+	}
+
+	g := c.group
+	now := time.Now()
+	username := m.Username
+	g.AddToChatHistory(m.Source, &username, now, m.Kind, m.Value)
+	err := broadcast(g.GetClients(c), clientMessage{
+		Type:     "chat",
+		Source:   m.Source,
+		Username: &username,
+		Time:     now.Format(time.RFC3339),
+		Kind:     m.Kind,
+		Value:    m.Value,
+	})
+	if err != nil {
+		c.log().Warnf("broadcast(chat): %v", err)
+	}
+}
+
+// gotLocalChat forwards a chat message from a local client to the
+// upstream group, if chat is bridged in both directions.
+func (c *CascadeClient) gotLocalChat(m clientMessage) {
+	if c.chatMode() != "bidirectional" {
+		return
+	}
+
+	value := m.Value
+	if s, ok := value.(string); ok && m.Username != nil &&
+		*m.Username != "" {
+		value = *m.Username + ": " + s
+	}
+
+	remote := c.getRemote()
+	if remote == nil {
+		return
+	}
+	username := remote.Username()
+	err := remote.Send(client.Message{
+		Type:     "chat",
+		Source:   remote.Id(),
+		Username: &username,
+		Kind:     m.Kind,
+		NoEcho:   true,
+		Value:    value,
+	})
+	if err != nil && err != client.ErrClosed {
+		c.log().Warnf("Cascade: chat: %v", err)
+	}
+}
+
+// forwardChat forwards a chat message sent by a local client to all
+// upstream servers.
+func forwardChat(g *group.Group, m clientMessage) {
+	for _, c := range g.GetClients(nil) {
+		cc, ok := c.(*CascadeClient)
+		if ok {
+			cc.gotLocalChat(m)
+		}
+	}
+}
+
+// UpdateCascade starts or stops the connection to the upstream server
+// of a group.  The connection is active when the group's description
+// declares an upstream server and there are web clients in the group.
+func UpdateCascade(g *group.Group) {
+	cascadeMu.Lock()
+	defer cascadeMu.Unlock()
+
+	upstream := g.Description().Upstream
+	var cascade *CascadeClient
+	wanted := false
+	for _, c := range g.GetClients(nil) {
+		switch c := c.(type) {
+		case *CascadeClient:
+			cascade = c
+		case *webClient:
+			wanted = true
+		}
+	}
+	if upstream == nil {
+		wanted = false
+	}
+
+	if cascade != nil {
+		if wanted && cascade.upstream == *upstream {
+			return
+		}
+		cascade.Close()
+	}
+
+	if !wanted {
+		return
+	}
+
+	c := newCascadeClient(g, *upstream)
+	_, err := group.AddClient(g.Name(), c,
+		group.ClientCredentials{System: true},
+	)
+	if err != nil {
+		logger.Warnf("Cascade %v: %v", g.Name(), err)
+		return
+	}
+	go c.run()
+}
+
+// UpdateCascades calls UpdateCascade for all groups.  It is called
+// periodically in order to notice changes to group descriptions.
+func UpdateCascades() {
+	var gs []*group.Group
+	group.Range(func(g *group.Group) bool {
+		gs = append(gs, g)
+		return true
+	})
+	for _, g := range gs {
+		UpdateCascade(g)
+	}
+}
+
+// A cascadeDown is a local stream published to the upstream server.
+type cascadeDown struct {
+	stream *client.LocalStream
+	tracks []*cascadeTrack
+}
+
+// A cascadeTrack forwards the packets of a local track upstream.
+type cascadeTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	remote conn.UpTrack
+}
+
+func (t *cascadeTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+}
+
+func (t *cascadeTrack) SetCname(string) {
+}
+
+func (t *cascadeTrack) GetMaxBitrate() (uint64, int, int) {
+	return ^uint64(0), -1, -1
+}
+
+// publish sends a local stream to the upstream server.
+func (c *CascadeClient) publish(id, label string, tracks []conn.UpTrack) error {
+	remote := c.getRemote()
+	if remote == nil {
+		return nil
+	}
+
+	// with simulcast, only send the highest layer
+	high := false
+	for _, t := range tracks {
+		if t.Kind() == webrtc.RTPCodecTypeVideo && t.Label() != "l" {
+			high = true
+		}
+	}
+
+	down := &cascadeDown{}
+	var locals []webrtc.TrackLocal
+	for _, t := range tracks {
+		if t.Kind() == webrtc.RTPCodecTypeVideo && high &&
+			t.Label() == "l" {
+			continue
+		}
+		local, err := webrtc.NewTrackLocalStaticRTP(
+			t.Codec(), t.Kind().String(), id,
+		)
+		if err != nil {
+			return err
+		}
+		track := &cascadeTrack{TrackLocalStaticRTP: local, remote: t}
+		down.tracks = append(down.tracks, track)
+		locals = append(locals, track)
+	}
+	if len(locals) == 0 {
+		return nil
+	}
+
+	stream, err := remote.Publish(label, locals...)
+	if err != nil {
+		return err
+	}
+	down.stream = stream
+
+	c.mu.Lock()
+	if c.closed || c.remote != remote || c.down[id] != nil {
+		c.mu.Unlock()
+		stream.Close()
+		return nil
+	}
+	c.down[id] = down
+	for _, t := range down.tracks {
+		err := t.remote.AddLocal(t)
+		if err != nil {
+			c.log().Warnf("Cascade: %v", err)
+		}
+	}
+	c.mu.Unlock()
+
+	// the upstream server may refuse the stream
+	go func() {
+		<-stream.Done()
+		c.mu.Lock()
+		if c.down[id] == down {
+			delete(c.down, id)
+		} else {
+			down = nil
+		}
+		c.mu.Unlock()
+		if down != nil {
+			down.close()
+		}
+	}()
+	return nil
+}
+
+// gotKeyframeRequest forwards keyframe requests from the upstream server.
+func (c *CascadeClient) gotKeyframeRequest(s *client.LocalStream, t webrtc.TrackLocal) {
+	if track, ok := t.(*cascadeTrack); ok {
+		track.remote.RequestKeyframe()
+	}
+}
+
+// unpublish stops sending a local stream upstream.
+func (c *CascadeClient) unpublish(id string) {
+	c.mu.Lock()
+	down := c.down[id]
+	delete(c.down, id)
+	c.mu.Unlock()
+	if down == nil {
+		return
+	}
+	down.close()
+}
+
+// closeDown stops sending all local streams upstream.
+func (c *CascadeClient) closeDown() {
+	c.mu.Lock()
+	down := c.down
+	c.down = make(map[string]*cascadeDown)
+	c.mu.Unlock()
+
+	for _, d := range down {
+		d.close()
+	}
+}
+
+func (d *cascadeDown) close() {
+	for _, t := range d.tracks {
+		t.remote.DelLocal(t)
+	}
+	d.stream.Close()
+}
@@ -0,0 +1,35 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/group"
+)
+
+func TestChatMode(t *testing.T) {
+	modes := map[string]string{
+		"":              "read-only",
+		"none":          "none",
+		"read-only":     "read-only",
+		"bidirectional": "bidirectional",
+	}
+	for chat, mode := range modes {
+		c := &CascadeClient{upstream: group.Upstream{Chat: chat}}
+		if m := c.chatMode(); m != mode {
+			t.Errorf("%v: expected %v, got %v", chat, mode, m)
+		}
+	}
+}
+
+func TestIsRemote(t *testing.T) {
+	if isRemote(&rtpUpConnection{}) {
+		t.Errorf("Local connection is remote")
+	}
+	up := &rtpUpConnection{source: "id", username: "user"}
+	if !isRemote(up) {
+		t.Errorf("Remote connection is not remote")
+	}
+	if id, username := up.User(); id != "id" || username != "user" {
+		t.Errorf("Expected id, user, got %v, %v", id, username)
+	}
+}
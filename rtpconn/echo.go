@@ -0,0 +1,89 @@
+package rtpconn
+
+import (
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+// the interval at which clients in an echo group are sent the
+// statistics of their connection
+const echoInterval = 2 * time.Second
+
+type echoStatsAction struct {
+	group *group.Group
+}
+
+// mediaReceivers returns the clients that receive the media sent by c.
+// In an echo group, this is c itself.
+func mediaReceivers(g *group.Group, c group.Client) []group.Client {
+	if g.Description().Echo {
+		return []group.Client{c}
+	}
+	return g.Peers(c)
+}
+
+// echoId returns the id of the down connection that carries a stream
+// back to its sender in an echo group, which must differ from the id of
+// the up connection.
+func echoId(id string) string {
+	return id + "-echo"
+}
+
+// scheduleEchoStats arranges for the client to be sent its statistics
+// after echoInterval.  It must be called from the client loop.
+func (c *webClient) scheduleEchoStats() {
+	if c.echoTimer {
+		return
+	}
+	c.echoTimer = true
+	g := c.group
+	time.AfterFunc(echoInterval, func() {
+		c.action(echoStatsAction{g})
+	})
+}
+
+// writeEchoStats sends the client a usermessage of kind echo describing
+// the quality of the path between the client and the server.  The
+// round-trip time is measured on the media that we send back, packet
+// loss in both directions.
+func (c *webClient) writeEchoStats() error {
+	s := c.GetStats()
+	if len(s.Up) == 0 && len(s.Down) == 0 {
+		return nil
+	}
+	var rtt, jitter time.Duration
+	var upLoss, downLoss float64
+	for _, conn := range s.Up {
+		for _, t := range conn.Tracks {
+			if t.Loss > upLoss {
+				upLoss = t.Loss
+			}
+			if time.Duration(t.Jitter) > jitter {
+				jitter = time.Duration(t.Jitter)
+			}
+		}
+	}
+	for _, conn := range s.Down {
+		for _, t := range conn.Tracks {
+			if t.Loss > downLoss {
+				downLoss = t.Loss
+			}
+			if time.Duration(t.Rtt) > rtt {
+				rtt = time.Duration(t.Rtt)
+			}
+		}
+	}
+	return c.write(clientMessage{
+		Type:       "usermessage",
+		Kind:       "echo",
+		Dest:       c.id,
+		Privileged: true,
+		Value: map[string]interface{}{
+			"rtt":      float64(rtt) / float64(time.Millisecond),
+			"jitter":   float64(jitter) / float64(time.Millisecond),
+			"upLoss":   upLoss,
+			"downLoss": downLoss,
+		},
+	})
+}
@@ -0,0 +1,187 @@
+package rtpconn
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/stats"
+)
+
+// the time constant of the average utilisation of the pool
+const utilisationWindow = 10 * time.Second
+
+// EgressWorkers is the number of goroutines used for writing packets to
+// subscribers, which is where SRTP encryption happens.  If it is 0,
+// a value derived from GOMAXPROCS is used.
+var EgressWorkers int
+
+// egressPool is a pool of goroutines that run send queues.  A queue is
+// only ever run by a single goroutine at a time, which preserves the
+// ordering of packets sent to a given subscriber.
+type egressPool struct {
+	workers int
+	// idle workers wait on handoff, so that a queue can be given to one
+	// of them directly; wake is signalled when a queue is added to the
+	// run list.
+	handoff chan *sendQueue
+	wake    chan struct{}
+
+	mu sync.Mutex
+	// queues waiting to be run
+	runnable []*sendQueue
+	// number of workers currently running a queue
+	active int
+
+	// statistics, protected by mu
+	busy    time.Duration
+	packets uint64
+	// the number of queues handed directly to an idle worker
+	direct uint64
+	// an exponentially weighted average of the fraction of time the
+	// workers are busy, and the values of time and busy when it was
+	// last updated
+	utilisation float64
+	lastUpdate  time.Time
+	lastBusy    time.Duration
+}
+
+var egress struct {
+	once sync.Once
+	pool *egressPool
+}
+
+func getEgressPool() *egressPool {
+	egress.once.Do(func() {
+		n := EgressWorkers
+		if n <= 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		egress.pool = newEgressPool(n)
+	})
+	return egress.pool
+}
+
+func newEgressPool(workers int) *egressPool {
+	p := &egressPool{
+		workers:    workers,
+		handoff:    make(chan *sendQueue),
+		wake:       make(chan struct{}, workers),
+		lastUpdate: time.Now(),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// schedule arranges for q to be run by a worker.  Below full load, some
+// worker is idle, and the queue is handed to it directly, bypassing the
+// run list and its lock.  The queue is never run in the calling
+// goroutine, and the handoff doesn't block if no worker is idle, so that
+// a slow subscriber cannot delay the writer that feeds it.
+func (p *egressPool) schedule(q *sendQueue) {
+	select {
+	case p.handoff <- q:
+		return
+	default:
+	}
+
+	p.mu.Lock()
+	p.runnable = append(p.runnable, q)
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+		// enough wakeups are pending already
+	}
+}
+
+// next removes the first queue from the run list, and returns nil if
+// the list is empty.
+func (p *egressPool) next() *sendQueue {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.runnable) == 0 {
+		return nil
+	}
+	q := p.runnable[0]
+	p.runnable[0] = nil
+	p.runnable = p.runnable[1:]
+	p.active++
+	return q
+}
+
+func (p *egressPool) worker() {
+	for {
+		q := p.next()
+		if q == nil {
+			select {
+			case q = <-p.handoff:
+				p.mu.Lock()
+				p.active++
+				p.direct++
+				p.mu.Unlock()
+			case <-p.wake:
+				continue
+			}
+		}
+
+		start := time.Now()
+		n, more := q.run()
+		d := time.Since(start)
+
+		p.mu.Lock()
+		p.active--
+		p.busy += d
+		p.packets += uint64(n)
+		if more {
+			// put it at the end, so that other queues get
+			// a chance to run.
+			p.runnable = append(p.runnable, q)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// updateUtilisation folds the time spent by the workers since the last
+// update into the average utilisation.  Since the average decays with
+// time, it doesn't depend on how often it is updated.
+// Called locked.
+func (p *egressPool) updateUtilisation(now time.Time) {
+	dt := now.Sub(p.lastUpdate)
+	if dt <= 0 {
+		return
+	}
+	u := float64(p.busy-p.lastBusy) /
+		float64(dt*time.Duration(p.workers))
+	alpha := 1 - math.Exp(-float64(dt)/float64(utilisationWindow))
+	p.utilisation += alpha * (u - p.utilisation)
+	p.lastUpdate = now
+	p.lastBusy = p.busy
+}
+
+// getStats returns statistics about the pool.  The utilisation is
+// averaged over the last few seconds.
+func (p *egressPool) getStats() stats.Egress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.updateUtilisation(time.Now())
+
+	return stats.Egress{
+		Workers:     p.workers,
+		Active:      p.active,
+		Backlog:     len(p.runnable),
+		Utilisation: p.utilisation,
+		Busy:        stats.Duration(p.busy),
+		Packets:     p.packets,
+		Direct:      p.direct,
+	}
+}
+
+// GetEgressStats returns statistics about the egress pool.
+func GetEgressStats() stats.Egress {
+	return getEgressPool().getStats()
+}
@@ -0,0 +1,132 @@
+package rtpconn
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/estimator"
+)
+
+func TestEgressPool(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "audio/opus"}, "a", "b",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+
+	const nqueues = 8
+	const npackets = 1000
+
+	pool := newEgressPool(2)
+	queues := make([]*sendQueue, nqueues)
+	tracks := make([]*rtpDownTrack, nqueues)
+	for i := range queues {
+		queues[i] = newSendQueue(pool)
+		tracks[i] = &rtpDownTrack{
+			track: local,
+			conn:  &rtpDownConnection{},
+			rate:  estimator.New(time.Second),
+		}
+	}
+
+	var wg sync.WaitGroup
+	buf := make([]byte, 100)
+	for i := range queues {
+		wg.Add(1)
+		go func(q *sendQueue, track *rtpDownTrack) {
+			defer wg.Done()
+			for j := 0; j < npackets; j++ {
+				q.push(track, buf, priorityAudio)
+			}
+		}(queues[i], tracks[i])
+	}
+	wg.Wait()
+
+	for {
+		s := pool.getStats()
+		n := s.Packets
+		for _, q := range queues {
+			dropped, _ := q.getDropped()
+			n += dropped[priorityAudio]
+		}
+		if n == nqueues*npackets {
+			break
+		}
+		if n > nqueues*npackets {
+			t.Fatalf("Too many packets: %v", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, q := range queues {
+		q.mu.Lock()
+		if q.scheduled || len(q.packets) > 0 {
+			t.Errorf("Queue not drained")
+		}
+		q.mu.Unlock()
+	}
+
+	s := pool.getStats()
+	if s.Workers != 2 || s.Active != 0 || s.Backlog != 0 {
+		t.Errorf("Unexpected stats %v", s)
+	}
+}
+
+func TestEgressUtilisation(t *testing.T) {
+	now := time.Now()
+	p := &egressPool{workers: 2, lastUpdate: now}
+
+	// both workers busy for a whole window
+	now = now.Add(utilisationWindow)
+	p.busy += 2 * utilisationWindow
+	p.updateUtilisation(now)
+	u := p.utilisation
+	if u < 0.6 || u > 0.7 {
+		t.Errorf("Expected about 0.63, got %v", u)
+	}
+
+	// an immediate second caller doesn't reset the average
+	p.updateUtilisation(now.Add(time.Millisecond))
+	if p.utilisation < 0.99*u {
+		t.Errorf("Average was reset: %v", p.utilisation)
+	}
+
+	// idle for a long time
+	p.updateUtilisation(now.Add(10 * utilisationWindow))
+	if p.utilisation > 0.001 {
+		t.Errorf("Expected about 0, got %v", p.utilisation)
+	}
+}
+
+func TestEgressDirect(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "audio/opus"}, "a", "b",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+
+	pool := newEgressPool(1)
+	q := newSendQueue(pool)
+	track := &rtpDownTrack{
+		track: local,
+		conn:  &rtpDownConnection{},
+		rate:  estimator.New(time.Second),
+	}
+
+	// give the worker time to become idle
+	time.Sleep(10 * time.Millisecond)
+	q.push(track, make([]byte, 100), priorityAudio)
+
+	for pool.getStats().Packets < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	s := pool.getStats()
+	if s.Direct != 1 || s.Backlog != 0 {
+		t.Errorf("Expected direct handoff, got %v", s)
+	}
+}
@@ -0,0 +1,181 @@
+package rtpconn
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+// An Impairment describes the network conditions simulated on the down
+// connections of some clients.  It is only useful for exercising the
+// reaction of clients and of congestion control to packet loss.
+type Impairment struct {
+	// the group and username of the affected clients, any if empty
+	Group, User string
+	// the percentages of packets that are dropped, delayed by
+	// Latency, and swapped with the next packet
+	Loss, Delay, Reorder float64
+	Latency              time.Duration
+	// the seed of the random number generator, which makes the
+	// packets affected the same from one run to the next
+	Seed int64
+}
+
+// Impairments is the list of impairments applied to down connections;
+// a connection is affected by the first one that matches.  It is set
+// by the main program, and must not be modified afterwards.
+var Impairments []*Impairment
+
+const defaultLatency = 100 * time.Millisecond
+
+// a packet held back in order to be reordered is sent anyway after this
+// delay if no other packet arrives
+const reorderTimeout = 50 * time.Millisecond
+
+// ParseImpairment parses the description of an impairment, which is
+// a comma-separated list of key=value pairs, for example
+// "user=bob,loss=5,reorder=1".
+func ParseImpairment(s string) (*Impairment, error) {
+	i := &Impairment{}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %v", kv)
+		}
+		var err error
+		switch k {
+		case "group":
+			i.Group = v
+		case "user":
+			i.User = v
+		case "loss":
+			i.Loss, err = parsePercentage(v)
+		case "delay":
+			i.Delay, err = parsePercentage(v)
+		case "reorder":
+			i.Reorder, err = parsePercentage(v)
+		case "latency":
+			i.Latency, err = time.ParseDuration(v)
+			if err == nil && i.Latency < 0 {
+				err = errors.New("negative latency")
+			}
+		case "seed":
+			i.Seed, err = strconv.ParseInt(v, 10, 64)
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", k, err)
+		}
+	}
+	if i.Loss+i.Delay+i.Reorder > 100 {
+		return nil, errors.New("percentages add up to more than 100")
+	}
+	if i.Latency == 0 {
+		i.Latency = defaultLatency
+	}
+	return i, nil
+}
+
+func parsePercentage(v string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 100 {
+		return 0, errors.New("percentage out of range")
+	}
+	return p, nil
+}
+
+func (i *Impairment) String() string {
+	return fmt.Sprintf(
+		"loss %v%%, delay %v%% by %v, reorder %v%%",
+		i.Loss, i.Delay, i.Latency, i.Reorder,
+	)
+}
+
+// getImpairment returns the impairment that applies to the down
+// connections of a client, or nil.
+func getImpairment(c group.Client) *Impairment {
+	for _, i := range Impairments {
+		if i.Group != "" && i.Group != c.Group().Name() {
+			continue
+		}
+		if i.User != "" && i.User != c.Username() {
+			continue
+		}
+		return i
+	}
+	return nil
+}
+
+// An impairer applies an impairment to the packets of a down track.
+type impairer struct {
+	impairment *Impairment
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	// a packet held back until the next one has been sent
+	held []byte
+	// incremented whenever a packet is held
+	heldSeqno uint64
+}
+
+func newImpairer(i *Impairment) *impairer {
+	return &impairer{
+		impairment: i,
+		rand:       rand.New(rand.NewSource(i.Seed)),
+	}
+}
+
+// apply applies the impairment to a packet.  It calls send on the
+// packets that are not dropped, possibly later and from a different
+// goroutine.  The caller may reuse buf after apply returns.
+func (imp *impairer) apply(buf []byte, send func([]byte)) {
+	i := imp.impairment
+	imp.mu.Lock()
+	x := imp.rand.Float64() * 100
+	held := imp.held
+	imp.held = nil
+
+	switch {
+	case x < i.Loss:
+		imp.mu.Unlock()
+	case x < i.Loss+i.Delay:
+		imp.mu.Unlock()
+		b := append([]byte(nil), buf...)
+		time.AfterFunc(i.Latency, func() {
+			send(b)
+		})
+	case x < i.Loss+i.Delay+i.Reorder && held == nil:
+		b := append([]byte(nil), buf...)
+		imp.held = b
+		imp.heldSeqno++
+		seqno := imp.heldSeqno
+		imp.mu.Unlock()
+		time.AfterFunc(reorderTimeout, func() {
+			imp.mu.Lock()
+			if imp.held == nil || imp.heldSeqno != seqno {
+				imp.mu.Unlock()
+				return
+			}
+			imp.held = nil
+			imp.mu.Unlock()
+			send(b)
+		})
+	default:
+		imp.mu.Unlock()
+		send(buf)
+	}
+
+	if held != nil {
+		send(held)
+	}
+}
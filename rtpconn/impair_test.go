@@ -0,0 +1,100 @@
+package rtpconn
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseImpairment(t *testing.T) {
+	i, err := ParseImpairment("group=test, user=bob,loss=5%,delay=10,latency=200ms,reorder=1.5,seed=42")
+	if err != nil {
+		t.Fatalf("ParseImpairment: %v", err)
+	}
+	expected := Impairment{
+		Group: "test", User: "bob",
+		Loss: 5, Delay: 10, Reorder: 1.5,
+		Latency: 200 * time.Millisecond,
+		Seed:    42,
+	}
+	if *i != expected {
+		t.Errorf("Expected %v, got %v", expected, *i)
+	}
+
+	i, err = ParseImpairment("delay=100")
+	if err != nil {
+		t.Fatalf("ParseImpairment: %v", err)
+	}
+	if i.Latency != defaultLatency {
+		t.Errorf("Expected %v, got %v", defaultLatency, i.Latency)
+	}
+
+	bad := []string{
+		"", "loss", "loss=x", "loss=101", "loss=-1", "loss=60,delay=60",
+		"latency=-1s", "seed=1.5", "jitter=5",
+	}
+	for _, s := range bad {
+		_, err := ParseImpairment(s)
+		if err == nil {
+			t.Errorf("%#v: expected error", s)
+		}
+	}
+}
+
+// impairedSequence passes the packets 0 to n-1 through an impairer,
+// and returns the packets sent, in order.
+func impairedSequence(i *Impairment, n int, wait time.Duration) []byte {
+	var mu sync.Mutex
+	var sent []byte
+	send := func(b []byte) {
+		mu.Lock()
+		sent = append(sent, b[0])
+		mu.Unlock()
+	}
+	imp := newImpairer(i)
+	buf := make([]byte, 1)
+	for j := 0; j < n; j++ {
+		buf[0] = byte(j)
+		imp.apply(buf, send)
+	}
+	time.Sleep(wait)
+	mu.Lock()
+	defer mu.Unlock()
+	return sent
+}
+
+func TestImpairer(t *testing.T) {
+	sent := impairedSequence(&Impairment{Loss: 100}, 10, 0)
+	if len(sent) != 0 {
+		t.Errorf("Expected no packets, got %v", sent)
+	}
+
+	sent = impairedSequence(&Impairment{Reorder: 100}, 4, 0)
+	if string(sent) != "\x01\x00\x03\x02" {
+		t.Errorf("Expected swapped packets, got %v", sent)
+	}
+
+	// a held packet is sent even if no other packet follows
+	sent = impairedSequence(&Impairment{Reorder: 100}, 1, 2*reorderTimeout)
+	if len(sent) != 1 {
+		t.Errorf("Expected one packet, got %v", sent)
+	}
+
+	sent = impairedSequence(
+		&Impairment{Delay: 100, Latency: 10 * time.Millisecond}, 10, 0,
+	)
+	if len(sent) != 0 {
+		t.Errorf("Expected no packets, got %v", sent)
+	}
+
+	// the same packets are affected from one run to the next
+	i := &Impairment{Loss: 30, Seed: 7}
+	sent = impairedSequence(i, 100, 0)
+	if len(sent) < 50 || len(sent) > 90 {
+		t.Errorf("Unexpected number of packets %v", len(sent))
+	}
+	sent2 := impairedSequence(i, 100, 0)
+	if string(sent) != string(sent2) {
+		t.Errorf("Different runs, %v and %v", sent, sent2)
+	}
+}
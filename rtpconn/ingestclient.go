@@ -0,0 +1,188 @@
+package rtpconn
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/pion/webrtc/v3"
+)
+
+// IngestClient is a client that injects a stream received over RTMP or
+// SRT, pulled from an RTSP camera, or generated by the server itself.
+// The media is sent over a local WebRTC connection, see the ingest
+// package, so that it goes through the same machinery as media from
+// other clients.
+type IngestClient struct {
+	group    *group.Group
+	id       string
+	username string
+	done     chan struct{}
+
+	mu          sync.Mutex
+	permissions []string
+	connection  *rtpUpConnection
+	closed      bool
+}
+
+func NewIngestClient(g *group.Group, id string) *IngestClient {
+	return &IngestClient{group: g, id: id, done: make(chan struct{})}
+}
+
+func (c *IngestClient) Group() *group.Group {
+	return c.group
+}
+
+func (c *IngestClient) Id() string {
+	return c.id
+}
+
+func (c *IngestClient) Username() string {
+	return c.username
+}
+
+func (c *IngestClient) SetUsername(username string) {
+	c.username = username
+}
+
+func (c *IngestClient) Permissions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.permissions
+}
+
+func (c *IngestClient) SetPermissions(perms []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.permissions = perms
+}
+
+func (c *IngestClient) Data() map[string]interface{} {
+	return nil
+}
+
+func (c *IngestClient) PushConn(g *group.Group, id string, conn conn.Up, tracks []conn.UpTrack, replace string) error {
+	return nil
+}
+
+func (c *IngestClient) RequestConns(target group.Client, g *group.Group, id string) error {
+	if g != c.group {
+		return nil
+	}
+
+	c.mu.Lock()
+	up := c.connection
+	c.mu.Unlock()
+	if up == nil {
+		return nil
+	}
+	tracks := up.getTracks()
+	ts := make([]conn.UpTrack, len(tracks))
+	for i, t := range tracks {
+		ts[i] = t
+	}
+	target.PushConn(g, up.Id(), up, ts, "")
+	return nil
+}
+
+func (c *IngestClient) Joined(group, kind string) error {
+	return nil
+}
+
+func (c *IngestClient) PushClient(group, kind, id, username string, permissions []string, status map[string]interface{}) error {
+	return nil
+}
+
+func (c *IngestClient) Kick(id string, user *string, message string) error {
+	return c.Close()
+}
+
+// Done returns a channel that is closed when the client is closed,
+// either by the ingest server or because it was kicked.
+func (c *IngestClient) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *IngestClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	up := c.connection
+	c.connection = nil
+	c.mu.Unlock()
+
+	g := c.group
+	if up != nil {
+		up.pc.OnICEConnectionStateChange(nil)
+		up.pc.Close()
+		for _, c := range g.GetClients(c) {
+			c.PushConn(g, up.Id(), nil, nil, "")
+		}
+	}
+	group.DelClient(c)
+	return nil
+}
+
+// Connect accepts an offer from the local connection, and returns the
+// answer.
+func (c *IngestClient) Connect(ctx context.Context, offer []byte) ([]byte, error) {
+	up, err := newUpConn(c, c.id, "", string(offer))
+	if err != nil {
+		return nil, err
+	}
+
+	up.pc.OnICEConnectionStateChange(
+		func(state webrtc.ICEConnectionState) {
+			switch state {
+			case webrtc.ICEConnectionStateFailed,
+				webrtc.ICEConnectionStateClosed:
+				c.Close()
+			}
+		})
+
+	err = up.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offer),
+	})
+	if err != nil {
+		up.pc.Close()
+		return nil, err
+	}
+
+	answer, err := up.pc.CreateAnswer(nil)
+	if err != nil {
+		up.pc.Close()
+		return nil, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(up.pc)
+	err = up.pc.SetLocalDescription(answer)
+	if err != nil {
+		up.pc.Close()
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		up.pc.Close()
+		return nil, ctx.Err()
+	case <-gatherComplete:
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.connection != nil {
+		up.pc.OnICEConnectionStateChange(nil)
+		up.pc.Close()
+		return nil, errors.New("client is closed or already connected")
+	}
+	c.connection = up
+
+	return []byte(up.pc.LocalDescription().SDP), nil
+}
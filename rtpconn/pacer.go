@@ -0,0 +1,119 @@
+package rtpconn
+
+import (
+	"time"
+
+	"github.com/jech/galene/rtptime"
+)
+
+const (
+	// pacingFactor is the ratio between the pacing rate and the
+	// estimated capacity; pacing at a higher rate allows the queue to
+	// drain after a burst.
+	pacingFactor = 5 / 2.0
+	// pacingBurst is the amount of data that may be sent back-to-back
+	pacingBurst = 5 * time.Millisecond
+	// but we always allow a few full-sized packets
+	pacingMinBurst = 4 * 1200
+	// the minimum pacing rate, in bits per second
+	pacingMinRate = 200 * 1000
+)
+
+// A pacer is a token bucket that limits the rate at which a send queue
+// is drained, which avoids sending keyframes and bursts of
+// retransmissions back-to-back.  It is protected by the queue's mutex.
+type pacer struct {
+	// the pacing rate in bits per second, 0 if unlimited
+	rate   uint64
+	budget int64
+	last   time.Time
+}
+
+// burst returns the size of the bucket, in bytes.
+func (p *pacer) burst() int64 {
+	b := int64(p.rate * uint64(pacingBurst) / (8 * uint64(time.Second)))
+	if b < pacingMinBurst {
+		b = pacingMinBurst
+	}
+	return b
+}
+
+// setRate sets the pacing rate.  A rate of 0 disables pacing.
+func (p *pacer) setRate(rate uint64) {
+	if rate != 0 && rate < pacingMinRate {
+		rate = pacingMinRate
+	}
+	p.rate = rate
+	if b := p.burst(); p.budget > b {
+		p.budget = b
+	}
+}
+
+// refill adds the tokens accumulated since the last call.
+func (p *pacer) refill(now time.Time) {
+	if p.rate == 0 {
+		return
+	}
+	burst := p.burst()
+	d := now.Sub(p.last)
+	if p.last.IsZero() || d > time.Second {
+		// this avoids overflow
+		p.budget = burst
+	} else if d > 0 {
+		p.budget += int64(uint64(d) * p.rate / (8 * uint64(time.Second)))
+	}
+	if p.budget > burst {
+		p.budget = burst
+	}
+	p.last = now
+}
+
+// allow returns true if a packet may be sent now.
+func (p *pacer) allow() bool {
+	return p.rate == 0 || p.budget > 0
+}
+
+// sent records that size bytes have been sent.
+func (p *pacer) sent(size int) {
+	if p.rate != 0 {
+		p.budget -= int64(size)
+	}
+}
+
+// delay returns the time after which a packet may be sent.
+func (p *pacer) delay() time.Duration {
+	if p.allow() {
+		return 0
+	}
+	d := time.Duration(
+		uint64(-p.budget+1) * 8 * uint64(time.Second) / p.rate,
+	)
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d
+}
+
+// updatePacing sets the pacing rate of the send queue from the receiver's
+// feedback.
+func (down *rtpDownConnection) updatePacing() {
+	rate, ok := down.twcc.Estimate()
+	if !ok {
+		// REMB applies to the whole connection, so take the
+		// largest limit rather than their sum.
+		rate = 0
+		jiffies := rtptime.Jiffies()
+		for _, t := range down.getTracks() {
+			r := t.feedbackBitrate(jiffies)
+			if r == ^uint64(0) {
+				// no feedback, don't pace
+				rate = 0
+				break
+			}
+			if r > rate {
+				rate = r
+			}
+		}
+	}
+	down.queue.setPacingRate(uint64(float64(rate) * pacingFactor))
+}
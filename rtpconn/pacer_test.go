@@ -0,0 +1,95 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/estimator"
+)
+
+func TestPacer(t *testing.T) {
+	var p pacer
+	now := time.Now()
+	p.refill(now)
+	if !p.allow() || p.delay() != 0 {
+		t.Errorf("Unlimited pacer is limited")
+	}
+
+	// 1Mbit/s, or 125 bytes per millisecond
+	p.setRate(1000 * 1000)
+	p.refill(now)
+	if p.budget != pacingMinBurst {
+		t.Errorf("Expected %v, got %v", pacingMinBurst, p.budget)
+	}
+	for p.allow() {
+		p.sent(1200)
+	}
+	if p.budget != pacingMinBurst-4*1200 {
+		t.Errorf("Unexpected budget %v", p.budget)
+	}
+	if d := p.delay(); d != time.Millisecond {
+		t.Errorf("Expected 1ms, got %v", d)
+	}
+	p.sent(1250)
+	if d := p.delay(); d < 10*time.Millisecond || d > 11*time.Millisecond {
+		t.Errorf("Expected 10ms, got %v", d)
+	}
+	p.refill(now.Add(4 * time.Millisecond))
+	if p.allow() || p.budget != -750 {
+		t.Errorf("Unexpected budget %v", p.budget)
+	}
+
+	// the bucket doesn't overflow after a long pause
+	p.refill(now.Add(time.Hour))
+	if p.budget != pacingMinBurst {
+		t.Errorf("Expected %v, got %v", pacingMinBurst, p.budget)
+	}
+
+	p.setRate(1000)
+	if p.rate != pacingMinRate {
+		t.Errorf("Expected %v, got %v", pacingMinRate, p.rate)
+	}
+}
+
+func TestSendQueuePacing(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "video/VP8"}, "a", "b",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	track := &rtpDownTrack{
+		track: local,
+		conn:  &rtpDownConnection{},
+		rate:  estimator.New(time.Second),
+	}
+
+	q := newSendQueue(newEgressPool(1))
+	defer q.close()
+	q.setPacingRate(1000 * 1000)
+
+	// a 24kB keyframe takes roughly 150ms to drain at 1Mbit/s
+	start := time.Now()
+	buf := make([]byte, 1200)
+	for i := 0; i < 20; i++ {
+		q.push(track, buf, priorityKeyframe)
+	}
+	for {
+		q.mu.Lock()
+		done := !q.scheduled
+		q.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Queue not drained")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d := time.Since(start)
+	if d < 100*time.Millisecond {
+		t.Errorf("Queue drained too fast (%v)", d)
+	}
+}
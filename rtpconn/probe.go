@@ -0,0 +1,103 @@
+package rtpconn
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/rtptime"
+)
+
+const (
+	// probeInterval is the mean interval between two probes.
+	probeInterval = 10 * time.Second
+	// probeDuration is the duration of a probe, which must be long
+	// enough for the estimator to measure the acknowledged rate.
+	probeDuration = time.Second
+	// maxProbePackets limits the number of padding packets sent at
+	// once, in case the timer wheel is late.
+	maxProbePackets = 64
+)
+
+// probeTrack returns a track that can carry padding, and the current
+// estimate, if the receiver's video is currently limited by the estimated
+// bandwidth and there is no recent loss.  It returns nil otherwise.
+func (down *rtpDownConnection) probeTrack() (*rtpDownTrack, uint64) {
+	if down.getTWCCId() == 0 {
+		return nil, 0
+	}
+	rate, ok := down.twcc.Estimate()
+	if !ok {
+		return nil, 0
+	}
+
+	jiffies := rtptime.Jiffies()
+	var track *rtpDownTrack
+	limited := false
+	for _, t := range down.getTracks() {
+		if t.getRemote().Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		loss, _ := t.stats.Get(jiffies)
+		if loss >= 5 {
+			return nil, 0
+		}
+		layer := t.getLayerInfo()
+		if (!layer.limitSid && layer.sid < layer.maxSid) ||
+			layer.tid < layer.maxTid {
+			limited = true
+		}
+		if t.rtx != nil && t.rtx.negotiated() {
+			track = t
+		}
+	}
+	if !limited {
+		return nil, 0
+	}
+	return track, rate
+}
+
+// sendPadding queues enough padding packets to make up size bytes.
+func (down *rtpDownTrack) sendPadding(size int) {
+	n := (size + paddingSize - 1) / paddingSize
+	if n > maxProbePackets {
+		n = maxProbePackets
+	}
+	ibuf := packetBufPool.Get()
+	defer packetBufPool.Put(ibuf)
+	buf := ibuf.([]byte)
+	for i := 0; i < n; i++ {
+		m := down.rtx.padding(buf, paddingSize)
+		if m == 0 {
+			return
+		}
+		down.write(buf[:m], priorityPadding)
+	}
+}
+
+// startProbe starts a probe if the receiver's video is limited by the
+// estimated bandwidth.  During a probe, padding is sent on the RTX stream
+// at half the estimated rate; if the padding gets through without
+// increasing the delay, the estimator raises its estimate, which allows
+// higher layers to be sent.  It is called by the timer wheel, and returns
+// false when the connection is closed.
+func startProbe(down *rtpDownConnection) bool {
+	if down.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return false
+	}
+	track, rate := down.probeTrack()
+	if track == nil {
+		return true
+	}
+
+	start := time.Now()
+	last := start
+	rtcpWheel.schedule(wheelTick, func() bool {
+		now := time.Now()
+		size := rate / 16 * uint64(now.Sub(last)) / uint64(time.Second)
+		last = now
+		track.sendPadding(int(size))
+		return now.Sub(start) < probeDuration
+	})
+	return true
+}
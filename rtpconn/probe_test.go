@@ -0,0 +1,64 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/rtptime"
+	"github.com/jech/galene/twcc"
+)
+
+func TestProbeTrack(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "video/VP8"}, "video", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	track := &rtpDownTrack{
+		rtx:     newRTXTrack(local),
+		atomics: &downTrackAtomics{},
+		stats:   new(receiverStats),
+	}
+	track.setRemote(&fakeUpTrack{kind: webrtc.RTPCodecTypeVideo})
+	down := &rtpDownConnection{
+		twcc:   twcc.New(),
+		tracks: []*rtpDownTrack{track},
+	}
+	track.setLayerInfo(layerInfo{maxTid: 2})
+
+	if tr, _ := down.probeTrack(); tr != nil {
+		t.Errorf("Probing without TWCC")
+	}
+
+	down.twccId = 3
+	if tr, _ := down.probeTrack(); tr != nil {
+		t.Errorf("Probing without an estimate")
+	}
+
+	now := rtptime.Microseconds()
+	r := twcc.NewRecorder()
+	r.Record(down.twcc.Send(1200, now), now)
+	down.twcc.Feedback(r.Feedback(1, 2), now)
+	if tr, _ := down.probeTrack(); tr != nil {
+		t.Errorf("Probing without RTX")
+	}
+
+	track.rtx.pt = 97
+	tr, rate := down.probeTrack()
+	if tr != track || rate == 0 {
+		t.Errorf("Expected %v, got %v %v", track, tr, rate)
+	}
+
+	track.setLayerInfo(layerInfo{tid: 2, maxTid: 2})
+	if tr, _ := down.probeTrack(); tr != nil {
+		t.Errorf("Probing at the highest layer")
+	}
+
+	track.setLayerInfo(layerInfo{maxTid: 2})
+	track.stats.Set(20, 0, rtptime.Jiffies())
+	if tr, _ := down.probeTrack(); tr != nil {
+		t.Errorf("Probing with loss")
+	}
+}
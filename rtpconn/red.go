@@ -0,0 +1,141 @@
+package rtpconn
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/codecs"
+	"github.com/jech/galene/rtpheader"
+)
+
+// redTrack is a local track for audio that the sender protects with
+// redundancy (RED, RFC 2198).  RED is offered to the receiver alongside
+// the primary codec; if the receiver only accepts the latter, then the
+// redundant encodings are stripped and only the primary encoding is sent,
+// written directly to the RTP stream.
+type redTrack struct {
+	*webrtc.TrackLocalStaticRTP
+
+	mu sync.Mutex
+	// whether RED was negotiated, in which case the packets are
+	// forwarded unchanged
+	bound bool
+	// the payload type of the primary codec, 0 if RED was negotiated
+	pt     uint8
+	ssrc   webrtc.SSRC
+	writer webrtc.TrackLocalWriter
+}
+
+func newREDTrack(local *webrtc.TrackLocalStaticRTP) *redTrack {
+	return &redTrack{TrackLocalStaticRTP: local}
+}
+
+// Bind is called by pion when the track is negotiated.
+func (t *redTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	var primary *webrtc.RTPCodecParameters
+	for _, c := range ctx.CodecParameters() {
+		if strings.EqualFold(c.MimeType, "audio/red") {
+			codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+			if err != nil {
+				return codec, err
+			}
+			t.mu.Lock()
+			t.bound = true
+			t.pt = 0
+			t.writer = nil
+			t.mu.Unlock()
+			return codec, nil
+		}
+		if primary == nil &&
+			strings.EqualFold(c.MimeType, webrtc.MimeTypeOpus) {
+			c := c
+			primary = &c
+		}
+	}
+	if primary == nil {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	t.mu.Lock()
+	t.bound = false
+	t.pt = uint8(primary.PayloadType)
+	t.ssrc = ctx.SSRC()
+	t.writer = ctx.WriteStream()
+	t.mu.Unlock()
+	return *primary, nil
+}
+
+func (t *redTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.Lock()
+	bound := t.bound
+	t.bound = false
+	t.pt = 0
+	t.writer = nil
+	t.mu.Unlock()
+	if !bound {
+		return nil
+	}
+	return t.TrackLocalStaticRTP.Unbind(ctx)
+}
+
+// primary stores in result the packet in buf with the redundant
+// encodings stripped.  It returns 0 if the receiver negotiated RED, or if
+// the packet cannot be converted.
+func (t *redTrack) primary(buf []byte, result []byte) int {
+	t.mu.Lock()
+	pt := t.pt
+	ssrc := t.ssrc
+	t.mu.Unlock()
+	if pt == 0 {
+		return 0
+	}
+
+	h, err := rtpheader.Parse(buf)
+	if err != nil {
+		return 0
+	}
+	payload, err := codecs.REDPrimary(h.Payload())
+	if err != nil {
+		return 0
+	}
+	offset := len(buf) - len(h.Payload())
+	if (buf[0] & 0x20) != 0 {
+		offset -= int(buf[len(buf)-1])
+	}
+	if offset+len(payload) > len(result) {
+		return 0
+	}
+
+	copy(result, buf[:offset])
+	// the padding, if any, has been dropped
+	result[0] &^= 0x20
+	result[1] = (buf[1] & 0x80) | pt
+	binary.BigEndian.PutUint32(result[8:], uint32(ssrc))
+	copy(result[offset:], payload)
+	return offset + len(payload)
+}
+
+// isPrimary returns true if buf was produced by primary.
+func (t *redTrack) isPrimary(buf []byte) bool {
+	t.mu.Lock()
+	pt := t.pt
+	ssrc := t.ssrc
+	t.mu.Unlock()
+	return pt != 0 && len(buf) >= 12 &&
+		(buf[1]&0x7F) == pt &&
+		binary.BigEndian.Uint32(buf[8:]) == uint32(ssrc)
+}
+
+// write writes a packet produced by primary to the network.
+func (t *redTrack) write(buf []byte) (int, error) {
+	t.mu.Lock()
+	writer := t.writer
+	t.mu.Unlock()
+	if writer == nil {
+		return 0, nil
+	}
+	return writer.Write(buf)
+}
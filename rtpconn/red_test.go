@@ -0,0 +1,174 @@
+package rtpconn
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+)
+
+func TestREDPrimary(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "audio/red"}, "audio", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	red := newREDTrack(local)
+
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			PayloadType:    63,
+			SequenceNumber: 42,
+			Timestamp:      4242,
+			SSRC:           1,
+		},
+		// one redundant block of length 2, then the primary
+		Payload: []byte{0x80 | 111, 0x03, 0xC0, 0x02, 111,
+			5, 6, 7, 8, 9},
+	}
+	packet.SetExtension(1, []byte{1, 2})
+	buf, err := packet.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	result := make([]byte, 1500)
+	if red.primary(buf, result) != 0 {
+		t.Errorf("Converted without a binding")
+	}
+
+	red.pt = 111
+	red.ssrc = 12
+	n := red.primary(buf, result)
+	if n != len(buf)-7 {
+		t.Fatalf("Expected %v, got %v", len(buf)-7, n)
+	}
+	if !red.isPrimary(result[:n]) || red.isPrimary(buf) {
+		t.Errorf("isPrimary failed")
+	}
+
+	var p rtp.Packet
+	err = p.Unmarshal(result[:n])
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if p.PayloadType != 111 || !p.Marker || p.SSRC != 12 ||
+		p.SequenceNumber != 42 || p.Timestamp != 4242 ||
+		!bytes.Equal(p.GetExtension(1), []byte{1, 2}) {
+		t.Errorf("Bad header %#v", p.Header)
+	}
+	if !bytes.Equal(p.Payload, []byte{7, 8, 9}) {
+		t.Errorf("Bad payload %v", p.Payload)
+	}
+
+	if red.primary(buf[:len(buf)-4], result) != 0 {
+		t.Errorf("Converted a truncated packet")
+	}
+}
+
+func TestREDNegotiation(t *testing.T) {
+	for _, receiver := range []string{"red", "opus"} {
+		t.Run(receiver, func(t *testing.T) {
+			api, err := group.APIFromNames([]string{"opus", "red"})
+			if err != nil {
+				t.Fatalf("APIFromNames: %v", err)
+			}
+			pc, err := api.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatalf("NewPeerConnection: %v", err)
+			}
+			defer pc.Close()
+
+			names := []string{"opus"}
+			if receiver == "red" {
+				names = append(names, "red")
+			}
+			rapi, err := group.APIFromNames(names)
+			if err != nil {
+				t.Fatalf("APIFromNames: %v", err)
+			}
+			rpc, err := rapi.NewPeerConnection(
+				webrtc.Configuration{},
+			)
+			if err != nil {
+				t.Fatalf("NewPeerConnection: %v", err)
+			}
+			defer rpc.Close()
+
+			codec := webrtc.RTPCodecCapability{
+				MimeType:    "audio/red",
+				ClockRate:   48000,
+				Channels:    2,
+				SDPFmtpLine: "111/111",
+			}
+			local, err := webrtc.NewTrackLocalStaticRTP(
+				codec, "audio", "stream",
+			)
+			if err != nil {
+				t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+			}
+			red := newREDTrack(local)
+			transceiver, err := pc.AddTransceiverFromTrack(red,
+				webrtc.RTPTransceiverInit{
+					Direction: webrtc.RTPTransceiverDirectionSendonly,
+				},
+			)
+			if err != nil {
+				t.Fatalf("AddTransceiver: %v", err)
+			}
+			err = transceiver.SetCodecPreferences(
+				[]webrtc.RTPCodecParameters{
+					{
+						RTPCodecCapability: codec,
+						PayloadType:        63,
+					},
+					group.REDPrimaryCodec(),
+				},
+			)
+			if err != nil {
+				t.Fatalf("SetCodecPreferences: %v", err)
+			}
+
+			offer, err := pc.CreateOffer(nil)
+			if err != nil {
+				t.Fatalf("CreateOffer: %v", err)
+			}
+			err = pc.SetLocalDescription(offer)
+			if err != nil {
+				t.Fatalf("SetLocalDescription: %v", err)
+			}
+			err = rpc.SetRemoteDescription(offer)
+			if err != nil {
+				t.Fatalf("SetRemoteDescription: %v", err)
+			}
+			answer, err := rpc.CreateAnswer(nil)
+			if err != nil {
+				t.Fatalf("CreateAnswer: %v", err)
+			}
+			err = rpc.SetLocalDescription(answer)
+			if err != nil {
+				t.Fatalf("SetLocalDescription: %v", err)
+			}
+			err = pc.SetRemoteDescription(answer)
+			if err != nil {
+				t.Fatalf("SetRemoteDescription: %v", err)
+			}
+
+			red.mu.Lock()
+			bound, pt := red.bound, red.pt
+			red.mu.Unlock()
+			if receiver == "red" && (!bound || pt != 0) {
+				t.Errorf("RED not negotiated")
+			}
+			if receiver == "opus" && (bound || pt != 111) {
+				t.Errorf("Expected Opus, got %v %v", bound, pt)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package rtpconn
+
+import (
+	"sync"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// maxReverse is the number of recent packets that may be mapped back to
+// their source.
+const maxReverse = 0x4000
+
+// A rewriter maps the packets of whichever source is currently forwarded
+// on a down track onto a single sequence number and timestamp space, so
+// that the source may be switched without renegotiation.  The outgoing
+// SSRC is that of the track binding, and is set by the WebRTC stack.
+//
+// Switches are explicit, see rewrite; the caller is responsible for only
+// switching on a keyframe.  Switching to the current source restarts it,
+// which hides the gap after forwarding was paused.
+type rewriter struct {
+	mu      sync.Mutex
+	started bool
+	// the current source
+	ssrc uint32
+	// the deltas applied to the packets of the current source
+	seqnoDelta uint16
+	tsDelta    uint32
+	// the earliest outgoing seqno of the current source that may
+	// still be mapped back, see reverse
+	first uint16
+	// the most recent packet sent, and when it was sent
+	lastSeqno uint16
+	lastTs    uint32
+	lastTime  uint64
+}
+
+// rewrite maps a packet from the source ssrc.  If switching is true, the
+// packet becomes the first one of the current source.  It returns false
+// if the packet belongs to another source, typically one that has been
+// switched away from, and should be dropped.
+func (r *rewriter) rewrite(ssrc uint32, seqno uint16, ts uint32, clockrate uint32, now uint64, switching bool) (bool, uint16, uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.started {
+		r.started = true
+		r.ssrc = ssrc
+		r.first = seqno
+		r.lastSeqno = seqno - 1
+		r.lastTs = ts
+		r.lastTime = now
+	} else if switching {
+		// continue where the previous source stopped, leaving
+		// a timestamp gap equal to the time elapsed
+		elapsed := uint32(0)
+		if now > r.lastTime {
+			d := rtptime.ToDuration(
+				int64(now-r.lastTime), rtptime.JiffiesPerSec,
+			)
+			elapsed = uint32(rtptime.FromDuration(d, clockrate))
+		}
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		r.ssrc = ssrc
+		r.seqnoDelta = r.lastSeqno + 1 - seqno
+		r.tsDelta = r.lastTs + elapsed - ts
+		r.first = seqno + r.seqnoDelta
+	} else if ssrc != r.ssrc {
+		return false, 0, 0
+	}
+
+	newseqno := seqno + r.seqnoDelta
+	newts := ts + r.tsDelta
+	if delta := newseqno - r.lastSeqno; delta != 0 && delta < 0x8000 {
+		r.lastSeqno = newseqno
+		r.lastTs = newts
+		r.lastTime = now
+		if r.lastSeqno-r.first > maxReverse {
+			r.first = r.lastSeqno - maxReverse
+		}
+	}
+	return true, newseqno, newts
+}
+
+// reverse maps an outgoing seqno back to the seqno of the current
+// source.  It returns false if the packet was sent by an earlier source.
+func (r *rewriter) reverse(seqno uint16) (bool, uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.started || seqno-r.first > r.lastSeqno-r.first {
+		return false, 0
+	}
+	return true, seqno - r.seqnoDelta
+}
+
+// timestampDelta returns the offset between the timestamps of the current
+// source and the outgoing timestamps.
+func (r *rewriter) timestampDelta() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tsDelta
+}
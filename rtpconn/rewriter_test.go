@@ -0,0 +1,88 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/rtptime"
+)
+
+func TestRewriter(t *testing.T) {
+	var r rewriter
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+
+	for i := uint16(0); i < 10; i++ {
+		ok, seqno, ts := r.rewrite(1, 100+i, 5000+uint32(i)*3000,
+			90000, now, false)
+		if !ok || seqno != 100+i || ts != 5000+uint32(i)*3000 {
+			t.Errorf("Expected %v %v, got %v %v %v",
+				100+i, 5000+uint32(i)*3000, ok, seqno, ts)
+		}
+	}
+
+	ok, seqno := r.reverse(105)
+	if !ok || seqno != 105 {
+		t.Errorf("Expected 105, got %v %v", ok, seqno)
+	}
+
+	// switch to a new source 100ms later
+	now += rtptime.JiffiesPerSec / 10
+	ok, seqno, ts := r.rewrite(2, 40000, 1234, 90000, now, true)
+	if !ok || seqno != 110 || ts != 5000+9*3000+9000 {
+		t.Errorf("Expected 110 %v, got %v %v %v",
+			5000+9*3000+9000, ok, seqno, ts)
+	}
+	ok, seqno, ts = r.rewrite(2, 40001, 4234, 90000, now, false)
+	if !ok || seqno != 111 || ts != 5000+9*3000+12000 {
+		t.Errorf("Expected 111 %v, got %v %v %v",
+			5000+9*3000+12000, ok, seqno, ts)
+	}
+
+	if delta := r.timestampDelta(); delta != 5000+9*3000+9000-1234 {
+		t.Errorf("Expected %v, got %v", 5000+9*3000+9000-1234, delta)
+	}
+
+	ok, _, _ = r.rewrite(1, 110, 35000, 90000, now, false)
+	if ok {
+		t.Errorf("Accepted a packet from the previous source")
+	}
+
+	ok, seqno = r.reverse(111)
+	if !ok || seqno != 40001 {
+		t.Errorf("Expected 40001, got %v %v", ok, seqno)
+	}
+	ok, _ = r.reverse(105)
+	if ok {
+		t.Errorf("Reversed a packet from the previous source")
+	}
+	ok, _ = r.reverse(112)
+	if ok {
+		t.Errorf("Reversed a packet that wasn't sent")
+	}
+
+	// restart the current source after a pause of one second
+	now += rtptime.JiffiesPerSec
+	ok, seqno, ts = r.rewrite(2, 40100, 304234, 90000, now, true)
+	if !ok || seqno != 112 || ts != 5000+9*3000+12000+90000 {
+		t.Errorf("Expected 112 %v, got %v %v %v",
+			5000+9*3000+12000+90000, ok, seqno, ts)
+	}
+	ok, _ = r.reverse(111)
+	if ok {
+		t.Errorf("Reversed a packet sent before the restart")
+	}
+}
+
+func TestRewriterWrap(t *testing.T) {
+	var r rewriter
+	for i := 0; i < 70000; i++ {
+		ok, seqno, _ := r.rewrite(1, uint16(i), uint32(i), 90000, 0, false)
+		if !ok || seqno != uint16(i) {
+			t.Fatalf("Expected %v, got %v %v", uint16(i), ok, seqno)
+		}
+	}
+	last := uint16(69999 & 0xFFFF)
+	ok, seqno := r.reverse(last)
+	if !ok || seqno != last {
+		t.Errorf("Expected %v, got %v %v", last, ok, seqno)
+	}
+}
@@ -1,11 +1,13 @@
 package rtpconn
 
 import (
+	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 	"math/bits"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,14 +20,17 @@ import (
 	"github.com/jech/galene/conn"
 	"github.com/jech/galene/estimator"
 	"github.com/jech/galene/group"
-	"github.com/jech/galene/ice"
 	"github.com/jech/galene/jitter"
+	"github.com/jech/galene/logging"
 	"github.com/jech/galene/packetcache"
 	"github.com/jech/galene/packetmap"
 	"github.com/jech/galene/rtptime"
+	"github.com/jech/galene/twcc"
 	"github.com/jech/galene/unbounded"
 )
 
+var logger = logging.New("rtpconn")
+
 type bitrate struct {
 	bitrate uint64
 	jiffies uint64
@@ -76,26 +81,144 @@ type downTrackAtomics struct {
 	sr        uint64
 	srNTP     uint64
 	remoteNTP uint64
+	// packets requested by the receiver in NACKs
+	nacks     uint64
 	remoteRTP uint32
 	layerInfo uint32
+	// the highest layers requested by the receiver, see setLayerLimit
+	layerLimit uint32
+	// the size at which the receiver renders the video
+	renderSize uint32
 }
 
 type rtpDownTrack struct {
 	track          *webrtc.TrackLocalStaticRTP
+	rtx            *rtxTrack
+	red            *redTrack
 	sender         *webrtc.RTPSender
 	conn           *rtpDownConnection
-	remote         conn.UpTrack
+	remote         atomic.Value // remoteTrack
 	ssrc           webrtc.SSRC
 	packetmap      packetmap.Map
+	rewriter       rewriter
 	maxBitrate     *bitrate
 	maxREMBBitrate *bitrate
+	maxTWCCBitrate *bitrate
 	rate           *estimator.Estimator
 	stats          *receiverStats
 	atomics        *downTrackAtomics
 	cname          atomic.Value
+	// the track we are switching to, see switchRemote
+	pending atomic.Pointer[rtpUpTrack]
+	// whether forwarding is paused, see setPaused
+	paused atomic.Bool
+	// nil unless the connection is impaired
+	impair *impairer
+}
+
+// remoteTrack wraps the source of a down track, so that all the values
+// stored in rtpDownTrack.remote have the same type.
+type remoteTrack struct {
+	conn.UpTrack
+}
+
+// getRemote returns the track currently forwarded.
+func (down *rtpDownTrack) getRemote() conn.UpTrack {
+	remote, _ := down.remote.Load().(remoteTrack)
+	return remote.UpTrack
+}
+
+func (down *rtpDownTrack) setRemote(remote conn.UpTrack) {
+	down.remote.Store(remoteTrack{remote})
+}
+
+// getTarget returns the track being switched to, if any, and the track
+// currently forwarded otherwise.
+func (down *rtpDownTrack) getTarget() conn.UpTrack {
+	if pending := down.pending.Load(); pending != nil {
+		return pending
+	}
+	return down.getRemote()
+}
+
+var errCodecMismatch = errors.New("codec mismatch")
+
+// switchRemote causes down to forward up instead of its current source,
+// without renegotiation.  The switch happens on the next keyframe from
+// up; until then, the current source is still forwarded.  Switching to
+// the current source restarts it, which is used after a pause.
+func (down *rtpDownTrack) switchRemote(up *rtpUpTrack) error {
+	remote := down.getRemote()
+	if !strings.EqualFold(up.Codec().MimeType, remote.Codec().MimeType) {
+		return errCodecMismatch
+	}
+	old := down.pending.Swap(up)
+	if old != nil && old != up && conn.UpTrack(old) != remote {
+		old.DelLocal(down)
+	}
+	if conn.UpTrack(up) != remote {
+		err := up.AddLocal(down)
+		if err != nil {
+			down.pending.CompareAndSwap(up, nil)
+			return err
+		}
+	}
+	return up.RequestKeyframe()
+}
+
+// commitRemote makes pending the source of down.  Called by writePacket
+// on the first keyframe from pending.
+func (down *rtpDownTrack) commitRemote(pending *rtpUpTrack) bool {
+	if !down.pending.CompareAndSwap(pending, nil) {
+		return false
+	}
+	old := down.getRemote()
+	down.setRemote(pending)
+	if old != conn.UpTrack(pending) {
+		old.DelLocal(down)
+	}
+	// SetTimeOffset ignores the sender reports received during the
+	// switch, apply those of the new source
+	pending.mu.Lock()
+	ntp, rtp := pending.srNTPTime, pending.srRTPTime
+	pending.mu.Unlock()
+	if ntp != 0 {
+		down.SetTimeOffset(ntp, rtp)
+	}
+	return true
+}
+
+// setPaused pauses or resumes forwarding without renegotiation.  The
+// receiver sees the track freeze; when forwarding resumes, it continues
+// on the next keyframe, with no gap in sequence numbers.
+func (down *rtpDownTrack) setPaused(paused bool) {
+	if !paused && down.paused.Load() {
+		// restart the source before unpausing, so that we wait
+		// for a keyframe
+		up, ok := down.getTarget().(*rtpUpTrack)
+		if ok {
+			err := down.switchRemote(up)
+			if err != nil {
+				down.conn.log.Warnf("Resume: %v", err)
+			}
+		}
+	}
+	down.paused.Store(paused)
+}
+
+// detach stops forwarding to down.
+func (down *rtpDownTrack) detach() {
+	if pending := down.pending.Swap(nil); pending != nil {
+		pending.DelLocal(down)
+	}
+	down.getRemote().DelLocal(down)
 }
 
 func (down *rtpDownTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+	if down.pending.Load() != nil {
+		// we don't know which source this comes from
+		return
+	}
 	atomic.StoreUint64(&down.atomics.remoteNTP, ntp)
 	atomic.StoreUint32(&down.atomics.remoteRTP, rtp)
 }
@@ -167,6 +290,28 @@ func (down *rtpDownTrack) setLayerInfo(info layerInfo) {
 	)
 }
 
+// noLayerLimit indicates that the receiver accepts any layer.
+const noLayerLimit = 0xF
+
+// setLayerLimit sets the highest spatial and temporal layers that the
+// receiver wishes to receive.  A negative value means no limit.
+func (down *rtpDownTrack) setLayerLimit(sid, tid int) {
+	limit := func(v int) uint32 {
+		if v < 0 || v >= noLayerLimit {
+			return noLayerLimit
+		}
+		return uint32(v)
+	}
+	// stored complemented, so that the zero value means no limit
+	atomic.StoreUint32(&down.atomics.layerLimit,
+		(limit(sid)|limit(tid)<<4)^0xFF)
+}
+
+func (down *rtpDownTrack) getLayerLimit() (uint8, uint8) {
+	l := atomic.LoadUint32(&down.atomics.layerLimit) ^ 0xFF
+	return uint8(l & 0xF), uint8((l >> 4) & 0xF)
+}
+
 const (
 	negotiationUnneeded = iota
 	negotiationNeeded
@@ -180,6 +325,23 @@ type rtpDownConnection struct {
 	iceCandidates     []*webrtc.ICECandidateInit
 	negotiationNeeded int
 	requested         []string
+	queue             *sendQueue
+	// whether we are sending the low layer of a simulcast stream for
+	// lack of bandwidth, and when we last switched
+	simulcastLow    bool
+	simulcastSwitch time.Time
+	// whether we have stopped sending video for lack of bandwidth
+	videoPaused bool
+	// per-track requests made by the receiver, indexed by kind
+	trackRequests map[webrtc.RTPCodecType]trackRequest
+	// sender-side bandwidth estimation
+	twcc   *twcc.Estimator
+	twccId uint32
+	// the trace of the establishment of the connection, may be nil
+	trace *connTrace
+	// the simulated network conditions, nil in normal operation
+	impairment *Impairment
+	log        *logging.Logger
 
 	mu     sync.Mutex
 	tracks []*rtpDownTrack
@@ -198,19 +360,28 @@ func newDownConn(c group.Client, id string, remote conn.Up) (*rtpDownConnection,
 	if err != nil {
 		return nil, err
 	}
-	pc, err := api.NewPeerConnection(*ice.ICEConfiguration())
+	pc, err := api.NewPeerConnection(*c.Group().ICEConfiguration())
 	if err != nil {
 		return nil, err
 	}
 
+	l := clientLogger(c, id)
 	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Printf("Got track on downstream connection")
+		l.Warnf("Got track on downstream connection")
 	})
 
 	conn := &rtpDownConnection{
 		id:     id,
 		pc:     pc,
 		remote: remote,
+		queue:  newSendQueue(getEgressPool()),
+		twcc:   twcc.New(),
+		log:    clientLogger(c, id),
+	}
+	conn.queue.memory = c.Group().Memory(group.MemoryQueue)
+	conn.impairment = getImpairment(c)
+	if conn.impairment != nil {
+		conn.log.Infof("Impairing connection: %v", conn.impairment)
 	}
 
 	return conn, nil
@@ -223,16 +394,104 @@ var packetBufPool = sync.Pool{
 }
 
 func (down *rtpDownTrack) Write(buf []byte) (int, error) {
-	codec := down.remote.Codec().MimeType
+	return down.writePacket(buf, false)
+}
+
+// retransmit sends a packet requested by the receiver, on the RTX stream
+// if one was negotiated.
+func (down *rtpDownTrack) retransmit(buf []byte) (int, error) {
+	return down.writePacket(buf, true)
+}
+
+var errTruncated = errors.New("truncated packet")
+
+func (down *rtpDownTrack) writePacket(buf []byte, retransmit bool) (int, error) {
+	if len(buf) < 12 {
+		return 0, errTruncated
+	}
+	if down.paused.Load() {
+		return 0, nil
+	}
+	ssrc := binary.BigEndian.Uint32(buf[8:])
+	remote := down.getRemote()
+	pending := down.pending.Load()
+	switching := pending != nil && !retransmit &&
+		uint32(pending.track.SSRC()) == ssrc
+	if switching {
+		remote = pending
+	}
+	codec := remote.Codec().MimeType
 
 	flags, err := codecs.PacketFlags(codec, buf)
 	if err != nil {
 		return 0, err
 	}
 
+	if strings.EqualFold(codec, "video/av1") {
+		// the layer information was extracted from the dependency
+		// descriptor by the reader, which strips header extensions
+		if up, ok := remote.(*rtpUpTrack); ok {
+			info, ok := up.cache.Info(flags.Seqno)
+			if ok {
+				flags.Keyframe = info.Keyframe
+				if info.Layer.Valid {
+					flags.Start = info.Layer.Start
+					flags.End = info.Layer.End
+					flags.Sid = info.Layer.Sid
+					flags.Tid = info.Layer.Tid
+					flags.TidUpSync = info.Keyframe ||
+						info.Layer.TidUpSync
+				}
+			}
+		}
+	}
+
+	if switching {
+		if !flags.Keyframe {
+			if flags.Start {
+				pending.RequestKeyframe()
+			}
+			return 0, nil
+		}
+		if !down.commitRemote(pending) {
+			return 0, nil
+		}
+	}
+
+	// map the source onto the outgoing seqno and timestamp space;
+	// the packetmap works on the rewritten seqnos
+	seqno := flags.Seqno
+	ts := binary.BigEndian.Uint32(buf[4:])
+	ok, mapped, newts := down.rewriter.rewrite(
+		ssrc, seqno, ts, remote.Codec().ClockRate, rtptime.Jiffies(),
+		switching,
+	)
+	if !ok {
+		return 0, nil
+	}
+	flags.Seqno = mapped
+
+	if !retransmit && remote.Kind() == webrtc.RTPCodecTypeAudio {
+		up, ok := remote.(*rtpUpTrack)
+		if ok && up.isSuppressed() {
+			// the receiver sees a timestamp jump, as with DTX
+			down.packetmap.Drop(flags.Seqno, flags.Pid)
+			return 0, nil
+		}
+	}
+
 	layer := down.getLayerInfo()
 
-	if flags.Tid > layer.maxTid || flags.Sid > layer.maxSid {
+	maxSid := layer.maxSid
+	if flags.Scalability {
+		// the sender tells us how many spatial layers it sends
+		maxSid = flags.MaxSid
+	}
+	if flags.Sid > maxSid {
+		maxSid = flags.Sid
+	}
+
+	if flags.Tid > layer.maxTid || maxSid != layer.maxSid {
 		if flags.Tid > layer.maxTid {
 			// increase eagerly if this is the first time we
 			// see a given layer
@@ -242,13 +501,21 @@ func (down *rtpDownTrack) Write(buf []byte) (int, error) {
 			}
 			layer.maxTid = flags.Tid
 		}
-		if flags.Sid > layer.maxSid {
+		if maxSid > layer.maxSid {
 			if layer.sid == layer.maxSid && !layer.limitSid {
-				layer.wantedSid = flags.Sid
-				layer.sid = flags.Sid
+				layer.wantedSid = maxSid
+				layer.sid = maxSid
+			}
+		} else if maxSid < layer.maxSid {
+			// the sender has stopped sending some layers
+			if layer.sid > maxSid {
+				layer.sid = maxSid
+			}
+			if layer.wantedSid > maxSid {
+				layer.wantedSid = maxSid
 			}
-			layer.maxSid = flags.Sid
 		}
+		layer.maxSid = maxSid
 		down.setLayerInfo(layer)
 		down.adjustLayer()
 		layer = down.getLayerInfo()
@@ -272,7 +539,7 @@ func (down *rtpDownTrack) Write(buf []byte) (int, error) {
 			layer.sid = layer.wantedSid
 			down.setLayerInfo(layer)
 		} else {
-			down.remote.RequestKeyframe()
+			remote.RequestKeyframe()
 		}
 	}
 
@@ -291,8 +558,17 @@ func (down *rtpDownTrack) Write(buf []byte) (int, error) {
 
 	setMarker := flags.Sid == layer.sid && flags.End && !flags.Marker
 
-	if !setMarker && newseqno == flags.Seqno && piddelta == 0 {
-		return down.write(buf)
+	priority := priorityAudio
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
+		if flags.Keyframe {
+			priority = priorityKeyframe
+		} else {
+			priority = priorityVideo
+		}
+	}
+
+	if !setMarker && newseqno == seqno && newts == ts && piddelta == 0 {
+		return down.send(buf, priority, retransmit)
 	}
 
 	ibuf2 := packetBufPool.Get()
@@ -304,15 +580,103 @@ func (down *rtpDownTrack) Write(buf []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return down.write(buf2[:n])
+	binary.BigEndian.PutUint32(buf2[4:], newts)
+	return down.send(buf2[:n], priority, retransmit)
 }
 
-func (down *rtpDownTrack) write(buf []byte) (int, error) {
-	n, err := down.track.Write(buf)
-	if err == nil {
+// send queues a packet, encapsulating retransmissions in RTX if possible,
+// and stripping redundant audio if the receiver didn't negotiate it.
+func (down *rtpDownTrack) send(buf []byte, priority packetPriority, retransmit bool) (int, error) {
+	if down.red != nil {
+		ibuf := packetBufPool.Get()
+		defer packetBufPool.Put(ibuf)
+		pbuf := ibuf.([]byte)
+		n := down.red.primary(buf, pbuf)
+		if n > 0 {
+			buf = pbuf[:n]
+		}
+	}
+	if retransmit && down.rtx != nil {
+		ibuf := packetBufPool.Get()
+		defer packetBufPool.Put(ibuf)
+		rbuf := ibuf.([]byte)
+		n := down.rtx.packet(buf, rbuf)
+		if n > 0 {
+			return down.write(rbuf[:n], priority)
+		}
+	}
+	return down.write(buf, priority)
+}
+
+// write queues a packet for sending.  The packet is copied, so the
+// caller may reuse buf.
+func (down *rtpDownTrack) write(buf []byte, priority packetPriority) (int, error) {
+	if !down.conn.queue.push(down, buf, priority) {
+		return 0, nil
+	}
+	return len(buf), nil
+}
+
+// writeNow writes a packet to the network.  Called by sendLoop.
+func (down *rtpDownTrack) writeNow(buf []byte) {
+	rtx := down.rtx != nil && down.rtx.isRTX(buf)
+	padding := rtx && isPadding(buf)
+	primary := down.red != nil && down.red.isPrimary(buf)
+	if down.rtx != nil && !rtx && len(buf) >= 12 {
+		atomic.StoreUint32(
+			&down.rtx.timestamp, binary.BigEndian.Uint32(buf[4:]),
+		)
+	}
+
+	if down.conn.getTWCCId() != 0 {
+		ibuf := packetBufPool.Get()
+		defer packetBufPool.Put(ibuf)
+		b := ibuf.([]byte)
+		n := down.conn.twccPacket(buf, b)
+		if n > 0 {
+			buf = b[:n]
+		}
+	}
+
+	if down.impair != nil {
+		down.impair.apply(buf, func(b []byte) {
+			down.writeWire(b, rtx || primary, padding)
+		})
+		return
+	}
+	down.writeWire(buf, rtx || primary, padding)
+}
+
+// writeWire writes a packet to the network.  If direct is true, the
+// packet was produced by the RTX or RED track, and already carries the
+// right payload type and SSRC.
+func (down *rtpDownTrack) writeWire(buf []byte, direct, padding bool) {
+	var n int
+	var err error
+	if direct && down.rtx != nil {
+		n, err = down.rtx.write(buf)
+	} else if direct && down.red != nil {
+		n, err = down.red.write(buf)
+	} else {
+		n, err = down.track.Write(buf)
+	}
+	// padding doesn't count towards the rate used for choosing layers
+	if err == nil && !padding {
 		down.rate.Accumulate(uint32(n))
 	}
-	return n, err
+}
+
+// feedbackBitrate returns the lowest bitrate limit derived from the
+// receiver's feedback, or ^uint64(0) if there was no recent feedback.
+func (t *rtpDownTrack) feedbackBitrate(now uint64) uint64 {
+	max := t.maxBitrate.Get(now)
+	if r := t.maxREMBBitrate.Get(now); r < max {
+		max = r
+	}
+	if r := t.maxTWCCBitrate.Get(now); r < max {
+		max = r
+	}
+	return max
 }
 
 func (t *rtpDownTrack) GetMaxBitrate() (uint64, int, int) {
@@ -326,6 +690,10 @@ func (t *rtpDownTrack) GetMaxBitrate() (uint64, int, int) {
 	if rr != 0 && rr < r {
 		r = rr
 	}
+	rr = t.maxTWCCBitrate.Get(now)
+	if rr != 0 && rr < r {
+		r = rr
+	}
 	return r, int(layer.sid), int(layer.tid)
 }
 
@@ -333,25 +701,41 @@ func (t *rtpDownTrack) GetMaxBitrate() (uint64, int, int) {
 // adjusts the layer by one step.  It prefers temporal layers, and only
 // uses spatial layers as a last resort.
 func (t *rtpDownTrack) adjustLayer() {
+	sidLimit, tidLimit := t.getLayerLimit()
+	layer := t.getLayerInfo()
+	if s := t.sizeLimit(layer.maxSid); s < sidLimit {
+		sidLimit = s
+	}
+	if layer.wantedSid > sidLimit || layer.wantedTid > tidLimit {
+		// the receiver has asked for a lower layer
+		if layer.wantedSid > sidLimit {
+			layer.wantedSid = sidLimit
+		}
+		if layer.wantedTid > tidLimit {
+			layer.wantedTid = tidLimit
+		}
+		t.setLayerInfo(layer)
+		return
+	}
+
 	max, _, _ := t.GetMaxBitrate()
 	r, _ := t.rate.Estimate()
 	rate := uint64(r) * 8
 	if rate < max*7/8 {
 		// switch up
-		layer := t.getLayerInfo()
 		if layer.limitSid && layer.wantedSid != 0 {
 			layer.wantedSid = 0
 			t.setLayerInfo(layer)
-		} else if !layer.limitSid && layer.sid < layer.maxSid {
+		} else if !layer.limitSid && layer.sid < layer.maxSid &&
+			layer.sid < sidLimit {
 			layer.wantedSid = layer.sid + 1
 			t.setLayerInfo(layer)
-		} else if layer.tid < layer.maxTid {
+		} else if layer.tid < layer.maxTid && layer.tid < tidLimit {
 			layer.wantedTid = layer.tid + 1
 			t.setLayerInfo(layer)
 		}
 	} else if rate > max*3/2 {
 		// switch down
-		layer := t.getLayerInfo()
 		if layer.tid > 0 {
 			layer.wantedTid = layer.tid - 1
 			t.setLayerInfo(layer)
@@ -366,22 +750,55 @@ func (t *rtpDownTrack) adjustLayer() {
 	}
 }
 
+// clientLogger returns a logger that identifies client c, its group and,
+// if id is not empty, the connection id.
+func clientLogger(c group.Client, id string) *logging.Logger {
+	var name string
+	if g := c.Group(); g != nil {
+		name = g.Name()
+	}
+	return logger.With("group", name, "client", c.Id(), "conn", id)
+}
+
+// addICECandidate adds a remote candidate to pc.  If mDNS is enabled,
+// candidates with an mDNS hostname are resolved asynchronously.
+func addICECandidate(pc *webrtc.PeerConnection, candidate *webrtc.ICECandidateInit, l *logging.Logger) error {
+	if !group.IsMDNSCandidate(candidate) {
+		return pc.AddICECandidate(*candidate)
+	}
+	if !group.UseMDNS {
+		return nil
+	}
+	go func() {
+		c, err := group.ResolveMDNSCandidate(candidate)
+		if err != nil {
+			l.Warnf("Resolve mDNS candidate: %v", err)
+			return
+		}
+		err = pc.AddICECandidate(c)
+		if err != nil {
+			l.Warnf("Add mDNS candidate: %v", err)
+		}
+	}()
+	return nil
+}
+
 func (down *rtpDownConnection) addICECandidate(candidate *webrtc.ICECandidateInit) error {
 	if down.pc.RemoteDescription() != nil {
-		return down.pc.AddICECandidate(*candidate)
+		return addICECandidate(down.pc, candidate, down.log)
 	}
 	down.iceCandidates = append(down.iceCandidates, candidate)
 	return nil
 }
 
-func flushICECandidates(pc *webrtc.PeerConnection, candidates []*webrtc.ICECandidateInit) error {
+func flushICECandidates(pc *webrtc.PeerConnection, candidates []*webrtc.ICECandidateInit, l *logging.Logger) error {
 	if pc.RemoteDescription() == nil {
 		return errors.New("flushICECandidates called in bad state")
 	}
 
 	var err error
 	for _, candidate := range candidates {
-		err2 := pc.AddICECandidate(*candidate)
+		err2 := addICECandidate(pc, candidate, l)
 		if err == nil {
 			err = err2
 		}
@@ -390,12 +807,17 @@ func flushICECandidates(pc *webrtc.PeerConnection, candidates []*webrtc.ICECandi
 }
 
 func (down *rtpDownConnection) flushICECandidates() error {
-	err := flushICECandidates(down.pc, down.iceCandidates)
+	err := flushICECandidates(down.pc, down.iceCandidates, down.log)
 	down.iceCandidates = nil
 	return err
 }
 
 type rtpUpTrack struct {
+	// keyframe requests received, PLIs or FIRs sent, requests
+	// that were aggregated with others and packets requested in NACKs;
+	// accessed atomically, and kept first for alignment
+	kfRequests, plis, kfSuppressed, nacks uint64
+
 	track    *webrtc.TrackRemote
 	receiver *webrtc.RTPReceiver
 	conn     *rtpUpConnection
@@ -403,16 +825,59 @@ type rtpUpTrack struct {
 	cache    *packetcache.Cache
 	jitter   *jitter.Estimator
 	cname    atomic.Value
+	// the loudest audio level since the last report, as the distance
+	// from silence, accessed atomically
+	loudness uint32
+	// whether the track carries audio levels, and whether it is
+	// silent and not forwarded, accessed atomically
+	hasLevel   uint32
+	suppressed uint32
+	// when the track was last heard, only used by audioLevelSender
+	lastHeard time.Time
+	// the size of the video, set on keyframes, accessed atomically
+	dimensions uint32
 
 	actions    *unbounded.Channel[trackAction]
 	readerDone chan struct{}
-
-	mu            sync.Mutex
-	srTime        uint64
-	srNTPTime     uint64
-	srRTPTime     uint32
+	memory     *group.MemoryAccount
+
+	mu        sync.Mutex
+	srTime    uint64
+	srNTPTime uint64
+	srRTPTime uint32
+	// the loss-based limit sent in REMB, 0 if none
+	lossRate      uint64
 	local         []conn.DownTrack
 	bufferedNACKs []uint16
+	// memory accounted for the cache
+	cacheBytes    int64
+	cacheReleased bool
+	// the sequence number of the last FIR, only used by the reader
+	firSeqno uint8
+}
+
+// resizeCache resizes the packet cache, and accounts for the memory it
+// uses.
+func (up *rtpUpTrack) resizeCache(packets int) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.cacheReleased {
+		return
+	}
+	up.cache.ResizeCond(packets)
+	bytes := int64(up.cache.Bytes())
+	up.memory.Add(bytes - up.cacheBytes)
+	up.cacheBytes = bytes
+}
+
+// releaseCache is called when the track is closed.
+func (up *rtpUpTrack) releaseCache() {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.cacheReleased = true
+	up.cache.Clear()
+	up.memory.Add(-up.cacheBytes)
+	up.cacheBytes = 0
 }
 
 type trackActionKind int
@@ -455,6 +920,7 @@ func (up *rtpUpTrack) AddLocal(local conn.DownTrack) error {
 }
 
 func (up *rtpUpTrack) RequestKeyframe() error {
+	atomic.AddUint64(&up.kfRequests, 1)
 	up.action(trackActionKeyframe, nil)
 	return nil
 }
@@ -493,6 +959,21 @@ func (up *rtpUpTrack) Codec() webrtc.RTPCodecCapability {
 	return up.track.Codec().RTPCodecCapability
 }
 
+// headerExtensionId returns the id negotiated for the header extension
+// with the given URI, or 0 if it was not negotiated.
+func (up *rtpUpTrack) headerExtensionId(uri string) uint8 {
+	return extensionId(up.receiver.GetParameters().HeaderExtensions, uri)
+}
+
+func extensionId(exts []webrtc.RTPHeaderExtensionParameter, uri string) uint8 {
+	for _, e := range exts {
+		if e.URI == uri {
+			return uint8(e.ID)
+		}
+	}
+	return 0
+}
+
 func (up *rtpUpTrack) hasRtcpFb(tpe, parameter string) bool {
 	for _, fb := range up.track.Codec().RTCPFeedback {
 		if fb.Type == tpe && fb.Parameter == parameter {
@@ -509,6 +990,17 @@ type rtpUpConnection struct {
 	pc            *webrtc.PeerConnection
 	iceCandidates []*webrtc.ICECandidateInit
 
+	// the user on the upstream server, for a cascaded connection
+	source   string
+	username string
+
+	// transport-wide congestion control feedback, if negotiated
+	twcc   *twcc.Recorder
+	twccId uint32
+	// the trace of the establishment of the connection, may be nil
+	trace *connTrace
+	log   *logging.Logger
+
 	mu      sync.Mutex
 	closed  bool
 	pushed  bool
@@ -544,9 +1036,18 @@ func (up *rtpUpConnection) Label() string {
 }
 
 func (up *rtpUpConnection) User() (string, string) {
+	if up.source != "" {
+		return up.source, up.username
+	}
 	return up.client.Id(), up.client.Username()
 }
 
+// isRemote returns true if up was received from an upstream server.
+func isRemote(up conn.Up) bool {
+	u, ok := up.(*rtpUpConnection)
+	return ok && u.source != ""
+}
+
 func (up *rtpUpConnection) AddLocal(local conn.Down) error {
 	up.mu.Lock()
 	defer up.mu.Unlock()
@@ -586,14 +1087,14 @@ func (up *rtpUpConnection) getLocal() []conn.Down {
 
 func (up *rtpUpConnection) addICECandidate(candidate *webrtc.ICECandidateInit) error {
 	if up.pc.RemoteDescription() != nil {
-		return up.pc.AddICECandidate(*candidate)
+		return addICECandidate(up.pc, candidate, up.log)
 	}
 	up.iceCandidates = append(up.iceCandidates, candidate)
 	return nil
 }
 
 func (up *rtpUpConnection) flushICECandidates() error {
-	err := flushICECandidates(up.pc, up.iceCandidates)
+	err := flushICECandidates(up.pc, up.iceCandidates, up.log)
 	up.iceCandidates = nil
 	return err
 }
@@ -615,25 +1116,103 @@ func pushConnNow(up *rtpUpConnection, g *group.Group, cs []group.Client) {
 	}
 }
 
-// pushConn schedules a call to pushConnNow
-func pushConn(up *rtpUpConnection, g *group.Group, cs []group.Client) {
+// pushConn schedules a call to pushConnNow.  The list of clients is
+// computed when the connection is pushed, so that clients that joined
+// in the meantime are not missed.
+func pushConn(up *rtpUpConnection, g *group.Group) {
 	up.mu.Lock()
 	up.pushed = false
 	up.mu.Unlock()
 
-	go func(g *group.Group, cs []group.Client) {
+	go func(g *group.Group) {
 		time.Sleep(200 * time.Millisecond)
 		up.mu.Lock()
 		pushed := up.pushed
 		up.pushed = true
 		up.mu.Unlock()
 		if !pushed {
-			pushConnNow(up, g, cs)
+			pushConnNow(up, g, mediaReceivers(g, up.client))
+		}
+	}(g)
+}
+
+// musicBitrate is the Opus bitrate requested in music mode.
+const musicBitrate = 128000
+
+// musicSDP modifies the Opus parameters of a description in order to
+// request stereo at a high bitrate.  It is applied both to the answers
+// sent to senders and to the offers sent to receivers.  This needs to be
+// done by hand, since pion copies the parameters from the offer in an
+// answer, and uses the ones tuned for speech in an offer.
+func musicSDP(description string) (string, error) {
+	var desc sdp.SessionDescription
+	err := desc.Unmarshal([]byte(description))
+	if err != nil {
+		return "", err
+	}
+	for _, m := range desc.MediaDescriptions {
+		if m.MediaName.Media != "audio" {
+			continue
+		}
+		for _, a := range m.Attributes {
+			if a.Key != "rtpmap" {
+				continue
+			}
+			pt, codec, _ := strings.Cut(a.Value, " ")
+			if !strings.HasPrefix(strings.ToLower(codec), "opus/") {
+				continue
+			}
+			found := false
+			for i, f := range m.Attributes {
+				if f.Key != "fmtp" {
+					continue
+				}
+				p, fmtp, _ := strings.Cut(f.Value, " ")
+				if p == pt {
+					m.Attributes[i].Value =
+						pt + " " + musicFmtp(fmtp)
+					found = true
+				}
+			}
+			if !found {
+				m.WithValueAttribute("fmtp", pt+" "+musicFmtp(""))
+			}
+		}
+	}
+	buf, err := desc.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func musicFmtp(fmtp string) string {
+	var params []string
+	for _, f := range strings.Split(fmtp, ";") {
+		k, _, _ := strings.Cut(f, "=")
+		if k == "" || k == "stereo" || k == "maxaveragebitrate" {
+			continue
 		}
-	}(g, cs)
+		params = append(params, f)
+	}
+	params = append(params,
+		"stereo=1",
+		"maxaveragebitrate="+strconv.Itoa(musicBitrate),
+	)
+	return strings.Join(params, ";")
 }
 
 func newUpConn(c group.Client, id string, label string, offer string) (*rtpUpConnection, error) {
+	return newUpConnFrom(c, id, label, offer, "", "")
+}
+
+// newUpConnFrom creates an up connection on behalf of the user with id
+// source on another server.
+func newUpConnFrom(c group.Client, id string, label string, offer string, source string, username string) (*rtpUpConnection, error) {
+	if c.Group().MemoryExceeded() {
+		return nil, group.ErrMemoryExceeded
+	}
+
 	var o sdp.SessionDescription
 	err := o.Unmarshal([]byte(offer))
 	if err != nil {
@@ -644,7 +1223,7 @@ func newUpConn(c group.Client, id string, label string, offer string) (*rtpUpCon
 	if err != nil {
 		return nil, err
 	}
-	pc, err := api.NewPeerConnection(*ice.ICEConfiguration())
+	pc, err := api.NewPeerConnection(*c.Group().ICEConfiguration())
 	if err != nil {
 		return nil, err
 	}
@@ -662,21 +1241,36 @@ func newUpConn(c group.Client, id string, label string, offer string) (*rtpUpCon
 		}
 	}
 
-	up := &rtpUpConnection{id: id, client: c, label: label, pc: pc}
+	up := &rtpUpConnection{
+		id:       id,
+		client:   c,
+		label:    label,
+		pc:       pc,
+		source:   source,
+		username: username,
+		twcc:     twcc.NewRecorder(),
+		log:      clientLogger(c, id),
+	}
 
 	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		up.setTWCC(receiver)
+
 		up.mu.Lock()
 
+		// each simulcast layer is a distinct remote track, and
+		// gets its own packet cache
 		track := &rtpUpTrack{
 			track:      remote,
 			receiver:   receiver,
 			conn:       up,
-			cache:      packetcache.New(minPacketCache(remote)),
+			cache:      packetcache.New(minPacketCache(remote), packetcache.BufSize),
 			rate:       estimator.New(time.Second),
 			jitter:     jitter.New(remote.Codec().ClockRate),
 			actions:    unbounded.New[trackAction](),
 			readerDone: make(chan struct{}),
+			memory:     c.Group().Memory(group.MemoryCache),
 		}
+		track.resizeCache(minPacketCache(remote))
 
 		up.tracks = append(up.tracks, track)
 
@@ -686,11 +1280,22 @@ func newUpConn(c group.Client, id string, label string, offer string) (*rtpUpCon
 
 		up.mu.Unlock()
 
-		pushConn(up, c.Group(), c.Group().GetClients(c))
+		pushConn(up, c.Group())
 	})
 
-	pushConn(up, c.Group(), c.Group().GetClients(c))
-	go rtcpUpSender(up)
+	pushConn(up, c.Group())
+	rtcpWheel.schedule(time.Second, func() bool {
+		return rtcpUpSender(up)
+	})
+	rtcpWheel.schedule(twccInterval, func() bool {
+		return twccUpSender(up)
+	})
+	if source == "" {
+		g := c.Group()
+		rtcpWheel.schedule(audioLevelInterval, func() bool {
+			return audioLevelSender(up, g)
+		})
+	}
 
 	return up, nil
 }
@@ -698,11 +1303,32 @@ func newUpConn(c group.Client, id string, label string, offer string) (*rtpUpCon
 var ErrUnsupportedFeedback = errors.New("unsupported feedback type")
 var ErrRateLimited = errors.New("rate limited")
 
-func (track *rtpUpTrack) sendPLI() error {
-	if !track.hasRtcpFb("nack", "pli") {
-		return ErrUnsupportedFeedback
+// sendKeyframeRequest asks the sender for a keyframe, using PLI if
+// possible, and FIR otherwise, since some hardware endpoints and gateways
+// only implement the latter.  Only called by the reader.
+func (track *rtpUpTrack) sendKeyframeRequest() error {
+	if track.hasRtcpFb("nack", "pli") {
+		return sendPLI(track.conn.pc, track.track.SSRC())
+	}
+	if track.hasRtcpFb("ccm", "fir") {
+		track.firSeqno++
+		return sendFIR(
+			track.conn.pc, track.track.SSRC(), track.firSeqno,
+		)
 	}
-	return sendPLI(track.conn.pc, track.track.SSRC())
+	return ErrUnsupportedFeedback
+}
+
+// countKeyframeRequests records that n keyframe requests were satisfied,
+// either by a PLI or by a keyframe sent spontaneously by the sender.
+func (track *rtpUpTrack) countKeyframeRequests(n uint64, sent bool) {
+	if sent {
+		atomic.AddUint64(&track.plis, 1)
+		if n > 0 {
+			n--
+		}
+	}
+	atomic.AddUint64(&track.kfSuppressed, n)
 }
 
 func sendPLI(pc *webrtc.PeerConnection, ssrc webrtc.SSRC) error {
@@ -711,16 +1337,30 @@ func sendPLI(pc *webrtc.PeerConnection, ssrc webrtc.SSRC) error {
 	})
 }
 
-func (track *rtpUpTrack) sendNACK(first uint16, bitmap uint16) error {
+func sendFIR(pc *webrtc.PeerConnection, ssrc webrtc.SSRC, seqno uint8) error {
+	return pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.FullIntraRequest{
+			MediaSSRC: uint32(ssrc),
+			FIR: []rtcp.FIREntry{
+				{SSRC: uint32(ssrc), SequenceNumber: seqno},
+			},
+		},
+	})
+}
+
+func (track *rtpUpTrack) sendNACK(nacks []rtcp.NackPair) error {
 	if !track.hasRtcpFb("nack", "") {
 		return ErrUnsupportedFeedback
 	}
 
-	err := sendNACKs(track.conn.pc, track.track.SSRC(),
-		[]rtcp.NackPair{{first, rtcp.PacketBitmap(bitmap)}},
-	)
+	err := sendNACKs(track.conn.pc, track.track.SSRC(), nacks)
 	if err == nil {
-		track.cache.Expect(1 + bits.OnesCount16(bitmap))
+		count := 0
+		for _, nack := range nacks {
+			count += 1 + bits.OnesCount16(uint16(nack.LostPackets))
+		}
+		track.cache.Expect(count)
+		atomic.AddUint64(&track.nacks, uint64(count))
 	}
 	return err
 }
@@ -739,7 +1379,7 @@ func (track *rtpUpTrack) sendNACKs(seqnos []uint16) error {
 
 	for len(seqnos) > 0 {
 		if len(nacks) >= 240 {
-			log.Printf("NACK: packet overflow")
+			track.conn.log.Warnf("NACK: packet overflow")
 			break
 		}
 		var f, b uint16
@@ -749,6 +1389,7 @@ func (track *rtpUpTrack) sendNACKs(seqnos []uint16) error {
 	err := sendNACKs(track.conn.pc, track.track.SSRC(), nacks)
 	if err == nil {
 		track.cache.Expect(count)
+		atomic.AddUint64(&track.nacks, uint64(count))
 	}
 	return err
 }
@@ -763,21 +1404,60 @@ func sendNACKs(pc *webrtc.PeerConnection, ssrc webrtc.SSRC, nacks []rtcp.NackPai
 	return pc.WriteRTCP([]rtcp.Packet{packet})
 }
 
+// rto returns the retransmission timeout towards the receiver of
+// a down track, in jiffies.
+func (t *rtpDownTrack) rto(now uint64) uint64 {
+	_, j := t.stats.Get(now)
+	jitter := uint64(j) *
+		(rtptime.JiffiesPerSec / uint64(t.getRemote().Codec().ClockRate))
+	return t.getRTT() + 4*jitter
+}
+
+// tooLate returns true if a retransmission of a packet that arrived at
+// the given time would reach the receiver after it has been played out.
+func (t *rtpDownTrack) tooLate(arrival, now uint64) bool {
+	if now < arrival {
+		return false
+	}
+	// a retransmitted packet is useless after a couple of RTOs
+	deadline := 2 * t.rto(now)
+	min := uint64(minPacketAge(t.getRemote().Kind())) *
+		rtptime.JiffiesPerSec / uint64(time.Second)
+	if deadline < min {
+		deadline = min
+	}
+	return now-arrival > deadline
+}
+
 func gotNACK(track *rtpDownTrack, p *rtcp.TransportLayerNack) {
 	buf := make([]byte, packetcache.BufSize)
+	up, _ := track.getRemote().(*rtpUpTrack)
+	now := rtptime.Jiffies()
 	for _, nack := range p.Nacks {
+		atomic.AddUint64(&track.atomics.nacks,
+			uint64(len(nack.PacketList())))
 		nack.Range(func(s uint16) bool {
 			ok, seqno, _ := track.packetmap.Reverse(s)
 			if !ok {
 				return true
 			}
-			l := track.remote.GetPacket(seqno, buf, true)
+			ok, seqno = track.rewriter.reverse(seqno)
+			if !ok {
+				return true
+			}
+			if up != nil {
+				info, ok := up.cache.Info(seqno)
+				if ok && track.tooLate(info.Time, now) {
+					return true
+				}
+			}
+			l := track.getRemote().GetPacket(seqno, buf, true)
 			if l == 0 {
 				return true
 			}
-			_, err := track.Write(buf[:l])
+			_, err := track.retransmit(buf[:l])
 			if err != nil {
-				log.Printf("Write: %v", err)
+				track.conn.log.Warnf("Write: %v", err)
 				return false
 			}
 			return true
@@ -786,10 +1466,18 @@ func gotNACK(track *rtpDownTrack, p *rtcp.TransportLayerNack) {
 }
 
 func (track *rtpUpTrack) GetPacket(seqno uint16, result []byte, nack bool) uint16 {
+	if !nack {
+		// the maximum age only applies to retransmissions
+		return track.cache.GetAny(seqno, result)
+	}
 	n := track.cache.Get(seqno, result)
-	if n > 0 || !nack {
+	if n > 0 {
 		return n
 	}
+	if track.cache.Has(seqno) {
+		// the packet has expired, don't bother the sender
+		return 0
+	}
 
 	track.mu.Lock()
 	defer track.mu.Unlock()
@@ -817,13 +1505,13 @@ func rtcpUpListener(track *rtpUpTrack) {
 		n, _, err := track.receiver.ReadSimulcast(buf, track.track.RID())
 		if err != nil {
 			if err != io.EOF && err != io.ErrClosedPipe {
-				log.Printf("Read RTCP: %v", err)
+				track.conn.log.Warnf("Read RTCP: %v", err)
 			}
 			return
 		}
 		ps, err := rtcp.Unmarshal(buf[:n])
 		if err != nil {
-			log.Printf("Unmarshal RTCP: %v", err)
+			track.conn.log.Warnf("Unmarshal RTCP: %v", err)
 			continue
 		}
 
@@ -871,7 +1559,7 @@ func rtcpUpListener(track *rtpUpTrack) {
 				if ok {
 					err := sendSR(l)
 					if err != nil {
-						log.Printf("sendSR: %v", err)
+						track.conn.log.Warnf("sendSR: %v", err)
 					}
 				}
 			}
@@ -941,6 +1629,9 @@ func sendUpRTCP(up *rtpUpConnection) error {
 	}
 
 	now := rtptime.Jiffies()
+	// senders that do transport-wide congestion control get feedback
+	// from us, the others need an estimate
+	usesTWCC := up.getTWCCId() != 0
 
 	reports := make([]rtcp.ReceptionReport, 0, len(up.tracks))
 	for _, t := range tracks {
@@ -959,6 +1650,10 @@ func sendUpRTCP(up *rtpUpConnection) error {
 			}
 		}
 
+		if !usesTWCC {
+			t.updateLossRate(uint8(fractionLost))
+		}
+
 		t.mu.Lock()
 		srTime := t.srTime
 		srNTPTime := t.srNTPTime
@@ -994,13 +1689,20 @@ func sendUpRTCP(up *rtpUpConnection) error {
 			continue
 		}
 		ssrcs = append(ssrcs, uint32(t.track.SSRC()))
+		var r uint64
 		if t.Kind() == webrtc.RTPCodecTypeAudio {
-			rate = sadd(rate, 100*1024)
+			r = 100 * 1024
 		} else if t.Label() == "l" {
-			rate = sadd(rate, group.LowBitrate)
+			r = group.LowBitrate
 		} else {
-			rate = sadd(rate, maxUpBitrate(t))
+			r = maxUpBitrate(t)
+		}
+		t.mu.Lock()
+		if t.lossRate != 0 && t.lossRate < r {
+			r = t.lossRate
 		}
+		t.mu.Unlock()
+		rate = sadd(rate, r)
 	}
 
 	if rate > group.MaxBitrate {
@@ -1017,17 +1719,17 @@ func sendUpRTCP(up *rtpUpConnection) error {
 	return up.pc.WriteRTCP(packets)
 }
 
-func rtcpUpSender(conn *rtpUpConnection) {
-	for {
-		time.Sleep(time.Second)
-		err := sendUpRTCP(conn)
-		if err != nil {
-			if err == io.EOF || err == io.ErrClosedPipe {
-				return
-			}
-			log.Printf("sendUpRTCP: %v", err)
+// rtcpUpSender sends receiver reports.  It is called by the timer wheel,
+// and returns false when the connection is closed.
+func rtcpUpSender(conn *rtpUpConnection) bool {
+	err := sendUpRTCP(conn)
+	if err != nil {
+		if err == io.EOF || err == io.ErrClosedPipe {
+			return false
 		}
+		conn.log.Warnf("sendUpRTCP: %v", err)
 	}
+	return true
 }
 
 func sendSR(conn *rtpDownConnection) error {
@@ -1052,7 +1754,8 @@ func sendSR(conn *rtpDownConnection) error {
 				delay := rtptime.FromDuration(
 					d, clockrate,
 				)
-				nowRTP = remoteRTP + uint32(delay)
+				nowRTP = remoteRTP + uint32(delay) +
+					t.rewriter.timestampDelta()
 			}
 
 			p, b := t.rate.Totals()
@@ -1097,17 +1800,17 @@ func sendSR(conn *rtpDownConnection) error {
 	return conn.pc.WriteRTCP(packets)
 }
 
-func rtcpDownSender(conn *rtpDownConnection) {
-	for {
-		time.Sleep(time.Second / 2)
-		err := sendSR(conn)
-		if err != nil {
-			if err == io.EOF || err == io.ErrClosedPipe {
-				return
-			}
-			log.Printf("sendSR: %v", err)
+// rtcpDownSender sends sender reports.  It is called by the timer wheel,
+// and returns false when the connection is closed.
+func rtcpDownSender(conn *rtpDownConnection) bool {
+	err := sendSR(conn)
+	if err != nil {
+		if err == io.EOF || err == io.ErrClosedPipe {
+			return false
 		}
+		conn.log.Warnf("sendSR: %v", err)
 	}
+	return true
 }
 
 const (
@@ -1146,7 +1849,39 @@ func (track *rtpDownTrack) updateRate(loss uint8, now uint64) {
 	track.maxBitrate.Set(rate, now)
 }
 
+// updateLossRate updates the limit that we send to a sender that doesn't
+// do transport-wide congestion control, based on the loss rate and on
+// the rate at which we actually receive.
+func (t *rtpUpTrack) updateLossRate(loss uint8) {
+	r, _ := t.rate.Estimate()
+	actual := 8 * uint64(r)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rate := t.lossRate
+	if loss > 25 {
+		// loss > 0.1, multiply by (1 - loss/2)
+		if rate == 0 || rate > actual {
+			rate = actual
+		}
+		rate = rate * (512 - uint64(loss)) / 512
+		if rate < minLossRate {
+			rate = minLossRate
+		}
+	} else if loss < 5 && rate != 0 {
+		// loss < 0.02, multiply by 1.05
+		rate = rate * 269 / 256
+		if rate > 2*actual+initLossRate {
+			// we're no longer limiting the sender
+			rate = 0
+		}
+	}
+	t.lossRate = rate
+}
+
 func rtcpDownListener(track *rtpDownTrack) {
+	// a FIR is retransmitted with an unchanged sequence number
+	firSeen := false
 	lastFirSeqno := uint8(0)
 
 	buf := make([]byte, 1500)
@@ -1155,23 +1890,24 @@ func rtcpDownListener(track *rtpDownTrack) {
 		n, _, err := track.sender.Read(buf)
 		if err != nil {
 			if err != io.EOF && err != io.ErrClosedPipe {
-				log.Printf("Read RTCP: %v", err)
+				track.conn.log.Warnf("Read RTCP: %v", err)
 			}
 			return
 		}
 		ps, err := rtcp.Unmarshal(buf[:n])
 		if err != nil {
-			log.Printf("Unmarshal RTCP: %v", err)
+			track.conn.log.Warnf("Unmarshal RTCP: %v", err)
 			continue
 		}
 
 		adjust := false
+		feedback := false
 		jiffies := rtptime.Jiffies()
 
 		for _, p := range ps {
 			switch p := p.(type) {
 			case *rtcp.PictureLossIndication:
-				track.remote.RequestKeyframe()
+				track.getRemote().RequestKeyframe()
 			case *rtcp.FullIntraRequest:
 				found := false
 				var seqno uint8
@@ -1183,13 +1919,15 @@ func rtcpDownListener(track *rtpDownTrack) {
 					}
 				}
 				if !found {
-					log.Printf("Misdirected FIR")
+					track.conn.log.Warnf("Misdirected FIR")
 					continue
 				}
 
-				if seqno != lastFirSeqno {
-					track.remote.RequestKeyframe()
+				if !firSeen || seqno != lastFirSeqno {
+					track.getRemote().RequestKeyframe()
 				}
+				firSeen = true
+				lastFirSeqno = seqno
 			case *rtcp.ReceiverEstimatedMaximumBitrate:
 				rate := uint64(p.Bitrate + 0.5)
 				track.maxREMBBitrate.Set(rate, jiffies)
@@ -1209,11 +1947,17 @@ func rtcpDownListener(track *rtpDownTrack) {
 				}
 			case *rtcp.TransportLayerNack:
 				gotNACK(track, p)
+			case *rtcp.TransportLayerCC:
+				track.conn.gotTWCC(p)
+				feedback = true
 			}
 		}
 		if adjust {
 			track.adjustLayer()
 		}
+		if adjust || feedback {
+			track.conn.updatePacing()
+		}
 	}
 }
 
@@ -1251,25 +1995,38 @@ func minPacketCache(track *webrtc.TrackRemote) int {
 	return 24
 }
 
+// minPacketAge returns the minimum age after which we stop
+// retransmitting packets.  Audio is played out sooner than video.
+func minPacketAge(kind webrtc.RTPCodecType) time.Duration {
+	if kind == webrtc.RTPCodecTypeVideo {
+		return 200 * time.Millisecond
+	}
+	return 100 * time.Millisecond
+}
+
 func updateUpTrack(track *rtpUpTrack) {
 	now := rtptime.Jiffies()
 
-	clockrate := track.track.Codec().ClockRate
 	local := track.getLocal()
 	var maxrto uint64
 	for _, l := range local {
 		ll, ok := l.(*rtpDownTrack)
 		if ok {
-			_, j := ll.stats.Get(now)
-			jitter := uint64(j) *
-				(rtptime.JiffiesPerSec / uint64(clockrate))
-			rtt := ll.getRTT()
-			rto := rtt + 4*jitter
+			rto := ll.rto(now)
 			if rto > maxrto {
 				maxrto = rto
 			}
 		}
 	}
+
+	// a retransmitted packet is useless after a couple of RTOs; each
+	// receiver applies its own deadline, see tooLate
+	maxage := rtptime.ToDuration(int64(2*maxrto), rtptime.JiffiesPerSec)
+	if m := minPacketAge(track.track.Kind()); maxage < m {
+		maxage = m
+	}
+	track.cache.SetMaxAge(maxage)
+
 	_, r := track.rate.Estimate()
 	packets := int((uint64(r) * maxrto * 4) / rtptime.JiffiesPerSec)
 	min := minPacketCache(track.track)
@@ -1279,5 +2036,12 @@ func updateUpTrack(track *rtpUpTrack) {
 	if packets > 1024 {
 		packets = 1024
 	}
-	track.cache.ResizeCond(packets)
+	// the client may have left its group while the track is still
+	// being torn down
+	g := track.conn.client.Group()
+	if g != nil && g.MemoryExceeded() {
+		// shed load by shrinking the cache
+		packets = min
+	}
+	track.resizeCache(packets)
 }
@@ -1,9 +1,17 @@
 package rtpconn
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/estimator"
+	"github.com/jech/galene/group"
 	"github.com/jech/galene/rtptime"
+	"github.com/jech/galene/unbounded"
 )
 
 func TestDownTrackAtomics(t *testing.T) {
@@ -11,6 +19,7 @@ func TestDownTrackAtomics(t *testing.T) {
 		atomics:        &downTrackAtomics{},
 		maxBitrate:     new(bitrate),
 		maxREMBBitrate: new(bitrate),
+		maxTWCCBitrate: new(bitrate),
 	}
 
 	down.SetTimeOffset(1, 2)
@@ -38,6 +47,96 @@ func TestDownTrackAtomics(t *testing.T) {
 	}
 }
 
+func TestLayerLimit(t *testing.T) {
+	down := &rtpDownTrack{
+		atomics:        &downTrackAtomics{},
+		rate:           estimator.New(time.Second),
+		maxBitrate:     new(bitrate),
+		maxREMBBitrate: new(bitrate),
+		maxTWCCBitrate: new(bitrate),
+	}
+	down.maxBitrate.Set(10000000, rtptime.Jiffies())
+	down.setLayerInfo(layerInfo{maxSid: 2, maxTid: 2})
+
+	if sid, tid := down.getLayerLimit(); sid != 0xF || tid != 0xF {
+		t.Errorf("Expected no limit, got %v %v", sid, tid)
+	}
+
+	down.setLayerLimit(0, 1)
+	if sid, tid := down.getLayerLimit(); sid != 0 || tid != 1 {
+		t.Errorf("Expected 0 1, got %v %v", sid, tid)
+	}
+
+	down.adjustLayer()
+	layer := down.getLayerInfo()
+	if layer.wantedSid != 0 || layer.wantedTid != 1 {
+		t.Errorf("Expected 0 1, got %v %v",
+			layer.wantedSid, layer.wantedTid)
+	}
+
+	layer.tid = 1
+	down.setLayerInfo(layer)
+	down.adjustLayer()
+	layer = down.getLayerInfo()
+	if layer.wantedSid != 0 || layer.wantedTid != 1 {
+		t.Errorf("Expected 0 1, got %v %v",
+			layer.wantedSid, layer.wantedTid)
+	}
+
+	layer.wantedSid = 2
+	layer.wantedTid = 2
+	down.setLayerInfo(layer)
+	down.adjustLayer()
+	layer = down.getLayerInfo()
+	if layer.wantedSid != 0 || layer.wantedTid != 1 {
+		t.Errorf("Expected 0 1, got %v %v",
+			layer.wantedSid, layer.wantedTid)
+	}
+
+	down.setLayerLimit(-1, -1)
+	down.adjustLayer()
+	layer = down.getLayerInfo()
+	if layer.wantedSid != 1 {
+		t.Errorf("Expected 1, got %v", layer.wantedSid)
+	}
+}
+
+func TestCountKeyframeRequests(t *testing.T) {
+	var track rtpUpTrack
+	track.countKeyframeRequests(10, true)
+	track.countKeyframeRequests(2, false)
+	track.countKeyframeRequests(0, true)
+	if track.plis != 2 || track.kfSuppressed != 11 {
+		t.Errorf("Expected 2 11, got %v %v",
+			track.plis, track.kfSuppressed)
+	}
+}
+
+func TestTooLate(t *testing.T) {
+	down := &rtpDownTrack{
+		atomics: &downTrackAtomics{},
+		stats:   new(receiverStats),
+	}
+	down.setRemote(&fakeUpTrack{kind: webrtc.RTPCodecTypeVideo})
+	ms := uint64(rtptime.JiffiesPerSec / 1000)
+	now := uint64(1000 * rtptime.JiffiesPerSec)
+
+	if down.tooLate(now-100*ms, now) {
+		t.Errorf("Recent packet is too late")
+	}
+	if !down.tooLate(now-300*ms, now) {
+		t.Errorf("Old packet is not too late")
+	}
+
+	down.setRTT(250 * ms)
+	if down.tooLate(now-300*ms, now) {
+		t.Errorf("Packet is too late despite the RTT")
+	}
+	if !down.tooLate(now-600*ms, now) {
+		t.Errorf("Old packet is not too late despite the RTT")
+	}
+}
+
 func TestSadd(t *testing.T) {
 	ts := []struct{ x, y, z uint64 }{
 		{0, 0, 0},
@@ -54,3 +153,187 @@ func TestSadd(t *testing.T) {
 		}
 	}
 }
+
+func TestMusicSDP(t *testing.T) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer offerer.Close()
+	_, err = offerer.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+		webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		},
+	)
+	if err != nil {
+		t.Fatalf("AddTransceiver: %v", err)
+	}
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	err = offerer.SetLocalDescription(offer)
+	if err != nil {
+		t.Fatalf("SetLocalDescription: %v", err)
+	}
+
+	api, err := group.APIFromNames([]string{"opus"})
+	if err != nil {
+		t.Fatalf("APIFromNames: %v", err)
+	}
+	answerer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer answerer.Close()
+	err = answerer.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatalf("SetRemoteDescription: %v", err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("CreateAnswer: %v", err)
+	}
+	if strings.Contains(answer.SDP, "stereo=1") {
+		t.Errorf("Stereo without music mode")
+	}
+
+	answer.SDP, err = musicSDP(answer.SDP)
+	if err != nil {
+		t.Fatalf("musicSDP: %v", err)
+	}
+	if !strings.Contains(answer.SDP, ";stereo=1;maxaveragebitrate=128000") {
+		t.Errorf("Bad answer %v", answer.SDP)
+	}
+	err = offerer.SetRemoteDescription(answer)
+	if err != nil {
+		t.Errorf("SetRemoteDescription: %v", err)
+	}
+}
+
+func TestMusicOffer(t *testing.T) {
+	api, err := group.APIFromNames([]string{"opus"})
+	if err != nil {
+		t.Fatalf("APIFromNames: %v", err)
+	}
+	offerer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer offerer.Close()
+	_, err = offerer.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+		webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		},
+	)
+	if err != nil {
+		t.Fatalf("AddTransceiver: %v", err)
+	}
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	err = offerer.SetLocalDescription(offer)
+	if err != nil {
+		t.Fatalf("SetLocalDescription: %v", err)
+	}
+
+	offer.SDP, err = musicSDP(offer.SDP)
+	if err != nil {
+		t.Fatalf("musicSDP: %v", err)
+	}
+	if !strings.Contains(offer.SDP, ";stereo=1;maxaveragebitrate=128000") {
+		t.Errorf("Bad offer %v", offer.SDP)
+	}
+
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer answerer.Close()
+	err = answerer.SetRemoteDescription(offer)
+	if err != nil {
+		t.Errorf("SetRemoteDescription: %v", err)
+	}
+}
+
+func TestMusicFmtp(t *testing.T) {
+	tests := []struct{ fmtp, result string }{
+		{"", "stereo=1;maxaveragebitrate=128000"},
+		{"minptime=10;stereo=0", "minptime=10;stereo=1;maxaveragebitrate=128000"},
+	}
+	for _, test := range tests {
+		r := musicFmtp(test.fmtp)
+		if r != test.result {
+			t.Errorf("%v: expected %v, got %v",
+				test.fmtp, test.result, r)
+		}
+	}
+}
+
+func TestUpdateLossRate(t *testing.T) {
+	up := &rtpUpTrack{rate: estimator.New(time.Second)}
+	up.updateLossRate(0)
+	if up.lossRate != 0 {
+		t.Errorf("Expected no limit, got %v", up.lossRate)
+	}
+	up.updateLossRate(128)
+	if up.lossRate != minLossRate {
+		t.Errorf("Expected %v, got %v", minLossRate, up.lossRate)
+	}
+	up.updateLossRate(10)
+	if up.lossRate != minLossRate {
+		t.Errorf("Expected %v, got %v", minLossRate, up.lossRate)
+	}
+	for i := 0; i < 100 && up.lossRate != 0; i++ {
+		prev := up.lossRate
+		up.updateLossRate(0)
+		if up.lossRate != 0 && up.lossRate <= prev {
+			t.Fatalf("Rate didn't increase: %v", up.lossRate)
+		}
+	}
+	if up.lossRate != 0 {
+		t.Errorf("Limit not lifted: %v", up.lossRate)
+	}
+}
+
+func TestCommitRemote(t *testing.T) {
+	down := &rtpDownTrack{atomics: &downTrackAtomics{}}
+	old := &rtpUpTrack{
+		actions: unbounded.New[trackAction](),
+		local:   []conn.DownTrack{down},
+	}
+	up := &rtpUpTrack{
+		actions:   unbounded.New[trackAction](),
+		local:     []conn.DownTrack{down},
+		srNTPTime: 10,
+		srRTPTime: 20,
+	}
+	down.setRemote(old)
+	down.SetTimeOffset(1, 2)
+	down.pending.Store(up)
+
+	if down.getTarget() != conn.UpTrack(up) {
+		t.Errorf("Target is not the pending track")
+	}
+	down.SetTimeOffset(3, 4)
+	if ntp, rtp := down.getTimeOffset(); ntp != 1 || rtp != 2 {
+		t.Errorf("Expected 1 2, got %v %v", ntp, rtp)
+	}
+
+	if !down.commitRemote(up) {
+		t.Fatalf("commitRemote failed")
+	}
+	if down.getRemote() != conn.UpTrack(up) || down.pending.Load() != nil {
+		t.Errorf("Switch didn't happen")
+	}
+	if len(old.local) != 0 || len(up.local) != 1 {
+		t.Errorf("Expected 0 1, got %v %v", len(old.local), len(up.local))
+	}
+	if ntp, rtp := down.getTimeOffset(); ntp != 10 || rtp != 20 {
+		t.Errorf("Expected 10 20, got %v %v", ntp, rtp)
+	}
+	if down.commitRemote(up) {
+		t.Errorf("Committed twice")
+	}
+}
@@ -2,32 +2,51 @@ package rtpconn
 
 import (
 	"io"
-	"log"
+	"strings"
 	"time"
 
-	"github.com/pion/rtp"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 
 	"github.com/jech/galene/codecs"
 	"github.com/jech/galene/packetcache"
+	"github.com/jech/galene/rtpheader"
 	"github.com/jech/galene/rtptime"
 )
 
+// minKeyframeInterval is the minimum interval between two keyframe
+// requests sent to a given sender.  Requests from receivers that arrive
+// in the meantime are aggregated.
+const minKeyframeInterval = 500 * time.Millisecond
+
 func readLoop(track *rtpUpTrack) {
 	writers := rtpWriterPool{track: track}
 	defer func() {
 		writers.close()
+		track.releaseCache()
 		close(track.readerDone)
 	}()
 
 	isvideo := track.track.Kind() == webrtc.RTPCodecTypeVideo
 	codec := track.track.Codec()
 	sendNACK := track.hasRtcpFb("nack", "")
-	sendPLI := track.hasRtcpFb("nack", "pli")
+	sendKf := track.hasRtcpFb("nack", "pli") ||
+		track.hasRtcpFb("ccm", "fir")
+	var ddId uint8
+	if strings.EqualFold(codec.MimeType, "video/av1") {
+		ddId = track.headerExtensionId(codecs.DependencyDescriptorURI)
+	}
+	var levelId uint8
+	if !isvideo {
+		levelId = track.headerExtensionId(sdp.AudioLevelURI)
+	}
+	var structure *codecs.DependencyStructure
 	var kfNeeded bool
 	var kfRequested time.Time
+	// the number of requests not yet satisfied
+	var kfPending uint64
 	buf := make([]byte, packetcache.BufSize)
-	var packet rtp.Packet
 	for {
 
 		select {
@@ -41,15 +60,16 @@ func readLoop(track *rtpUpTrack) {
 						action.action == trackActionAdd,
 					)
 					if err != nil {
-						log.Printf(
+						track.conn.log.Warnf(
 							"add/remove track: %v",
 							err,
 						)
 					}
 				case trackActionKeyframe:
 					kfNeeded = true
+					kfPending++
 				default:
-					log.Printf("Unknown action")
+					track.conn.log.Errorf("Unknown action")
 				}
 			}
 		default:
@@ -58,70 +78,83 @@ func readLoop(track *rtpUpTrack) {
 		bytes, _, err := track.track.Read(buf)
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("%v", err)
+				track.conn.log.Warnf("%v", err)
 			}
 			break
 		}
 		track.rate.Accumulate(uint32(bytes))
 
-		err = packet.Unmarshal(buf[:bytes])
+		header, err := rtpheader.Parse(buf[:bytes])
 		if err != nil {
-			log.Printf("%v", err)
+			track.conn.log.Warnf("%v", err)
 			continue
 		}
+		seqno := header.SequenceNumber()
+		timestamp := header.Timestamp()
+		marker := header.Marker()
 
-		track.jitter.Accumulate(packet.Timestamp)
+		track.jitter.Accumulate(timestamp)
 
-		kf, kfKnown := codecs.Keyframe(codec.MimeType, &packet)
+		kf, kfKnown := codecs.KeyframePayload(
+			codec.MimeType, header.Payload(),
+		)
 		if kf || !kfKnown {
 			kfNeeded = false
+			if kfPending > 0 {
+				track.countKeyframeRequests(kfPending, false)
+				kfPending = 0
+			}
 		}
-		if packet.Extension {
-			packet.Extension = false
-			packet.Extensions = nil
-			bytes, err = packet.MarshalTo(buf)
-			if err != nil {
-				log.Printf("%v", err)
-				continue
+		if kf {
+			track.recordDimensions(codec.MimeType, buf[:bytes])
+		}
+		var layer packetcache.Layer
+		if ddId != 0 && header.HasExtension() {
+			layer, structure = dependencyLayer(
+				header.Extension(ddId), structure,
+			)
+		}
+		if header.HasExtension() {
+			id := track.conn.getTWCCId()
+			if id != 0 {
+				tseqno, ok := rtpheader.TransportSequenceNumber(
+					header.Extension(id),
+				)
+				if ok {
+					track.conn.twcc.Record(
+						tseqno, rtptime.Microseconds(),
+					)
+				}
+			}
+			if levelId != 0 {
+				level, _, ok := rtpheader.AudioLevel(
+					header.Extension(levelId),
+				)
+				if ok {
+					track.recordLevel(level)
+				}
 			}
+			bytes = header.StripExtension(buf[:bytes])
 		}
 
-		first, index := track.cache.Store(
-			packet.SequenceNumber, packet.Timestamp,
-			kf, packet.Marker, buf[:bytes],
+		first, index, err := track.cache.Store(
+			seqno, timestamp, kf, marker, buf[:bytes],
 		)
+		if err != nil {
+			track.conn.log.Warnf("%v", err)
+			continue
+		}
+		if layer.Valid {
+			track.cache.SetLayer(seqno, layer)
+		}
 
 		_, rate := track.rate.Estimate()
 
-		delta := packet.SequenceNumber - first
-		if (delta & 0x8000) != 0 {
-			delta = 0
-		}
-		// send a NACK if a packet is late by 20ms or 2 packets,
-		// whichever is more.  Since TCP sends a dupack after 2 packets,
-		// this should be safe.
-		packets := rate / 50
-		if packets > 24 {
-			packets = 24
-		}
-		if packets < 2 {
-			packets = 2
-		}
-		// send NACKs for more recent packets, this makes better
-		// use of the NACK bitmap
-		unnacked := uint16(4)
-		if unnacked > uint16(packets) {
-			unnacked = uint16(packets)
-		}
-		if uint32(delta) > packets {
-			found, first, bitmap := track.cache.BitmapGet(
-				packet.SequenceNumber - unnacked,
-			)
-			if found && sendNACK {
-				err := track.sendNACK(first, bitmap)
-				if err != nil {
-					log.Printf("%v", err)
-				}
+		nacks := CheckNACK(track.cache, seqno, first, rate)
+		if len(nacks) > 0 && sendNACK {
+			err := track.sendNACK(nacks)
+			if err != nil {
+				track.conn.log.Warnf("%v", err)
 			}
 		}
 
@@ -130,17 +163,18 @@ func readLoop(track *rtpUpTrack) {
 			delay = rtptime.JiffiesPerSec / rate / 2
 		}
 
-		writers.write(packet.SequenceNumber, index, delay,
-			isvideo, packet.Marker)
+		writers.write(seqno, index, delay, isvideo, marker)
 
 		now := time.Now()
-		if kfNeeded && now.Sub(kfRequested) > time.Second/2 {
-			if sendPLI {
-				err := track.sendPLI()
+		if kfNeeded && now.Sub(kfRequested) > minKeyframeInterval {
+			if sendKf {
+				err := track.sendKeyframeRequest()
 				if err != nil {
-					log.Printf("sendPLI: %v", err)
+					track.conn.log.Warnf("sendKeyframeRequest: %v", err)
 					kfNeeded = false
 				}
+				track.countKeyframeRequests(kfPending, true)
+				kfPending = 0
 			} else {
 				kfNeeded = false
 			}
@@ -148,3 +182,56 @@ func readLoop(track *rtpUpTrack) {
 		}
 	}
 }
+
+// dependencyLayer parses a dependency descriptor, and returns the layer
+// information of the packet together with the current structure.
+func dependencyLayer(ext []byte, structure *codecs.DependencyStructure) (packetcache.Layer, *codecs.DependencyStructure) {
+	if ext == nil {
+		return packetcache.Layer{}, structure
+	}
+	dd, err := codecs.ParseDependencyDescriptor(ext, structure)
+	if dd.Structure != nil {
+		structure = dd.Structure
+	}
+	if err != nil {
+		return packetcache.Layer{}, structure
+	}
+	return packetcache.Layer{
+		Valid:     true,
+		Sid:       dd.Sid,
+		Tid:       dd.Tid,
+		Start:     dd.StartOfFrame,
+		End:       dd.EndOfFrame,
+		TidUpSync: dd.TidUpSync(structure),
+	}, structure
+}
+
+// CheckNACK is called after a packet has been stored in cache, with the
+// packet's seqno, the first seqno returned by Store, and the current
+// packet rate.  It returns the NACK pairs that should be sent, if any.
+func CheckNACK(cache *packetcache.Cache, seqno, first uint16, rate uint32) []rtcp.NackPair {
+	delta := seqno - first
+	if (delta & 0x8000) != 0 {
+		delta = 0
+	}
+	// send a NACK if a packet is late by 20ms or 2 packets,
+	// whichever is more.  Since TCP sends a dupack after 2 packets,
+	// this should be safe.
+	packets := rate / 50
+	if packets > 24 {
+		packets = 24
+	}
+	if packets < 2 {
+		packets = 2
+	}
+	// send NACKs for more recent packets, this makes better
+	// use of the NACK bitmap
+	unnacked := uint16(4)
+	if unnacked > uint16(packets) {
+		unnacked = uint16(packets)
+	}
+	if uint32(delta) <= packets {
+		return nil
+	}
+	return cache.ToNACKs(seqno - unnacked)
+}
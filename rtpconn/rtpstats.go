@@ -2,23 +2,51 @@ package rtpconn
 
 import (
 	"sort"
+	"sync/atomic"
 	"time"
 
+	"github.com/pion/webrtc/v3"
+
 	"github.com/jech/galene/rtptime"
 	"github.com/jech/galene/stats"
 )
 
+// getTransport returns the candidate pair selected by ICE, or nil if
+// ICE hasn't completed yet.
+func getTransport(pc *webrtc.PeerConnection) *stats.Transport {
+	sctp := pc.SCTP()
+	if sctp == nil || sctp.Transport() == nil {
+		return nil
+	}
+	ice := sctp.Transport().ICETransport()
+	if ice == nil {
+		return nil
+	}
+	pair, err := ice.GetSelectedCandidatePair()
+	if err != nil || pair == nil ||
+		pair.Local == nil || pair.Remote == nil {
+		return nil
+	}
+	return &stats.Transport{
+		Protocol: pair.Local.Protocol.String(),
+		Local:    pair.Local.Typ.String(),
+		Remote:   pair.Remote.Typ.String(),
+	}
+}
+
 func (c *webClient) GetStats() *stats.Client {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	cs := stats.Client{
-		Id: c.id,
+		Id:       c.id,
+		Username: c.username,
 	}
 
 	for _, up := range c.up {
 		conns := stats.Conn{
-			Id: up.id,
+			Id:        up.id,
+			Transport: getTransport(up.pc),
 		}
 		tracks := up.getTracks()
 		for _, t := range tracks {
@@ -31,11 +59,37 @@ func (c *webClient) GetStats() *stats.Client {
 			jitter := time.Duration(t.jitter.Jitter()) *
 				(time.Second / time.Duration(t.jitter.HZ()))
 			rate, _ := t.rate.Estimate()
+			u := t.cache.GetUsage()
+			var kf *stats.Keyframes
+			if t.Kind() == webrtc.RTPCodecTypeVideo {
+				kf = &stats.Keyframes{
+					Requests: atomic.LoadUint64(
+						&t.kfRequests,
+					),
+					PLIs: atomic.LoadUint64(&t.plis),
+					Suppressed: atomic.LoadUint64(
+						&t.kfSuppressed,
+					),
+				}
+			}
 			conns.Tracks = append(conns.Tracks, stats.Track{
 				Bitrate:    uint64(rate) * 8,
 				MaxBitrate: maxUpBitrate(t),
 				Loss:       loss,
 				Jitter:     stats.Duration(jitter),
+				Cache: &stats.Cache{
+					Capacity:    u.Capacity,
+					Occupied:    u.Occupied,
+					Bytes:       u.Bytes,
+					Overwritten: u.Overwritten,
+					Hits:        u.Hits,
+					Misses:      u.Misses,
+					Expired:     u.Expired,
+					Grown:       u.Grown,
+					Shrunk:      u.Shrunk,
+				},
+				Keyframes: kf,
+				NACKs:     atomic.LoadUint64(&t.nacks),
 			})
 		}
 		cs.Up = append(cs.Up, conns)
@@ -46,8 +100,14 @@ func (c *webClient) GetStats() *stats.Client {
 
 	jiffies := rtptime.Jiffies()
 	for _, down := range c.down {
+		dropped, tooLarge := down.queue.getDropped()
 		conns := stats.Conn{
-			Id: down.id,
+			Id:               down.id,
+			Transport:        getTransport(down.pc),
+			DroppedVideo:     dropped[priorityVideo],
+			DroppedKeyframes: dropped[priorityKeyframe],
+			DroppedAudio:     dropped[priorityAudio],
+			DroppedTooLarge:  tooLarge,
 		}
 		for _, t := range down.tracks {
 			layer := t.getLayerInfo()
@@ -72,6 +132,7 @@ func (c *webClient) GetStats() *stats.Client {
 				Loss:       float64(loss) / 256.0,
 				Rtt:        stats.Duration(rtt),
 				Jitter:     stats.Duration(j),
+				NACKs:      atomic.LoadUint64(&t.atomics.nacks),
 			})
 		}
 		cs.Down = append(cs.Down, conns)
@@ -2,7 +2,6 @@ package rtpconn
 
 import (
 	"errors"
-	"log"
 	"sort"
 	"time"
 
@@ -59,7 +58,7 @@ func (wp *rtpWriterPool) add(track conn.DownTrack, add bool) error {
 				if wp.count > 0 {
 					wp.count--
 				} else {
-					log.Printf("Negative writer count!")
+					logger.Errorf("Negative writer count!")
 				}
 			}
 			return nil
@@ -210,7 +209,7 @@ func sendSequence(kf, last uint16, track conn.DownTrack, cache *packetcache.Cach
 	buf := make([]byte, packetcache.BufSize)
 	seqno := kf
 	for ((last - seqno) & 0x8000) == 0 {
-		bytes := cache.Get(seqno, buf)
+		bytes := cache.GetAny(seqno, buf)
 		if bytes == 0 {
 			return
 		}
@@ -255,10 +254,15 @@ func rtpWriterLoop(writer *rtpWriter, track *rtpUpTrack) {
 					action.track.SetCname(cname)
 				}
 
+				// replay the most recent complete keyframe
+				// and the packets that follow it
 				last, foundLast := track.cache.Last()
-				kf, foundKf := track.cache.Keyframe()
+				kf, _, foundKf := track.cache.Keyframe()
 				if foundLast && foundKf {
-					if last-kf < 40 { // modulo 2^16
+					// modulo 2^16.  The keyframe is
+					// replayed even if it is too old
+					// to be retransmitted.
+					if last-kf < 40 && track.cache.Has(kf) {
 						go sendSequence(
 							kf, last,
 							action.track,
@@ -268,8 +272,8 @@ func rtpWriterLoop(writer *rtpWriter, track *rtpUpTrack) {
 						track.RequestKeyframe()
 					}
 				} else {
-					// no keyframe yet, one should
-					// arrive soon.  Do nothing.
+					// no complete keyframe yet, one
+					// should arrive soon.  Do nothing.
 				}
 			} else {
 				found := false
@@ -329,7 +333,7 @@ func nackWriter(track *rtpUpTrack) {
 
 	// drop any nacks before the last keyframe
 	var cutoff uint16
-	seqno, found := track.cache.Keyframe()
+	seqno, _, found := track.cache.Keyframe()
 	if found {
 		cutoff = seqno
 	} else {
@@ -349,8 +353,7 @@ func nackWriter(track *rtpUpTrack) {
 			nacks = append(nacks[:i], nacks[i+1:]...)
 			continue
 		}
-		l := track.cache.Get(nacks[i], nil)
-		if l > 0 {
+		if track.cache.Has(nacks[i]) {
 			// the packet arrived in the meantime
 			nacks = append(nacks[:i], nacks[i+1:]...)
 			continue
@@ -0,0 +1,224 @@
+package rtpconn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+)
+
+// rtxTrack is a local track that can send retransmissions on a separate
+// RTX stream (RFC 4588), with its own SSRC and sequence numbers, so that
+// they are not mistaken for new packets by the receiver's congestion
+// controller.  Pion doesn't implement sending RTX, so we need to announce
+// the stream in the SDP ourselves, and write to the RTP stream directly.
+type rtxTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	ssrc  webrtc.SSRC
+	seqno uint32
+	// the timestamp of the last media packet, used for padding
+	timestamp uint32
+
+	mu sync.Mutex
+	// the negotiated payload type, 0 if RTX was not negotiated
+	pt     uint8
+	writer webrtc.TrackLocalWriter
+}
+
+func newRTXTrack(local *webrtc.TrackLocalStaticRTP) *rtxTrack {
+	return &rtxTrack{
+		TrackLocalStaticRTP: local,
+		ssrc:                webrtc.SSRC(rand.Uint32()),
+		seqno:               uint32(rand.Intn(0x10000)),
+	}
+}
+
+// Bind is called by pion when the track is negotiated.
+func (t *rtxTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err != nil {
+		return codec, err
+	}
+
+	apt := fmt.Sprintf("%d", codec.PayloadType)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pt = 0
+	for _, c := range ctx.CodecParameters() {
+		if strings.EqualFold(c.MimeType, "video/rtx") &&
+			group.FmtpValue(c.SDPFmtpLine, "apt") == apt {
+			t.pt = uint8(c.PayloadType)
+			t.writer = ctx.WriteStream()
+			break
+		}
+	}
+	return codec, nil
+}
+
+func (t *rtxTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.Lock()
+	t.pt = 0
+	t.writer = nil
+	t.mu.Unlock()
+	return t.TrackLocalStaticRTP.Unbind(ctx)
+}
+
+// negotiated returns true if the receiver accepted RTX.
+func (t *rtxTrack) negotiated() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pt != 0
+}
+
+// packet encapsulates the packet in buf into an RTX packet, which is
+// stored in result.  It returns 0 if this is not possible.
+func (t *rtxTrack) packet(buf []byte, result []byte) int {
+	t.mu.Lock()
+	pt := t.pt
+	t.mu.Unlock()
+	if pt == 0 || len(buf) < 12 || len(buf)+2 > len(result) {
+		return 0
+	}
+
+	offset := 12 + 4*int(buf[0]&0x0F)
+	if (buf[0] & 0x10) != 0 {
+		if len(buf) < offset+4 {
+			return 0
+		}
+		length := binary.BigEndian.Uint16(buf[offset+2:])
+		offset += 4 + 4*int(length)
+	}
+	if len(buf) < offset {
+		return 0
+	}
+
+	copy(result, buf[:offset])
+	result[1] = (buf[1] & 0x80) | pt
+	seqno := uint16(atomic.AddUint32(&t.seqno, 1))
+	binary.BigEndian.PutUint16(result[2:], seqno)
+	binary.BigEndian.PutUint32(result[8:], uint32(t.ssrc))
+	// the original sequence number
+	copy(result[offset:], buf[2:4])
+	copy(result[offset+2:], buf[offset:])
+	return len(buf) + 2
+}
+
+// paddingSize is the size of the largest padding packet.
+const paddingSize = 12 + 255
+
+// padding stores in result an RTX packet of the given size that only
+// contains padding, as used for bandwidth probing.  It returns 0 if this
+// is not possible.
+func (t *rtxTrack) padding(result []byte, size int) int {
+	t.mu.Lock()
+	pt := t.pt
+	t.mu.Unlock()
+	if pt == 0 || size <= 12 || size > paddingSize || size > len(result) {
+		return 0
+	}
+
+	result[0] = 0xA0 // version 2, padding
+	result[1] = pt
+	seqno := uint16(atomic.AddUint32(&t.seqno, 1))
+	binary.BigEndian.PutUint16(result[2:], seqno)
+	binary.BigEndian.PutUint32(result[4:], atomic.LoadUint32(&t.timestamp))
+	binary.BigEndian.PutUint32(result[8:], uint32(t.ssrc))
+	for i := 12; i < size-1; i++ {
+		result[i] = 0
+	}
+	result[size-1] = uint8(size - 12)
+	return size
+}
+
+// isPadding returns true if buf was produced by padding.
+func isPadding(buf []byte) bool {
+	return len(buf) > 12 && (buf[0]&0x3F) == 0x20 &&
+		int(buf[len(buf)-1]) == len(buf)-12
+}
+
+// isRTX returns true if buf was produced by packet or padding.
+func (t *rtxTrack) isRTX(buf []byte) bool {
+	t.mu.Lock()
+	pt := t.pt
+	t.mu.Unlock()
+	return pt != 0 && len(buf) >= 12 &&
+		(buf[1]&0x7F) == pt &&
+		binary.BigEndian.Uint32(buf[8:]) == uint32(t.ssrc)
+}
+
+// write writes an RTX packet to the network.
+func (t *rtxTrack) write(buf []byte) (int, error) {
+	t.mu.Lock()
+	writer := t.writer
+	t.mu.Unlock()
+	if writer == nil {
+		return 0, nil
+	}
+	return writer.Write(buf)
+}
+
+// rtxSDP announces the RTX streams of the given tracks in an SDP
+// description generated by pion, by adding an SSRC group to the media
+// section of each track that offers RTX.
+func rtxSDP(description string, tracks []*rtpDownTrack) (string, error) {
+	var desc sdp.SessionDescription
+	err := desc.Unmarshal([]byte(description))
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tracks {
+		if t.rtx == nil {
+			continue
+		}
+		prefix := fmt.Sprintf("%d ", t.ssrc)
+		for _, m := range desc.MediaDescriptions {
+			if !hasRTX(m) {
+				continue
+			}
+			var attrs []string
+			for _, a := range m.Attributes {
+				if a.Key == "ssrc" &&
+					strings.HasPrefix(a.Value, prefix) {
+					attrs = append(attrs,
+						strings.TrimPrefix(a.Value, prefix),
+					)
+				}
+			}
+			if len(attrs) == 0 {
+				continue
+			}
+			m.WithValueAttribute("ssrc-group",
+				fmt.Sprintf("FID %d %d", t.ssrc, t.rtx.ssrc),
+			)
+			for _, a := range attrs {
+				m.WithValueAttribute("ssrc",
+					fmt.Sprintf("%d %s", t.rtx.ssrc, a),
+				)
+			}
+		}
+	}
+	buf, err := desc.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func hasRTX(m *sdp.MediaDescription) bool {
+	for _, a := range m.Attributes {
+		if a.Key == "rtpmap" {
+			_, codec, _ := strings.Cut(a.Value, " ")
+			if strings.HasPrefix(strings.ToLower(codec), "rtx/") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package rtpconn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+)
+
+func TestRTXPacket(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "video/VP8"}, "video", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	rtx := newRTXTrack(local)
+
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			PayloadType:    96,
+			SequenceNumber: 42,
+			Timestamp:      4242,
+			SSRC:           1,
+			CSRC:           []uint32{2},
+		},
+		Payload: []byte{1, 2, 3, 4},
+	}
+	packet.SetExtension(1, []byte{5, 6})
+	buf, err := packet.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	result := make([]byte, 1500)
+	if rtx.packet(buf, result) != 0 {
+		t.Errorf("Encapsulated without RTX")
+	}
+
+	rtx.pt = 97
+	n := rtx.packet(buf, result)
+	if n != len(buf)+2 {
+		t.Fatalf("Expected %v, got %v", len(buf)+2, n)
+	}
+	if !rtx.isRTX(result[:n]) || rtx.isRTX(buf) {
+		t.Errorf("isRTX failed")
+	}
+
+	var p rtp.Packet
+	err = p.Unmarshal(result[:n])
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if p.PayloadType != 97 || !p.Marker || p.SSRC != uint32(rtx.ssrc) ||
+		p.Timestamp != 4242 || len(p.CSRC) != 1 ||
+		!bytes.Equal(p.GetExtension(1), []byte{5, 6}) {
+		t.Errorf("Bad header %#v", p.Header)
+	}
+	if len(p.Payload) != 6 ||
+		binary.BigEndian.Uint16(p.Payload) != 42 ||
+		!bytes.Equal(p.Payload[2:], packet.Payload) {
+		t.Errorf("Bad payload %v", p.Payload)
+	}
+
+	n2 := rtx.packet(buf, result)
+	if n2 != n || binary.BigEndian.Uint16(result[2:]) != p.SequenceNumber+1 {
+		t.Errorf("Bad seqno")
+	}
+
+	if rtx.packet(buf, result[:len(buf)+1]) != 0 {
+		t.Errorf("Encapsulated into a short buffer")
+	}
+	if rtx.packet(buf[:10], result) != 0 {
+		t.Errorf("Encapsulated a truncated packet")
+	}
+}
+
+func TestRTXSDP(t *testing.T) {
+	api, err := group.APIFromNames([]string{"vp8"})
+	if err != nil {
+		t.Fatalf("APIFromNames: %v", err)
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer pc.Close()
+
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{
+			MimeType:  "video/VP8",
+			ClockRate: 90000,
+		}, "video", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	rtx := newRTXTrack(local)
+	transceiver, err := pc.AddTransceiverFromTrack(rtx,
+		webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		},
+	)
+	if err != nil {
+		t.Fatalf("AddTransceiver: %v", err)
+	}
+	err = transceiver.SetCodecPreferences([]webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: local.Codec(),
+			PayloadType:        96,
+		},
+		group.RTXCodec(96),
+	})
+	if err != nil {
+		t.Fatalf("SetCodecPreferences: %v", err)
+	}
+	track := &rtpDownTrack{
+		track: local,
+		rtx:   rtx,
+		ssrc:  transceiver.Sender().GetParameters().Encodings[0].SSRC,
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	if !strings.Contains(offer.SDP, "rtx/90000") {
+		t.Fatalf("RTX not offered: %v", offer.SDP)
+	}
+
+	offer.SDP, err = rtxSDP(offer.SDP, []*rtpDownTrack{track})
+	if err != nil {
+		t.Fatalf("rtxSDP: %v", err)
+	}
+	fid := fmt.Sprintf("a=ssrc-group:FID %d %d", track.ssrc, rtx.ssrc)
+	if !strings.Contains(offer.SDP, fid) ||
+		!strings.Contains(offer.SDP, fmt.Sprintf("a=ssrc:%d ", rtx.ssrc)) {
+		t.Errorf("Bad offer %v", offer.SDP)
+	}
+
+	receiver, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	defer receiver.Close()
+	err = receiver.SetRemoteDescription(offer)
+	if err != nil {
+		t.Errorf("SetRemoteDescription: %v", err)
+	}
+}
+
+func TestRTXPadding(t *testing.T) {
+	local, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: "video/VP8"}, "video", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	rtx := newRTXTrack(local)
+	rtx.timestamp = 4242
+
+	result := make([]byte, 1500)
+	if rtx.padding(result, paddingSize) != 0 {
+		t.Errorf("Generated padding without RTX")
+	}
+
+	rtx.pt = 97
+	if rtx.padding(result, paddingSize+1) != 0 {
+		t.Errorf("Generated oversized padding")
+	}
+	n := rtx.padding(result, paddingSize)
+	if n != paddingSize {
+		t.Fatalf("Expected %v, got %v", paddingSize, n)
+	}
+	if !rtx.isRTX(result[:n]) || !isPadding(result[:n]) {
+		t.Errorf("Bad padding packet %v", result[:n])
+	}
+
+	var p rtp.Packet
+	err = p.Unmarshal(result[:n])
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !p.Padding || p.PayloadType != 97 || p.Timestamp != 4242 ||
+		p.SSRC != uint32(rtx.ssrc) || len(p.Payload) != 0 {
+		t.Errorf("Bad packet %v", p)
+	}
+
+	packet := rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 96, SSRC: 1},
+		Payload: []byte{1, 2, 3, 4},
+	}
+	buf, err := packet.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	m := rtx.packet(buf, result)
+	if isPadding(buf) || isPadding(result[:m]) {
+		t.Errorf("Media packet is padding")
+	}
+}
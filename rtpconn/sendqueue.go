@@ -0,0 +1,268 @@
+package rtpconn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/packetcache"
+)
+
+// sendQueueSize is the maximum number of packets queued for a single
+// down connection.
+const sendQueueSize = 256
+
+// A subscriber is considered to be chronically congested if it has been
+// dropping packets continuously for congestionDuration.
+const congestionDuration = 5 * time.Second
+const congestionWarningInterval = time.Minute
+
+// packetPriority determines which packets are dropped first when a send
+// queue overflows.  Lower values are dropped first.
+type packetPriority uint8
+
+const (
+	priorityPadding packetPriority = iota
+	priorityVideo
+	priorityKeyframe
+	priorityAudio
+	numPriorities
+)
+
+type queuedPacket struct {
+	track    *rtpDownTrack
+	buf      []byte
+	priority packetPriority
+}
+
+// A sendQueue is a bounded queue of packets waiting to be sent to
+// a single subscriber.  It decouples the writers, which are shared
+// between subscribers, from the network, so that a single slow subscriber
+// cannot stall the others.  Queues are run by the egress pool.
+type sendQueue struct {
+	pool *egressPool
+
+	// called (unlocked) when the queue has been dropping packets
+	// for a long time
+	onCongestion func()
+	// the number of bytes queued, may be nil
+	memory *group.MemoryAccount
+
+	// only accessed by the goroutine running the queue
+	spare []queuedPacket
+	// used for resuming a paced queue
+	timer *time.Timer
+
+	mu      sync.Mutex
+	packets []queuedPacket
+	closed  bool
+	// true if the queue is being run or waiting to be run, which
+	// ensures that packets are written in order.
+	scheduled bool
+	dropped   [numPriorities]uint64
+	// packets that didn't fit in a buffer
+	tooLarge uint64
+	pacer    pacer
+	// congestion tracking
+	congestedSince time.Time
+	lastDrop       time.Time
+	lastWarning    time.Time
+}
+
+func newSendQueue(pool *egressPool) *sendQueue {
+	return &sendQueue{
+		pool:    pool,
+		spare:   make([]queuedPacket, 0, sendQueueSize),
+		packets: make([]queuedPacket, 0, sendQueueSize),
+	}
+}
+
+func putPacketBuf(buf []byte) {
+	packetBufPool.Put(buf[:cap(buf)])
+}
+
+// drop records that a packet was dropped.  It returns true if the
+// subscriber should be notified.  Called locked.
+func (q *sendQueue) drop(priority packetPriority, now time.Time) bool {
+	q.dropped[priority]++
+	if now.Sub(q.lastDrop) > time.Second {
+		q.congestedSince = now
+	}
+	q.lastDrop = now
+	if now.Sub(q.congestedSince) < congestionDuration ||
+		now.Sub(q.lastWarning) < congestionWarningInterval {
+		return false
+	}
+	q.lastWarning = now
+	return true
+}
+
+// push queues a copy of buf.  If the queue is full, it drops the oldest
+// packet with the lowest priority, which might be the new packet itself.
+// Packets larger than packetcache.BufSize are dropped.  It returns false
+// if the new packet was dropped.
+func (q *sendQueue) push(track *rtpDownTrack, buf []byte, priority packetPriority) bool {
+	notify := false
+	schedule := false
+	ok := func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if q.closed {
+			return false
+		}
+
+		if len(buf) > packetcache.BufSize {
+			q.tooLarge++
+			return false
+		}
+
+		if len(q.packets) >= sendQueueSize {
+			victim := 0
+			for i := range q.packets {
+				if q.packets[i].priority <
+					q.packets[victim].priority {
+					victim = i
+				}
+			}
+			p := q.packets[victim].priority
+			if priority < p {
+				notify = q.drop(priority, time.Now())
+				return false
+			}
+			notify = q.drop(p, time.Now())
+			q.memory.Add(-int64(len(q.packets[victim].buf)))
+			putPacketBuf(q.packets[victim].buf)
+			copy(q.packets[victim:], q.packets[victim+1:])
+			q.packets[len(q.packets)-1] = queuedPacket{}
+			q.packets = q.packets[:len(q.packets)-1]
+		}
+
+		b := packetBufPool.Get().([]byte)
+		copy(b, buf)
+		q.memory.Add(int64(len(buf)))
+		q.packets = append(q.packets, queuedPacket{
+			track:    track,
+			buf:      b[:len(buf)],
+			priority: priority,
+		})
+		if !q.scheduled {
+			q.scheduled = true
+			schedule = true
+		}
+		return true
+	}()
+
+	if notify && q.onCongestion != nil {
+		q.onCongestion()
+	}
+
+	if schedule {
+		q.pool.schedule(q)
+	}
+	return ok
+}
+
+// setPacingRate sets the rate, in bits per second, at which the queue is
+// drained.  A rate of 0 disables pacing.
+func (q *sendQueue) setPacingRate(rate uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pacer.setRate(rate)
+}
+
+// take returns the queued packets that the pacer allows to be sent now,
+// and replaces them with the spare slice.  Only called by the goroutine
+// running the queue.
+func (q *sendQueue) take() []queuedPacket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pacer.refill(time.Now())
+	n := 0
+	for n < len(q.packets) && q.pacer.allow() {
+		q.pacer.sent(len(q.packets[n].buf))
+		n++
+	}
+	if n == len(q.packets) {
+		packets := q.packets
+		q.packets = q.spare[:0]
+		q.spare = nil
+		return packets
+	}
+	packets := append(q.spare[:0], q.packets[:n]...)
+	q.spare = nil
+	m := copy(q.packets, q.packets[n:])
+	for i := m; i < len(q.packets); i++ {
+		q.packets[i] = queuedPacket{}
+	}
+	q.packets = q.packets[:m]
+	return packets
+}
+
+// wakeup is called when the pacer allows a paced queue to proceed.
+func (q *sendQueue) wakeup() {
+	q.pool.schedule(q)
+}
+
+// run writes out the packets currently in the queue that the pacer
+// allows, and returns the number of packets written.  It returns true if
+// more packets are ready to be sent, in which case the caller must
+// arrange for the queue to be run again.  If the pacer delays the
+// remaining packets, the queue arranges to be run again itself.
+func (q *sendQueue) run() (int, bool) {
+	packets := q.take()
+	var bytes int
+	for i := range packets {
+		packets[i].track.writeNow(packets[i].buf)
+		bytes += len(packets[i].buf)
+		putPacketBuf(packets[i].buf)
+		packets[i] = queuedPacket{}
+	}
+	q.memory.Add(-int64(bytes))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.spare = packets[:0]
+	if len(q.packets) > 0 && !q.closed {
+		q.pacer.refill(time.Now())
+		d := q.pacer.delay()
+		if d == 0 {
+			return len(packets), true
+		}
+		// remain scheduled until the timer fires
+		if q.timer == nil {
+			q.timer = time.AfterFunc(d, q.wakeup)
+		} else {
+			q.timer.Reset(d)
+		}
+		return len(packets), false
+	}
+	q.scheduled = false
+	return len(packets), false
+}
+
+// getDropped returns the number of packets dropped for each priority,
+// and the number of packets dropped because they were too large.
+func (q *sendQueue) getDropped() ([numPriorities]uint64, uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped, q.tooLarge
+}
+
+// close discards any queued packets, and causes any further packets to
+// be dropped.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	var bytes int
+	for i := range q.packets {
+		bytes += len(q.packets[i].buf)
+		putPacketBuf(q.packets[i].buf)
+	}
+	q.memory.Add(-int64(bytes))
+	q.packets = nil
+}
@@ -0,0 +1,173 @@
+package rtpconn
+
+import (
+	"testing"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/packetcache"
+)
+
+func TestSendQueueDrop(t *testing.T) {
+	q := newSendQueue(nil)
+	defer q.close()
+	// pretend the queue is being run, so that nothing gets sent
+	q.scheduled = true
+	q.memory = &group.MemoryAccount{}
+
+	buf := make([]byte, 100)
+	for i := 0; i < sendQueueSize; i++ {
+		p := priorityVideo
+		if i%2 == 0 {
+			p = priorityAudio
+		} else if i%3 == 0 {
+			p = priorityKeyframe
+		}
+		buf[0] = byte(i)
+		if !q.push(nil, buf, p) {
+			t.Fatalf("Couldn't push packet %v", i)
+		}
+	}
+
+	count := func(p packetPriority) int {
+		n := 0
+		for _, pkt := range q.packets {
+			if pkt.priority == p {
+				n++
+			}
+		}
+		return n
+	}
+
+	audio := count(priorityAudio)
+	keyframes := count(priorityKeyframe)
+	video := count(priorityVideo)
+
+	// non-keyframe video is dropped first, oldest first
+	if !q.push(nil, buf, priorityAudio) {
+		t.Errorf("Audio packet was dropped")
+	}
+	if count(priorityVideo) != video-1 {
+		t.Errorf("Expected %v, got %v", video-1, count(priorityVideo))
+	}
+	if q.packets[0].buf[0] != 0 || q.packets[1].buf[0] != 2 {
+		t.Errorf("Bad packet order: %v %v",
+			q.packets[0].buf[0], q.packets[1].buf[0])
+	}
+
+	// then keyframes
+	for i := 0; i < video-1; i++ {
+		q.push(nil, buf, priorityKeyframe)
+	}
+	if count(priorityVideo) != 0 {
+		t.Errorf("Expected no video, got %v", count(priorityVideo))
+	}
+	if q.push(nil, buf, priorityVideo) {
+		t.Errorf("Video packet was queued")
+	}
+	if !q.push(nil, buf, priorityAudio) {
+		t.Errorf("Audio packet was dropped")
+	}
+	if count(priorityKeyframe) != keyframes+video-2 {
+		t.Errorf("Expected %v, got %v",
+			keyframes+video-2, count(priorityKeyframe))
+	}
+
+	// audio is only dropped once video is gone
+	for i := 0; i < sendQueueSize; i++ {
+		q.push(nil, buf, priorityAudio)
+	}
+	if count(priorityAudio) != sendQueueSize {
+		t.Errorf("Expected %v, got %v",
+			sendQueueSize, count(priorityAudio))
+	}
+	if q.push(nil, buf, priorityKeyframe) {
+		t.Errorf("Keyframe was queued")
+	}
+
+	dropped, _ := q.getDropped()
+	if dropped[priorityVideo] != uint64(video)+1 ||
+		dropped[priorityKeyframe] != uint64(keyframes+video) ||
+		dropped[priorityAudio] != uint64(audio+2) {
+		t.Errorf("Unexpected drop counts %v (%v %v %v)",
+			dropped, video, keyframes, audio)
+	}
+
+	if m := q.memory.Get(); m != int64(sendQueueSize*len(buf)) {
+		t.Errorf("Expected %v bytes, got %v",
+			sendQueueSize*len(buf), m)
+	}
+	q.close()
+	if m := q.memory.Get(); m != 0 {
+		t.Errorf("Expected 0 bytes, got %v", m)
+	}
+}
+
+func TestSendQueueTooLarge(t *testing.T) {
+	q := newSendQueue(nil)
+	defer q.close()
+	q.scheduled = true
+
+	if q.push(nil, make([]byte, packetcache.BufSize+1), priorityAudio) {
+		t.Errorf("Oversized packet was queued")
+	}
+	if !q.push(nil, make([]byte, packetcache.BufSize), priorityAudio) {
+		t.Errorf("Full-sized packet was dropped")
+	}
+	if len(q.packets) != 1 ||
+		len(q.packets[0].buf) != packetcache.BufSize {
+		t.Errorf("Bad queue %v", len(q.packets))
+	}
+	_, tooLarge := q.getDropped()
+	if tooLarge != 1 {
+		t.Errorf("Expected 1, got %v", tooLarge)
+	}
+}
+
+func TestSendQueueCongestion(t *testing.T) {
+	q := newSendQueue(nil)
+	defer q.close()
+	// pretend the queue is being run, so that nothing gets sent
+	q.scheduled = true
+
+	notified := 0
+	q.onCongestion = func() {
+		notified++
+	}
+
+	buf := make([]byte, 100)
+	for i := 0; i < sendQueueSize; i++ {
+		q.push(nil, buf, priorityAudio)
+	}
+	q.push(nil, buf, priorityVideo)
+	if notified != 0 {
+		t.Errorf("Notified after a single drop")
+	}
+
+	q.mu.Lock()
+	q.congestedSince = q.congestedSince.Add(-congestionDuration)
+	q.mu.Unlock()
+	q.push(nil, buf, priorityVideo)
+	q.push(nil, buf, priorityVideo)
+	if notified != 1 {
+		t.Errorf("Expected 1 notification, got %v", notified)
+	}
+}
+
+func BenchmarkSendQueue(b *testing.B) {
+	q := newSendQueue(nil)
+	defer q.close()
+	// pretend the queue is being run, so that nothing gets sent
+	q.scheduled = true
+
+	buf := make([]byte, 1200)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.push(nil, buf, priorityVideo)
+		packets := q.take()
+		for _, p := range packets {
+			putPacketBuf(p.buf)
+		}
+		q.spare = packets[:0]
+	}
+}
@@ -0,0 +1,111 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/codecs"
+	"github.com/jech/galene/conn"
+)
+
+// recordDimensions records the size of the video carried by an up track.
+// It is called by the reader on keyframes.
+func (t *rtpUpTrack) recordDimensions(codec string, buf []byte) {
+	var packet rtp.Packet
+	err := packet.Unmarshal(buf)
+	if err != nil {
+		return
+	}
+	w, h := codecs.KeyframeDimensions(codec, &packet)
+	if w == 0 || h == 0 {
+		return
+	}
+	atomic.StoreUint32(&t.dimensions, (w&0xFFFF)|(h&0xFFFF)<<16)
+}
+
+// getDimensions returns the size of the video carried by t, or zero if
+// unknown.
+func (t *rtpUpTrack) getDimensions() (uint32, uint32) {
+	d := atomic.LoadUint32(&t.dimensions)
+	return d & 0xFFFF, d >> 16
+}
+
+// setRenderSize records the size in pixels at which the receiver
+// renders a down track.  Zero means unknown.
+func (down *rtpDownTrack) setRenderSize(width, height int) {
+	size := func(v int) uint32 {
+		if v < 0 {
+			return 0
+		}
+		if v > 0xFFFF {
+			return 0xFFFF
+		}
+		return uint32(v)
+	}
+	atomic.StoreUint32(&down.atomics.renderSize,
+		size(width)|size(height)<<16)
+}
+
+func (down *rtpDownTrack) getRenderSize() (uint32, uint32) {
+	s := atomic.LoadUint32(&down.atomics.renderSize)
+	return s & 0xFFFF, s >> 16
+}
+
+// sizeLayer returns the lowest spatial layer that is at least as large
+// as the rendered size, assuming that each layer has half the resolution
+// of the one above it.  The top layer has the given width and height.
+func sizeLayer(maxSid uint8, width, height, rwidth, rheight uint32) uint8 {
+	if width == 0 || height == 0 || (rwidth == 0 && rheight == 0) {
+		return maxSid
+	}
+	sid := maxSid
+	for sid > 0 && width/2 >= rwidth && height/2 >= rheight {
+		width /= 2
+		height /= 2
+		sid--
+	}
+	return sid
+}
+
+// sizeLimit returns the highest spatial layer useful to the receiver of
+// a down track, given the size at which it renders the video.
+func (down *rtpDownTrack) sizeLimit(maxSid uint8) uint8 {
+	rw, rh := down.getRenderSize()
+	if rw == 0 && rh == 0 {
+		return maxSid
+	}
+	up, ok := down.getRemote().(*rtpUpTrack)
+	if !ok {
+		return maxSid
+	}
+	w, h := up.getDimensions()
+	return sizeLayer(maxSid, w, h, rw, rh)
+}
+
+// simulcastLowFits returns true if the low track of a simulcast stream,
+// the last video track, is large enough for the size at which the
+// receiver renders it.
+func simulcastLowFits(tracks []conn.UpTrack, req trackRequest) bool {
+	if req.width <= 0 && req.height <= 0 {
+		return false
+	}
+	var video []*rtpUpTrack
+	for _, t := range tracks {
+		if t.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		if tt, ok := t.(*rtpUpTrack); ok {
+			video = append(video, tt)
+		}
+	}
+	if len(video) < 2 {
+		return false
+	}
+	w, h := video[len(video)-1].getDimensions()
+	if w == 0 || h == 0 {
+		return false
+	}
+	return int(w) >= req.width && int(h) >= req.height
+}
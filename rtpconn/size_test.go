@@ -0,0 +1,45 @@
+package rtpconn
+
+import (
+	"testing"
+)
+
+func TestSizeLayer(t *testing.T) {
+	tests := []struct {
+		maxSid        uint8
+		width, height uint32
+		rw, rh        uint32
+		sid           uint8
+	}{
+		{2, 1280, 720, 0, 0, 2},
+		{2, 0, 0, 160, 90, 2},
+		{2, 1280, 720, 1280, 720, 2},
+		{2, 1280, 720, 640, 360, 1},
+		{2, 1280, 720, 320, 180, 0},
+		{2, 1280, 720, 160, 90, 0},
+		{2, 1280, 720, 700, 300, 2},
+		{2, 1280, 720, 600, 0, 1},
+		{0, 1280, 720, 160, 90, 0},
+	}
+	for _, test := range tests {
+		sid := sizeLayer(test.maxSid,
+			test.width, test.height, test.rw, test.rh)
+		if sid != test.sid {
+			t.Errorf("%v: expected %v, got %v", test, test.sid, sid)
+		}
+	}
+}
+
+func TestRenderSize(t *testing.T) {
+	down := &rtpDownTrack{atomics: &downTrackAtomics{}}
+	if w, h := down.getRenderSize(); w != 0 || h != 0 {
+		t.Errorf("Expected 0 0, got %v %v", w, h)
+	}
+	down.setRenderSize(320, 180)
+	if w, h := down.getRenderSize(); w != 320 || h != 180 {
+		t.Errorf("Expected 320 180, got %v %v", w, h)
+	}
+	if s := down.sizeLimit(2); s != 2 {
+		t.Errorf("Expected 2 without an up track, got %v", s)
+	}
+}
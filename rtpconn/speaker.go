@@ -0,0 +1,100 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+)
+
+// audioLevelInterval is the interval at which audio levels are reported
+// to the group.
+const audioLevelInterval = 200 * time.Millisecond
+
+// With silence suppression, a track that has been quieter than
+// suppressLevel, in -dBov, for suppressDelay is no longer forwarded.
+const (
+	suppressLevel = 60
+	suppressDelay = 2 * time.Second
+)
+
+// recordLevel records the audio level of a packet, in -dBov.
+func (t *rtpUpTrack) recordLevel(level uint8) {
+	if level > group.Silence {
+		level = group.Silence
+	}
+	if atomic.LoadUint32(&t.hasLevel) == 0 {
+		atomic.StoreUint32(&t.hasLevel, 1)
+	}
+	if level < suppressLevel && atomic.LoadUint32(&t.suppressed) != 0 {
+		// resume forwarding immediately, in order to avoid
+		// clipping the beginning of speech
+		atomic.StoreUint32(&t.suppressed, 0)
+	}
+	loudness := uint32(group.Silence - level)
+	for {
+		old := atomic.LoadUint32(&t.loudness)
+		if loudness <= old ||
+			atomic.CompareAndSwapUint32(&t.loudness, old, loudness) {
+			return
+		}
+	}
+}
+
+// takeLevel returns the loudest level recorded since the last call.
+func (t *rtpUpTrack) takeLevel() uint8 {
+	return uint8(group.Silence - atomic.SwapUint32(&t.loudness, 0))
+}
+
+func (t *rtpUpTrack) isSuppressed() bool {
+	return atomic.LoadUint32(&t.suppressed) != 0
+}
+
+// updateSuppressed decides whether a track should be suppressed, given
+// the loudest level recorded during the last interval.
+func (t *rtpUpTrack) updateSuppressed(level uint8, enabled bool, now time.Time) {
+	if !enabled || atomic.LoadUint32(&t.hasLevel) == 0 ||
+		level < suppressLevel {
+		t.lastHeard = now
+		if t.isSuppressed() {
+			atomic.StoreUint32(&t.suppressed, 0)
+		}
+		return
+	}
+	if now.Sub(t.lastHeard) >= suppressDelay && !t.isSuppressed() {
+		atomic.StoreUint32(&t.suppressed, 1)
+	}
+}
+
+// audioLevelSender reports the audio level of a connection to the group,
+// which performs active speaker detection, and decides whether its audio
+// is suppressed.  It is called by the timer wheel, and returns false when
+// the connection is closed.
+func audioLevelSender(up *rtpUpConnection, g *group.Group) bool {
+	if up.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		g.DelAudioLevel(up.client, up.id)
+		return false
+	}
+
+	suppress := g.Description().SilenceSuppression
+	now := time.Now()
+	level := uint8(group.Silence)
+	audio := false
+	for _, t := range up.getTracks() {
+		if t.Kind() != webrtc.RTPCodecTypeAudio {
+			continue
+		}
+		audio = true
+		l := t.takeLevel()
+		t.updateSuppressed(l, suppress, now)
+		if l < level {
+			level = l
+		}
+	}
+	if audio {
+		g.SetAudioLevel(up.client, up.id, level)
+	}
+	return true
+}
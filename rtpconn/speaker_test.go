@@ -0,0 +1,67 @@
+package rtpconn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+func TestRecordLevel(t *testing.T) {
+	var track rtpUpTrack
+	if l := track.takeLevel(); l != group.Silence {
+		t.Errorf("Expected silence, got %v", l)
+	}
+
+	track.recordLevel(60)
+	track.recordLevel(40)
+	track.recordLevel(50)
+	if l := track.takeLevel(); l != 40 {
+		t.Errorf("Expected 40, got %v", l)
+	}
+	if l := track.takeLevel(); l != group.Silence {
+		t.Errorf("Expected silence, got %v", l)
+	}
+
+	track.recordLevel(200)
+	if l := track.takeLevel(); l != group.Silence {
+		t.Errorf("Expected silence, got %v", l)
+	}
+}
+
+func TestSuppressed(t *testing.T) {
+	var track rtpUpTrack
+	now := time.Now()
+
+	track.updateSuppressed(group.Silence, true, now)
+	if track.isSuppressed() {
+		t.Errorf("Suppressed a track without audio levels")
+	}
+
+	track.recordLevel(30)
+	track.updateSuppressed(track.takeLevel(), true, now)
+	if track.isSuppressed() {
+		t.Errorf("Suppressed a loud track")
+	}
+
+	track.recordLevel(90)
+	track.updateSuppressed(track.takeLevel(), true, now.Add(time.Second))
+	if track.isSuppressed() {
+		t.Errorf("Suppressed a track too early")
+	}
+
+	track.updateSuppressed(group.Silence, false, now.Add(3*time.Second))
+	if track.isSuppressed() {
+		t.Errorf("Suppressed a track with suppression disabled")
+	}
+
+	track.updateSuppressed(group.Silence, true, now.Add(6*time.Second))
+	if !track.isSuppressed() {
+		t.Errorf("Didn't suppress a silent track")
+	}
+
+	track.recordLevel(40)
+	if track.isSuppressed() {
+		t.Errorf("Still suppressed after speech")
+	}
+}
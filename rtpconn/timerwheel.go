@@ -0,0 +1,134 @@
+package rtpconn
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// wheelTick is the granularity of the timer wheel.
+const wheelTick = 50 * time.Millisecond
+
+// wheelSlots is the number of slots in the timer wheel.  Tasks with
+// an interval longer than wheelSlots * wheelTick wait for multiple turns.
+const wheelSlots = 64
+
+// A periodicTask is a function run at randomised intervals by
+// a timerWheel.
+type periodicTask struct {
+	interval time.Duration
+	f        func() bool
+	// number of whole turns of the wheel to wait, protected by the
+	// wheel's mutex
+	rounds int
+}
+
+// A timerWheel runs periodic tasks from a single goroutine that wakes up
+// every wheelTick, which avoids having one goroutine and one timer per
+// connection.  The goroutine only runs when there are tasks.
+type timerWheel struct {
+	mu      sync.Mutex
+	slots   [wheelSlots][]*periodicTask
+	current int
+	count   int
+	running bool
+	// for testing
+	ticks uint64
+}
+
+var rtcpWheel timerWheel
+
+// randomInterval returns an interval randomised uniformly in
+// [interval/2, 3*interval/2], as required by RFC 3550 Section 6.3.1.
+func randomInterval(interval time.Duration) time.Duration {
+	return interval/2 + time.Duration(rand.Int63n(int64(interval)+1))
+}
+
+// insert schedules t to run after delay.  Called locked.
+func (w *timerWheel) insert(t *periodicTask, delay time.Duration) {
+	n := int((delay + wheelTick - 1) / wheelTick)
+	if n < 1 {
+		n = 1
+	}
+	t.rounds = (n - 1) / wheelSlots
+	slot := (w.current + n) % wheelSlots
+	w.slots[slot] = append(w.slots[slot], t)
+}
+
+// schedule arranges for f to be called at randomised intervals with mean
+// interval, starting one interval from now.  The task is stopped when f
+// returns false.
+func (w *timerWheel) schedule(interval time.Duration, f func() bool) {
+	t := &periodicTask{interval: interval, f: f}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.insert(t, randomInterval(interval))
+	w.count++
+	if !w.running {
+		w.running = true
+		go w.loop()
+	}
+}
+
+// advance moves the wheel by one slot and returns the tasks that are
+// due.  It returns false if there are no tasks left, in which case the
+// caller must terminate.
+func (w *timerWheel) advance() ([]*periodicTask, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.count == 0 {
+		w.running = false
+		return nil, false
+	}
+
+	w.ticks++
+	w.current = (w.current + 1) % wheelSlots
+	slot := w.slots[w.current]
+	var due []*periodicTask
+	i := 0
+	for _, t := range slot {
+		if t.rounds > 0 {
+			t.rounds--
+			slot[i] = t
+			i++
+			continue
+		}
+		due = append(due, t)
+	}
+	for j := i; j < len(slot); j++ {
+		slot[j] = nil
+	}
+	w.slots[w.current] = slot[:i]
+	return due, true
+}
+
+func (w *timerWheel) loop() {
+	ticker := time.NewTicker(wheelTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		due, ok := w.advance()
+		if !ok {
+			return
+		}
+		if len(due) == 0 {
+			continue
+		}
+
+		i := 0
+		for _, t := range due {
+			if t.f() {
+				due[i] = t
+				i++
+			}
+		}
+
+		w.mu.Lock()
+		for _, t := range due[:i] {
+			w.insert(t, randomInterval(t.interval))
+		}
+		w.count -= len(due) - i
+		w.mu.Unlock()
+	}
+}
@@ -0,0 +1,69 @@
+package rtpconn
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRandomInterval(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		d := randomInterval(time.Second)
+		if d < time.Second/2 || d > 3*time.Second/2 {
+			t.Errorf("Out of range: %v", d)
+		}
+	}
+}
+
+func TestTimerWheelRounds(t *testing.T) {
+	var w timerWheel
+	task := &periodicTask{}
+	w.insert(task, 3*wheelSlots*wheelTick)
+	if task.rounds != 2 {
+		t.Errorf("Expected 2, got %v", task.rounds)
+	}
+	for i := 0; i < 3*wheelSlots; i++ {
+		w.count = 1
+		due, _ := w.advance()
+		if len(due) != 0 && i != 3*wheelSlots-1 {
+			t.Fatalf("Task due early at %v", i)
+		}
+		if len(due) != 1 && i == 3*wheelSlots-1 {
+			t.Fatalf("Task not due")
+		}
+	}
+}
+
+func TestTimerWheel(t *testing.T) {
+	var w timerWheel
+	const tasks = 2000
+	var calls int64
+	var stop int32
+	for i := 0; i < tasks; i++ {
+		w.schedule(200*time.Millisecond, func() bool {
+			atomic.AddInt64(&calls, 1)
+			return atomic.LoadInt32(&stop) == 0
+		})
+	}
+
+	time.Sleep(time.Second)
+	atomic.StoreInt32(&stop, 1)
+
+	// each task should have run about 5 times
+	c := atomic.LoadInt64(&calls)
+	if c < 3*tasks || c > 7*tasks {
+		t.Errorf("Expected about %v calls, got %v", 5*tasks, c)
+	}
+
+	// the wheel should stop once all tasks have returned false
+	time.Sleep(500 * time.Millisecond)
+	w.mu.Lock()
+	running, count, ticks := w.running, w.count, w.ticks
+	w.mu.Unlock()
+	if running || count != 0 {
+		t.Errorf("Wheel still running (%v tasks)", count)
+	}
+	if ticks > uint64(2*time.Second/wheelTick) {
+		t.Errorf("Too many wakeups: %v", ticks)
+	}
+}
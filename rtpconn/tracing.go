@@ -0,0 +1,113 @@
+package rtpconn
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/tracing"
+)
+
+// connTrace traces the establishment of a connection: the offer/answer
+// exchange, candidate gathering and ICE connectivity checks.  A nil
+// connTrace does nothing, which happens when tracing is disabled.
+type connTrace struct {
+	parent        *tracing.Span
+	direction, id string
+
+	mu          sync.Mutex
+	negotiation *tracing.Span
+	gathering   *tracing.Span
+	ice         *tracing.Span
+}
+
+func newConnTrace(parent *tracing.Span, direction, id string) *connTrace {
+	if parent == nil {
+		return nil
+	}
+	return &connTrace{parent: parent, direction: direction, id: id}
+}
+
+func (t *connTrace) start(name string) *tracing.Span {
+	s := tracing.Start(t.parent, name)
+	s.SetAttribute("direction", t.direction)
+	s.SetAttribute("id", t.id)
+	return s
+}
+
+// startNegotiation is called when an offer is sent or received.
+func (t *connTrace) startNegotiation() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.negotiation.End()
+	t.negotiation = t.start("negotiate")
+}
+
+// endNegotiation is called when the answer has been sent or received.
+func (t *connTrace) endNegotiation(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.negotiation.Fail(err)
+	t.negotiation.End()
+	t.negotiation = nil
+}
+
+func (t *connTrace) gatheringState(state webrtc.ICEGathererState) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case webrtc.ICEGathererStateGathering:
+		t.gathering.End()
+		t.gathering = t.start("gather")
+	case webrtc.ICEGathererStateComplete:
+		t.gathering.End()
+		t.gathering = nil
+	}
+}
+
+var errICEFailed = errors.New("ICE failed")
+
+func (t *connTrace) iceState(state webrtc.ICEConnectionState) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case webrtc.ICEConnectionStateChecking:
+		if t.ice == nil {
+			t.ice = t.start("ice")
+		}
+	case webrtc.ICEConnectionStateConnected,
+		webrtc.ICEConnectionStateCompleted:
+		t.ice.End()
+		t.ice = nil
+	case webrtc.ICEConnectionStateFailed:
+		t.ice.Fail(errICEFailed)
+		t.ice.End()
+		t.ice = nil
+	}
+}
+
+// close ends any spans still in progress.
+func (t *connTrace) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range []*tracing.Span{t.negotiation, t.gathering, t.ice} {
+		s.End()
+	}
+	t.negotiation, t.gathering, t.ice = nil, nil, nil
+}
@@ -0,0 +1,152 @@
+package rtpconn
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/rtptime"
+	"github.com/jech/galene/twcc"
+)
+
+// setTWCC records the id negotiated for the transport-wide sequence
+// number extension.  Called after the receiver's answer is applied.
+func (down *rtpDownConnection) setTWCC() {
+	var id uint8
+	for _, t := range down.getTracks() {
+		id = extensionId(
+			t.sender.GetParameters().HeaderExtensions, twcc.URI,
+		)
+		if id != 0 {
+			break
+		}
+	}
+	atomic.StoreUint32(&down.twccId, uint32(id))
+}
+
+func (down *rtpDownConnection) getTWCCId() uint8 {
+	return uint8(atomic.LoadUint32(&down.twccId))
+}
+
+// twccPacket copies the packet in buf into result, adding a
+// transport-wide sequence number, and records it with the estimator.  It
+// returns 0 if this is not possible, in which case the packet should be
+// sent as is.
+func (down *rtpDownConnection) twccPacket(buf []byte, result []byte) int {
+	id := down.getTWCCId()
+	if id == 0 || id > 14 || len(buf) < 12 || (buf[0]&0x10) != 0 {
+		return 0
+	}
+	offset := 12 + 4*int(buf[0]&0x0F)
+	if len(buf) < offset || len(buf)+8 > len(result) {
+		return 0
+	}
+
+	seqno := down.twcc.Send(len(buf)+8, rtptime.Microseconds())
+
+	copy(result, buf[:offset])
+	result[0] |= 0x10
+	// a one-byte header extension, padded to a multiple of 4 bytes
+	binary.BigEndian.PutUint16(result[offset:], 0xBEDE)
+	binary.BigEndian.PutUint16(result[offset+2:], 1)
+	result[offset+4] = (id << 4) | 1
+	binary.BigEndian.PutUint16(result[offset+5:], seqno)
+	result[offset+7] = 0
+	copy(result[offset+8:], buf[offset:])
+	return len(buf) + 8
+}
+
+func hasFeedback(fb []webrtc.RTCPFeedback, tpe string) bool {
+	for _, f := range fb {
+		if f.Type == tpe && f.Parameter == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// gotTWCC processes transport-wide congestion control feedback.  The
+// capacity of the connection, minus what is used by audio, is shared
+// between the video tracks, and the layers are adjusted accordingly.
+func (down *rtpDownConnection) gotTWCC(p *rtcp.TransportLayerCC) {
+	down.twcc.Feedback(p, rtptime.Microseconds())
+	rate, ok := down.twcc.Estimate()
+	if !ok {
+		return
+	}
+
+	tracks := down.getTracks()
+	var video []*rtpDownTrack
+	for _, t := range tracks {
+		if t.getRemote().Kind() == webrtc.RTPCodecTypeVideo {
+			video = append(video, t)
+		} else {
+			r, _ := t.rate.Estimate()
+			if rate > 8*uint64(r) {
+				rate -= 8 * uint64(r)
+			} else {
+				rate = 0
+			}
+		}
+	}
+	if len(video) == 0 {
+		return
+	}
+
+	share := rate / uint64(len(video))
+	if share < minLossRate {
+		share = minLossRate
+	}
+	jiffies := rtptime.Jiffies()
+	for _, t := range video {
+		t.maxTWCCBitrate.Set(share, jiffies)
+		t.adjustLayer()
+	}
+}
+
+// twccInterval is the interval at which we send feedback to senders.
+const twccInterval = 100 * time.Millisecond
+
+// setTWCC records the id of the transport-wide sequence number extension
+// if the sender negotiated it.  Called when a track is received, after
+// negotiation.
+func (up *rtpUpConnection) setTWCC(receiver *webrtc.RTPReceiver) {
+	id := extensionId(receiver.GetParameters().HeaderExtensions, twcc.URI)
+	if id != 0 {
+		atomic.StoreUint32(&up.twccId, uint32(id))
+	}
+}
+
+func (up *rtpUpConnection) getTWCCId() uint8 {
+	return uint8(atomic.LoadUint32(&up.twccId))
+}
+
+// twccUpSender sends transport-wide feedback.  It is called by the timer
+// wheel, and returns false when the connection is closed.
+func twccUpSender(up *rtpUpConnection) bool {
+	tracks := up.getTracks()
+	if len(tracks) == 0 {
+		return up.pc.ConnectionState() != webrtc.PeerConnectionStateClosed
+	}
+	if up.getTWCCId() == 0 {
+		// the sender gets REMB instead
+		return false
+	}
+
+	p := up.twcc.Feedback(0, uint32(tracks[0].track.SSRC()))
+	if p == nil {
+		return true
+	}
+	err := up.pc.WriteRTCP([]rtcp.Packet{p})
+	if err != nil {
+		if err == io.EOF || err == io.ErrClosedPipe {
+			return false
+		}
+		up.log.Warnf("WriteRTCP: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package rtpconn
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtpheader"
+	"github.com/jech/galene/twcc"
+)
+
+func TestTWCCPacket(t *testing.T) {
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    96,
+			SequenceNumber: 42,
+			SSRC:           1,
+			CSRC:           []uint32{2},
+		},
+		Payload: []byte{1, 2, 3, 4, 5},
+	}
+	buf, err := packet.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	down := &rtpDownConnection{twcc: twcc.New()}
+	result := make([]byte, 1500)
+	if down.twccPacket(buf, result) != 0 {
+		t.Errorf("Added extension without negotiation")
+	}
+
+	down.twccId = 3
+	for i := 0; i < 2; i++ {
+		n := down.twccPacket(buf, result)
+		if n != len(buf)+8 {
+			t.Fatalf("Expected %v, got %v", len(buf)+8, n)
+		}
+		h, err := rtpheader.Parse(result[:n])
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		seqno, ok := rtpheader.TransportSequenceNumber(h.Extension(3))
+		if !ok || seqno != uint16(i) ||
+			h.SequenceNumber() != 42 || h.SSRC() != 1 ||
+			!bytes.Equal(h.Payload(), packet.Payload) {
+			t.Errorf("Bad packet %v", result[:n])
+		}
+		var p rtp.Packet
+		err = p.Unmarshal(result[:n])
+		if err != nil || len(p.CSRC) != 1 || p.CSRC[0] != 2 {
+			t.Errorf("Unmarshal: %v %v", p.CSRC, err)
+		}
+	}
+
+	// packets that already carry an extension are left alone
+	n := down.twccPacket(buf, result)
+	if down.twccPacket(result[:n], make([]byte, 1500)) != 0 {
+		t.Errorf("Added a second extension")
+	}
+	if down.twccPacket(buf, result[:len(buf)+7]) != 0 {
+		t.Errorf("Added extension to a short buffer")
+	}
+}
+
+func TestTWCCNegotiation(t *testing.T) {
+	api, err := group.APIFromNames([]string{"vp8", "opus"})
+	if err != nil {
+		t.Fatalf("APIFromNames: %v", err)
+	}
+
+	for _, direction := range []webrtc.RTPTransceiverDirection{
+		webrtc.RTPTransceiverDirectionSendonly,
+		webrtc.RTPTransceiverDirectionRecvonly,
+	} {
+		pc, err := api.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatalf("NewPeerConnection: %v", err)
+		}
+		defer pc.Close()
+		_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+			webrtc.RTPTransceiverInit{Direction: direction},
+		)
+		if err != nil {
+			t.Fatalf("AddTransceiver: %v", err)
+		}
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			t.Fatalf("CreateOffer: %v", err)
+		}
+		if !strings.Contains(offer.SDP, twcc.URI) ||
+			!strings.Contains(offer.SDP, "transport-cc") {
+			t.Errorf("%v: bad offer %v", direction, offer.SDP)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package rtpconn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+// Limits on client messages.
+const (
+	maxMessageSize   = 1024 * 1024
+	maxIdLength      = 256
+	maxNameLength    = 256
+	maxSecretLength  = 4096
+	maxSDPLength     = 256 * 1024
+	maxListLength    = 64
+	maxCandidateSize = 1024
+)
+
+// A client is disconnected if it sends more than maxViolations invalid
+// messages within violationInterval.
+const (
+	maxViolations     = 10
+	violationInterval = time.Minute
+)
+
+// A validationError indicates that a client message is malformed.  It
+// is reported to the client, and the message is ignored.
+type validationError struct {
+	typ     string
+	field   string
+	message string
+}
+
+func (err *validationError) Error() string {
+	if err.field == "" {
+		return "invalid message: " + err.message
+	}
+	t := ""
+	if err.typ != "" {
+		t = " in " + err.typ
+	}
+	return fmt.Sprintf("invalid field %v%v: %v", err.field, t, err.message)
+}
+
+type valueType int
+
+const (
+	valueAny valueType = iota
+	// the value must be absent
+	valueNone
+	// a string, or absent
+	valueString
+	// a JSON object
+	valueObject
+)
+
+type valueSchema struct {
+	typ valueType
+	// if not nil, the permitted values of a string
+	enum []string
+}
+
+// A messageSchema describes the messages of a given type.
+type messageSchema struct {
+	// the permitted values of kind; if nil, kind is not checked
+	kinds []string
+	// the fields that must be present and not empty
+	required []string
+	// the value, indexed by kind; the empty kind applies to all kinds
+	values map[string]valueSchema
+}
+
+// the values of the record group action: the empty string, "mixed", or
+// a recording format
+var recordModes = []string{"", "mixed", "webm", "mp4", "ogg"}
+
+var messageSchemas = map[string]messageSchema{
+	"handshake": {},
+	"join": {
+		kinds:    []string{"join", "leave"},
+		required: []string{"group"},
+	},
+	"request":       {},
+	"requestStream": {required: []string{"id"}},
+	"requestTrack":  {required: []string{"id", "mid"}},
+	"offer":         {required: []string{"id", "sdp"}},
+	"answer":        {required: []string{"id", "sdp"}},
+	"renegotiate":   {required: []string{"id"}},
+	"close":         {required: []string{"id"}},
+	"abort":         {required: []string{"id"}},
+	"ice":           {required: []string{"id", "candidate"}},
+	"chat": {
+		values: map[string]valueSchema{"": {typ: valueString}},
+	},
+	"usermessage": {},
+	"groupaction": {
+		kinds: []string{
+			"clearchat", "lock", "unlock", "record", "unrecord",
+			"tap", "untap", "restream", "unrestream",
+			"testsource", "untestsource",
+			"subgroups", "setdata",
+			"maketoken", "edittoken", "listtokens",
+		},
+		values: map[string]valueSchema{
+			"clearchat":    {typ: valueNone},
+			"lock":         {typ: valueString},
+			"unlock":       {typ: valueString},
+			"record":       {typ: valueString, enum: recordModes},
+			"unrecord":     {typ: valueNone},
+			"tap":          {typ: valueObject},
+			"untap":        {typ: valueString},
+			"restream":     {typ: valueObject},
+			"unrestream":   {typ: valueString},
+			"testsource":   {typ: valueNone},
+			"untestsource": {typ: valueNone},
+			"subgroups":    {typ: valueNone},
+			"setdata":      {typ: valueObject},
+			"maketoken":    {typ: valueObject},
+			"edittoken":    {typ: valueObject},
+			"listtokens":   {typ: valueNone},
+		},
+	},
+	"useraction": {
+		kinds: []string{
+			"op", "unop", "present", "unpresent", "kick", "setdata",
+		},
+		required: []string{"dest"},
+		values: map[string]valueSchema{
+			"op":        {typ: valueString},
+			"unop":      {typ: valueString},
+			"present":   {typ: valueString},
+			"unpresent": {typ: valueString},
+			"kick":      {typ: valueString},
+			"setdata":   {typ: valueObject},
+		},
+	},
+	"ping": {},
+	"pong": {},
+}
+
+// present returns true if the given field is present and not empty.
+func present(m *clientMessage, field string) bool {
+	switch field {
+	case "id":
+		return m.Id != ""
+	case "group":
+		return m.Group != ""
+	case "sdp":
+		return m.SDP != ""
+	case "candidate":
+		return m.Candidate != nil
+	case "dest":
+		return m.Dest != ""
+	case "mid":
+		return m.Mid != ""
+	default:
+		panic("unknown field " + field)
+	}
+}
+
+func checkValue(v interface{}, s valueSchema) string {
+	switch s.typ {
+	case valueNone:
+		if v != nil {
+			return "unexpected value"
+		}
+	case valueString:
+		if v == nil {
+			break
+		}
+		vv, ok := v.(string)
+		if !ok {
+			return "expected a string"
+		}
+		if s.enum != nil && !member(vv, s.enum) {
+			return "unknown value"
+		}
+	case valueObject:
+		if _, ok := v.(map[string]interface{}); !ok {
+			return "expected an object"
+		}
+	}
+	return ""
+}
+
+func checkStringList(l []string, maxLength int) string {
+	if len(l) > maxListLength {
+		return "too many elements"
+	}
+	for _, s := range l {
+		if len(s) > maxLength {
+			return "element too long"
+		}
+	}
+	return ""
+}
+
+// validateMessage checks that a message is well-formed.  It is called
+// before the message is dispatched, and doesn't depend on the state of
+// the client.
+func validateMessage(m *clientMessage) error {
+	invalid := func(field, message string) error {
+		return &validationError{
+			typ: m.Type, field: field, message: message,
+		}
+	}
+
+	schema, ok := messageSchemas[m.Type]
+	if !ok {
+		if len(m.Type) > maxNameLength {
+			return invalid("type", "too long")
+		}
+		return invalid("type", "unknown message type")
+	}
+
+	fields := []struct {
+		field  string
+		value  string
+		length int
+	}{
+		{"kind", m.Kind, maxNameLength},
+		{"error", m.Error, maxNameLength},
+		{"id", m.Id, maxIdLength},
+		{"replace", m.Replace, maxIdLength},
+		{"source", m.Source, maxIdLength},
+		{"dest", m.Dest, maxIdLength},
+		{"password", m.Password, maxSecretLength},
+		{"token", m.Token, maxSecretLength},
+		{"group", m.Group, maxNameLength},
+		{"time", m.Time, maxNameLength},
+		{"sdp", m.SDP, maxSDPLength},
+		{"label", m.Label, maxNameLength},
+		{"mid", m.Mid, maxNameLength},
+	}
+	for _, s := range fields {
+		if len(s.value) > s.length {
+			return invalid(s.field, "too long")
+		}
+	}
+	if m.Username != nil && len(*m.Username) > maxNameLength {
+		return invalid("username", "too long")
+	}
+
+	lists := []struct {
+		field string
+		value []string
+	}{
+		{"version", m.Version},
+		{"features", m.Features},
+		{"permissions", m.Permissions},
+	}
+	for _, l := range lists {
+		if e := checkStringList(l.value, maxNameLength); e != "" {
+			return invalid(l.field, e)
+		}
+	}
+
+	if len(m.Data) > maxListLength {
+		return invalid("data", "too many elements")
+	}
+	for k := range m.Data {
+		if len(k) > maxNameLength {
+			return invalid("data", "key too long")
+		}
+	}
+
+	if m.Candidate != nil {
+		c := m.Candidate
+		if len(c.Candidate) > maxCandidateSize ||
+			(c.SDPMid != nil && len(*c.SDPMid) > maxNameLength) ||
+			(c.UsernameFragment != nil &&
+				len(*c.UsernameFragment) > maxNameLength) {
+			return invalid("candidate", "too long")
+		}
+	}
+
+	if schema.kinds != nil && !member(m.Kind, schema.kinds) {
+		if m.Kind == "" {
+			return invalid("kind", "missing")
+		}
+		return invalid("kind", "unknown value")
+	}
+
+	for _, f := range schema.required {
+		if !present(m, f) {
+			return invalid(f, "missing")
+		}
+	}
+
+	vs, ok := schema.values[m.Kind]
+	if !ok {
+		vs = schema.values[""]
+	}
+	if e := checkValue(m.Value, vs); e != "" {
+		return invalid("value", e)
+	}
+
+	switch m.Type {
+	case "request":
+		requested, err := parseRequested(m.Request)
+		if err != nil {
+			return invalid("request", "expected lists of strings")
+		}
+		if len(requested) > maxListLength {
+			return invalid("request", "too many elements")
+		}
+		for k, v := range requested {
+			if len(k) > maxNameLength {
+				return invalid("request", "label too long")
+			}
+			if e := checkStringList(v, maxNameLength); e != "" {
+				return invalid("request", e)
+			}
+		}
+	case "requestStream":
+		requested, err := toStringArray(m.Request)
+		if err != nil {
+			return invalid("request", "expected a list of strings")
+		}
+		if e := checkStringList(requested, maxNameLength); e != "" {
+			return invalid("request", e)
+		}
+	case "requestTrack":
+		_, err := parseTrackRequest(m.Request)
+		if err != nil {
+			return invalid("request", "expected a track request")
+		}
+	}
+
+	return nil
+}
+
+// decodeMessage decodes and validates a client message.  If the message
+// is malformed, it returns a *validationError.
+func decodeMessage(data []byte) (clientMessage, error) {
+	var m clientMessage
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			field := typeErr.Field
+			if field == "" {
+				return m, &validationError{
+					message: "expected an object",
+				}
+			}
+			// Value is of the form "number 42"
+			value, _, _ := strings.Cut(typeErr.Value, " ")
+			return m, &validationError{
+				typ:     m.Type,
+				field:   field,
+				message: "unexpected " + value,
+			}
+		}
+		return m, &validationError{message: "malformed JSON"}
+	}
+	return m, validateMessage(&m)
+}
+
+// invalidMessage reports a validation error to the client.  It returns
+// an error, which causes the client to be disconnected, if the client
+// has sent too many invalid messages recently.
+func (c *webClient) invalidMessage(err *validationError) error {
+	now := time.Now()
+	if now.Sub(c.violationsTime) > violationInterval {
+		c.violations = 0
+		c.violationsTime = now
+	}
+	c.violations++
+	if c.violations > maxViolations {
+		return group.ProtocolError("too many invalid messages")
+	}
+	return c.write(clientMessage{
+		Type:       "usermessage",
+		Kind:       "error",
+		Dest:       c.id,
+		Privileged: true,
+		Error:      "invalid-message",
+		Field:      err.field,
+		Value:      err.Error(),
+	})
+}
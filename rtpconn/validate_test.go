@@ -0,0 +1,163 @@
+package rtpconn
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jech/galene/group"
+)
+
+var validMessages = []string{
+	`{"type":"handshake","version":["2"],"features":["user-batch"],"id":"a"}`,
+	`{"type":"join","kind":"join","group":"g","username":"u","password":"p","data":{"raisehand":true}}`,
+	`{"type":"join","kind":"leave","group":"g"}`,
+	`{"type":"request","request":{"":["audio","video"]}}`,
+	`{"type":"requestStream","id":"x","request":["audio"]}`,
+	`{"type":"requestTrack","id":"x","mid":"1","request":{"spatial":0}}`,
+	`{"type":"requestTrack","id":"x","mid":"0","request":{"off":true}}`,
+	`{"type":"requestTrack","id":"x","mid":"1",` +
+		`"request":{"width":320,"height":180}}`,
+	`{"type":"offer","id":"x","label":"camera","sdp":"v=0"}`,
+	`{"type":"answer","id":"x","sdp":"v=0"}`,
+	`{"type":"ice","id":"x","candidate":{"candidate":"c","sdpMid":"0"}}`,
+	`{"type":"abort","id":"x"}`,
+	`{"type":"chat","source":"a","dest":"","username":null,"kind":"me","value":"hello"}`,
+	`{"type":"usermessage","kind":"filetransfer","dest":"b","value":{"type":"invite"}}`,
+	`{"type":"groupaction","kind":"lock","value":"closed"}`,
+	`{"type":"groupaction","kind":"record","value":"mixed"}`,
+	`{"type":"groupaction","kind":"record","value":"mp4"}`,
+	`{"type":"groupaction","kind":"record"}`,
+	`{"type":"groupaction","kind":"maketoken","value":{"group":"g"}}`,
+	`{"type":"useraction","kind":"kick","dest":"b","value":"bye"}`,
+	`{"type":"useraction","kind":"op","dest":"b","value":""}`,
+	`{"type":"useraction","kind":"setdata","dest":"a","value":{"k":1}}`,
+	`{"type":"ping"}`,
+}
+
+func TestValidateMessage(t *testing.T) {
+	for _, v := range validMessages {
+		_, err := decodeMessage([]byte(v))
+		if err != nil {
+			t.Errorf("%v: %v", v, err)
+		}
+	}
+
+	long := strings.Repeat("x", 1000)
+	invalid := []struct {
+		message string
+		field   string
+	}{
+		{`{"type":"teleport"}`, "type"},
+		{`{"type":"join","group":"g"}`, "kind"},
+		{`{"type":"join","kind":"jump","group":"g"}`, "kind"},
+		{`{"type":"join","kind":"join"}`, "group"},
+		{`{"type":"join","kind":"join","group":"` + long + `"}`, "group"},
+		{`{"type":"handshake","id":"` + long + `"}`, "id"},
+		{`{"type":"offer","sdp":"v=0"}`, "id"},
+		{`{"type":"ice","id":"x"}`, "candidate"},
+		{`{"type":"ice","id":"x","candidate":{"candidate":"` +
+			strings.Repeat(long, 2) + `"}}`, "candidate"},
+		{`{"type":"chat","value":{}}`, "value"},
+		{`{"type":"groupaction","kind":"record","value":"loud"}`, "value"},
+		{`{"type":"groupaction","kind":"tap","value":"t"}`, "value"},
+		{`{"type":"groupaction","kind":"restream","value":"r"}`, "value"},
+		{`{"type":"groupaction","kind":"clearchat","value":1}`, "value"},
+		{`{"type":"useraction","kind":"op"}`, "dest"},
+		{`{"type":"useraction","kind":"kick","dest":"b","value":2}`, "value"},
+		{`{"type":"request","request":{"":[1]}}`, "request"},
+		{`{"type":"requestStream","id":"x","request":"audio"}`, "request"},
+		{`{"type":"requestTrack","id":"x","request":{}}`, "mid"},
+		{`{"type":"requestTrack","id":"x","mid":"1",` +
+			`"request":{"spatial":-1}}`, "request"},
+		{`{"type":"requestTrack","id":"x","mid":"1",` +
+			`"request":{"loud":true}}`, "request"},
+		{`{"type":"offer","id":1}`, "id"},
+		{`{"type":"ice","id":"x","candidate":{"sdpMLineIndex":"0"}}`,
+			"candidate.sdpMLineIndex"},
+		{`{"type":"handshake","version":[2]}`, "version"},
+	}
+	for _, v := range invalid {
+		_, err := decodeMessage([]byte(v.message))
+		var verr *validationError
+		if !errors.As(err, &verr) {
+			t.Errorf("%v: expected validation error, got %v",
+				v.message, err)
+			continue
+		}
+		// recent versions of Go include array indices
+		if !strings.HasPrefix(verr.field, v.field) {
+			t.Errorf("%v: expected field %v, got %v",
+				v.message, v.field, verr.field)
+		}
+	}
+
+	for _, v := range []string{``, `[]`, `{"type":`, `{} {}`, `null1`} {
+		_, err := decodeMessage([]byte(v))
+		var verr *validationError
+		if !errors.As(err, &verr) {
+			t.Errorf("%q: expected validation error, got %v", v, err)
+		}
+	}
+}
+
+func TestInvalidMessage(t *testing.T) {
+	c := &webClient{
+		id:         "a",
+		writeCh:    make(chan interface{}, 2*maxViolations),
+		writerDone: make(chan struct{}),
+	}
+	verr := &validationError{
+		typ: "join", field: "kind", message: "missing",
+	}
+	for i := 0; i < maxViolations; i++ {
+		err := c.invalidMessage(verr)
+		if err != nil {
+			t.Fatalf("invalidMessage: %v", err)
+		}
+	}
+	err := c.invalidMessage(verr)
+	if _, ok := err.(group.ProtocolError); !ok {
+		t.Errorf("Expected protocol error, got %v", err)
+	}
+
+	m := (<-c.writeCh).(clientMessage)
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	expected := `{"type":"usermessage","kind":"error",` +
+		`"error":"invalid-message","field":"kind","dest":"a",` +
+		`"privileged":true,"value":"invalid field kind in join: missing"}`
+	if string(b) != expected {
+		t.Errorf("Expected %v, got %v", expected, string(b))
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, v := range validMessages {
+		f.Add([]byte(v))
+	}
+	f.Add([]byte(`{"type":"ice","id":"x","candidate":{"sdpMLineIndex":-1}}`))
+	f.Add([]byte(`{"type":"request","request":{"a":null}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := decodeMessage(data)
+		if err != nil {
+			var verr *validationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			_ = verr.Error()
+			return
+		}
+		if _, ok := messageSchemas[m.Type]; !ok {
+			t.Errorf("Accepted unknown type %q", m.Type)
+		}
+		for _, f := range messageSchemas[m.Type].required {
+			if !present(&m, f) {
+				t.Errorf("Accepted message without %v", f)
+			}
+		}
+	})
+}
@@ -6,20 +6,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 
 	"github.com/jech/galene/conn"
-	"github.com/jech/galene/diskwriter"
 	"github.com/jech/galene/estimator"
 	"github.com/jech/galene/group"
 	"github.com/jech/galene/ice"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/rtptime"
+	"github.com/jech/galene/tap"
 	"github.com/jech/galene/token"
+	"github.com/jech/galene/tracing"
 	"github.com/jech/galene/unbounded"
 )
 
@@ -67,12 +71,62 @@ type webClient struct {
 	writeCh     chan interface{}
 	writerDone  chan struct{}
 	actions     *unbounded.Channel[any]
+	speaking    bool
+	// whether last-N is enabled, which requires speaker updates
+	lastNEnabled atomic.Bool
+	// the root span of the session, nil if tracing is disabled
+	trace *tracing.Span
+
+	// only accessed by the client loop
+	userBatch      bool
+	pendingUsers   []*group.ClientUpdate
+	pendingIndex   map[string]int
+	lastUserBatch  time.Time
+	userBatchTimer bool
+	echoTimer      bool
+	violations     int
+	violationsTime time.Time
+	// when we last paused or resumed video for lack of bandwidth
+	videoSwitch time.Time
+	// the clients whose video we receive and when they entered the
+	// set, nil if last-N is disabled
+	lastN      map[string]time.Time
+	lastNTimer bool
 
 	mu   sync.Mutex
 	down map[string]*rtpDownConnection
 	up   map[string]*rtpUpConnection
 }
 
+// Restreamer is implemented by the clients that push the media of
+// a group to an external server.
+type Restreamer interface {
+	group.Client
+	RestreamName() string
+	Close() error
+}
+
+// NewRestreamer, if not nil, creates the restreamer with the given name,
+// restricted to the streams of user if it is not empty.  It is set by
+// the main program, in order to avoid an import cycle.
+var NewRestreamer func(g *group.Group, name, user string) (Restreamer, error)
+
+// StartTestSource and StopTestSource, if not nil, start and stop the
+// synthetic media source of a group.  They are set by the main program,
+// in order to avoid an import cycle.
+var StartTestSource func(g *group.Group) error
+var StopTestSource func(g *group.Group) bool
+
+// UpdateCameras, if not nil, is called whenever a client joins or leaves
+// a group, so that cameras only run while there are users.  It is set
+// by the main program, in order to avoid an import cycle.
+var UpdateCameras func(g *group.Group)
+
+// log returns a logger that identifies the client and its group.
+func (c *webClient) log() *logging.Logger {
+	return clientLogger(c, "")
+}
+
 func (c *webClient) Group() *group.Group {
 	return c.group
 }
@@ -101,18 +155,38 @@ func (c *webClient) SetPermissions(perms []string) {
 	c.permissions = perms
 }
 
-func (c *webClient) PushClient(group, kind, id string, username string, perms []string, data map[string]interface{}) error {
-	c.action(pushClientAction{
-		group, kind, id, username, perms, data,
-	})
+func (c *webClient) PushClient(g, kind, id string, username string, perms []string, data map[string]interface{}) error {
+	c.action(pushClientAction{&group.ClientUpdate{
+		Group:       g,
+		Kind:        kind,
+		Id:          id,
+		Username:    username,
+		Permissions: perms,
+		Data:        data,
+	}})
+	return nil
+}
+
+func (c *webClient) PushClientUpdate(u *group.ClientUpdate) error {
+	c.action(pushClientAction{u})
+	return nil
+}
+
+func (c *webClient) PushSpeakers(group, active string, speaking []string) error {
+	if !c.speaking && !c.lastNEnabled.Load() {
+		return nil
+	}
+	c.action(speakersAction{group, active, speaking})
 	return nil
 }
 
 type clientMessage struct {
 	Type             string                   `json:"type"`
 	Version          []string                 `json:"version,omitempty"`
+	Features         []string                 `json:"features,omitempty"`
 	Kind             string                   `json:"kind,omitempty"`
 	Error            string                   `json:"error,omitempty"`
+	Field            string                   `json:"field,omitempty"`
 	Id               string                   `json:"id,omitempty"`
 	Replace          string                   `json:"replace,omitempty"`
 	Source           string                   `json:"source,omitempty"`
@@ -121,6 +195,7 @@ type clientMessage struct {
 	Password         string                   `json:"password,omitempty"`
 	Token            string                   `json:"token,omitempty"`
 	Privileged       bool                     `json:"privileged,omitempty"`
+	Remote           bool                     `json:"remote,omitempty"`
 	Permissions      []string                 `json:"permissions,omitempty"`
 	Status           *group.Status            `json:"status,omitempty"`
 	Data             map[string]interface{}   `json:"data,omitempty"`
@@ -131,7 +206,9 @@ type clientMessage struct {
 	SDP              string                   `json:"sdp,omitempty"`
 	Candidate        *webrtc.ICECandidateInit `json:"candidate,omitempty"`
 	Label            string                   `json:"label,omitempty"`
+	Mid              string                   `json:"mid,omitempty"`
 	Request          interface{}              `json:"request,omitempty"`
+	Paused           bool                     `json:"paused,omitempty"`
 	RTCConfiguration *webrtc.Configuration    `json:"rtcConfiguration,omitempty"`
 }
 
@@ -181,12 +258,16 @@ func addUpConn(c *webClient, id, label string, offer string) (*rtpUpConnection,
 	}
 
 	c.up[id] = conn
+	conn.trace = newConnTrace(c.trace, "up", id)
 
 	conn.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		sendICE(c, id, candidate)
 	})
 
+	conn.pc.OnICEGatheringStateChange(conn.trace.gatheringState)
+
 	conn.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		conn.trace.iceState(state)
 		if state == webrtc.ICEConnectionStateFailed {
 			c.action(connectionFailedAction{id: id})
 		}
@@ -229,12 +310,13 @@ func delUpConn(c *webClient, id string, userId string, push bool) error {
 	conn.mu.Unlock()
 
 	conn.pc.Close()
+	conn.trace.close()
 
 	if push && g != nil {
-		for _, c := range g.GetClients(c) {
+		for _, c := range mediaReceivers(g, c) {
 			err := c.PushConn(g, id, nil, nil, replace)
 			if err != nil {
-				log.Printf("PushConn: %v", err)
+				conn.log.Warnf("PushConn: %v", err)
 			}
 		}
 	}
@@ -268,9 +350,7 @@ func getConn(c *webClient, id string) iceConnection {
 	return nil
 }
 
-func addDownConn(c *webClient, remote conn.Up) (*rtpDownConnection, bool, error) {
-	id := remote.Id()
-
+func addDownConn(c *webClient, id string, remote conn.Up) (*rtpDownConnection, bool, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -291,11 +371,16 @@ func addDownConn(c *webClient, remote conn.Up) (*rtpDownConnection, bool, error)
 		return nil, false, err
 	}
 
+	down.trace = newConnTrace(c.trace, "down", id)
+
 	down.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		sendICE(c, down.id, candidate)
 	})
 
+	down.pc.OnICEGatheringStateChange(down.trace.gatheringState)
+
 	down.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		down.trace.iceState(state)
 		if state == webrtc.ICEConnectionStateFailed {
 			c.action(connectionFailedAction{id: down.id})
 		}
@@ -304,12 +389,22 @@ func addDownConn(c *webClient, remote conn.Up) (*rtpDownConnection, bool, error)
 	err = remote.AddLocal(down)
 	if err != nil {
 		down.pc.Close()
+		down.trace.close()
 		return nil, false, err
 	}
 
+	down.queue.onCongestion = func() {
+		c.action(congestionAction{id: down.id})
+	}
+
 	c.down[down.id] = down
 
-	go rtcpDownSender(down)
+	rtcpWheel.schedule(time.Second/2, func() bool {
+		return rtcpDownSender(down)
+	})
+	rtcpWheel.schedule(probeInterval, func() bool {
+		return startProbe(down)
+	})
 
 	return down, true, nil
 }
@@ -318,6 +413,8 @@ func delDownConn(c *webClient, id string) error {
 	conn := delDownConnHelper(c, id)
 	if conn != nil {
 		conn.pc.Close()
+		conn.queue.close()
+		conn.trace.close()
 		return nil
 	}
 	return os.ErrNotExist
@@ -339,7 +436,7 @@ func delDownConnHelper(c *webClient, id string) *rtpDownConnection {
 	for _, track := range conn.tracks {
 		// we only insert the track after we get an answer, so
 		// ignore errors here.
-		track.remote.DelLocal(track)
+		track.detach()
 	}
 	delete(c.down, id)
 	return conn
@@ -349,7 +446,7 @@ var errUnexpectedTrackType = errors.New("unexpected track type, this shouldn't h
 
 func addDownTrackUnlocked(conn *rtpDownConnection, remoteTrack *rtpUpTrack) error {
 	for _, t := range conn.tracks {
-		tt, ok := t.remote.(*rtpUpTrack)
+		tt, ok := t.getTarget().(*rtpUpTrack)
 		if !ok {
 			return errUnexpectedTrackType
 		}
@@ -360,7 +457,7 @@ func addDownTrackUnlocked(conn *rtpDownConnection, remoteTrack *rtpUpTrack) erro
 
 	id := remoteTrack.track.ID()
 	if id == "" {
-		log.Println("Got track with empty id")
+		conn.log.Warnf("Got track with empty id")
 		id = remoteTrack.track.RID()
 	}
 	if id == "" {
@@ -368,7 +465,7 @@ func addDownTrackUnlocked(conn *rtpDownConnection, remoteTrack *rtpUpTrack) erro
 	}
 	msid := remoteTrack.track.StreamID()
 	if msid == "" || msid == "-" {
-		log.Println("Got track with empty msid")
+		conn.log.Warnf("Got track with empty msid")
 		msid = remoteTrack.conn.Label()
 	}
 	if msid == "" {
@@ -382,7 +479,18 @@ func addDownTrackUnlocked(conn *rtpDownConnection, remoteTrack *rtpUpTrack) erro
 		return err
 	}
 
-	transceiver, err := conn.pc.AddTransceiverFromTrack(local,
+	var rtx *rtxTrack
+	var red *redTrack
+	var trackLocal webrtc.TrackLocal = local
+	if local.Kind() == webrtc.RTPCodecTypeVideo {
+		rtx = newRTXTrack(local)
+		trackLocal = rtx
+	} else if strings.EqualFold(local.Codec().MimeType, "audio/red") {
+		red = newREDTrack(local)
+		trackLocal = red
+	}
+
+	transceiver, err := conn.pc.AddTransceiverFromTrack(trackLocal,
 		webrtc.RTPTransceiverInit{
 			Direction: webrtc.RTPTransceiverDirectionSendonly,
 		},
@@ -394,19 +502,37 @@ func addDownTrackUnlocked(conn *rtpDownConnection, remoteTrack *rtpUpTrack) erro
 	codec := local.Codec()
 	ptype, err := group.CodecPayloadType(local.Codec())
 	if err != nil {
-		log.Printf("Couldn't determine ptype for codec %v: %v",
+		conn.log.Warnf("Couldn't determine ptype for codec %v: %v",
 			codec.MimeType, err)
 	} else {
-		err := transceiver.SetCodecPreferences(
-			[]webrtc.RTPCodecParameters{
-				{
-					RTPCodecCapability: codec,
-					PayloadType:        ptype,
-				},
+		// ask the receiver for transport-wide feedback, even if
+		// the sender didn't negotiate it
+		if !hasFeedback(codec.RTCPFeedback, "transport-cc") {
+			fb := make([]webrtc.RTCPFeedback, 0,
+				len(codec.RTCPFeedback)+1)
+			fb = append(fb, codec.RTCPFeedback...)
+			fb = append(fb,
+				webrtc.RTCPFeedback{Type: "transport-cc"},
+			)
+			codec.RTCPFeedback = fb
+		}
+		codecs := []webrtc.RTPCodecParameters{
+			{
+				RTPCodecCapability: codec,
+				PayloadType:        ptype,
 			},
-		)
+		}
+		if rtx != nil {
+			codecs = append(codecs, group.RTXCodec(ptype))
+		}
+		if red != nil {
+			// let receivers that don't do RED fall back to
+			// the primary encoding
+			codecs = append(codecs, group.REDPrimaryCodec())
+		}
+		err := transceiver.SetCodecPreferences(codecs)
 		if err != nil {
-			log.Printf("Couldn't set ptype for codec %v: %v",
+			conn.log.Warnf("Couldn't set ptype for codec %v: %v",
 				codec.MimeType, err)
 		}
 	}
@@ -418,16 +544,22 @@ func addDownTrackUnlocked(conn *rtpDownConnection, remoteTrack *rtpUpTrack) erro
 
 	track := &rtpDownTrack{
 		track:          local,
+		rtx:            rtx,
+		red:            red,
 		sender:         transceiver.Sender(),
 		ssrc:           parms.Encodings[0].SSRC,
 		conn:           conn,
-		remote:         remoteTrack,
 		maxBitrate:     new(bitrate),
 		maxREMBBitrate: new(bitrate),
+		maxTWCCBitrate: new(bitrate),
 		stats:          new(receiverStats),
 		rate:           estimator.New(time.Second),
 		atomics:        &downTrackAtomics{},
 	}
+	track.setRemote(remoteTrack)
+	if conn.impairment != nil {
+		track.impair = newImpairer(conn.impairment)
+	}
 
 	conn.tracks = append(conn.tracks, track)
 
@@ -439,7 +571,7 @@ func addDownTrackUnlocked(conn *rtpDownConnection, remoteTrack *rtpUpTrack) erro
 func delDownTrackUnlocked(conn *rtpDownConnection, track *rtpDownTrack) error {
 	for i := range conn.tracks {
 		if conn.tracks[i] == track {
-			track.remote.DelLocal(track)
+			track.detach()
 			conn.tracks =
 				append(conn.tracks[:i], conn.tracks[i+1:]...)
 			return conn.pc.RemoveTrack(track.sender)
@@ -462,7 +594,7 @@ outer:
 			return false, errUnexpectedTrackType
 		}
 		for _, track := range conn.tracks {
-			rt2, ok := track.remote.(*rtpUpTrack)
+			rt2, ok := track.getTarget().(*rtpUpTrack)
 			if !ok {
 				return false, errUnexpectedTrackType
 			}
@@ -475,7 +607,7 @@ outer:
 
 outer2:
 	for _, track := range conn.tracks {
-		rt, ok := track.remote.(*rtpUpTrack)
+		rt, ok := track.getTarget().(*rtpUpTrack)
 		if !ok {
 			return false, errUnexpectedTrackType
 		}
@@ -523,7 +655,7 @@ outer2:
 	return true, nil
 }
 
-func negotiate(c *webClient, down *rtpDownConnection, restartIce bool, replace string) error {
+func negotiate(c *webClient, down *rtpDownConnection, restartIce bool, replace string) (err error) {
 	if down.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
 		// avoid sending multiple offers back-to-back
 		if restartIce {
@@ -536,6 +668,14 @@ func negotiate(c *webClient, down *rtpDownConnection, restartIce bool, replace s
 
 	down.negotiationNeeded = negotiationUnneeded
 
+	// the negotiation ends when we get an answer
+	down.trace.startNegotiation()
+	defer func() {
+		if err != nil {
+			down.trace.endNegotiation(err)
+		}
+	}()
+
 	options := webrtc.OfferOptions{ICERestart: restartIce}
 	offer, err := down.pc.CreateOffer(&options)
 	if err != nil {
@@ -547,6 +687,22 @@ func negotiate(c *webClient, down *rtpDownConnection, restartIce bool, replace s
 		return err
 	}
 
+	local, err := rtxSDP(
+		down.pc.LocalDescription().SDP, down.getTracks(),
+	)
+	if err != nil {
+		down.log.Warnf("RTX: %v", err)
+		local = down.pc.LocalDescription().SDP
+	}
+	if c.group.Description().MusicMode {
+		s, err := musicSDP(local)
+		if err != nil {
+			down.log.Warnf("Music mode: %v", err)
+		} else {
+			local = s
+		}
+	}
+
 	source, username := down.remote.User()
 
 	return c.write(clientMessage{
@@ -556,7 +712,9 @@ func negotiate(c *webClient, down *rtpDownConnection, restartIce bool, replace s
 		Replace:  replace,
 		Source:   source,
 		Username: &username,
-		SDP:      down.pc.LocalDescription().SDP,
+		Remote:   isRemote(down.remote),
+		Paused:   down.videoPaused,
+		SDP:      local,
 	})
 }
 
@@ -572,12 +730,17 @@ func sendICE(c *webClient, id string, candidate *webrtc.ICECandidate) error {
 	})
 }
 
-func gotOffer(c *webClient, id, label string, sdp string, replace string) error {
+func gotOffer(c *webClient, id, label string, sdp string, replace string) (err error) {
 	up, _, err := addUpConn(c, id, label, sdp)
 	if err != nil {
 		return err
 	}
 
+	up.trace.startNegotiation()
+	defer func() {
+		up.trace.endNegotiation(err)
+	}()
+
 	if replace != "" {
 		up.replace = replace
 		delUpConn(c, replace, c.Id(), false)
@@ -603,25 +766,39 @@ func gotOffer(c *webClient, id, label string, sdp string, replace string) error
 
 	err = up.flushICECandidates()
 	if err != nil {
-		log.Printf("ICE: %v", err)
+		up.log.Warnf("ICE: %v", err)
+	}
+
+	local := up.pc.LocalDescription().SDP
+	if c.group.Description().MusicMode {
+		s, err := musicSDP(local)
+		if err != nil {
+			up.log.Warnf("Music mode: %v", err)
+		} else {
+			local = s
+		}
 	}
 
 	return c.write(clientMessage{
 		Type: "answer",
 		Id:   id,
-		SDP:  up.pc.LocalDescription().SDP,
+		SDP:  local,
 	})
 }
 
 var ErrUnknownId = errors.New("unknown id")
 
-func gotAnswer(c *webClient, id string, sdp string) error {
+func gotAnswer(c *webClient, id string, sdp string) (err error) {
 	down := getDownConn(c, id)
 	if down == nil {
 		return ErrUnknownId
 	}
 
-	err := down.pc.SetRemoteDescription(webrtc.SessionDescription{
+	defer func() {
+		down.trace.endNegotiation(err)
+	}()
+
+	err = down.pc.SetRemoteDescription(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeAnswer,
 		SDP:  sdp,
 	})
@@ -629,17 +806,19 @@ func gotAnswer(c *webClient, id string, sdp string) error {
 		return err
 	}
 
+	down.setTWCC()
+
 	err = down.flushICECandidates()
 	if err != nil {
-		log.Printf("ICE: %v", err)
+		down.log.Warnf("ICE: %v", err)
 	}
 
 	add := func() {
 		down.pc.OnConnectionStateChange(nil)
 		for _, t := range down.tracks {
-			err := t.remote.AddLocal(t)
+			err := t.getRemote().AddLocal(t)
 			if err != nil && err != os.ErrClosed {
-				log.Printf("Add track: %v", err)
+				down.log.Warnf("Add track: %v", err)
 			}
 		}
 	}
@@ -729,19 +908,359 @@ func (c *webClient) setRequestedStream(down *rtpDownConnection, requested []stri
 	return remoteClient.RequestConns(c, c.group, remote.id)
 }
 
+// A trackRequest is a receiver's request for a single track.
+type trackRequest struct {
+	// don't send this track at all
+	off bool
+	// the highest spatial and temporal layers wanted, -1 if unlimited
+	sid, tid int
+	// the size at which the receiver renders the track, 0 if unknown
+	width, height int
+}
+
+func parseTrackRequest(r interface{}) (trackRequest, error) {
+	req := trackRequest{sid: -1, tid: -1}
+	if r == nil {
+		return req, nil
+	}
+	rr, ok := r.(map[string]interface{})
+	if !ok {
+		return req, errBadType
+	}
+	layer := func(v interface{}) (int, error) {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f >= noLayerLimit || f != float64(int(f)) {
+			return 0, errBadType
+		}
+		return int(f), nil
+	}
+	size := func(v interface{}) (int, error) {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f > 0xFFFF {
+			return 0, errBadType
+		}
+		return int(f), nil
+	}
+	for k, v := range rr {
+		var err error
+		switch k {
+		case "off":
+			req.off, ok = v.(bool)
+			if !ok {
+				err = errBadType
+			}
+		case "spatial":
+			req.sid, err = layer(v)
+		case "temporal":
+			req.tid, err = layer(v)
+		case "width":
+			req.width, err = size(v)
+		case "height":
+			req.height, err = size(v)
+		default:
+			err = errors.New("unknown field " + k)
+		}
+		if err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// applyTrackRequests sets the layer limits of the tracks of down.
+func applyTrackRequests(down *rtpDownConnection) {
+	for _, t := range down.getTracks() {
+		req, ok := down.trackRequests[t.track.Kind()]
+		if !ok {
+			req = trackRequest{sid: -1, tid: -1}
+		}
+		t.setLayerLimit(req.sid, req.tid)
+		t.setRenderSize(req.width, req.height)
+		t.adjustLayer()
+	}
+}
+
+// withoutRequestedOff returns the tracks that the receiver has not
+// switched off.
+func withoutRequestedOff(tracks []conn.UpTrack, requests map[webrtc.RTPCodecType]trackRequest) []conn.UpTrack {
+	if len(requests) == 0 {
+		return tracks
+	}
+	var ts []conn.UpTrack
+	for _, t := range tracks {
+		if !requests[t.Kind()].off {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+func (c *webClient) setRequestedTrack(down *rtpDownConnection, mid string, req trackRequest) error {
+	var kind webrtc.RTPCodecType
+	for _, t := range down.pc.GetTransceivers() {
+		if t.Mid() == mid {
+			kind = t.Kind()
+			break
+		}
+	}
+	if kind == 0 {
+		// the track may have been removed concurrently
+		down.log.Warnf("Track request for unknown mid %v", mid)
+		return nil
+	}
+
+	if down.trackRequests == nil {
+		down.trackRequests =
+			make(map[webrtc.RTPCodecType]trackRequest)
+	}
+	down.trackRequests[kind] = req
+	applyTrackRequests(down)
+
+	remote, ok := down.remote.(*rtpUpConnection)
+	if !ok {
+		return nil
+	}
+	return remote.client.RequestConns(c, c.group, remote.id)
+}
+
 func (c *webClient) RequestConns(target group.Client, g *group.Group, id string) error {
 	c.action(requestConnsAction{g, target, id})
 	return nil
 }
 
 func requestConns(target group.Client, g *group.Group, id string) {
-	clients := g.GetClients(target)
+	// the peer relation is symmetric
+	clients := mediaReceivers(g, target)
 	for _, c := range clients {
 		c.RequestConns(target, g, id)
 	}
 }
 
-func requestedTracks(c *webClient, requested []string, tracks []conn.UpTrack) ([]conn.UpTrack, bool) {
+// simulcastProbe is the time after which we try the high layer of a
+// simulcast stream again.  The loss-based estimator cannot tell whether
+// the receiver could sustain a higher rate than the one it receives.
+const simulcastProbe = 30 * time.Second
+
+// adjustSimulcast switches the down connections that carry simulcast
+// video between the high and the low layer, depending on the bandwidth
+// available to the receiver.  Called periodically by the client loop.
+func adjustSimulcast(c *webClient) {
+	c.mu.Lock()
+	downs := make([]*rtpDownConnection, 0, len(c.down))
+	for _, down := range c.down {
+		downs = append(downs, down)
+	}
+	c.mu.Unlock()
+
+	now := time.Now()
+	jiffies := rtptime.Jiffies()
+	for _, down := range downs {
+		up, ok := down.remote.(*rtpUpConnection)
+		if !ok {
+			continue
+		}
+		if !member("video", getRequested(c, down, up)) {
+			continue
+		}
+		var video []*rtpUpTrack
+		for _, t := range up.getTracks() {
+			if t.Kind() == webrtc.RTPCodecTypeVideo {
+				video = append(video, t)
+			}
+		}
+		if len(video) < 2 {
+			continue
+		}
+		var track *rtpDownTrack
+		for _, t := range down.getTracks() {
+			target := t.getTarget()
+			if target == conn.UpTrack(video[0]) ||
+				target == conn.UpTrack(video[len(video)-1]) {
+				track = t
+			}
+		}
+		if track == nil {
+			continue
+		}
+
+		max := track.feedbackBitrate(jiffies)
+		if max == ^uint64(0) {
+			// no feedback from the receiver
+			continue
+		}
+		r, _ := video[0].rate.Estimate()
+		rate := uint64(r) * 8
+		loss, _ := track.stats.Get(jiffies)
+
+		low := down.simulcastLow
+		if !low && rate > max*3/2 {
+			low = true
+		} else if low && (rate < max*7/8 ||
+			(loss < 5 && now.Sub(down.simulcastSwitch) > simulcastProbe)) {
+			low = false
+		}
+		if low == down.simulcastLow {
+			continue
+		}
+		down.simulcastLow = low
+		down.simulcastSwitch = now
+
+		tracks := make([]conn.UpTrack, len(video))
+		for i, t := range video {
+			tracks[i] = t
+		}
+		next := video[0]
+		if useLow(down, tracks) {
+			next = video[len(video)-1]
+		}
+		if track.getTarget() == conn.UpTrack(next) {
+			continue
+		}
+		err := track.switchRemote(next)
+		if err != nil {
+			c.log().Warnf("Switch simulcast layer: %v", err)
+			up.client.RequestConns(c, c.group, up.id)
+		}
+	}
+}
+
+// videoProbe is the time after which we try to resume video that was
+// paused for lack of bandwidth.
+const videoProbe = 30 * time.Second
+
+// importance returns a value used for choosing which video to pause
+// first.  Screen shares are the most important, then streams with the
+// most audio, which are likely to be the current speakers.
+func importance(up *rtpUpConnection) uint64 {
+	if up.Label() == "screenshare" {
+		return ^uint64(0)
+	}
+	var rate uint64
+	for _, t := range up.getTracks() {
+		if t.Kind() == webrtc.RTPCodecTypeAudio {
+			r, _ := t.rate.Estimate()
+			rate += uint64(r)
+		}
+	}
+	return rate
+}
+
+// adjustVideo pauses the video of the least important stream when the
+// receiver is congested even though all of the video it receives is at
+// the lowest quality, and resumes it when the congestion is gone.
+// Called periodically by the client loop, after adjustSimulcast.
+func adjustVideo(c *webClient) {
+	c.mu.Lock()
+	downs := make([]*rtpDownConnection, 0, len(c.down))
+	for _, down := range c.down {
+		downs = append(downs, down)
+	}
+	c.mu.Unlock()
+
+	now := time.Now()
+	jiffies := rtptime.Jiffies()
+	congested := false
+	var pause, resume *rtpDownConnection
+	var pauseImportance, resumeImportance uint64
+	for _, down := range downs {
+		up, ok := down.remote.(*rtpUpConnection)
+		if !ok {
+			continue
+		}
+		if down.videoPaused {
+			i := importance(up)
+			if resume == nil || i > resumeImportance {
+				resume = down
+				resumeImportance = i
+			}
+			continue
+		}
+
+		var video *rtpDownTrack
+		audio := false
+		for _, t := range down.getTracks() {
+			if t.getRemote().Kind() == webrtc.RTPCodecTypeVideo {
+				video = t
+			} else {
+				audio = true
+			}
+		}
+		if video == nil {
+			continue
+		}
+
+		simulcast := 0
+		for _, t := range up.getTracks() {
+			if t.Kind() == webrtc.RTPCodecTypeVideo {
+				simulcast++
+			}
+		}
+		max := video.feedbackBitrate(jiffies)
+		r, _ := video.rate.Estimate()
+		layer := video.getLayerInfo()
+		lowest := layer.sid == 0 && layer.tid == 0 &&
+			(down.simulcastLow || simulcast < 2)
+		if max != ^uint64(0) && lowest && 8*uint64(r) > max*3/2 {
+			congested = true
+		}
+
+		// never pause a stream that would be left empty
+		if audio {
+			i := importance(up)
+			if pause == nil || i < pauseImportance {
+				pause = down
+				pauseImportance = i
+			}
+		}
+	}
+
+	var down *rtpDownConnection
+	if congested && pause != nil {
+		down = pause
+		down.videoPaused = true
+	} else if !congested && resume != nil &&
+		now.Sub(c.videoSwitch) > videoProbe {
+		down = resume
+		down.videoPaused = false
+	}
+	if down == nil {
+		return
+	}
+	c.videoSwitch = now
+	up := down.remote.(*rtpUpConnection)
+	up.client.RequestConns(c, c.group, up.id)
+}
+
+// useLow returns true if the low layer of a simulcast stream should be
+// forwarded on down, which may be nil.  Besides bandwidth, a request for
+// the lowest layer, or for a size that the low simulcast track can
+// satisfy, selects the low track.
+func useLow(down *rtpDownConnection, tracks []conn.UpTrack) bool {
+	if down == nil {
+		return false
+	}
+	video, ok := down.trackRequests[webrtc.RTPCodecTypeVideo]
+	return down.simulcastLow || (ok && video.sid == 0) ||
+		simulcastLowFits(tracks, video)
+}
+
+// getRequested returns the tracks requested by the client for a given
+// up connection.  The down connection may be nil.
+func getRequested(c *webClient, down *rtpDownConnection, up conn.Up) []string {
+	if down != nil && down.requested != nil {
+		return down.requested
+	}
+	req, ok := c.requested[up.Label()]
+	if !ok {
+		req = c.requested[""]
+	}
+	return req
+}
+
+// requestedTracks returns the tracks that match a request.  If low is
+// true, the low layer of a simulcast stream is selected even if the
+// client asked for the high layer.
+func requestedTracks(c *webClient, requested []string, tracks []conn.UpTrack, low bool) ([]conn.UpTrack, bool) {
 	if len(requested) == 0 {
 		return nil, false
 	}
@@ -755,7 +1274,7 @@ func requestedTracks(c *webClient, requested []string, tracks []conn.UpTrack) ([
 		case "video-low":
 			videoLow = true
 		default:
-			log.Printf("client requested unknown value %v", s)
+			c.log().Warnf("client requested unknown value %v", s)
 		}
 	}
 
@@ -784,7 +1303,7 @@ func requestedTracks(c *webClient, requested []string, tracks []conn.UpTrack) ([
 		}
 	}
 	if video {
-		t, _ := find(webrtc.RTPCodecTypeVideo, false)
+		t, _ := find(webrtc.RTPCodecTypeVideo, low)
 		if t != nil {
 			ts = append(ts, t)
 		}
@@ -801,28 +1320,209 @@ func requestedTracks(c *webClient, requested []string, tracks []conn.UpTrack) ([
 	return ts, limitSid
 }
 
+// lastNHold is the minimum time during which a client remains in the
+// last-N of another client, so that video doesn't flap between speakers.
+const lastNHold = 5 * time.Second
+
+// inLastN returns true if the video of up should be forwarded to c.
+// Screen shares and streams from other servers are always forwarded.
+func (c *webClient) inLastN(up conn.Up) bool {
+	if c.lastN == nil || up.Label() == "screenshare" || isRemote(up) {
+		return true
+	}
+	id, _ := up.User()
+	_, ok := c.lastN[id]
+	return ok
+}
+
+// nextLastN computes the set of clients whose video is forwarded, given
+// the current set, the candidates ordered by most recent speech, and the
+// size of the set.  A client that entered the set less than lastNHold
+// ago is not replaced; in that case, nextLastN returns how long to wait
+// before trying again.
+func nextLastN(current map[string]time.Time, candidates []string, n int, now time.Time) (map[string]time.Time, time.Duration) {
+	rank := make(map[string]int, len(candidates))
+	for i, id := range candidates {
+		rank[id] = i
+	}
+
+	next := make(map[string]time.Time, n)
+	for id, t := range current {
+		if _, ok := rank[id]; ok {
+			next[id] = t
+		}
+	}
+	// the size of the set was reduced
+	for len(next) > n {
+		var last string
+		for id := range next {
+			if last == "" || rank[id] > rank[last] {
+				last = id
+			}
+		}
+		delete(next, last)
+	}
+
+	var retry time.Duration
+	for i, id := range candidates {
+		if _, ok := next[id]; ok {
+			continue
+		}
+		if len(next) < n {
+			next[id] = now
+			continue
+		}
+		// replace the least recent speaker that was held long enough
+		var victim string
+		for v, t := range next {
+			if rank[v] <= i {
+				continue
+			}
+			if wait := lastNHold - now.Sub(t); wait > 0 {
+				if retry == 0 || wait < retry {
+					retry = wait
+				}
+				continue
+			}
+			if victim == "" || rank[v] > rank[victim] {
+				victim = v
+			}
+		}
+		if victim == "" {
+			break
+		}
+		delete(next, victim)
+		next[id] = now
+	}
+	return next, retry
+}
+
+// updateLastN recomputes the set of clients whose video is forwarded to
+// c, and pauses or resumes the video of the clients that left or entered
+// the set.  Called by the client loop whenever the speakers or the
+// members of the group change.
+func updateLastN(c *webClient) {
+	if c.group == nil {
+		return
+	}
+	n := c.group.Description().LastN
+	if n <= 0 {
+		c.lastNEnabled.Store(false)
+		if c.lastN != nil {
+			c.lastN = nil
+			applyLastN(c)
+		}
+		return
+	}
+	c.lastNEnabled.Store(true)
+
+	candidates := c.group.RecentSpeakers(c, c.group.ClientCount())
+	next, retry := nextLastN(c.lastN, candidates, n, time.Now())
+	changed := c.lastN == nil || len(next) != len(c.lastN)
+	for id := range next {
+		if _, ok := c.lastN[id]; !ok {
+			changed = true
+		}
+	}
+	c.lastN = next
+	if changed {
+		applyLastN(c)
+	}
+	if retry > 0 && !c.lastNTimer {
+		c.lastNTimer = true
+		time.AfterFunc(retry, func() {
+			c.action(lastNAction{})
+		})
+	}
+}
+
+// applyLastN pauses or resumes the video sent to c according to last-N.
+// Video is paused rather than removed, so that it can be resumed without
+// renegotiation.
+func applyLastN(c *webClient) {
+	c.mu.Lock()
+	downs := make([]*rtpDownConnection, 0, len(c.down))
+	for _, down := range c.down {
+		downs = append(downs, down)
+	}
+	c.mu.Unlock()
+
+	for _, down := range downs {
+		applyLastNConn(c, down)
+	}
+}
+
+func applyLastNConn(c *webClient, down *rtpDownConnection) {
+	in := c.inLastN(down.remote)
+	for _, t := range down.getTracks() {
+		if t.getTarget().Kind() == webrtc.RTPCodecTypeVideo {
+			t.setPaused(!in)
+		}
+	}
+}
+
+// withoutVideo returns the audio tracks in tracks.
+func withoutVideo(tracks []conn.UpTrack) []conn.UpTrack {
+	var ts []conn.UpTrack
+	for _, t := range tracks {
+		if t.Kind() != webrtc.RTPCodecTypeVideo {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
 func (c *webClient) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
 	c.action(pushConnAction{g, id, up, tracks, replace})
 	return nil
 }
 
-func readMessage(conn *websocket.Conn, m *clientMessage) error {
+// A ClientConn carries the messages exchanged with a client.  It is
+// implemented by *websocket.Conn, and by the web server's WebTransport
+// sessions, which use the WebSocket message types and close codes.
+type ClientConn interface {
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteJSON(v interface{}) error
+	Close() error
+}
+
+func readMessage(conn ClientConn, m *clientMessage) error {
 	err := conn.SetReadDeadline(time.Now().Add(15 * time.Second))
 	if err != nil {
 		return err
 	}
 	defer conn.SetReadDeadline(time.Time{})
 
-	return conn.ReadJSON(&m)
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	*m, err = decodeMessage(data)
+	return err
 }
 
 const protocolVersion = "2"
 
-func StartClient(conn *websocket.Conn) (err error) {
+func StartClient(conn ClientConn) (err error) {
 	var m clientMessage
 
+	conn.SetReadLimit(maxMessageSize)
+
 	err = readMessage(conn, &m)
 	if err != nil {
+		var verr *validationError
+		if errors.As(err, &verr) {
+			conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(
+					websocket.CloseProtocolError,
+					verr.Error(),
+				),
+			)
+		}
 		conn.Close()
 		return
 	}
@@ -849,13 +1549,19 @@ func StartClient(conn *websocket.Conn) (err error) {
 	}
 
 	c := &webClient{
-		id:      m.Id,
-		actions: unbounded.New[any](),
-		done:    make(chan struct{}),
+		id:        m.Id,
+		actions:   unbounded.New[any](),
+		done:      make(chan struct{}),
+		userBatch: member("user-batch", m.Features),
+		speaking:  member("speaking", m.Features),
 	}
 
 	defer close(c.done)
 
+	c.trace = tracing.Start(nil, "session")
+	c.trace.SetAttribute("client", c.id)
+	defer c.trace.End()
+
 	c.writeCh = make(chan interface{}, 100)
 	c.writerDone = make(chan struct{})
 	go clientWriter(conn, c.writeCh, c.writerDone)
@@ -893,13 +1599,22 @@ type connectionFailedAction struct {
 	id string
 }
 
+type congestionAction struct {
+	id string
+}
+
 type pushClientAction struct {
-	group       string
-	kind        string
-	id          string
-	username    string
-	permissions []string
-	data        map[string]interface{}
+	update *group.ClientUpdate
+}
+
+type flushUsersAction struct{}
+
+type lastNAction struct{}
+
+type speakersAction struct {
+	group    string
+	active   string
+	speaking []string
 }
 
 type permissionsChangedAction struct{}
@@ -944,7 +1659,7 @@ func addnew(v string, l []string) []string {
 	return l
 }
 
-func clientLoop(c *webClient, ws *websocket.Conn, versionError bool) error {
+func clientLoop(c *webClient, ws ClientConn, versionError bool) error {
 	read := make(chan interface{}, 1)
 	go clientReader(ws, read, c.done)
 
@@ -988,21 +1703,26 @@ func clientLoop(c *webClient, ws *websocket.Conn, versionError bool) error {
 				if err != nil {
 					return err
 				}
+			case *validationError:
+				readTime = time.Now()
+				err := c.invalidMessage(m)
+				if err != nil {
+					return err
+				}
 			case error:
 				return m
 			}
 		case <-c.actions.Ch:
-			actions := c.actions.Get()
-			for _, a := range actions {
-				err := handleAction(c, a)
-				if err != nil {
-					return err
-				}
+			err := handleActions(c, c.actions.Get())
+			if err != nil {
+				return err
 			}
 		case <-ticker.C:
 			if time.Since(readTime) > 75*time.Second {
 				return errors.New("client is dead")
 			}
+			adjustSimulcast(c)
+			adjustVideo(c)
 			// Some reverse proxies timeout connexions at 60
 			// seconds, make sure we generate some activity
 			// after 55s at most.
@@ -1021,31 +1741,32 @@ func clientLoop(c *webClient, ws *websocket.Conn, versionError bool) error {
 func pushDownConn(c *webClient, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
 	var requested []conn.UpTrack
 	limitSid := false
+	paused := false
+	var trackRequests map[webrtc.RTPCodecType]trackRequest
 	if up != nil {
 		var old *rtpDownConnection
 		if replace != "" {
 			old = getDownConn(c, replace)
 		} else {
-			old = getDownConn(c, up.Id())
+			old = getDownConn(c, id)
 		}
-		var req []string
 		if old != nil {
-			req = old.requested
+			trackRequests = old.trackRequests
 		}
-		if req == nil {
-			var ok bool
-			req, ok = c.requested[up.Label()]
-			if !ok {
-				req = c.requested[""]
-			}
+		requested, limitSid = requestedTracks(
+			c, getRequested(c, old, up), tracks, useLow(old, tracks),
+		)
+		requested = withoutRequestedOff(requested, trackRequests)
+		paused = old != nil && old.videoPaused
+		if paused {
+			requested = withoutVideo(requested)
 		}
-		requested, limitSid = requestedTracks(c, req, tracks)
 	}
 
 	if replace != "" {
 		err := delDownConn(c, replace)
 		if err != nil {
-			log.Printf("Replace: %v", err)
+			c.log().Warnf("Replace: %v", err)
 		}
 	}
 
@@ -1061,20 +1782,26 @@ func pushDownConn(c *webClient, id string, up conn.Up, tracks []conn.UpTrack, re
 		return nil
 	}
 
-	down, _, err := addDownConn(c, up)
+	down, _, err := addDownConn(c, id, up)
 	if err != nil {
 		if errors.Is(err, os.ErrClosed) {
 			return nil
 		}
 		return err
 	}
+	down.videoPaused = paused
+	down.trackRequests = trackRequests
 	done, err := replaceTracks(down, requested, limitSid)
+	if err == nil {
+		applyTrackRequests(down)
+		applyLastNConn(c, down)
+	}
 	if err != nil || !done {
 		return err
 	}
 	err = negotiate(c, down, false, replace)
 	if err != nil {
-		log.Printf("Negotiation failed: %v", err)
+		c.log().Warnf("Negotiation failed: %v", err)
 		closeDownConn(c, down.id, err.Error())
 		return err
 	}
@@ -1082,18 +1809,137 @@ func pushDownConn(c *webClient, id string, up conn.Up, tracks []conn.UpTrack, re
 	return nil
 }
 
+// Clients that support the user-batch feature receive membership updates
+// in batches.  In groups larger than userBatchThreshold, batches are sent
+// at most once every userBatchInterval.
+const userBatchThreshold = 100
+const userBatchInterval = time.Second
+
+func userMessage(u *group.ClientUpdate) clientMessage {
+	username := u.Username
+	return clientMessage{
+		Type:        "user",
+		Kind:        u.Kind,
+		Id:          u.Id,
+		Username:    &username,
+		Permissions: u.Permissions,
+		Data:        u.Data,
+	}
+}
+
+func encodeUser(u *group.ClientUpdate) ([]byte, error) {
+	return json.Marshal(userMessage(u))
+}
+
+// queueUser adds an update to the pending batch, merging it with any
+// pending update for the same user.
+func (c *webClient) queueUser(u *group.ClientUpdate) {
+	if i, ok := c.pendingIndex[u.Id]; ok {
+		v := c.pendingUsers[i]
+		if v.Kind == "add" && u.Kind == "delete" {
+			// the client never knew about this user
+			c.pendingUsers[i] = nil
+			delete(c.pendingIndex, u.Id)
+			return
+		} else if v.Kind == "add" && u.Kind == "change" {
+			c.pendingUsers[i] = &group.ClientUpdate{
+				Group:       u.Group,
+				Kind:        "add",
+				Id:          u.Id,
+				Username:    u.Username,
+				Permissions: u.Permissions,
+				Data:        u.Data,
+			}
+			return
+		} else if v.Kind == "change" {
+			c.pendingUsers[i] = u
+			return
+		}
+	}
+	if c.pendingIndex == nil {
+		c.pendingIndex = make(map[string]int)
+	}
+	c.pendingIndex[u.Id] = len(c.pendingUsers)
+	c.pendingUsers = append(c.pendingUsers, u)
+}
+
+// flushUsers sends all pending user updates in a single message.
+func (c *webClient) flushUsers() error {
+	if len(c.pendingUsers) == 0 {
+		return nil
+	}
+	users := make([]clientMessage, 0, len(c.pendingUsers))
+	for _, u := range c.pendingUsers {
+		if u != nil {
+			users = append(users, userMessage(u))
+		}
+	}
+	c.pendingUsers = nil
+	c.pendingIndex = nil
+	c.lastUserBatch = time.Now()
+	if len(users) == 0 {
+		return nil
+	}
+	return c.write(clientMessage{
+		Type:  "user",
+		Kind:  "batch",
+		Value: users,
+	})
+}
+
+// handleActions handles a set of actions.  Pending user updates are
+// flushed before any other action, in order to preserve ordering, and at
+// the end unless they are being rate-limited.
+func handleActions(c *webClient, actions []any) error {
+	for _, a := range actions {
+		if _, ok := a.(pushClientAction); !ok {
+			err := c.flushUsers()
+			if err != nil {
+				return err
+			}
+		}
+		err := handleAction(c, a)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.pendingUsers) == 0 {
+		return nil
+	}
+	delay := userBatchInterval - time.Since(c.lastUserBatch)
+	if delay <= 0 || c.group == nil ||
+		c.group.ClientCount() <= userBatchThreshold {
+		return c.flushUsers()
+	}
+	if !c.userBatchTimer {
+		c.userBatchTimer = true
+		time.AfterFunc(delay, func() {
+			c.action(flushUsersAction{})
+		})
+	}
+	return nil
+}
+
 func handleAction(c *webClient, a any) error {
 	switch a := a.(type) {
 	case pushConnAction:
 		if c.group == nil || c.group != a.group {
-			log.Printf("Got connectsions for wrong group")
+			c.log().Warnf("Got connectsions for wrong group")
 			return nil
 		}
-		return pushDownConn(c, a.id, a.conn, a.tracks, a.replace)
+		id, replace := a.id, a.replace
+		if c.group.Description().Echo {
+			id = echoId(id)
+			if replace != "" {
+				replace = echoId(replace)
+			}
+		}
+		return pushDownConn(c, id, a.conn, a.tracks, replace)
 	case requestConnsAction:
 		g := c.group
 		if g == nil || a.group != g {
-			log.Printf("Misdirected pushConns")
+			c.log().Warnf("Misdirected pushConns")
 			return nil
 		}
 		for _, u := range c.up {
@@ -1109,9 +1955,19 @@ func handleAction(c *webClient, a any) error {
 			}
 			err := a.target.PushConn(g, u.id, u, ts, replace)
 			if err != nil {
-				log.Printf("PushConn: %v", err)
+				c.log().Warnf("PushConn: %v", err)
 			}
 		}
+	case congestionAction:
+		c.write(clientMessage{
+			Type:       "usermessage",
+			Kind:       "warning",
+			Dest:       c.id,
+			Privileged: true,
+			Error:      "congested",
+			Value: "Your connection is too slow, " +
+				"some media is being dropped",
+		})
 	case connectionFailedAction:
 		if down := getDownConn(c, a.id); down != nil {
 			err := negotiate(c, down, true, "")
@@ -1122,7 +1978,7 @@ func handleAction(c *webClient, a any) error {
 				[]conn.UpTrack, len(down.tracks),
 			)
 			for i, t := range down.tracks {
-				tracks[i] = t.remote
+				tracks[i] = t.getTarget()
 			}
 			c.PushConn(
 				c.group,
@@ -1135,35 +1991,53 @@ func handleAction(c *webClient, a any) error {
 				Id:   a.id,
 			})
 		} else {
-			log.Printf("Attempting to renegotiate " +
+			c.log().Warnf("Attempting to renegotiate " +
 				"unknown connection")
 		}
 
 	case pushClientAction:
-		if a.group != c.group.Name() {
-			log.Printf("got client for wrong group")
+		if a.update.Group != c.group.Name() {
+			c.log().Warnf("got client for wrong group")
 			return nil
 		}
-		perms := append([]string(nil), a.permissions...)
-		username := a.username
-		return c.write(clientMessage{
-			Type:        "user",
-			Kind:        a.kind,
-			Id:          a.id,
-			Username:    &username,
-			Permissions: perms,
-			Data:        a.data,
-		})
+		updateLastN(c)
+		if c.userBatch {
+			c.queueUser(a.update)
+			return nil
+		}
+		b, err := a.update.Encode(encodeUser)
+		if err != nil {
+			return err
+		}
+		return c.writeRaw(b)
+	case flushUsersAction:
+		c.userBatchTimer = false
+	case lastNAction:
+		c.lastNTimer = false
+		updateLastN(c)
+	case echoStatsAction:
+		c.echoTimer = false
+		if c.group == nil || c.group != a.group ||
+			!c.group.Description().Echo {
+			return nil
+		}
+		err := c.writeEchoStats()
+		if err != nil {
+			return err
+		}
+		c.scheduleEchoStats()
 	case joinedAction:
 		var status *group.Status
 		var data map[string]interface{}
 		var g *group.Group
+		conf := ice.ICEConfiguration()
 		if a.group != "" {
 			g = group.Get(a.group)
 			if g != nil {
 				s := g.Status(true, nil)
 				status = &s
 				data = g.Data()
+				conf = g.ICEConfiguration()
 			}
 		}
 		perms := append([]string(nil), c.permissions...)
@@ -1176,14 +2050,14 @@ func handleAction(c *webClient, a any) error {
 			Permissions:      perms,
 			Status:           status,
 			Data:             data,
-			RTCConfiguration: ice.ICEConfiguration(),
+			RTCConfiguration: conf,
 		})
 		if err != nil {
 			return err
 		}
 		if a.kind == "join" {
 			if g == nil {
-				log.Println("g is null when joining" +
+				c.log().Warnf("g is null when joining" +
 					"this shouldn't happen")
 				return nil
 			}
@@ -1217,7 +2091,7 @@ func handleAction(c *webClient, a any) error {
 			Username:         &username,
 			Permissions:      perms,
 			Status:           &status,
-			RTCConfiguration: ice.ICEConfiguration(),
+			RTCConfiguration: g.ICEConfiguration(),
 		})
 		if !member("present", c.permissions) {
 			up := getUpConns(c)
@@ -1236,20 +2110,34 @@ func handleAction(c *webClient, a any) error {
 		id := c.Id()
 		user := c.Username()
 		d := c.Data()
-		clients := g.GetClients(nil)
-		go func(clients []group.Client) {
-			for _, cc := range clients {
-				cc.PushClient(
-					g.Name(), "change", id, user, perms, d,
-				)
-			}
-		}(clients)
+		clients := append(g.Peers(c), c)
+		go group.PushClientUpdate(clients, &group.ClientUpdate{
+			Group:       g.Name(),
+			Kind:        "change",
+			Id:          id,
+			Username:    user,
+			Permissions: perms,
+			Data:        d,
+		})
+	case speakersAction:
+		if c.group == nil || a.group != c.group.Name() {
+			return nil
+		}
+		updateLastN(c)
+		if !c.speaking {
+			return nil
+		}
+		return c.write(clientMessage{
+			Type:   "speaking",
+			Source: a.active,
+			Value:  a.speaking,
+		})
 	case kickAction:
 		return group.KickError{
 			a.id, a.username, a.message,
 		}
 	default:
-		log.Printf("unexpected action %T", a)
+		c.log().Errorf("unexpected action %T", a)
 		return errors.New("unexpected action")
 	}
 	return nil
@@ -1290,17 +2178,24 @@ func leaveGroup(c *webClient) {
 		}
 	}
 
+	g := c.group
 	group.DelClient(c)
 	c.permissions = nil
 	c.data = nil
 	c.requested = make(map[string][]string)
+	c.lastN = nil
+	c.lastNEnabled.Store(false)
 	c.group = nil
+	UpdateCascade(g)
+	if UpdateCameras != nil {
+		UpdateCameras(g)
+	}
 }
 
 func closeDownConn(c *webClient, id string, message string) error {
 	err := delDownConn(c, id)
 	if err != nil && !os.IsNotExist(err) {
-		log.Printf("Close down connection: %v", err)
+		c.log().Warnf("Close down connection: %v", err)
 	}
 	err = c.write(clientMessage{
 		Type: "close",
@@ -1365,6 +2260,11 @@ func kickClient(g *group.Group, id string, user *string, dest string, message st
 		return group.UserError("no such user")
 	}
 
+	by := ""
+	if user != nil {
+		by = *user
+	}
+	notifyAction(g, "kick", by, dest, message)
 	return client.Kick(id, user, message)
 }
 
@@ -1402,7 +2302,22 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 				"cannot join multiple groups",
 			)
 		}
+		if owner := group.OwnerURL(m.Group); owner != "" {
+			// served by a different instance of the cluster
+			username := c.username
+			return c.write(clientMessage{
+				Type:     "joined",
+				Kind:     "redirect",
+				Group:    m.Group,
+				Username: &username,
+				Value:    owner,
+			})
+		}
+		span := tracing.Start(c.trace, "join")
+		span.SetAttribute("group", m.Group)
+		defer span.End()
 		c.data = m.Data
+		auth := tracing.Start(span, "auth")
 		g, err := group.AddClient(m.Group, c,
 			group.ClientCredentials{
 				Username: m.Username,
@@ -1410,7 +2325,10 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 				Token:    m.Token,
 			},
 		)
+		auth.Fail(err)
+		auth.End()
 		if err != nil {
+			span.Fail(err)
 			var e, s string
 			var autherr *group.NotAuthorisedError
 			if os.IsNotExist(err) {
@@ -1426,12 +2344,12 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			} else if errors.As(err, &autherr) {
 				s = "not authorised"
 				time.Sleep(200 * time.Millisecond)
-				log.Printf("Join group: %v", err)
+				c.log().Warnf("Join group: %v", err)
 			} else if _, ok := err.(group.UserError); ok {
 				s = err.Error()
 			} else {
 				s = "internal server error"
-				log.Printf("Join group: %v", err)
+				c.log().Warnf("Join group: %v", err)
 			}
 			username := c.username
 			return c.write(clientMessage{
@@ -1456,6 +2374,15 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			})
 		}
 		c.group = g
+		span.SetAttribute("username", c.username)
+		updateLastN(c)
+		if g.Description().Echo {
+			c.scheduleEchoStats()
+		}
+		UpdateCascade(g)
+		if UpdateCameras != nil {
+			UpdateCameras(g)
+		}
 	case "request":
 		requested, err := parseRequested(m.Request)
 		if err != nil {
@@ -1472,6 +2399,16 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			return err
 		}
 		c.setRequestedStream(down, requested)
+	case "requestTrack":
+		down := getDownConn(c, m.Id)
+		if down == nil {
+			return ErrUnknownId
+		}
+		req, err := parseTrackRequest(m.Request)
+		if err != nil {
+			return err
+		}
+		return c.setRequestedTrack(down, m.Mid, req)
 	case "offer":
 		if m.Id == "" {
 			return errEmptyId
@@ -1488,7 +2425,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		}
 		err := gotOffer(c, m.Id, m.Label, m.SDP, m.Replace)
 		if err != nil {
-			log.Printf("gotOffer: %v", err)
+			c.log().Warnf("gotOffer: %v", err)
 			return failUpConnection(c, m.Id, err.Error())
 		}
 	case "answer":
@@ -1497,7 +2434,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		}
 		err := gotAnswer(c, m.Id, m.SDP)
 		if err != nil {
-			log.Printf("gotAnswer: %v", err)
+			c.log().Warnf("gotAnswer: %v", err)
 			message := ""
 			if err != ErrUnknownId {
 				message = err.Error()
@@ -1529,7 +2466,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 				return closeDownConn(c, m.Id, err.Error())
 			}
 		} else {
-			log.Printf("Trying to renegotiate unknown connection")
+			c.log().Warnf("Trying to renegotiate unknown connection")
 		}
 	case "close":
 		if m.Id == "" {
@@ -1537,7 +2474,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		}
 		err := delUpConn(c, m.Id, c.id, true)
 		if err != nil {
-			log.Printf("Deleting up connection %v: %v",
+			c.log().Warnf("Deleting up connection %v: %v",
 				m.Id, err)
 			return nil
 		}
@@ -1555,7 +2492,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		}
 		err := gotICE(c, m.Candidate, m.Id)
 		if err != nil {
-			log.Printf("ICE: %v", err)
+			c.log().Warnf("ICE: %v", err)
 		}
 	case "chat", "usermessage":
 		g := c.group
@@ -1564,8 +2501,9 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		}
 
 		now := time.Now()
+		echo := g.Description().Echo
 
-		if m.Type == "chat" {
+		if m.Type == "chat" && !echo {
 			if m.Dest == "" {
 				g.AddToChatHistory(
 					m.Source, m.Username, now, m.Kind, m.Value,
@@ -1584,16 +2522,23 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			Value:      m.Value,
 		}
 		if m.Dest == "" {
-			var except group.Client
-			if m.NoEcho {
-				except = c
+			clients := g.Peers(c)
+			if !m.NoEcho {
+				clients = append(clients, c)
 			}
-			err := broadcast(g.GetClients(except), mm)
+			err := broadcast(clients, mm)
 			if err != nil {
-				log.Printf("broadcast(chat): %v", err)
+				c.log().Warnf("broadcast(chat): %v", err)
+			}
+			if m.Type == "chat" && !echo {
+				forwardChat(g, mm)
 			}
 		} else {
 			cc := g.GetClient(m.Dest)
+			if echo && cc != c {
+				// clients of an echo group don't see each other
+				cc = nil
+			}
 			if cc == nil {
 				return c.error(group.UserError("user unknown"))
 			}
@@ -1604,6 +2549,10 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 				))
 			}
 			ccc.write(mm)
+			if m.Type == "usermessage" && m.Kind == "mute" &&
+				mm.Privileged {
+				notifyAction(g, "mute", c.username, m.Dest, "")
+			}
 		}
 	case "groupaction":
 		g := c.group
@@ -1613,6 +2562,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		switch m.Kind {
 		case "clearchat":
 			g.ClearChatHistory()
+			g.Notify("clearchat", c.username, "")
 			m := clientMessage{
 				Type:       "usermessage",
 				Kind:       "clearchat",
@@ -1620,7 +2570,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			}
 			err := broadcast(g.GetClients(nil), m)
 			if err != nil {
-				log.Printf("broadcast(clearchat): %v", err)
+				c.log().Warnf("broadcast(clearchat): %v", err)
 			}
 		case "lock", "unlock":
 			if !member("op", c.permissions) {
@@ -1636,34 +2586,137 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			if !member("record", c.permissions) {
 				return c.error(group.UserError("not authorised"))
 			}
+			format, _ := m.Value.(string)
+			mixed := format == "mixed"
+			if mixed {
+				format = ""
+			}
+			err := StartRecording(g, mixed, format, c.username)
+			if err != nil {
+				return c.error(err)
+			}
+		case "unrecord":
+			if !member("record", c.permissions) {
+				return c.error(group.UserError("not authorised"))
+			}
+			StopRecording(g, c.username)
+		case "tap":
+			if !member("op", c.permissions) {
+				return c.error(group.UserError("not authorised"))
+			}
+			v, ok := m.Value.(map[string]interface{})
+			if !ok {
+				return c.error(group.UserError("bad value in tap"))
+			}
+			name, _ := v["name"].(string)
+			user, _ := v["user"].(string)
 			for _, cc := range g.GetClients(c) {
-				_, ok := cc.(*diskwriter.Client)
-				if ok {
-					return c.error(group.UserError("already recording"))
+				t, ok := cc.(*tap.Client)
+				if ok && t.Name() == name {
+					return c.error(group.UserError(
+						"tap " + name + " is already attached",
+					))
 				}
 			}
-			disk := diskwriter.New(g)
-			_, err := group.AddClient(g.Name(), disk,
+			t, err := tap.New(g, name, user)
+			if err != nil {
+				return c.error(group.UserError(err.Error()))
+			}
+			_, err = group.AddClient(g.Name(), t,
 				group.ClientCredentials{
 					System: true,
 				},
 			)
 			if err != nil {
-				disk.Close()
+				t.Close()
 				return c.error(err)
 			}
-			requestConns(disk, c.group, "")
-		case "unrecord":
-			if !member("record", c.permissions) {
+			requestConns(t, c.group, "")
+		case "untap":
+			if !member("op", c.permissions) {
 				return c.error(group.UserError("not authorised"))
 			}
+			name, _ := m.Value.(string)
 			for _, cc := range g.GetClients(c) {
-				disk, ok := cc.(*diskwriter.Client)
-				if ok {
-					disk.Close()
-					group.DelClient(disk)
+				t, ok := cc.(*tap.Client)
+				if ok && (name == "" || t.Name() == name) {
+					t.Close()
+					group.DelClient(t)
 				}
 			}
+		case "restream":
+			if !member("op", c.permissions) {
+				return c.error(group.UserError("not authorised"))
+			}
+			if NewRestreamer == nil {
+				return c.error(group.UserError(
+					"restreaming is not supported",
+				))
+			}
+			v, ok := m.Value.(map[string]interface{})
+			if !ok {
+				return c.error(group.UserError(
+					"bad value in restream",
+				))
+			}
+			name, _ := v["name"].(string)
+			user, _ := v["user"].(string)
+			for _, cc := range g.GetClients(c) {
+				r, ok := cc.(Restreamer)
+				if ok && r.RestreamName() == name {
+					return c.error(group.UserError(
+						"restream " + name + " is already running",
+					))
+				}
+			}
+			r, err := NewRestreamer(g, name, user)
+			if err != nil {
+				return c.error(group.UserError(err.Error()))
+			}
+			_, err = group.AddClient(g.Name(), r,
+				group.ClientCredentials{
+					System: true,
+				},
+			)
+			if err != nil {
+				r.Close()
+				return c.error(err)
+			}
+			requestConns(r, c.group, "")
+		case "unrestream":
+			if !member("op", c.permissions) {
+				return c.error(group.UserError("not authorised"))
+			}
+			name, _ := m.Value.(string)
+			for _, cc := range g.GetClients(c) {
+				r, ok := cc.(Restreamer)
+				if ok && (name == "" || r.RestreamName() == name) {
+					r.Close()
+					group.DelClient(r)
+				}
+			}
+		case "testsource":
+			if !member("op", c.permissions) {
+				return c.error(group.UserError("not authorised"))
+			}
+			if StartTestSource == nil {
+				return c.error(group.UserError(
+					"the test source is not supported",
+				))
+			}
+			err := StartTestSource(g)
+			if err != nil {
+				return c.error(group.UserError(err.Error()))
+			}
+		case "untestsource":
+			if !member("op", c.permissions) {
+				return c.error(group.UserError("not authorised"))
+			}
+			if StopTestSource == nil || !StopTestSource(g) {
+				return c.error(group.UserError(
+					"the test source is not running",
+				))
+			}
 		case "subgroups":
 			if !member("op", c.permissions) {
 				return c.error(group.UserError("not authorised"))
@@ -1846,6 +2899,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			if err != nil {
 				return c.error(err)
 			}
+			notifyAction(g, m.Kind, c.username, m.Dest, "")
 		case "kick":
 			if !member("op", c.permissions) {
 				return c.error(group.UserError("not authorised"))
@@ -1883,14 +2937,16 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			user := c.Username()
 			perms := c.Permissions()
 			data = c.Data()
-			go func(clients []group.Client) {
-				for _, cc := range clients {
-					cc.PushClient(
-						g.Name(), "change",
-						id, user, perms, data,
-					)
-				}
-			}(g.GetClients(nil))
+			go group.PushClientUpdate(
+				append(g.Peers(c), c), &group.ClientUpdate{
+					Group:       g.Name(),
+					Kind:        "change",
+					Id:          id,
+					Username:    user,
+					Permissions: perms,
+					Data:        data,
+				},
+			)
 		default:
 			return group.UserError("unknown user action")
 		}
@@ -1901,7 +2957,7 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			Type: "pong",
 		})
 	default:
-		log.Printf("unexpected message: %v", m.Type)
+		c.log().Warnf("unexpected message: %v", m.Type)
 		return group.ProtocolError("unexpected message")
 	}
 	return nil
@@ -2004,11 +3060,10 @@ func parseStatefulToken(value interface{}) (*token.Stateful, error) {
 	}, nil
 }
 
-func clientReader(conn *websocket.Conn, read chan<- interface{}, done <-chan struct{}) {
+func clientReader(conn ClientConn, read chan<- interface{}, done <-chan struct{}) {
 	defer close(read)
 	for {
-		var m clientMessage
-		err := conn.ReadJSON(&m)
+		_, data, err := conn.ReadMessage()
 		if err != nil {
 			select {
 			case read <- err:
@@ -2017,15 +3072,22 @@ func clientReader(conn *websocket.Conn, read chan<- interface{}, done <-chan str
 				return
 			}
 		}
+		var item interface{}
+		m, err := decodeMessage(data)
+		if err != nil {
+			item = err
+		} else {
+			item = m
+		}
 		select {
-		case read <- m:
+		case read <- item:
 		case <-done:
 			return
 		}
 	}
 }
 
-func clientWriter(conn *websocket.Conn, ch <-chan interface{}, done chan<- struct{}) {
+func clientWriter(conn ClientConn, ch <-chan interface{}, done chan<- struct{}) {
 	defer func() {
 		close(done)
 		conn.Close()
@@ -2062,7 +3124,7 @@ func clientWriter(conn *websocket.Conn, ch <-chan interface{}, done chan<- struc
 			}
 			return
 		default:
-			log.Printf("clientWriter: unexpected message %T", m)
+			logger.Errorf("clientWriter: unexpected message %T", m)
 			return
 		}
 	}
@@ -2097,6 +3159,16 @@ func (c *webClient) write(m clientMessage) error {
 	}
 }
 
+// writeRaw writes a message that has already been encoded.
+func (c *webClient) writeRaw(b []byte) error {
+	select {
+	case c.writeCh <- b:
+		return nil
+	case <-c.writerDone:
+		return ErrClientDead
+	}
+}
+
 func broadcast(cs []group.Client, m clientMessage) error {
 	b, err := json.Marshal(m)
 	if err != nil {
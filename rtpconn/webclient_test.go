@@ -1,11 +1,23 @@
 package rtpconn
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
 	"github.com/jech/galene/token"
+	"github.com/jech/galene/unbounded"
 )
 
 var tokens = []string{
@@ -50,3 +62,327 @@ func TestParseStatefulToken(t *testing.T) {
 		}
 	}
 }
+
+func TestQueueUser(t *testing.T) {
+	c := &webClient{}
+	update := func(kind, id string) *group.ClientUpdate {
+		return &group.ClientUpdate{Kind: kind, Id: id, Username: kind}
+	}
+	c.queueUser(update("add", "a"))
+	c.queueUser(update("add", "b"))
+	c.queueUser(update("change", "a"))
+	c.queueUser(update("delete", "b"))
+	c.queueUser(update("add", "c"))
+	c.queueUser(update("change", "c"))
+	c.queueUser(update("change", "c"))
+	c.queueUser(update("delete", "c"))
+	c.queueUser(update("delete", "d"))
+	c.queueUser(update("add", "d"))
+
+	var result []string
+	for _, u := range c.pendingUsers {
+		if u != nil {
+			result = append(result, u.Kind+" "+u.Id+" "+u.Username)
+		}
+	}
+	expected := []string{"add a change", "delete d delete", "add d add"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+// fakeClient is a webClient without a websocket.  It counts the
+// user additions and deletions it receives.
+type fakeClient struct {
+	c             *webClient
+	mu            sync.Mutex
+	cond          *sync.Cond
+	adds, deletes int
+}
+
+func newFakeClient(id string, g *group.Group) *fakeClient {
+	f := &fakeClient{
+		c: &webClient{
+			group:       g,
+			id:          id,
+			permissions: []string{"system"},
+			actions:     unbounded.New[any](),
+			done:        make(chan struct{}),
+			writeCh:     make(chan interface{}, 100),
+			writerDone:  make(chan struct{}),
+		},
+	}
+	f.cond = sync.NewCond(&f.mu)
+
+	go func() {
+		defer close(f.c.writerDone)
+		for {
+			var m interface{}
+			select {
+			case m = <-f.c.writeCh:
+			case <-f.c.done:
+				return
+			}
+			var b []byte
+			switch m := m.(type) {
+			case clientMessage:
+				b, _ = json.Marshal(m)
+			case []byte:
+				b = m
+			}
+			a := bytes.Count(b, []byte(`"kind":"add"`))
+			d := bytes.Count(b, []byte(`"kind":"delete"`))
+			f.mu.Lock()
+			f.adds += a
+			f.deletes += d
+			f.cond.Broadcast()
+			f.mu.Unlock()
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-f.c.actions.Ch:
+				handleActions(f.c, f.c.actions.Get())
+			case <-f.c.done:
+				return
+			}
+		}
+	}()
+	return f
+}
+
+func (f *fakeClient) wait(adds, deletes int) {
+	f.mu.Lock()
+	for f.adds < adds || f.deletes < deletes {
+		f.cond.Wait()
+	}
+	f.mu.Unlock()
+}
+
+func (f *fakeClient) close() {
+	close(f.c.done)
+}
+
+var benchmarkGroupCount int
+
+// benchmarkJoin measures the time needed for a client to join and leave
+// a large group.
+func benchmarkJoin(b *testing.B, batch bool) {
+	const n = 1000
+
+	benchmarkGroupCount++
+	name := fmt.Sprintf("bench%v", benchmarkGroupCount)
+	group.Directory = b.TempDir()
+	err := os.WriteFile(
+		filepath.Join(group.Directory, name+".json"),
+		[]byte("{}"), 0o600,
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	g, err := group.Add(name, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer group.Delete(name)
+
+	members := make([]*fakeClient, n)
+	for i := range members {
+		members[i] = newFakeClient(fmt.Sprintf("client%v", i), g)
+		defer members[i].close()
+		_, err := group.AddClient(
+			name, members[i].c, group.ClientCredentials{},
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, m := range members {
+		m.wait(n, 0)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		f := newFakeClient("newcomer", g)
+		f.c.userBatch = batch
+		_, err := group.AddClient(name, f.c, group.ClientCredentials{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.wait(n+1, 0)
+		for _, m := range members {
+			m.wait(n+i+1, i)
+		}
+		group.DelClient(f.c)
+		for _, m := range members {
+			m.wait(n+i+1, i+1)
+		}
+		f.close()
+	}
+
+	b.StopTimer()
+	for _, m := range members {
+		group.DelClient(m.c)
+	}
+}
+
+func BenchmarkJoin(b *testing.B) {
+	benchmarkJoin(b, false)
+}
+
+func BenchmarkJoinBatch(b *testing.B) {
+	benchmarkJoin(b, true)
+}
+
+type fakeUpTrack struct {
+	conn.UpTrack
+	label string
+	kind  webrtc.RTPCodecType
+}
+
+func (t *fakeUpTrack) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+func (t *fakeUpTrack) Codec() webrtc.RTPCodecCapability {
+	if t.kind == webrtc.RTPCodecTypeAudio {
+		return webrtc.RTPCodecCapability{
+			MimeType: "audio/opus", ClockRate: 48000,
+		}
+	}
+	return webrtc.RTPCodecCapability{
+		MimeType: "video/vp8", ClockRate: 90000,
+	}
+}
+
+func TestRequestedTracks(t *testing.T) {
+	audio := &fakeUpTrack{label: "audio", kind: webrtc.RTPCodecTypeAudio}
+	high := &fakeUpTrack{label: "high", kind: webrtc.RTPCodecTypeVideo}
+	low := &fakeUpTrack{label: "low", kind: webrtc.RTPCodecTypeVideo}
+	simulcast := []conn.UpTrack{audio, high, low}
+	single := []conn.UpTrack{audio, high}
+
+	tests := []struct {
+		requested []string
+		tracks    []conn.UpTrack
+		low       bool
+		expected  []conn.UpTrack
+		limitSid  bool
+	}{
+		{[]string{"audio", "video"}, simulcast, false,
+			[]conn.UpTrack{audio, high}, false},
+		{[]string{"audio", "video"}, simulcast, true,
+			[]conn.UpTrack{audio, low}, false},
+		{[]string{"video-low"}, simulcast, false,
+			[]conn.UpTrack{low}, false},
+		{[]string{"video"}, single, true,
+			[]conn.UpTrack{high}, false},
+		{[]string{"video-low"}, single, false,
+			[]conn.UpTrack{high}, true},
+		{[]string{"audio"}, simulcast, true,
+			[]conn.UpTrack{audio}, false},
+	}
+
+	for i, test := range tests {
+		tracks, limitSid := requestedTracks(
+			nil, test.requested, test.tracks, test.low,
+		)
+		if !reflect.DeepEqual(tracks, test.expected) ||
+			limitSid != test.limitSid {
+			t.Errorf("%v: expected %v %v, got %v %v", i,
+				test.expected, test.limitSid, tracks, limitSid)
+		}
+	}
+}
+
+func TestWithoutVideo(t *testing.T) {
+	audio := &fakeUpTrack{label: "audio", kind: webrtc.RTPCodecTypeAudio}
+	video := &fakeUpTrack{label: "video", kind: webrtc.RTPCodecTypeVideo}
+
+	tracks := withoutVideo([]conn.UpTrack{video, audio})
+	if !reflect.DeepEqual(tracks, []conn.UpTrack{audio}) {
+		t.Errorf("Expected audio, got %v", tracks)
+	}
+	if tracks := withoutVideo([]conn.UpTrack{video}); len(tracks) != 0 {
+		t.Errorf("Expected nothing, got %v", tracks)
+	}
+}
+
+func TestInLastN(t *testing.T) {
+	bob := &webClient{id: "b"}
+	alice := &webClient{id: "a"}
+	camera := &rtpUpConnection{client: bob, label: "camera"}
+	screen := &rtpUpConnection{client: bob, label: "screenshare"}
+	remote := &rtpUpConnection{client: bob, label: "camera", source: "r"}
+	other := &rtpUpConnection{client: alice, label: "camera"}
+
+	c := &webClient{}
+	for _, up := range []*rtpUpConnection{camera, screen, remote, other} {
+		if !c.inLastN(up) {
+			t.Errorf("%v/%v: not forwarded without last-N",
+				up.client.Id(), up.label)
+		}
+	}
+
+	c.lastN = map[string]time.Time{"a": time.Now()}
+	if c.inLastN(camera) || !c.inLastN(other) {
+		t.Errorf("Camera forwarding doesn't follow last-N")
+	}
+	if !c.inLastN(screen) || !c.inLastN(remote) {
+		t.Errorf("Screen share or remote stream not forwarded")
+	}
+}
+
+func TestNextLastN(t *testing.T) {
+	now := time.Now()
+	keys := func(m map[string]time.Time) []string {
+		var l []string
+		for k := range m {
+			l = append(l, k)
+		}
+		sort.Strings(l)
+		return l
+	}
+
+	next, retry := nextLastN(nil, []string{"a", "b", "c"}, 2, now)
+	if !reflect.DeepEqual(keys(next), []string{"a", "b"}) || retry != 0 {
+		t.Errorf("Expected [a b] 0, got %v %v", keys(next), retry)
+	}
+
+	// c speaks, but a and b were just added
+	now = now.Add(lastNHold / 2)
+	current := next
+	next, retry = nextLastN(current, []string{"c", "a", "b"}, 2, now)
+	if !reflect.DeepEqual(keys(next), []string{"a", "b"}) ||
+		retry != lastNHold/2 {
+		t.Errorf("Expected [a b] %v, got %v %v",
+			lastNHold/2, keys(next), retry)
+	}
+
+	// later, c replaces the least recent speaker
+	now = now.Add(lastNHold / 2)
+	next, retry = nextLastN(current, []string{"c", "a", "b"}, 2, now)
+	if !reflect.DeepEqual(keys(next), []string{"a", "c"}) || retry != 0 {
+		t.Errorf("Expected [a c] 0, got %v %v", keys(next), retry)
+	}
+	if !next["c"].Equal(now) || !next["a"].Equal(current["a"]) {
+		t.Errorf("Bad times %v", next)
+	}
+
+	// a client that left is replaced immediately
+	current = next
+	next, _ = nextLastN(current, []string{"b", "c"}, 2, now)
+	if !reflect.DeepEqual(keys(next), []string{"b", "c"}) {
+		t.Errorf("Expected [b c], got %v", keys(next))
+	}
+
+	// the set shrinks
+	next, _ = nextLastN(current, []string{"c", "a"}, 1, now)
+	if !reflect.DeepEqual(keys(next), []string{"c"}) {
+		t.Errorf("Expected [c], got %v", keys(next))
+	}
+}
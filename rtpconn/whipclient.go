@@ -190,7 +190,16 @@ func (c *WhipClient) gotOffer(ctx context.Context, offer []byte) ([]byte, error)
 	case <-gatherComplete:
 	}
 
-	return []byte(conn.pc.CurrentLocalDescription().SDP), nil
+	local := conn.pc.CurrentLocalDescription().SDP
+	if c.group.Description().MusicMode {
+		s, err := musicSDP(local)
+		if err != nil {
+			conn.log.Warnf("Music mode: %v", err)
+		} else {
+			local = s
+		}
+	}
+	return []byte(local), nil
 }
 
 func (c *WhipClient) GotICECandidate(init webrtc.ICECandidateInit) error {
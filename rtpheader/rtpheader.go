@@ -0,0 +1,193 @@
+// Package rtpheader implements allocation-free parsing of RTP headers.
+//
+// Unlike rtp.Packet.Unmarshal, the functions in this package do not copy
+// anything out of the packet: Parse computes the offsets of the various
+// parts of the packet once, and the accessors read values directly from
+// the underlying buffer.  This is intended for the forwarding path; code
+// that is not performance-critical should keep using the pion parser.
+package rtpheader
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrTruncated = errors.New("truncated RTP packet")
+var ErrBadVersion = errors.New("bad RTP version")
+
+const (
+	profileOneByte = 0xBEDE
+	profileTwoByte = 0x1000
+)
+
+// Header is a parsed view of an RTP packet.  It remains valid only as
+// long as the underlying buffer is not modified.
+type Header struct {
+	buf []byte
+	// offset of the extension data, after the extension header.
+	// Zero if there is no extension.
+	extension int
+	// offset of the payload
+	payload int
+	// offset of the end of the payload, excluding padding
+	end int
+}
+
+// Parse parses the header of the RTP packet contained in buf.
+func Parse(buf []byte) (Header, error) {
+	if len(buf) < 12 {
+		return Header{}, ErrTruncated
+	}
+	if (buf[0] >> 6) != 2 {
+		return Header{}, ErrBadVersion
+	}
+
+	offset := 12 + int(buf[0]&0x0F)*4
+	if len(buf) < offset {
+		return Header{}, ErrTruncated
+	}
+
+	extension := 0
+	if (buf[0] & 0x10) != 0 {
+		if len(buf) < offset+4 {
+			return Header{}, ErrTruncated
+		}
+		length := int(binary.BigEndian.Uint16(buf[offset+2:])) * 4
+		extension = offset + 4
+		offset = extension + length
+		if len(buf) < offset {
+			return Header{}, ErrTruncated
+		}
+	}
+
+	end := len(buf)
+	if (buf[0] & 0x20) != 0 {
+		padding := int(buf[len(buf)-1])
+		if end-padding < offset {
+			return Header{}, ErrTruncated
+		}
+		end -= padding
+	}
+
+	return Header{
+		buf:       buf,
+		extension: extension,
+		payload:   offset,
+		end:       end,
+	}, nil
+}
+
+// Marker returns the value of the marker bit.
+func (h Header) Marker() bool {
+	return (h.buf[1] & 0x80) != 0
+}
+
+// PayloadType returns the payload type.
+func (h Header) PayloadType() uint8 {
+	return h.buf[1] & 0x7F
+}
+
+// SequenceNumber returns the packet's sequence number.
+func (h Header) SequenceNumber() uint16 {
+	return binary.BigEndian.Uint16(h.buf[2:])
+}
+
+// Timestamp returns the packet's RTP timestamp.
+func (h Header) Timestamp() uint32 {
+	return binary.BigEndian.Uint32(h.buf[4:])
+}
+
+// SSRC returns the packet's synchronisation source.
+func (h Header) SSRC() uint32 {
+	return binary.BigEndian.Uint32(h.buf[8:])
+}
+
+// HasExtension returns true if the packet carries a header extension.
+func (h Header) HasExtension() bool {
+	return h.extension != 0
+}
+
+// Payload returns the packet's payload, excluding any padding.
+func (h Header) Payload() []byte {
+	return h.buf[h.payload:h.end]
+}
+
+// Extension returns the value of the RFC 8285 header extension with the
+// given id, or nil if it is not present.
+func (h Header) Extension(id uint8) []byte {
+	if h.extension == 0 || id == 0 {
+		return nil
+	}
+	profile := binary.BigEndian.Uint16(h.buf[h.extension-4:])
+	data := h.buf[h.extension:h.payload]
+
+	i := 0
+	for i < len(data) {
+		if data[i] == 0 {
+			// padding
+			i++
+			continue
+		}
+		var extid uint8
+		var length int
+		switch profile {
+		case profileOneByte:
+			extid = data[i] >> 4
+			length = int(data[i]&0x0F) + 1
+			i++
+			if extid == 15 {
+				// reserved, stop parsing
+				return nil
+			}
+		case profileTwoByte:
+			if i+1 >= len(data) {
+				return nil
+			}
+			extid = data[i]
+			length = int(data[i+1])
+			i += 2
+		default:
+			return nil
+		}
+		if i+length > len(data) {
+			return nil
+		}
+		if extid == id {
+			return data[i : i+length]
+		}
+		i += length
+	}
+	return nil
+}
+
+// StripExtension removes the header extension from the packet contained
+// in buf, which must have been passed to Parse to obtain h.  It returns
+// the new length of the packet.  The header h is invalid after this call.
+func (h Header) StripExtension(buf []byte) int {
+	if h.extension == 0 {
+		return len(buf)
+	}
+	start := h.extension - 4
+	n := copy(buf[start:], buf[h.payload:])
+	buf[0] &^= 0x10
+	return start + n
+}
+
+// AudioLevel parses the value of an RFC 6464 audio level extension.
+// It returns the level in -dBov, the voice activity flag, and whether
+// the value could be parsed.
+func AudioLevel(ext []byte) (uint8, bool, bool) {
+	if len(ext) < 1 {
+		return 0, false, false
+	}
+	return ext[0] & 0x7F, (ext[0] & 0x80) != 0, true
+}
+
+// TransportSequenceNumber parses the value of a transport-wide congestion
+// control extension.
+func TransportSequenceNumber(ext []byte) (uint16, bool) {
+	if len(ext) < 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(ext), true
+}
@@ -0,0 +1,181 @@
+package rtpheader
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func marshal(t testing.TB, packet *rtp.Packet) []byte {
+	buf, err := packet.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return buf
+}
+
+func testPacket(t testing.TB, profile uint16) []byte {
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:          2,
+			Marker:           true,
+			PayloadType:      96,
+			SequenceNumber:   0x4243,
+			Timestamp:        0x12345678,
+			SSRC:             0xDEADBEEF,
+			CSRC:             []uint32{1, 2},
+			Extension:        true,
+			ExtensionProfile: profile,
+		},
+		Payload: []byte{1, 2, 3, 4, 5},
+	}
+	err := packet.SetExtension(1, []byte{0x85})
+	if err != nil {
+		t.Fatalf("SetExtension: %v", err)
+	}
+	err = packet.SetExtension(3, []byte{0x01, 0x02})
+	if err != nil {
+		t.Fatalf("SetExtension: %v", err)
+	}
+	return marshal(t, &packet)
+}
+
+func TestParse(t *testing.T) {
+	for _, profile := range []uint16{profileOneByte, profileTwoByte} {
+		buf := testPacket(t, profile)
+		h, err := Parse(buf)
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		if !h.Marker() || h.PayloadType() != 96 ||
+			h.SequenceNumber() != 0x4243 ||
+			h.Timestamp() != 0x12345678 ||
+			h.SSRC() != 0xDEADBEEF {
+			t.Errorf("Bad header fields")
+		}
+		if !bytes.Equal(h.Payload(), []byte{1, 2, 3, 4, 5}) {
+			t.Errorf("Bad payload %v", h.Payload())
+		}
+		level, voice, ok := AudioLevel(h.Extension(1))
+		if !ok || level != 5 || !voice {
+			t.Errorf("Bad audio level %v %v %v", level, voice, ok)
+		}
+		tsn, ok := TransportSequenceNumber(h.Extension(3))
+		if !ok || tsn != 0x0102 {
+			t.Errorf("Bad transport seqno %v %v", tsn, ok)
+		}
+		if h.Extension(2) != nil {
+			t.Errorf("Found non-existent extension")
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Padding:        true,
+			SequenceNumber: 42,
+		},
+		Payload:     []byte{1, 2, 3},
+		PaddingSize: 5,
+	}
+	buf := marshal(t, &packet)
+	h, err := Parse(buf)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if !bytes.Equal(h.Payload(), []byte{1, 2, 3}) {
+		t.Errorf("Bad payload %v", h.Payload())
+	}
+}
+
+func TestStripExtension(t *testing.T) {
+	buf := testPacket(t, profileOneByte)
+	h, err := Parse(buf)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	n := h.StripExtension(buf)
+
+	var packet rtp.Packet
+	err = packet.Unmarshal(buf[:n])
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if packet.Extension || len(packet.Extensions) != 0 {
+		t.Errorf("Extension was not stripped")
+	}
+	if len(packet.CSRC) != 2 || packet.SequenceNumber != 0x4243 {
+		t.Errorf("Bad header %v", packet.Header)
+	}
+	if !bytes.Equal(packet.Payload, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("Bad payload %v", packet.Payload)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	buf := testPacket(t, profileOneByte)
+	for i := 0; i < 12+8+4; i++ {
+		_, err := Parse(buf[:i])
+		if err == nil {
+			t.Errorf("Parse succeeded on truncated packet (%v)", i)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(testPacket(f, profileOneByte))
+	f.Add(testPacket(f, profileTwoByte))
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h, err := Parse(buf)
+		var packet rtp.Packet
+		err2 := packet.Unmarshal(buf)
+		if err != nil {
+			return
+		}
+		if err2 == nil {
+			if h.SequenceNumber() != packet.SequenceNumber ||
+				h.Timestamp() != packet.Timestamp ||
+				h.Marker() != packet.Marker {
+				t.Errorf("Mismatch with pion parser")
+			}
+			// pion stops at the reserved extension id 15
+			// without skipping the rest of the extension
+			if !h.HasExtension() &&
+				!bytes.Equal(h.Payload(), packet.Payload) {
+				t.Errorf("Payload mismatch with pion parser")
+			}
+		}
+		for id := uint8(0); id < 16; id++ {
+			h.Extension(id)
+		}
+		h.StripExtension(append([]byte(nil), buf...))
+	})
+}
+
+func BenchmarkParse(b *testing.B) {
+	buf := testPacket(b, profileOneByte)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h, err := Parse(buf)
+		if err != nil || len(h.Extension(3)) != 2 {
+			b.Fatalf("Parse failed")
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	buf := testPacket(b, profileOneByte)
+	var packet rtp.Packet
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := packet.Unmarshal(buf)
+		if err != nil || len(packet.GetExtension(3)) != 2 {
+			b.Fatalf("Unmarshal failed")
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package rtptime
+
+// Sequence numbers and timestamps wrap around on the wire.  The functions
+// in this file convert them to monotonic 64-bit values, which can be
+// compared and subtracted without worrying about wraparound.
+
+type wrapping interface {
+	uint16 | uint32
+}
+
+// extend returns the extended value of v that is closest to ref.  If v is
+// exactly half the range away from ref, it is assumed to be earlier.
+func extend[T wrapping](ref int64, v T) int64 {
+	d := v - T(ref)
+	half := ^T(0)/2 + 1
+	if d < half {
+		return ref + int64(d)
+	}
+	return ref - int64(-d)
+}
+
+// ExtendSeqno returns the extended sequence number of seqno that is
+// closest to ref.
+func ExtendSeqno(ref int64, seqno uint16) int64 {
+	return extend(ref, seqno)
+}
+
+// ExtendTimestamp returns the extended timestamp of ts that is closest
+// to ref.
+func ExtendTimestamp(ref int64, ts uint32) int64 {
+	return extend(ref, ts)
+}
+
+// An Extender converts the values of a stream of sequence numbers or
+// timestamps into extended values.  The first value is extended to
+// itself, which makes the low bits of extended values equal to the wire
+// values, and the cycle count start at 0.  The zero value is ready for
+// use.  An Extender is not safe for concurrent use.
+type Extender[T wrapping] struct {
+	valid   bool
+	highest int64
+}
+
+// SeqnoExtender extends RTP sequence numbers.
+type SeqnoExtender = Extender[uint16]
+
+// TimestampExtender extends RTP timestamps.
+type TimestampExtender = Extender[uint32]
+
+// Extend returns the extended value of v, and records it.  Values that
+// are earlier than the highest value seen so far are assumed to be
+// reordered.
+func (e *Extender[T]) Extend(v T) int64 {
+	if !e.valid {
+		e.valid = true
+		e.highest = int64(v)
+		return e.highest
+	}
+	x := extend(e.highest, v)
+	if x > e.highest {
+		e.highest = x
+	}
+	return x
+}
+
+// Peek returns the extended value of v without recording it.
+func (e *Extender[T]) Peek(v T) int64 {
+	if !e.valid {
+		return int64(v)
+	}
+	return extend(e.highest, v)
+}
+
+// Resync records v as the new highest value, following the previous
+// highest value, whatever the distance.  This is used after
+// a discontinuity, and keeps extended values monotonic.
+func (e *Extender[T]) Resync(v T) int64 {
+	if !e.valid {
+		return e.Extend(v)
+	}
+	e.highest += int64(v - T(e.highest))
+	return e.highest
+}
+
+// Highest returns the highest extended value seen so far, and false if
+// no value has been seen.
+func (e *Extender[T]) Highest() (int64, bool) {
+	return e.highest, e.valid
+}
+
+// Reset forgets all previously seen values.
+func (e *Extender[T]) Reset() {
+	*e = Extender[T]{}
+}
@@ -0,0 +1,150 @@
+package rtptime
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+func TestExtendSeqno(t *testing.T) {
+	cases := []struct {
+		ref   int64
+		seqno uint16
+		x     int64
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0, 0xFFFF, -1},
+		{0xFFFF, 0, 0x10000},
+		{0x10000, 0xFFFF, 0xFFFF},
+		{0x12345, 0x2345, 0x12345},
+		{0, 0x7FFF, 0x7FFF},
+		{0, 0x8000, -0x8000},
+		{5 << 16, 3, 5<<16 + 3},
+	}
+	for _, c := range cases {
+		x := ExtendSeqno(c.ref, c.seqno)
+		if x != c.x {
+			t.Errorf("ExtendSeqno(%v, %v): expected %v, got %v",
+				c.ref, c.seqno, c.x, x)
+		}
+	}
+}
+
+func TestExtendProperties(t *testing.T) {
+	seqno := func(ref int64, v uint16) bool {
+		x := ExtendSeqno(ref, v)
+		d := x - ref
+		return uint16(x) == v && d >= -0x8000 && d < 0x8000
+	}
+	if err := quick.Check(seqno, nil); err != nil {
+		t.Error(err)
+	}
+
+	ts := func(ref int64, v uint32) bool {
+		x := ExtendTimestamp(ref, v)
+		d := x - ref
+		return uint32(x) == v && d >= -0x80000000 && d < 0x80000000
+	}
+	if err := quick.Check(ts, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// stream generates n increasing extended values starting at start, with
+// random increments less than maxStep, and then reorders them locally by
+// at most window positions.
+func stream(r *rand.Rand, start int64, n int, maxStep int64, window int) []int64 {
+	values := make([]int64, n)
+	v := start
+	for i := range values {
+		values[i] = v
+		v += r.Int63n(maxStep)
+	}
+	for i := 0; i+window < n; i += window {
+		r.Shuffle(window, func(j, k int) {
+			values[i+j], values[i+k] = values[i+k], values[i+j]
+		})
+	}
+	return values
+}
+
+func TestSeqnoExtender(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	for iter := 0; iter < 100; iter++ {
+		start := r.Int63n(1 << 40)
+		// 200000 packets is about 3 wraps with no loss, and many
+		// more with the increments below
+		values := stream(r, start, 200000, 1+r.Int63n(200), 1+r.Intn(64))
+		var e SeqnoExtender
+		offset := values[0] - int64(uint16(values[0]))
+		var highest int64
+		for i, v := range values {
+			x := e.Extend(uint16(v))
+			if x != v-offset {
+				t.Fatalf("Iteration %v, packet %v: "+
+					"expected %v, got %v",
+					iter, i, v-offset, x)
+			}
+			if x > highest || i == 0 {
+				highest = x
+			}
+			h, ok := e.Highest()
+			if !ok || h != highest {
+				t.Fatalf("Highest: expected %v, got %v",
+					highest, h)
+			}
+		}
+	}
+}
+
+func TestTimestampExtender(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	for iter := 0; iter < 100; iter++ {
+		start := r.Int63n(1 << 40)
+		// steps of up to 2^26 wrap around every few dozen packets
+		values := stream(r, start, 10000, 1+r.Int63n(1<<26), 1+r.Intn(16))
+		var e TimestampExtender
+		offset := values[0] - int64(uint32(values[0]))
+		for i, v := range values {
+			x := e.Extend(uint32(v))
+			if x != v-offset {
+				t.Fatalf("Iteration %v, packet %v: "+
+					"expected %v, got %v",
+					iter, i, v-offset, x)
+			}
+			if p := e.Peek(uint32(v)); p != x {
+				t.Fatalf("Peek: expected %v, got %v", x, p)
+			}
+		}
+	}
+}
+
+func TestExtenderResync(t *testing.T) {
+	var e SeqnoExtender
+	if x := e.Extend(0xFFF0); x != 0xFFF0 {
+		t.Errorf("Expected %v, got %v", 0xFFF0, x)
+	}
+	// a jump of more than half the range is considered as reordering
+	if x := e.Extend(0x9000); x != 0x9000 {
+		t.Errorf("Expected %v, got %v", 0x9000, x)
+	}
+	if h, _ := e.Highest(); h != 0xFFF0 {
+		t.Errorf("Expected %v, got %v", 0xFFF0, h)
+	}
+	// unless we resync
+	if x := e.Resync(0x9000); x != 0x19000 {
+		t.Errorf("Expected %v, got %v", 0x19000, x)
+	}
+	if x := e.Extend(0x9001); x != 0x19001 {
+		t.Errorf("Expected %v, got %v", 0x19001, x)
+	}
+
+	e.Reset()
+	if _, ok := e.Highest(); ok {
+		t.Errorf("Highest is valid after reset")
+	}
+	if x := e.Extend(3); x != 3 {
+		t.Errorf("Expected 3, got %v", x)
+	}
+}
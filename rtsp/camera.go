@@ -0,0 +1,362 @@
+package rtsp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/jech/galene/group"
+	galeneingest "github.com/jech/galene/ingest"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/rtpconn"
+)
+
+var logger = logging.New("rtsp")
+
+func newId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		logger.Fatalf("rand.Read: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// An ingest pulls the video of a camera into a group, reconnecting
+// whenever the connection is lost, until it is closed.
+type ingest struct {
+	group  *group.Group
+	name   string
+	camera group.Camera
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	conn   *conn
+}
+
+var ingests struct {
+	mu      sync.Mutex
+	ingests map[string]map[string]*ingest
+}
+
+// wanted returns true if a group has users other than system clients,
+// such as the cameras themselves.
+func wanted(g *group.Group) bool {
+	for _, c := range g.GetClients(nil) {
+		system := false
+		for _, p := range c.Permissions() {
+			if p == "system" {
+				system = true
+				break
+			}
+		}
+		if !system {
+			return true
+		}
+	}
+	return false
+}
+
+// Update starts or stops the cameras of a group.  Cameras are active
+// when they are declared in the group's description and there are users
+// in the group.
+func Update(g *group.Group) {
+	ingests.mu.Lock()
+	defer ingests.mu.Unlock()
+
+	cameras := g.Description().Cameras
+	if !wanted(g) {
+		cameras = nil
+	}
+
+	running := ingests.ingests[g.Name()]
+	for name, in := range running {
+		if c, ok := cameras[name]; !ok || c != in.camera || in.isClosed() {
+			in.close()
+			delete(running, name)
+		}
+	}
+	for name, c := range cameras {
+		if running[name] != nil {
+			continue
+		}
+		if running == nil {
+			if ingests.ingests == nil {
+				ingests.ingests = make(map[string]map[string]*ingest)
+			}
+			running = make(map[string]*ingest)
+			ingests.ingests[g.Name()] = running
+		}
+		in := &ingest{
+			group:  g,
+			name:   name,
+			camera: c,
+			done:   make(chan struct{}),
+		}
+		running[name] = in
+		go in.run()
+	}
+	if len(running) == 0 {
+		delete(ingests.ingests, g.Name())
+	}
+}
+
+// UpdateAll calls Update for all groups.  It is called periodically in
+// order to notice changes to group descriptions.
+func UpdateAll() {
+	var gs []*group.Group
+	group.Range(func(g *group.Group) bool {
+		gs = append(gs, g)
+		return true
+	})
+	for _, g := range gs {
+		Update(g)
+	}
+}
+
+func (in *ingest) isClosed() bool {
+	select {
+	case <-in.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (in *ingest) close() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.closed {
+		return
+	}
+	in.closed = true
+	close(in.done)
+	if in.conn != nil {
+		in.conn.close()
+	}
+}
+
+func (in *ingest) run() {
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := in.stream()
+		if in.isClosed() {
+			return
+		}
+		logger.Warnf("RTSP %v/%v: %v", in.group.Name(), in.name, err)
+
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		select {
+		case <-time.After(delay):
+		case <-in.done:
+			return
+		}
+		delay *= 2
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
+
+// stream connects to the camera and forwards its video until the
+// connection is lost.
+func (in *ingest) stream() error {
+	u, err := url.Parse(in.camera.URL)
+	if err != nil {
+		return err
+	}
+	c, err := dial(u, readTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	in.mu.Lock()
+	if in.closed {
+		in.mu.Unlock()
+		return nil
+	}
+	in.conn = c
+	in.mu.Unlock()
+
+	// credentials are sent in the Authorization header
+	uu := *u
+	uu.User = nil
+	uri := uu.String()
+
+	base, t, err := c.describe(uri)
+	if err != nil {
+		return err
+	}
+	channel, timeout, err := c.setup(t.control)
+	if err != nil {
+		return err
+	}
+	err = c.play(base)
+	if err != nil {
+		return err
+	}
+
+	client := rtpconn.NewIngestClient(in.group, newId())
+	client.SetUsername(in.name)
+	client.SetPermissions([]string{"system"})
+	_, err = group.AddClient(in.group.Name(), client,
+		group.ClientCredentials{System: true},
+	)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+	p, err := newPublisher(ctx, client, t)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	logger.Infof("RTSP %v/%v: connected to %v",
+		in.group.Name(), in.name, u.Redacted())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.write("OPTIONS", uri, nil)
+			case <-client.Done():
+				select {
+				case <-stop:
+				default:
+					// kicked by an operator
+					in.close()
+				}
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		ch, data, err := c.readPacket(buf)
+		if err != nil {
+			return err
+		}
+		if ch != channel {
+			continue
+		}
+		var packet rtp.Packet
+		err = packet.Unmarshal(data)
+		if err != nil || packet.PayloadType != t.payloadType {
+			continue
+		}
+		p.write(&packet)
+	}
+}
+
+// A publisher sends the video received over RTSP to the server.  Cameras
+// that only announce their parameter sets out of band get them inserted
+// before keyframes.
+type publisher struct {
+	*galeneingest.Publisher
+	sps, pps  []byte
+	sawParams bool
+}
+
+func newPublisher(ctx context.Context, c *rtpconn.IngestClient, t *track) (*publisher, error) {
+	p, err := galeneingest.NewPublisher(ctx, c, false)
+	if err != nil {
+		return nil, err
+	}
+	return &publisher{Publisher: p, sps: t.sps, pps: t.pps}, nil
+}
+
+// write forwards a packet from the camera.
+func (p *publisher) write(packet *rtp.Packet) {
+	params, keyframe := nalInfo(packet.Payload)
+	if params {
+		p.sawParams = true
+	}
+	if keyframe {
+		if !p.sawParams && p.sps != nil && p.pps != nil {
+			p.WriteVideoRTP(&rtp.Packet{
+				Header: rtp.Header{
+					Version:   2,
+					Timestamp: packet.Timestamp,
+				},
+				Payload: stapA(p.sps, p.pps),
+			})
+		}
+		p.sawParams = false
+	}
+	p.WriteVideoRTP(packet)
+}
+
+// nalInfo returns whether an H.264 payload carries a sequence parameter
+// set, and whether it starts an IDR picture.
+func nalInfo(payload []byte) (bool, bool) {
+	if len(payload) < 1 {
+		return false, false
+	}
+	switch payload[0] & 0x1F {
+	case 5:
+		return false, true
+	case 7:
+		return true, false
+	case 24: // STAP-A
+		params, keyframe := false, false
+		b := payload[1:]
+		for len(b) > 2 {
+			n := int(b[0])<<8 | int(b[1])
+			if n == 0 || len(b) < 2+n {
+				break
+			}
+			switch b[2] & 0x1F {
+			case 5:
+				keyframe = true
+			case 7:
+				params = true
+			}
+			b = b[2+n:]
+		}
+		return params, keyframe
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return false, false
+		}
+		start := payload[1]&0x80 != 0
+		return false, start && payload[1]&0x1F == 5
+	}
+	return false, false
+}
+
+// stapA aggregates NAL units into a single STAP-A payload.
+func stapA(nalus ...[]byte) []byte {
+	nri := byte(0)
+	for _, n := range nalus {
+		if len(n) > 0 && n[0]&0x60 > nri {
+			nri = n[0] & 0x60
+		}
+	}
+	b := []byte{nri | 24}
+	for _, n := range nalus {
+		b = append(b, byte(len(n)>>8), byte(len(n)))
+		b = append(b, n...)
+	}
+	return b
+}
@@ -0,0 +1,471 @@
+// Package rtsp implements RTSP camera ingest: the H.264 video of an RTSP
+// source, typically an IP camera, is pulled over TCP and injected into
+// a group as if it came from an ordinary client.
+package rtsp
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// time after which an unresponsive camera is considered dead
+const readTimeout = 10 * time.Second
+
+// A response is an RTSP response.
+type response struct {
+	status int
+	reason string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// A conn is an RTSP connection to a camera.  Media is received over the
+// same TCP connection, interleaved with RTSP messages.
+type conn struct {
+	nc   net.Conn
+	r    *bufio.Reader
+	auth *authenticator
+
+	mu      sync.Mutex
+	cseq    int
+	session string
+}
+
+// dial connects to the server of a given URL.
+func dial(u *url.URL, timeout time.Duration) (*conn, error) {
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "554")
+	}
+	nc, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{nc: nc, r: bufio.NewReader(nc)}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		c.auth = &authenticator{
+			username: u.User.Username(),
+			password: password,
+		}
+	}
+	return c, nil
+}
+
+func (c *conn) close() error {
+	return c.nc.Close()
+}
+
+// write sends a request without waiting for the response.
+func (c *conn) write(method, uri string, header [][2]string) error {
+	var b strings.Builder
+	c.mu.Lock()
+	c.cseq++
+	fmt.Fprintf(&b, "%v %v RTSP/1.0\r\nCSeq: %v\r\n", method, uri, c.cseq)
+	b.WriteString("User-Agent: Galene\r\n")
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %v\r\n", c.session)
+	}
+	if c.auth != nil {
+		if a := c.auth.authorization(method, uri); a != "" {
+			fmt.Fprintf(&b, "Authorization: %v\r\n", a)
+		}
+	}
+	c.mu.Unlock()
+	for _, h := range header {
+		fmt.Fprintf(&b, "%v: %v\r\n", h[0], h[1])
+	}
+	b.WriteString("\r\n")
+
+	c.nc.SetWriteDeadline(time.Now().Add(readTimeout))
+	_, err := io.WriteString(c.nc, b.String())
+	return err
+}
+
+// request sends a request and waits for the response, authenticating
+// if required.  Any status other than 200 is an error.
+func (c *conn) request(method, uri string, header [][2]string) (*response, error) {
+	for i := 0; i < 2; i++ {
+		err := c.write(method, uri, header)
+		if err != nil {
+			return nil, err
+		}
+		c.nc.SetReadDeadline(time.Now().Add(readTimeout))
+		r, err := readResponse(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if r.status == 401 && i == 0 && c.auth != nil {
+			c.mu.Lock()
+			err = c.auth.challenge(r.header.Values("Www-Authenticate"))
+			c.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if r.status != 200 {
+			return nil, fmt.Errorf("%v: %v %v",
+				method, r.status, r.reason)
+		}
+		return r, nil
+	}
+	return nil, errors.New(method + ": authentication failed")
+}
+
+// readResponse reads an RTSP response.
+func readResponse(r *bufio.Reader) (*response, error) {
+	tr := textproto.NewReader(r)
+	line, err := tr.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(rest, " ")
+	if !strings.HasPrefix(proto, "RTSP/") {
+		return nil, errors.New("malformed RTSP response")
+	}
+	status, err := strconv.Atoi(code)
+	if err != nil {
+		return nil, errors.New("malformed RTSP status")
+	}
+	header, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	resp := &response{status: status, reason: reason, header: header}
+	if cl := header.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > 1024*1024 {
+			return nil, errors.New("bad Content-Length")
+		}
+		resp.body = make([]byte, n)
+		_, err = io.ReadFull(r, resp.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// readPacket returns the next interleaved packet, skipping any RTSP
+// responses, such as the replies to keepalives.
+func (c *conn) readPacket(buf []byte) (uint8, []byte, error) {
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(readTimeout))
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if b[0] != '$' {
+			_, err := readResponse(c.r)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		var h [4]byte
+		_, err = io.ReadFull(c.r, h[:])
+		if err != nil {
+			return 0, nil, err
+		}
+		n := int(binary.BigEndian.Uint16(h[2:]))
+		if n > len(buf) {
+			_, err = c.r.Discard(n)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		_, err = io.ReadFull(c.r, buf[:n])
+		if err != nil {
+			return 0, nil, err
+		}
+		return h[1], buf[:n], nil
+	}
+}
+
+// A track is the video track of a camera, as described by DESCRIBE.
+type track struct {
+	control     string
+	payloadType uint8
+	sps, pps    []byte
+}
+
+// describe fetches the description of a stream, and returns the base
+// URL for aggregate control together with its H.264 track.
+func (c *conn) describe(uri string) (string, *track, error) {
+	r, err := c.request("DESCRIBE", uri, [][2]string{
+		{"Accept", "application/sdp"},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	base := r.header.Get("Content-Base")
+	if base == "" {
+		base = r.header.Get("Content-Location")
+	}
+	if base == "" {
+		base = uri
+	}
+	t, err := parseDescription(r.body, base)
+	if err != nil {
+		return "", nil, err
+	}
+	return base, t, nil
+}
+
+// parseDescription finds the first H.264 track in a session description.
+func parseDescription(body []byte, base string) (*track, error) {
+	var desc sdp.SessionDescription
+	err := desc.Unmarshal(body)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range desc.MediaDescriptions {
+		if m.MediaName.Media != "video" {
+			continue
+		}
+		for _, f := range m.MediaName.Formats {
+			pt, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				continue
+			}
+			codec, err := desc.GetCodecForPayloadType(uint8(pt))
+			if err != nil || !strings.EqualFold(codec.Name, "H264") {
+				continue
+			}
+			t := &track{payloadType: uint8(pt)}
+			control, _ := m.Attribute("control")
+			t.control = controlURL(base, control)
+			t.sps, t.pps = parameterSets(codec.Fmtp)
+			return t, nil
+		}
+	}
+	return nil, errors.New("no H.264 video in stream")
+}
+
+// controlURL resolves a control attribute against the base URL.  As is
+// customary for RTSP, relative controls are appended to the base.
+func controlURL(base, control string) string {
+	if control == "" || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(strings.ToLower(control), "rtsp://") {
+		return control
+	}
+	if !strings.HasSuffix(base, "/") {
+		base = base + "/"
+	}
+	return base + control
+}
+
+// parameterSets returns the SPS and PPS carried in an H.264 fmtp line.
+func parameterSets(fmtp string) ([]byte, []byte) {
+	for _, p := range strings.Split(fmtp, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if key != "sprop-parameter-sets" {
+			continue
+		}
+		sets := strings.Split(value, ",")
+		if len(sets) < 2 {
+			return nil, nil
+		}
+		sps, err1 := base64.StdEncoding.DecodeString(sets[0])
+		pps, err2 := base64.StdEncoding.DecodeString(sets[1])
+		if err1 != nil || err2 != nil {
+			return nil, nil
+		}
+		return sps, pps
+	}
+	return nil, nil
+}
+
+// setup requests interleaved transport for a track, and returns the
+// channel on which RTP is received together with the session timeout.
+func (c *conn) setup(uri string) (uint8, time.Duration, error) {
+	r, err := c.request("SETUP", uri, [][2]string{
+		{"Transport", "RTP/AVP/TCP;unicast;interleaved=0-1"},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	session, params, _ := strings.Cut(r.header.Get("Session"), ";")
+	if session == "" {
+		return 0, 0, errors.New("SETUP: no session")
+	}
+	timeout := 60 * time.Second
+	if v, ok := headerParam(params, "timeout"); ok {
+		t, err := strconv.Atoi(v)
+		if err == nil && t > 0 {
+			timeout = time.Duration(t) * time.Second
+		}
+	}
+	c.mu.Lock()
+	c.session = strings.TrimSpace(session)
+	c.mu.Unlock()
+
+	channel := uint8(0)
+	if v, ok := headerParam(r.header.Get("Transport"), "interleaved"); ok {
+		first, _, _ := strings.Cut(v, "-")
+		ch, err := strconv.ParseUint(first, 10, 8)
+		if err == nil {
+			channel = uint8(ch)
+		}
+	}
+	return channel, timeout, nil
+}
+
+// headerParam returns the value of a parameter in a semicolon-separated
+// list.
+func headerParam(value, name string) (string, bool) {
+	for _, p := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (c *conn) play(uri string) error {
+	_, err := c.request("PLAY", uri, [][2]string{{"Range", "npt=0.000-"}})
+	return err
+}
+
+// An authenticator computes the Authorization header, using either
+// Basic or Digest authentication depending on what the server asked for.
+type authenticator struct {
+	username, password string
+
+	scheme string
+	realm  string
+	nonce  string
+	opaque string
+	qop    string
+	nc     int
+}
+
+// challenge records the parameters of a WWW-Authenticate header.  Digest
+// is preferred over Basic.
+func (a *authenticator) challenge(headers []string) error {
+	basic := false
+	for _, h := range headers {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(h), " ")
+		switch strings.ToLower(scheme) {
+		case "digest":
+			p := parseAuthParams(params)
+			a.scheme = "digest"
+			a.realm = p["realm"]
+			a.nonce = p["nonce"]
+			a.opaque = p["opaque"]
+			a.qop = ""
+			for _, q := range strings.Split(p["qop"], ",") {
+				if strings.TrimSpace(q) == "auth" {
+					a.qop = "auth"
+				}
+			}
+			a.nc = 0
+			return nil
+		case "basic":
+			basic = true
+		}
+	}
+	if basic {
+		a.scheme = "basic"
+		return nil
+	}
+	return errors.New("unsupported authentication scheme")
+}
+
+func (a *authenticator) authorization(method, uri string) string {
+	switch a.scheme {
+	case "basic":
+		return "Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(a.username+":"+a.password),
+		)
+	case "digest":
+		ha1 := md5hex(a.username + ":" + a.realm + ":" + a.password)
+		ha2 := md5hex(method + ":" + uri)
+		v := fmt.Sprintf(
+			`Digest username="%v", realm="%v", nonce="%v", uri="%v"`,
+			a.username, a.realm, a.nonce, uri,
+		)
+		if a.qop != "" {
+			a.nc++
+			nc := fmt.Sprintf("%08x", a.nc)
+			cnonce := newCnonce()
+			v += fmt.Sprintf(
+				`, qop=%v, nc=%v, cnonce="%v", response="%v"`,
+				a.qop, nc, cnonce,
+				md5hex(ha1+":"+a.nonce+":"+nc+":"+
+					cnonce+":"+a.qop+":"+ha2),
+			)
+		} else {
+			v += fmt.Sprintf(`, response="%v"`,
+				md5hex(ha1+":"+a.nonce+":"+ha2))
+		}
+		if a.opaque != "" {
+			v += fmt.Sprintf(`, opaque="%v"`, a.opaque)
+		}
+		return v
+	}
+	return ""
+}
+
+func md5hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func newCnonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseAuthParams parses a comma-separated list of key=value pairs,
+// where values may be quoted.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, s = rest[1:], ""
+			} else {
+				value, s = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+}
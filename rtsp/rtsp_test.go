@@ -0,0 +1,273 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const description = "v=0\r\n" +
+	"o=- 0 0 IN IP4 192.0.2.1\r\n" +
+	"s=Camera\r\n" +
+	"t=0 0\r\n" +
+	"a=control:*\r\n" +
+	"m=audio 0 RTP/AVP 0\r\n" +
+	"a=control:trackID=0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:96 packetization-mode=1;" +
+	"sprop-parameter-sets=Z0IAH5WoFAFuQA==,aM48gA==\r\n" +
+	"a=control:trackID=1\r\n"
+
+func TestParseDescription(t *testing.T) {
+	tr, err := parseDescription(
+		[]byte(description), "rtsp://192.0.2.1/stream",
+	)
+	if err != nil {
+		t.Fatalf("parseDescription: %v", err)
+	}
+	if tr.payloadType != 96 {
+		t.Errorf("Payload type %v", tr.payloadType)
+	}
+	if tr.control != "rtsp://192.0.2.1/stream/trackID=1" {
+		t.Errorf("Control %v", tr.control)
+	}
+	if len(tr.sps) == 0 || tr.sps[0]&0x1F != 7 ||
+		len(tr.pps) == 0 || tr.pps[0]&0x1F != 8 {
+		t.Errorf("Parameter sets %v %v", tr.sps, tr.pps)
+	}
+
+	_, err = parseDescription([]byte(strings.Replace(
+		description, "H264", "H265", 1,
+	)), "rtsp://192.0.2.1/stream")
+	if err == nil {
+		t.Errorf("H.265 accepted")
+	}
+}
+
+func TestControlURL(t *testing.T) {
+	tests := [][3]string{
+		{"rtsp://a/s", "", "rtsp://a/s"},
+		{"rtsp://a/s", "*", "rtsp://a/s"},
+		{"rtsp://a/s/", "track1", "rtsp://a/s/track1"},
+		{"rtsp://a/s", "track1", "rtsp://a/s/track1"},
+		{"rtsp://a/s", "rtsp://b/t", "rtsp://b/t"},
+	}
+	for _, tt := range tests {
+		c := controlURL(tt[0], tt[1])
+		if c != tt[2] {
+			t.Errorf("%v %v: got %v, expected %v",
+				tt[0], tt[1], c, tt[2])
+		}
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	p := parseAuthParams(
+		`realm="Camera, 1", nonce="abc", qop="auth,auth-int",stale=FALSE`,
+	)
+	expected := map[string]string{
+		"realm": "Camera, 1",
+		"nonce": "abc",
+		"qop":   "auth,auth-int",
+		"stale": "FALSE",
+	}
+	if len(p) != len(expected) {
+		t.Errorf("Got %v", p)
+	}
+	for k, v := range expected {
+		if p[k] != v {
+			t.Errorf("%v: got %v, expected %v", k, p[k], v)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	// the example in RFC 2617 Section 3.5, without qop
+	a := authenticator{username: "Mufasa", password: "Circle Of Life"}
+	err := a.challenge([]string{
+		`Basic realm="x"`,
+		`Digest realm="testrealm@host.com", ` +
+			`nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093"`,
+	})
+	if err != nil {
+		t.Fatalf("challenge: %v", err)
+	}
+	v := a.authorization("GET", "/dir/index.html")
+	response := md5hex(
+		md5hex("Mufasa:testrealm@host.com:Circle Of Life") +
+			":dcd98b7102dd2f0e8b11d0f600bfb0c093:" +
+			md5hex("GET:/dir/index.html"),
+	)
+	if !strings.Contains(v, `response="`+response+`"`) {
+		t.Errorf("Got %v", v)
+	}
+
+	err = a.challenge([]string{`Basic realm="x"`})
+	if err != nil {
+		t.Fatalf("challenge: %v", err)
+	}
+	v = a.authorization("DESCRIBE", "rtsp://a/")
+	if v != "Basic TXVmYXNhOkNpcmNsZSBPZiBMaWZl" {
+		t.Errorf("Got %v", v)
+	}
+
+	err = a.challenge([]string{`Bearer realm="x"`})
+	if err == nil {
+		t.Errorf("Bearer accepted")
+	}
+}
+
+func TestNALInfo(t *testing.T) {
+	sps := []byte{0x67, 0x42}
+	pps := []byte{0x68, 0xce}
+	tests := []struct {
+		payload          []byte
+		params, keyframe bool
+	}{
+		{[]byte{0x65, 0}, false, true},
+		{[]byte{0x41, 0}, false, false},
+		{sps, true, false},
+		{stapA(sps, pps), true, false},
+		{stapA(sps, pps, []byte{0x65, 0}), true, true},
+		{[]byte{0x7c, 0x85, 0}, false, true},
+		{[]byte{0x7c, 0x05, 0}, false, false},
+		{[]byte{0x7c, 0x81, 0}, false, false},
+	}
+	for _, tt := range tests {
+		params, keyframe := nalInfo(tt.payload)
+		if params != tt.params || keyframe != tt.keyframe {
+			t.Errorf("%v: got %v %v, expected %v %v",
+				tt.payload, params, keyframe,
+				tt.params, tt.keyframe)
+		}
+	}
+
+	if s := stapA(sps, pps); s[0] != 0x78 {
+		t.Errorf("STAP-A header %x", s[0])
+	}
+}
+
+// serveCamera implements just enough of an RTSP server, with Digest
+// authentication, to stream a single packet.
+func serveCamera(t *testing.T, l net.Listener) {
+	nc, err := l.Accept()
+	if err != nil {
+		t.Errorf("Accept: %v", err)
+		return
+	}
+	defer nc.Close()
+	r := textproto.NewReader(bufio.NewReader(nc))
+
+	a := authenticator{username: "admin", password: "secret"}
+	a.challenge([]string{`Digest realm="camera", nonce="1234"`})
+
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+		method, rest, _ := strings.Cut(line, " ")
+		uri, _, _ := strings.Cut(rest, " ")
+		h, err := r.ReadMIMEHeader()
+		if err != nil {
+			t.Errorf("ReadMIMEHeader: %v", err)
+			return
+		}
+		cseq := h.Get("Cseq")
+
+		if h.Get("Authorization") != a.authorization(method, uri) {
+			fmt.Fprintf(nc, "RTSP/1.0 401 Unauthorized\r\n"+
+				"CSeq: %v\r\n"+
+				"WWW-Authenticate: Digest realm=\"camera\", "+
+				"nonce=\"1234\"\r\n\r\n", cseq)
+			continue
+		}
+
+		switch method {
+		case "DESCRIBE":
+			fmt.Fprintf(nc, "RTSP/1.0 200 OK\r\nCSeq: %v\r\n"+
+				"Content-Base: %v/\r\n"+
+				"Content-Type: application/sdp\r\n"+
+				"Content-Length: %v\r\n\r\n%v",
+				cseq, uri, len(description), description)
+		case "SETUP":
+			if !strings.HasSuffix(uri, "/trackID=1") {
+				t.Errorf("SETUP %v", uri)
+			}
+			fmt.Fprintf(nc, "RTSP/1.0 200 OK\r\nCSeq: %v\r\n"+
+				"Session: 42;timeout=30\r\n"+
+				"Transport: RTP/AVP/TCP;unicast;"+
+				"interleaved=2-3\r\n\r\n", cseq)
+		case "PLAY":
+			if h.Get("Session") != "42" {
+				t.Errorf("PLAY session %v", h.Get("Session"))
+			}
+			fmt.Fprintf(nc, "RTSP/1.0 200 OK\r\nCSeq: %v\r\n"+
+				"Session: 42\r\n\r\n", cseq)
+			// a keepalive reply, then RTCP and RTP
+			fmt.Fprintf(nc, "RTSP/1.0 200 OK\r\nCSeq: 99\r\n\r\n")
+			nc.Write([]byte{'$', 3, 0, 2, 0x80, 0xc8})
+			nc.Write([]byte{'$', 2, 0, 3, 1, 2, 3})
+		default:
+			t.Errorf("Unexpected method %v", method)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go serveCamera(t, l)
+
+	u, err := url.Parse(
+		"rtsp://admin:secret@" + l.Addr().String() + "/stream",
+	)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	c, err := dial(u, time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.close()
+
+	uri := "rtsp://" + l.Addr().String() + "/stream"
+	base, tr, err := c.describe(uri)
+	if err != nil {
+		t.Fatalf("describe: %v", err)
+	}
+	if base != uri+"/" {
+		t.Errorf("Base %v", base)
+	}
+	channel, timeout, err := c.setup(tr.control)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	if channel != 2 || timeout != 30*time.Second {
+		t.Errorf("Setup: got %v %v", channel, timeout)
+	}
+	err = c.play(base)
+	if err != nil {
+		t.Fatalf("play: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	ch, data, err := c.readPacket(buf)
+	if err != nil || ch != 3 || !bytes.Equal(data, []byte{0x80, 0xc8}) {
+		t.Errorf("readPacket: got %v %v %v", ch, data, err)
+	}
+	ch, data, err = c.readPacket(buf)
+	if err != nil || ch != 2 || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("readPacket: got %v %v %v", ch, data, err)
+	}
+}
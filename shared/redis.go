@@ -0,0 +1,313 @@
+package shared
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisTimeout = 5 * time.Second
+
+// all keys are stored under this prefix
+const redisNamespace = "galene:"
+
+// redisError is an error returned by the server.
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// Redis is a store backed by a Redis server.  It uses a single
+// connection, which is reestablished when an error occurs.
+type Redis struct {
+	address  string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func openRedis(u *url.URL) (*Redis, error) {
+	r := &Redis{
+		address: u.Host,
+	}
+	if u.Port() == "" {
+		r.address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		db, err := strconv.Atoi(p)
+		if err != nil || db < 0 {
+			return nil, errors.New("bad Redis database " + p)
+		}
+		r.db = db
+	}
+
+	// check that the server is reachable
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.do("PING")
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// called locked
+func (r *Redis) connect() error {
+	conn, err := net.DialTimeout("tcp", r.address, redisTimeout)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.r = bufio.NewReader(conn)
+	if r.password != "" {
+		_, err = r.command("AUTH", r.password)
+		if err != nil {
+			r.close()
+			return err
+		}
+	}
+	if r.db != 0 {
+		_, err = r.command("SELECT", strconv.Itoa(r.db))
+		if err != nil {
+			r.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// called locked
+func (r *Redis) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+		r.r = nil
+	}
+}
+
+// do sends a command, connecting if necessary.  If an existing
+// connection fails, which happens after the server restarts, commands
+// other than SET NX are retried once.  Called locked.
+func (r *Redis) do(args ...string) (interface{}, error) {
+	reused := r.conn != nil
+	if !reused {
+		err := r.connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+	v, err := r.command(args...)
+	if err != nil {
+		var rerr redisError
+		if errors.As(err, &rerr) {
+			return nil, err
+		}
+		// the connection is in an unknown state
+		r.close()
+		if reused && args[len(args)-1] != "NX" {
+			return r.do(args...)
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// command sends a command on the current connection and returns the
+// reply.  Called locked.
+func (r *Redis) command(args ...string) (interface{}, error) {
+	r.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b []byte
+	b = append(b, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, a := range args {
+		b = append(b, fmt.Sprintf("$%d\r\n", len(a))...)
+		b = append(b, a...)
+		b = append(b, '\r', '\n')
+	}
+	_, err := r.conn.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	return readReply(r.r)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: bad reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a reply in RESP format.  Strings are returned as
+// []byte, integers as int64, arrays as []interface{}, and nil values as
+// nil.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	default:
+		return nil, errors.New("redis: bad reply")
+	}
+}
+
+func (r *Redis) Get(key string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, err := r.do("GET", redisNamespace+key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, errors.New("redis: unexpected reply")
+	}
+	return b, nil
+}
+
+func setArgs(key string, value []byte, ttl time.Duration) []string {
+	args := []string{"SET", redisNamespace + key, string(value)}
+	if ttl > 0 {
+		ms := int64(ttl / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		args = append(args, "PX", strconv.FormatInt(ms, 10))
+	}
+	return args
+}
+
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.do(setArgs(key, value, ttl)...)
+	return err
+}
+
+func (r *Redis) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, err := r.do(append(setArgs(key, value, ttl), "NX")...)
+	if err != nil {
+		return false, err
+	}
+	return v != nil, nil
+}
+
+func (r *Redis) Delete(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.do("DEL", redisNamespace+key)
+	return err
+}
+
+// escapeGlob escapes the characters that are special in Redis
+// patterns.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (r *Redis) Keys(prefix string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pattern := escapeGlob(redisNamespace+prefix) + "*"
+	var keys []string
+	cursor := "0"
+	for {
+		v, err := r.do("SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		a, ok := v.([]interface{})
+		if !ok || len(a) != 2 {
+			return nil, errors.New("redis: unexpected reply")
+		}
+		c, ok1 := a[0].([]byte)
+		ks, ok2 := a[1].([]interface{})
+		if !ok1 || !ok2 {
+			return nil, errors.New("redis: unexpected reply")
+		}
+		for _, k := range ks {
+			kb, ok := k.([]byte)
+			if ok {
+				keys = append(keys,
+					strings.TrimPrefix(string(kb), redisNamespace),
+				)
+			}
+		}
+		cursor = string(c)
+		if cursor == "0" {
+			break
+		}
+	}
+	return keys, nil
+}
+
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.close()
+	return nil
+}
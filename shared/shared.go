@@ -0,0 +1,147 @@
+// Package shared implements a store for the state that must be
+// consistent across several instances of Galene running behind the
+// same name, such as stateful tokens and group locks.
+package shared
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Store is a key-value store shared between instances.
+type Store interface {
+	// Get returns the value associated with a key, or nil if the
+	// key doesn't exist.
+	Get(key string) ([]byte, error)
+	// Set sets the value of a key.  If ttl is not zero, the key
+	// expires after ttl.
+	Set(key string, value []byte, ttl time.Duration) error
+	// SetNX sets the value of a key if it doesn't exist already, and
+	// returns true if it did so.
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+	// Delete deletes a key.  It is not an error if the key doesn't
+	// exist.
+	Delete(key string) error
+	// Keys returns the keys that start with prefix.
+	Keys(prefix string) ([]string, error)
+	Close() error
+}
+
+// Open opens the store at the given URL, which is either "memory:" for
+// a store local to this process or "redis://[:password@]host[:port][/db]".
+func Open(u string) (Store, error) {
+	url, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	switch url.Scheme {
+	case "memory":
+		return NewMemory(), nil
+	case "redis":
+		r, err := openRedis(url)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	default:
+		return nil, errors.New("unknown store " + url.Scheme)
+	}
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// Memory is a store that is local to this process, used for testing.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]entry)}
+}
+
+// called locked
+func (m *Memory) get(key string) ([]byte, bool) {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(m.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+// called locked
+func (m *Memory) set(key string, value []byte, ttl time.Duration) {
+	var expires time.Time
+	if ttl != 0 {
+		expires = time.Now().Add(ttl)
+	}
+	m.entries[key] = entry{
+		value:   append([]byte(nil), value...),
+		expires: expires,
+	}
+}
+
+func (m *Memory) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.get(key)
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (m *Memory) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(key, value, ttl)
+	return nil
+}
+
+func (m *Memory) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.get(key); ok {
+		return false, nil
+	}
+	m.set(key, value, ttl)
+	return true, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *Memory) Keys(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for k := range m.entries {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if _, ok := m.get(k); ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,261 @@
+package shared
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, s Store) {
+	v, err := s.Get("a")
+	if err != nil || v != nil {
+		t.Errorf("Get missing: %v %v", v, err)
+	}
+
+	err = s.Set("a", []byte("1"), 0)
+	if err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	v, err = s.Get("a")
+	if err != nil || string(v) != "1" {
+		t.Errorf("Get: %v %v", v, err)
+	}
+
+	ok, err := s.SetNX("a", []byte("2"), 0)
+	if err != nil || ok {
+		t.Errorf("SetNX existing: %v %v", ok, err)
+	}
+	ok, err = s.SetNX("b*", []byte("2"), 0)
+	if err != nil || !ok {
+		t.Errorf("SetNX: %v %v", ok, err)
+	}
+
+	err = s.Set("c", []byte("3"), 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	keys, err := s.Keys("")
+	if err != nil || strings.Join(keys, " ") != "a b* c" {
+		t.Errorf("Keys: %v %v", keys, err)
+	}
+	keys, err = s.Keys("b*")
+	if err != nil || len(keys) != 1 || keys[0] != "b*" {
+		t.Errorf("Keys: %v %v", keys, err)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	v, err = s.Get("c")
+	if err != nil || v != nil {
+		t.Errorf("Get expired: %v %v", v, err)
+	}
+
+	err = s.Delete("a")
+	if err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	err = s.Delete("a")
+	if err != nil {
+		t.Errorf("Delete missing: %v", err)
+	}
+	v, err = s.Get("a")
+	if err != nil || v != nil {
+		t.Errorf("Get deleted: %v %v", v, err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	s, err := Open("memory:")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+// fakeRedis implements the subset of the Redis protocol that we use,
+// on top of a Memory store.
+type fakeRedis struct {
+	listener net.Listener
+	store    *Memory
+	password string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	f := &fakeRedis{
+		listener: l,
+		store:    NewMemory(),
+		password: password,
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// dropConnections closes all client connections.
+func (f *fakeRedis) dropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) close() {
+	f.listener.Close()
+	f.dropConnections()
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := f.password == ""
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return
+		}
+		a, ok := v.([]interface{})
+		if !ok || len(a) == 0 {
+			return
+		}
+		args := make([]string, len(a))
+		for i := range a {
+			args[i] = string(a[i].([]byte))
+		}
+
+		reply := "+OK\r\n"
+		switch {
+		case args[0] == "AUTH":
+			if args[1] != f.password {
+				reply = "-WRONGPASS invalid password\r\n"
+			} else {
+				authenticated = true
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required\r\n"
+		case args[0] == "PING":
+			reply = "+PONG\r\n"
+		case args[0] == "SELECT":
+		case args[0] == "GET":
+			v, _ := f.store.Get(args[1])
+			if v == nil {
+				reply = "$-1\r\n"
+			} else {
+				reply = bulk(string(v))
+			}
+		case args[0] == "SET":
+			var ttl time.Duration
+			nx := false
+			for i := 3; i < len(args); i++ {
+				switch args[i] {
+				case "PX":
+					ms, _ := strconv.Atoi(args[i+1])
+					ttl = time.Duration(ms) * time.Millisecond
+					i++
+				case "NX":
+					nx = true
+				}
+			}
+			if nx {
+				ok, _ := f.store.SetNX(args[1], []byte(args[2]), ttl)
+				if !ok {
+					reply = "$-1\r\n"
+				}
+			} else {
+				f.store.Set(args[1], []byte(args[2]), ttl)
+			}
+		case args[0] == "DEL":
+			f.store.Delete(args[1])
+			reply = ":1\r\n"
+		case args[0] == "SCAN":
+			// a single iteration, with an unescaped prefix
+			prefix := strings.TrimSuffix(args[3], "*")
+			prefix = strings.ReplaceAll(prefix, "\\", "")
+			keys, _ := f.store.Keys(prefix)
+			reply = "*2\r\n" + bulk("0") +
+				fmt.Sprintf("*%d\r\n", len(keys))
+			for _, k := range keys {
+				m, _ := path.Match(args[3], k)
+				if !m {
+					panic("bad pattern " + args[3])
+				}
+				reply += bulk(k)
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		_, err = conn.Write([]byte(reply))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestRedis(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	defer f.close()
+	addr := f.listener.Addr().String()
+
+	_, err := Open("redis://:wrong@" + addr + "/1")
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected WRONGPASS, got %v", err)
+	}
+
+	s, err := Open("redis://:secret@" + addr + "/1")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	testStore(t, s)
+
+	keys, _ := f.store.Keys("")
+	if len(keys) != 1 || keys[0] != "galene:b*" {
+		t.Errorf("Bad keys %v", keys)
+	}
+
+	// the connection is reestablished after an error
+	f.dropConnections()
+	v, err := s.Get("b*")
+	if err != nil || string(v) != "2" {
+		t.Errorf("Get after reconnect: %v %v", v, err)
+	}
+
+	// but SET NX is not retried
+	f.dropConnections()
+	_, err = s.SetNX("d", []byte("4"), 0)
+	if err == nil {
+		t.Errorf("SetNX succeeded on a closed connection")
+	}
+	ok, err := s.SetNX("d", []byte("4"), 0)
+	if err != nil || !ok {
+		t.Errorf("SetNX after reconnect: %v %v", ok, err)
+	}
+}
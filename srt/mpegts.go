@@ -0,0 +1,323 @@
+package srt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// This file implements a minimal MPEG-TS demultiplexer, which is
+// sufficient for the streams sent by live encoders: a single program,
+// with PSI sections that fit in a single TS packet.
+
+const tsPacketSize = 188
+
+// MPEG-TS stream types
+const (
+	streamTypeAAC     = 0x0F
+	streamTypeH264    = 0x1B
+	streamTypeHEVC    = 0x24
+	streamTypePrivate = 0x06
+)
+
+// the kinds of elementary streams that we know about
+const (
+	esUnknown = iota
+	esH264
+	esOpus
+	esAAC
+	esHEVC
+)
+
+var errTSSync = errors.New("lost MPEG-TS synchronisation")
+
+// An esStream is an elementary stream being reassembled.
+type esStream struct {
+	kind int
+	// the continuity counter of the last packet, or -1
+	cc int
+	// the PES packet being reassembled, nil if we are waiting for the
+	// start of the next one
+	pes []byte
+}
+
+// A demuxer extracts the PES packets from an MPEG-TS stream.
+type demuxer struct {
+	pmtPID  uint16
+	streams map[uint16]*esStream
+	// called for every complete PES packet; pts is only valid if
+	// hasPTS is true
+	onPES func(kind int, pts uint64, hasPTS bool, data []byte)
+}
+
+func newDemuxer(onPES func(kind int, pts uint64, hasPTS bool, data []byte)) *demuxer {
+	return &demuxer{
+		pmtPID:  0x1FFF,
+		streams: make(map[uint16]*esStream),
+		onPES:   onPES,
+	}
+}
+
+// write processes a sequence of TS packets.
+func (d *demuxer) write(data []byte) error {
+	if len(data)%tsPacketSize != 0 {
+		return errTSSync
+	}
+	for i := 0; i < len(data); i += tsPacketSize {
+		err := d.packet(data[i : i+tsPacketSize])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *demuxer) packet(p []byte) error {
+	if p[0] != 0x47 {
+		return errTSSync
+	}
+	start := p[1]&0x40 != 0
+	pid := binary.BigEndian.Uint16(p[1:]) & 0x1FFF
+	afc := (p[3] >> 4) & 3
+	cc := int(p[3] & 0xF)
+
+	payload := p[4:]
+	if afc&2 != 0 {
+		n := int(p[4])
+		if 5+n > len(p) {
+			return nil
+		}
+		payload = p[5+n:]
+	}
+	if afc&1 == 0 {
+		payload = nil
+	}
+
+	if pid == 0 || pid == d.pmtPID {
+		if start && len(payload) > 0 {
+			d.psi(pid, payload)
+		}
+		return nil
+	}
+
+	s := d.streams[pid]
+	if s == nil || payload == nil {
+		return nil
+	}
+	if s.cc >= 0 && cc == s.cc {
+		// duplicate packet
+		return nil
+	}
+	if s.cc >= 0 && cc != (s.cc+1)&0xF {
+		// packets were lost, drop the incomplete PES packet
+		s.pes = nil
+	}
+	s.cc = cc
+
+	if start {
+		d.flush(s)
+		s.pes = append(make([]byte, 0, 4096), payload...)
+	} else if s.pes != nil {
+		s.pes = append(s.pes, payload...)
+	}
+
+	// flush as soon as possible if the length is known
+	if len(s.pes) >= 6 {
+		n := int(binary.BigEndian.Uint16(s.pes[4:]))
+		if n != 0 && len(s.pes) >= 6+n {
+			s.pes = s.pes[:6+n]
+			d.flush(s)
+		}
+	}
+	return nil
+}
+
+// flush delivers the PES packet being reassembled, if any.
+func (d *demuxer) flush(s *esStream) {
+	pes := s.pes
+	s.pes = nil
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return
+	}
+	n := 9 + int(pes[8])
+	if n > len(pes) {
+		return
+	}
+	var pts uint64
+	hasPTS := pes[7]&0x80 != 0 && n >= 14
+	if hasPTS {
+		pts = parsePTS(pes[9:])
+	}
+	if d.onPES != nil {
+		d.onPES(s.kind, pts, hasPTS, pes[n:])
+	}
+}
+
+func parsePTS(b []byte) uint64 {
+	return uint64(b[0]>>1&7)<<30 | uint64(b[1])<<22 |
+		uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// psi parses a PAT or a PMT.
+func (d *demuxer) psi(pid uint16, payload []byte) {
+	pointer := int(payload[0])
+	if 1+pointer >= len(payload) {
+		return
+	}
+	section := payload[1+pointer:]
+	if len(section) < 12 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(section[1:]) & 0xFFF)
+	if 3+length > len(section) || length < 13 {
+		return
+	}
+	// skip the header and the CRC
+	body := section[8 : 3+length-4]
+
+	switch {
+	case pid == 0 && section[0] == 0:
+		for i := 0; i+4 <= len(body); i += 4 {
+			program := binary.BigEndian.Uint16(body[i:])
+			if program != 0 {
+				d.pmtPID = binary.BigEndian.Uint16(body[i+2:]) &
+					0x1FFF
+				return
+			}
+		}
+	case pid == d.pmtPID && section[0] == 2:
+		d.pmt(body)
+	}
+}
+
+func (d *demuxer) pmt(body []byte) {
+	if len(body) < 4 {
+		return
+	}
+	infoLength := int(binary.BigEndian.Uint16(body[2:]) & 0xFFF)
+	if 4+infoLength > len(body) {
+		return
+	}
+	streams := make(map[uint16]*esStream)
+	es := body[4+infoLength:]
+	for len(es) >= 5 {
+		typ := es[0]
+		pid := binary.BigEndian.Uint16(es[1:]) & 0x1FFF
+		n := int(binary.BigEndian.Uint16(es[3:]) & 0xFFF)
+		if 5+n > len(es) {
+			break
+		}
+		kind := esKind(typ, es[5:5+n])
+		if s := d.streams[pid]; s != nil && s.kind == kind {
+			streams[pid] = s
+		} else {
+			streams[pid] = &esStream{kind: kind, cc: -1}
+		}
+		es = es[5+n:]
+	}
+	d.streams = streams
+}
+
+// esKind determines the kind of an elementary stream from its stream
+// type and its descriptors.
+func esKind(typ uint8, descriptors []byte) int {
+	switch typ {
+	case streamTypeH264:
+		return esH264
+	case streamTypeAAC:
+		return esAAC
+	case streamTypeHEVC:
+		return esHEVC
+	case streamTypePrivate:
+		for len(descriptors) >= 2 {
+			tag := descriptors[0]
+			n := int(descriptors[1])
+			if 2+n > len(descriptors) {
+				break
+			}
+			// registration descriptor
+			if tag == 0x05 && n >= 4 &&
+				string(descriptors[2:6]) == "Opus" {
+				return esOpus
+			}
+			descriptors = descriptors[2+n:]
+		}
+	}
+	return esUnknown
+}
+
+// opusPackets splits the payload of an Opus PES packet into Opus
+// packets.  Each packet is preceded by a control header, which contains
+// its size and optional trimming information that we ignore.
+func opusPackets(data []byte) ([][]byte, error) {
+	var packets [][]byte
+	for len(data) > 0 {
+		if len(data) < 2 ||
+			binary.BigEndian.Uint16(data)&0xFFE0 != 0x7FE0 {
+			return packets, errors.New("bad Opus control header")
+		}
+		startTrim := data[1]&0x10 != 0
+		endTrim := data[1]&0x08 != 0
+		extension := data[1]&0x04 != 0
+		data = data[2:]
+		size := 0
+		for {
+			if len(data) < 1 {
+				return packets, errShortPacket
+			}
+			b := data[0]
+			data = data[1:]
+			size += int(b)
+			if b != 0xFF {
+				break
+			}
+		}
+		skip := 0
+		if startTrim {
+			skip += 2
+		}
+		if endTrim {
+			skip += 2
+		}
+		if extension {
+			if len(data) < skip+1 {
+				return packets, errShortPacket
+			}
+			skip += 1 + int(data[skip])
+		}
+		if len(data) < skip+size {
+			return packets, errShortPacket
+		}
+		packets = append(packets, data[skip:skip+size])
+		data = data[skip+size:]
+	}
+	return packets, nil
+}
+
+// opusDuration returns the duration of an Opus packet in samples at
+// 48kHz, as specified in RFC 6716 Section 3.1.
+func opusDuration(packet []byte) int {
+	if len(packet) < 1 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frame int
+	switch {
+	case config < 12:
+		frame = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		frame = []int{480, 960}[config%2]
+	default:
+		frame = []int{120, 240, 480, 960}[config%4]
+	}
+	switch packet[0] & 3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return int(packet[1]&0x3F) * frame
+	}
+}
@@ -0,0 +1,191 @@
+package srt
+
+import (
+	"bytes"
+	"testing"
+)
+
+// tsPackets splits a payload into TS packets, padding the last one with
+// an adaptation field.
+func tsPackets(pid uint16, cc *int, data []byte) []byte {
+	var out []byte
+	start := true
+	for len(data) > 0 {
+		p := make([]byte, tsPacketSize)
+		p[0] = 0x47
+		p[1] = byte(pid >> 8)
+		if start {
+			p[1] |= 0x40
+		}
+		p[2] = byte(pid)
+		p[3] = 0x10 | byte(*cc&0xF)
+		*cc++
+		n := len(data)
+		if n >= tsPacketSize-4 {
+			n = tsPacketSize - 4
+			copy(p[4:], data[:n])
+		} else {
+			p[3] |= 0x20
+			af := tsPacketSize - 4 - n - 1
+			p[4] = byte(af)
+			for i := 0; i < af; i++ {
+				p[5+i] = 0xFF
+			}
+			if af > 0 {
+				p[5] = 0
+			}
+			copy(p[5+af:], data)
+		}
+		out = append(out, p...)
+		data = data[n:]
+		start = false
+	}
+	return out
+}
+
+// section returns a PSI section preceded by a pointer field.
+func section(tableId byte, body []byte) []byte {
+	length := 5 + len(body) + 4
+	s := []byte{0, tableId, 0xB0 | byte(length>>8), byte(length),
+		0, 1, 0xC1, 0, 0}
+	s = append(s, body...)
+	return append(s, 0, 0, 0, 0)
+}
+
+func pes(streamId byte, pts uint64, data []byte, withLength bool) []byte {
+	h := []byte{0, 0, 1, streamId, 0, 0, 0x80, 0x80, 5,
+		byte(0x21 | (pts>>29)&0x0E), byte(pts >> 22),
+		byte(1 | (pts>>14)&0xFE), byte(pts >> 7), byte(1 | (pts<<1)&0xFE),
+	}
+	if withLength {
+		n := len(h) - 6 + len(data)
+		h[4] = byte(n >> 8)
+		h[5] = byte(n)
+	}
+	return append(h, data...)
+}
+
+type pesRecord struct {
+	kind int
+	pts  uint64
+	data []byte
+}
+
+func TestDemuxer(t *testing.T) {
+	var got []pesRecord
+	d := newDemuxer(func(kind int, pts uint64, hasPTS bool, data []byte) {
+		if !hasPTS {
+			t.Errorf("No PTS")
+		}
+		got = append(got, pesRecord{kind, pts,
+			append([]byte(nil), data...)})
+	})
+
+	var ts []byte
+	var patCC, pmtCC, videoCC, audioCC int
+	ts = append(ts, tsPackets(0, &patCC,
+		section(0, []byte{0, 1, 0xE1, 0x00}))...)
+	ts = append(ts, tsPackets(0x100, &pmtCC, section(2, []byte{
+		0xE1, 0x01, 0xF0, 0x00,
+		streamTypeH264, 0xE1, 0x01, 0xF0, 0x00,
+		streamTypePrivate, 0xE1, 0x02, 0xF0, 0x06,
+		0x05, 0x04, 'O', 'p', 'u', 's',
+	}))...)
+
+	video := bytes.Repeat([]byte{0, 0, 0, 1, 0x65, 0xAA}, 100)
+	ts = append(ts, tsPackets(0x101, &videoCC,
+		pes(0xE0, 1<<33-1, video, false))...)
+	// two Opus packets of 20ms
+	opus := []byte{0x7F, 0xE0, 3, 0x78, 1, 2, 0x7F, 0xE0, 2, 0x78, 3}
+	ts = append(ts, tsPackets(0x102, &audioCC,
+		pes(0xC0, 1800, opus, true))...)
+	// the next access unit flushes the first one
+	ts = append(ts, tsPackets(0x101, &videoCC,
+		pes(0xE0, 3000, []byte{0, 0, 0, 1, 0x41}, false))...)
+
+	for i := 0; i < len(ts); i += 7 * tsPacketSize {
+		end := i + 7*tsPacketSize
+		if end > len(ts) {
+			end = len(ts)
+		}
+		err := d.write(ts[i:end])
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 PES packets, got %v", len(got))
+	}
+	if got[0].kind != esOpus || got[0].pts != 1800 {
+		t.Errorf("Bad audio %v %v", got[0].kind, got[0].pts)
+	}
+	packets, err := opusPackets(got[0].data)
+	if err != nil || len(packets) != 2 ||
+		!bytes.Equal(packets[0], []byte{0x78, 1, 2}) ||
+		!bytes.Equal(packets[1], []byte{0x78, 3}) {
+		t.Errorf("Bad Opus packets %v %v", packets, err)
+	}
+	if got[1].kind != esH264 || got[1].pts != 1<<33-1 ||
+		!bytes.Equal(got[1].data, video) {
+		t.Errorf("Bad video %v %v %v",
+			got[1].kind, got[1].pts, len(got[1].data))
+	}
+}
+
+func TestDemuxerLoss(t *testing.T) {
+	count := 0
+	d := newDemuxer(func(kind int, pts uint64, hasPTS bool, data []byte) {
+		count++
+	})
+	var patCC, pmtCC, videoCC int
+	d.write(tsPackets(0, &patCC, section(0, []byte{0, 1, 0xE1, 0x00})))
+	d.write(tsPackets(0x100, &pmtCC, section(2, []byte{
+		0xE1, 0x01, 0xF0, 0x00,
+		streamTypeH264, 0xE1, 0x01, 0xF0, 0x00,
+	})))
+	video := tsPackets(0x101, &videoCC,
+		pes(0xE0, 0, make([]byte, 1000), false))
+	// drop the second packet
+	d.write(video[:tsPacketSize])
+	d.write(video[2*tsPacketSize:])
+	d.write(tsPackets(0x101, &videoCC, pes(0xE0, 0, []byte{1}, false)))
+	d.write(tsPackets(0x101, &videoCC, pes(0xE0, 0, []byte{2}, false)))
+	if count != 1 {
+		t.Errorf("Expected 1 PES packet, got %v", count)
+	}
+}
+
+func TestOpusDuration(t *testing.T) {
+	tests := []struct {
+		packet   []byte
+		duration int
+	}{
+		{[]byte{0x78}, 960},        // CELT 20ms
+		{[]byte{0x79}, 1920},       // two frames
+		{[]byte{0x7B, 0x03}, 2880}, // three frames
+		{[]byte{0x08}, 960},        // SILK 20ms
+		{[]byte{0x18}, 2880},       // SILK 60ms
+		{[]byte{0x60}, 480},        // hybrid 10ms
+		{[]byte{0x80}, 120},        // CELT 2.5ms
+		{[]byte{}, 0},
+	}
+	for _, tt := range tests {
+		if d := opusDuration(tt.packet); d != tt.duration {
+			t.Errorf("%v: expected %v, got %v",
+				tt.packet, tt.duration, d)
+		}
+	}
+}
+
+func TestPTSClock(t *testing.T) {
+	var c ptsClock
+	a := c.ms(1<<33 - 90)
+	b := c.ms(90)
+	if b-a != 2 {
+		t.Errorf("Expected 2ms across wraparound, got %v", b-a)
+	}
+	if e := c.ms(1<<33 - 90*2); a-e != 1 {
+		t.Errorf("Expected -1ms, got %v", int32(e-a))
+	}
+}
@@ -0,0 +1,319 @@
+package srt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// This file implements the wire format of SRT packets, as described in
+// draft-sharabayko-srt.
+
+const headerSize = 16
+
+// control packet types
+const (
+	ctrlHandshake = 0
+	ctrlKeepalive = 1
+	ctrlACK       = 2
+	ctrlNAK       = 3
+	ctrlShutdown  = 5
+	ctrlACKACK    = 6
+	ctrlDropReq   = 7
+)
+
+// handshake types; values above 1000 are rejections
+const (
+	hsInduction  = 1
+	hsConclusion = 0xFFFFFFFF
+	hsRejectBase = 1000
+)
+
+// rejection reasons, see srt_rejectreason_t and the access control
+// guidelines of libsrt
+const (
+	rejPeer         = 2
+	rejRogue        = 4
+	rejVersion      = 8
+	rejUnsecure     = 11
+	rejMessageAPI   = 12
+	rejCongestion   = 13
+	rejFilter       = 14
+	rejGroup        = 15
+	rejBadRequest   = 1400
+	rejUnauthorized = 1401
+	rejNotFound     = 1404
+	rejBadMode      = 1405
+)
+
+// handshake extension types
+const (
+	extHSReq      = 1
+	extHSRsp      = 2
+	extKMReq      = 3
+	extSID        = 5
+	extCongestion = 6
+	extFilter     = 7
+	extGroup      = 8
+)
+
+// flags of the extension field of the conclusion handshake
+const (
+	extFlagHSReq  = 0x1
+	extFlagKMReq  = 0x2
+	extFlagConfig = 0x4
+)
+
+// SRT flags, negotiated by the HSREQ and HSRSP extensions
+const (
+	flagTSBPDSnd  = 0x01
+	flagTSBPDRcv  = 0x02
+	flagCrypt     = 0x04
+	flagTLPktDrop = 0x08
+	flagNAKReport = 0x10
+	flagRexmit    = 0x20
+	flagStream    = 0x40
+)
+
+// the magic value sent in the extension field of the induction response
+const srtMagic = 0x4A17
+
+// the SRT version that we announce, 1.5.0
+const srtVersion = 0x010500
+
+var errShortPacket = errors.New("SRT packet too short")
+
+// seqnoMask is the mask of the 31-bit sequence numbers.
+const seqnoMask = 0x7FFFFFFF
+
+// seqnoDiff returns a - b, taking wraparound into account.
+func seqnoDiff(a, b uint32) int32 {
+	// sign-extend the 31-bit difference
+	return int32((a-b)<<1) >> 1
+}
+
+// A dataPacket is a packet carrying media.
+type dataPacket struct {
+	seqno   uint32
+	msgno   uint32
+	encrypt uint8
+	rexmit  bool
+	ts      uint32
+	dest    uint32
+	payload []byte
+}
+
+// A controlPacket is a packet carrying control information.
+type controlPacket struct {
+	typ     uint16
+	subtype uint16
+	info    uint32
+	ts      uint32
+	dest    uint32
+	cif     []byte
+}
+
+func isControl(buf []byte) bool {
+	return len(buf) > 0 && buf[0]&0x80 != 0
+}
+
+func parseData(buf []byte) (*dataPacket, error) {
+	if len(buf) < headerSize {
+		return nil, errShortPacket
+	}
+	w1 := binary.BigEndian.Uint32(buf[4:])
+	return &dataPacket{
+		seqno:   binary.BigEndian.Uint32(buf) & seqnoMask,
+		encrypt: uint8(w1>>27) & 3,
+		rexmit:  w1&(1<<26) != 0,
+		msgno:   w1 & 0x3FFFFFF,
+		ts:      binary.BigEndian.Uint32(buf[8:]),
+		dest:    binary.BigEndian.Uint32(buf[12:]),
+		payload: buf[headerSize:],
+	}, nil
+}
+
+func parseControl(buf []byte) (*controlPacket, error) {
+	if len(buf) < headerSize {
+		return nil, errShortPacket
+	}
+	return &controlPacket{
+		typ:     binary.BigEndian.Uint16(buf) & 0x7FFF,
+		subtype: binary.BigEndian.Uint16(buf[2:]),
+		info:    binary.BigEndian.Uint32(buf[4:]),
+		ts:      binary.BigEndian.Uint32(buf[8:]),
+		dest:    binary.BigEndian.Uint32(buf[12:]),
+		cif:     buf[headerSize:],
+	}, nil
+}
+
+func (p *controlPacket) marshal() []byte {
+	buf := make([]byte, headerSize+len(p.cif))
+	binary.BigEndian.PutUint16(buf, 0x8000|p.typ)
+	binary.BigEndian.PutUint16(buf[2:], p.subtype)
+	binary.BigEndian.PutUint32(buf[4:], p.info)
+	binary.BigEndian.PutUint32(buf[8:], p.ts)
+	binary.BigEndian.PutUint32(buf[12:], p.dest)
+	copy(buf[headerSize:], p.cif)
+	return buf
+}
+
+// An extension is a handshake extension.  The contents are a sequence
+// of 32-bit words.
+type extension struct {
+	typ  uint16
+	data []byte
+}
+
+// A handshake is the contents of a handshake control packet.
+type handshake struct {
+	version    uint32
+	encryption uint16
+	extFlags   uint16
+	isn        uint32
+	mtu        uint32
+	window     uint32
+	typ        uint32
+	socket     uint32
+	cookie     uint32
+	peerIP     [16]byte
+	extensions []extension
+}
+
+const handshakeSize = 48
+
+func parseHandshake(cif []byte) (*handshake, error) {
+	if len(cif) < handshakeSize {
+		return nil, errShortPacket
+	}
+	hs := &handshake{
+		version:    binary.BigEndian.Uint32(cif),
+		encryption: binary.BigEndian.Uint16(cif[4:]),
+		extFlags:   binary.BigEndian.Uint16(cif[6:]),
+		isn:        binary.BigEndian.Uint32(cif[8:]) & seqnoMask,
+		mtu:        binary.BigEndian.Uint32(cif[12:]),
+		window:     binary.BigEndian.Uint32(cif[16:]),
+		typ:        binary.BigEndian.Uint32(cif[20:]),
+		socket:     binary.BigEndian.Uint32(cif[24:]),
+		cookie:     binary.BigEndian.Uint32(cif[28:]),
+	}
+	copy(hs.peerIP[:], cif[32:48])
+	data := cif[handshakeSize:]
+	for len(data) >= 4 {
+		typ := binary.BigEndian.Uint16(data)
+		n := 4 * int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+n {
+			return nil, errShortPacket
+		}
+		hs.extensions = append(hs.extensions,
+			extension{typ: typ, data: data[4 : 4+n]},
+		)
+		data = data[4+n:]
+	}
+	return hs, nil
+}
+
+func (hs *handshake) marshal() []byte {
+	n := handshakeSize
+	for _, e := range hs.extensions {
+		n += 4 + len(e.data)
+	}
+	buf := make([]byte, n)
+	binary.BigEndian.PutUint32(buf, hs.version)
+	binary.BigEndian.PutUint16(buf[4:], hs.encryption)
+	binary.BigEndian.PutUint16(buf[6:], hs.extFlags)
+	binary.BigEndian.PutUint32(buf[8:], hs.isn)
+	binary.BigEndian.PutUint32(buf[12:], hs.mtu)
+	binary.BigEndian.PutUint32(buf[16:], hs.window)
+	binary.BigEndian.PutUint32(buf[20:], hs.typ)
+	binary.BigEndian.PutUint32(buf[24:], hs.socket)
+	binary.BigEndian.PutUint32(buf[28:], hs.cookie)
+	copy(buf[32:48], hs.peerIP[:])
+	p := buf[handshakeSize:]
+	for _, e := range hs.extensions {
+		binary.BigEndian.PutUint16(p, e.typ)
+		binary.BigEndian.PutUint16(p[2:], uint16(len(e.data)/4))
+		copy(p[4:], e.data)
+		p = p[4+len(e.data):]
+	}
+	return buf
+}
+
+func (hs *handshake) extension(typ uint16) []byte {
+	for _, e := range hs.extensions {
+		if e.typ == typ {
+			return e.data
+		}
+	}
+	return nil
+}
+
+// hsReq is the contents of the HSREQ and HSRSP extensions.
+type hsReq struct {
+	version uint32
+	flags   uint32
+	// the TSBPD delays, in milliseconds
+	recvDelay, sendDelay uint16
+}
+
+func parseHSReq(data []byte) (hsReq, error) {
+	if len(data) < 12 {
+		return hsReq{}, errShortPacket
+	}
+	return hsReq{
+		version:   binary.BigEndian.Uint32(data),
+		flags:     binary.BigEndian.Uint32(data[4:]),
+		recvDelay: binary.BigEndian.Uint16(data[8:]),
+		sendDelay: binary.BigEndian.Uint16(data[10:]),
+	}, nil
+}
+
+func (r hsReq) marshal() []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf, r.version)
+	binary.BigEndian.PutUint32(buf[4:], r.flags)
+	binary.BigEndian.PutUint16(buf[8:], r.recvDelay)
+	binary.BigEndian.PutUint16(buf[10:], r.sendDelay)
+	return buf
+}
+
+// decodeString decodes a string extension, such as the stream id.
+// Strings are padded with zeroes to a multiple of four bytes, and each
+// 32-bit word is stored in little-endian order.
+func decodeString(data []byte) string {
+	buf := make([]byte, len(data)&^3)
+	for i := 0; i+4 <= len(data); i += 4 {
+		binary.LittleEndian.PutUint32(buf[i:],
+			binary.BigEndian.Uint32(data[i:]))
+	}
+	for len(buf) > 0 && buf[len(buf)-1] == 0 {
+		buf = buf[:len(buf)-1]
+	}
+	return string(buf)
+}
+
+// encodeString is the inverse of decodeString.
+func encodeString(s string) []byte {
+	buf := make([]byte, (len(s)+3)&^3)
+	copy(buf, s)
+	for i := 0; i < len(buf); i += 4 {
+		binary.BigEndian.PutUint32(buf[i:],
+			binary.LittleEndian.Uint32(buf[i:]))
+	}
+	return buf
+}
+
+// lossList encodes a list of sequence number ranges as the contents of
+// a NAK packet.  A range is encoded as its first element with the high
+// bit set, followed by its last element.
+func lossList(ranges [][2]uint32) []byte {
+	var buf []byte
+	for _, r := range ranges {
+		if r[0] == r[1] {
+			buf = binary.BigEndian.AppendUint32(buf, r[0])
+		} else {
+			buf = binary.BigEndian.AppendUint32(buf, r[0]|0x80000000)
+			buf = binary.BigEndian.AppendUint32(buf, r[1])
+		}
+	}
+	return buf
+}
@@ -0,0 +1,108 @@
+package srt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSeqnoDiff(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		d    int32
+	}{
+		{10, 5, 5},
+		{5, 10, -5},
+		{0, seqnoMask, 1},
+		{seqnoMask, 0, -1},
+		{3, seqnoMask - 2, 6},
+	}
+	for _, tt := range tests {
+		if d := seqnoDiff(tt.a, tt.b); d != tt.d {
+			t.Errorf("%v - %v: expected %v, got %v",
+				tt.a, tt.b, tt.d, d)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	hs := &handshake{
+		version:  5,
+		extFlags: extFlagHSReq,
+		isn:      12345,
+		mtu:      1500,
+		window:   8192,
+		typ:      hsConclusion,
+		socket:   42,
+		cookie:   0xdeadbeef,
+		extensions: []extension{
+			{extHSReq, hsReq{srtVersion, flagTSBPDSnd, 0, 120}.marshal()},
+			{extSID, encodeString("group/key")},
+		},
+	}
+	p := &controlPacket{typ: ctrlHandshake, dest: 7, cif: hs.marshal()}
+	buf := p.marshal()
+	if !isControl(buf) {
+		t.Fatalf("Not a control packet")
+	}
+	q, err := parseControl(buf)
+	if err != nil || q.typ != ctrlHandshake || q.dest != 7 {
+		t.Fatalf("parseControl: %v %v", q, err)
+	}
+	hs2, err := parseHandshake(q.cif)
+	if err != nil {
+		t.Fatalf("parseHandshake: %v", err)
+	}
+	if !reflect.DeepEqual(hs, hs2) {
+		t.Errorf("Expected %v, got %v", hs, hs2)
+	}
+	req, err := parseHSReq(hs2.extension(extHSReq))
+	if err != nil || req.sendDelay != 120 || req.flags != flagTSBPDSnd {
+		t.Errorf("parseHSReq: %v %v", req, err)
+	}
+	if sid := decodeString(hs2.extension(extSID)); sid != "group/key" {
+		t.Errorf("Expected group/key, got %v", sid)
+	}
+}
+
+func TestString(t *testing.T) {
+	// the stream id "abcdef" as sent by libsrt
+	data := []byte{'d', 'c', 'b', 'a', 0, 0, 'f', 'e'}
+	if !bytes.Equal(encodeString("abcdef"), data) {
+		t.Errorf("Bad encoding %v", encodeString("abcdef"))
+	}
+	if s := decodeString(data); s != "abcdef" {
+		t.Errorf("Expected abcdef, got %v", s)
+	}
+}
+
+func TestData(t *testing.T) {
+	buf := []byte{
+		0x00, 0x00, 0x01, 0x00,
+		0xC4, 0x00, 0x00, 0x03,
+		0x00, 0x00, 0x10, 0x00,
+		0x00, 0x00, 0x00, 0x2A,
+		1, 2, 3,
+	}
+	p, err := parseData(buf)
+	if err != nil {
+		t.Fatalf("parseData: %v", err)
+	}
+	if p.seqno != 256 || p.msgno != 3 || !p.rexmit || p.encrypt != 0 ||
+		p.ts != 4096 || p.dest != 42 ||
+		!bytes.Equal(p.payload, []byte{1, 2, 3}) {
+		t.Errorf("Bad packet %v", p)
+	}
+}
+
+func TestLossList(t *testing.T) {
+	l := lossList([][2]uint32{{3, 3}, {5, 8}})
+	expected := []byte{
+		0, 0, 0, 3,
+		0x80, 0, 0, 5,
+		0, 0, 0, 8,
+	}
+	if !bytes.Equal(l, expected) {
+		t.Errorf("Expected %v, got %v", expected, l)
+	}
+}
@@ -0,0 +1,188 @@
+package srt
+
+import (
+	"sort"
+	"time"
+)
+
+// A receiver reorders the data packets of a connection, keeps track of
+// the packets that were lost, and delivers packets once their play time,
+// the time at which they were sent plus the latency, has been reached
+// (timestamp-based packet delivery, TSBPD).  Packets that have not been
+// recovered by their play time are skipped (too-late packet drop).
+type receiver struct {
+	latency time.Duration
+
+	started bool
+	// the next packet to deliver
+	next uint32
+	// the highest sequence number received
+	highest uint32
+	buffer  map[uint32]*dataPacket
+	// the lost packets, with the time at which they were last reported
+	lost map[uint32]time.Time
+
+	// the local time corresponding to the sender's timestamp refTS,
+	// assuming a minimal network delay
+	refTS   uint32
+	refTime time.Time
+}
+
+// the largest gap in sequence numbers that is treated as loss, which is
+// also the size of the flow window that we announce
+const maxGap = 8192
+
+func newReceiver(isn uint32, latency time.Duration) *receiver {
+	return &receiver{
+		latency: latency,
+		next:    isn,
+		highest: (isn - 1) & seqnoMask,
+		buffer:  make(map[uint32]*dataPacket),
+		lost:    make(map[uint32]time.Time),
+	}
+}
+
+// sendTime returns the local time corresponding to a timestamp.
+// Timestamps are in microseconds, and wrap around after about 71 minutes.
+func (r *receiver) sendTime(ts uint32) time.Time {
+	return r.refTime.Add(time.Duration(int32(ts-r.refTS)) * time.Microsecond)
+}
+
+// gotData records a data packet, and returns the range of sequence
+// numbers that were found to be lost, if any.
+func (r *receiver) gotData(p *dataPacket, now time.Time) (lost [2]uint32, ok bool) {
+	if !r.started {
+		r.started = true
+		r.refTS = p.ts
+		r.refTime = now
+	} else if t := r.sendTime(p.ts); now.Before(t) {
+		// the packet arrived faster than the earlier ones
+		r.refTS = p.ts
+		r.refTime = now
+	} else if int32(p.ts-r.refTS) > 0 {
+		r.refTime = t
+		r.refTS = p.ts
+	}
+
+	if seqnoDiff(p.seqno, r.next) < 0 {
+		// too late
+		return
+	}
+	if r.buffer[p.seqno] != nil {
+		return
+	}
+	r.buffer[p.seqno] = p
+
+	d := seqnoDiff(p.seqno, r.highest)
+	if d <= 0 {
+		delete(r.lost, p.seqno)
+		return
+	}
+	if d > maxGap {
+		// the sender skipped ahead, don't wait for the packets
+		// in between
+		r.buffer = map[uint32]*dataPacket{p.seqno: p}
+		r.lost = make(map[uint32]time.Time)
+		r.next = p.seqno
+		r.highest = p.seqno
+		return
+	}
+	first := (r.highest + 1) & seqnoMask
+	r.highest = p.seqno
+	if d == 1 {
+		return
+	}
+	last := (p.seqno - 1) & seqnoMask
+	for s := first; s != p.seqno; s = (s + 1) & seqnoMask {
+		r.lost[s] = now
+	}
+	return [2]uint32{first, last}, true
+}
+
+// drop stops waiting for the packets in the given range, which the
+// sender will not retransmit.
+func (r *receiver) drop(first, last uint32) {
+	if seqnoDiff(last, first) < 0 {
+		return
+	}
+	for s := first; ; s = (s + 1) & seqnoMask {
+		delete(r.lost, s)
+		if s == last {
+			break
+		}
+	}
+}
+
+// ackNumber returns the sequence number of the first packet that has
+// not been received.
+func (r *receiver) ackNumber() uint32 {
+	ack := (r.highest + 1) & seqnoMask
+	for s := range r.lost {
+		if seqnoDiff(s, ack) < 0 {
+			ack = s
+		}
+	}
+	if seqnoDiff(ack, r.next) < 0 {
+		ack = r.next
+	}
+	return ack
+}
+
+// deliver returns the packets whose play time has been reached, in
+// order.
+func (r *receiver) deliver(now time.Time) []*dataPacket {
+	var packets []*dataPacket
+	for seqnoDiff(r.highest, r.next) >= 0 {
+		p, ok := r.buffer[r.next]
+		if !ok {
+			// skip the missing packets if a later packet is due
+			s := (r.next + 1) & seqnoMask
+			for r.buffer[s] == nil {
+				s = (s + 1) & seqnoMask
+			}
+			p = r.buffer[s]
+			if now.Before(r.sendTime(p.ts).Add(r.latency)) {
+				break
+			}
+			r.drop(r.next, (s-1)&seqnoMask)
+			r.next = s
+		}
+		if now.Before(r.sendTime(p.ts).Add(r.latency)) {
+			break
+		}
+		delete(r.buffer, r.next)
+		r.next = (r.next + 1) & seqnoMask
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+// lossReport returns the ranges of packets that are still missing and
+// were last reported more than interval ago.
+func (r *receiver) lossReport(now time.Time, interval time.Duration) [][2]uint32 {
+	var seqnos []uint32
+	for s, t := range r.lost {
+		if now.Sub(t) >= interval {
+			seqnos = append(seqnos, s)
+			r.lost[s] = now
+		}
+	}
+	sort.Slice(seqnos, func(i, j int) bool {
+		return seqnoDiff(seqnos[i], seqnos[j]) < 0
+	})
+	var ranges [][2]uint32
+	for _, s := range seqnos {
+		n := len(ranges)
+		if n > 0 && ranges[n-1][1] == (s-1)&seqnoMask {
+			ranges[n-1][1] = s
+			continue
+		}
+		ranges = append(ranges, [2]uint32{s, s})
+	}
+	return ranges
+}
+
+// buffered returns the number of packets in the buffer.
+func (r *receiver) buffered() int {
+	return len(r.buffer)
+}
@@ -0,0 +1,104 @@
+package srt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func seqnos(packets []*dataPacket) []uint32 {
+	var s []uint32
+	for _, p := range packets {
+		s = append(s, p.seqno)
+	}
+	return s
+}
+
+func TestReceiver(t *testing.T) {
+	start := time.Now()
+	latency := 100 * time.Millisecond
+	r := newReceiver(10, latency)
+
+	// packets are sent every 10ms, and arrive immediately
+	packet := func(seqno uint32) *dataPacket {
+		return &dataPacket{seqno: seqno, ts: (seqno - 10) * 10000}
+	}
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	for _, s := range []uint32{10, 11} {
+		_, lost := r.gotData(packet(s), at(int(s-10)*10))
+		if lost {
+			t.Errorf("%v: unexpected loss", s)
+		}
+	}
+	l, lost := r.gotData(packet(14), at(40))
+	if !lost || l != [2]uint32{12, 13} {
+		t.Errorf("Expected loss of 12-13, got %v %v", l, lost)
+	}
+	if a := r.ackNumber(); a != 12 {
+		t.Errorf("Expected ACK 12, got %v", a)
+	}
+
+	if d := r.deliver(at(50)); len(d) != 0 {
+		t.Errorf("Delivered too early: %v", seqnos(d))
+	}
+	if d := seqnos(r.deliver(at(110))); !reflect.DeepEqual(d, []uint32{10, 11}) {
+		t.Errorf("Expected 10 11, got %v", d)
+	}
+
+	// not reported again before the interval
+	if l := r.lossReport(at(45), 20*time.Millisecond); len(l) != 0 {
+		t.Errorf("Reported too early: %v", l)
+	}
+	l2 := r.lossReport(at(60), 20*time.Millisecond)
+	if !reflect.DeepEqual(l2, [][2]uint32{{12, 13}}) {
+		t.Errorf("Expected 12-13, got %v", l2)
+	}
+
+	// a retransmission
+	r.gotData(packet(12), at(70))
+	if a := r.ackNumber(); a != 13 {
+		t.Errorf("Expected ACK 13, got %v", a)
+	}
+	if d := seqnos(r.deliver(at(125))); !reflect.DeepEqual(d, []uint32{12}) {
+		t.Errorf("Expected 12, got %v", d)
+	}
+
+	// 13 is never recovered, and is skipped when 14 is due
+	if d := r.deliver(at(135)); len(d) != 0 {
+		t.Errorf("Delivered too early: %v", seqnos(d))
+	}
+	if d := seqnos(r.deliver(at(140))); !reflect.DeepEqual(d, []uint32{14}) {
+		t.Errorf("Expected 14, got %v", d)
+	}
+	if a := r.ackNumber(); a != 15 {
+		t.Errorf("Expected ACK 15, got %v", a)
+	}
+	if l := r.lossReport(at(200), 0); len(l) != 0 {
+		t.Errorf("Unexpected loss report %v", l)
+	}
+
+	// late and duplicate packets are ignored
+	r.gotData(packet(13), at(150))
+	r.gotData(packet(15), at(150))
+	r.gotData(packet(15), at(150))
+	if d := seqnos(r.deliver(at(300))); !reflect.DeepEqual(d, []uint32{15}) {
+		t.Errorf("Expected 15, got %v", d)
+	}
+}
+
+func TestReceiverWrap(t *testing.T) {
+	start := time.Now()
+	r := newReceiver(seqnoMask, 0)
+	r.gotData(&dataPacket{seqno: seqnoMask, ts: 0xFFFFFFF0}, start)
+	l, lost := r.gotData(&dataPacket{seqno: 1, ts: 0x10}, start)
+	if !lost || l != [2]uint32{0, 0} {
+		t.Errorf("Expected loss of 0, got %v %v", l, lost)
+	}
+	d := seqnos(r.deliver(start.Add(time.Millisecond)))
+	if !reflect.DeepEqual(d, []uint32{seqnoMask, 1}) {
+		t.Errorf("Expected %v 1, got %v", seqnoMask, d)
+	}
+}
@@ -0,0 +1,309 @@
+package srt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jech/galene/ingest"
+	"github.com/jech/galene/rtpconn"
+)
+
+// A session is an SRT connection carrying a stream published to a
+// group.  All of its state is owned by the goroutine running run.
+type session struct {
+	l        *listener
+	addr     *net.UDPAddr
+	socket   uint32
+	peer     uint32
+	key      string
+	start    time.Time
+	response *controlPacket
+	packets  chan []byte
+	// closed by the listener when it shuts down
+	done chan struct{}
+
+	client    *rtpconn.IngestClient
+	publisher *ingest.Publisher
+	recv      *receiver
+	demux     *demuxer
+	clock     ptsClock
+	warned    map[string]bool
+
+	ackNo       uint32
+	acks        map[uint32]time.Time
+	lastAck     uint32
+	lastAckTime time.Time
+	rtt, rttVar time.Duration
+
+	lastRecv, lastSend time.Time
+	// the packets and bytes received since the last ACK
+	packetCount, byteCount int
+}
+
+// warn logs a message once per session.
+func (s *session) warn(format string, args ...interface{}) {
+	m := fmt.Sprintf(format, args...)
+	if s.warned[m] {
+		return
+	}
+	if s.warned == nil {
+		s.warned = make(map[string]bool)
+	}
+	s.warned[m] = true
+	logger.Warnf("SRT %v: %v", s.addr, m)
+}
+
+func (s *session) run() {
+	defer s.close()
+
+	now := time.Now()
+	s.lastRecv = now
+	s.lastSend = now
+	s.lastAckTime = now
+	s.acks = make(map[uint32]time.Time)
+
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-s.packets:
+			now := time.Now()
+			s.lastRecv = now
+			if !isControl(data) {
+				s.gotData(data, now)
+			} else if !s.gotControl(data, now) {
+				return
+			}
+		case now := <-ticker.C:
+			if !s.tick(now) {
+				return
+			}
+		case <-s.client.Done():
+			// kicked by an operator
+			s.sendControl(ctrlShutdown, 0, make([]byte, 4))
+			return
+		case <-s.done:
+			s.sendControl(ctrlShutdown, 0, make([]byte, 4))
+			return
+		}
+	}
+}
+
+func (s *session) close() {
+	s.l.mu.Lock()
+	delete(s.l.sessions, s.socket)
+	delete(s.l.peers, s.key)
+	s.l.mu.Unlock()
+	s.publisher.Close()
+	s.client.Close()
+	logger.Infof("SRT %v: done publishing to %v",
+		s.addr, s.client.Group().Name())
+}
+
+func (s *session) sendControl(typ uint16, info uint32, cif []byte) {
+	s.lastSend = time.Now()
+	s.l.write(s.addr, &controlPacket{
+		typ:  typ,
+		info: info,
+		ts:   uint32(s.lastSend.Sub(s.start) / time.Microsecond),
+		dest: s.peer,
+		cif:  cif,
+	})
+}
+
+// sendNAK sends loss reports, splitting them so that each fits in
+// a packet.
+func (s *session) sendNAK(ranges [][2]uint32) {
+	for len(ranges) > 0 {
+		n := len(ranges)
+		if n > 150 {
+			n = 150
+		}
+		s.sendControl(ctrlNAK, 0, lossList(ranges[:n]))
+		ranges = ranges[n:]
+	}
+}
+
+func (s *session) gotData(data []byte, now time.Time) {
+	p, err := parseData(data)
+	if err != nil {
+		return
+	}
+	if p.encrypt != 0 {
+		s.warn("dropping encrypted packets")
+		return
+	}
+	s.packetCount++
+	s.byteCount += len(p.payload)
+	lost, ok := s.recv.gotData(p, now)
+	if ok {
+		s.sendNAK([][2]uint32{lost})
+	}
+}
+
+// gotControl handles a control packet, and returns false if the
+// session should terminate.
+func (s *session) gotControl(data []byte, now time.Time) bool {
+	p, err := parseControl(data)
+	if err != nil {
+		return true
+	}
+	switch p.typ {
+	case ctrlHandshake:
+		// our response was lost
+		s.l.write(s.addr, s.response)
+	case ctrlACKACK:
+		t, ok := s.acks[p.info]
+		if !ok {
+			break
+		}
+		delete(s.acks, p.info)
+		rtt := now.Sub(t)
+		if s.rtt == 0 {
+			s.rtt = rtt
+			s.rttVar = rtt / 2
+		} else {
+			d := s.rtt - rtt
+			if d < 0 {
+				d = -d
+			}
+			s.rttVar = (3*s.rttVar + d) / 4
+			s.rtt = (7*s.rtt + rtt) / 8
+		}
+	case ctrlDropReq:
+		if len(p.cif) >= 8 {
+			s.recv.drop(
+				binary.BigEndian.Uint32(p.cif)&seqnoMask,
+				binary.BigEndian.Uint32(p.cif[4:])&seqnoMask,
+			)
+		}
+	case ctrlShutdown:
+		return false
+	}
+	return true
+}
+
+// tick is called periodically.  It delivers the packets that are due,
+// and sends ACKs, loss reports and keepalives.  It returns false if the
+// session should terminate.
+func (s *session) tick(now time.Time) bool {
+	if now.Sub(s.lastRecv) > peerTimeout {
+		s.warn("peer timed out")
+		return false
+	}
+
+	for _, p := range s.recv.deliver(now) {
+		err := s.demux.write(p.payload)
+		if err != nil {
+			s.warn("%v", err)
+		}
+	}
+
+	ack := s.recv.ackNumber()
+	if ack != s.lastAck || now.Sub(s.lastAckTime) >= 10*ackInterval {
+		s.sendACK(ack, now)
+	}
+
+	interval := s.rtt + 4*s.rttVar
+	if interval < 20*time.Millisecond {
+		interval = 20 * time.Millisecond
+	}
+	if ranges := s.recv.lossReport(now, interval); len(ranges) > 0 {
+		s.sendNAK(ranges)
+	}
+
+	if now.Sub(s.lastSend) >= keepaliveInterval {
+		s.sendControl(ctrlKeepalive, 0, make([]byte, 4))
+	}
+	return true
+}
+
+// sendACK sends a full ACK, which the sender answers with an ACKACK that
+// we use to measure the RTT.
+func (s *session) sendACK(ack uint32, now time.Time) {
+	elapsed := now.Sub(s.lastAckTime).Seconds()
+	var packetRate, byteRate uint32
+	if elapsed > 0 {
+		packetRate = uint32(float64(s.packetCount) / elapsed)
+		byteRate = uint32(float64(s.byteCount) / elapsed)
+	}
+	s.packetCount = 0
+	s.byteCount = 0
+
+	available := maxGap - s.recv.buffered()
+	if available < 2 {
+		available = 2
+	}
+
+	cif := make([]byte, 28)
+	binary.BigEndian.PutUint32(cif, ack)
+	binary.BigEndian.PutUint32(cif[4:],
+		uint32(s.rtt/time.Microsecond))
+	binary.BigEndian.PutUint32(cif[8:],
+		uint32(s.rttVar/time.Microsecond))
+	binary.BigEndian.PutUint32(cif[12:], uint32(available))
+	binary.BigEndian.PutUint32(cif[16:], packetRate)
+	binary.BigEndian.PutUint32(cif[20:], packetRate)
+	binary.BigEndian.PutUint32(cif[24:], byteRate)
+
+	s.ackNo++
+	if len(s.acks) > 1000 {
+		// the sender is not answering
+		s.acks = make(map[uint32]time.Time)
+	}
+	s.acks[s.ackNo] = now
+	s.lastAck = ack
+	s.lastAckTime = now
+	s.sendControl(ctrlACK, s.ackNo, cif)
+}
+
+// gotPES is called by the demuxer with each PES packet.
+func (s *session) gotPES(kind int, pts uint64, hasPTS bool, data []byte) {
+	if !hasPTS {
+		return
+	}
+	switch kind {
+	case esH264:
+		s.publisher.WriteVideo(s.clock.ms(pts), data)
+	case esOpus:
+		packets, err := opusPackets(data)
+		if err != nil {
+			s.warn("%v", err)
+		}
+		ms := s.clock.ms(pts)
+		samples := 0
+		for _, p := range packets {
+			s.publisher.WriteAudio(ms+uint32(samples/48), p)
+			samples += opusDuration(p)
+		}
+	case esAAC:
+		s.warn("unsupported audio codec, audio will be dropped; " +
+			"only Opus is supported")
+	case esHEVC:
+		s.warn("unsupported video codec, only H.264 is supported")
+	}
+}
+
+// A ptsClock converts the 33-bit timestamps of MPEG-TS, which wrap
+// around after about 26 hours, into milliseconds.
+type ptsClock struct {
+	started bool
+	last    uint64
+	ext     int64
+}
+
+func (c *ptsClock) ms(pts uint64) uint32 {
+	if !c.started {
+		c.started = true
+		c.last = pts
+		// keep earlier timestamps positive
+		c.ext = int64(pts) + 1<<33
+	}
+	// sign-extend the 33-bit difference
+	d := int64((pts-c.last)<<31) >> 31
+	c.last = pts
+	c.ext += d
+	return uint32(c.ext / 90)
+}
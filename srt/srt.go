@@ -0,0 +1,452 @@
+// Package srt implements SRT ingest: an MPEG-TS stream sent over SRT by
+// a contribution encoder is injected into a group as if it came from an
+// ordinary client.  Only the live mode of SRT is implemented, and
+// encryption is not supported.
+package srt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/ingest"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/rtpconn"
+)
+
+var logger = logging.New("srt")
+
+// the minimal latency; the sender may request more
+const defaultLatency = 120 * time.Millisecond
+
+// time after which a silent peer is dropped
+const peerTimeout = 5 * time.Second
+
+// the time allowed for connecting the publisher
+const connectTimeout = 10 * time.Second
+
+const (
+	ackInterval       = 10 * time.Millisecond
+	keepaliveInterval = time.Second
+)
+
+var server struct {
+	mu       sync.Mutex
+	listener *listener
+}
+
+// Serve listens for SRT connections on the given UDP address.  It
+// returns when the listener is closed by Shutdown.
+func Serve(address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	server.mu.Lock()
+	server.listener = l
+	server.mu.Unlock()
+	return l.run()
+}
+
+// Shutdown closes the listener and all sessions.
+func Shutdown() {
+	server.mu.Lock()
+	l := server.listener
+	server.listener = nil
+	server.mu.Unlock()
+	if l != nil {
+		l.close()
+	}
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		logger.Fatalf("rand.Read: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// A listener is a UDP socket that accepts SRT connections.  All sessions
+// share the socket, and are demultiplexed by their socket id.
+type listener struct {
+	conn   *net.UDPConn
+	secret []byte
+
+	mu       sync.Mutex
+	closed   bool
+	sessions map[uint32]*session
+	// the sessions indexed by the caller's address and socket id, in
+	// order to recognise retransmitted handshakes
+	peers   map[string]*session
+	pending map[string]bool
+}
+
+func listen(addr *net.UDPAddr) (*listener, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &listener{
+		conn:     conn,
+		secret:   secret,
+		sessions: make(map[uint32]*session),
+		peers:    make(map[string]*session),
+		pending:  make(map[string]bool),
+	}, nil
+}
+
+func (l *listener) run() error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		if n < headerSize {
+			continue
+		}
+		data := append([]byte(nil), buf[:n]...)
+		dest := binary.BigEndian.Uint32(data[12:])
+		if dest == 0 {
+			if isControl(data) {
+				l.gotHandshake(addr, data)
+			}
+			continue
+		}
+		l.mu.Lock()
+		s := l.sessions[dest]
+		l.mu.Unlock()
+		if s == nil || !s.addr.IP.Equal(addr.IP) || s.addr.Port != addr.Port {
+			continue
+		}
+		select {
+		case s.packets <- data:
+		default:
+			// the session is not keeping up
+		}
+	}
+}
+
+func (l *listener) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	l.conn.Close()
+	for _, s := range l.sessions {
+		close(s.done)
+	}
+}
+
+func (l *listener) write(addr *net.UDPAddr, p *controlPacket) {
+	_, err := l.conn.WriteToUDP(p.marshal(), addr)
+	if err != nil {
+		logger.Debugf("SRT %v: %v", addr, err)
+	}
+}
+
+// cookie returns the SYN cookie for a given address, which changes every
+// minute.
+func (l *listener) cookie(addr *net.UDPAddr, t time.Time) uint32 {
+	m := hmac.New(sha256.New, l.secret)
+	fmt.Fprintf(m, "%v %v", addr, t.Unix()/60)
+	return binary.BigEndian.Uint32(m.Sum(nil))
+}
+
+func (l *listener) gotHandshake(addr *net.UDPAddr, data []byte) {
+	p, err := parseControl(data)
+	if err != nil || p.typ != ctrlHandshake {
+		return
+	}
+	hs, err := parseHandshake(p.cif)
+	if err != nil {
+		return
+	}
+
+	switch hs.typ {
+	case hsInduction:
+		l.write(addr, &controlPacket{
+			typ:  ctrlHandshake,
+			dest: hs.socket,
+			cif: (&handshake{
+				version:  5,
+				extFlags: srtMagic,
+				isn:      hs.isn,
+				mtu:      hs.mtu,
+				window:   hs.window,
+				typ:      hsInduction,
+				socket:   hs.socket,
+				cookie:   l.cookie(addr, time.Now()),
+				peerIP:   hs.peerIP,
+			}).marshal(),
+		})
+	case hsConclusion:
+		now := time.Now()
+		if hs.cookie != l.cookie(addr, now) &&
+			hs.cookie != l.cookie(addr, now.Add(-time.Minute)) {
+			l.reject(addr, hs, rejRogue)
+			return
+		}
+		key := fmt.Sprintf("%v/%v", addr, hs.socket)
+		l.mu.Lock()
+		if s := l.peers[key]; s != nil {
+			// our response was lost
+			l.mu.Unlock()
+			l.write(addr, s.response)
+			return
+		}
+		if l.pending[key] || l.closed {
+			l.mu.Unlock()
+			return
+		}
+		l.pending[key] = true
+		l.mu.Unlock()
+
+		go func() {
+			defer func() {
+				l.mu.Lock()
+				delete(l.pending, key)
+				l.mu.Unlock()
+			}()
+			reason, err := l.accept(addr, hs, key)
+			if err != nil {
+				logger.Warnf("SRT %v: %v", addr, err)
+				l.reject(addr, hs, reason)
+			}
+		}()
+	}
+}
+
+// reject sends a handshake that rejects a connection.
+func (l *listener) reject(addr *net.UDPAddr, hs *handshake, reason int) {
+	l.write(addr, &controlPacket{
+		typ:  ctrlHandshake,
+		dest: hs.socket,
+		cif: (&handshake{
+			version: 5,
+			isn:     hs.isn,
+			mtu:     hs.mtu,
+			window:  hs.window,
+			typ:     uint32(hsRejectBase + reason),
+			cookie:  hs.cookie,
+			peerIP:  hs.peerIP,
+		}).marshal(),
+	})
+}
+
+var errBadMode = errors.New("only publishing is supported")
+
+// parseStreamId returns the group name, the key and the username from
+// a stream id.  The stream id is either of the form group/key, or uses
+// the syntax recommended by the SRT access control guidelines, for
+// example "#!::r=group/key,m=publish,u=username".
+func parseStreamId(sid string) (string, string, string, error) {
+	resource := sid
+	username := ""
+	if strings.HasPrefix(sid, "#!::") {
+		resource = ""
+		for _, kv := range strings.Split(sid[4:], ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			switch k {
+			case "r":
+				resource = v
+			case "u":
+				username = v
+			case "m":
+				if v != "publish" {
+					return "", "", "", errBadMode
+				}
+			}
+		}
+	}
+	resource = strings.Trim(resource, "/")
+	i := strings.LastIndexByte(resource, '/')
+	if i <= 0 || i == len(resource)-1 {
+		return "", "", "",
+			errors.New("the stream id must be group/key")
+	}
+	return resource[:i], resource[i+1:], username, nil
+}
+
+func canPresent(perms []string) bool {
+	for _, p := range perms {
+		if p == "present" {
+			return true
+		}
+	}
+	return false
+}
+
+// accept checks a conclusion handshake, joins the group and starts a new
+// session.  In case of failure, it returns the rejection reason.
+func (l *listener) accept(addr *net.UDPAddr, hs *handshake, key string) (int, error) {
+	if hs.version != 5 {
+		return rejVersion, errors.New("unsupported SRT version")
+	}
+	if hs.encryption != 0 || hs.extension(extKMReq) != nil {
+		return rejUnsecure, errors.New("encryption is not supported")
+	}
+	data := hs.extension(extHSReq)
+	if data == nil {
+		return rejVersion, errors.New("no HSREQ extension")
+	}
+	req, err := parseHSReq(data)
+	if err != nil {
+		return rejVersion, err
+	}
+	if req.flags&flagStream != 0 {
+		return rejMessageAPI, errors.New("stream mode is not supported")
+	}
+	if data := hs.extension(extCongestion); data != nil &&
+		decodeString(data) != "live" {
+		return rejCongestion, errors.New("only live mode is supported")
+	}
+	if hs.extension(extFilter) != nil {
+		return rejFilter, errors.New("packet filters are not supported")
+	}
+	if hs.extension(extGroup) != nil {
+		return rejGroup, errors.New("bonding is not supported")
+	}
+
+	groupName, token, username, err :=
+		parseStreamId(decodeString(hs.extension(extSID)))
+	if err == errBadMode {
+		return rejBadMode, err
+	} else if err != nil {
+		return rejBadRequest, err
+	}
+	if username == "" {
+		username = "SRT"
+	}
+
+	g, err := group.Add(groupName, nil)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return rejNotFound, err
+		}
+		return rejBadRequest, err
+	}
+	c := rtpconn.NewIngestClient(g, newId())
+	_, err = group.AddClient(g.Name(), c, group.ClientCredentials{
+		Username: &username,
+		Token:    token,
+	})
+	if err != nil {
+		return rejUnauthorized, err
+	}
+	if !canPresent(c.Permissions()) {
+		group.DelClient(c)
+		return rejUnauthorized, errors.New("not allowed to present")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	p, err := ingest.NewPublisher(ctx, c, true)
+	cancel()
+	if err != nil {
+		c.Close()
+		return rejPeer, err
+	}
+
+	latency := defaultLatency
+	if d := time.Duration(req.sendDelay) * time.Millisecond; d > latency {
+		latency = d
+	}
+	s := &session{
+		l:         l,
+		addr:      addr,
+		peer:      hs.socket,
+		key:       key,
+		start:     time.Now(),
+		client:    c,
+		publisher: p,
+		recv:      newReceiver(hs.isn, latency),
+		packets:   make(chan []byte, 1024),
+		done:      make(chan struct{}),
+	}
+	s.demux = newDemuxer(s.gotPES)
+
+	mtu := hs.mtu
+	if mtu > 1500 {
+		mtu = 1500
+	}
+	ms := uint16(latency / time.Millisecond)
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		s.publisher.Close()
+		c.Close()
+		return rejPeer, errors.New("server shutting down")
+	}
+	for s.socket == 0 || l.sessions[s.socket] != nil {
+		var b [4]byte
+		rand.Read(b[:])
+		s.socket = binary.BigEndian.Uint32(b[:])
+	}
+	s.response = &controlPacket{
+		typ:  ctrlHandshake,
+		dest: hs.socket,
+		cif: (&handshake{
+			version:  5,
+			extFlags: extFlagHSReq,
+			isn:      hs.isn,
+			mtu:      mtu,
+			window:   maxGap,
+			typ:      hsConclusion,
+			socket:   s.socket,
+			cookie:   hs.cookie,
+			peerIP:   hs.peerIP,
+			extensions: []extension{{
+				typ: extHSRsp,
+				data: hsReq{
+					version: srtVersion,
+					flags: flagTSBPDSnd | flagTSBPDRcv |
+						flagTLPktDrop | flagNAKReport |
+						flagRexmit,
+					recvDelay: ms,
+					sendDelay: ms,
+				}.marshal(),
+			}},
+		}).marshal(),
+	}
+	l.sessions[s.socket] = s
+	l.peers[key] = s
+	l.mu.Unlock()
+
+	l.write(addr, s.response)
+	logger.Infof("SRT %v: publishing to %v as %v, latency %v",
+		addr, g.Name(), c.Username(), latency)
+	go s.run()
+	return 0, nil
+}
@@ -0,0 +1,147 @@
+package srt
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseStreamId(t *testing.T) {
+	tests := []struct {
+		sid, group, key, username string
+	}{
+		{"group/key", "group", "key", ""},
+		{"/group/sub/key/", "group/sub", "key", ""},
+		{"#!::r=group/key,m=publish", "group", "key", ""},
+		{"#!::u=john,r=group/sub/key", "group/sub", "key", "john"},
+	}
+	for _, tt := range tests {
+		g, k, u, err := parseStreamId(tt.sid)
+		if err != nil || g != tt.group || k != tt.key ||
+			u != tt.username {
+			t.Errorf("%v: got %v %v %v %v", tt.sid, g, k, u, err)
+		}
+	}
+	for _, bad := range []string{"", "group", "group/", "/key",
+		"#!::m=publish"} {
+		_, _, _, err := parseStreamId(bad)
+		if err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+	_, _, _, err := parseStreamId("#!::r=group/key,m=request")
+	if err != errBadMode {
+		t.Errorf("Expected bad mode, got %v", err)
+	}
+}
+
+// testCaller is the calling side of an SRT handshake.
+type testCaller struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func newTestCaller(t *testing.T) (*testCaller, func()) {
+	l, err := listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go l.run()
+	conn, err := net.DialUDP("udp", nil,
+		l.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		l.close()
+		t.Fatalf("DialUDP: %v", err)
+	}
+	return &testCaller{t: t, conn: conn}, func() {
+		conn.Close()
+		l.close()
+	}
+}
+
+func (c *testCaller) handshake(hs *handshake) *handshake {
+	p := &controlPacket{typ: ctrlHandshake, cif: hs.marshal()}
+	_, err := c.conn.Write(p.marshal())
+	if err != nil {
+		c.t.Fatalf("Write: %v", err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatalf("Read: %v", err)
+	}
+	q, err := parseControl(buf[:n])
+	if err != nil || q.typ != ctrlHandshake || q.dest != hs.socket {
+		c.t.Fatalf("Bad reply %v %v", q, err)
+	}
+	r, err := parseHandshake(q.cif)
+	if err != nil {
+		c.t.Fatalf("parseHandshake: %v", err)
+	}
+	return r
+}
+
+// induction performs the first phase of the handshake, and returns the
+// cookie.
+func (c *testCaller) induction() uint32 {
+	r := c.handshake(&handshake{
+		version:  4,
+		extFlags: 2,
+		isn:      1000,
+		mtu:      1500,
+		window:   8192,
+		typ:      hsInduction,
+		socket:   42,
+	})
+	if r.version != 5 || r.extFlags != srtMagic || r.typ != hsInduction {
+		c.t.Fatalf("Bad induction response %v", r)
+	}
+	return r.cookie
+}
+
+func conclusion(cookie uint32, sid string) *handshake {
+	return &handshake{
+		version:  5,
+		extFlags: extFlagHSReq | extFlagConfig,
+		isn:      1000,
+		mtu:      1500,
+		window:   8192,
+		typ:      hsConclusion,
+		socket:   42,
+		cookie:   cookie,
+		extensions: []extension{
+			{extHSReq, hsReq{
+				srtVersion, flagTSBPDSnd | flagTLPktDrop, 0, 120,
+			}.marshal()},
+			{extSID, encodeString(sid)},
+		},
+	}
+}
+
+func TestHandshakeReject(t *testing.T) {
+	c, done := newTestCaller(t)
+	defer done()
+
+	cookie := c.induction()
+
+	encrypted := conclusion(cookie, "group/key")
+	encrypted.encryption = 2
+	tests := []struct {
+		hs     *handshake
+		reason int
+	}{
+		{conclusion(cookie+1, "group/key"), rejRogue},
+		{conclusion(cookie, "group"), rejBadRequest},
+		{conclusion(cookie, "#!::r=group/key,m=request"), rejBadMode},
+		{encrypted, rejUnsecure},
+	}
+
+	for _, tt := range tests {
+		r := c.handshake(tt.hs)
+		if r.typ != uint32(hsRejectBase+tt.reason) {
+			t.Errorf("Expected rejection %v, got %v",
+				tt.reason, r.typ)
+		}
+	}
+}
@@ -51,6 +51,7 @@ let connectingAgain = false;
  * @property {string} [filter]
  * @property {boolean} [preprocessing]
  * @property {boolean} [hqaudio]
+ * @property {boolean} [red]
  * @property {boolean} [forceRelay]
  */
 
@@ -244,6 +245,13 @@ function reflectSettings() {
         store = true;
     }
 
+    if(settings.hasOwnProperty('red')) {
+        getInputElement('redbox').checked = settings.red;
+    } else {
+        settings.red = getInputElement('redbox').checked;
+        store = true;
+    }
+
     if(store)
         storeSettings(settings);
 }
@@ -415,6 +423,7 @@ function gotDownStream(c) {
     };
     c.onnegotiationcompleted = function() {
         resetMedia(c);
+        setLabel(c);
     }
     c.onstatus = function(status) {
         setMediaStatus(c);
@@ -577,6 +586,14 @@ getInputElement('hqaudiobox').onchange = function(e) {
     replaceCameraStream();
 };
 
+getInputElement('redbox').onchange = function(e) {
+    e.preventDefault();
+    if(!(this instanceof HTMLInputElement))
+        throw new Error('Unexpected type for this');
+    updateSettings({red: this.checked});
+    replaceCameraStream();
+};
+
 document.getElementById('mutebutton').onclick = function(e) {
     e.preventDefault();
     let localMute = getSettings().localMute;
@@ -763,7 +780,7 @@ function setActive(c, value) {
  * @param {Object<string,any>} stats
  */
 function gotDownStats(stats) {
-    if(!getInputElement('activitybox').checked)
+    if(!getInputElement('activitybox').checked || serverSpeaking)
         return;
 
     let c = this;
@@ -790,6 +807,38 @@ function gotDownStats(stats) {
     }
 }
 
+/**
+ * True if the server performs active speaker detection, in which case we
+ * don't need to guess from the audio energy.
+ *
+ * @type {boolean}
+ */
+let serverSpeaking = false;
+
+/**
+ * @this {ServerConnection}
+ * @param {string} active
+ * @param {Array<string>} speaking
+ */
+function gotSpeaking(active, speaking) {
+    serverSpeaking = true;
+    for(let id in this.users) {
+        let elt = document.getElementById('user-' + id);
+        if(!elt)
+            continue;
+        if(speaking.indexOf(id) >= 0)
+            elt.classList.add('user-speaking');
+        else
+            elt.classList.remove('user-speaking');
+    }
+    if(!getInputElement('activitybox').checked)
+        return;
+    for(let id in this.down) {
+        let c = this.down[id];
+        setActive(c, speaking.indexOf(c.source) >= 0);
+    }
+}
+
 /**
  * @param {HTMLSelectElement} select
  * @param {string} label
@@ -1291,6 +1340,8 @@ function setUpStream(c, stream) {
             streams: [stream],
             sendEncodings: encodings,
         });
+        if(t.kind === 'audio')
+            setRED(tr, settings.red);
 
         // Firefox before 110 does not implement sendEncodings, and
         // requires this hack, which throws an exception on Chromium.
@@ -1392,6 +1443,30 @@ function replaceCameraStream() {
         addLocalMedia(c.localId);
 }
 
+/**
+ * setRED puts RED (redundant audio) first in the list of codecs of
+ * an audio transceiver, or removes it, so that the server's answer
+ * selects or avoids it.
+ *
+ * @param {RTCRtpTransceiver} tr
+ * @param {boolean} red
+ */
+function setRED(tr, red) {
+    if(!tr.setCodecPreferences || !RTCRtpSender.getCapabilities)
+        return;
+    let codecs = RTCRtpSender.getCapabilities('audio').codecs;
+    /** @param {RTCRtpCodecCapability} c */
+    let isRED = c => c.mimeType.toLowerCase() === 'audio/red';
+    let others = codecs.filter(c => !isRED(c));
+    try {
+        tr.setCodecPreferences(
+            red ? codecs.filter(isRED).concat(others) : others,
+        );
+    } catch(e) {
+        console.warn(e);
+    }
+}
+
 /**
  * @param {string} [localId]
  */
@@ -1422,6 +1497,8 @@ async function addLocalMedia(localId) {
             audio.noiseSuppression = false;
             audio.autoGainControl = false;
         }
+        if(settings.hqaudio)
+            audio.channelCount = {ideal: 2};
     }
 
     let old = serverConnection.findByLocalId(localId);
@@ -1773,6 +1850,12 @@ async function setMedia(c, mirror, video) {
         media.onfullscreenchange = function(e) {
             forceDownRate(c.id, document.fullscreenElement === media, false);
         }
+        if(!c.userdata.resizeObserver && 'ResizeObserver' in window) {
+            c.userdata.resizeObserver =
+                new ResizeObserver(() => reportRenderSize(c, media));
+            c.userdata.resizeObserver.observe(media);
+        }
+        reportRenderSize(c, media);
     }
 
     let label = document.getElementById('label-' + c.localId);
@@ -1790,6 +1873,34 @@ async function setMedia(c, mirror, video) {
     resizePeers();
 }
 
+/**
+ * Tells the server the size at which the video of a down stream is
+ * rendered, so that it doesn't send more pixels than necessary.
+ *
+ * @param {Stream} c
+ * @param {HTMLVideoElement} media
+ */
+function reportRenderSize(c, media) {
+    let ratio = window.devicePixelRatio || 1;
+    let width = Math.round(media.clientWidth * ratio);
+    let height = Math.round(media.clientHeight * ratio);
+    if(!width || !height)
+        return;
+    // don't flood the server while the window is being resized
+    let old = c.userdata.renderSize;
+    if(old && Math.abs(width - old.width) < old.width / 4 &&
+       Math.abs(height - old.height) < old.height / 4)
+        return;
+    let mid = null;
+    c.pc.getTransceivers().forEach(t => {
+        if(t.mid && t.receiver.track && t.receiver.track.kind === 'video')
+            mid = t.mid;
+    });
+    if(!mid)
+        return;
+    c.userdata.renderSize = {width: width, height: height};
+    c.requestTrack(mid, {width: width, height: height});
+}
 
 /**
  * @param {Stream} c
@@ -2046,6 +2157,10 @@ function setLabel(c, fallback) {
     if(!label)
         return;
     let l = c.username;
+    if(c.paused)
+        l = (l || '') + ' (video paused due to bandwidth)';
+    if(c.userdata.echo)
+        l = (l || '') + ' ' + c.userdata.echo;
     if(l) {
         label.textContent = l;
         label.classList.remove('label-fallback');
@@ -2778,12 +2893,39 @@ function gotUserMessage(id, dest, username, time, privileged, kind, error, messa
         }
         localMessage(s);
         break;
+    case 'echo':
+        if(!privileged) {
+            console.error(`Got unprivileged message of kind ${kind}`);
+            return;
+        }
+        let echo = formatEcho(message);
+        for(let id in serverConnection.down) {
+            let c = serverConnection.down[id];
+            if(c.source === serverConnection.id) {
+                c.userdata.echo = echo;
+                setLabel(c);
+            }
+        }
+        break;
     default:
         console.warn(`Got unknown user message ${kind}`);
         break;
     }
 };
 
+/**
+ * formatEcho formats the statistics sent by the server in an echo group.
+ *
+ * @param {Object} stats
+ * @returns {string}
+ */
+function formatEcho(stats) {
+    let percent = x => `${Math.round(x * 100)}%`;
+    return `(RTT ${Math.round(stats.rtt)}ms, ` +
+        `jitter ${Math.round(stats.jitter)}ms, ` +
+        `loss ${percent(stats.upLoss)} up, ${percent(stats.downLoss)} down)`;
+}
+
 /**
  * @param {Object} token
  * @param {boolean} [details]
@@ -3116,10 +3258,14 @@ commands.unlock = {
 };
 
 commands.record = {
+    parameters: '[mixed|webm|mp4|ogg]',
     predicate: recordingPredicate,
     description: 'start recording',
     f: (c, r) => {
-        serverConnection.groupAction('record');
+        let mode = r.trim();
+        if(mode && ['mixed', 'webm', 'mp4', 'ogg'].indexOf(mode) < 0)
+            throw new Error(`Unknown recording mode ${mode}`);
+        serverConnection.groupAction('record', mode || undefined);
     }
 };
 
@@ -3131,6 +3277,70 @@ commands.unrecord = {
     }
 };
 
+commands.tap = {
+    parameters: 'name [username]',
+    predicate: operatorPredicate,
+    description: 'forward media to an external process',
+    f: (c, r) => {
+        let p = parseCommand(r);
+        if(!p[0])
+            throw new Error('/tap requires parameters');
+        let v = {name: p[0]};
+        if(p[1])
+            v.user = p[1];
+        serverConnection.groupAction('tap', v);
+    }
+};
+
+commands.untap = {
+    parameters: '[name]',
+    predicate: operatorPredicate,
+    description: 'stop forwarding media to an external process',
+    f: (c, r) => {
+        serverConnection.groupAction('untap', r.trim());
+    }
+};
+
+commands.restream = {
+    parameters: 'name [username]',
+    predicate: operatorPredicate,
+    description: 'push media to a live-streaming server',
+    f: (c, r) => {
+        let p = parseCommand(r);
+        if(!p[0])
+            throw new Error('/restream requires parameters');
+        let v = {name: p[0]};
+        if(p[1])
+            v.user = p[1];
+        serverConnection.groupAction('restream', v);
+    }
+};
+
+commands.unrestream = {
+    parameters: '[name]',
+    predicate: operatorPredicate,
+    description: 'stop pushing media to a live-streaming server',
+    f: (c, r) => {
+        serverConnection.groupAction('unrestream', r.trim());
+    }
+};
+
+commands.testsource = {
+    predicate: operatorPredicate,
+    description: 'inject a test card into the group',
+    f: (c, r) => {
+        serverConnection.groupAction('testsource');
+    }
+};
+
+commands.untestsource = {
+    predicate: operatorPredicate,
+    description: 'remove the test card',
+    f: (c, r) => {
+        serverConnection.groupAction('untestsource');
+    }
+};
+
 commands.subgroups = {
     predicate: operatorPredicate,
     description: 'list subgroups',
@@ -3283,6 +3493,21 @@ function renegotiateStreams() {
         serverConnection.down[id].restartIce();
 }
 
+/**
+ * Restarts ICE on all streams when the network changes, rather than
+ * waiting for the browser to notice that the old path is gone.
+ */
+function networkChanged() {
+    if(serverConnection && serverConnection.socket)
+        renegotiateStreams();
+}
+
+window.addEventListener('online', networkChanged);
+/** @ts-ignore */
+if(navigator.connection && navigator.connection.addEventListener)
+    /** @ts-ignore */
+    navigator.connection.addEventListener('change', networkChanged);
+
 commands.renegotiate = {
     description: 'renegotiate media streams',
     f: (c, r) => {
@@ -3888,6 +4113,8 @@ async function serverConnect() {
     serverConnection.onjoined = gotJoined;
     serverConnection.onchat = addToChatbox;
     serverConnection.onusermessage = gotUserMessage;
+    serverConnection.onspeaking = gotSpeaking;
+    serverSpeaking = false;
     serverConnection.onfiletransfer = gotFileTransfer;
 
     let url = groupStatus.endpoint;
@@ -3897,7 +4124,7 @@ async function serverConnect() {
     }
 
     try {
-        await serverConnection.connect(url);
+        await serverConnection.connect(url, groupStatus.webTransportEndpoint);
     } catch(e) {
         console.error(e);
         displayError(e.message ? e.message : "Couldn't connect to " + url);
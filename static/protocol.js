@@ -101,9 +101,9 @@ function ServerConnection() {
      */
     this.users = {};
     /**
-     * The underlying websocket.
+     * The underlying websocket, or WebTransport session.
      *
-     * @type {WebSocket}
+     * @type {WebSocket|WebTransportSocket}
      */
     this.socket = null;
     /**
@@ -208,6 +208,14 @@ function ServerConnection() {
      * @type {(this: ServerConnection, id: string, dest: string, username: string, time: Date, privileged: boolean, kind: string, error: string, message: unknown) => void}
      */
     this.onusermessage = null;
+    /**
+     * onspeaking is called when the set of users that are speaking
+     * changes.  Active is the id of the active speaker, or the empty
+     * string; speaking is the list of ids of the users currently speaking.
+     *
+     * @type {(this: ServerConnection, active: string, speaking: Array<string>) => void}
+     */
+    this.onspeaking = null;
     /**
      * The set of files currently being transferred.
      *
@@ -230,6 +238,7 @@ function ServerConnection() {
   * @typedef {Object} message
   * @property {string} type
   * @property {Array<string>} [version]
+  * @property {Array<string>} [features]
   * @property {string} [kind]
   * @property {string} [error]
   * @property {string} [id]
@@ -276,20 +285,163 @@ ServerConnection.prototype.send = function(m) {
 };
 
 /**
- * connect connects to the server.
+ * WebTransportSocket carries the messages of the protocol over a
+ * bidirectional WebTransport stream, one message per line.  It
+ * implements the subset of the WebSocket interface used by
+ * ServerConnection.  It is created by openWebTransport, and start must
+ * be called once the callbacks have been set.
+ *
+ * @constructor
+ * @param {WebTransport} transport
+ * @param {WebTransportBidirectionalStream} stream
+ */
+function WebTransportSocket(transport, stream) {
+    /** @type {WebTransport} */
+    this.transport = transport;
+    /** @type {WebTransportBidirectionalStream} */
+    this.stream = stream;
+    /** @type {WritableStreamDefaultWriter} */
+    this.writer = stream.writable.getWriter();
+    /** @type {number} */
+    this.readyState = this.OPEN;
+    /** @type {(this: WebTransportSocket, e: Event) => void} */
+    this.onerror = null;
+    /** @type {(this: WebTransportSocket, e: Event) => void} */
+    this.onopen = null;
+    /** @type {(this: WebTransportSocket, e: {code: number, reason: string}) => void} */
+    this.onclose = null;
+    /** @type {(this: WebTransportSocket, e: {data: string}) => void} */
+    this.onmessage = null;
+}
+
+WebTransportSocket.prototype.CONNECTING = 0;
+WebTransportSocket.prototype.OPEN = 1;
+WebTransportSocket.prototype.CLOSING = 2;
+WebTransportSocket.prototype.CLOSED = 3;
+
+/**
+ * openWebTransport opens a WebTransport session and the stream used for
+ * the protocol.  It fails if the session cannot be established within
+ * the given time.
+ *
+ * @param {string} url
+ * @param {number} timeout - the timeout in milliseconds.
+ * @returns {Promise<WebTransportSocket>}
+ */
+async function openWebTransport(url, timeout) {
+    let transport = new WebTransport(url);
+    let timer = setTimeout(() => {
+        transport.close();
+    }, timeout);
+    try {
+        await transport.ready;
+        let stream = await transport.createBidirectionalStream();
+        return new WebTransportSocket(transport, stream);
+    } catch(e) {
+        transport.close();
+        throw e;
+    } finally {
+        clearTimeout(timer);
+    }
+}
+
+/**
+ * start calls the onopen callback, and starts delivering messages.
+ */
+WebTransportSocket.prototype.start = async function() {
+    let socket = this;
+    let closed = socket.transport.closed.then(info => {
+        socket.readyState = socket.CLOSED;
+        return {code: info.closeCode || 1005, reason: info.reason || ''};
+    }, e => {
+        socket.readyState = socket.CLOSED;
+        return {code: 1006, reason: e.message || ''};
+    });
+    if(socket.onopen)
+        socket.onopen.call(socket, new Event('open'));
+
+    let reader = socket.stream.readable.
+        pipeThrough(new TextDecoderStream()).getReader();
+    let buffer = '';
+    try {
+        while(true) {
+            let {value, done} = await reader.read();
+            if(done)
+                break;
+            buffer += value;
+            let lines = buffer.split('\n');
+            buffer = lines.pop();
+            for(let i = 0; i < lines.length; i++) {
+                if(lines[i] && socket.onmessage)
+                    socket.onmessage.call(socket, {data: lines[i]});
+            }
+        }
+    } catch(e) {
+        if(socket.readyState === socket.OPEN && socket.onerror)
+            socket.onerror.call(socket, new Event('error'));
+    }
+    socket.close();
+    let e = await closed;
+    if(socket.onclose)
+        socket.onclose.call(socket, e);
+};
+
+/**
+ * send sends a message to the server.
+ *
+ * @param {string} data
+ */
+WebTransportSocket.prototype.send = function(data) {
+    if(this.readyState !== this.OPEN)
+        return;
+    this.writer.write(new TextEncoder().encode(data + '\n')).catch(e => {
+        console.warn('WebTransport write:', e);
+    });
+};
+
+/**
+ * close closes the session.
+ *
+ * @param {number} [code]
+ * @param {string} [reason]
+ */
+WebTransportSocket.prototype.close = function(code, reason) {
+    if(this.readyState !== this.OPEN)
+        return;
+    this.readyState = this.CLOSING;
+    try {
+        this.transport.close({closeCode: code || 0, reason: reason || ''});
+    } catch(e) {
+        console.warn('WebTransport close:', e);
+    }
+};
+
+/**
+ * connect connects to the server.  If webTransportURL is set and the
+ * browser supports WebTransport, it is tried first, and the WebSocket at
+ * url is used if it fails.
  *
- * @param {string} url - The URL to connect to.
+ * @param {string} url - The URL of the WebSocket to connect to.
+ * @param {string} [webTransportURL] - The URL of the WebTransport endpoint.
  * @returns {Promise<ServerConnection>}
  * @function
  */
-ServerConnection.prototype.connect = async function(url) {
+ServerConnection.prototype.connect = async function(url, webTransportURL) {
     let sc = this;
     if(sc.socket) {
         sc.socket.close(1000, 'Reconnecting');
         sc.socket = null;
     }
 
-    sc.socket = new WebSocket(url);
+    let socket = null;
+    if(webTransportURL && typeof WebTransport !== 'undefined') {
+        try {
+            socket = await openWebTransport(webTransportURL, 5000);
+        } catch(e) {
+            console.warn('WebTransport failed, using WebSocket:', e);
+        }
+    }
+    sc.socket = socket || new WebSocket(url);
 
     return await new Promise((resolve, reject) => {
         this.socket.onerror = function(e) {
@@ -299,6 +451,7 @@ ServerConnection.prototype.connect = async function(url) {
             sc.send({
                 type: 'handshake',
                 version: ['2'],
+                features: ['user-batch', 'speaking'],
                 id: sc.id,
             });
             if(sc.onconnected)
@@ -343,7 +496,7 @@ ServerConnection.prototype.connect = async function(url) {
             }
             case 'offer':
                 sc.gotOffer(m.id, m.label, m.source, m.username,
-                            m.sdp, m.replace);
+                            m.sdp, m.replace, m.paused);
                 break;
             case 'answer':
                 sc.gotAnswer(m.id, m.sdp);
@@ -389,48 +542,12 @@ ServerConnection.prototype.connect = async function(url) {
                                      m.error || null, m.value || null);
                 break;
             case 'user':
-                switch(m.kind) {
-                case 'add':
-                    if(m.id in sc.users)
-                        console.warn(`Duplicate user ${m.id} ${m.username}`);
-                    sc.users[m.id] = {
-                        username: m.username,
-                        permissions: m.permissions || [],
-                        data: m.data || {},
-                        streams: {},
-                    };
-                    break;
-                case 'change':
-                    if(!(m.id in sc.users)) {
-                        console.warn(`Unknown user ${m.id} ${m.username}`);
-                        sc.users[m.id] = {
-                            username: m.username,
-                            permissions: m.permissions || [],
-                            data: m.data || {},
-                            streams: {},
-                        };
-                    } else {
-                        sc.users[m.id].username = m.username;
-                        sc.users[m.id].permissions = m.permissions || [];
-                        sc.users[m.id].data = m.data || {};
-                    }
-                    break;
-                case 'delete':
-                    if(!(m.id in sc.users))
-                        console.warn(`Unknown user ${m.id} ${m.username}`);
-                    for(let t in sc.transferredFiles) {
-                        let f = sc.transferredFiles[t];
-                        if(f.userid === m.id)
-                            f.fail('user has gone away');
-                    }
-                    delete(sc.users[m.id]);
-                    break;
-                default:
-                    console.warn(`Unknown user action ${m.kind}`);
-                    return;
+                if(m.kind === 'batch') {
+                    for(let i = 0; i < m.value.length; i++)
+                        sc.gotUser(m.value[i]);
+                } else {
+                    sc.gotUser(m);
                 }
-                if(sc.onuser)
-                    sc.onuser.call(sc, m.id, m.kind);
                 break;
             case 'chat':
             case 'chathistory':
@@ -450,6 +567,10 @@ ServerConnection.prototype.connect = async function(url) {
                         m.privileged, m.kind, m.error, m.value,
                     );
                 break;
+            case 'speaking':
+                if(sc.onspeaking)
+                    sc.onspeaking.call(sc, m.source || '', m.value || []);
+                break;
             case 'ping':
                 sc.send({
                     type: 'pong',
@@ -463,6 +584,8 @@ ServerConnection.prototype.connect = async function(url) {
                 return;
             }
         };
+        if(this.socket instanceof WebTransportSocket)
+            this.socket.start();
     });
 };
 
@@ -679,10 +802,7 @@ ServerConnection.prototype.newUpStream = function(localId) {
     };
 
     pc.oniceconnectionstatechange = e => {
-        if(c.onstatus)
-            c.onstatus.call(c, pc.iceConnectionState);
-        if(pc.iceConnectionState === 'failed')
-            c.restartIce();
+        c.gotIceState();
     };
 
     pc.ontrack = console.error;
@@ -764,6 +884,59 @@ ServerConnection.prototype.groupAction = function(kind, data) {
     });
 };
 
+/**
+ * gotUser is called when we receive a user message from the server.
+ * Don't call this.
+ *
+ * @param {message} m
+ * @function
+ */
+ServerConnection.prototype.gotUser = function(m) {
+    let sc = this;
+    switch(m.kind) {
+    case 'add':
+        if(m.id in sc.users)
+            console.warn(`Duplicate user ${m.id} ${m.username}`);
+        sc.users[m.id] = {
+            username: m.username,
+            permissions: m.permissions || [],
+            data: m.data || {},
+            streams: {},
+        };
+        break;
+    case 'change':
+        if(!(m.id in sc.users)) {
+            console.warn(`Unknown user ${m.id} ${m.username}`);
+            sc.users[m.id] = {
+                username: m.username,
+                permissions: m.permissions || [],
+                data: m.data || {},
+                streams: {},
+            };
+        } else {
+            sc.users[m.id].username = m.username;
+            sc.users[m.id].permissions = m.permissions || [];
+            sc.users[m.id].data = m.data || {};
+        }
+        break;
+    case 'delete':
+        if(!(m.id in sc.users))
+            console.warn(`Unknown user ${m.id} ${m.username}`);
+        for(let t in sc.transferredFiles) {
+            let f = sc.transferredFiles[t];
+            if(f.userid === m.id)
+                f.fail('user has gone away');
+        }
+        delete(sc.users[m.id]);
+        break;
+    default:
+        console.warn(`Unknown user action ${m.kind}`);
+        return;
+    }
+    if(sc.onuser)
+        sc.onuser.call(sc, m.id, m.kind);
+};
+
 /**
  * gotOffer is called when we receive an offer from the server.  Don't call this.
  *
@@ -773,9 +946,10 @@ ServerConnection.prototype.groupAction = function(kind, data) {
  * @param {string} username
  * @param {string} sdp
  * @param {string} replace
+ * @param {boolean} [paused]
  * @function
  */
-ServerConnection.prototype.gotOffer = async function(id, label, source, username, sdp, replace) {
+ServerConnection.prototype.gotOffer = async function(id, label, source, username, sdp, replace, paused) {
     let sc = this;
 
     if(sc.up[id]) {
@@ -825,14 +999,7 @@ ServerConnection.prototype.gotOffer = async function(id, label, source, username
         };
 
         pc.oniceconnectionstatechange = e => {
-            if(c.onstatus)
-                c.onstatus.call(c, pc.iceConnectionState);
-            if(pc.iceConnectionState === 'failed') {
-                sc.send({
-                    type: 'renegotiate',
-                    id: id,
-                });
-            }
+            c.gotIceState();
         };
 
         c.pc.ontrack = function(e) {
@@ -854,6 +1021,7 @@ ServerConnection.prototype.gotOffer = async function(id, label, source, username
 
     c.source = source;
     c.username = username;
+    c.paused = !!paused;
 
     if(sc.ondownstream)
         sc.ondownstream.call(sc, c);
@@ -1070,6 +1238,13 @@ function Stream(sc, id, localId, pc, up) {
      * @type {boolean}
      */
     this.localDescriptionSent = false;
+    /**
+     * For down streams, indicates whether the server has stopped sending
+     * video due to lack of bandwidth.
+     *
+     * @type {boolean}
+     */
+    this.paused = false;
     /**
      * Buffered local ICE candidates.  This will be flushed by
      * flushLocalIceCandidates after we send a local description.
@@ -1099,6 +1274,12 @@ function Stream(sc, id, localId, pc, up) {
      * @type {number}
      */
     this.statsHandler = null;
+    /**
+     * The timer that restarts ICE if the stream remains disconnected.
+     *
+     * @type {number}
+     */
+    this.iceRestartTimer = null;
     /**
      * userdata is a convenient place to attach data to a Stream.
      * It is not used by the library.
@@ -1188,6 +1369,11 @@ Stream.prototype.close = function(replace) {
         c.statsHandler = null;
     }
 
+    if(c.iceRestartTimer) {
+        clearTimeout(c.iceRestartTimer);
+        c.iceRestartTimer = null;
+    }
+
     c.pc.close();
 
     if(c.up && !replace && c.localDescriptionSent) {
@@ -1365,11 +1551,49 @@ Stream.prototype.negotiate = async function (restartIce) {
 };
 
 /**
- * restartIce causes an ICE restart on a stream.  For up streams, it is
- * called automatically when ICE signals that the connection has failed,
- * but may also be called by the application.  For down streams, it
- * requests that the server perform an ICE restart.  In either case,
- * it returns immediately, negotiation will happen asynchronously.
+ * iceRestartDelay is the time, in milliseconds, that a stream may remain
+ * disconnected before we restart ICE.  Browsers only declare failure
+ * after tens of seconds, which is too long after a network change.
+ *
+ * @type {number}
+ */
+const iceRestartDelay = 3000;
+
+/**
+ * gotIceState is called when the ICE state of a stream changes.  It
+ * restarts ICE if the connection has failed, or has been disconnected
+ * for a while.  Don't call this.
+ *
+ * @function
+ */
+Stream.prototype.gotIceState = function() {
+    let c = this;
+    let state = c.pc.iceConnectionState;
+    if(c.onstatus)
+        c.onstatus.call(c, state);
+    if(c.iceRestartTimer) {
+        clearTimeout(c.iceRestartTimer);
+        c.iceRestartTimer = null;
+    }
+    if(state === 'failed') {
+        c.restartIce();
+    } else if(state === 'disconnected') {
+        c.iceRestartTimer = setTimeout(() => {
+            c.iceRestartTimer = null;
+            if(c.pc.iceConnectionState === 'disconnected')
+                c.restartIce();
+        }, iceRestartDelay);
+    }
+};
+
+/**
+ * restartIce causes an ICE restart on a stream.  It is called
+ * automatically when ICE signals that the connection has failed or has
+ * been disconnected for a while, but may also be called by the
+ * application, for example when the network has changed.  For down
+ * streams, it requests that the server perform an ICE restart.  In
+ * either case, it returns immediately, negotiation will happen
+ * asynchronously.
  */
 
 Stream.prototype.restartIce = function () {
@@ -1410,6 +1634,25 @@ Stream.prototype.request = function(what) {
     });
 };
 
+/**
+ * requestTrack requests a given quality for a single track of a stream.
+ *
+ * @param {string} mid - the mid of the track's transceiver.
+ * @param {Object} [request] - an object with optional fields 'spatial'
+ *     and 'temporal', the highest layers wanted, 'width' and 'height',
+ *     the size at which the track is rendered, and 'off', which stops
+ *     the track.  If absent, the server chooses freely.
+ */
+Stream.prototype.requestTrack = function(mid, request) {
+    let c = this;
+    c.sc.send({
+        type: 'requestTrack',
+        id: c.id,
+        mid: mid,
+        request: request || {},
+    });
+};
+
 /**
  * updateStats is called periodically, if requested by setStatsInterval,
  * in order to recompute stream statistics and invoke the onstats handler.
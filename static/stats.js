@@ -49,6 +49,17 @@ function formatGroup(table, group) {
     let td = document.createElement('td');
     td.textContent = group.name;
     tr.appendChild(td);
+    if(group.memory) {
+        let m = group.memory;
+        let total = m.cache + m.history + m.queue + m.recording;
+        let td2 = document.createElement('td');
+        td2.colSpan = 4;
+        let text = `${Math.round(total / 1024)}kB`;
+        if(m.max)
+            text = text + `/${Math.round(m.max / 1024)}kB`;
+        td2.textContent = text;
+        tr.appendChild(td2);
+    }
     table.appendChild(tr);
     if(group.clients) {
         for(let i = 0; i < group.clients.length; i++) {
@@ -127,6 +138,24 @@ function formatTrack(table, track) {
         text = text + `±${Math.round(track.jitter * 1000) / 1000}ms`;
     td4.textContent = text;
     tr.appendChild(td4);
+    if(track.cache) {
+        let c = track.cache;
+        let td5 = document.createElement('td');
+        td5.textContent =
+            `${c.occupied}/${c.capacity} ${Math.round(c.bytes / 1024)}kB ` +
+            `${c.hits}/${c.hits + c.misses + c.expired}`;
+        td5.title =
+            `${c.overwritten} overwritten, ${c.expired} expired, ` +
+            `grown ${c.grown} times, shrunk ${c.shrunk} times`;
+        tr.appendChild(td5);
+    }
+    if(track.keyframes) {
+        let k = track.keyframes;
+        let td6 = document.createElement('td');
+        td6.textContent = `${k.plis}/${k.requests} PLI`;
+        td6.title = `${k.suppressed} keyframe requests suppressed`;
+        tr.appendChild(td6);
+    }
     table.appendChild(tr);
 }
 
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package stats
+
+import (
+	"syscall"
+	"time"
+)
+
+// CPUTime returns the CPU time consumed by the process so far, in user
+// and system mode.
+func CPUTime() Duration {
+	var ru syscall.Rusage
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	if err != nil {
+		return 0
+	}
+	return Duration(time.Duration(ru.Utime.Nano() + ru.Stime.Nano()))
+}
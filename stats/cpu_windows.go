@@ -0,0 +1,24 @@
+package stats
+
+import (
+	"syscall"
+)
+
+// CPUTime returns the CPU time consumed by the process so far, in user
+// and kernel mode.
+func CPUTime() Duration {
+	var creation, exit, kernel, user syscall.Filetime
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0
+	}
+	err = syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user)
+	if err != nil {
+		return 0
+	}
+	// a Filetime counts intervals of 100ns
+	ticks := func(f syscall.Filetime) int64 {
+		return int64(f.HighDateTime)<<32 | int64(f.LowDateTime)
+	}
+	return Duration((ticks(kernel) + ticks(user)) * 100)
+}
@@ -0,0 +1,203 @@
+package stats
+
+import (
+	"bufio"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A family is a set of samples of a single metric.
+type family struct {
+	name, kind, help string
+	samples          []string
+}
+
+// metrics accumulates samples in the Prometheus text format.
+type metrics struct {
+	families []*family
+	index    map[string]*family
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// add adds a sample.  Labels are given as pairs of names and values.
+func (m *metrics) add(name, kind, help string, value float64, labels ...string) {
+	f := m.index[name]
+	if f == nil {
+		f = &family{name: name, kind: kind, help: help}
+		if m.index == nil {
+			m.index = make(map[string]*family)
+		}
+		m.index[name] = f
+		m.families = append(m.families, f)
+	}
+
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	f.samples = append(f.samples, b.String())
+}
+
+func (m *metrics) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range m.families {
+		bw.WriteString("# HELP " + f.name + " " + f.help + "\n")
+		bw.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+		for _, s := range f.samples {
+			bw.WriteString(s + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+func seconds(d Duration) float64 {
+	return float64(d) / float64(time.Second)
+}
+
+func (m *metrics) addTrack(labels []string, t *Track) {
+	m.add("galene_track_bitrate_bits_per_second", "gauge",
+		"Estimated bitrate of a track.",
+		float64(t.Bitrate), labels...)
+	m.add("galene_track_loss_ratio", "gauge",
+		"Fraction of packets lost.",
+		t.Loss, labels...)
+	m.add("galene_track_jitter_seconds", "gauge",
+		"Interarrival jitter.",
+		seconds(t.Jitter), labels...)
+	if t.Rtt != 0 {
+		m.add("galene_track_rtt_seconds", "gauge",
+			"Round-trip time to the receiver.",
+			seconds(t.Rtt), labels...)
+	}
+	m.add("galene_track_nacked_packets_total", "counter",
+		"Packets requested in NACKs.",
+		float64(t.NACKs), labels...)
+	if k := t.Keyframes; k != nil {
+		m.add("galene_track_keyframe_requests_total", "counter",
+			"Keyframe requests received from receivers.",
+			float64(k.Requests), labels...)
+		m.add("galene_track_plis_total", "counter",
+			"PLIs or FIRs sent to the sender.",
+			float64(k.PLIs), labels...)
+	}
+	if c := t.Cache; c != nil {
+		m.add("galene_track_cache_packets", "gauge",
+			"Packets in the packet cache.",
+			float64(c.Occupied), labels...)
+		m.add("galene_track_cache_capacity_packets", "gauge",
+			"Capacity of the packet cache.",
+			float64(c.Capacity), labels...)
+		m.add("galene_track_cache_bytes", "gauge",
+			"Size of the packet cache.",
+			float64(c.Bytes), labels...)
+	}
+}
+
+// WritePrometheus writes the given statistics in the Prometheus text
+// exposition format.
+func WritePrometheus(w io.Writer, groups []GroupStats, server Server) error {
+	var m metrics
+
+	m.add("galene_goroutines", "gauge",
+		"Number of goroutines.",
+		float64(runtime.NumGoroutine()))
+	m.add("galene_groups", "gauge",
+		"Number of active groups.",
+		float64(len(groups)))
+	m.add("galene_cpu_seconds_total", "counter",
+		"CPU time consumed by the server.",
+		seconds(server.CPU))
+
+	e := server.Egress
+	m.add("galene_egress_workers", "gauge",
+		"Number of egress workers.", float64(e.Workers))
+	m.add("galene_egress_backlog", "gauge",
+		"Packets waiting for an egress worker.", float64(e.Backlog))
+	m.add("galene_egress_utilisation_ratio", "gauge",
+		"Fraction of time the egress workers are busy.",
+		e.Utilisation)
+	m.add("galene_egress_packets_total", "counter",
+		"Packets written by the egress workers.", float64(e.Packets))
+	m.add("galene_egress_direct_total", "counter",
+		"Send queues handed directly to an idle egress worker.",
+		float64(e.Direct))
+
+	for _, g := range groups {
+		m.add("galene_group_clients", "gauge",
+			"Number of clients in a group.",
+			float64(len(g.Clients)), "group", g.Name)
+		for _, kind := range []struct {
+			name  string
+			value int64
+		}{
+			{"cache", g.Memory.Cache},
+			{"history", g.Memory.History},
+			{"queue", g.Memory.Queue},
+			{"recording", g.Memory.Recording},
+		} {
+			m.add("galene_group_memory_bytes", "gauge",
+				"Memory accounted to a group.",
+				float64(kind.value),
+				"group", g.Name, "kind", kind.name)
+		}
+
+		tracks := map[string]int{"up": 0, "down": 0}
+		for _, c := range g.Clients {
+			for _, conns := range []struct {
+				direction string
+				conns     []Conn
+			}{{"up", c.Up}, {"down", c.Down}} {
+				for _, conn := range conns.conns {
+					labels := []string{
+						"group", g.Name,
+						"client", c.Id,
+						"conn", conn.Id,
+						"direction", conns.direction,
+					}
+					if conns.direction == "down" {
+						m.add("galene_conn_dropped_packets_total",
+							"counter",
+							"Packets dropped by the send queue.",
+							float64(conn.DroppedVideo+
+								conn.DroppedKeyframes+
+								conn.DroppedAudio+
+								conn.DroppedTooLarge),
+							labels...)
+					}
+					for i := range conn.Tracks {
+						l := make([]string, len(labels), len(labels)+2)
+						copy(l, labels)
+						l = append(l, "track", strconv.Itoa(i))
+						m.addTrack(l, &conn.Tracks[i])
+					}
+					tracks[conns.direction] += len(conn.Tracks)
+				}
+			}
+		}
+		for _, direction := range []string{"up", "down"} {
+			m.add("galene_group_tracks", "gauge",
+				"Number of tracks in a group.",
+				float64(tracks[direction]),
+				"group", g.Name, "direction", direction)
+		}
+	}
+
+	return m.write(w)
+}
@@ -0,0 +1,73 @@
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	groups := []GroupStats{{
+		Name:   `a"b`,
+		Memory: Memory{Cache: 1000},
+		Clients: []*Client{{
+			Id: "c1",
+			Up: []Conn{{
+				Id: "u1",
+				Tracks: []Track{{
+					Bitrate:   100000,
+					Loss:      0.5,
+					Jitter:    Duration(10 * time.Millisecond),
+					NACKs:     3,
+					Keyframes: &Keyframes{Requests: 2, PLIs: 1},
+				}},
+			}},
+			Down: []Conn{{
+				Id:           "d1",
+				DroppedAudio: 4,
+				Tracks:       []Track{{}, {Rtt: Duration(time.Second)}},
+			}},
+		}},
+	}}
+
+	var buf bytes.Buffer
+	err := WritePrometheus(&buf, groups, Server{
+		CPU:    Duration(1500 * time.Millisecond),
+		Egress: Egress{Workers: 4},
+	})
+	if err != nil {
+		t.Fatalf("WritePrometheus: %v", err)
+	}
+	out := buf.String()
+
+	up := `group="a\"b",client="c1",conn="u1",direction="up",track="0"`
+	down := `group="a\"b",client="c1",conn="d1",direction="down"`
+	expected := []string{
+		"# TYPE galene_groups gauge\ngalene_groups 1\n",
+		"galene_cpu_seconds_total 1.5\n",
+		"galene_egress_workers 4\n",
+		`galene_group_clients{group="a\"b"} 1` + "\n",
+		`galene_group_memory_bytes{group="a\"b",kind="cache"} 1000` + "\n",
+		`galene_group_tracks{group="a\"b",direction="up"} 1` + "\n",
+		`galene_group_tracks{group="a\"b",direction="down"} 2` + "\n",
+		"galene_track_bitrate_bits_per_second{" + up + "} 100000\n",
+		"galene_track_loss_ratio{" + up + "} 0.5\n",
+		"galene_track_jitter_seconds{" + up + "} 0.01\n",
+		"galene_track_nacked_packets_total{" + up + "} 3\n",
+		"galene_track_plis_total{" + up + "} 1\n",
+		"galene_conn_dropped_packets_total{" + down + "} 4\n",
+		"galene_track_rtt_seconds{" + down + `,track="1"} 1` + "\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Missing %q", e)
+		}
+	}
+	if strings.Count(out, "# TYPE galene_track_loss_ratio ") != 1 {
+		t.Errorf("Duplicate family")
+	}
+	if strings.Contains(out, "galene_track_rtt_seconds{"+down+`,track="0"}`) {
+		t.Errorf("Zero RTT exported")
+	}
+}
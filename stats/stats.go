@@ -6,17 +6,42 @@ import (
 	"time"
 
 	"github.com/jech/galene/group"
+	"github.com/jech/galene/mixer"
 )
 
 type GroupStats struct {
 	Name    string    `json:"name"`
+	Memory  Memory    `json:"memory"`
+	Mixer   *Mixer    `json:"mixer,omitempty"`
 	Clients []*Client `json:"clients,omitempty"`
 }
 
+// Mixer contains statistics about a group's audio mixer.
+type Mixer struct {
+	Inputs      int      `json:"inputs"`
+	Unsupported int      `json:"unsupported,omitempty"`
+	Consumers   int      `json:"consumers"`
+	Decoded     uint64   `json:"decoded"`
+	Frames      uint64   `json:"frames"`
+	Underruns   uint64   `json:"underruns"`
+	Overruns    uint64   `json:"overruns"`
+	Busy        Duration `json:"busy"`
+}
+
+// Memory contains the number of bytes accounted to a group.
+type Memory struct {
+	Cache     int64 `json:"cache"`
+	History   int64 `json:"history"`
+	Queue     int64 `json:"queue"`
+	Recording int64 `json:"recording"`
+	Max       int64 `json:"max,omitempty"`
+}
+
 type Client struct {
-	Id   string `json:"id"`
-	Up   []Conn `json:"up,omitempty"`
-	Down []Conn `json:"down,omitempty"`
+	Id       string `json:"id"`
+	Username string `json:"username,omitempty"`
+	Up       []Conn `json:"up,omitempty"`
+	Down     []Conn `json:"down,omitempty"`
 }
 
 type Statable interface {
@@ -24,9 +49,21 @@ type Statable interface {
 }
 
 type Conn struct {
-	Id         string  `json:"id"`
-	MaxBitrate uint64  `json:"maxBitrate,omitempty"`
-	Tracks     []Track `json:"tracks"`
+	Id               string     `json:"id"`
+	Transport        *Transport `json:"transport,omitempty"`
+	MaxBitrate       uint64     `json:"maxBitrate,omitempty"`
+	DroppedVideo     uint64     `json:"droppedVideo,omitempty"`
+	DroppedKeyframes uint64     `json:"droppedKeyframes,omitempty"`
+	DroppedAudio     uint64     `json:"droppedAudio,omitempty"`
+	DroppedTooLarge  uint64     `json:"droppedTooLarge,omitempty"`
+	Tracks           []Track    `json:"tracks"`
+}
+
+// Transport describes the ICE candidate pair selected for a connection.
+type Transport struct {
+	Protocol string `json:"protocol"`
+	Local    string `json:"local"`
+	Remote   string `json:"remote"`
 }
 
 type Duration time.Duration
@@ -47,15 +84,62 @@ func (d *Duration) UnmarshalJSON(buf []byte) error {
 }
 
 type Track struct {
-	Sid        *uint8   `json:"sid,omitempty"`
-	MaxSid     *uint8   `json:"maxSid,omitempty"`
-	Tid        *uint8   `json:"tid,omitempty"`
-	MaxTid     *uint8   `json:"maxTid,omitempty"`
-	Bitrate    uint64   `json:"bitrate"`
-	MaxBitrate uint64   `json:"maxBitrate,omitempty"`
-	Loss       float64  `json:"loss"`
-	Rtt        Duration `json:"rtt,omitempty"`
-	Jitter     Duration `json:"jitter,omitempty"`
+	Sid        *uint8     `json:"sid,omitempty"`
+	MaxSid     *uint8     `json:"maxSid,omitempty"`
+	Tid        *uint8     `json:"tid,omitempty"`
+	MaxTid     *uint8     `json:"maxTid,omitempty"`
+	Bitrate    uint64     `json:"bitrate"`
+	MaxBitrate uint64     `json:"maxBitrate,omitempty"`
+	Loss       float64    `json:"loss"`
+	Rtt        Duration   `json:"rtt,omitempty"`
+	Jitter     Duration   `json:"jitter,omitempty"`
+	Cache      *Cache     `json:"cache,omitempty"`
+	Keyframes  *Keyframes `json:"keyframes,omitempty"`
+	// packets requested in NACKs, by us for up tracks, by the
+	// receiver for down tracks
+	NACKs uint64 `json:"nacks,omitempty"`
+}
+
+// Keyframes contains statistics about the keyframe requests sent by
+// the receivers of an up track.
+type Keyframes struct {
+	Requests   uint64 `json:"requests"`
+	PLIs       uint64 `json:"plis"`
+	Suppressed uint64 `json:"suppressed"`
+}
+
+// Cache contains statistics about the packet cache of an up track.
+type Cache struct {
+	Capacity    int    `json:"capacity"`
+	Occupied    int    `json:"occupied"`
+	Bytes       int    `json:"bytes"`
+	Overwritten uint64 `json:"overwritten"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Expired     uint64 `json:"expired"`
+	Grown       uint32 `json:"grown"`
+	Shrunk      uint32 `json:"shrunk"`
+}
+
+// Egress contains statistics about the pool of goroutines that write
+// packets to subscribers, and therefore perform SRTP encryption.
+type Egress struct {
+	Workers     int      `json:"workers"`
+	Active      int      `json:"active"`
+	Backlog     int      `json:"backlog"`
+	Utilisation float64  `json:"utilisation"`
+	Busy        Duration `json:"busy"`
+	Packets     uint64   `json:"packets"`
+	// the number of times a queue was handed directly to an idle
+	// worker rather than waiting in the run list
+	Direct uint64 `json:"direct"`
+}
+
+// Server contains server-wide statistics.
+type Server struct {
+	// the CPU time consumed by the server since it started
+	CPU    Duration `json:"cpu"`
+	Egress Egress   `json:"egress"`
 }
 
 func GetGroups() []GroupStats {
@@ -69,9 +153,28 @@ func GetGroups() []GroupStats {
 		}
 		clients := g.GetClients(nil)
 		stats := GroupStats{
-			Name:    name,
+			Name: name,
+			Memory: Memory{
+				Cache:     g.Memory(group.MemoryCache).Get(),
+				History:   g.Memory(group.MemoryHistory).Get(),
+				Queue:     g.Memory(group.MemoryQueue).Get(),
+				Recording: g.Memory(group.MemoryRecording).Get(),
+				Max:       g.MaxMemory(),
+			},
 			Clients: make([]*Client, 0, len(clients)),
 		}
+		if m := mixer.GetStats(g); m != nil {
+			stats.Mixer = &Mixer{
+				Inputs:      m.Inputs,
+				Unsupported: m.Unsupported,
+				Consumers:   m.Consumers,
+				Decoded:     m.Decoded,
+				Frames:      m.Frames,
+				Underruns:   m.Underruns,
+				Overruns:    m.Overruns,
+				Busy:        Duration(m.Busy),
+			}
+		}
 		for _, c := range clients {
 			s, ok := c.(Statable)
 			if ok {
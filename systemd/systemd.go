@@ -0,0 +1,160 @@
+// Package systemd implements the parts of the systemd protocols that are
+// useful to Galene: socket activation and service notifications.  All
+// functions do nothing when not running under systemd.
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+var listeners struct {
+	once  sync.Once
+	files map[string][]*os.File
+}
+
+// parseListenFds parses the environment variables set by systemd for
+// socket activation, and returns the file descriptors indexed by name.
+func parseListenFds(pid, fds, names string) map[string][]int {
+	p, err := strconv.Atoi(pid)
+	if err != nil || p != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	var ns []string
+	if names != "" {
+		ns = strings.Split(names, ":")
+	}
+	fdmap := make(map[string][]int)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(ns) {
+			name = ns[i]
+		}
+		fdmap[name] = append(fdmap[name], listenFdsStart+i)
+	}
+	return fdmap
+}
+
+func getFiles() map[string][]*os.File {
+	listeners.once.Do(func() {
+		fdmap := parseListenFds(
+			os.Getenv("LISTEN_PID"),
+			os.Getenv("LISTEN_FDS"),
+			os.Getenv("LISTEN_FDNAMES"),
+		)
+		if fdmap != nil {
+			listeners.files = make(map[string][]*os.File)
+		}
+		for name, fds := range fdmap {
+			for _, fd := range fds {
+				listeners.files[name] = append(
+					listeners.files[name],
+					os.NewFile(uintptr(fd), "systemd:"+name),
+				)
+			}
+		}
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	return listeners.files
+}
+
+// Files returns the sockets with the given name passed by systemd, as
+// set by FileDescriptorName in the socket unit.
+func Files(name string) []*os.File {
+	return getFiles()[name]
+}
+
+// Sockets returns the sockets with the given name, converted to
+// listeners (for stream sockets) and packet connections (for datagram
+// sockets).  The sockets are duplicated, so the results may be closed
+// and Sockets called again.
+func Sockets(name string) ([]net.Listener, []net.PacketConn, error) {
+	var ls []net.Listener
+	var pcs []net.PacketConn
+	for _, f := range Files(name) {
+		l, err := net.FileListener(f)
+		if err == nil {
+			ls = append(ls, l)
+			continue
+		}
+		pc, err := net.FilePacketConn(f)
+		if err == nil {
+			pcs = append(pcs, pc)
+			continue
+		}
+		for _, l := range ls {
+			l.Close()
+		}
+		for _, pc := range pcs {
+			pc.Close()
+		}
+		return nil, nil, errors.New(
+			"couldn't use socket " + f.Name() + ": " + err.Error(),
+		)
+	}
+	return ls, pcs, nil
+}
+
+// Notify sends a state change notification to the service manager,
+// such as "READY=1" or "STOPPING=1".
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: socket, Net: "unixgram"},
+	)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// parseWatchdog parses the environment variables set by systemd when
+// WatchdogSec is set.
+func parseWatchdog(usec, pid string) time.Duration {
+	if usec == "" {
+		return 0
+	}
+	if pid != "" {
+		p, err := strconv.Atoi(pid)
+		if err != nil || p != os.Getpid() {
+			return 0
+		}
+	}
+	u, err := strconv.ParseUint(usec, 10, 63)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(u) * time.Microsecond
+}
+
+// WatchdogInterval returns the interval within which the service
+// manager expects "WATCHDOG=1" notifications, or 0 if the watchdog is
+// disabled.
+func WatchdogInterval() time.Duration {
+	return parseWatchdog(
+		os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID"),
+	)
+}
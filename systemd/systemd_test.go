@@ -0,0 +1,145 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseListenFds(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	if fs := parseListenFds("1", "2", ""); fs != nil {
+		t.Errorf("Accepted wrong pid")
+	}
+	if fs := parseListenFds(pid, "0", ""); fs != nil {
+		t.Errorf("Accepted zero fds")
+	}
+	if fs := parseListenFds("", "", ""); fs != nil {
+		t.Errorf("Accepted empty environment")
+	}
+
+	fs := parseListenFds(pid, "3", "http:turn:turn")
+	if len(fs["http"]) != 1 || len(fs["turn"]) != 2 {
+		t.Fatalf("Bad result %v", fs)
+	}
+	if fd := fs["http"][0]; fd != 3 {
+		t.Errorf("Expected 3, got %v", fd)
+	}
+	if fd := fs["turn"][1]; fd != 5 {
+		t.Errorf("Expected 5, got %v", fd)
+	}
+
+	fs = parseListenFds(pid, "1", "")
+	if len(fs["unknown"]) != 1 {
+		t.Errorf("Bad result %v", fs)
+	}
+}
+
+func TestParseWatchdog(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	if d := parseWatchdog("", ""); d != 0 {
+		t.Errorf("Expected 0, got %v", d)
+	}
+	if d := parseWatchdog("3000000", ""); d != 3*time.Second {
+		t.Errorf("Expected 3s, got %v", d)
+	}
+	if d := parseWatchdog("3000000", pid); d != 3*time.Second {
+		t.Errorf("Expected 3s, got %v", d)
+	}
+	if d := parseWatchdog("3000000", "1"); d != 0 {
+		t.Errorf("Expected 0, got %v", d)
+	}
+	if d := parseWatchdog("x", ""); d != 0 {
+		t.Errorf("Expected 0, got %v", d)
+	}
+}
+
+func TestSockets(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+
+	lf, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	pcf, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+
+	listeners.once.Do(func() {})
+	listeners.files = map[string][]*os.File{"test": {lf, pcf}}
+	defer func() {
+		listeners.files = nil
+	}()
+
+	ls, pcs, err := Sockets("test")
+	if err != nil {
+		t.Fatalf("Sockets: %v", err)
+	}
+	if len(ls) != 1 || len(pcs) != 1 {
+		t.Fatalf("Got %v listeners and %v packet conns", len(ls), len(pcs))
+	}
+	if ls[0].Addr().String() != l.Addr().String() {
+		t.Errorf("Expected %v, got %v", l.Addr(), ls[0].Addr())
+	}
+	if pcs[0].LocalAddr().String() != pc.LocalAddr().String() {
+		t.Errorf("Expected %v, got %v", pc.LocalAddr(), pcs[0].LocalAddr())
+	}
+
+	// the sockets are duplicated
+	ls[0].Close()
+	pcs[0].Close()
+	ls, pcs, err = Sockets("test")
+	if err != nil || len(ls) != 1 || len(pcs) != 1 {
+		t.Fatalf("Sockets: %v %v %v", ls, pcs, err)
+	}
+	ls[0].Close()
+	pcs[0].Close()
+
+	ls, pcs, err = Sockets("none")
+	if err != nil || len(ls) != 0 || len(pcs) != 0 {
+		t.Errorf("Sockets: %v %v %v", ls, pcs, err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	err := Notify("READY=1")
+	if err != nil {
+		t.Errorf("Notify: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify")
+	c, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: path, Net: "unixgram"},
+	)
+	if err != nil {
+		t.Fatalf("ListenUnixgram: %v", err)
+	}
+	defer c.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	err = Notify("READY=1")
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	buf := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("Read: %q %v", buf[:n], err)
+	}
+}
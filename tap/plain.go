@@ -0,0 +1,254 @@
+package tap
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtpheader"
+)
+
+// A plainStream forwards a single track as plain RTP, together with
+// RTCP sender reports on the next port up.
+type plainStream struct {
+	rtp, rtcp *sender
+
+	mu      sync.Mutex
+	pt      uint8
+	ssrc    uint32
+	packets uint32
+	octets  uint32
+}
+
+// plainOutput is the destination of a tap in "plain" format: audio is
+// sent to the configured port, and video two ports up.
+type plainOutput struct {
+	host         string
+	port         int
+	audio, video *plainStream
+}
+
+func newPlainStream(host string, port int, onError func(error)) (*plainStream, error) {
+	c1, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	c2, err := net.Dial("udp",
+		net.JoinHostPort(host, strconv.Itoa(port+1)),
+	)
+	if err != nil {
+		c1.Close()
+		return nil, err
+	}
+	return &plainStream{
+		rtp:  newSender(c1, onError),
+		rtcp: newSender(c2, onError),
+	}, nil
+}
+
+func (s *plainStream) close() {
+	s.rtp.close()
+	s.rtcp.close()
+}
+
+func (s *plainStream) dropped() uint64 {
+	return atomic.LoadUint64(&s.rtp.dropped) +
+		atomic.LoadUint64(&s.rtcp.dropped)
+}
+
+func newPlainOutput(address string, video bool, onError func(error)) (*plainOutput, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, err
+	}
+	o := &plainOutput{host: host, port: port}
+	o.audio, err = newPlainStream(host, port, onError)
+	if err != nil {
+		return nil, err
+	}
+	if video {
+		o.video, err = newPlainStream(host, port+2, onError)
+		if err != nil {
+			o.audio.close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *plainOutput) close() {
+	o.audio.close()
+	if o.video != nil {
+		o.video.close()
+	}
+}
+
+func (o *plainOutput) dropped() uint64 {
+	n := o.audio.dropped()
+	if o.video != nil {
+		n += o.video.dropped()
+	}
+	return n
+}
+
+// setPayloadType sets the payload type announced in the SDP.
+func (s *plainStream) setPayloadType(pt uint8) {
+	s.mu.Lock()
+	s.pt = pt
+	s.mu.Unlock()
+}
+
+// write forwards an RTP packet, rewriting just the payload type, which
+// may have been chosen by the sender.
+func (s *plainStream) write(buf []byte) {
+	h, err := rtpheader.Parse(buf)
+	if err != nil {
+		return
+	}
+	b := append(getBuf(), buf...)
+	s.mu.Lock()
+	b[1] = (b[1] & 0x80) | s.pt
+	s.ssrc = h.SSRC()
+	s.packets++
+	s.octets += uint32(len(h.Payload()))
+	s.mu.Unlock()
+	s.rtp.send(b)
+}
+
+// senderReport sends a sender report that maps the sender's clock to
+// the RTP timestamps, which allows the consumer to synchronise audio
+// and video.
+func (s *plainStream) senderReport(ntp uint64, rtpTime uint32) {
+	s.mu.Lock()
+	sr := rtcp.SenderReport{
+		SSRC:        s.ssrc,
+		NTPTime:     ntp,
+		RTPTime:     rtpTime,
+		PacketCount: s.packets,
+		OctetCount:  s.octets,
+	}
+	s.mu.Unlock()
+	if sr.SSRC == 0 || ntp == 0 {
+		return
+	}
+	b, err := sr.Marshal()
+	if err != nil {
+		return
+	}
+	s.rtcp.send(b)
+}
+
+// pushPlain starts forwarding a connection in plain format.  Since there
+// is just one pair of ports per media type, only one connection is
+// forwarded at a time.  Called with c.mu held.
+func (c *Client) pushPlain(id string, tracks []conn.UpTrack) {
+	if len(c.down) > 0 {
+		return
+	}
+
+	var audio, video conn.UpTrack
+	for _, t := range tracks {
+		_, err := group.CodecPayloadType(t.Codec())
+		if err != nil {
+			continue
+		}
+		switch t.Kind() {
+		case webrtc.RTPCodecTypeAudio:
+			if audio == nil {
+				audio = t
+			}
+		case webrtc.RTPCodecTypeVideo:
+			// with simulcast, forward the highest layer
+			if c.plain.video != nil &&
+				(video == nil || video.Label() == "l") {
+				video = t
+			}
+		}
+	}
+	if audio == nil && video == nil {
+		return
+	}
+
+	d := &tapConn{}
+	add := func(t conn.UpTrack, s *plainStream) {
+		pt, _ := group.CodecPayloadType(t.Codec())
+		s.setPayloadType(uint8(pt))
+		d.tracks = append(d.tracks, &tapTrack{remote: t, plain: s})
+	}
+	if audio != nil {
+		add(audio, c.plain.audio)
+	}
+	if video != nil {
+		add(video, c.plain.video)
+	}
+
+	if c.config.SDP != "" {
+		err := os.WriteFile(c.config.SDP, []byte(
+			plainSDP(c.plain.host, c.plain.port, audio, video),
+		), 0o644)
+		if err != nil {
+			logger.Warnf("Tap %v/%v: %v", c.group.Name(), c.name, err)
+		}
+	}
+
+	for _, tt := range d.tracks {
+		err := tt.remote.AddLocal(tt)
+		if err != nil {
+			logger.Warnf("Tap: %v", err)
+		}
+	}
+	if video != nil {
+		video.RequestKeyframe()
+	}
+	if c.down == nil {
+		c.down = make(map[string]*tapConn)
+	}
+	c.down[id] = d
+}
+
+// plainSDP returns a session description suitable for ffmpeg or
+// GStreamer.
+func plainSDP(host string, port int, audio, video conn.UpTrack) string {
+	family := "IP4"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		family = "IP6"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\no=- 0 0 IN %v %v\r\n", family, host)
+	fmt.Fprintf(&b, "s=Galene\r\nc=IN %v %v\r\nt=0 0\r\n", family, host)
+	media := func(kind string, port int, t conn.UpTrack) {
+		codec := t.Codec()
+		pt, _ := group.CodecPayloadType(codec)
+		_, name, _ := strings.Cut(codec.MimeType, "/")
+		fmt.Fprintf(&b, "m=%v %v RTP/AVP %v\r\n", kind, port, pt)
+		fmt.Fprintf(&b, "a=rtpmap:%v %v/%v", pt, name, codec.ClockRate)
+		if codec.Channels > 1 {
+			fmt.Fprintf(&b, "/%v", codec.Channels)
+		}
+		b.WriteString("\r\n")
+		if codec.SDPFmtpLine != "" {
+			fmt.Fprintf(&b, "a=fmtp:%v %v\r\n", pt, codec.SDPFmtpLine)
+		}
+		b.WriteString("a=recvonly\r\n")
+	}
+	if audio != nil {
+		media("audio", port, audio)
+	}
+	if video != nil {
+		media("video", port+2, video)
+	}
+	return b.String()
+}
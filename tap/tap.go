@@ -0,0 +1,431 @@
+// Package tap forwards the media of a group to a local process over
+// a UNIX or UDP socket, either framed or as plain RTP.
+package tap
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/rtpheader"
+)
+
+var logger = logging.New("tap")
+
+// Message types
+const (
+	TypeRTPAudio = 1
+	TypeRTPVideo = 2
+	TypeOpus     = 3
+)
+
+const (
+	queueLength  = 256
+	writeTimeout = time.Second
+	// the size of the buffers in bufPool, enough for a framed packet
+	// with a long username
+	bufSize = 2048
+)
+
+// bufPool holds the buffers of the messages queued by senders.  It
+// stores array pointers, which, unlike slices, don't need to be
+// allocated when converted to an interface.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new([bufSize]byte)
+	},
+}
+
+func getBuf() []byte {
+	return bufPool.Get().(*[bufSize]byte)[:0]
+}
+
+// putBuf returns a buffer obtained from getBuf to the pool.  Buffers of
+// a different capacity, which were either allocated elsewhere or grown
+// by append, are left to the garbage collector.
+func putBuf(b []byte) {
+	if cap(b) == bufSize {
+		bufPool.Put((*[bufSize]byte)(b[:bufSize]))
+	}
+}
+
+// appendFrame appends a message to b: a four-byte length, the type, the
+// length-prefixed user id and username, the local time in microseconds
+// since the Unix epoch, the RTP timestamp, and the payload.
+func appendFrame(b []byte, typ byte, id, username string, now time.Time, ts uint32, payload []byte) []byte {
+	if len(id) > 255 {
+		id = id[:255]
+	}
+	if len(username) > 255 {
+		username = username[:255]
+	}
+	length := 1 + 1 + len(id) + 1 + len(username) + 8 + 4 + len(payload)
+	b = binary.BigEndian.AppendUint32(b, uint32(length))
+	b = append(b, typ, byte(len(id)))
+	b = append(b, id...)
+	b = append(b, byte(len(username)))
+	b = append(b, username...)
+	b = binary.BigEndian.AppendUint64(b, uint64(now.UnixMicro()))
+	b = binary.BigEndian.AppendUint32(b, ts)
+	return append(b, payload...)
+}
+
+// A sender writes messages to a socket from its own goroutine, and drops
+// them when the socket cannot keep up.
+type sender struct {
+	conn    net.Conn
+	queue   chan []byte
+	done    chan struct{}
+	dropped uint64
+	// called once if writing fails
+	onError func(error)
+}
+
+func newSender(c net.Conn, onError func(error)) *sender {
+	s := &sender{
+		conn:    c,
+		queue:   make(chan []byte, queueLength),
+		done:    make(chan struct{}),
+		onError: onError,
+	}
+	go s.run()
+	return s
+}
+
+func (s *sender) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case b := <-s.queue:
+			s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := s.conn.Write(b)
+			putBuf(b)
+			if err != nil {
+				select {
+				case <-s.done:
+				default:
+					s.onError(err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// send queues a message, and never blocks.  It takes ownership of b,
+// which is returned to bufPool once it has been written.
+func (s *sender) send(b []byte) {
+	select {
+	case s.queue <- b:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		putBuf(b)
+	}
+}
+
+func (s *sender) close() {
+	close(s.done)
+	s.conn.Close()
+}
+
+// Client is a group client that forwards media to a tap.
+type Client struct {
+	group  *group.Group
+	id     string
+	name   string
+	config group.Tap
+	sender *sender
+	plain  *plainOutput
+
+	mu     sync.Mutex
+	down   map[string]*tapConn
+	closed bool
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// New connects to the consumer of a tap.  The user, if not empty,
+// restricts the tap to the streams of the given user.
+func New(g *group.Group, name, user string) (*Client, error) {
+	config, ok := g.Description().Taps[name]
+	if !ok {
+		return nil, group.UserError("unknown tap " + name)
+	}
+	if user != "" {
+		if config.User != "" && config.User != user {
+			return nil, group.UserError(
+				"tap " + name + " is restricted to user " +
+					config.User,
+			)
+		}
+		config.User = user
+	}
+	network, address, err := config.ParseAddress()
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		group:  g,
+		id:     newId(),
+		name:   name,
+		config: config,
+	}
+	if config.Format == "plain" {
+		c.plain, err = newPlainOutput(address, config.Video, c.detach)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	cn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c.sender = newSender(cn, c.detach)
+	return c, nil
+}
+
+func (c *Client) Group() *group.Group {
+	return c.group
+}
+
+func (c *Client) Id() string {
+	return c.id
+}
+
+func (c *Client) Name() string {
+	return c.name
+}
+
+func (c *Client) Username() string {
+	return "TAP " + c.name
+}
+
+func (c *Client) SetUsername(string) {
+	return
+}
+
+func (c *Client) Permissions() []string {
+	return []string{"system"}
+}
+
+func (c *Client) SetPermissions(perms []string) {
+	return
+}
+
+func (c *Client) Data() map[string]interface{} {
+	return nil
+}
+
+func (c *Client) PushClient(group, kind, id, username string, perms []string, data map[string]interface{}) error {
+	return nil
+}
+
+func (c *Client) RequestConns(target group.Client, g *group.Group, id string) error {
+	return nil
+}
+
+func (c *Client) Joined(group, kind string) error {
+	return nil
+}
+
+func (c *Client) Kick(id string, user *string, message string) error {
+	err := c.Close()
+	group.DelClient(c)
+	return err
+}
+
+// Close stops forwarding.  The caller should then remove the client
+// from its group.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	down := c.down
+	c.down = nil
+	c.mu.Unlock()
+
+	for _, d := range down {
+		d.close()
+	}
+	var n uint64
+	if c.plain != nil {
+		c.plain.close()
+		n = c.plain.dropped()
+	} else {
+		c.sender.close()
+		n = atomic.LoadUint64(&c.sender.dropped)
+	}
+	if n > 0 {
+		logger.Warnf("Tap %v/%v: dropped %v messages",
+			c.group.Name(), c.name, n)
+	}
+	return nil
+}
+
+// detach is called when the consumer has disappeared.
+func (c *Client) detach(err error) {
+	logger.Warnf("Tap %v/%v: %v", c.group.Name(), c.name, err)
+	c.group.WallOps("Tap " + c.name + " detached: consumer disappeared")
+	c.Close()
+	group.DelClient(c)
+}
+
+func (c *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, replace string) error {
+	if c.group != g {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New("tap is closed")
+	}
+
+	if replace != "" {
+		if d := c.down[replace]; d != nil {
+			d.close()
+			delete(c.down, replace)
+		}
+	}
+	if d := c.down[id]; d != nil {
+		d.close()
+		delete(c.down, id)
+	}
+
+	if up == nil {
+		return nil
+	}
+
+	userId, username := up.User()
+	if c.config.User != "" && username != c.config.User {
+		return nil
+	}
+
+	if c.plain != nil {
+		c.pushPlain(id, tracks)
+		return nil
+	}
+
+	// with simulcast, only forward the highest layer
+	high := false
+	for _, t := range tracks {
+		if t.Kind() == webrtc.RTPCodecTypeVideo && t.Label() != "l" {
+			high = true
+		}
+	}
+
+	d := &tapConn{}
+	for _, t := range tracks {
+		var typ byte
+		switch t.Kind() {
+		case webrtc.RTPCodecTypeAudio:
+			typ = TypeRTPAudio
+			if c.config.Format == "opus" {
+				if t.Codec().MimeType != webrtc.MimeTypeOpus {
+					continue
+				}
+				typ = TypeOpus
+			}
+		case webrtc.RTPCodecTypeVideo:
+			if !c.config.Video {
+				continue
+			}
+			if high && t.Label() == "l" {
+				continue
+			}
+			typ = TypeRTPVideo
+		default:
+			continue
+		}
+		tt := &tapTrack{
+			remote:   t,
+			sender:   c.sender,
+			typ:      typ,
+			id:       userId,
+			username: username,
+		}
+		d.tracks = append(d.tracks, tt)
+	}
+	for _, tt := range d.tracks {
+		err := tt.remote.AddLocal(tt)
+		if err != nil {
+			logger.Warnf("Tap: %v", err)
+		}
+	}
+	if c.down == nil {
+		c.down = make(map[string]*tapConn)
+	}
+	c.down[id] = d
+	return nil
+}
+
+type tapConn struct {
+	tracks []*tapTrack
+}
+
+func (d *tapConn) close() {
+	for _, t := range d.tracks {
+		t.remote.DelLocal(t)
+	}
+}
+
+type tapTrack struct {
+	remote   conn.UpTrack
+	sender   *sender
+	plain    *plainStream
+	typ      byte
+	id       string
+	username string
+}
+
+func (t *tapTrack) Write(buf []byte) (int, error) {
+	if t.plain != nil {
+		t.plain.write(buf)
+		return len(buf), nil
+	}
+	h, err := rtpheader.Parse(buf)
+	if err != nil {
+		return 0, nil
+	}
+	payload := buf
+	if t.typ == TypeOpus {
+		payload = h.Payload()
+	}
+	t.sender.send(appendFrame(getBuf(),
+		t.typ, t.id, t.username, time.Now(), h.Timestamp(), payload,
+	))
+	return len(buf), nil
+}
+
+func (t *tapTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+	if t.plain != nil {
+		t.plain.senderReport(ntp, rtp)
+	}
+}
+
+func (t *tapTrack) SetCname(string) {
+}
+
+func (t *tapTrack) GetMaxBitrate() (uint64, int, int) {
+	return ^uint64(0), -1, -1
+}
@@ -0,0 +1,282 @@
+package tap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+)
+
+func TestFrame(t *testing.T) {
+	now := time.Unix(1700000000, 123456000)
+	payload := []byte{1, 2, 3}
+	b := appendFrame(nil, TypeOpus, "id", "bob", now, 42, payload)
+
+	if len(b) != 4+1+1+2+1+3+8+4+3 {
+		t.Fatalf("Bad length %v", len(b))
+	}
+	if l := binary.BigEndian.Uint32(b); int(l) != len(b)-4 {
+		t.Errorf("Bad length field %v", l)
+	}
+	if b[4] != TypeOpus {
+		t.Errorf("Bad type %v", b[4])
+	}
+	if b[5] != 2 || string(b[6:8]) != "id" {
+		t.Errorf("Bad id %v", b[5:8])
+	}
+	if b[8] != 3 || string(b[9:12]) != "bob" {
+		t.Errorf("Bad username %v", b[8:12])
+	}
+	if v := binary.BigEndian.Uint64(b[12:]); v != uint64(now.UnixMicro()) {
+		t.Errorf("Bad time %v", v)
+	}
+	if v := binary.BigEndian.Uint32(b[20:]); v != 42 {
+		t.Errorf("Bad timestamp %v", v)
+	}
+	if !bytes.Equal(b[24:], payload) {
+		t.Errorf("Bad payload %v", b[24:])
+	}
+}
+
+func TestFrameLongUsername(t *testing.T) {
+	username := string(bytes.Repeat([]byte{'a'}, 300))
+	b := appendFrame(nil, TypeRTPAudio, "", username, time.Now(), 0, nil)
+	if b[5] != 0 || b[6] != 255 {
+		t.Errorf("Bad lengths %v %v", b[5], b[6])
+	}
+	if l := binary.BigEndian.Uint32(b); int(l) != len(b)-4 {
+		t.Errorf("Bad length field %v", l)
+	}
+}
+
+func TestSenderDrop(t *testing.T) {
+	// the other end never reads, so the queue eventually fills up
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := newSender(c1, func(error) {})
+	defer s.close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*queueLength; i++ {
+			s.send([]byte{0})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Send blocked")
+	}
+	if atomic.LoadUint64(&s.dropped) == 0 {
+		t.Errorf("Nothing dropped")
+	}
+}
+
+func TestSenderDetach(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tap.sock")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{
+		Name: path, Net: "unixgram",
+	})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	c, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	errors := make(chan error, 1)
+	s := newSender(c, func(err error) {
+		errors <- err
+	})
+	defer s.close()
+
+	s.send([]byte{1, 2, 3})
+	buf := make([]byte, 16)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := l.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte{1, 2, 3}) {
+		t.Fatalf("Read: %v %v", buf[:n], err)
+	}
+
+	// the consumer goes away
+	l.Close()
+	s.send([]byte{4})
+	select {
+	case <-errors:
+	case <-time.After(time.Second):
+		t.Errorf("Sender didn't notice the consumer went away")
+	}
+}
+
+type fakeTrack struct {
+	kind  webrtc.RTPCodecType
+	codec webrtc.RTPCodecCapability
+}
+
+func (t *fakeTrack) AddLocal(conn.DownTrack) error {
+	return nil
+}
+
+func (t *fakeTrack) DelLocal(conn.DownTrack) bool {
+	return false
+}
+
+func (t *fakeTrack) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+func (t *fakeTrack) Label() string {
+	return ""
+}
+
+func (t *fakeTrack) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+func (t *fakeTrack) GetPacket(uint16, []byte, bool) uint16 {
+	return 0
+}
+
+func (t *fakeTrack) RequestKeyframe() error {
+	return nil
+}
+
+func TestPlainSDP(t *testing.T) {
+	audio := &fakeTrack{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecCapability{
+		MimeType:    "audio/opus",
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1",
+	}}
+	video := &fakeTrack{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{
+		MimeType:  "video/VP8",
+		ClockRate: 90000,
+	}}
+	sdp := plainSDP("127.0.0.1", 5004, audio, video)
+	for _, l := range []string{
+		"c=IN IP4 127.0.0.1\r\n",
+		"m=audio 5004 RTP/AVP 111\r\n",
+		"a=rtpmap:111 opus/48000/2\r\n",
+		"a=fmtp:111 minptime=10;useinbandfec=1\r\n",
+		"m=video 5006 RTP/AVP 96\r\n",
+		"a=rtpmap:96 VP8/90000\r\n",
+	} {
+		if !strings.Contains(sdp, l) {
+			t.Errorf("Missing %q in %v", l, sdp)
+		}
+	}
+
+	sdp = plainSDP("::1", 5004, audio, nil)
+	if !strings.Contains(sdp, "c=IN IP6 ::1\r\n") ||
+		strings.Contains(sdp, "m=video") {
+		t.Errorf("Bad SDP %v", sdp)
+	}
+}
+
+func TestPlainStream(t *testing.T) {
+	var listeners [2]*net.UDPConn
+	for {
+		var err error
+		listeners[0], err = net.ListenUDP("udp", &net.UDPAddr{
+			IP: net.IPv4(127, 0, 0, 1),
+		})
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		port := listeners[0].LocalAddr().(*net.UDPAddr).Port
+		listeners[1], err = net.ListenUDP("udp", &net.UDPAddr{
+			IP:   net.IPv4(127, 0, 0, 1),
+			Port: port + 1,
+		})
+		if err == nil {
+			break
+		}
+		listeners[0].Close()
+	}
+	defer listeners[0].Close()
+	defer listeners[1].Close()
+
+	s, err := newPlainStream("127.0.0.1",
+		listeners[0].LocalAddr().(*net.UDPAddr).Port,
+		func(error) {},
+	)
+	if err != nil {
+		t.Fatalf("newPlainStream: %v", err)
+	}
+	defer s.close()
+	s.setPayloadType(96)
+
+	p := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			PayloadType:    120,
+			SequenceNumber: 42,
+			SSRC:           1234,
+		},
+		Payload: []byte{1, 2, 3},
+	}
+	buf, _ := p.Marshal()
+	s.write(buf)
+	s.senderReport(0x1000000000, 4242)
+
+	b := make([]byte, 1500)
+	listeners[0].SetReadDeadline(time.Now().Add(time.Second))
+	n, err := listeners[0].Read(b)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	var q rtp.Packet
+	err = q.Unmarshal(b[:n])
+	if err != nil || q.PayloadType != 96 || !q.Marker ||
+		q.SequenceNumber != 42 || !bytes.Equal(q.Payload, p.Payload) {
+		t.Errorf("Got %v %v", q, err)
+	}
+
+	listeners[1].SetReadDeadline(time.Now().Add(time.Second))
+	n, err = listeners[1].Read(b)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	var sr rtcp.SenderReport
+	err = sr.Unmarshal(b[:n])
+	if err != nil || sr.SSRC != 1234 || sr.RTPTime != 4242 ||
+		sr.PacketCount != 1 || sr.OctetCount != 3 {
+		t.Errorf("Got %v %v", sr, err)
+	}
+}
+
+func TestTapTrackAllocs(t *testing.T) {
+	// a sender with no room in its queue drops every message
+	s := &sender{queue: make(chan []byte)}
+	tt := &tapTrack{sender: s, typ: TypeOpus, id: "id", username: "bob"}
+	buf, err := (&rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 111},
+		Payload: make([]byte, 100),
+	}).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	tt.Write(buf)
+	allocs := testing.AllocsPerRun(100, func() {
+		tt.Write(buf)
+	})
+	if allocs != 0 {
+		t.Errorf("Write allocates %v times", allocs)
+	}
+	if atomic.LoadUint64(&s.dropped) != 102 {
+		t.Errorf("Expected 102 dropped, got %v", s.dropped)
+	}
+}
@@ -0,0 +1,118 @@
+package testsource
+
+import (
+	"math"
+)
+
+// The test card consists of colour bars, a grey ramp, and a white
+// square that moves along the bottom row of macroblocks.  The square
+// goes round once per cycle, and a beep is played whenever it is at the
+// left edge, which makes it possible to check lip synchronisation.
+
+const (
+	frameRate = 10
+	// the number of frames in a cycle, one per position of the square
+	cycleFrames = mbCols
+	// the audio sample rate of G.711
+	sampleRate = 8000
+	// the number of audio samples in a cycle
+	cycleSamples  = cycleFrames * sampleRate / frameRate
+	beepLength    = sampleRate / 5
+	beepFrequency = 1000
+)
+
+// 75% colour bars, in limited range BT.601 YCbCr
+var bars = [][3]byte{
+	{180, 128, 128}, // white
+	{162, 44, 142},  // yellow
+	{131, 156, 44},  // cyan
+	{112, 72, 58},   // green
+	{84, 184, 198},  // magenta
+	{65, 100, 212},  // red
+	{35, 212, 114},  // blue
+}
+
+const (
+	barsHeight = 12 * 16
+	rampHeight = 2 * 16
+)
+
+// sample returns the colour of the pixel at (x, y) when the square is at
+// the given position.
+func sample(x, y, position int) (byte, byte, byte) {
+	switch {
+	case y < barsHeight:
+		b := bars[x*len(bars)/width]
+		return b[0], b[1], b[2]
+	case y < barsHeight+rampHeight:
+		return byte(16 + x*(235-16)/(width-1)), 128, 128
+	case x/16 == position:
+		return 235, 128, 128
+	default:
+		return 16, 128, 128
+	}
+}
+
+// card returns the picture of the test card with the square at the
+// given position.
+func card(position int) picture {
+	return func(mbx, mby int, y *[256]byte, cb, cr *[64]byte) {
+		for j := 0; j < 16; j++ {
+			for i := 0; i < 16; i++ {
+				y[j*16+i], _, _ =
+					sample(mbx*16+i, mby*16+j, position)
+			}
+		}
+		for j := 0; j < 8; j++ {
+			for i := 0; i < 8; i++ {
+				_, cb[j*8+i], cr[j*8+i] =
+					sample(mbx*16+2*i, mby*16+2*j, position)
+			}
+		}
+	}
+}
+
+// moved returns a function that indicates which macroblocks change when
+// the square moves from one position to the next.
+func moved(from, to int) func(mbx, mby int) bool {
+	return func(mbx, mby int) bool {
+		return mby == mbRows-1 && (mbx == from || mbx == to)
+	}
+}
+
+// tone returns a cycle of audio, encoded in G.711 µ-law.
+func tone() []byte {
+	b := make([]byte, cycleSamples)
+	for i := range b {
+		var v float64
+		if i < beepLength {
+			v = 8000 * math.Sin(
+				2*math.Pi*beepFrequency*float64(i)/sampleRate,
+			)
+		}
+		b[i] = ulawEncode(int16(v))
+	}
+	return b
+}
+
+// ulawEncode encodes a sample in G.711 µ-law, see the mixer package.
+func ulawEncode(v int16) byte {
+	const bias = 0x84
+	const clip = 32635
+	sign := byte(0)
+	s := int(v)
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > clip {
+		s = clip
+	}
+	s += bias
+	exponent := byte(7)
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := byte(s>>(exponent+3)) & 0x0F
+	return ^(sign | exponent<<4 | mantissa)
+}
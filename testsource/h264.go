@@ -0,0 +1,224 @@
+package testsource
+
+// A trivial H.264 encoder.  Every macroblock that changes is sent as an
+// I_PCM macroblock, which carries raw samples, and the other ones are
+// skipped.  This is wasteful, but it doesn't require an actual encoder,
+// and it's good enough for a test card that hardly changes.
+
+const (
+	width  = 320
+	height = 240
+	mbCols = width / 16
+	mbRows = height / 16
+)
+
+// the macroblock types of I_PCM in I and P slices
+const (
+	iPCM = 25
+	pPCM = 5 + iPCM
+)
+
+// A bitWriter writes the fields of an H.264 RBSP.
+type bitWriter struct {
+	buf   []byte
+	nbits int
+}
+
+func (w *bitWriter) bit(b bool) {
+	if w.nbits%8 == 0 {
+		w.buf = append(w.buf, 0)
+	}
+	if b {
+		w.buf[len(w.buf)-1] |= 0x80 >> (w.nbits % 8)
+	}
+	w.nbits++
+}
+
+// u writes n bits of v, most significant first.
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit((v>>i)&1 != 0)
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code.
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for (v >> n) > 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v)
+}
+
+// se writes a signed Exp-Golomb code.
+func (w *bitWriter) se(v int32) {
+	if v > 0 {
+		w.ue(uint32(2*v - 1))
+	} else {
+		w.ue(uint32(-2 * v))
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.nbits%8 != 0 {
+		w.bit(false)
+	}
+}
+
+// bytes writes raw bytes, which must be aligned.
+func (w *bitWriter) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+	w.nbits += 8 * len(b)
+}
+
+// trailing writes rbsp_trailing_bits.
+func (w *bitWriter) trailing() {
+	w.bit(true)
+	w.align()
+}
+
+// nal returns a NAL unit with the given header and RBSP, with emulation
+// prevention bytes inserted.
+func nal(header byte, rbsp []byte) []byte {
+	b := make([]byte, 0, len(rbsp)+len(rbsp)/64+1)
+	b = append(b, header)
+	zeros := 0
+	for _, c := range rbsp {
+		if zeros >= 2 && c <= 3 {
+			b = append(b, 3)
+			zeros = 0
+		}
+		b = append(b, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return b
+}
+
+// annexB concatenates NAL units into an Annex B byte stream.
+func annexB(nalus ...[]byte) []byte {
+	var b []byte
+	for _, n := range nalus {
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, n...)
+	}
+	return b
+}
+
+// sps returns a constrained baseline sequence parameter set, level 3.1,
+// which is what Galene negotiates.
+func sps() []byte {
+	var w bitWriter
+	w.u(8, 66)   // profile_idc
+	w.u(8, 0xe0) // constraint_set0, 1 and 2
+	w.u(8, 31)   // level_idc
+	w.ue(0)      // seq_parameter_set_id
+	w.ue(0)      // log2_max_frame_num_minus4
+	w.ue(2)      // pic_order_cnt_type, output order is decoding order
+	w.ue(1)      // max_num_ref_frames
+	w.bit(false) // gaps_in_frame_num_value_allowed_flag
+	w.ue(mbCols - 1)
+	w.ue(mbRows - 1)
+	w.bit(true)  // frame_mbs_only_flag
+	w.bit(true)  // direct_8x8_inference_flag
+	w.bit(false) // frame_cropping_flag
+	w.bit(false) // vui_parameters_present_flag
+	w.trailing()
+	return nal(0x67, w.buf)
+}
+
+func pps() []byte {
+	var w bitWriter
+	w.ue(0)      // pic_parameter_set_id
+	w.ue(0)      // seq_parameter_set_id
+	w.bit(false) // entropy_coding_mode_flag, CAVLC
+	w.bit(false) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)      // num_slice_groups_minus1
+	w.ue(0)      // num_ref_idx_l0_default_active_minus1
+	w.ue(0)      // num_ref_idx_l1_default_active_minus1
+	w.bit(false) // weighted_pred_flag
+	w.u(2, 0)    // weighted_bipred_idc
+	w.se(0)      // pic_init_qp_minus26
+	w.se(0)      // pic_init_qs_minus26
+	w.se(0)      // chroma_qp_index_offset
+	w.bit(true)  // deblocking_filter_control_present_flag
+	w.bit(false) // constrained_intra_pred_flag
+	w.bit(false) // redundant_pic_cnt_present_flag
+	w.trailing()
+	return nal(0x68, w.buf)
+}
+
+// A picture computes the samples of a macroblock.  The luma samples are
+// stored in raster order in y, the chroma samples in cb and cr.
+type picture func(mbx, mby int, y *[256]byte, cb, cr *[64]byte)
+
+// pcm writes an I_PCM macroblock, except for mb_type.
+func (w *bitWriter) pcm(pic picture, mbx, mby int) {
+	var y [256]byte
+	var cb, cr [64]byte
+	pic(mbx, mby, &y, &cb, &cr)
+	w.align() // pcm_alignment_zero_bit
+	w.bytes(y[:])
+	w.bytes(cb[:])
+	w.bytes(cr[:])
+}
+
+// idr encodes a whole picture as an IDR slice.
+func idr(pic picture, idrPicId uint32) []byte {
+	var w bitWriter
+	w.ue(0)   // first_mb_in_slice
+	w.ue(7)   // slice_type, I
+	w.ue(0)   // pic_parameter_set_id
+	w.u(4, 0) // frame_num
+	w.ue(idrPicId)
+	w.bit(false) // no_output_of_prior_pics_flag
+	w.bit(false) // long_term_reference_flag
+	w.se(0)      // slice_qp_delta
+	w.ue(1)      // disable_deblocking_filter_idc
+	for mby := 0; mby < mbRows; mby++ {
+		for mbx := 0; mbx < mbCols; mbx++ {
+			w.ue(iPCM)
+			w.pcm(pic, mbx, mby)
+		}
+	}
+	w.trailing()
+	return nal(0x65, w.buf)
+}
+
+// predicted encodes a P slice where the macroblocks for which changed
+// returns true are taken from pic, and the other ones are skipped.
+func predicted(pic picture, frameNum uint32, changed func(mbx, mby int) bool) []byte {
+	var w bitWriter
+	w.ue(0) // first_mb_in_slice
+	w.ue(5) // slice_type, P
+	w.ue(0) // pic_parameter_set_id
+	w.u(4, frameNum%16)
+	w.bit(false) // num_ref_idx_active_override_flag
+	w.bit(false) // ref_pic_list_modification_flag_l0
+	w.bit(false) // adaptive_ref_pic_marking_mode_flag
+	w.se(0)      // slice_qp_delta
+	w.ue(1)      // disable_deblocking_filter_idc
+	skipped := uint32(0)
+	for mby := 0; mby < mbRows; mby++ {
+		for mbx := 0; mbx < mbCols; mbx++ {
+			if !changed(mbx, mby) {
+				skipped++
+				continue
+			}
+			w.ue(skipped) // mb_skip_run
+			skipped = 0
+			w.ue(pPCM)
+			w.pcm(pic, mbx, mby)
+		}
+	}
+	if skipped > 0 {
+		w.ue(skipped)
+	}
+	w.trailing()
+	return nal(0x41, w.buf)
+}
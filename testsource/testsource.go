@@ -0,0 +1,412 @@
+// Package testsource implements a synthetic media source that operators
+// may inject into a group, in order to check that media flows from the
+// server to the clients without needing a second participant.
+//
+// Since we don't have a VP8 or Opus encoder, the video is sent in H.264,
+// and the audio in G.711; the group must include "h264" in its codecs,
+// and the beep is only sent if it includes "pcmu" too.
+package testsource
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/rtpconn"
+)
+
+var logger = logging.New("testsource")
+
+// the username of the test source in the group
+const username = "Test source"
+
+// how long we wait for the local connection to be established
+const connectTimeout = 10 * time.Second
+
+// the parameters that Galene uses for H.264 and PCMU, see
+// group.codecsFromName
+var h264Capability = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeH264,
+	ClockRate:   90000,
+	SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+}
+
+var pcmuCapability = webrtc.RTPCodecCapability{
+	MimeType:  webrtc.MimeTypePCMU,
+	ClockRate: 8000,
+	Channels:  1,
+}
+
+var ErrRunning = errors.New("the test source is already running")
+var ErrNoH264 = errors.New("the group doesn't accept H.264")
+
+var api struct {
+	once sync.Once
+	api  *webrtc.API
+	err  error
+}
+
+func getAPI() (*webrtc.API, error) {
+	api.once.Do(func() {
+		var m webrtc.MediaEngine
+		err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: h264Capability,
+			PayloadType:        102,
+		}, webrtc.RTPCodecTypeVideo)
+		if err != nil {
+			api.err = err
+			return
+		}
+		// the track of a remote PCMU stream with the static payload
+		// type 0 doesn't get a codec, so use a dynamic payload type
+		err = m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: pcmuCapability,
+			PayloadType:        110,
+		}, webrtc.RTPCodecTypeAudio)
+		if err != nil {
+			api.err = err
+			return
+		}
+		var i interceptor.Registry
+		err = webrtc.RegisterDefaultInterceptors(&m, &i)
+		if err != nil {
+			api.err = err
+			return
+		}
+		// the connection is local, and may need to go over the
+		// loopback interface
+		var s webrtc.SettingEngine
+		s.SetIncludeLoopbackCandidate(true)
+		s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+		api.api = webrtc.NewAPI(
+			webrtc.WithMediaEngine(&m),
+			webrtc.WithInterceptorRegistry(&i),
+			webrtc.WithSettingEngine(s),
+		)
+	})
+	return api.api, api.err
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		logger.Fatalf("rand.Read: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hasCodec(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUsers returns true if a group has users other than system clients.
+func hasUsers(g *group.Group) bool {
+	for _, c := range g.GetClients(nil) {
+		system := false
+		for _, p := range c.Permissions() {
+			if p == "system" {
+				system = true
+				break
+			}
+		}
+		if !system {
+			return true
+		}
+	}
+	return false
+}
+
+// A source sends the test card to a group over a local WebRTC connection.
+type source struct {
+	group  *group.Group
+	client *rtpconn.IngestClient
+	pc     *webrtc.PeerConnection
+	video  *webrtc.TrackLocalStaticSample
+	// nil if the group doesn't accept PCMU
+	audio *webrtc.TrackLocalStaticSample
+	// signalled when a receiver requests a keyframe
+	keyframe chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+var sources struct {
+	mu      sync.Mutex
+	sources map[string]*source
+}
+
+// Start injects the test source into a group.  It runs until it is
+// stopped, kicked, or the group has no users left.
+func Start(g *group.Group) error {
+	codecs := g.Description().Codecs
+	if !hasCodec(codecs, "h264") {
+		return ErrNoH264
+	}
+
+	sources.mu.Lock()
+	defer sources.mu.Unlock()
+	if sources.sources[g.Name()] != nil {
+		return ErrRunning
+	}
+
+	s := &source{
+		group:    g,
+		keyframe: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	err := s.connect(hasCodec(codecs, "pcmu"))
+	if err != nil {
+		return err
+	}
+	if sources.sources == nil {
+		sources.sources = make(map[string]*source)
+	}
+	sources.sources[g.Name()] = s
+	go s.run()
+	return nil
+}
+
+// Stop stops the test source of a group.  It returns false if there was
+// no test source.
+func Stop(g *group.Group) bool {
+	sources.mu.Lock()
+	s := sources.sources[g.Name()]
+	sources.mu.Unlock()
+	if s == nil {
+		return false
+	}
+	s.stop()
+	return true
+}
+
+func (s *source) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// connect joins the group and establishes the local connection.
+func (s *source) connect(withAudio bool) error {
+	api, err := getAPI()
+	if err != nil {
+		return err
+	}
+
+	client := rtpconn.NewIngestClient(s.group, newId())
+	client.SetUsername(username)
+	client.SetPermissions([]string{"system"})
+	_, err = group.AddClient(s.group.Name(), client,
+		group.ClientCredentials{System: true},
+	)
+	if err != nil {
+		return err
+	}
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		client.Close()
+		return err
+	}
+	s.client = client
+	s.pc = pc
+
+	err = s.addTracks(withAudio)
+	if err != nil {
+		s.close()
+		return err
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		s.close()
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	err = pc.SetLocalDescription(offer)
+	if err != nil {
+		s.close()
+		return err
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(), connectTimeout,
+	)
+	defer cancel()
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		s.close()
+		return ctx.Err()
+	}
+
+	answer, err := client.Connect(ctx, []byte(pc.LocalDescription().SDP))
+	if err != nil {
+		s.close()
+		return err
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	})
+	if err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *source) addTracks(withAudio bool) error {
+	var err error
+	s.video, err = webrtc.NewTrackLocalStaticSample(
+		h264Capability, "video", s.client.Id(),
+	)
+	if err != nil {
+		return err
+	}
+	sender, err := s.pc.AddTrack(s.video)
+	if err != nil {
+		return err
+	}
+	go s.readRTCP(sender)
+
+	if !withAudio {
+		return nil
+	}
+	s.audio, err = webrtc.NewTrackLocalStaticSample(
+		pcmuCapability, "audio", s.client.Id(),
+	)
+	if err != nil {
+		return err
+	}
+	sender, err = s.pc.AddTrack(s.audio)
+	if err != nil {
+		return err
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, _, err := sender.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// readRTCP notices keyframe requests.
+func (s *source) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range packets {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				select {
+				case s.keyframe <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (s *source) close() {
+	s.pc.Close()
+	s.client.Close()
+}
+
+func (s *source) run() {
+	defer func() {
+		sources.mu.Lock()
+		if sources.sources[s.group.Name()] == s {
+			delete(sources.sources, s.group.Name())
+		}
+		sources.mu.Unlock()
+		s.close()
+		logger.Infof("Test source %v: stopped", s.group.Name())
+	}()
+
+	logger.Infof("Test source %v: started", s.group.Name())
+
+	const packetSamples = sampleRate / 50
+	const packetsPerFrame = 50 / frameRate
+	audio := tone()
+	ticker := time.NewTicker(time.Second / 50)
+	defer ticker.Stop()
+
+	var frame, frameNum uint32
+	var idrPicId uint32
+	keyframe := true
+	n := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.keyframe:
+			keyframe = true
+			continue
+		case <-s.client.Done():
+			return
+		case <-s.done:
+			return
+		}
+
+		if n%50 == 0 && !hasUsers(s.group) {
+			return
+		}
+
+		if s.audio != nil {
+			i := (n * packetSamples) % cycleSamples
+			s.audio.WriteSample(media.Sample{
+				Data:     audio[i : i+packetSamples],
+				Duration: time.Second / 50,
+			})
+		}
+
+		if n%packetsPerFrame == 0 {
+			position := int(frame % cycleFrames)
+			var data []byte
+			if keyframe {
+				keyframe = false
+				frameNum = 0
+				data = annexB(
+					sps(), pps(),
+					idr(card(position), idrPicId),
+				)
+				idrPicId = (idrPicId + 1) % 2
+			} else {
+				frameNum++
+				from := (position + cycleFrames - 1) % cycleFrames
+				data = annexB(predicted(
+					card(position), frameNum,
+					moved(from, position),
+				))
+			}
+			s.video.WriteSample(media.Sample{
+				Data:     data,
+				Duration: time.Second / frameRate,
+			})
+			frame++
+		}
+		n++
+	}
+}
@@ -0,0 +1,199 @@
+package testsource
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExpGolomb(t *testing.T) {
+	var w bitWriter
+	w.ue(0)
+	w.ue(1)
+	w.ue(3)
+	w.se(1)
+	w.se(-1)
+	w.trailing()
+	// 1 010 00100 010 011 1
+	expected := []byte{0xa2, 0x27}
+	if !bytes.Equal(w.buf, expected) {
+		t.Errorf("Expected %x, got %x", expected, w.buf)
+	}
+}
+
+func TestEmulationPrevention(t *testing.T) {
+	n := nal(0x65, []byte{0, 0, 1, 0, 0, 0, 5, 0, 0, 4})
+	expected := []byte{0x65, 0, 0, 3, 1, 0, 0, 3, 0, 5, 0, 0, 4}
+	if !bytes.Equal(n, expected) {
+		t.Errorf("Expected %x, got %x", expected, n)
+	}
+}
+
+type bitReader struct {
+	buf   []byte
+	nbits int
+}
+
+func (r *bitReader) u(n int) uint32 {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		b := r.buf[r.nbits/8] >> (7 - r.nbits%8) & 1
+		v = v<<1 | uint32(b)
+		r.nbits++
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	n := 0
+	for r.u(1) == 0 {
+		n++
+	}
+	return 1<<n - 1 + r.u(n)
+}
+
+// unescape removes the header and emulation prevention bytes of a NAL.
+func unescape(n []byte) []byte {
+	var b []byte
+	zeros := 0
+	for _, c := range n[1:] {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		b = append(b, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return b
+}
+
+// readPCM reads an I_PCM macroblock, and checks it against the card.
+func readPCM(t *testing.T, r *bitReader, position, mb int) {
+	t.Helper()
+	for r.nbits%8 != 0 {
+		if r.u(1) != 0 {
+			t.Fatalf("Bad pcm_alignment_zero_bit")
+		}
+	}
+	var y [256]byte
+	var cb, cr [64]byte
+	card(position)(mb%mbCols, mb/mbCols, &y, &cb, &cr)
+	expected := append(append(y[:], cb[:]...), cr[:]...)
+	got := r.buf[r.nbits/8 : r.nbits/8+len(expected)]
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Bad samples in macroblock %v", mb)
+	}
+	r.nbits += 8 * len(expected)
+}
+
+func checkTrailing(t *testing.T, r *bitReader) {
+	t.Helper()
+	if r.u(1) != 1 {
+		t.Errorf("Bad rbsp_stop_one_bit")
+	}
+	for r.nbits%8 != 0 {
+		if r.u(1) != 0 {
+			t.Errorf("Bad rbsp_alignment_zero_bit")
+		}
+	}
+	if r.nbits != 8*len(r.buf) {
+		t.Errorf("Trailing garbage")
+	}
+}
+
+func TestIDR(t *testing.T) {
+	n := idr(card(3), 1)
+	if n[0] != 0x65 {
+		t.Errorf("Bad NAL header %x", n[0])
+	}
+	r := bitReader{buf: unescape(n)}
+	// first_mb_in_slice, slice_type, pps id
+	if r.ue() != 0 || r.ue() != 7 || r.ue() != 0 {
+		t.Errorf("Bad slice header")
+	}
+	if r.u(4) != 0 || r.ue() != 1 || r.u(2) != 0 {
+		t.Errorf("Bad slice header")
+	}
+	// slice_qp_delta, disable_deblocking_filter_idc
+	if r.ue() != 0 || r.ue() != 1 {
+		t.Errorf("Bad slice header")
+	}
+	for mb := 0; mb < mbCols*mbRows; mb++ {
+		if tp := r.ue(); tp != iPCM {
+			t.Fatalf("Macroblock %v: expected I_PCM, got %v", mb, tp)
+		}
+		readPCM(t, &r, 3, mb)
+	}
+	checkTrailing(t, &r)
+}
+
+func TestPredicted(t *testing.T) {
+	for _, position := range []int{0, 5, mbCols - 1} {
+		from := (position + cycleFrames - 1) % cycleFrames
+		n := predicted(card(position), 17, moved(from, position))
+		if n[0] != 0x41 {
+			t.Errorf("Bad NAL header %x", n[0])
+		}
+		r := bitReader{buf: unescape(n)}
+		if r.ue() != 0 || r.ue() != 5 || r.ue() != 0 {
+			t.Errorf("Bad slice header")
+		}
+		if fn := r.u(4); fn != 1 {
+			t.Errorf("Expected frame_num 1, got %v", fn)
+		}
+		if r.u(3) != 0 || r.ue() != 0 || r.ue() != 1 {
+			t.Errorf("Bad slice header")
+		}
+
+		var coded []int
+		mb := 0
+		for {
+			mb += int(r.ue())
+			if mb >= mbCols*mbRows {
+				break
+			}
+			if tp := r.ue(); tp != pPCM {
+				t.Fatalf("Expected I_PCM, got %v", tp)
+			}
+			readPCM(t, &r, position, mb)
+			coded = append(coded, mb)
+			mb++
+			if mb == mbCols*mbRows {
+				break
+			}
+		}
+		checkTrailing(t, &r)
+
+		last := (mbRows - 1) * mbCols
+		expected := []int{last + from, last + position}
+		if from > position {
+			expected[0], expected[1] = expected[1], expected[0]
+		}
+		if len(coded) != 2 ||
+			coded[0] != expected[0] || coded[1] != expected[1] {
+			t.Errorf("Expected %v, got %v", expected, coded)
+		}
+	}
+}
+
+func TestTone(t *testing.T) {
+	b := tone()
+	if len(b) != cycleSamples {
+		t.Errorf("Expected %v samples, got %v", cycleSamples, len(b))
+	}
+	loud := 0
+	for i, v := range b {
+		if i >= beepLength && v != ulawEncode(0) {
+			t.Fatalf("Sample %v is not silent", i)
+		}
+		if i < beepLength && v != ulawEncode(0) {
+			loud++
+		}
+	}
+	if loud < beepLength/2 {
+		t.Errorf("Beep is too quiet")
+	}
+}
@@ -0,0 +1,114 @@
+package token
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/jech/galene/shared"
+)
+
+// expired tokens are kept for this long, so that they may be extended
+const expireDelay = 7 * 24 * time.Hour
+
+const sharedPrefix = "token:"
+
+// SetStore causes stateful tokens to be kept in a shared store rather
+// than in the tokens file.  Tokens are never cached, so that a token
+// created or extended by one instance is immediately valid on the
+// others.
+func SetStore(store shared.Store) {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	tokens.store = store
+}
+
+// ttl returns the time after which a token may be removed from the
+// store.
+func ttl(token *Stateful) time.Duration {
+	if token.Expires == nil {
+		return 0
+	}
+	d := time.Until(*token.Expires) + expireDelay
+	if d <= 0 {
+		d = time.Millisecond
+	}
+	return d
+}
+
+// called locked
+func (state *state) getShared(token string) (*Stateful, error) {
+	v, err := state.store.Get(sharedPrefix + token)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	var t Stateful
+	err = json.Unmarshal(v, &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// called locked
+func (state *state) addShared(token *Stateful) (*Stateful, error) {
+	v, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := state.store.SetNX(sharedPrefix+token.Token, v, ttl(token))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, os.ErrExist
+	}
+	return token, nil
+}
+
+// editShared modifies a token.  Concurrent edits on different
+// instances are resolved by the last writer winning.  Called locked.
+func (state *state) editShared(group, token string, expires time.Time) (*Stateful, error) {
+	old, err := state.getShared(token)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return nil, os.ErrNotExist
+	}
+	if old.Group != group {
+		return nil, os.ErrPermission
+	}
+	new := old.Clone()
+	new.Expires = &expires
+	v, err := json.Marshal(new)
+	if err != nil {
+		return nil, err
+	}
+	err = state.store.Set(sharedPrefix+token, v, ttl(new))
+	if err != nil {
+		return nil, err
+	}
+	return new, nil
+}
+
+// called locked
+func (state *state) listShared(group string) ([]*Stateful, error) {
+	keys, err := state.store.Keys(sharedPrefix)
+	if err != nil {
+		return nil, err
+	}
+	a := make([]*Stateful, 0)
+	for _, k := range keys {
+		t, err := state.getShared(k[len(sharedPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		if t == nil || (group != "" && t.Group != group) {
+			continue
+		}
+		a = append(a, t)
+	}
+	sortTokens(a)
+	return a, nil
+}
@@ -9,6 +9,8 @@ import (
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/jech/galene/shared"
 )
 
 // A stateful token
@@ -45,6 +47,8 @@ type state struct {
 	fileSize int64
 	modTime  time.Time
 	tokens   map[string]*Stateful
+	// if not nil, tokens are kept in a shared store instead of the file
+	store shared.Store
 }
 
 var tokens state
@@ -60,6 +64,9 @@ func SetStatefulFilename(filename string) {
 func getStateful(token string) (*Stateful, error) {
 	tokens.mu.Lock()
 	defer tokens.mu.Unlock()
+	if tokens.store != nil {
+		return tokens.getShared(token)
+	}
 	err := tokens.load()
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -167,6 +174,10 @@ func (state *state) Add(token *Stateful) (*Stateful, error) {
 	tokens.mu.Lock()
 	defer tokens.mu.Unlock()
 
+	if state.store != nil {
+		return state.addShared(token)
+	}
+
 	if state.filename == "" {
 		return nil, os.ErrNotExist
 	}
@@ -229,6 +240,10 @@ func (state *state) Edit(group, token string, expires time.Time) (*Stateful, err
 
 // called locked
 func (state *state) edit(group, token string, expires time.Time) (*Stateful, error) {
+	if state.store != nil {
+		return state.editShared(group, token, expires)
+	}
+
 	err := state.load()
 	if err != nil {
 		return nil, err
@@ -315,6 +330,10 @@ func (state *state) rewrite() error {
 
 // called locked
 func (state *state) list(group string) ([]*Stateful, error) {
+	if state.store != nil {
+		return state.listShared(group)
+	}
+
 	err := state.load()
 	if err != nil {
 		return nil, err
@@ -332,6 +351,12 @@ func (state *state) list(group string) ([]*Stateful, error) {
 		}
 		a = append(a, t)
 	}
+	sortTokens(a)
+	return a, nil
+}
+
+// sortTokens sorts tokens by expiration time.
+func sortTokens(a []*Stateful) {
 	sort.Slice(a, func(i, j int) bool {
 		if a[j].Expires == nil {
 			return false
@@ -341,7 +366,6 @@ func (state *state) list(group string) ([]*Stateful, error) {
 		}
 		return (*a[i].Expires).Before(*a[j].Expires)
 	})
-	return a, nil
 }
 
 func (state *state) List(group string) ([]*Stateful, error) {
@@ -358,13 +382,18 @@ func (state *state) Expire() error {
 	state.mu.Lock()
 	defer state.mu.Unlock()
 
+	if state.store != nil {
+		// tokens in the store expire by themselves
+		return nil
+	}
+
 	err := state.load()
 	if err != nil {
 		return err
 	}
 
 	now := time.Now()
-	cutoff := now.Add(-time.Hour * 24 * 7)
+	cutoff := now.Add(-expireDelay)
 
 	modified := false
 	for k, t := range state.tokens {
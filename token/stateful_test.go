@@ -9,6 +9,8 @@ import (
 	"sort"
 	"testing"
 	"time"
+
+	"github.com/jech/galene/shared"
 )
 
 func timeEqual(a, b *time.Time) bool {
@@ -366,3 +368,65 @@ func TestExpire(t *testing.T) {
 	expectTokens(t, s.tokens, tokens[:len(tokens)-1])
 	expectTokenFile(t, s.filename, tokens[:len(tokens)-1])
 }
+
+func TestSharedStorage(t *testing.T) {
+	store := shared.NewMemory()
+	s := state{
+		store: store,
+	}
+	future := time.Now().Add(time.Hour)
+	user := "user"
+	token := &Stateful{
+		Token:       "tok",
+		Group:       "test",
+		Username:    &user,
+		Permissions: []string{"present"},
+		Expires:     &future,
+	}
+
+	_, err := s.Add(token)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	_, err = s.Add(token)
+	if !os.IsExist(err) {
+		t.Errorf("Add duplicate: %v", err)
+	}
+
+	// another instance sharing the store
+	s2 := state{
+		store: store,
+	}
+	got, err := s2.getShared("tok")
+	if err != nil || got == nil || !equal(got, token) {
+		t.Errorf("getShared: got %v (%v), expected %v", got, err, token)
+	}
+
+	_, err = s2.Edit("test2", "tok", future.Add(time.Hour))
+	if !os.IsPermission(err) {
+		t.Errorf("Edit succeeded with wrong group: %v", err)
+	}
+	_, err = s2.Edit("test", "tok", future.Add(time.Hour))
+	if err != nil {
+		t.Errorf("Edit: %v", err)
+	}
+	got, err = s.getShared("tok")
+	if err != nil || got == nil ||
+		!got.Expires.Equal(future.Add(time.Hour)) {
+		t.Errorf("Edit not visible: %v %v", got, err)
+	}
+
+	a, err := s.List("test")
+	if err != nil || len(a) != 1 || a[0].Token != "tok" {
+		t.Errorf("List: %v %v", a, err)
+	}
+	a, err = s.List("other")
+	if err != nil || len(a) != 0 {
+		t.Errorf("List: %v %v", a, err)
+	}
+
+	_, err = s.Edit("test", "notoken", future)
+	if !os.IsNotExist(err) {
+		t.Errorf("Edit missing token: %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+// Package tracing records spans that describe the signalling and the
+// negotiation of connections, and exports them to an OpenTelemetry
+// collector using OTLP over HTTP with JSON encoding.
+package tracing
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+)
+
+var logger = logging.New("tracing")
+
+const (
+	defaultServiceName = "galene"
+	// the number of spans waiting to be exported
+	queueLength = 2048
+	// the maximum number of spans in a single request
+	batchSize     = 512
+	batchInterval = 5 * time.Second
+)
+
+// A Span is an operation within a trace.  A nil span is valid, and all
+// of its methods do nothing; this is what Start returns when tracing is
+// disabled.
+type Span struct {
+	traceId [16]byte
+	spanId  [8]byte
+	parent  [8]byte
+	name    string
+	start   time.Time
+
+	mu         sync.Mutex
+	ended      bool
+	attributes map[string]string
+	err        string
+}
+
+type exporter struct {
+	config *group.Tracing
+	queue  chan record
+	cancel chan struct{}
+	done   chan struct{}
+}
+
+var tracer struct {
+	mu       sync.Mutex
+	exporter *exporter
+}
+
+// Check checks a configuration.
+func Check(c *group.Tracing) error {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("endpoint must be an HTTP URL")
+	}
+	return nil
+}
+
+func tracingEqual(a, b *group.Tracing) bool {
+	if a.Endpoint != b.Endpoint || a.ServiceName != b.ServiceName ||
+		len(a.Headers) != len(b.Headers) {
+		return false
+	}
+	for k, v := range a.Headers {
+		if w, ok := b.Headers[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// Configure starts, stops or reconfigures the export of traces.  If c is
+// nil, tracing is disabled, after all pending spans have been exported.
+func Configure(c *group.Tracing) error {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	e := tracer.exporter
+	if c != nil && e != nil && tracingEqual(c, e.config) {
+		return nil
+	}
+
+	if e != nil {
+		tracer.exporter = nil
+		close(e.cancel)
+		<-e.done
+	}
+
+	if c == nil {
+		return nil
+	}
+
+	err := Check(c)
+	if err != nil {
+		return err
+	}
+
+	config := *c
+	if config.ServiceName == "" {
+		config.ServiceName = defaultServiceName
+	}
+	e = &exporter{
+		config: &config,
+		queue:  make(chan record, queueLength),
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	tracer.exporter = e
+	go e.run()
+	return nil
+}
+
+func enabled() bool {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	return tracer.exporter != nil
+}
+
+// Start starts a new span.  If parent is nil, the span starts a new
+// trace.  It returns nil if tracing is disabled.
+func Start(parent *Span, name string) *Span {
+	if !enabled() {
+		return nil
+	}
+	s := &Span{name: name, start: time.Now()}
+	if parent != nil {
+		s.traceId = parent.traceId
+		s.parent = parent.spanId
+	} else {
+		crand.Read(s.traceId[:])
+	}
+	crand.Read(s.spanId[:])
+	return s
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.attributes == nil {
+		s.attributes = make(map[string]string)
+	}
+	s.attributes[key] = value
+}
+
+// Fail marks the span as having failed.
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End ends the span and queues it for export.  Calling End more than
+// once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	r := record{
+		traceId: s.traceId,
+		spanId:  s.spanId,
+		parent:  s.parent,
+		name:    s.name,
+		start:   s.start,
+		end:     time.Now(),
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	r.attributes = s.attributes
+	r.err = s.err
+	s.mu.Unlock()
+
+	tracer.mu.Lock()
+	e := tracer.exporter
+	tracer.mu.Unlock()
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- r:
+	default:
+		// drop spans rather than slowing down the server
+	}
+}
+
+// a record is a span that has ended
+type record struct {
+	traceId    [16]byte
+	spanId     [8]byte
+	parent     [8]byte
+	name       string
+	start, end time.Time
+	attributes map[string]string
+	err        string
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	var batch []record
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := e.export(batch)
+		if err != nil {
+			logger.Warnf("Tracing: %v", err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case r := <-e.queue:
+			batch = append(batch, r)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.cancel:
+			for {
+				select {
+				case r := <-e.queue:
+					batch = append(batch, r)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// The OTLP/JSON encoding of a batch of spans.
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const (
+	spanKindInternal = 1
+	statusCodeError  = 2
+)
+
+func attributes(m map[string]string) []otlpAttribute {
+	var a []otlpAttribute
+	for k, v := range m {
+		a = append(a, otlpAttribute{k, otlpValue{v}})
+	}
+	return a
+}
+
+func encode(serviceName string, batch []record) ([]byte, error) {
+	var scope otlpScopeSpans
+	scope.Scope.Name = "github.com/jech/galene/tracing"
+	for _, r := range batch {
+		s := otlpSpan{
+			TraceId: hex.EncodeToString(r.traceId[:]),
+			SpanId:  hex.EncodeToString(r.spanId[:]),
+			Name:    r.name,
+			Kind:    spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(
+				r.start.UnixNano(), 10,
+			),
+			EndTimeUnixNano: strconv.FormatInt(
+				r.end.UnixNano(), 10,
+			),
+			Attributes: attributes(r.attributes),
+		}
+		if r.parent != [8]byte{} {
+			s.ParentSpanId = hex.EncodeToString(r.parent[:])
+		}
+		if r.err != "" {
+			s.Status = otlpStatus{
+				Code:    statusCodeError,
+				Message: r.err,
+			}
+		}
+		scope.Spans = append(scope.Spans, s)
+	}
+
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = attributes(
+		map[string]string{"service.name": serviceName},
+	)
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{resource},
+	})
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func (e *exporter) export(batch []record) error {
+	body, err := encode(e.config.ServiceName, batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(
+		"POST", e.config.Endpoint, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%v: %v", e.config.Endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jech/galene/group"
+)
+
+func TestNilSpan(t *testing.T) {
+	if err := Configure(nil); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	s := Start(nil, "test")
+	if s != nil {
+		t.Errorf("Start returned a span while disabled")
+	}
+	s.SetAttribute("a", "b")
+	s.Fail(errors.New("error"))
+	s.End()
+}
+
+func TestCheck(t *testing.T) {
+	good := []string{
+		"http://localhost:4318/v1/traces",
+		"https://otel.example.org/v1/traces",
+	}
+	bad := []string{"", "localhost:4318", "ftp://otel.example.org"}
+	for _, e := range good {
+		if err := Check(&group.Tracing{Endpoint: e}); err != nil {
+			t.Errorf("%v: %v", e, err)
+		}
+	}
+	for _, e := range bad {
+		if err := Check(&group.Tracing{Endpoint: e}); err == nil {
+			t.Errorf("%v: accepted", e)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	requests := make(chan otlpRequest, 4)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			var req otlpRequest
+			err := json.Unmarshal(body, &req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			requests <- req
+		},
+	))
+	defer server.Close()
+
+	err := Configure(&group.Tracing{
+		Endpoint: server.URL,
+		Headers:  map[string]string{"Authorization": "secret"},
+	})
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+
+	root := Start(nil, "session")
+	child := Start(root, "auth")
+	child.SetAttribute("group", "test")
+	child.Fail(errors.New("not authorised"))
+	child.End()
+	child.End()
+	root.End()
+
+	// disabling tracing flushes pending spans
+	err = Configure(nil)
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+
+	req := <-requests
+	if len(req.ResourceSpans) != 1 {
+		t.Fatalf("Got %v resource spans", len(req.ResourceSpans))
+	}
+	rs := req.ResourceSpans[0]
+	attrs := rs.Resource.Attributes
+	if len(attrs) != 1 || attrs[0].Value.StringValue != "galene" {
+		t.Errorf("Resource attributes: %v", attrs)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Got %v spans, expected 2", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.Name != "auth" || r.Name != "session" {
+		t.Errorf("Names: %v %v", c.Name, r.Name)
+	}
+	if c.TraceId != r.TraceId || len(r.TraceId) != 32 {
+		t.Errorf("Trace ids: %v %v", c.TraceId, r.TraceId)
+	}
+	if c.ParentSpanId != r.SpanId || r.ParentSpanId != "" {
+		t.Errorf("Parent: %v %v", c.ParentSpanId, r.SpanId)
+	}
+	if c.Status.Code != statusCodeError ||
+		c.Status.Message != "not authorised" {
+		t.Errorf("Status: %v", c.Status)
+	}
+	if r.Status.Code != 0 {
+		t.Errorf("Status: %v", r.Status)
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Key != "group" {
+		t.Errorf("Attributes: %v", c.Attributes)
+	}
+}
@@ -2,25 +2,45 @@ package turnserver
 
 import (
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
-	"log"
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/pion/stun"
 	"github.com/pion/turn/v2"
 	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/logging"
+	"github.com/jech/galene/systemd"
 )
 
+var logger = logging.New("turnserver")
+
 var username string
 var password string
 var Address string
 
+// TLSAddress is the address on which the server accepts TURN over TLS.
+// If its host part is not empty, it is used in the URLs sent to clients,
+// and should therefore match the certificate.
+var TLSAddress string
+
+// GetCertificate returns the certificate used for TURN over TLS.
+var GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
 var server struct {
 	mu        sync.Mutex
 	addresses []net.Addr
+	tlsURLs   []string
 	server    *turn.Server
+	// the addresses of the UDP sockets, used by Check
+	local []net.Addr
+	// the reason why the server failed to start
+	err error
 }
 
 func publicAddresses() ([]net.IP, error) {
@@ -52,22 +72,24 @@ func publicAddresses() ([]net.IP, error) {
 	return as, nil
 }
 
+func relayGenerator(a net.IP, relay net.IP) turn.RelayAddressGenerator {
+	if relay == nil || relay.IsUnspecified() {
+		return &turn.RelayAddressGeneratorNone{
+			Address: a.String(),
+		}
+	}
+	return &turn.RelayAddressGeneratorStatic{
+		RelayAddress: relay,
+		Address:      a.String(),
+	}
+}
+
 func listener(a net.IP, port int, relay net.IP) (*turn.PacketConnConfig, *turn.ListenerConfig) {
 	var pcc *turn.PacketConnConfig
 	var lc *turn.ListenerConfig
 	s := net.JoinHostPort(a.String(), strconv.Itoa(port))
 
-	var g turn.RelayAddressGenerator
-	if relay == nil || relay.IsUnspecified() {
-		g = &turn.RelayAddressGeneratorNone{
-			Address: a.String(),
-		}
-	} else {
-		g = &turn.RelayAddressGeneratorStatic{
-			RelayAddress: relay,
-			Address:      a.String(),
-		}
-	}
+	g := relayGenerator(a, relay)
 
 	p, err := net.ListenPacket("udp4", s)
 	if err == nil {
@@ -76,7 +98,7 @@ func listener(a net.IP, port int, relay net.IP) (*turn.PacketConnConfig, *turn.L
 			RelayAddressGenerator: g,
 		}
 	} else {
-		log.Printf("TURN: listenPacket(%v): %v", s, err)
+		logger.Warnf("TURN: listenPacket(%v): %v", s, err)
 	}
 
 	l, err := net.Listen("tcp4", s)
@@ -86,16 +108,155 @@ func listener(a net.IP, port int, relay net.IP) (*turn.PacketConnConfig, *turn.L
 			RelayAddressGenerator: g,
 		}
 	} else {
-		log.Printf("TURN: listen(%v): %v", s, err)
+		logger.Warnf("TURN: listen(%v): %v", s, err)
 	}
 
 	return pcc, lc
 }
 
+// tlsListeners returns the configuration for TURN over TLS.  If relay
+// is specified, then it listens on all addresses and relays through
+// relay, otherwise it listens on each public address.
+func tlsListeners(relay net.IP) ([]turn.ListenerConfig, error) {
+	if GetCertificate == nil {
+		return nil, errors.New("no certificate")
+	}
+	host, p, err := net.SplitHostPort(TLSAddress)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var as []net.IP
+	if relay != nil && !relay.IsUnspecified() {
+		as = []net.IP{net.IP{0, 0, 0, 0}}
+	} else {
+		as, err = publicAddresses()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config := &tls.Config{
+		GetCertificate: GetCertificate,
+	}
+	var lcs []turn.ListenerConfig
+	for _, a := range as {
+		s := net.JoinHostPort(a.String(), p)
+		l, err := tls.Listen("tcp4", s, config)
+		if err != nil {
+			logger.Warnf("TURN: listen(%v): %v", s, err)
+			continue
+		}
+		lcs = append(lcs, turn.ListenerConfig{
+			Listener:              l,
+			RelayAddressGenerator: relayGenerator(a, relay),
+		})
+		if host == "" {
+			ip := a
+			if relay != nil && !relay.IsUnspecified() {
+				ip = relay
+			}
+			server.tlsURLs = append(server.tlsURLs,
+				"turns:"+net.JoinHostPort(ip.String(),
+					strconv.Itoa(port))+"?transport=tcp",
+			)
+		}
+	}
+	if len(lcs) > 0 && host != "" {
+		server.tlsURLs = append(server.tlsURLs,
+			"turns:"+TLSAddress+"?transport=tcp",
+		)
+	}
+	return lcs, nil
+}
+
+// systemdListeners returns the configuration for sockets passed by
+// systemd.  The relay address is taken from addr if it is specified,
+// otherwise from the sockets' addresses.
+func systemdListeners(addr *net.UDPAddr, ls []net.Listener, pcs []net.PacketConn) ([]turn.ListenerConfig, []turn.PacketConnConfig, error) {
+	var ips []net.IP
+	relay := addr.IP.To4()
+	if relay != nil && !relay.IsUnspecified() {
+		ips = []net.IP{relay}
+	} else {
+		for _, pc := range pcs {
+			a, ok := pc.LocalAddr().(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			ip := a.IP.To4()
+			if ip != nil && !ip.IsUnspecified() {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			as, err := publicAddresses()
+			if err != nil {
+				return nil, nil, err
+			}
+			ips = as
+		}
+	}
+	if len(ips) == 0 {
+		return nil, nil, errors.New("no public addresses")
+	}
+
+	var g turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{
+		RelayAddress: ips[0],
+		Address:      "0.0.0.0",
+	}
+
+	var lcs []turn.ListenerConfig
+	var pccs []turn.PacketConnConfig
+	for _, pc := range pcs {
+		a, ok := pc.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			return nil, nil, errors.New("TURN socket is not UDP")
+		}
+		pccs = append(pccs, turn.PacketConnConfig{
+			PacketConn:            pc,
+			RelayAddressGenerator: g,
+		})
+		for _, ip := range ips {
+			server.addresses = append(server.addresses,
+				&net.UDPAddr{IP: ip, Port: a.Port},
+			)
+		}
+	}
+	for _, l := range ls {
+		a, ok := l.Addr().(*net.TCPAddr)
+		if !ok {
+			return nil, nil, errors.New("TURN socket is not TCP")
+		}
+		lcs = append(lcs, turn.ListenerConfig{
+			Listener:              l,
+			RelayAddressGenerator: g,
+		})
+		for _, ip := range ips {
+			server.addresses = append(server.addresses,
+				&net.TCPAddr{IP: ip, Port: a.Port},
+			)
+		}
+	}
+	logger.Infof("Using TURN sockets passed by systemd")
+	return lcs, pccs, nil
+}
+
 func Start() error {
 	server.mu.Lock()
 	defer server.mu.Unlock()
 
+	err := start()
+	server.err = err
+	return err
+}
+
+// start is called with server.mu held.
+func start() error {
 	if server.server != nil {
 		return nil
 	}
@@ -127,7 +288,23 @@ func Start() error {
 	var lcs []turn.ListenerConfig
 	var pccs []turn.PacketConnConfig
 
-	if addr.IP != nil && !addr.IP.IsUnspecified() {
+	ls, pcs, err := systemd.Sockets("turn")
+	if err != nil {
+		return err
+	}
+	if len(ls) > 0 || len(pcs) > 0 {
+		lcs, pccs, err = systemdListeners(addr, ls, pcs)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			for _, pc := range pcs {
+				pc.Close()
+			}
+			server.addresses = nil
+			return err
+		}
+	} else if addr.IP != nil && !addr.IP.IsUnspecified() {
 		a := addr.IP.To4()
 		if a == nil {
 			return errors.New("couldn't parse address")
@@ -180,11 +357,19 @@ func Start() error {
 		}
 	}
 
+	if TLSAddress != "" {
+		tlcs, err := tlsListeners(addr.IP.To4())
+		if err != nil {
+			logger.Warnf("TURN over TLS: %v", err)
+		}
+		lcs = append(lcs, tlcs...)
+	}
+
 	if len(pccs) == 0 && len(lcs) == 0 {
 		return errors.New("couldn't establish any listeners")
 	}
 
-	log.Printf("Starting built-in TURN server on %v", addr.String())
+	logger.Infof("Starting built-in TURN server on %v", addr.String())
 
 	server.server, err = turn.NewServer(turn.ServerConfig{
 		Realm: "galene.org",
@@ -200,9 +385,14 @@ func Start() error {
 
 	if err != nil {
 		server.addresses = nil
+		server.tlsURLs = nil
 		return err
 	}
 
+	server.local = nil
+	for _, pcc := range pccs {
+		server.local = append(server.local, pcc.PacketConn.LocalAddr())
+	}
 	return nil
 }
 
@@ -210,7 +400,7 @@ func ICEServers() []webrtc.ICEServer {
 	server.mu.Lock()
 	defer server.mu.Unlock()
 
-	if len(server.addresses) == 0 {
+	if len(server.addresses) == 0 && len(server.tlsURLs) == 0 {
 		return nil
 	}
 
@@ -222,9 +412,10 @@ func ICEServers() []webrtc.ICEServer {
 		case *net.TCPAddr:
 			urls = append(urls, "turn:"+a.String()+"?transport=tcp")
 		default:
-			log.Printf("unexpected TURN address %T", a)
+			logger.Warnf("unexpected TURN address %T", a)
 		}
 	}
+	urls = append(urls, server.tlsURLs...)
 
 	return []webrtc.ICEServer{
 		{
@@ -241,10 +432,13 @@ func Stop() error {
 	defer server.mu.Unlock()
 
 	server.addresses = nil
+	server.tlsURLs = nil
+	server.local = nil
+	server.err = nil
 	if server.server == nil {
 		return nil
 	}
-	log.Printf("Stopping built-in TURN server")
+	logger.Infof("Stopping built-in TURN server")
 	err := server.server.Close()
 	server.server = nil
 	return err
@@ -261,3 +455,67 @@ func StartStop(start bool) error {
 	}
 	return Start()
 }
+
+// Check returns an error if the built-in TURN server failed to start,
+// or if it doesn't reply to a STUN binding request.
+func Check(timeout time.Duration) error {
+	server.mu.Lock()
+	err := server.err
+	local := server.local
+	server.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	for _, a := range local {
+		a, ok := a.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		addr := *a
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			addr.IP = net.IPv4(127, 0, 0, 1)
+		}
+		err := binding(&addr, timeout)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func binding(addr *net.UDPAddr, timeout time.Duration) error {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request.Raw)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		response := stun.Message{Raw: buf[:n]}
+		err = response.Decode()
+		if err != nil ||
+			response.TransactionID != request.TransactionID {
+			continue
+		}
+		if response.Type != stun.BindingSuccess {
+			return errors.New("unexpected STUN response " +
+				response.Type.String())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,165 @@
+package twcc
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pion/rtcp"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// the maximum number of packets described by a single feedback packet
+const maxFeedback = 4096
+
+type recorded struct {
+	seqno int64
+	time  uint64
+}
+
+// A Recorder records the arrival of packets carrying transport-wide
+// sequence numbers, and generates the corresponding feedback.  All times
+// are in microseconds.
+type Recorder struct {
+	mu       sync.Mutex
+	valid    bool
+	next     int64
+	highest  int64
+	arrivals []recorded
+	count    uint8
+}
+
+// NewRecorder returns a new recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Record records that the packet with the given sequence number arrived
+// at time now.
+func (r *Recorder) Record(seqno uint16, now uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.valid {
+		r.valid = true
+		r.next = int64(seqno)
+		r.highest = int64(seqno)
+	}
+	s := rtptime.ExtendSeqno(r.highest, seqno)
+	if s < r.next {
+		// already reported
+		return
+	}
+	if s > r.highest {
+		r.highest = s
+	}
+	r.arrivals = append(r.arrivals, recorded{s, now})
+}
+
+// Feedback returns a feedback packet describing the packets recorded
+// since the last call, or nil if there are none.
+func (r *Recorder) Feedback(sender, media uint32) *rtcp.TransportLayerCC {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.arrivals) == 0 {
+		return nil
+	}
+
+	sort.Slice(r.arrivals, func(i, j int) bool {
+		return r.arrivals[i].seqno < r.arrivals[j].seqno
+	})
+
+	base := r.next
+	if r.arrivals[0].seqno-base > maxFeedback/2 {
+		// don't report a long run of lost packets
+		base = r.arrivals[0].seqno
+	}
+
+	ref := r.arrivals[0].time / 64000
+	last := int64(ref * 256)
+	var symbols []uint16
+	var deltas []*rtcp.RecvDelta
+	seqno := base
+	i := 0
+	for i < len(r.arrivals) && len(symbols) < maxFeedback {
+		a := r.arrivals[i]
+		if a.seqno < seqno {
+			// duplicate
+			i++
+			continue
+		}
+		if a.seqno > seqno {
+			symbols = append(symbols, rtcp.TypeTCCPacketNotReceived)
+			seqno++
+			continue
+		}
+		units := int64(a.time / 250)
+		delta := units - last
+		tpe := rtcp.TypeTCCPacketReceivedSmallDelta
+		if delta < 0 || delta > 0xFF {
+			if delta < -0x8000 || delta > 0x7FFF {
+				// doesn't fit, leave it for the next packet
+				break
+			}
+			tpe = rtcp.TypeTCCPacketReceivedLargeDelta
+		}
+		symbols = append(symbols, tpe)
+		deltas = append(deltas, &rtcp.RecvDelta{
+			Type:  tpe,
+			Delta: delta * 250,
+		})
+		last = units
+		seqno++
+		i++
+	}
+	if len(deltas) == 0 {
+		// the first packet is too far from the reference time,
+		// this cannot happen
+		r.arrivals = r.arrivals[:0]
+		return nil
+	}
+
+	// trim trailing losses, they will be reported next time
+	for symbols[len(symbols)-1] == rtcp.TypeTCCPacketNotReceived {
+		symbols = symbols[:len(symbols)-1]
+		seqno--
+	}
+
+	var chunks []rtcp.PacketStatusChunk
+	for j := 0; j < len(symbols); {
+		k := j + 1
+		for k < len(symbols) && symbols[k] == symbols[j] &&
+			k-j < 0x1FFF {
+			k++
+		}
+		chunks = append(chunks, &rtcp.RunLengthChunk{
+			Type:               rtcp.TypeTCCRunLengthChunk,
+			PacketStatusSymbol: symbols[j],
+			RunLength:          uint16(k - j),
+		})
+		j = k
+	}
+
+	p := &rtcp.TransportLayerCC{
+		SenderSSRC:         sender,
+		MediaSSRC:          media,
+		BaseSequenceNumber: uint16(base),
+		PacketStatusCount:  uint16(len(symbols)),
+		ReferenceTime:      uint32(ref & 0xFFFFFF),
+		FbPktCount:         r.count,
+		PacketChunks:       chunks,
+		RecvDeltas:         deltas,
+	}
+	p.Header = rtcp.Header{
+		Count:  rtcp.FormatTCC,
+		Type:   rtcp.TypeTransportSpecificFeedback,
+		Length: p.Len()/4 - 1,
+	}
+	r.count++
+
+	r.next = seqno
+	n := copy(r.arrivals, r.arrivals[i:])
+	r.arrivals = r.arrivals[:n]
+	return p
+}
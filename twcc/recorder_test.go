@@ -0,0 +1,81 @@
+package twcc
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	if r.Feedback(1, 2) != nil {
+		t.Errorf("Got feedback without packets")
+	}
+
+	r.Record(65534, 1000000)
+	r.Record(0, 1000500)
+	r.Record(65535, 1001000)
+	r.Record(0, 1001000)
+	r.Record(3, 1100000)
+	p := r.Feedback(1, 2)
+	if p == nil {
+		t.Fatalf("No feedback")
+	}
+
+	buf, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var q rtcp.TransportLayerCC
+	err = q.Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if q.SenderSSRC != 1 || q.MediaSSRC != 2 || q.FbPktCount != 0 {
+		t.Errorf("Bad feedback %v", q)
+	}
+
+	expected := []result{
+		{65534, true, 1000000}, {65535, true, 1001000},
+		{0, true, 1000500}, {1, false, 0}, {2, false, 0},
+		{3, true, 1100000},
+	}
+	results := parse(&q)
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, results)
+	}
+	for i := range results {
+		if results[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], results[i])
+		}
+	}
+
+	// late packets are not reported again
+	r.Record(1, 1100000)
+	r.Record(4, 1100250)
+	p = r.Feedback(1, 2)
+	results = parse(p)
+	if p.FbPktCount != 1 || len(results) != 1 ||
+		results[0] != (result{4, true, 1100250}) {
+		t.Errorf("Got %v", results)
+	}
+}
+
+func TestRecorderEstimator(t *testing.T) {
+	e := New()
+	r := NewRecorder()
+	now := uint64(1000000)
+	for i := 0; i < 1000; i++ {
+		// 1200 bytes every 10ms, or 960kbit/s
+		seqno := e.Send(1200, now)
+		r.Record(seqno, now+20000)
+		now += 10000
+		if i%10 == 9 {
+			e.Feedback(r.Feedback(1, 2), now)
+		}
+	}
+	rate, ok := e.Estimate()
+	if !ok || rate < 960*1000 {
+		t.Errorf("Got %v %v", rate, ok)
+	}
+}
@@ -0,0 +1,354 @@
+// Package twcc implements sender-side bandwidth estimation based on
+// transport-wide congestion control feedback.
+//
+// The estimator is a simplified version of the delay-based controller of
+// Google Congestion Control: it tracks the variation of the one-way delay
+// between groups of packets, and decreases the estimate when the delay
+// increases consistently.  Loss-based control is left to the caller,
+// which gets loss rates from receiver reports.
+package twcc
+
+import (
+	"sync"
+
+	"github.com/pion/rtcp"
+)
+
+// URI is the URI of the transport-wide sequence number header extension.
+const URI = "http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01"
+
+const (
+	// MinRate and MaxRate are the bounds of the estimate, in bits/s
+	MinRate  = 10000
+	MaxRate  = 1 << 30
+	initRate = 1000 * 1000
+
+	historySize = 4096
+	// packets sent within a burst are grouped together, in microseconds
+	burst = 5000
+	// the interval over which the acknowledged rate is computed
+	ackedInterval = 250000
+	// the minimum interval between two decreases
+	decreaseInterval = 200000
+
+	// the parameters of the trendline filter
+	window    = 20
+	smoothing = 0.9
+	gain      = 4.0
+	threshold = 12.5
+)
+
+const (
+	stateNormal = iota
+	stateOveruse
+	stateUnderuse
+)
+
+type sentPacket struct {
+	valid bool
+	seqno uint16
+	time  uint64
+	size  uint32
+}
+
+type packetGroup struct {
+	valid bool
+	// send time of the first and last packets
+	first, last uint64
+	// arrival time of the last packet
+	arrival int64
+}
+
+type sample struct {
+	x, y float64
+}
+
+// An Estimator estimates the capacity of the path to a receiver.  All
+// times are in microseconds.
+type Estimator struct {
+	mu      sync.Mutex
+	seqno   uint16
+	history [historySize]sentPacket
+
+	current, previous packetGroup
+	accumulated       float64
+	smoothed          float64
+	firstArrival      int64
+	samples           [window]sample
+	count             int
+	state             int
+
+	ackedValid bool
+	ackedStart int64
+	ackedBytes uint64
+	acked      uint64
+
+	feedback  bool
+	rate      uint64
+	time      uint64
+	decreased uint64
+}
+
+// New returns a new estimator.
+func New() *Estimator {
+	return &Estimator{}
+}
+
+// Send records that a packet of the given size is being sent at time
+// now, and returns the transport-wide sequence number to put in the
+// packet.
+func (e *Estimator) Send(size int, now uint64) uint16 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	seqno := e.seqno
+	e.seqno++
+	e.history[seqno%historySize] = sentPacket{
+		valid: true,
+		seqno: seqno,
+		time:  now,
+		size:  uint32(size),
+	}
+	return seqno
+}
+
+type result struct {
+	seqno    uint16
+	received bool
+	arrival  int64
+}
+
+// parse returns the status of each packet described by a feedback
+// packet, and the arrival time of the packets that were received.
+func parse(p *rtcp.TransportLayerCC) []result {
+	results := make([]result, 0, p.PacketStatusCount)
+	seqno := p.BaseSequenceNumber
+	add := func(symbol uint16) {
+		if len(results) >= int(p.PacketStatusCount) {
+			return
+		}
+		results = append(results, result{
+			seqno: seqno,
+			received: symbol == rtcp.TypeTCCPacketReceivedSmallDelta ||
+				symbol == rtcp.TypeTCCPacketReceivedLargeDelta,
+		})
+		seqno++
+	}
+	for _, c := range p.PacketChunks {
+		switch c := c.(type) {
+		case *rtcp.RunLengthChunk:
+			for i := uint16(0); i < c.RunLength; i++ {
+				add(c.PacketStatusSymbol)
+			}
+		case *rtcp.StatusVectorChunk:
+			for _, s := range c.SymbolList {
+				add(s)
+			}
+		}
+	}
+
+	arrival := int64(p.ReferenceTime) * 64000
+	j := 0
+	for i := range results {
+		if !results[i].received {
+			continue
+		}
+		if j >= len(p.RecvDeltas) {
+			return results[:i]
+		}
+		arrival += p.RecvDeltas[j].Delta
+		j++
+		results[i].arrival = arrival
+	}
+	return results
+}
+
+// Feedback processes a feedback packet received at time now.
+func (e *Estimator) Feedback(p *rtcp.TransportLayerCC, now uint64) {
+	results := parse(p)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	found := false
+	for _, r := range results {
+		h := &e.history[r.seqno%historySize]
+		if !h.valid || h.seqno != r.seqno {
+			continue
+		}
+		found = true
+		if !r.received {
+			// it might be reported as received later
+			continue
+		}
+		h.valid = false
+		e.ack(r.arrival, h.size)
+		e.delay(h.time, r.arrival)
+	}
+	if found {
+		e.update(now)
+	}
+}
+
+// ack updates the acknowledged rate.  Called locked.
+func (e *Estimator) ack(arrival int64, size uint32) {
+	if !e.ackedValid || arrival < e.ackedStart {
+		e.ackedValid = true
+		e.ackedStart = arrival
+		e.ackedBytes = 0
+	}
+	e.ackedBytes += uint64(size)
+	if arrival-e.ackedStart < ackedInterval {
+		return
+	}
+	rate := e.ackedBytes * 8 * 1000000 / uint64(arrival-e.ackedStart)
+	if e.acked == 0 {
+		e.acked = rate
+	} else {
+		e.acked = (3*e.acked + rate) / 4
+	}
+	e.ackedStart = arrival
+	e.ackedBytes = 0
+}
+
+// delay updates the delay variation with a newly acknowledged packet.
+// Called locked.
+func (e *Estimator) delay(send uint64, arrival int64) {
+	if e.current.valid && arrival < e.current.arrival-1000000 {
+		// the receiver's clock jumped, start afresh
+		e.current = packetGroup{}
+		e.previous = packetGroup{}
+		e.accumulated = 0
+		e.smoothed = 0
+		e.count = 0
+	}
+
+	if !e.current.valid {
+		e.current = packetGroup{true, send, send, arrival}
+		return
+	}
+	if send < e.current.first {
+		// reordered
+		return
+	}
+	if send-e.current.first <= burst {
+		if send > e.current.last {
+			e.current.last = send
+		}
+		if arrival > e.current.arrival {
+			e.current.arrival = arrival
+		}
+		return
+	}
+
+	if e.previous.valid {
+		sendDelta := float64(e.current.last - e.previous.last)
+		arrivalDelta := float64(e.current.arrival - e.previous.arrival)
+		e.trend(arrivalDelta-sendDelta, e.current.arrival)
+	}
+	e.previous = e.current
+	e.current = packetGroup{true, send, send, arrival}
+}
+
+// trend feeds a delay variation to the trendline filter, and updates the
+// state of the detector.  Called locked.
+func (e *Estimator) trend(variation float64, arrival int64) {
+	e.accumulated += variation / 1000
+	e.smoothed = smoothing*e.smoothed + (1-smoothing)*e.accumulated
+	if e.count == 0 {
+		e.firstArrival = arrival
+	}
+	e.samples[e.count%window] = sample{
+		x: float64(arrival-e.firstArrival) / 1000,
+		y: e.smoothed,
+	}
+	e.count++
+	if e.count < window {
+		return
+	}
+
+	n := e.count
+	if n > 60 {
+		n = 60
+	}
+	t := float64(n) * slope(e.samples[:]) * gain
+	if t > threshold {
+		e.state = stateOveruse
+	} else if t < -threshold {
+		e.state = stateUnderuse
+	} else {
+		e.state = stateNormal
+	}
+}
+
+// slope returns the slope of the linear regression of the samples.
+func slope(samples []sample) float64 {
+	var sx, sy float64
+	for _, s := range samples {
+		sx += s.x
+		sy += s.y
+	}
+	mx := sx / float64(len(samples))
+	my := sy / float64(len(samples))
+	var num, den float64
+	for _, s := range samples {
+		num += (s.x - mx) * (s.y - my)
+		den += (s.x - mx) * (s.x - mx)
+	}
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// update updates the estimate according to the state of the detector.
+// Called locked.
+func (e *Estimator) update(now uint64) {
+	if !e.feedback {
+		e.feedback = true
+		e.rate = initRate
+		e.time = now
+	}
+
+	switch e.state {
+	case stateOveruse:
+		if now-e.decreased >= decreaseInterval {
+			// decrease below the rate that actually gets through
+			rate := e.rate
+			if e.acked > 0 {
+				rate = e.acked
+			}
+			e.rate = rate * 85 / 100
+			e.decreased = now
+		}
+	case stateNormal:
+		dt := now - e.time
+		if dt > 1000000 {
+			dt = 1000000
+		}
+		// increase by 8% per second
+		e.rate += e.rate * 8 * dt / (100 * 1000000)
+		// we're not congested at the current rate
+		if e.acked > e.rate {
+			e.rate = e.acked
+		}
+		// but don't get too far ahead of it
+		if e.acked > 0 && e.rate > e.acked*3/2+MinRate {
+			e.rate = e.acked*3/2 + MinRate
+		}
+	}
+
+	if e.rate < MinRate {
+		e.rate = MinRate
+	} else if e.rate > MaxRate {
+		e.rate = MaxRate
+	}
+	e.time = now
+}
+
+// Estimate returns the estimated capacity in bits per second, and false
+// if no feedback has been received yet.
+func (e *Estimator) Estimate() (uint64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rate, e.feedback
+}
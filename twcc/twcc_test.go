@@ -0,0 +1,160 @@
+package twcc
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+)
+
+type arrival struct {
+	seqno uint16
+	time  int64
+}
+
+// feedback builds a feedback packet for consecutive packets, where an
+// arrival time of -1 means that the packet was lost.
+func feedback(arrivals []arrival) *rtcp.TransportLayerCC {
+	p := &rtcp.TransportLayerCC{
+		BaseSequenceNumber: arrivals[0].seqno,
+		PacketStatusCount:  uint16(len(arrivals)),
+	}
+	var ref int64 = -1
+	var last int64
+	for _, a := range arrivals {
+		symbol := uint16(rtcp.TypeTCCPacketNotReceived)
+		if a.time >= 0 {
+			symbol = rtcp.TypeTCCPacketReceivedLargeDelta
+			if ref < 0 {
+				ref = a.time / 64000
+				last = ref * 64000
+				p.ReferenceTime = uint32(ref)
+			}
+			p.RecvDeltas = append(p.RecvDeltas, &rtcp.RecvDelta{
+				Type:  symbol,
+				Delta: a.time - last,
+			})
+			last = a.time
+		}
+		p.PacketChunks = append(p.PacketChunks, &rtcp.StatusVectorChunk{
+			SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit,
+			SymbolList: []uint16{symbol},
+		})
+	}
+	return p
+}
+
+func TestParse(t *testing.T) {
+	p := feedback([]arrival{
+		{65535, 100000}, {0, -1}, {1, 100250}, {2, 180000},
+	})
+	// merge the chunks into a single chunk, as a receiver would do
+	var symbols []uint16
+	for _, c := range p.PacketChunks {
+		symbols = append(symbols,
+			c.(*rtcp.StatusVectorChunk).SymbolList...)
+	}
+	for len(symbols) < 7 {
+		symbols = append(symbols, rtcp.TypeTCCPacketNotReceived)
+	}
+	p.PacketChunks = []rtcp.PacketStatusChunk{&rtcp.StatusVectorChunk{
+		Type:       rtcp.TypeTCCStatusVectorChunk,
+		SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit,
+		SymbolList: symbols,
+	}}
+	p.Header = rtcp.Header{
+		Count:  rtcp.FormatTCC,
+		Type:   rtcp.TypeTransportSpecificFeedback,
+		Length: p.Len()/4 - 1,
+	}
+	buf, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var q rtcp.TransportLayerCC
+	err = q.Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	results := parse(&q)
+	expected := []result{
+		{65535, true, 100000}, {0, false, 0},
+		{1, true, 100250}, {2, true, 180000},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, results)
+	}
+	for i := range results {
+		if results[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], results[i])
+		}
+	}
+}
+
+// simulate sends at the given rate over a bottleneck with the given
+// capacity for the given number of seconds, and returns the estimate.
+func simulate(e *Estimator, rate, capacity uint64, seconds int) uint64 {
+	const size = 1200
+	interval := uint64(size * 8 * 1000000 / rate)
+	transmit := int64(size * 8 * 1000000 / capacity)
+
+	var now, nextFeedback uint64
+	var free int64
+	var arrivals []arrival
+	for now < uint64(seconds)*1000000 {
+		seqno := e.Send(size, now)
+		start := int64(now) + 20000
+		if start < free {
+			start = free
+		}
+		free = start + transmit
+		arrivals = append(arrivals, arrival{seqno, free})
+
+		now += interval
+		if now >= nextFeedback {
+			e.Feedback(feedback(arrivals), now)
+			arrivals = arrivals[:0]
+			nextFeedback = now + 100000
+		}
+	}
+	r, _ := e.Estimate()
+	return r
+}
+
+func TestEstimatorUncongested(t *testing.T) {
+	e := New()
+	if _, ok := e.Estimate(); ok {
+		t.Errorf("Got estimate without feedback")
+	}
+	r := simulate(e, 1500*1000, 10*1000*1000, 10)
+	if r < 1500*1000 {
+		t.Errorf("Expected at least 1.5Mbit/s, got %v", r)
+	}
+}
+
+func TestEstimatorCongested(t *testing.T) {
+	e := New()
+	r := simulate(e, 2000*1000, 1000*1000, 10)
+	if r > 1000*1000 {
+		t.Errorf("Expected at most 1Mbit/s, got %v", r)
+	}
+	if r < 500*1000 {
+		t.Errorf("Expected at least 500kbit/s, got %v", r)
+	}
+}
+
+func TestEstimatorLost(t *testing.T) {
+	e := New()
+	seqno := e.Send(1200, 0)
+	e.Feedback(feedback([]arrival{{seqno, -1}}), 1000)
+	if r, ok := e.Estimate(); !ok || r != initRate {
+		t.Errorf("Got %v %v", r, ok)
+	}
+
+	// feedback about packets we didn't send is ignored
+	e = New()
+	e.Feedback(feedback([]arrival{{42, 1000}}), 1000)
+	if _, ok := e.Estimate(); ok {
+		t.Errorf("Got estimate for unknown packet")
+	}
+}
@@ -0,0 +1,110 @@
+package upload
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+const defaultRegion = "us-east-1"
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 signs a request using AWS Signature Version 4, signing all the
+// headers of the request.  The request must not have a query, and
+// payload is the hex-encoded SHA-256 of the body.
+func signV4(req *http.Request, payload, region, keyId, secret string, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	names := []string{"host"}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	request := strings.Join([]string{
+		req.Method, uri, "", canonical.String(), signed, payload,
+	}, "\n")
+	hash := sha256.Sum256([]byte(request))
+
+	scope := date[:8] + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" +
+		hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), date[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, "+
+			"SignedHeaders=%v, Signature=%v",
+		keyId, scope, signed, signature,
+	))
+}
+
+func fileSHA256(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func putS3(c *group.Upload, filename, key string) error {
+	u, err := remoteURL(c.URL, key)
+	if err != nil {
+		return err
+	}
+	payload, err := fileSHA256(filename)
+	if err != nil {
+		return err
+	}
+	region := c.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	return put(u, filename, func(req *http.Request) error {
+		signV4(req, payload, region,
+			c.AccessKeyId, c.SecretAccessKey, time.Now())
+		return nil
+	})
+}
@@ -0,0 +1,301 @@
+// Package upload copies recordings to remote storage once they are
+// complete, either to an S3-compatible bucket, to a WebDAV server or by
+// running an external command, and then removes the local copy.
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
+)
+
+var logger = logging.New("upload")
+
+const (
+	// the number of files waiting to be uploaded
+	queueLength = 1024
+	// the number of attempts before giving up on a file
+	attempts = 3
+	// the maximum duration of a single attempt
+	timeout = time.Hour
+)
+
+var retryDelay = time.Minute
+
+var httpClient = &http.Client{Timeout: timeout}
+
+var uploader struct {
+	mu     sync.Mutex
+	config *group.Upload
+	queue  chan string
+}
+
+// Check checks a configuration.
+func Check(c *group.Upload) error {
+	switch c.Type {
+	case "command":
+		if len(c.Command) == 0 || c.Command[0] == "" {
+			return errors.New("no command")
+		}
+		return nil
+	case "s3", "webdav":
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.New("url must be an HTTP URL")
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return errors.New("url must not have a query")
+		}
+		if c.Type == "s3" &&
+			(c.AccessKeyId == "" || c.SecretAccessKey == "") {
+			return errors.New("no S3 credentials")
+		}
+		return nil
+	case "":
+		return errors.New("no type")
+	default:
+		return errors.New("unknown type " + c.Type)
+	}
+}
+
+// Configure sets the configuration used for the files that are uploaded
+// from now on.  If c is nil, files are no longer uploaded.
+func Configure(c *group.Upload) error {
+	if c != nil {
+		err := Check(c)
+		if err != nil {
+			return err
+		}
+		config := *c
+		c = &config
+	}
+
+	uploader.mu.Lock()
+	defer uploader.mu.Unlock()
+	uploader.config = c
+	if c != nil && uploader.queue == nil {
+		uploader.queue = make(chan string, queueLength)
+		go run(uploader.queue)
+	}
+	return nil
+}
+
+func getConfig() *group.Upload {
+	uploader.mu.Lock()
+	defer uploader.mu.Unlock()
+	return uploader.config
+}
+
+// File schedules the upload of a recording file.  It does nothing if
+// uploads are not configured, and never blocks.
+func File(filename string) {
+	uploader.mu.Lock()
+	defer uploader.mu.Unlock()
+	if uploader.config == nil {
+		return
+	}
+	select {
+	case uploader.queue <- filename:
+	default:
+		logger.Warnf("Upload queue full, not uploading %v", filename)
+	}
+}
+
+func run(queue <-chan string) {
+	for filename := range queue {
+		c := getConfig()
+		if c == nil {
+			continue
+		}
+		process(c, filename)
+	}
+}
+
+// key returns the name of a file relative to the recordings directory,
+// which is used as the remote name of the file.
+func key(filename string) string {
+	rel, err := filepath.Rel(diskwriter.Directory, filename)
+	if err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(filename)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// process uploads a file, retrying on failure, and removes it unless
+// configured otherwise.
+func process(c *group.Upload, filename string) {
+	k := key(filename)
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(retryDelay << (i - 1))
+		}
+		err = uploadFile(c, filename, k)
+		if err == nil {
+			break
+		}
+		logger.Warnf("Upload %v: %v", k, err)
+	}
+	if err != nil {
+		message := fmt.Sprintf(
+			"Couldn't upload recording %v, keeping local copy", k,
+		)
+		logger.Errorf("%v", message)
+		if g := group.Get(path.Dir(k)); g != nil {
+			g.WallOps(message)
+		}
+		return
+	}
+
+	logger.Infof("Uploaded %v", k)
+	if !c.Keep {
+		err := os.Remove(filename)
+		if err != nil {
+			logger.Warnf("Remove %v: %v", filename, err)
+		}
+	}
+}
+
+func uploadFile(c *group.Upload, filename, key string) error {
+	switch c.Type {
+	case "command":
+		return runCommand(c, filename)
+	case "s3":
+		return putS3(c, filename, key)
+	case "webdav":
+		return putWebDAV(c, filename, key)
+	default:
+		return errors.New("unknown type " + c.Type)
+	}
+}
+
+func runCommand(c *group.Upload, filename string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := append(append([]string(nil), c.Command[1:]...), filename)
+	output, err := exec.CommandContext(ctx, c.Command[0], args...).
+		CombinedOutput()
+	if err != nil {
+		if len(output) > 0 {
+			return fmt.Errorf("%w: %v",
+				err, strings.TrimSpace(string(output)))
+		}
+		return err
+	}
+	return nil
+}
+
+// escapeKey escapes a key for use in an URL path, in the way expected
+// by AWS Signature Version 4.
+func escapeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' ||
+			c >= '0' && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func remoteURL(base, key string) (*url.URL, error) {
+	return url.Parse(strings.TrimSuffix(base, "/") + "/" + escapeKey(key))
+}
+
+// put uploads a file with a PUT request.  If prepare is not nil, it is
+// called on the request before it is sent.
+func put(u *url.URL, filename string, prepare func(*http.Request) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", u.String(), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	if fi.Size() == 0 {
+		// an empty body would otherwise be sent chunked
+		req.Body = http.NoBody
+	}
+	if prepare != nil {
+		err := prepare(req)
+		if err != nil {
+			return err
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+func putWebDAV(c *group.Upload, filename, key string) error {
+	auth := func(req *http.Request) error {
+		if c.Username != "" || c.Password != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+		return nil
+	}
+
+	// create the parent collections, which fails harmlessly if they
+	// already exist
+	dirs := strings.Split(key, "/")
+	for i := 1; i < len(dirs); i++ {
+		u, err := remoteURL(c.URL, strings.Join(dirs[:i], "/")+"/")
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("MKCOL", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		auth(req)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated &&
+			resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("MKCOL %v: %v", u.Path, resp.Status)
+		}
+	}
+
+	u, err := remoteURL(c.URL, key)
+	if err != nil {
+		return err
+	}
+	return put(u, filename, auth)
+}
@@ -0,0 +1,317 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtpconn"
+)
+
+// The administrative API.  Since group names may contain slashes, the
+// components of a path that are not names start with a dot, which is
+// not allowed at the start of a group name.
+const apiPrefix = "/galene-api/v0/"
+
+type apiClient struct {
+	Id          string   `json:"id"`
+	Username    string   `json:"username,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+type apiGroup struct {
+	Name        string      `json:"name"`
+	Locked      bool        `json:"locked,omitempty"`
+	LockMessage string      `json:"lockMessage,omitempty"`
+	Recording   bool        `json:"recording,omitempty"`
+	ClientCount int         `json:"clientCount"`
+	Clients     []apiClient `json:"clients,omitempty"`
+}
+
+func describeGroup(g *group.Group, withClients bool) apiGroup {
+	d := apiGroup{Name: g.Name()}
+	d.Locked, d.LockMessage = g.Locked()
+	for _, c := range g.GetClients(nil) {
+		if _, ok := c.(*diskwriter.Client); ok {
+			d.Recording = true
+			continue
+		}
+		if member("system", c.Permissions()) {
+			continue
+		}
+		d.ClientCount++
+		if withClients {
+			perms := c.Permissions()
+			if perms == nil {
+				perms = []string{}
+			}
+			d.Clients = append(d.Clients, apiClient{
+				Id:          c.Id(),
+				Username:    c.Username(),
+				Permissions: perms,
+			})
+		}
+	}
+	return d
+}
+
+func member(v string, l []string) bool {
+	for _, w := range l {
+		if v == w {
+			return true
+		}
+	}
+	return false
+}
+
+// splitAPIPath splits the path of a request below /.groups/ into a group
+// name and the remaining components.
+func splitAPIPath(p string) (string, []string) {
+	if i := strings.Index(p, "/."); i >= 0 {
+		return p[:i], strings.Split(p[i+1:], "/")
+	}
+	return strings.TrimSuffix(p, "/"), nil
+}
+
+func apiError(w http.ResponseWriter, err error) {
+	var code int
+	if os.IsNotExist(err) {
+		code = http.StatusNotFound
+	} else if errors.Is(err, errMethodNotAllowed) {
+		code = http.StatusMethodNotAllowed
+	} else if _, ok := err.(group.UserError); ok {
+		code = http.StatusConflict
+	} else if errors.Is(err, errBadRequest) {
+		code = http.StatusBadRequest
+	} else {
+		logger.Warnf("API: %v", err)
+		code = http.StatusInternalServerError
+	}
+	http.Error(w, err.Error(), code)
+}
+
+var errMethodNotAllowed = errors.New("method not allowed")
+var errBadRequest = errors.New("bad request")
+
+func apiJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-cache")
+	if r.Method == "HEAD" {
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiBody decodes the optional JSON body of a request.
+func apiBody(r *http.Request, v interface{}) error {
+	d := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	err := d.Decode(v)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return nil
+}
+
+// sameOrigin returns false if the request was made by a script running
+// on a different site, which could otherwise use credentials cached by
+// the browser.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := checkAdmin(w, r, "galene-api")
+	if !ok {
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" && !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	if p == ".groups" || p == ".groups/" {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			apiError(w, errMethodNotAllowed)
+			return
+		}
+		groups := []apiGroup{}
+		group.Range(func(g *group.Group) bool {
+			groups = append(groups, describeGroup(g, false))
+			return true
+		})
+		sort.Slice(groups, func(i, j int) bool {
+			return groups[i].Name < groups[j].Name
+		})
+		apiJSON(w, r, groups)
+		return
+	}
+
+	if p == ".events" {
+		apiEvents(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(p, ".groups/") {
+		apiError(w, os.ErrNotExist)
+		return
+	}
+	name, rest := splitAPIPath(strings.TrimPrefix(p, ".groups/"))
+	if len(rest) == 1 && rest[0] == ".description" {
+		err := apiDescriptionRequest(w, r, name)
+		if err != nil {
+			apiError(w, err)
+		}
+		return
+	}
+
+	g := group.Get(name)
+	if g == nil {
+		apiError(w, os.ErrNotExist)
+		return
+	}
+
+	err := apiGroupRequest(w, r, g, rest, username)
+	if err != nil {
+		apiError(w, err)
+	}
+}
+
+func apiGroupRequest(w http.ResponseWriter, r *http.Request, g *group.Group, rest []string, username string) error {
+	method := func(methods ...string) error {
+		if !member(r.Method, methods) {
+			return errMethodNotAllowed
+		}
+		return nil
+	}
+
+	switch {
+	case len(rest) == 0:
+		if err := method("GET", "HEAD"); err != nil {
+			return err
+		}
+		apiJSON(w, r, describeGroup(g, true))
+		return nil
+	case len(rest) == 1 && rest[0] == ".lock":
+		if err := method("PUT", "DELETE"); err != nil {
+			return err
+		}
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := apiBody(r, &body); err != nil {
+			return err
+		}
+		g.SetLocked(r.Method == "PUT", body.Message)
+	case len(rest) == 1 && rest[0] == ".recording":
+		if err := method("PUT", "DELETE"); err != nil {
+			return err
+		}
+		if r.Method == "DELETE" {
+			if !rtpconn.StopRecording(g, username) {
+				return os.ErrNotExist
+			}
+			break
+		}
+		var body struct {
+			Mixed  bool   `json:"mixed"`
+			Format string `json:"format"`
+		}
+		if err := apiBody(r, &body); err != nil {
+			return err
+		}
+		err := rtpconn.StartRecording(
+			g, body.Mixed, body.Format, username,
+		)
+		if err != nil {
+			return err
+		}
+	case len(rest) == 3 && rest[0] == ".clients" &&
+		(rest[2] == ".kick" || rest[2] == ".mute"):
+		if err := method("POST"); err != nil {
+			return err
+		}
+		c := g.GetClient(rest[1])
+		if c == nil {
+			return os.ErrNotExist
+		}
+		if rest[2] == ".mute" {
+			err := rtpconn.Mute(g, c.Id(), username)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := apiBody(r, &body); err != nil {
+			return err
+		}
+		err := rtpconn.Kick(g, c.Id(), username, body.Message)
+		if err != nil {
+			return err
+		}
+	default:
+		return os.ErrNotExist
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiDescriptionRequest handles requests for the definition of a group,
+// which need not be running.
+func apiDescriptionRequest(w http.ResponseWriter, r *http.Request, name string) error {
+	switch r.Method {
+	case "GET", "HEAD":
+		desc, err := group.OwnDescription(name)
+		if err != nil {
+			return err
+		}
+		apiJSON(w, r, desc)
+		return nil
+	case "PUT":
+		var desc group.Description
+		d := json.NewDecoder(io.LimitReader(r.Body, 1024*1024))
+		d.DisallowUnknownFields()
+		err := d.Decode(&desc)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		created, err := group.WriteDescription(name, &desc)
+		if err != nil {
+			return err
+		}
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return nil
+	case "DELETE":
+		err := group.DeleteDescription(name)
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return errMethodNotAllowed
+	}
+}
@@ -0,0 +1,330 @@
+package webserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/client"
+	"github.com/jech/galene/group"
+)
+
+func apiRequest(method, path, body string, auth bool) *httptest.ResponseRecorder {
+	var b io.Reader
+	if body != "" {
+		b = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, apiPrefix+path, b)
+	if auth {
+		r.SetBasicAuth("admin", "pw")
+	}
+	w := httptest.NewRecorder()
+	apiHandler(w, r)
+	return w
+}
+
+func TestSplitAPIPath(t *testing.T) {
+	tests := []struct {
+		path, name string
+		rest       []string
+	}{
+		{"test", "test", nil},
+		{"test/", "test", nil},
+		{"a/b/", "a/b", nil},
+		{"a/b/.lock", "a/b", []string{".lock"}},
+		{"test/.clients/x/.kick", "test", []string{".clients", "x", ".kick"}},
+	}
+	for _, test := range tests {
+		name, rest := splitAPIPath(test.path)
+		if name != test.name || strings.Join(rest, "/") !=
+			strings.Join(test.rest, "/") {
+			t.Errorf("%v: got %v %v", test.path, name, rest)
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	server := startServer(t)
+	err := os.WriteFile(
+		filepath.Join(group.DataDirectory, "config.json"),
+		[]byte(`{"admin": [{"username": "admin", "password": "pw"}]}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	muted := make(chan struct{}, 1)
+	bob, err := client.Connect(server.URL+"/group/test/", client.Config{
+		Username: "bob",
+		Handlers: client.Handlers{
+			UserMessage: func(m client.UserMessage) {
+				if m.Kind == "mute" && m.Privileged &&
+					m.Username == "admin" {
+					muted <- struct{}{}
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer bob.Close()
+
+	if w := apiRequest("GET", ".groups/", "", false); w.Code != http.StatusUnauthorized {
+		t.Errorf("No credentials: got %v", w.Code)
+	}
+
+	w := apiRequest("GET", ".groups/", "", true)
+	var groups []apiGroup
+	err = json.Unmarshal(w.Body.Bytes(), &groups)
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Groups: got %v %v", w.Code, err)
+	}
+	found := false
+	for _, g := range groups {
+		if g.Name == "test" {
+			found = g.ClientCount == 1
+		}
+	}
+	if !found {
+		t.Errorf("Groups: got %v", groups)
+	}
+
+	w = apiRequest("GET", ".groups/test/", "", true)
+	var desc apiGroup
+	err = json.Unmarshal(w.Body.Bytes(), &desc)
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Group: got %v %v", w.Code, err)
+	}
+	if len(desc.Clients) != 1 || desc.Clients[0].Id != bob.Id() ||
+		desc.Clients[0].Username != "bob" {
+		t.Errorf("Group: got %v", desc)
+	}
+
+	g := group.Get("test")
+	w = apiRequest("PUT", ".groups/test/.lock", `{"message": "closed"}`, true)
+	if locked, message := g.Locked(); w.Code != http.StatusNoContent ||
+		!locked || message != "closed" {
+		t.Errorf("Lock: got %v %v %v", w.Code, locked, message)
+	}
+	w = apiRequest("DELETE", ".groups/test/.lock", "", true)
+	if locked, _ := g.Locked(); w.Code != http.StatusNoContent || locked {
+		t.Errorf("Unlock: got %v %v", w.Code, locked)
+	}
+
+	w = apiRequest("DELETE", ".groups/test/.recording", "", true)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Stop recording: got %v", w.Code)
+	}
+
+	w = apiRequest("POST", ".groups/test/.clients/"+bob.Id()+"/.mute", "", true)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Mute: got %v", w.Code)
+	}
+	wait(t, muted, "mute")
+
+	w = apiRequest("POST", ".groups/test/.clients/"+bob.Id()+"/.kick",
+		`{"message": "bye"}`, true)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Kick: got %v", w.Code)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for g.GetClient(bob.Id()) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Client was not kicked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	failures := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", ".groups/nonexistent/", "", http.StatusNotFound},
+		{"GET", ".groups/test/.unknown", "", http.StatusNotFound},
+		{"GET", ".unknown/", "", http.StatusNotFound},
+		{"POST", ".groups/", "", http.StatusMethodNotAllowed},
+		{"GET", ".groups/test/.lock", "", http.StatusMethodNotAllowed},
+		{"PUT", ".groups/test/.lock", "{", http.StatusBadRequest},
+		{"POST", ".groups/test/.clients/nonexistent/.kick", "",
+			http.StatusNotFound},
+	}
+	for _, e := range failures {
+		w := apiRequest(e.method, e.path, e.body, true)
+		if w.Code != e.code {
+			t.Errorf("%v %v: got %v, expected %v",
+				e.method, e.path, w.Code, e.code)
+		}
+	}
+
+	r := httptest.NewRequest("PUT", apiPrefix+".groups/test/.lock", nil)
+	r.SetBasicAuth("admin", "pw")
+	r.Header.Set("Origin", "https://attacker.example.org")
+	w = httptest.NewRecorder()
+	apiHandler(w, r)
+	if locked, _ := g.Locked(); w.Code != http.StatusForbidden || locked {
+		t.Errorf("Cross-origin: got %v %v", w.Code, locked)
+	}
+}
+
+func TestAPIDescription(t *testing.T) {
+	server := startServer(t)
+	err := os.WriteFile(
+		filepath.Join(group.DataDirectory, "config.json"),
+		[]byte(`{"admin": [{"username": "admin", "password": "pw"}]}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	w := apiRequest("GET", ".groups/room/.description", "", true)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Get nonexistent: got %v", w.Code)
+	}
+
+	desc := `{"max-clients": 5, "presenter": [{"username": "bob", "password": "pw"}]}`
+	w = apiRequest("PUT", ".groups/room/.description", desc, true)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create: got %v %v", w.Code, w.Body.String())
+	}
+
+	bob, err := client.Connect(server.URL+"/group/room/", client.Config{
+		Username: "bob",
+		Password: "pw",
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer bob.Close()
+
+	w = apiRequest("PUT", ".groups/room/.description",
+		`{"max-clients": 10, "presenter": [{"username": "bob", "password": "pw"}]}`,
+		true,
+	)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Modify: got %v", w.Code)
+	}
+	if d := group.Get("room").Description(); d.MaxClients != 10 {
+		t.Errorf("Modify: got %v", d.MaxClients)
+	}
+
+	w = apiRequest("GET", ".groups/room/.description", "", true)
+	var d group.Description
+	err = json.Unmarshal(w.Body.Bytes(), &d)
+	if w.Code != http.StatusOK || err != nil || d.MaxClients != 10 {
+		t.Errorf("Get: got %v %v %v", w.Code, err, w.Body.String())
+	}
+
+	w = apiRequest("PUT", ".groups/room/.description", `{"unknown": 1}`, true)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unknown field: got %v", w.Code)
+	}
+
+	w = apiRequest("DELETE", ".groups/room/.description", "", true)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Delete: got %v", w.Code)
+	}
+	wait(t, bob.Done(), "kick")
+
+	w = apiRequest("DELETE", ".groups/room/.description", "", true)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Delete twice: got %v", w.Code)
+	}
+}
+
+func TestAPIEvents(t *testing.T) {
+	server := startServer(t)
+	err := os.WriteFile(
+		filepath.Join(group.DataDirectory, "config.json"),
+		[]byte(`{"admin": [{"username": "admin", "password": "pw"}]}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	events := httptest.NewServer(http.HandlerFunc(apiHandler))
+	defer events.Close()
+
+	w := apiRequest("POST", ".events", "", true)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %v", w.Code)
+	}
+
+	req, err := http.NewRequest("GET",
+		events.URL+apiPrefix+".events?group=test&events=user-join,error",
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.SetBasicAuth("admin", "pw")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("content-type") != "text/event-stream" {
+		t.Fatalf("Get: got %v %v",
+			resp.StatusCode, resp.Header.Get("content-type"))
+	}
+
+	// the stream is subscribed once the headers have been received
+	bob, err := client.Connect(server.URL+"/group/test/", client.Config{
+		Username: "bob",
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer bob.Close()
+	g := group.Get("test")
+	g.Notify("record", "op", "")
+	g.Notify("error", "", "disk full")
+
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("Stream closed, got %v", got)
+			}
+			if strings.HasPrefix(line, "event: ") {
+				got = append(got, strings.TrimPrefix(line, "event: "))
+			}
+			if strings.HasPrefix(line, "data: ") {
+				var e struct {
+					Group string `json:"group"`
+				}
+				err := json.Unmarshal(
+					[]byte(strings.TrimPrefix(line, "data: ")), &e,
+				)
+				if err != nil || e.Group != "test" {
+					t.Errorf("Data: got %v %v", line, err)
+				}
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timeout, got %v", got)
+		}
+	}
+	if got[0] != "user-join" || got[1] != "error" {
+		t.Errorf("Got %v", got)
+	}
+}
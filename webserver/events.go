@@ -0,0 +1,96 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/notify"
+)
+
+// the interval at which comments are sent on an idle event stream,
+// which prevents proxies from timing out the connection
+var eventsKeepalive = 30 * time.Second
+
+// eventsDone is closed when the server shuts down, which causes event
+// streams to terminate.
+var eventsDone = make(chan struct{})
+var eventsDoneOnce sync.Once
+
+func closeEventStreams() {
+	eventsDoneOnce.Do(func() {
+		close(eventsDone)
+	})
+}
+
+// apiEvents streams the events of all groups as server-sent events.  The
+// query parameters group and events restrict the stream to a single group
+// and to a comma-separated list of kinds of events.
+func apiEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, errMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiError(w, errors.New("streaming not supported"))
+		return
+	}
+
+	groupName := r.URL.Query().Get("group")
+	var kinds []string
+	if k := r.URL.Query().Get("events"); k != "" {
+		kinds = strings.Split(k, ",")
+	}
+
+	ch, unsubscribe := group.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	// disable buffering in nginx
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// tell the client how long to wait before reconnecting
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventsKeepalive)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case e := <-ch:
+			if groupName != "" && e.Group != groupName {
+				continue
+			}
+			if kinds != nil && !member(e.Kind, kinds) {
+				continue
+			}
+			var data []byte
+			data, err = json.Marshal(notify.NewEvent(e))
+			if err != nil {
+				logger.Warnf("Events: %v", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n",
+				e.Kind, data)
+		case <-ticker.C:
+			_, err = fmt.Fprintf(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-eventsDone:
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
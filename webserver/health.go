@@ -0,0 +1,148 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/turnserver"
+)
+
+const healthTimeout = 5 * time.Second
+
+// the time during which the results of the network checks are reused
+const networkCheckInterval = 5 * time.Second
+
+// checkICE checks that we are able to gather local ICE candidates, which
+// requires allocating UDP ports in the configured range.
+func checkICE() error {
+	api, err := group.APIFromNames(nil)
+	if err != nil {
+		return err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	_, err = pc.CreateDataChannel("health", nil)
+	if err != nil {
+		return err
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	err = pc.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(healthTimeout):
+		return errors.New("timeout while gathering candidates")
+	}
+	if !strings.Contains(pc.LocalDescription().SDP, "a=candidate:") {
+		return errors.New("no local candidates")
+	}
+	return nil
+}
+
+var networkCheck struct {
+	mu        sync.Mutex
+	time      time.Time
+	ice, turn string
+}
+
+// checkNetwork returns the results of checkICE and of the TURN check.
+// These allocate UDP ports and probe the TURN server, and the readiness
+// endpoint is not authenticated, so only one check runs at a time, and
+// its results are reused for a few seconds.
+func checkNetwork() (string, string) {
+	networkCheck.mu.Lock()
+	defer networkCheck.mu.Unlock()
+	if time.Since(networkCheck.time) >= networkCheckInterval {
+		networkCheck.ice = result(checkICE())
+		networkCheck.turn = result(turnserver.Check(healthTimeout))
+		networkCheck.time = time.Now()
+	}
+	return networkCheck.ice, networkCheck.turn
+}
+
+// checkGroups checks that the list of groups is not deadlocked.
+func checkGroups() error {
+	done := make(chan struct{})
+	go func() {
+		group.Range(func(g *group.Group) bool {
+			return true
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(healthTimeout):
+		return errors.New("timeout")
+	}
+}
+
+func healthReply(w http.ResponseWriter, r *http.Request, status map[string]string) {
+	code := http.StatusOK
+	for _, v := range status {
+		if v != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(code)
+	if r.Method == "HEAD" {
+		return
+	}
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		logger.Warnf("%v: %v", r.URL.Path, err)
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// healthzHandler is a liveness probe: it fails if the server should be
+// restarted.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	healthReply(w, r, map[string]string{
+		"groups": result(checkGroups()),
+	})
+}
+
+// readyzHandler is a readiness probe: it fails if the server is unable
+// to serve new clients.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ice, turn := checkNetwork()
+	status := map[string]string{
+		"groups":     result(checkGroups()),
+		"ice":        ice,
+		"turn":       turn,
+		"diskwriter": result(diskwriter.Check()),
+	}
+	select {
+	case <-group.Draining():
+		status["drain"] = "draining"
+	default:
+	}
+	healthReply(w, r, status)
+}
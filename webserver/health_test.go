@@ -0,0 +1,94 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/turnserver"
+)
+
+func readyz(t *testing.T) (int, map[string]string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	var status map[string]string
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return w.Code, status
+}
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	// don't use the results of another test
+	networkCheck.mu.Lock()
+	networkCheck.time = time.Time{}
+	networkCheck.mu.Unlock()
+
+	dir := diskwriter.Directory
+	diskwriter.Directory = t.TempDir()
+	defer func() {
+		diskwriter.Directory = dir
+	}()
+
+	address := turnserver.Address
+	turnserver.Address = "127.0.0.1:0"
+	defer func() {
+		turnserver.Stop()
+		turnserver.Address = address
+	}()
+	err := turnserver.Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	code, status := readyz(t)
+	if code != http.StatusOK || len(status) != 4 {
+		t.Errorf("Got %v %v", code, status)
+	}
+
+	// not a directory
+	f := filepath.Join(t.TempDir(), "file")
+	err = os.WriteFile(f, nil, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	diskwriter.Directory = f
+	code, status = readyz(t)
+	if code != http.StatusServiceUnavailable ||
+		status["diskwriter"] == "ok" || status["turn"] != "ok" {
+		t.Errorf("Got %v %v", code, status)
+	}
+}
+
+func TestReadyzCache(t *testing.T) {
+	networkCheck.mu.Lock()
+	networkCheck.time = time.Now()
+	networkCheck.ice = "cached"
+	networkCheck.turn = "ok"
+	networkCheck.mu.Unlock()
+	defer func() {
+		networkCheck.mu.Lock()
+		networkCheck.time = time.Time{}
+		networkCheck.mu.Unlock()
+	}()
+
+	_, status := readyz(t)
+	if status["ice"] != "cached" {
+		t.Errorf("Expected cached result, got %v", status)
+	}
+}
@@ -0,0 +1,176 @@
+package webserver
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/hls"
+)
+
+// parseHLSName parses the name of a part (prefix-msn.part.m4s), of
+// a segment (prefix-msn.m4s) or of an initialisation segment
+// (prefix-epoch.mp4).  The part number is -1 if absent.
+func parseHLSName(name, prefix, suffix string) (uint64, int, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return 0, 0, false
+	}
+	s := strings.Split(
+		name[len(prefix):len(name)-len(suffix)], ".",
+	)
+	if len(s) > 2 {
+		return 0, 0, false
+	}
+	n, err := strconv.ParseUint(s[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	p := -1
+	if len(s) == 2 {
+		v, err := strconv.ParseUint(s[1], 10, 16)
+		if err != nil {
+			return 0, 0, false
+		}
+		p = int(v)
+	}
+	return n, p, true
+}
+
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	pth, kind, rest := splitPath(r.URL.Path)
+	if kind != ".hls" {
+		http.Error(w, "Internal server error",
+			http.StatusInternalServerError)
+		return
+	}
+
+	name := parseGroupName("/group/", pth)
+	if name == "" {
+		notFound(w)
+		return
+	}
+
+	if rest == "" || rest == "/" {
+		u := url.URL{
+			Path:     pth + "/.hls/index.m3u8",
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	g, err := group.Add(name, nil)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	conf, err := group.GetConfiguration()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if conf.PublicServer {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+
+	// the token is propagated to the URIs in the playlist, since
+	// players don't carry authorisation headers across requests
+	query := ""
+	token := r.URL.Query().Get("token")
+	if token != "" {
+		query = "token=" + url.QueryEscape(token)
+	} else {
+		token = parseBearerToken(r.Header.Get("Authorization"))
+	}
+	username, password, _ := r.BasicAuth()
+	creds := group.ClientCredentials{
+		Username: &username,
+		Password: password,
+		Token:    token,
+	}
+	_, _, err = g.GetPermission(creds)
+	if err != nil {
+		failAuthentication(w, "hls")
+		return
+	}
+
+	c, err := hls.Get(g)
+	if err != nil {
+		hlsError(w, g, err)
+		return
+	}
+
+	var data []byte
+	ctype := "video/mp4"
+	file := rest[1:]
+	if file == "index.m3u8" {
+		q := r.URL.Query()
+		msn, p := int64(-1), -1
+		if v := q.Get("_HLS_msn"); v != "" {
+			m, err := strconv.ParseUint(v, 10, 63)
+			if err != nil {
+				http.Error(w, "bad _HLS_msn",
+					http.StatusBadRequest)
+				return
+			}
+			msn = int64(m)
+			if v := q.Get("_HLS_part"); v != "" {
+				pp, err := strconv.ParseUint(v, 10, 16)
+				if err != nil {
+					http.Error(w, "bad _HLS_part",
+						http.StatusBadRequest)
+					return
+				}
+				p = int(pp)
+			}
+		}
+		data, err = c.Playlist(r.Context(), query, msn, p)
+		ctype = "application/vnd.apple.mpegurl"
+	} else if epoch, p, ok := parseHLSName(file, "init-", ".mp4"); ok && p < 0 {
+		data, err = c.Init(epoch)
+	} else if msn, p, ok := parseHLSName(file, "seg-", ".m4s"); ok && p < 0 {
+		data, err = c.Media(r.Context(), msn, -1)
+	} else if msn, p, ok := parseHLSName(file, "part-", ".m4s"); ok && p >= 0 {
+		data, err = c.Media(r.Context(), msn, p)
+	} else {
+		notFound(w)
+		return
+	}
+	if err != nil {
+		hlsError(w, g, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(data)
+}
+
+func hlsError(w http.ResponseWriter, g *group.Group, err error) {
+	var unavailable hls.UnavailableError
+	if errors.Is(err, hls.ErrNotFound) {
+		notFound(w)
+	} else if errors.Is(err, hls.ErrBadRequest) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	} else if errors.As(err, &unavailable) ||
+		errors.Is(err, group.ErrMemoryExceeded) {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "HLS unavailable: "+err.Error(),
+			http.StatusServiceUnavailable)
+	} else {
+		logger.Warnf("HLS %v: %v", g.Name(), err)
+		httpError(w, err)
+	}
+}
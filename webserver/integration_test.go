@@ -0,0 +1,645 @@
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/client"
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtpconn"
+	"github.com/jech/galene/testsource"
+)
+
+// startServer starts a server with a single group "test", where "op" is
+// an operator with password "pw" and everyone else may present.
+func startServer(t *testing.T) *httptest.Server {
+	group.DataDirectory = t.TempDir()
+	group.Directory = t.TempDir()
+	// override any configuration left over by other tests
+	err := os.WriteFile(
+		filepath.Join(group.DataDirectory, "config.json"),
+		[]byte("{}"), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	err = os.WriteFile(
+		filepath.Join(group.Directory, "test.json"),
+		[]byte(`{
+			"op": [{"username": "op", "password": "pw"}],
+			"presenter": [{}]
+		}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/group/", groupHandler)
+	mux.HandleFunc("/ws", wsHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func wait(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timeout waiting for %v", what)
+	}
+}
+
+// newVideoTrack returns a VP8 track to be fed by sendVideo.
+func newVideoTrack(t *testing.T) *webrtc.TrackLocalStaticRTP {
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeVP8,
+			ClockRate: 90000,
+		}, "video", "stream",
+	)
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	return track
+}
+
+// sendVideo sends keyframes over track until done is closed.
+func sendVideo(track *webrtc.TrackLocalStaticRTP, done <-chan struct{}) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for seqno := uint16(0); ; seqno++ {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		// a VP8 keyframe header
+		track.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         true,
+				SequenceNumber: seqno,
+				Timestamp:      uint32(seqno) * 1800,
+			},
+			Payload: []byte{0x10, 0x10, 0, 0, 0x9d, 0x01, 0x2a},
+		})
+	}
+}
+
+func TestJoinFail(t *testing.T) {
+	server := startServer(t)
+	_, err := client.Connect(server.URL+"/group/test/", client.Config{
+		Username: "op",
+		Password: "wrong",
+	})
+	if err == nil {
+		t.Errorf("Joined with wrong password")
+	}
+	_, err = client.Connect(server.URL+"/group/nonexistent/",
+		client.Config{Username: "op", Password: "pw"},
+	)
+	if err == nil {
+		t.Errorf("Joined nonexistent group")
+	}
+}
+
+func TestChat(t *testing.T) {
+	server := startServer(t)
+	url := server.URL + "/group/test/"
+
+	op, err := client.Connect(url, client.Config{
+		Username: "op",
+		Password: "pw",
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer op.Close()
+	if p := op.Permissions(); len(p) == 0 || p[0] != "op" {
+		t.Errorf("Expected op, got %v", p)
+	}
+	if g := op.Group(); g != "test" {
+		t.Errorf("Expected test, got %v", g)
+	}
+
+	// groups persist across tests
+	err = op.GroupAction("clearchat", nil)
+	if err != nil {
+		t.Fatalf("GroupAction: %v", err)
+	}
+	err = op.Chat("", "", "first")
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+
+	chat := make(chan client.Chat, 10)
+	added := make(chan struct{}, 10)
+	deleted := make(chan struct{}, 10)
+	bob, err := client.Connect(url, client.Config{
+		Username: "bob",
+		Handlers: client.Handlers{
+			Chat: func(m client.Chat) {
+				chat <- m
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer bob.Close()
+
+	m := <-chat
+	if !m.History || m.Value != "first" || m.Username != "op" {
+		t.Errorf("Bad history %#v", m)
+	}
+
+	op2, err := client.Connect(url, client.Config{
+		Username: "op",
+		Password: "pw",
+		Handlers: client.Handlers{
+			User: func(e client.UserEvent) {
+				if e.Username != "bob" {
+					return
+				}
+				switch e.Kind {
+				case "add":
+					added <- struct{}{}
+				case "delete":
+					deleted <- struct{}{}
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer op2.Close()
+	wait(t, added, "user")
+	if _, ok := op2.Users()[bob.Id()]; !ok {
+		t.Errorf("Bob not in users")
+	}
+
+	err = op2.Chat(bob.Id(), "me", "waves")
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	m = <-chat
+	if m.History || m.Value != "waves" || m.Kind != "me" ||
+		m.Source != op2.Id() || m.Dest != bob.Id() || !m.Privileged {
+		t.Errorf("Bad chat %#v", m)
+	}
+
+	err = op2.UserAction("kick", bob.Id(), "bye")
+	if err != nil {
+		t.Fatalf("UserAction: %v", err)
+	}
+	wait(t, deleted, "kick")
+	wait(t, bob.Done(), "disconnection")
+
+	bob.Close()
+	err = bob.Chat("", "", "too late")
+	if err != client.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+// Errors caused by earlier messages are delivered before Ping returns.
+func TestPing(t *testing.T) {
+	server := startServer(t)
+	failed := make(chan string, 1)
+	bob, err := client.Connect(server.URL+"/group/test/", client.Config{
+		Username: "bob",
+		Handlers: client.Handlers{
+			UserMessage: func(m client.UserMessage) {
+				if m.Kind == "error" {
+					failed <- fmt.Sprint(m.Value)
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer bob.Close()
+
+	err = bob.GroupAction("lock", "")
+	if err != nil {
+		t.Fatalf("GroupAction: %v", err)
+	}
+	err = bob.Ping()
+	if err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	select {
+	case <-failed:
+	default:
+		t.Errorf("Error not delivered before pong")
+	}
+
+	bob.Close()
+	if err := bob.Ping(); err != client.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestMedia(t *testing.T) {
+	server := startServer(t)
+	url := server.URL + "/group/test/"
+
+	track := newVideoTrack(t)
+
+	sender, err := client.Connect(url, client.Config{Username: "sender"})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer sender.Close()
+
+	stream, err := sender.Publish("camera", track)
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go sendVideo(track, done)
+
+	offered := make(chan *client.RemoteStream, 1)
+	received := make(chan struct{}, 1)
+	closed := make(chan struct{}, 1)
+	receiver, err := client.Connect(url, client.Config{
+		Username: "receiver",
+		Handlers: client.Handlers{
+			Stream: func(s *client.RemoteStream) bool {
+				offered <- s
+				return true
+			},
+			Track: func(s *client.RemoteStream, track *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+				_, _, err := track.ReadRTP()
+				if err == nil {
+					received <- struct{}{}
+				}
+			},
+			StreamClosed: func(s *client.RemoteStream) {
+				closed <- struct{}{}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer receiver.Close()
+
+	err = receiver.Request(map[string][]string{"": {"audio", "video"}})
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+
+	var s *client.RemoteStream
+	select {
+	case s = <-offered:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timeout waiting for offer")
+	}
+	if s.Label != "camera" || s.Source != sender.Id() ||
+		s.Username != "sender" {
+		t.Errorf("Bad stream %#v", s)
+	}
+	wait(t, received, "media")
+
+	err = stream.Close()
+	if err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	wait(t, stream.Done(), "local stream")
+	wait(t, closed, "remote stream")
+}
+
+// In an echo group, clients receive their own media and nothing else.
+func TestEcho(t *testing.T) {
+	server := startServer(t)
+	err := os.WriteFile(
+		filepath.Join(group.Directory, "echo.json"),
+		[]byte(`{"presenter": [{}], "echo": true}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	url := server.URL + "/group/echo/"
+
+	other, err := client.Connect(url, client.Config{
+		Username: "other",
+		Handlers: client.Handlers{
+			Stream: func(s *client.RemoteStream) bool {
+				t.Errorf("Got stream from %v", s.Username)
+				return false
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer other.Close()
+	err = other.Request(map[string][]string{"": {"audio", "video"}})
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+
+	offered := make(chan *client.RemoteStream, 1)
+	received := make(chan struct{}, 1)
+	echoed := make(chan struct{}, 1)
+	bob, err := client.Connect(url, client.Config{
+		Username: "bob",
+		Handlers: client.Handlers{
+			Stream: func(s *client.RemoteStream) bool {
+				offered <- s
+				return true
+			},
+			Track: func(s *client.RemoteStream, track *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+				_, _, err := track.ReadRTP()
+				if err == nil {
+					select {
+					case received <- struct{}{}:
+					default:
+					}
+				}
+			},
+			UserMessage: func(m client.UserMessage) {
+				if m.Kind == "echo" {
+					select {
+					case echoed <- struct{}{}:
+					default:
+					}
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer bob.Close()
+	err = bob.Request(map[string][]string{"": {"audio", "video"}})
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+
+	track := newVideoTrack(t)
+	_, err = bob.Publish("camera", track)
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go sendVideo(track, done)
+
+	var s *client.RemoteStream
+	select {
+	case s = <-offered:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timeout waiting for offer")
+	}
+	if s.Label != "camera" || s.Source != bob.Id() {
+		t.Errorf("Bad stream %#v", s)
+	}
+	wait(t, received, "media")
+	wait(t, echoed, "statistics")
+
+	err = bob.Ping()
+	if err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if _, ok := bob.Users()[other.Id()]; ok {
+		t.Errorf("Bob sees other")
+	}
+	if _, ok := other.Users()[bob.Id()]; ok {
+		t.Errorf("Other sees bob")
+	}
+}
+
+func TestTestSource(t *testing.T) {
+	server := startServer(t)
+	err := os.WriteFile(
+		filepath.Join(group.Directory, "card.json"),
+		[]byte(`{
+			"op": [{"username": "op", "password": "pw"}],
+			"codecs": ["vp8", "h264", "opus", "pcmu"]
+		}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	start, stop := rtpconn.StartTestSource, rtpconn.StopTestSource
+	rtpconn.StartTestSource = testsource.Start
+	rtpconn.StopTestSource = testsource.Stop
+	defer func() {
+		rtpconn.StartTestSource = start
+		rtpconn.StopTestSource = stop
+	}()
+
+	offered := make(chan *client.RemoteStream, 1)
+	received := make(chan string, 10)
+	closed := make(chan struct{}, 1)
+	op, err := client.Connect(server.URL+"/group/card/", client.Config{
+		Username: "op",
+		Password: "pw",
+		Handlers: client.Handlers{
+			Stream: func(s *client.RemoteStream) bool {
+				offered <- s
+				return true
+			},
+			Track: func(s *client.RemoteStream, track *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+				_, _, err := track.ReadRTP()
+				if err == nil {
+					received <- track.Kind().String()
+				}
+			},
+			StreamClosed: func(s *client.RemoteStream) {
+				closed <- struct{}{}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer op.Close()
+	err = op.Request(map[string][]string{"": {"audio", "video"}})
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+
+	err = op.GroupAction("testsource", nil)
+	if err != nil {
+		t.Fatalf("GroupAction: %v", err)
+	}
+
+	var s *client.RemoteStream
+	select {
+	case s = <-offered:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timeout waiting for offer")
+	}
+	if s.Username != "Test source" {
+		t.Errorf("Bad stream %#v", s)
+	}
+	kinds := make(map[string]bool)
+	for !kinds["audio"] || !kinds["video"] {
+		select {
+		case k := <-received:
+			kinds[k] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timeout waiting for media, got %v", kinds)
+		}
+	}
+
+	err = op.GroupAction("untestsource", nil)
+	if err != nil {
+		t.Fatalf("GroupAction: %v", err)
+	}
+	wait(t, closed, "stream closed")
+}
+
+func TestRecordMP4(t *testing.T) {
+	server := startServer(t)
+	err := os.WriteFile(
+		filepath.Join(group.Directory, "mp4.json"),
+		[]byte(`{
+			"op": [{"username": "op", "password": "pw"}],
+			"allow-recording": true,
+			"recording-format": "mp4",
+			"codecs": ["h264", "opus"]
+		}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	diskwriter.Directory = t.TempDir()
+	start, stop := rtpconn.StartTestSource, rtpconn.StopTestSource
+	rtpconn.StartTestSource = testsource.Start
+	rtpconn.StopTestSource = testsource.Stop
+	defer func() {
+		rtpconn.StartTestSource = start
+		rtpconn.StopTestSource = stop
+	}()
+
+	op, err := client.Connect(server.URL+"/group/mp4/", client.Config{
+		Username: "op",
+		Password: "pw",
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer op.Close()
+
+	err = op.GroupAction("testsource", nil)
+	if err != nil {
+		t.Fatalf("GroupAction: %v", err)
+	}
+	defer op.GroupAction("untestsource", nil)
+	err = op.GroupAction("record", nil)
+	if err != nil {
+		t.Fatalf("GroupAction: %v", err)
+	}
+	time.Sleep(2 * time.Second)
+	err = op.GroupAction("unrecord", nil)
+	if err != nil {
+		t.Fatalf("GroupAction: %v", err)
+	}
+
+	// the recording is written asynchronously
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		files, _ := filepath.Glob(
+			filepath.Join(diskwriter.Directory, "mp4", "*.mp4"),
+		)
+		if len(files) > 0 {
+			data, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if bytes.Contains(data, []byte("moof")) {
+				if !bytes.Equal(data[4:8], []byte("ftyp")) ||
+					!bytes.Contains(data, []byte("avcC")) {
+					t.Errorf("Bad MP4 file")
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for recording, got %v", files)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	server := startServer(t)
+	err := os.WriteFile(
+		filepath.Join(group.DataDirectory, "config.json"),
+		[]byte(`{"cluster": {
+			"self": "`+server.URL+`",
+			"instances": ["`+server.URL+`", "http://other.example.org"]
+		}}`), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var name string
+	for i := 0; name == ""; i++ {
+		if group.OwnerURL(fmt.Sprintf("g%v", i)) != "" {
+			name = fmt.Sprintf("g%v", i)
+		}
+	}
+	if group.OwnerURL("test") != "" {
+		t.Skip("test is not served locally")
+	}
+
+	hc := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := hc.Get(server.URL + "/group/" + name + "/.status?x=1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	location := "http://other.example.org/group/" + name + "/.status?x=1"
+	if resp.StatusCode != http.StatusTemporaryRedirect ||
+		resp.Header.Get("Location") != location {
+		t.Errorf("Got %v %v", resp.StatusCode,
+			resp.Header.Get("Location"))
+	}
+
+	c, err := client.Connect(server.URL+"/group/test/", client.Config{
+		Username: "op",
+		Password: "pw",
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+	c.Leave()
+	err = c.Join(name)
+	var redirect *client.RedirectError
+	if !errors.As(err, &redirect) ||
+		redirect.URL != "http://other.example.org/group/"+name+"/" {
+		t.Errorf("Join: %v", err)
+	}
+}
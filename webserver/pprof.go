@@ -0,0 +1,146 @@
+package webserver
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+// We don't use net/http/pprof, since it registers unauthenticated
+// handlers with the default mux, which we use.
+
+const maxProfileDuration = 5 * time.Minute
+
+func pprofEnabled() bool {
+	conf, err := group.GetConfiguration()
+	return err == nil && conf.Pprof
+}
+
+// profileDuration parses the parameter "seconds" of a request.
+func profileDuration(r *http.Request, def time.Duration) (time.Duration, error) {
+	s := r.URL.Query().Get("seconds")
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad duration %v", s)
+	}
+	d := time.Duration(n * float64(time.Second))
+	if d > maxProfileDuration {
+		d = maxProfileDuration
+	}
+	return d, nil
+}
+
+// sleep waits for d, or until the client goes away.
+func sleep(r *http.Request, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	if !pprofEnabled() {
+		notFound(w)
+		return
+	}
+	if _, ok := checkAdmin(w, r, "pprof"); !ok {
+		return
+	}
+
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-content-type-options", "nosniff")
+
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	switch name {
+	case "":
+		pprofIndex(w)
+	case "profile":
+		d, err := profileDuration(r, 30*time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("content-type", "application/octet-stream")
+		w.Header().Set("content-disposition",
+			`attachment; filename="profile"`)
+		err = pprof.StartCPUProfile(w)
+		if err != nil {
+			w.Header().Del("content-disposition")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		sleep(r, d)
+		pprof.StopCPUProfile()
+	case "trace":
+		d, err := profileDuration(r, time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("content-type", "application/octet-stream")
+		w.Header().Set("content-disposition",
+			`attachment; filename="trace"`)
+		err = trace.Start(w)
+		if err != nil {
+			w.Header().Del("content-disposition")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		sleep(r, d)
+		trace.Stop()
+	default:
+		p := pprof.Lookup(name)
+		if p == nil {
+			notFound(w)
+			return
+		}
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if name == "heap" && r.URL.Query().Get("gc") != "" {
+			runtime.GC()
+		}
+		if debug != 0 {
+			w.Header().Set("content-type",
+				"text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("content-type",
+				"application/octet-stream")
+			w.Header().Set("content-disposition",
+				fmt.Sprintf(`attachment; filename="%v"`, name))
+		}
+		if r.Method == "HEAD" {
+			return
+		}
+		err := p.WriteTo(w, debug)
+		if err != nil {
+			logger.Warnf("%v: %v", r.URL.Path, err)
+		}
+	}
+}
+
+func pprofIndex(w http.ResponseWriter) {
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<!DOCTYPE html>\n<title>Profiles</title>\n<ul>")
+	fmt.Fprintln(w, `<li><a href="profile?seconds=30">profile</a>`+
+		" (CPU, 30 seconds)")
+	fmt.Fprintln(w, `<li><a href="trace?seconds=1">trace</a>`+
+		" (execution trace, 1 second)")
+	for _, p := range pprof.Profiles() {
+		n := html.EscapeString(p.Name())
+		fmt.Fprintf(w, `<li><a href="%v?debug=1">%v</a> (%v)`+"\n",
+			n, n, p.Count())
+	}
+	fmt.Fprintln(w, "</ul>")
+}
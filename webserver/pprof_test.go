@@ -0,0 +1,88 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jech/galene/group"
+)
+
+func pprofGet(path string, auth bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	if auth {
+		r.SetBasicAuth("admin", "pw")
+	}
+	w := httptest.NewRecorder()
+	pprofHandler(w, r)
+	return w
+}
+
+func TestPprof(t *testing.T) {
+	dir := group.DataDirectory
+	group.DataDirectory = t.TempDir()
+	defer func() {
+		group.DataDirectory = dir
+	}()
+
+	config := func(pprof bool) {
+		t.Helper()
+		c := `{"admin": [{"username": "admin", "password": "pw"}]}`
+		if pprof {
+			c = `{"admin": [{"username": "admin", "password": "pw"}],
+			      "pprof": true}`
+		}
+		err := os.WriteFile(
+			filepath.Join(group.DataDirectory, "config.json"),
+			[]byte(c), 0600,
+		)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	config(false)
+	if w := pprofGet("/debug/pprof/", true); w.Code != http.StatusNotFound {
+		t.Errorf("Disabled: got %v", w.Code)
+	}
+
+	config(true)
+	if w := pprofGet("/debug/pprof/", false); w.Code != http.StatusUnauthorized {
+		t.Errorf("No credentials: got %v", w.Code)
+	}
+
+	w := pprofGet("/debug/pprof/", true)
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "goroutine") {
+		t.Errorf("Index: got %v %v", w.Code, w.Body.String())
+	}
+
+	w = pprofGet("/debug/pprof/goroutine?debug=1", true)
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "TestPprof") {
+		t.Errorf("Goroutine: got %v", w.Code)
+	}
+
+	w = pprofGet("/debug/pprof/heap?gc=1", true)
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("Heap: got %v", w.Code)
+	}
+
+	w = pprofGet("/debug/pprof/profile?seconds=0.1", true)
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("Profile: got %v %v", w.Code, w.Body.String())
+	}
+
+	w = pprofGet("/debug/pprof/profile?seconds=soon", true)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Bad duration: got %v", w.Code)
+	}
+
+	w = pprofGet("/debug/pprof/unknown", true)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unknown profile: got %v", w.Code)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"html"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
@@ -21,21 +20,83 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/quic-go/webtransport-go"
 
 	"github.com/jech/cert"
 	"github.com/jech/galene/diskwriter"
 	"github.com/jech/galene/group"
+	"github.com/jech/galene/logging"
 	"github.com/jech/galene/rtpconn"
 	"github.com/jech/galene/stats"
+	"github.com/jech/galene/systemd"
 )
 
+var logger = logging.New("webserver")
+
 var server atomic.Value
 
+// certificate holds the *cert.Certificate of the server.
+var certificate atomic.Value
+
 var StaticRoot string
 
 var Insecure bool
 
-func Serve(address string, dataDir string) error {
+// Listen returns the listener of the web server.  If Galene was
+// started by systemd with a socket named "http", then that socket is
+// used and address is ignored.
+func Listen(address string) (net.Listener, error) {
+	ls, pcs, err := systemd.Sockets("http")
+	if err != nil {
+		return nil, err
+	}
+	if len(ls) > 0 || len(pcs) > 0 {
+		for _, pc := range pcs {
+			pc.Close()
+		}
+		for _, l := range ls[1:] {
+			l.Close()
+		}
+		if len(ls) != 1 || len(pcs) != 0 {
+			return nil, errors.New(
+				"expected exactly one stream socket named http",
+			)
+		}
+		logger.Infof("Using socket %v passed by systemd", ls[0].Addr())
+		return ls[0], nil
+	}
+
+	proto := "tcp"
+	if strings.HasPrefix(address, "/") {
+		proto = "unix"
+	}
+	return net.Listen(proto, address)
+}
+
+// CheckCertificate returns an error if the server's certificate cannot
+// be loaded.
+func CheckCertificate(dataDir string) error {
+	if Insecure {
+		return nil
+	}
+	_, err := cert.New(
+		filepath.Join(dataDir, "cert.pem"),
+		filepath.Join(dataDir, "key.pem"),
+	).Get()
+	return err
+}
+
+// GetCertificate returns the certificate of the web server.  It is
+// suitable for use as the GetCertificate field of a tls.Config.
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c, ok := certificate.Load().(*cert.Certificate)
+	if !ok || c == nil {
+		return nil, errors.New("no certificate")
+	}
+	return c.Get()
+}
+
+func Serve(listener net.Listener, dataDir string) error {
 	http.Handle("/", &fileHandler{http.Dir(StaticRoot)})
 	http.HandleFunc("/group/", groupHandler)
 	http.HandleFunc("/recordings",
@@ -48,42 +109,58 @@ func Serve(address string, dataDir string) error {
 	http.HandleFunc("/public-groups.json", publicHandler)
 	http.HandleFunc("/stats.json",
 		func(w http.ResponseWriter, r *http.Request) {
-			statsHandler(w, r, dataDir)
+			statsHandler(w, r, func() interface{} {
+				return stats.GetGroups()
+			})
+		})
+	http.HandleFunc("/drain", drainHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/debug/pprof/", pprofHandler)
+	http.HandleFunc(apiPrefix, apiHandler)
+	http.HandleFunc("/server-stats.json",
+		func(w http.ResponseWriter, r *http.Request) {
+			statsHandler(w, r, func() interface{} {
+				return serverStats()
+			})
 		})
 
 	s := &http.Server{
-		Addr:              address,
+		Addr:              listener.Addr().String(),
 		ReadHeaderTimeout: 60 * time.Second,
 		IdleTimeout:       120 * time.Second,
 	}
 	if !Insecure {
-		certificate := cert.New(
+		certificate.Store(cert.New(
 			filepath.Join(dataDir, "cert.pem"),
 			filepath.Join(dataDir, "key.pem"),
-		)
+		))
 		s.TLSConfig = &tls.Config{
-			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-				return certificate.Get()
-			},
+			GetCertificate: GetCertificate,
 		}
 	}
 	s.RegisterOnShutdown(func() {
+		closeEventStreams()
 		group.Shutdown("server is shutting down")
 	})
 
 	server.Store(s)
 
-	proto := "tcp"
-	if strings.HasPrefix(address, "/") {
-		proto = "unix"
+	if WebTransport {
+		if Insecure {
+			logger.Warnf("WebTransport requires TLS, not enabled")
+		} else {
+			err := serveWebTransport(listener.Addr())
+			if err != nil {
+				logger.Warnf("WebTransport: %v", err)
+			}
+		}
 	}
 
-	listener, err := net.Listen(proto, address)
-	if err != nil {
-		return err
-	}
 	defer listener.Close()
 
+	var err error
 	if !Insecure {
 		err = s.ServeTLS(listener, "", "")
 	} else {
@@ -134,17 +211,21 @@ func httpError(w http.ResponseWriter, err error) {
 	}
 	var autherr *group.NotAuthorisedError
 	if errors.As(err, &autherr) {
-		log.Printf("HTTP server error: %v", err)
+		logger.Errorf("HTTP server error: %v", err)
 		http.Error(w, "not authorised", http.StatusUnauthorized)
 		return
 	}
+	if errors.Is(err, group.ErrDraining) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	var mberr *http.MaxBytesError
 	if errors.As(err, &mberr) {
 		http.Error(w, "Request body too large",
 			http.StatusRequestEntityTooLarge)
 		return
 	}
-	log.Printf("HTTP server error: %v", err)
+	logger.Errorf("HTTP server error: %v", err)
 	http.Error(w, "Internal server error",
 		http.StatusInternalServerError)
 }
@@ -322,6 +403,21 @@ func groupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	dir, kind, rest := splitPath(r.URL.Path)
+	if owner := group.OwnerURL(parseGroupName("/group/", dir)); owner != "" {
+		// served by a different instance of the cluster
+		u, err := url.Parse(owner)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if kind != "" {
+			u.Path = path.Join(u.Path, kind) + rest
+		}
+		u.RawQuery = r.URL.RawQuery
+		http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+		return
+	}
+
 	if kind == ".status" && rest == "" {
 		groupStatusHandler(w, r)
 		return
@@ -336,6 +432,9 @@ func groupHandler(w http.ResponseWriter, r *http.Request) {
 			whipResourceHandler(w, r)
 		}
 		return
+	} else if kind == ".hls" {
+		hlsHandler(w, r)
+		return
 	} else if kind != "" {
 		notFound(w)
 		return
@@ -424,12 +523,15 @@ func groupStatusHandler(w http.ResponseWriter, r *http.Request) {
 
 	base, err := baseURL(r)
 	if err != nil {
-		log.Printf("Parse ProxyURL: %v", err)
+		logger.Warnf("Parse ProxyURL: %v", err)
 		http.Error(w, "Internal server error",
 			http.StatusInternalServerError)
 		return
 	}
 	d := g.Status(false, base)
+	if d.Endpoint != "" {
+		d.WebTransportEndpoint = wtEndpoint(r)
+	}
 	w.Header().Set("content-type", "application/json")
 	w.Header().Set("cache-control", "no-cache")
 
@@ -444,7 +546,7 @@ func groupStatusHandler(w http.ResponseWriter, r *http.Request) {
 func publicHandler(w http.ResponseWriter, r *http.Request) {
 	base, err := baseURL(r)
 	if err != nil {
-		log.Printf("couldn't determine group base: %v", err)
+		logger.Warnf("couldn't determine group base: %v", err)
 		httpError(w, err)
 		return
 	}
@@ -482,18 +584,34 @@ func failAuthentication(w http.ResponseWriter, realm string) {
 	http.Error(w, "Haha!", http.StatusUnauthorized)
 }
 
-func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
+// checkAdmin checks that the request was made by an administrator, and
+// fails the request otherwise.
+func checkAdmin(w http.ResponseWriter, r *http.Request, realm string) (string, bool) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		failAuthentication(w, "stats")
-		return
+		failAuthentication(w, realm)
+		return "", false
 	}
 
 	if ok, err := adminMatch(username, password); !ok {
 		if err != nil {
-			log.Printf("Administrator password: %v", err)
+			logger.Warnf("Administrator password: %v", err)
 		}
-		failAuthentication(w, "stats")
+		failAuthentication(w, realm)
+		return "", false
+	}
+	return username, true
+}
+
+func serverStats() stats.Server {
+	return stats.Server{
+		CPU:    stats.CPUTime(),
+		Egress: rtpconn.GetEgressStats(),
+	}
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request, get func() interface{}) {
+	if _, ok := checkAdmin(w, r, "stats"); !ok {
 		return
 	}
 
@@ -503,11 +621,59 @@ func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
 		return
 	}
 
-	ss := stats.GetGroups()
 	e := json.NewEncoder(w)
-	err := e.Encode(ss)
+	err := e.Encode(get())
 	if err != nil {
-		log.Printf("stats.json: %v", err)
+		logger.Warnf("%v: %v", r.URL.Path, err)
+	}
+}
+
+// drainHandler causes the server to stop accepting new clients, and to
+// exit once the existing ones have left.
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, ok := checkAdmin(w, r, "drain")
+	if !ok {
+		return
+	}
+
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+
+	conf, err := group.GetConfiguration()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if group.Drain(conf.DrainMessage) {
+		logger.Infof("Drain requested by %v", username)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// metricsHandler exports statistics in the format expected by
+// Prometheus.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := checkAdmin(w, r, "stats"); !ok {
+		return
+	}
+
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	w.Header().Set("cache-control", "no-cache")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	err := stats.WritePrometheus(w, stats.GetGroups(), serverStats())
+	if err != nil {
+		logger.Warnf("%v: %v", r.URL.Path, err)
 	}
 }
 
@@ -535,13 +701,13 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Websocket upgrade: %v", err)
+		logger.Warnf("Websocket upgrade: %v", err)
 		return
 	}
 	go func() {
 		err := rtpconn.StartClient(conn)
 		if err != nil {
-			log.Printf("client: %v", err)
+			logger.Infof("client: %v", err)
 		}
 	}()
 }
@@ -773,4 +939,7 @@ func Shutdown() {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	s.Shutdown(ctx)
+	if v := wtServer.Load(); v != nil {
+		v.(*webtransport.Server).Close()
+	}
 }
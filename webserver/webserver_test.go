@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -209,3 +210,54 @@ func TestObfuscate(t *testing.T) {
 		t.Errorf("obfuscate: no errror")
 	}
 }
+
+func TestParseHLSName(t *testing.T) {
+	tests := []struct {
+		name, prefix, suffix string
+		n                    uint64
+		p                    int
+		ok                   bool
+	}{
+		{"init-3.mp4", "init-", ".mp4", 3, -1, true},
+		{"seg-12.m4s", "seg-", ".m4s", 12, -1, true},
+		{"part-12.3.m4s", "part-", ".m4s", 12, 3, true},
+		{"part-12.3.4.m4s", "part-", ".m4s", 0, 0, false},
+		{"part-.3.m4s", "part-", ".m4s", 0, 0, false},
+		{"seg-x.m4s", "seg-", ".m4s", 0, 0, false},
+		{"seg-12.mp4", "seg-", ".m4s", 0, 0, false},
+		{"part-1.-1.m4s", "part-", ".m4s", 0, 0, false},
+	}
+	for _, tt := range tests {
+		n, p, ok := parseHLSName(tt.name, tt.prefix, tt.suffix)
+		if ok != tt.ok || ok && (n != tt.n || p != tt.p) {
+			t.Errorf("%v: expected %v %v %v, got %v %v %v",
+				tt.name, tt.n, tt.p, tt.ok, n, p, ok)
+		}
+	}
+}
+
+func TestDrainCrossOrigin(t *testing.T) {
+	group.DataDirectory = t.TempDir()
+	err := os.WriteFile(
+		filepath.Join(group.DataDirectory, "config.json"),
+		[]byte(`{"admin": [{"username": "admin", "password": "pw"}]}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	r := httptest.NewRequest("POST", "/drain", nil)
+	r.SetBasicAuth("admin", "pw")
+	r.Header.Set("Origin", "https://attacker.example.org")
+	w := httptest.NewRecorder()
+	drainHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected %v, got %v", http.StatusForbidden, w.Code)
+	}
+	select {
+	case <-group.Draining():
+		t.Errorf("Server is draining")
+	default:
+	}
+}
@@ -0,0 +1,259 @@
+package webserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtpconn"
+)
+
+// This file implements the client protocol over WebTransport.  The
+// client opens a single bidirectional stream, which carries the same
+// messages as the WebSocket, each followed by a newline.
+
+// WebTransport indicates whether WebTransport is accepted over HTTP/3.
+var WebTransport bool
+
+// wtServer holds the *webtransport.Server, if any.
+var wtServer atomic.Value
+
+const wtPath = "/webtransport"
+
+// wtStream is the subset of webtransport.Stream used by wtConn.
+type wtStream interface {
+	io.ReadWriter
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// wtConn implements rtpconn.ClientConn over a WebTransport stream.
+type wtConn struct {
+	stream wtStream
+	reader *bufio.Reader
+	limit  int64
+	// closed when the session terminates
+	done <-chan struct{}
+	// closes the session with a WebSocket close code
+	close func(code int, text string) error
+}
+
+func newWTConn(stream wtStream, done <-chan struct{}, close func(int, string) error) *wtConn {
+	return &wtConn{
+		stream: stream,
+		reader: bufio.NewReader(stream),
+		done:   done,
+		close:  close,
+	}
+}
+
+func (c *wtConn) SetReadLimit(limit int64) {
+	c.limit = limit
+}
+
+func (c *wtConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *wtConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+var errWTMessageTooLarge = errors.New("message too large")
+
+// readLine returns the next non-empty line, without the newline.
+func (c *wtConn) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		data, err := c.reader.ReadSlice('\n')
+		line = append(line, data...)
+		if c.limit > 0 && int64(len(line)) > c.limit+1 {
+			return nil, errWTMessageTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+func (c *wtConn) ReadMessage() (int, []byte, error) {
+	data, err := c.readLine()
+	if err != nil {
+		select {
+		case <-c.done:
+			err = &websocket.CloseError{
+				Code: websocket.CloseNormalClosure,
+			}
+		default:
+			if err == io.EOF {
+				err = &websocket.CloseError{
+					Code: websocket.CloseNormalClosure,
+				}
+			}
+		}
+		return 0, nil, err
+	}
+	return websocket.TextMessage, data, nil
+}
+
+func (c *wtConn) write(data []byte) error {
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		data = append(data[:len(data):len(data)], '\n')
+	}
+	_, err := c.stream.Write(data)
+	return err
+}
+
+func (c *wtConn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case websocket.TextMessage:
+		return c.write(data)
+	case websocket.CloseMessage:
+		code := websocket.CloseNoStatusReceived
+		var text string
+		if len(data) >= 2 {
+			code = int(binary.BigEndian.Uint16(data))
+			text = string(data[2:])
+		}
+		return c.close(code, text)
+	default:
+		return errors.New("unsupported message type")
+	}
+}
+
+func (c *wtConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(data)
+}
+
+func (c *wtConn) Close() error {
+	return c.close(websocket.CloseNormalClosure, "")
+}
+
+var _ rtpconn.ClientConn = &wtConn{}
+
+func checkWTOrigin(r *http.Request) bool {
+	conf, err := group.GetConfiguration()
+	if err == nil && conf.PublicServer {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func wtHandler(w http.ResponseWriter, r *http.Request) {
+	v := wtServer.Load()
+	if v == nil {
+		http.Error(w, "WebTransport not available",
+			http.StatusNotFound)
+		return
+	}
+	s := v.(*webtransport.Server)
+
+	session, err := s.Upgrade(w, r)
+	if err != nil {
+		logger.Warnf("WebTransport upgrade: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	go func() {
+		ctx := session.Context()
+		stream, err := session.AcceptStream(ctx)
+		if err != nil {
+			session.CloseWithError(0, "")
+			return
+		}
+		conn := newWTConn(stream, ctx.Done(),
+			func(code int, text string) error {
+				return session.CloseWithError(
+					webtransport.SessionErrorCode(code), text,
+				)
+			},
+		)
+		err = rtpconn.StartClient(conn)
+		if err != nil {
+			logger.Infof("client: %v", err)
+		}
+	}()
+}
+
+// serveWebTransport accepts WebTransport sessions over HTTP/3 on the UDP
+// port with the same number as the web server's TCP port.
+func serveWebTransport(addr net.Addr) error {
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return errors.New("WebTransport requires a TCP listener")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   a.IP,
+		Port: a.Port,
+		Zone: a.Zone,
+	})
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(wtPath, wtHandler)
+	s := &webtransport.Server{
+		H3: http3.Server{
+			TLSConfig: &tls.Config{
+				GetCertificate: GetCertificate,
+			},
+			Handler: mux,
+		},
+		CheckOrigin: checkWTOrigin,
+	}
+	wtServer.Store(s)
+	go func() {
+		err := s.Serve(conn)
+		if err != nil && !errors.Is(err, net.ErrClosed) &&
+			err != http.ErrServerClosed {
+			logger.Errorf("WebTransport: %v", err)
+		}
+	}()
+	return nil
+}
+
+// wtEndpoint returns the URL of the WebTransport endpoint for a request,
+// or the empty string if WebTransport is not available.
+func wtEndpoint(r *http.Request) string {
+	if wtServer.Load() == nil || r.TLS == nil {
+		return ""
+	}
+	conf, err := group.GetConfiguration()
+	if err != nil || conf.ProxyURL != "" {
+		// HTTP/3 is not usually forwarded by reverse proxies
+		return ""
+	}
+	return "https://" + r.Host + wtPath
+}
@@ -0,0 +1,65 @@
+package webserver
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWTConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var code int
+	var text string
+	c := newWTConn(server, make(chan struct{}),
+		func(cd int, tx string) error {
+			code, text = cd, tx
+			return server.Close()
+		},
+	)
+	c.SetReadLimit(16)
+
+	go func() {
+		client.Write([]byte("\n{\"type\":\"ping\"}\r\n"))
+		client.Write([]byte("{\"type\":\"much-too-long\"}\n"))
+	}()
+
+	tp, data, err := c.ReadMessage()
+	if err != nil || tp != websocket.TextMessage ||
+		string(data) != `{"type":"ping"}` {
+		t.Errorf("ReadMessage: %v %q %v", tp, data, err)
+	}
+	_, _, err = c.ReadMessage()
+	if err != errWTMessageTooLarge {
+		t.Errorf("Expected message too large, got %v", err)
+	}
+
+	go func() {
+		c.WriteJSON(map[string]string{"type": "pong"})
+	}()
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || line != "{\"type\":\"pong\"}\n" {
+		t.Errorf("WriteJSON: %q %v", line, err)
+	}
+
+	err = c.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye"))
+	if err != nil || code != websocket.CloseGoingAway || text != "bye" {
+		t.Errorf("Close: %v %v %v", code, text, err)
+	}
+}
+
+func TestWTConnEOF(t *testing.T) {
+	client, server := net.Pipe()
+	c := newWTConn(server, make(chan struct{}),
+		func(int, string) error { return server.Close() },
+	)
+	client.Close()
+	_, _, err := c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected normal closure, got %v", err)
+	}
+}
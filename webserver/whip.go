@@ -9,7 +9,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
@@ -18,7 +17,6 @@ import (
 	"github.com/pion/webrtc/v3"
 
 	"github.com/jech/galene/group"
-	"github.com/jech/galene/ice"
 	"github.com/jech/galene/rtpconn"
 )
 
@@ -29,11 +27,11 @@ func init() {
 	idSecret = make([]byte, 16)
 	_, err := crand.Read(idSecret)
 	if err != nil {
-		log.Fatalf("crand.Read: %v", err)
+		logger.Fatalf("crand.Read: %v", err)
 	}
 	idCipher, err = aes.NewCipher(idSecret)
 	if err != nil {
-		log.Fatalf("NewCipher: %v", err)
+		logger.Fatalf("NewCipher: %v", err)
 	}
 }
 
@@ -126,8 +124,8 @@ func formatICEServer(server webrtc.ICEServer, u string) string {
 	return ""
 }
 
-func whipICEServers(w http.ResponseWriter) {
-	conf := ice.ICEConfiguration()
+func whipICEServers(w http.ResponseWriter, g *group.Group) {
+	conf := g.ICEConfiguration()
 	for _, server := range conf.ICEServers {
 		for _, u := range server.URLs {
 			v := formatICEServer(server, u)
@@ -180,7 +178,7 @@ func whipEndpointHandler(w http.ResponseWriter, r *http.Request) {
 			"Authorization, Content-Type",
 		)
 		w.Header().Set("Access-Control-Expose-Headers", "Link")
-		whipICEServers(w)
+		whipICEServers(w, g)
 		return
 	}
 
@@ -203,9 +201,12 @@ func whipEndpointHandler(w http.ResponseWriter, r *http.Request) {
 
 	token := parseBearerToken(r.Header.Get("Authorization"))
 
-	whip := "whip"
+	username := r.URL.Query().Get("name")
+	if username == "" {
+		username = "whip"
+	}
 	creds := group.ClientCredentials{
-		Username: &whip,
+		Username: &username,
 		Token:    token,
 	}
 
@@ -220,7 +221,7 @@ func whipEndpointHandler(w http.ResponseWriter, r *http.Request) {
 
 	_, err = group.AddClient(g.Name(), c, creds)
 	if err != nil {
-		log.Printf("WHIP: %v", err)
+		logger.Warnf("WHIP: %v", err)
 		httpError(w, err)
 		return
 	}
@@ -234,7 +235,7 @@ func whipEndpointHandler(w http.ResponseWriter, r *http.Request) {
 	answer, err := c.NewConnection(r.Context(), body)
 	if err != nil {
 		group.DelClient(c)
-		log.Printf("WHIP offer: %v", err)
+		logger.Warnf("WHIP offer: %v", err)
 		httpError(w, err)
 		return
 	}
@@ -242,7 +243,7 @@ func whipEndpointHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Location", path.Join(r.URL.Path, obfuscated))
 	w.Header().Set("Access-Control-Expose-Headers",
 		"Location, Content-Type, Link")
-	whipICEServers(w)
+	whipICEServers(w, g)
 	w.Header().Set("Content-Type", "application/sdp")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(answer)
@@ -374,7 +375,7 @@ func whipResourceHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			err := c.GotICECandidate(init)
 			if err != nil {
-				log.Printf("WHIP candidate: %v", err)
+				logger.Warnf("WHIP candidate: %v", err)
 			}
 		}
 	}